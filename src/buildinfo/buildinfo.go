@@ -0,0 +1,54 @@
+// Package buildinfo identifies the build of the proxy. Its variables are
+// set at build time with
+//
+//	-ldflags "-X ecs-svc-proxy/src/buildinfo.Version=v1.2.3
+//	          -X ecs-svc-proxy/src/buildinfo.Commit=$(git rev-parse HEAD)
+//	          -X ecs-svc-proxy/src/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	// Version is the release the binary was built from.
+	Version = "dev"
+	// Commit is the git commit the binary was built from. It defaults to
+	// the revision the Go toolchain stamped, if any.
+	Commit = ""
+	// Date is when the binary was built.
+	Date = "unknown"
+)
+
+// Info describes the build of the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build of the running binary.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    commit(),
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
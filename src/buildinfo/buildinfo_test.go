@@ -0,0 +1,22 @@
+package buildinfo
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	defer func(version, commit, date string) { Version, Commit, Date = version, commit, date }(Version, Commit, Date)
+
+	// unset, the commit is the toolchain's or unknown
+	if info := Get(); info.Version != "dev" || info.Date != "unknown" || info.Commit == "" || info.GoVersion != runtime.Version() {
+		t.Errorf("default build %+v", info)
+	}
+
+	// the variables -ldflags sets win
+	Version, Commit, Date = "v1.2.3", "0123abc", "2024-05-01T12:00:00Z"
+	want := Info{Version: "v1.2.3", Commit: "0123abc", Date: "2024-05-01T12:00:00Z", GoVersion: runtime.Version()}
+	if info := Get(); info != want {
+		t.Errorf("build %+v, want %+v", info, want)
+	}
+}
@@ -0,0 +1,34 @@
+package clock
+
+import "time"
+
+// Clock is the time source of everything timing TTLs, windows and
+// intervals: the route table with its breakers, ejections and drains, the
+// refresher, the caches, the limiters and the health checker among others,
+// so they can be driven by a fake one instead of waiting. Each defaults to
+// System.
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d passed.
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker sends the time on C every interval until stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// System is the wall clock.
+type System struct{}
+
+func (System) Now() time.Time                         { return time.Now() }
+func (System) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (System) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
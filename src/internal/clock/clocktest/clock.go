@@ -0,0 +1,125 @@
+package clocktest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+)
+
+// Clock is a clock that only moves when advanced.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+	tickers []*ticker
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// New returns a clock stopped at noon UTC on 1 May 2024.
+func New() *Clock {
+	return NewAt(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+}
+
+// NewAt returns a clock stopped at t.
+func NewAt(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the time the clock was advanced to.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock was advanced by
+// d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// NewTicker returns a ticker firing as the clock is advanced past each
+// interval d.
+func (c *Clock) NewTicker(d time.Duration) clock.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &ticker{clock: c, interval: d, next: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers due
+// by then. A ticker whose tick wasn't received yet drops the next ones, like
+// a time.Ticker.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.ch <- c.now:
+			default:
+			}
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+// WaitForTimers waits until n timers wait for the clock, so advancing it
+// fires them.
+func (c *Clock) WaitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers wait for the clock, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type ticker struct {
+	clock    *Clock
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+	ch       chan time.Time
+}
+
+func (t *ticker) C() <-chan time.Time { return t.ch }
+
+func (t *ticker) Stop() {
+	t.clock.mu.Lock()
+	t.stopped = true
+	t.clock.mu.Unlock()
+}
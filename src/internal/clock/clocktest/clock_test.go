@@ -0,0 +1,45 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	clock := New()
+	start := clock.Now()
+	after := clock.After(10 * time.Second)
+	ticker := clock.NewTicker(3 * time.Second)
+
+	clock.Advance(9 * time.Second)
+	select {
+	case <-after:
+		t.Fatal("timer fired before it was due")
+	default:
+	}
+	// the ticks of 6s and 9s were dropped while the one of 3s wasn't received
+	if tick := <-ticker.C(); !tick.Equal(start.Add(9 * time.Second)) {
+		t.Errorf("tick at %v, want the time the clock was advanced to", tick.Sub(start))
+	}
+	select {
+	case <-ticker.C():
+		t.Error("ticker queued more than one tick")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	if fired := <-after; !fired.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("timer fired at %v, want 10s", fired.Sub(start))
+	}
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker ticked")
+	default:
+	}
+
+	if fired := <-clock.After(0); !fired.Equal(clock.Now()) {
+		t.Error("timer of no duration didn't fire right away")
+	}
+}
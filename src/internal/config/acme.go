@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseACMEDomains parses ACME_DOMAINS, a comma separated list of host names
+// certificates may be issued for. A *.example.com entry allows every direct
+// subdomain of example.com, one label deep, but not example.com itself.
+func parseACMEDomains(value string) ([]string, error) {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.Contains(name, "*") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || !strings.Contains(name, ".") {
+			return nil, fmt.Errorf("invalid domain %q, expected example.com or *.example.com", domain)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// S3CacheScheme prefixes an ACME_CACHE kept in S3, as s3://bucket/prefix.
+const S3CacheScheme = "s3://"
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseACMEDomains(t *testing.T) {
+	domains, err := parseACMEDomains(" Proxy.Example.com,,*.tenants.example.com ")
+	if err != nil || !slices.Equal(domains, []string{"proxy.example.com", "*.tenants.example.com"}) {
+		t.Errorf("domains %q, %v", domains, err)
+	}
+	for _, value := range []string{"localhost", "*.*.example.com", "*.", ".example.com", "example.com.", "a*.example.com"} {
+		if _, err := parseACMEDomains(value); err == nil || !strings.Contains(err.Error(), "invalid domain") {
+			t.Errorf("parseACMEDomains(%q) = %v, want it rejected", value, err)
+		}
+	}
+}
+
+func TestConfigACME(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		values map[string]string
+		want   string
+	}{
+		{name: "with a certificate file", values: map[string]string{"TLS_CERT_FILE": "proxy.crt", "TLS_KEY_FILE": "proxy.key"}, want: "ACME_DOMAINS and TLS_CERT_FILE are mutually exclusive"},
+		{name: "without a bucket", values: map[string]string{"ACME_CACHE": "s3:///acme"}, want: `invalid ACME_CACHE "s3:///acme", expected s3://bucket/prefix`},
+		{name: "without a cache", values: map[string]string{"ACME_CACHE": ""}, want: "ACME_DOMAINS requires ACME_CACHE"},
+	} {
+		values := map[string]string{"ECS_CLUSTER": "tenants", "ACME_DOMAINS": "proxy.example.com"}
+		for key, value := range tt.values {
+			values[key] = value
+		}
+		if _, err := Load(values, "", nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load = %v, want %s", tt.name, err, tt.want)
+		}
+	}
+
+	cfg, err := Load(map[string]string{"ECS_CLUSTER": "tenants", "ACME_DOMAINS": "proxy.example.com"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ACMECache != "/var/cache/ecs-svc-proxy/acme" || cfg.ACMEDirectoryURL != "" {
+		t.Errorf("cache %q, directory %q, want the default cache and Let's Encrypt", cfg.ACMECache, cfg.ACMEDirectoryURL)
+	}
+}
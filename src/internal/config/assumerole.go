@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// AssumeRole describes a cluster in another AWS account that is discovered
+// through an assumed IAM role.
+type AssumeRole struct {
+	RoleARN    string
+	ExternalID string
+	Cluster    string
+	Region     string
+	Account    string
+}
+
+// parseAssumeRoles parses ASSUME_ROLES, a comma separated list of
+// role-arn|cluster[|external-id] entries. The cluster may be given as a
+// region:cluster pair and otherwise runs in defaultRegion.
+func parseAssumeRoles(value, defaultRegion string) ([]AssumeRole, error) {
+	var roles []AssumeRole
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid assume role entry %q, expected role-arn|cluster[|external-id]", entry)
+		}
+		roleARN, err := arn.Parse(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid role arn %q: %v", parts[0], err)
+		}
+		cluster, err := parseCluster(parts[1], defaultRegion)
+		if err != nil {
+			return nil, err
+		}
+		role := AssumeRole{
+			RoleARN: parts[0],
+			Cluster: cluster.Cluster,
+			Region:  cluster.Region,
+			Account: roleARN.AccountID,
+		}
+		if len(parts) == 3 {
+			role.ExternalID = parts[2]
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+func TestParseAssumeRoles(t *testing.T) {
+	roles, err := parseAssumeRoles("arn:aws:iam::111111111111:role/discovery|tenants, arn:aws:iam::222222222222:role/discovery|eu-west-1:other|secret", "us-west-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AssumeRole{
+		{RoleARN: "arn:aws:iam::111111111111:role/discovery", Cluster: "tenants", Region: "us-west-2", Account: "111111111111"},
+		{RoleARN: "arn:aws:iam::222222222222:role/discovery", Cluster: "other", Region: "eu-west-1", Account: "222222222222", ExternalID: "secret"},
+	}
+	if len(roles) != len(want) || roles[0] != want[0] || roles[1] != want[1] {
+		t.Errorf("roles %+v, want %+v", roles, want)
+	}
+
+	for _, value := range []string{
+		"arn:aws:iam::111111111111:role/discovery",
+		"not-an-arn|tenants",
+		"|tenants",
+		"arn:aws:iam::111111111111:role/discovery|tenants|id|extra",
+	} {
+		if _, err := parseAssumeRoles(value, "us-west-2"); err == nil {
+			t.Errorf("parseAssumeRoles(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+package config
+
+// DefaultBackendAllowedCIDRs are the private IPv4 ranges of RFC 1918 and the
+// IPv6 unique local range.
+const DefaultBackendAllowedCIDRs = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBackendAllowedCIDRsEmpty(t *testing.T) {
+	for _, value := range []string{"", " , ", "10.0.0.0/33"} {
+		_, err := Load(map[string]string{"ECS_CLUSTER": "tenants", "BACKEND_ALLOWED_CIDRS": value}, "", nil)
+		if err == nil || !strings.Contains(err.Error(), "BACKEND_ALLOWED_CIDRS") {
+			t.Errorf("BACKEND_ALLOWED_CIDRS=%q: err = %v, want startup to fail", value, err)
+		}
+	}
+	config, err := Load(map[string]string{"ECS_CLUSTER": "tenants"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.BackendAllowedCIDRs) != 4 {
+		t.Errorf("default BACKEND_ALLOWED_CIDRS %v, want the private ranges", config.BackendAllowedCIDRs)
+	}
+}
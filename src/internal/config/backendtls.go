@@ -0,0 +1,24 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseServerNames parses BACKEND_TLS_SERVER_NAMES, a comma separated list
+// of service=server-name entries.
+func parseServerNames(value string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		service, name, ok := strings.Cut(entry, "=")
+		if !ok || service == "" || name == "" {
+			return nil, fmt.Errorf("invalid server name entry %q, expected service=server-name", entry)
+		}
+		names[service] = name
+	}
+	return names, nil
+}
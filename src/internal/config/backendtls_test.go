@@ -0,0 +1,41 @@
+package config
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func FuzzParseServerNames(f *testing.F) {
+	for _, seed := range []string{
+		"acme=acme.internal",
+		" acme = acme.internal , globex=globex.internal,",
+		"société=société.example",
+		"acme=a=b",
+		"acme=%61cme.internal",
+		"acme=acme.internal\r\nglobex=x",
+		"=acme",
+		"acme",
+		strings.Repeat("acme=acme.internal,", 500),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		names, err := parseServerNames(value)
+		if err != nil {
+			return
+		}
+		// the entries can be written back and parsed to the same names
+		var entries []string
+		for service, name := range names {
+			if service == "" || name == "" || strings.Contains(service, "=") || strings.Contains(service+name, ",") {
+				t.Errorf("parseServerNames(%q) has %q=%q", value, service, name)
+			}
+			entries = append(entries, service+"="+name)
+		}
+		again, err := parseServerNames(strings.Join(entries, ","))
+		if err != nil || !maps.Equal(again, names) {
+			t.Errorf("parseServerNames(%q) = %q, parsed again %q, %v", value, names, again, err)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// clientOrgs maps client identities to the orgs they may route to. A nil
+// clientOrgs lets every client route every org.
+type clientOrgs map[string][]string
+
+// parseClientOrgs parses CLIENT_ORGS, a comma separated list of
+// identity=org|org entries, where * stands for every org.
+func parseClientOrgs(value string) (clientOrgs, error) {
+	var orgs clientOrgs
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, list, ok := strings.Cut(entry, "=")
+		if !ok || identity == "" || list == "" {
+			return nil, fmt.Errorf("invalid client entry %q, expected identity=org|org", entry)
+		}
+		if orgs == nil {
+			orgs = clientOrgs{}
+		}
+		orgs[identity] = append(orgs[identity], strings.Split(list, "|")...)
+	}
+	return orgs, nil
+}
+
+// Allowed reports whether the client with identity may route requests of
+// org. A client without a verified certificate has an empty identity.
+func (c clientOrgs) Allowed(identity, org string) bool {
+	if c == nil {
+		return true
+	}
+	allowed := c[identity]
+	return identity != "" && (slices.Contains(allowed, "*") || slices.Contains(allowed, org))
+}
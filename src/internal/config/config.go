@@ -0,0 +1,1274 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Config is the configuration of the proxy, read from the environment, the
+// config file and the command line.
+type Config struct {
+	AWSRegion         string
+	ECSCluster        string
+	ProxyPort         int
+	HeaderRoutingName string
+	Clusters          []ClusterConfig
+	AssumeRoles       []AssumeRole
+	// DiscoveryMode is where routes come from, one of DiscoveryModeECS or
+	// DiscoveryModeStatic. StaticRoutes is the inline JSON or the file of
+	// the static ones.
+	DiscoveryMode string
+	StaticRoutes  string
+	// ECSAPITimeout bounds each attempt of an ECS API call, 0 for no bound
+	// but the retry budget.
+	ECSAPITimeout time.Duration
+	// ECSEndpointURL replaces the ECS endpoint of every region, for
+	// LocalStack or a fake ECS API. Empty uses the SDK's own resolution.
+	ECSEndpointURL string
+	// PrimaryDeploymentOnly restricts routing to tasks started by each
+	// service's PRIMARY deployment.
+	PrimaryDeploymentOnly bool
+	// TaskSets selects the task sets PrimaryDeploymentOnly routes to in
+	// services deployed by CODE_DEPLOY or an EXTERNAL controller, one of the
+	// TaskSets constants.
+	TaskSets string
+	// TaskSelection is the policy choosing which of a service's tasks are
+	// routed to, one of TaskSelectionAll or TaskSelectionLatestRevision.
+	TaskSelection string
+	// AmbiguousMatch resolves an org ID that no service is named after but
+	// several contain, one of the AmbiguousMatch constants.
+	// AmbiguousMatchPriority lists the services AmbiguousMatchPriority
+	// prefers, first to last.
+	AmbiguousMatch         string
+	AmbiguousMatchPriority []string
+	// EventsQueueURL is the SQS queue receiving ECS task state change events
+	// from EventBridge. Routes are only updated from events when it is set.
+	EventsQueueURL string
+	// PortLabel is the task definition docker label holding the port a
+	// container listens on. Containers without it are reached on
+	// DefaultPort. PortNames select the port mapping of a name instead.
+	PortLabel   string
+	PortNames   PortNames
+	DefaultPort int
+	// AddressFamily selects which backend addresses are routed to, one of
+	// the AddressFamily constants.
+	AddressFamily string
+	// RoutableCIDRs are the subnets the proxy can reach. A container with
+	// several network interfaces is routed to the first one inside them.
+	RoutableCIDRs []netip.Prefix
+	// BackendAllowedCIDRs are the subnets a backend must be in to be
+	// routed to, whether it was discovered in the primary or the secondary
+	// cluster.
+	BackendAllowedCIDRs []netip.Prefix
+	// RefreshInterval is how often routes are rebuilt in the background,
+	// zero disables background refreshes.
+	RefreshInterval time.Duration
+	// RefreshOnMiss rebuilds the routes when a lookup misses, at most once
+	// per RefreshMinInterval.
+	RefreshOnMiss      bool
+	RefreshMinInterval time.Duration
+	// NegativeTTL is how long an org that matched nothing after a refresh
+	// is answered with 404 straight away. NegativeCacheSize bounds how many
+	// such orgs are remembered.
+	NegativeTTL       time.Duration
+	NegativeCacheSize int
+	// MissWait holds a request whose org missed while a refresh is in
+	// flight until the refresh is done, for up to MissWaitTimeout, and
+	// looks it up again. At most MissWaitMaxWaiters are held at once.
+	MissWait           bool
+	MissWaitTimeout    time.Duration
+	MissWaitMaxWaiters int
+	// RateLimit is the token bucket of each org, RateLimitOrgs overrides it
+	// by normalized org ID. Requests of orgs matching no service share one
+	// bucket. RateLimitMaxOrgs bounds how many buckets, and orgs of
+	// OrgMaxConcurrent, are kept. A zero
+	// RateLimit.Rate disables rate limiting.
+	RateLimit        RateLimit
+	RateLimitOrgs    map[string]RateLimit
+	RateLimitMaxOrgs int
+	// ProxyMode is how requests reach their backend, one of the ProxyMode
+	// constants.
+	ProxyMode string
+	// OrgTargets override the scheme, port or path prefix of the requests
+	// of the orgs listed, by org.
+	OrgTargets map[string]OrgTarget
+	// Mirrors send a share of the requests of the orgs listed to a shadow
+	// target, by normalized org. Copies time out after MirrorTimeout and
+	// bodies above MirrorMaxBody bytes aren't mirrored.
+	Mirrors       map[string]MirrorRule
+	MirrorTimeout time.Duration
+	MirrorMaxBody int64
+	// ResponseCache keeps the cacheable GET and HEAD responses of
+	// ProxyModeForward, up to ResponseCacheMaxBytes in all and
+	// ResponseCacheMaxEntry each.
+	ResponseCache         bool
+	ResponseCacheMaxBytes int64
+	ResponseCacheMaxEntry int64
+	// DryRun answers routed requests with the backend they would have gone
+	// to instead of redirecting or forwarding them.
+	DryRun bool
+	// LBStrategy picks one of a service's backends, one of the LBStrategy
+	// constants.
+	LBStrategy string
+	// AZAffinity is one of the AZAffinity constants. AvailabilityZone is
+	// the proxy's zone, read from the task metadata when empty.
+	AZAffinity       string
+	AvailabilityZone string
+	// ECSHealth takes the backends ECS reports UNHEALTHY out of rotation,
+	// and ECSHealthUnknown, one of the ECSHealthUnknown constants, says
+	// whether those it reports UNKNOWN stay in.
+	ECSHealth        bool
+	ECSHealthUnknown string
+	// ServiceCounts records the desired, running and pending task counts
+	// of each ECS service. A service with no running task but some on the
+	// way is answered with a 503 whose Retry-After is ScaleUpRetryAfter.
+	ServiceCounts     bool
+	ScaleUpRetryAfter time.Duration
+	// ServiceRoleTags reads the proxy.role and proxy.weight tags of the ECS
+	// services, routing the orgs matching tagged services to the live ones
+	// by weight.
+	ServiceRoleTags bool
+	// EnableWake sets the desired count of the WakeServices scaled to zero
+	// to WakeDesiredCount when a request comes for them, at most once per
+	// WakeInterval per service.
+	EnableWake       bool
+	WakeServices     []string
+	WakeDesiredCount int
+	WakeInterval     time.Duration
+	// DiscoveryConcurrency is how many DescribeTasks batches of a cluster
+	// run at once.
+	DiscoveryConcurrency int
+	// DiscoveryBudget bounds how long a refresh describes tasks for, zero
+	// means no limit.
+	DiscoveryBudget time.Duration
+	// StartupMode is what happens while discovery fails at startup, one of
+	// the StartupMode constants. StartupTimeout is how long a fail-fast
+	// startup retries discovery before exiting.
+	StartupMode    string
+	StartupTimeout time.Duration
+	// RoutesFreshTTL is the age after which routes are revalidated in the
+	// background while still being served, RoutesMaxAge the age after which
+	// requests wait for them to be rebuilt. Zero disables either.
+	RoutesFreshTTL time.Duration
+	RoutesMaxAge   time.Duration
+	// RefreshJitterPercent spreads background refreshes by up to this
+	// percentage of RefreshInterval either way. RefreshInitialDelay is the
+	// maximum random delay before the first one.
+	RefreshJitterPercent int
+	RefreshInitialDelay  time.Duration
+	// SnapshotPath is where the routes are saved after each discovery and
+	// restored from at startup if they are younger than SnapshotMaxAge.
+	SnapshotPath   string
+	SnapshotMaxAge time.Duration
+	// RouteStore is where the routes come from, one of the RouteStore
+	// constants. With RouteStoreRedis the replicas share them through the
+	// Redis server at RouteStoreAddr, under the keys prefixed with
+	// RouteStoreKey: the one holding the refresh lease for
+	// RouteStoreLeaseTTL discovers them, and the others discover their own
+	// when the shared ones are older than RouteStoreMaxStaleness.
+	RouteStore             string
+	RouteStoreAddr         string
+	RouteStorePassword     string
+	RouteStoreKey          string
+	RouteStoreLeaseTTL     time.Duration
+	RouteStoreMaxStaleness time.Duration
+	// AuditLogPath is a file route changes are appended to as JSON lines.
+	AuditLogPath string
+	// RoutesLogRedactIPs masks the backend addresses logged on SIGUSR1 but
+	// for their last octet.
+	RoutesLogRedactIPs bool
+	// HealthzPath serves the liveness check.
+	HealthzPath string
+	// ReadyzPath serves the readiness check. The proxy isn't ready after
+	// ReadyMaxFailures consecutive discovery failures, or while the route
+	// table is empty unless ReadyAllowEmpty.
+	ReadyzPath       string
+	ReadyMaxFailures int
+	ReadyAllowEmpty  bool
+	// HealthCheckInterval enables active health checks of every backend,
+	// an HTTP GET of HealthCheckPath if set and a TCP connect otherwise.
+	HealthCheckInterval    time.Duration
+	HealthCheckPath        string
+	HealthCheckTimeout     time.Duration
+	HealthCheckConcurrency int
+	// EjectFailures forwarding failures to a backend within EjectWindow
+	// take it out of rotation for EjectCooldown. Zero disables ejection.
+	EjectFailures int
+	EjectWindow   time.Duration
+	EjectCooldown time.Duration
+	// BreakerFailures consecutive failed requests to a backend open its
+	// circuit breaker for BreakerOpenTimeout. Zero disables the breakers.
+	BreakerFailures    int
+	BreakerOpenTimeout time.Duration
+	// ShutdownDelay is how long readiness fails before the listener closes
+	// on SIGTERM, ShutdownTimeout how long requests in flight then have to
+	// complete.
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout bound
+	// the connections of every listener, 0 being no limit, and
+	// MaxHeaderBytes the size of request headers. WriteTimeout covers the
+	// whole response, so it cuts streamed and upgraded ones.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// SecondaryCluster is the standby cluster an org fails over to when
+	// the primary clusters have no routable backend for it, nil if none.
+	// An org that failed over stays there for at least FailoverSticky.
+	SecondaryCluster *ClusterConfig
+	FailoverSticky   time.Duration
+	// LogLevel is the least severe level logged and LogFormat is text or
+	// json.
+	LogLevel  slog.Level
+	LogFormat string
+	// LogSampleBurst is how many times a repetitive message is logged per
+	// key every LogSampleWindow before it is only counted. Zero disables
+	// sampling.
+	LogSampleBurst  int
+	LogSampleWindow time.Duration
+	// TracingEnabled exports spans over OTLP, configured by the standard
+	// OTEL_* variables. It is set when an OTLP endpoint is.
+	TracingEnabled bool
+	// TracingEndpoint is the URL spans are exported to, from
+	// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT.
+	TracingEndpoint string
+	// SlowRequestThreshold logs requests taking longer, or whose backend
+	// takes longer, at warn. Zero disables it.
+	SlowRequestThreshold time.Duration
+	// MaxConcurrentRequests caps the routed requests served at once, zero
+	// if it doesn't. A request beyond it waits up to ConcurrencyQueueTimeout
+	// before it is turned down.
+	MaxConcurrentRequests   int
+	ConcurrencyQueueTimeout time.Duration
+	// OrgMaxConcurrent caps the requests in flight of each org, unless
+	// OrgMaxConcurrentOrgs overrides it by normalized org ID; zero if it
+	// doesn't. A request beyond it waits up to OrgConcurrencyQueueTimeout
+	// before it is turned down. As many orgs as buckets are tracked.
+	OrgMaxConcurrent           int
+	OrgMaxConcurrentOrgs       map[string]int
+	OrgConcurrencyQueueTimeout time.Duration
+	// RequestIDHeader carries the ID of each request.
+	RequestIDHeader string
+	// BackendTaskHeader names the task of the backend in the X-Backend-Task
+	// header of responses.
+	BackendTaskHeader bool
+	// TraceHeaders are the tracing headers forwarded as the client sent them
+	// and logged with each request. AmznTraceID is how X-Amzn-Trace-Id is
+	// completed first, one of the AmznTraceID constants.
+	TraceHeaders []string
+	AmznTraceID  string
+	// SecurityHeaders are set on every response of the proxy listeners.
+	SecurityHeaders []SecurityHeader
+	// Maintenance are the orgs under maintenance, answered with a 503, by
+	// org. MaintenancePage renders the answer to clients accepting HTML,
+	// nil if they get JSON too.
+	Maintenance     map[string]MaintenanceWindow
+	MaintenancePage *template.Template
+	// OrgHeaders are set on the requests forwarded for each org.
+	OrgHeaders OrgHeaders
+	// AllowedMethods are the methods each org may use, any without a rule.
+	AllowedMethods AllowedMethods
+	// ResponseHeaders are set on or removed from the responses relayed for
+	// each org.
+	ResponseHeaders ResponseHeaders
+	// RewriteLocation points Location headers naming the backend at the
+	// host the client used, RewriteCookieDomain the Domain of its cookies.
+	RewriteLocation     bool
+	RewriteCookieDomain bool
+	// ErrorMessages replace the message of error responses, by code.
+	ErrorMessages map[string]*texttemplate.Template
+	// AccessLog is the level requests are logged at, or off.
+	AccessLog string
+	// OrgMetricsMax is how many orgs get their own per-org series, the
+	// others share the "other" label. Zero disables per-org series.
+	OrgMetricsMax int
+	// MetricsSink publishes metrics every MetricsInterval to CloudWatch as
+	// EMF log lines under MetricsNamespace, to the StatsD agent at
+	// StatsDAddr, or nowhere.
+	MetricsSink      string
+	MetricsNamespace string
+	MetricsInterval  time.Duration
+	StatsDAddr       string
+	// MetricsPath serves the Prometheus metrics, on AdminAddr if it is set
+	// and on ProxyPort otherwise.
+	MetricsPath string
+	// AdminAddr is the host:port of the admin listener, or empty to serve
+	// the operator endpoints on ProxyPort. ADMIN_PORT is short for
+	// listening on every interface.
+	AdminAddr string
+	// EnablePprof serves the pprof profiles on AdminAddr.
+	EnablePprof bool
+	// AdminToken is the bearer token of the admin endpoints, usually read
+	// from Secrets Manager with a secretsmanager: reference. Without it the
+	// admin endpoints are open and the mutating ones disabled.
+	AdminToken string
+	// AdminRefreshTimeout is how long POST /admin/refresh on the admin listener
+	// waits for discovery.
+	AdminRefreshTimeout time.Duration
+	// DeepHealthTimeout bounds the ECS calls of /healthz/deep. Routes older
+	// than DeepHealthStaleAfter make it degraded, older than
+	// DeepHealthMaxStaleness down.
+	DeepHealthTimeout      time.Duration
+	DeepHealthStaleAfter   time.Duration
+	DeepHealthMaxStaleness time.Duration
+	// SecretsRefreshInterval is how often the secrets referenced by
+	// secretsmanager: values are fetched again, the configuration being
+	// reloaded when one was rotated. Zero fetches them once.
+	SecretsRefreshInterval time.Duration
+	// BindAddr is the interface the proxy listens on, all of them if empty.
+	BindAddr string
+	// ProxyListen is a unix:// socket path the proxy listens on instead of
+	// BindAddr and ProxyPort, created with SocketMode.
+	ProxyListen string
+	SocketMode  os.FileMode
+	// TLSCertFile and TLSKeyFile are the PEM files of the certificate TLS
+	// is terminated with, read again every TLSReloadInterval if they
+	// changed. With them ProxyPort serves TLS, unless TLSPort is set.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	// TLSMinVersion is the oldest TLS version accepted, and TLSCipherSuites
+	// the TLS 1.2 cipher suites, all secure ones if empty.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+	// BackendTLS forwards requests to backends over HTTPS unless their
+	// org's target sets a scheme. BackendTLSCertFile and BackendTLSKeyFile
+	// are the client certificate presented to backends, BackendTLSCAFile
+	// the CA bundle their certificates are verified with, the system roots
+	// if empty, and BackendTLSServerNames the names they are verified
+	// against by service, the service name if it isn't listed.
+	BackendTLS            bool
+	BackendTLSCertFile    string
+	BackendTLSKeyFile     string
+	BackendTLSCAFile      string
+	BackendTLSServerNames map[string]string
+	// ACMEDomains are the host names certificates are obtained for from
+	// the ACME directory at ACMEDirectoryURL, Let's Encrypt if it is empty,
+	// instead of reading them from TLSCertFile. ACMECache is the directory,
+	// or the s3://bucket/prefix, they are kept in.
+	ACMEDomains      []string
+	ACMEEmail        string
+	ACMECache        string
+	ACMEDirectoryURL string
+	// ClientAuth is whether TLS clients must present a certificate issued
+	// by ClientCAFile, one of the ClientAuth constants. ClientOrgs limits
+	// the orgs a client may route to by identity, nil if it doesn't.
+	ClientAuth   string
+	ClientCAFile string
+	ClientOrgs   clientOrgs
+	// AllowCIDRs and DenyCIDRs filter requests by client address, the TCP
+	// peer unless it is in TrustedProxies, in which case the rightmost
+	// X-Forwarded-For entry that isn't, as logged and forwarded.
+	// IPFilterExemptHealth lets health checks through whatever their
+	// address.
+	AllowCIDRs           []netip.Prefix
+	DenyCIDRs            []netip.Prefix
+	TrustedProxies       []netip.Prefix
+	IPFilterExemptHealth bool
+	// APIKeysFile, or APIKeys, the document itself, usually read from
+	// Secrets Manager, holds the hashed API keys of each org. Requests must
+	// then carry a key of their org in APIKeyHeader. The keys are read again
+	// every APIKeysReloadInterval if they changed.
+	APIKeysFile           string
+	APIKeys               string
+	APIKeyHeader          string
+	APIKeysReloadInterval time.Duration
+	// JWKSURL turns on the verification of bearer tokens, signed by a key
+	// of that JWKS, cached for JWKSTTL. JWTIssuers and JWTAudiences are
+	// the accepted ones, any if empty, and JWTClockSkew how far token
+	// times may be off.
+	JWKSURL      string
+	JWKSTTL      time.Duration
+	JWTIssuers   []string
+	JWTAudiences []string
+	JWTClockSkew time.Duration
+	// AuthMode is how requests are authenticated besides API keys and
+	// tokens, one of the AuthMode constants. With AuthModeSigV4 they carry
+	// in SigV4Header an STS GetCallerIdentity request presigned by the
+	// caller, signing the SigV4Audience header, and taken
+	// within SigV4ClockSkew of its validity. SigV4Principals maps the
+	// principals to the orgs they may route to.
+	AuthMode        string
+	SigV4Header     string
+	SigV4Audience   string
+	SigV4ClockSkew  time.Duration
+	SigV4Principals clientOrgs
+	// TLSPort is the port of a TLS listener served next to a plain
+	// ProxyPort with the same routing, or 0 for none.
+	TLSPort int
+	// RedirectToTLS answers requests on ProxyPort, but the health checks,
+	// with a redirect to TLSPort.
+	RedirectToTLS bool
+	// RetryAfter is sent with 503 responses to tell clients when to retry.
+	RetryAfter time.Duration
+	// UpstreamRetries is how many times a failed idempotent request is
+	// retried on another backend, as long as the retries to its service
+	// over RetryBudgetWindow stay within RetryBudgetPercent of its requests.
+	UpstreamRetries    int
+	RetryBudgetPercent int
+	RetryBudgetWindow  time.Duration
+	// OutlierMultiplier ejects a backend for OutlierEjectFor once its
+	// average latency over at least OutlierMinSamples requests exceeds the
+	// median of its service this many times. Zero disables it.
+	OutlierMultiplier float64
+	OutlierMinSamples int
+	OutlierEjectFor   time.Duration
+	// ClusterStagger spaces out the start of each cluster's discovery.
+	ClusterStagger time.Duration
+
+	// Settings holds the effective value of every variable by name, and
+	// UnknownKeys the config file keys that aren't one, for logging.
+	Settings    map[string]string
+	UnknownKeys []string
+}
+
+// ClusterConfig is a cluster and the region it runs in.
+type ClusterConfig struct {
+	Region  string
+	Cluster string
+}
+
+// String returns the cluster as region:cluster.
+func (c ClusterConfig) String() string {
+	return c.Region + ":" + c.Cluster
+}
+
+// envLoader reads configuration from the environment, falling back to the
+// settings of a config file. Invalid values are collected rather than
+// returned one at a time, so every mistake in a task definition is
+// reported by a single failed start.
+type envLoader struct {
+	// flags holds the values set on the command line by variable name,
+	// which override the environment.
+	flags map[string]string
+	// getenv looks variables up in the environment.
+	getenv func(key string) (string, bool)
+	// file holds the settings of the config file by variable name.
+	file map[string]string
+	// secrets resolves the values referencing a Secrets Manager secret,
+	// and references records them by variable name with the version they
+	// resolved to, so the values themselves are never logged. resolved
+	// holds the values, to keep them out of the errors too.
+	secrets    *SecretResolver
+	references map[string]string
+	resolved   map[string]string
+	// effective records the value of every variable read, defaults
+	// included.
+	effective map[string]string
+	errs      []error
+}
+
+// failf records an invalid value.
+func (l *envLoader) failf(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf(format, args...))
+}
+
+// err returns the invalid values, or nil if there were none. A value read
+// from a secret is replaced by its reference.
+func (l *envLoader) err() error {
+	err := errors.Join(l.errs...)
+	if err == nil || len(l.resolved) == 0 {
+		return err
+	}
+	message := err.Error()
+	for key, value := range l.resolved {
+		if value != "" {
+			message = strings.ReplaceAll(message, value, l.references[key])
+		}
+	}
+	return errors.New(message)
+}
+
+// lookup returns the value of key set by a flag, or else in the environment,
+// or else in the config file, with a secret reference replaced by the
+// secret.
+func (l *envLoader) lookup(key string) (string, bool) {
+	value, ok := l.flags[key]
+	if !ok {
+		value, ok = l.getenv(key)
+	}
+	if !ok {
+		value, ok = l.file[key]
+	}
+	ref, isSecret := strings.CutPrefix(value, secretPrefix)
+	if !ok || !isSecret {
+		return value, ok
+	}
+	if l.secrets == nil {
+		l.failf("%s references a secret, which can't be read here", key)
+		return "", false
+	}
+	value, version, err := l.secrets.Resolve(ref)
+	if err != nil {
+		l.failf("%s: %w", key, err)
+		return "", false
+	}
+	if l.references == nil {
+		l.references, l.resolved = map[string]string{}, map[string]string{}
+	}
+	l.references[key] = fmt.Sprintf("%s%s (version %s)", secretPrefix, ref, version)
+	l.resolved[key] = value
+	return value, true
+}
+
+// use records value as the effective value of key and returns it.
+func use[T any](l *envLoader, key string, value T) T {
+	if l.effective == nil {
+		l.effective = map[string]string{}
+	}
+	l.effective[key] = fmt.Sprint(value)
+	if ref, ok := l.references[key]; ok {
+		l.effective[key] = ref
+	}
+	return value
+}
+
+// string returns key, or defaultValue if it is unset.
+func (l *envLoader) string(key, defaultValue string) string {
+	if value, ok := l.lookup(key); ok {
+		return use(l, key, value)
+	}
+	return use(l, key, defaultValue)
+}
+
+// required returns key, which must be set and not empty.
+func (l *envLoader) required(key string) string {
+	value, _ := l.lookup(key)
+	if value == "" {
+		l.failf("missing mandatory env %s", key)
+	}
+	return use(l, key, value)
+}
+
+// bool returns key, true or false as accepted by strconv.ParseBool, or
+// defaultValue if it is unset.
+func (l *envLoader) bool(key string, defaultValue bool) bool {
+	value, ok := l.lookup(key)
+	if !ok {
+		return use(l, key, defaultValue)
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		l.failf("invalid %s %q, must be true or false", key, value)
+		return use(l, key, defaultValue)
+	}
+	return use(l, key, b)
+}
+
+// int returns key, or defaultValue if it is unset. It must be within
+// [min, max].
+func (l *envLoader) int(key string, defaultValue, min, max int) int {
+	value, ok := l.lookup(key)
+	if !ok {
+		return use(l, key, defaultValue)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		if max == math.MaxInt {
+			l.failf("invalid %s %q, must be an integer of at least %d", key, value, min)
+		} else {
+			l.failf("invalid %s %q, must be an integer from %d to %d", key, value, min, max)
+		}
+		return use(l, key, defaultValue)
+	}
+	return use(l, key, n)
+}
+
+// duration returns key, or defaultValue if it is unset. It must be at
+// least min.
+func (l *envLoader) duration(key string, defaultValue, min time.Duration) time.Duration {
+	value, ok := l.lookup(key)
+	if !ok {
+		return use(l, key, defaultValue)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		l.failf("invalid %s %q, must be a duration such as 30s or 1m30s", key, value)
+		return use(l, key, defaultValue)
+	}
+	if d < min {
+		l.failf("invalid %s %q, must be at least %s", key, value, min)
+		return use(l, key, defaultValue)
+	}
+	return use(l, key, d)
+}
+
+// oneOf returns key, or defaultValue if it is unset. It must be one of
+// allowed.
+func (l *envLoader) oneOf(key, defaultValue string, allowed ...string) string {
+	value := l.string(key, defaultValue)
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+	l.failf("invalid %s %q, must be one of %s", key, value, strings.Join(allowed, ", "))
+	return use(l, key, defaultValue)
+}
+
+// path returns key, or defaultValue if it is unset. Unless it is empty it
+// must start with /.
+func (l *envLoader) path(key, defaultValue string) string {
+	value := l.string(key, defaultValue)
+	if value != "" && !strings.HasPrefix(value, "/") {
+		l.failf("invalid %s %q, must start with /", key, value)
+	}
+	return value
+}
+
+// list returns the comma separated entries of key, without blanks.
+func (l *envLoader) list(key string) []string {
+	var entries []string
+	for _, entry := range strings.Split(l.string(key, ""), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// port returns key, or defaultValue if it is unset. It must be a port
+// number, or 0 if optional is set.
+func (l *envLoader) port(key string, defaultValue int, optional bool) int {
+	value, ok := l.lookup(key)
+	if !ok || (optional && value == "") {
+		return use(l, key, defaultValue)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > 65535 || (n == 0 && !optional) {
+		l.failf("invalid %s %q, must be a port from 1 to 65535", key, value)
+		return use(l, key, defaultValue)
+	}
+	return use(l, key, n)
+}
+
+// float returns key, or defaultValue if it is unset.
+func (l *envLoader) float(key string, defaultValue float64) float64 {
+	value, ok := l.lookup(key)
+	if !ok {
+		return use(l, key, defaultValue)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		l.failf("invalid %s %q, must be a number", key, value)
+		return use(l, key, defaultValue)
+	}
+	return use(l, key, f)
+}
+
+// header returns key, or defaultValue if it is unset. It must be a valid
+// HTTP header name.
+func (l *envLoader) header(key, defaultValue string) string {
+	value := l.string(key, defaultValue)
+	if !validHeaderName(value) {
+		l.failf("invalid %s %q, must be an HTTP header name", key, value)
+	}
+	return value
+}
+
+// validHeaderName reports whether name is a token as defined by RFC 9110.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseCluster parses either a plain cluster name, which runs in
+// defaultRegion, or a region:cluster pair.
+func parseCluster(value, defaultRegion string) (ClusterConfig, error) {
+	region, cluster, found := strings.Cut(strings.TrimSpace(value), ":")
+	if !found {
+		cluster, region = region, defaultRegion
+	}
+	if region == "" || cluster == "" {
+		return ClusterConfig{}, fmt.Errorf("invalid cluster %q, expected cluster or region:cluster", value)
+	}
+	return ClusterConfig{Region: region, Cluster: cluster}, nil
+}
+
+// parseClusters parses ECS_CLUSTER, a comma separated list of clusters as
+// accepted by parseCluster.
+func parseClusters(value, defaultRegion string) ([]ClusterConfig, error) {
+	var clusters []ClusterConfig
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		cluster, err := parseCluster(entry, defaultRegion)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// Load reads the configuration from flags, the values set on the
+// command line by variable name, the environment, and the config file if
+// file isn't empty, in that order of precedence. Values of the form
+// secretsmanager:<arn-or-name>[#json-key] are read through secrets. The
+// error lists every invalid value.
+func Load(flags map[string]string, file string, secrets *SecretResolver) (Config, error) {
+	env := envLoader{flags: flags, getenv: os.LookupEnv, secrets: secrets}
+	if file != "" {
+		settings, err := loadConfigFile(file)
+		if err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", file, err)
+		}
+		env.file = settings
+	}
+	config := loadConfig(&env)
+
+	config.Settings = env.effective
+	strict := env.bool("CONFIG_STRICT", false)
+	for key := range env.file {
+		if _, ok := env.effective[key]; ok {
+			continue
+		}
+		if strict {
+			env.failf("unknown config file key %s", strings.ToLower(key))
+		} else {
+			config.UnknownKeys = append(config.UnknownKeys, strings.ToLower(key))
+		}
+	}
+	sort.Strings(config.UnknownKeys)
+	return config, env.err()
+}
+
+// configDefaults returns the default value of every variable.
+func configDefaults() map[string]string {
+	env := envLoader{getenv: func(string) (string, bool) { return "", false }}
+	loadConfig(&env)
+	return env.effective
+}
+
+// loadConfig reads every variable from env into a Config.
+func loadConfig(env *envLoader) Config {
+	config := Config{
+		AWSRegion:         env.string("AWS_REGION", "us-west-2"),
+		ECSCluster:        env.string("ECS_CLUSTER", ""),
+		ProxyPort:         env.port("PROXY_PORT", 8080, false),
+		HeaderRoutingName: env.header("DEFAULT_ORG_ID", "X-Org-ID"),
+
+		PrimaryDeploymentOnly: env.bool("ROUTE_PRIMARY_DEPLOYMENT_ONLY", false),
+		TaskSets:              env.oneOf("ROUTE_TASK_SETS", TaskSetsPrimary, TaskSetsPrimary, TaskSetsAll),
+		TaskSelection:         env.oneOf("TASK_SELECTION", TaskSelectionAll, TaskSelectionAll, TaskSelectionLatestRevision),
+		EventsQueueURL:        env.string("EVENTS_QUEUE_URL", ""),
+		PortLabel:             env.string("PORT_LABEL", "proxy.port"),
+		AddressFamily:         env.oneOf("ADDRESS_FAMILY", AddressFamilyIPv4, AddressFamilyIPv4, AddressFamilyIPv6, AddressFamilyPreferIPv6),
+		RefreshOnMiss:         env.bool("REFRESH_ON_MISS", true),
+		ProxyMode:             env.oneOf("PROXY_MODE", ProxyModeRedirect, ProxyModeRedirect, ProxyModeForward),
+		DryRun:                env.bool("DRY_RUN", false),
+		IPFilterExemptHealth:  env.bool("IP_FILTER_EXEMPT_HEALTH", false),
+		LBStrategy:            env.oneOf("LB_STRATEGY", LBStrategyRoundRobin, LBStrategyRoundRobin, LBStrategyLeastConn, LBStrategyRandom),
+		StartupMode:           env.oneOf("STARTUP_MODE", StartupModeFailFast, StartupModeFailFast, StartupModeDegraded),
+		SnapshotPath:          env.string("SNAPSHOT_PATH", ""),
+		AuditLogPath:          env.string("AUDIT_LOG_PATH", ""),
+		RoutesLogRedactIPs:    env.bool("ROUTES_LOG_REDACT_IPS", false),
+		HealthzPath:           env.path("HEALTHZ_PATH", "/healthz"),
+		HealthCheckPath:       env.path("HEALTHCHECK_PATH", ""),
+		ReadyzPath:            env.path("READYZ_PATH", "/readyz"),
+		ReadyAllowEmpty:       env.bool("READY_ALLOW_EMPTY", false),
+		LogFormat:             env.oneOf("LOG_FORMAT", LogFormatText, LogFormatText, LogFormatJSON),
+		AccessLog:             env.oneOf("ACCESS_LOG", AccessLogInfo, AccessLogOff, AccessLogDebug, AccessLogInfo),
+		RequestIDHeader:       env.header("REQUEST_ID_HEADER", "X-Request-ID"),
+		MetricsSink:           env.oneOf("METRICS_SINK", MetricsSinkNone, MetricsSinkNone, MetricsSinkCloudWatch, MetricsSinkStatsD),
+		MetricsNamespace:      env.string("METRICS_NAMESPACE", "ECSServiceProxy"),
+		StatsDAddr:            env.string("STATSD_ADDR", "127.0.0.1:8125"),
+		MetricsPath:           env.path("METRICS_PATH", "/metrics"),
+		AdminAddr:             env.string("ADMIN_ADDR", ""),
+		AdminToken:            strings.TrimSpace(env.string("ADMIN_TOKEN", "")),
+		BindAddr:              env.string("BIND_ADDR", ""),
+		ProxyListen:           env.string("PROXY_LISTEN", ""),
+		TLSPort:               env.port("TLS_PORT", 0, true),
+		TLSCertFile:           env.string("TLS_CERT_FILE", ""),
+		TLSKeyFile:            env.string("TLS_KEY_FILE", ""),
+		TLSReloadInterval:     env.duration("TLS_RELOAD_INTERVAL", time.Minute, 0),
+		TLSMinVersion:         tlsVersions[env.oneOf("TLS_MIN_VERSION", "1.2", "1.2", "1.3")],
+		BackendTLS:            env.bool("BACKEND_TLS", false),
+		BackendTLSCertFile:    env.string("BACKEND_TLS_CERT_FILE", ""),
+		BackendTLSKeyFile:     env.string("BACKEND_TLS_KEY_FILE", ""),
+		BackendTLSCAFile:      env.string("BACKEND_TLS_CA_FILE", ""),
+		APIKeysFile:           env.string("API_KEYS_FILE", ""),
+		APIKeys:               env.string("API_KEYS", ""),
+		APIKeyHeader:          env.header("API_KEY_HEADER", "X-Api-Key"),
+		APIKeysReloadInterval: env.duration("API_KEYS_RELOAD_INTERVAL", time.Minute, 0),
+		JWKSURL:               env.string("JWT_JWKS_URL", ""),
+		JWKSTTL:               env.duration("JWT_JWKS_TTL", time.Hour, time.Minute),
+		JWTIssuers:            env.list("JWT_ISSUERS"),
+		JWTAudiences:          env.list("JWT_AUDIENCES"),
+		JWTClockSkew:          env.duration("JWT_CLOCK_SKEW", 30*time.Second, 0),
+		AuthMode:              env.oneOf("AUTH_MODE", AuthModeNone, AuthModeNone, AuthModeSigV4),
+		SigV4Header:           env.header("SIGV4_HEADER", "X-Amz-Presigned-Identity"),
+		SigV4Audience:         env.string("SIGV4_AUDIENCE", ""),
+		SigV4ClockSkew:        env.duration("SIGV4_CLOCK_SKEW", 5*time.Minute, 0),
+		ClientAuth:            env.oneOf("CLIENT_AUTH", ClientAuthNone, ClientAuthNone, ClientAuthRequest, ClientAuthRequire),
+		ClientCAFile:          env.string("CLIENT_CA_FILE", ""),
+		ACMEEmail:             env.string("ACME_EMAIL", ""),
+		ACMECache:             env.string("ACME_CACHE", "/var/cache/ecs-svc-proxy/acme"),
+		ACMEDirectoryURL:      env.string("ACME_DIRECTORY_URL", ""),
+		RedirectToTLS:         env.bool("REDIRECT_TO_TLS", false),
+		EnablePprof:           env.bool("ENABLE_PPROF", false),
+
+		SlowRequestThreshold:    env.duration("SLOW_REQUEST_THRESHOLD", 0, 0),
+		MaxConcurrentRequests:   env.int("MAX_CONCURRENT_REQUESTS", 0, 0, math.MaxInt),
+		ConcurrencyQueueTimeout: env.duration("CONCURRENCY_QUEUE_TIMEOUT", 0, 0),
+		OrgMetricsMax:           env.int("ORG_METRICS_MAX", 100, 0, math.MaxInt),
+		MetricsInterval:         env.duration("METRICS_INTERVAL", time.Minute, time.Second),
+		LogSampleBurst:          env.int("LOG_SAMPLE_BURST", 10, 0, math.MaxInt),
+		LogSampleWindow:         env.duration("LOG_SAMPLE_WINDOW", time.Minute, time.Second),
+		DefaultPort:             env.int("DEFAULT_PORT", 80, 1, 65535),
+
+		RefreshInterval:      env.duration("REFRESH_INTERVAL", 30*time.Second, 0),
+		RefreshMinInterval:   env.duration("REFRESH_MIN_INTERVAL", 10*time.Second, 0),
+		NegativeTTL:          env.duration("NEGATIVE_TTL", 30*time.Second, 0),
+		NegativeCacheSize:    env.int("NEGATIVE_CACHE_SIZE", 10000, 0, math.MaxInt),
+		RateLimitMaxOrgs:     env.int("RATE_LIMIT_MAX_ORGS", 10000, 1, math.MaxInt),
+		StartupTimeout:       env.duration("STARTUP_TIMEOUT", 2*time.Minute, time.Second),
+		RoutesFreshTTL:       env.duration("ROUTES_FRESH_TTL", 0, 0),
+		RoutesMaxAge:         env.duration("ROUTES_MAX_AGE", 0, 0),
+		RefreshJitterPercent: env.int("REFRESH_JITTER_PERCENT", 20, 0, 100),
+		RefreshInitialDelay:  env.duration("REFRESH_INITIAL_DELAY", 0, 0),
+		ReadyMaxFailures:     env.int("READY_MAX_FAILURES", 3, 0, math.MaxInt),
+
+		HealthCheckInterval:    env.duration("HEALTHCHECK_INTERVAL", 0, 0),
+		HealthCheckTimeout:     env.duration("HEALTHCHECK_TIMEOUT", 2*time.Second, time.Millisecond),
+		HealthCheckConcurrency: env.int("HEALTHCHECK_CONCURRENCY", 10, 1, math.MaxInt),
+		EjectFailures:          env.int("EJECT_FAILURES", 3, 0, math.MaxInt),
+		EjectWindow:            env.duration("EJECT_WINDOW", 10*time.Second, 0),
+		EjectCooldown:          env.duration("EJECT_COOLDOWN", 30*time.Second, 0),
+		BreakerFailures:        env.int("BREAKER_FAILURES", 5, 0, math.MaxInt),
+		BreakerOpenTimeout:     env.duration("BREAKER_OPEN_TIMEOUT", 30*time.Second, 0),
+
+		RetryAfter:         env.duration("RETRY_AFTER", 5*time.Second, time.Second),
+		UpstreamRetries:    env.int("UPSTREAM_RETRIES", 0, 0, math.MaxInt),
+		RetryBudgetPercent: env.int("RETRY_BUDGET_PERCENT", 20, 0, 100),
+		RetryBudgetWindow:  env.duration("RETRY_BUDGET_WINDOW", 10*time.Second, time.Second),
+		ShutdownDelay:      env.duration("SHUTDOWN_DELAY", 0, 0),
+		ShutdownTimeout:    env.duration("SHUTDOWN_TIMEOUT", 25*time.Second, 0),
+		ReadHeaderTimeout:  env.duration("READ_HEADER_TIMEOUT", 10*time.Second, 0),
+		ReadTimeout:        env.duration("READ_TIMEOUT", 0, 0),
+		WriteTimeout:       env.duration("WRITE_TIMEOUT", 0, 0),
+		IdleTimeout:        env.duration("IDLE_TIMEOUT", 120*time.Second, 0),
+		MaxHeaderBytes:     env.int("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes, 4096, math.MaxInt),
+		FailoverSticky:     env.duration("FAILOVER_STICKY", time.Minute, 0),
+		OutlierMinSamples:  env.int("OUTLIER_MIN_SAMPLES", 20, 1, math.MaxInt),
+		OutlierEjectFor:    env.duration("OUTLIER_EJECT_DURATION", 30*time.Second, 0),
+
+		SnapshotMaxAge:       env.duration("SNAPSHOT_MAX_AGE", 10*time.Minute, 0),
+		ClusterStagger:       env.duration("CLUSTER_STAGGER", 0, 0),
+		DiscoveryBudget:      env.duration("DISCOVERY_BUDGET", 0, 0),
+		DiscoveryConcurrency: env.int("DISCOVERY_CONCURRENCY", 4, 1, math.MaxInt),
+	}
+	config.TracingEndpoint = env.string("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint := env.string("OTEL_EXPORTER_OTLP_ENDPOINT", ""); config.TracingEndpoint == "" && endpoint != "" {
+		config.TracingEndpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	config.TracingEnabled = !env.bool("OTEL_SDK_DISABLED", false) && config.TracingEndpoint != ""
+
+	logLevel, err := parseLogLevel(env.string("LOG_LEVEL", "info"))
+	if err != nil {
+		env.failf("invalid LOG_LEVEL: %w", err)
+	}
+	config.LogLevel = logLevel
+
+	routableCIDRs, err := ParseCIDRs(env.string("ROUTABLE_CIDRS", ""))
+	if err != nil {
+		env.failf("invalid ROUTABLE_CIDRS: %w", err)
+	}
+	config.RoutableCIDRs = routableCIDRs
+	// an empty list would let every address through, the opposite of what
+	// someone clearing it by mistake wants
+	backendCIDRs, err := ParseCIDRs(env.string("BACKEND_ALLOWED_CIDRS", DefaultBackendAllowedCIDRs))
+	if err != nil {
+		env.failf("invalid BACKEND_ALLOWED_CIDRS: %w", err)
+	} else if len(backendCIDRs) == 0 {
+		env.failf("BACKEND_ALLOWED_CIDRS must not be empty")
+	}
+	config.BackendAllowedCIDRs = backendCIDRs
+	for key, cidrs := range map[string]*[]netip.Prefix{
+		"ALLOW_CIDRS":     &config.AllowCIDRs,
+		"DENY_CIDRS":      &config.DenyCIDRs,
+		"TRUSTED_PROXIES": &config.TrustedProxies,
+	} {
+		prefixes, err := ParseCIDRs(env.string(key, ""))
+		if err != nil {
+			env.failf("invalid %s: %w", key, err)
+		}
+		*cidrs = prefixes
+	}
+	if len(config.AllowCIDRs) == 0 && len(config.DenyCIDRs) == 0 && config.IPFilterExemptHealth {
+		env.failf("IP_FILTER_EXEMPT_HEALTH requires ALLOW_CIDRS or DENY_CIDRS")
+	}
+
+	if value := env.string("SECONDARY_CLUSTER", ""); value != "" {
+		secondary, err := parseCluster(value, config.AWSRegion)
+		if err != nil {
+			env.failf("invalid SECONDARY_CLUSTER: %w", err)
+		} else {
+			config.SecondaryCluster = &secondary
+		}
+	}
+
+	config.OutlierMultiplier = env.float("OUTLIER_MULTIPLIER", 0)
+	if config.OutlierMultiplier < 0 || (config.OutlierMultiplier > 0 && config.OutlierMultiplier <= 1) {
+		env.failf("invalid OUTLIER_MULTIPLIER %v, must be 0 or greater than 1", config.OutlierMultiplier)
+	}
+
+	if adminPort := env.port("ADMIN_PORT", 0, true); config.AdminAddr == "" && adminPort != 0 {
+		config.AdminAddr = ":" + strconv.Itoa(adminPort)
+	} else if config.AdminAddr != "" {
+		if _, port, err := net.SplitHostPort(config.AdminAddr); err != nil || port == "" {
+			env.failf("invalid ADMIN_ADDR %q, must be host:port", config.AdminAddr)
+		}
+	}
+	if config.ProxyListen != "" && (!strings.HasPrefix(config.ProxyListen, UnixScheme) || config.ProxyListen == UnixScheme) {
+		env.failf("invalid PROXY_LISTEN %q, must be unix:///path/to/socket", config.ProxyListen)
+	}
+	config.SocketMode = 0o660
+	if value := env.string("SOCKET_MODE", "0660"); value != "" {
+		if mode, err := strconv.ParseUint(value, 8, 32); err != nil || mode > 0o777 {
+			env.failf("invalid SOCKET_MODE %q, must be octal permissions such as 0660", value)
+		} else {
+			config.SocketMode = os.FileMode(mode)
+		}
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		env.failf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cipherSuites, err := parseCipherSuites(env.string("TLS_CIPHER_SUITES", ""))
+	if err != nil {
+		env.failf("TLS_CIPHER_SUITES: %w", err)
+	}
+	config.TLSCipherSuites = cipherSuites
+	if (config.BackendTLSCertFile == "") != (config.BackendTLSKeyFile == "") {
+		env.failf("BACKEND_TLS_CERT_FILE and BACKEND_TLS_KEY_FILE must be set together")
+	}
+	if config.BackendTLS && config.ProxyMode != ProxyModeForward {
+		env.failf("BACKEND_TLS requires PROXY_MODE=forward")
+	}
+	// health checks are plain HTTP, which a TLS backend would turn down
+	if config.BackendTLS && config.HealthCheckPath != "" {
+		env.failf("BACKEND_TLS requires TCP health checks, leave HEALTHCHECK_PATH empty")
+	}
+	serverNames, err := parseServerNames(env.string("BACKEND_TLS_SERVER_NAMES", ""))
+	if err != nil {
+		env.failf("BACKEND_TLS_SERVER_NAMES: %w", err)
+	}
+	config.BackendTLSServerNames = serverNames
+	acmeDomains, err := parseACMEDomains(env.string("ACME_DOMAINS", ""))
+	if err != nil {
+		env.failf("ACME_DOMAINS: %w", err)
+	}
+	config.ACMEDomains = acmeDomains
+	if len(config.ACMEDomains) > 0 {
+		if config.TLSCertFile != "" {
+			env.failf("ACME_DOMAINS and TLS_CERT_FILE are mutually exclusive")
+		}
+		if bucket, ok := strings.CutPrefix(config.ACMECache, S3CacheScheme); ok && strings.Split(bucket, "/")[0] == "" {
+			env.failf("invalid ACME_CACHE %q, expected s3://bucket/prefix", config.ACMECache)
+		} else if config.ACMECache == "" {
+			env.failf("ACME_DOMAINS requires ACME_CACHE")
+		}
+	}
+	if config.APIKeysFile != "" && config.APIKeys != "" {
+		env.failf("API_KEYS_FILE and API_KEYS are mutually exclusive")
+	}
+	config.ECSEndpointURL = env.string("ECS_ENDPOINT_URL", "")
+	if config.ECSEndpointURL != "" {
+		if u, err := url.Parse(config.ECSEndpointURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			env.failf("invalid ECS_ENDPOINT_URL %q, must be an http(s) URL", config.ECSEndpointURL)
+		}
+	}
+	if config.JWKSURL != "" {
+		if u, err := url.Parse(config.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			env.failf("invalid JWT_JWKS_URL %q, must be an http(s) URL", config.JWKSURL)
+		}
+	} else if len(config.JWTIssuers) > 0 || len(config.JWTAudiences) > 0 {
+		env.failf("JWT_ISSUERS and JWT_AUDIENCES require JWT_JWKS_URL")
+	}
+	principals, err := parseSigV4Principals(env.string("SIGV4_PRINCIPALS", ""))
+	if err != nil {
+		env.failf("SIGV4_PRINCIPALS: %w", err)
+	}
+	config.SigV4Principals = principals
+	if config.AuthMode == AuthModeSigV4 {
+		if config.SigV4Principals == nil {
+			env.failf("AUTH_MODE=sigv4 requires SIGV4_PRINCIPALS")
+		}
+		if config.SigV4Audience == "" {
+			env.failf("AUTH_MODE=sigv4 requires SIGV4_AUDIENCE")
+		}
+	} else if config.SigV4Principals != nil || config.SigV4Audience != "" {
+		env.failf("SIGV4_PRINCIPALS and SIGV4_AUDIENCE require AUTH_MODE=sigv4")
+	}
+	clientOrgs, err := parseClientOrgs(env.string("CLIENT_ORGS", ""))
+	if err != nil {
+		env.failf("CLIENT_ORGS: %w", err)
+	}
+	config.ClientOrgs = clientOrgs
+	if config.ClientAuth != ClientAuthNone {
+		if config.ClientCAFile == "" {
+			env.failf("CLIENT_AUTH requires CLIENT_CA_FILE")
+		}
+		if config.TLSCertFile == "" && len(config.ACMEDomains) == 0 {
+			env.failf("CLIENT_AUTH requires TLS_CERT_FILE or ACME_DOMAINS")
+		}
+		// the plain listener would let clients in without a certificate
+		if config.TLSPort != 0 && !config.RedirectToTLS {
+			env.failf("CLIENT_AUTH with TLS_PORT requires REDIRECT_TO_TLS")
+		}
+	} else if config.ClientOrgs != nil {
+		env.failf("CLIENT_ORGS requires CLIENT_AUTH")
+	}
+	if config.TLSPort != 0 {
+		if config.TLSCertFile == "" && len(config.ACMEDomains) == 0 {
+			env.failf("TLS_PORT requires TLS_CERT_FILE and TLS_KEY_FILE, or ACME_DOMAINS")
+		}
+		if config.TLSPort == config.ProxyPort {
+			env.failf("TLS_PORT %d must differ from PROXY_PORT", config.TLSPort)
+		}
+	} else if config.RedirectToTLS {
+		env.failf("REDIRECT_TO_TLS requires TLS_PORT")
+	}
+	if config.AdminToken != "" && config.AdminAddr == "" {
+		env.failf("ADMIN_TOKEN requires ADMIN_ADDR or ADMIN_PORT")
+	}
+	// an empty secret would leave the admin endpoints open
+	if _, ok := env.references["ADMIN_TOKEN"]; ok && config.AdminToken == "" {
+		env.failf("ADMIN_TOKEN references an empty secret")
+	}
+	if config.EnablePprof && config.AdminAddr == "" {
+		env.failf("ENABLE_PPROF requires ADMIN_ADDR or ADMIN_PORT")
+	}
+
+	config.DiscoveryMode = env.oneOf("DISCOVERY_MODE", DiscoveryModeECS, DiscoveryModeECS, DiscoveryModeStatic)
+	config.StaticRoutes = env.string("STATIC_ROUTES", "")
+	switch {
+	case config.DiscoveryMode == DiscoveryModeECS:
+		if config.ECSCluster == "" {
+			env.failf("missing mandatory env ECS_CLUSTER")
+		}
+		clusters, err := parseClusters(config.ECSCluster, config.AWSRegion)
+		switch {
+		case err != nil:
+			env.failf("ECS_CLUSTER: %w", err)
+		case len(clusters) == 0:
+			env.failf("ECS_CLUSTER: no cluster in %q", config.ECSCluster)
+		}
+		config.Clusters = clusters
+	case config.StaticRoutes == "":
+		env.failf("DISCOVERY_MODE static requires STATIC_ROUTES")
+	case InlineStaticRoutes(config.StaticRoutes):
+		if _, err := ParseStaticRoutes([]byte(config.StaticRoutes)); err != nil {
+			env.failf("STATIC_ROUTES: %w", err)
+		}
+	}
+
+	orgTargets, err := ParseOrgTargets(env.string("ORG_TARGETS", ""))
+	if err != nil {
+		env.failf("ORG_TARGETS: %w", err)
+	}
+	config.OrgTargets = orgTargets
+	config.RouteStore = env.oneOf("ROUTE_STORE", RouteStoreLocal, RouteStoreLocal, RouteStoreRedis)
+	config.RouteStoreAddr = env.string("ROUTE_STORE_ADDR", "")
+	config.RouteStorePassword = env.string("ROUTE_STORE_PASSWORD", "")
+	config.RouteStoreKey = env.string("ROUTE_STORE_KEY", "ecs-svc-proxy")
+	config.RouteStoreLeaseTTL = env.duration("ROUTE_STORE_LEASE_TTL", 30*time.Second, time.Second)
+	config.RouteStoreMaxStaleness = env.duration("ROUTE_STORE_MAX_STALENESS", 2*time.Minute, time.Second)
+	if config.RouteStore == RouteStoreRedis && config.RouteStoreAddr == "" {
+		env.failf("ROUTE_STORE redis requires ROUTE_STORE_ADDR")
+	}
+	config.AmbiguousMatch = env.oneOf("AMBIGUOUS_MATCH", AmbiguousMatchFirst, AmbiguousMatchFirst, AmbiguousMatchClosest, AmbiguousMatchPriority, AmbiguousMatchReject)
+	config.AmbiguousMatchPriority = env.list("AMBIGUOUS_MATCH_PRIORITY")
+	if config.AmbiguousMatch == AmbiguousMatchPriority && len(config.AmbiguousMatchPriority) == 0 {
+		env.failf("AMBIGUOUS_MATCH priority requires AMBIGUOUS_MATCH_PRIORITY")
+	}
+	config.AZAffinity = env.oneOf("AZ_AFFINITY", AZAffinityOff, AZAffinityOff, AZAffinityPrefer)
+	config.AvailabilityZone = env.string("AVAILABILITY_ZONE", "")
+	config.ECSHealth = env.bool("ECS_HEALTH", true)
+	config.ECSHealthUnknown = env.oneOf("ECS_HEALTH_UNKNOWN", ECSHealthUnknownInclude, ECSHealthUnknownInclude, ECSHealthUnknownExclude)
+	config.ServiceCounts = env.bool("SERVICE_COUNTS", false)
+	config.ScaleUpRetryAfter = env.duration("SCALE_UP_RETRY_AFTER", 30*time.Second, time.Second)
+	config.ServiceRoleTags = env.bool("SERVICE_ROLE_TAGS", false)
+	config.MissWait = env.bool("MISS_WAIT", false)
+	config.MissWaitTimeout = env.duration("MISS_WAIT_TIMEOUT", 2*time.Second, time.Millisecond)
+	config.MissWaitMaxWaiters = env.int("MISS_WAIT_MAX_WAITERS", 1000, 1, math.MaxInt)
+	config.EnableWake = env.bool("ENABLE_WAKE", false)
+	config.WakeServices = env.list("WAKE_SERVICES")
+	config.WakeDesiredCount = env.int("WAKE_DESIRED_COUNT", 1, 1, math.MaxInt32)
+	config.WakeInterval = env.duration("WAKE_INTERVAL", 5*time.Minute, time.Second)
+	if config.EnableWake && (!config.ServiceCounts || len(config.WakeServices) == 0) {
+		env.failf("ENABLE_WAKE requires SERVICE_COUNTS=true and WAKE_SERVICES")
+	}
+	orgPortNames, err := parsePortNames(env.string("TARGET_PORT_NAME_ORGS", ""))
+	if err != nil {
+		env.failf("TARGET_PORT_NAME_ORGS: %w", err)
+	}
+	config.PortNames = PortNames{name: env.string("TARGET_PORT_NAME", ""), orgs: orgPortNames}
+	mirrors, err := parseMirrors(env.string("MIRROR", ""))
+	if err != nil {
+		env.failf("MIRROR: %w", err)
+	}
+	config.Mirrors = mirrors
+	if len(config.Mirrors) > 0 && config.ProxyMode != ProxyModeForward {
+		env.failf("MIRROR requires PROXY_MODE=forward")
+	}
+	config.MirrorTimeout = env.duration("MIRROR_TIMEOUT", 2*time.Second, 10*time.Millisecond)
+	config.MirrorMaxBody = int64(env.int("MIRROR_MAX_BODY", 1<<20, 0, math.MaxInt))
+	config.ResponseCache = env.bool("RESPONSE_CACHE", false)
+	config.ResponseCacheMaxBytes = int64(env.int("RESPONSE_CACHE_MAX_BYTES", 64<<20, 1, math.MaxInt))
+	config.ResponseCacheMaxEntry = int64(env.int("RESPONSE_CACHE_MAX_ENTRY_BYTES", 1<<20, 1, math.MaxInt))
+	if config.ResponseCache && config.ProxyMode != ProxyModeForward {
+		env.failf("RESPONSE_CACHE requires PROXY_MODE=forward")
+	}
+	if config.ResponseCacheMaxEntry > config.ResponseCacheMaxBytes {
+		env.failf("RESPONSE_CACHE_MAX_ENTRY_BYTES must not exceed RESPONSE_CACHE_MAX_BYTES")
+	}
+	config.SecretsRefreshInterval = env.duration("SECRETS_REFRESH_INTERVAL", 0, 0)
+	config.ECSAPITimeout = env.duration("ECS_API_TIMEOUT", 10*time.Second, 0)
+	config.AdminRefreshTimeout = env.duration("ADMIN_REFRESH_TIMEOUT", 30*time.Second, time.Second)
+	config.DeepHealthTimeout = env.duration("DEEP_HEALTH_TIMEOUT", 2*time.Second, 100*time.Millisecond)
+	config.DeepHealthMaxStaleness = env.duration("DEEP_HEALTH_MAX_STALENESS", 10*time.Minute, time.Second)
+	config.DeepHealthStaleAfter = env.duration("DEEP_HEALTH_STALE_AFTER", min(2*config.RefreshInterval, config.DeepHealthMaxStaleness), 0)
+	if config.DeepHealthStaleAfter > config.DeepHealthMaxStaleness {
+		env.failf("DEEP_HEALTH_STALE_AFTER must not exceed DEEP_HEALTH_MAX_STALENESS")
+	}
+	config.RateLimit.Rate = env.float("RATE_LIMIT", 0)
+	config.RateLimit.Burst = env.int("RATE_LIMIT_BURST", defaultBurst(config.RateLimit.Rate), 1, math.MaxInt)
+	if config.RateLimit.Rate < 0 {
+		env.failf("invalid RATE_LIMIT %v, must be 0 or more", config.RateLimit.Rate)
+	}
+	rateLimits, err := parseRateLimits(env.string("RATE_LIMIT_ORGS", ""))
+	if err != nil {
+		env.failf("RATE_LIMIT_ORGS: %w", err)
+	}
+	config.RateLimitOrgs = rateLimits
+	config.OrgMaxConcurrent = env.int("ORG_MAX_CONCURRENT", 0, 0, math.MaxInt)
+	orgConcurrency, err := parseOrgConcurrency(env.string("ORG_MAX_CONCURRENT_ORGS", ""))
+	if err != nil {
+		env.failf("ORG_MAX_CONCURRENT_ORGS: %w", err)
+	}
+	config.OrgMaxConcurrentOrgs = orgConcurrency
+	if config.OrgMaxConcurrent == 0 && len(config.OrgMaxConcurrentOrgs) > 0 {
+		env.failf("ORG_MAX_CONCURRENT_ORGS requires ORG_MAX_CONCURRENT")
+	}
+	config.OrgConcurrencyQueueTimeout = env.duration("ORG_CONCURRENCY_QUEUE_TIMEOUT", 0, 0)
+	if config.RateLimit.Rate == 0 && len(config.RateLimitOrgs) > 0 {
+		env.failf("RATE_LIMIT_ORGS requires RATE_LIMIT")
+	}
+	if config.MaxConcurrentRequests == 0 && config.ConcurrencyQueueTimeout > 0 {
+		env.failf("CONCURRENCY_QUEUE_TIMEOUT requires MAX_CONCURRENT_REQUESTS")
+	}
+	traceHeaders, err := parseTraceHeaders(env.string("TRACE_HEADERS", defaultTraceHeaders))
+	if err != nil {
+		env.failf("TRACE_HEADERS: %w", err)
+	}
+	config.TraceHeaders = traceHeaders
+	config.BackendTaskHeader = env.bool("BACKEND_TASK_HEADER", false)
+	config.AmznTraceID = env.oneOf("AMZN_TRACE_ID", AmznTraceIDRoot, AmznTraceIDOff, AmznTraceIDRoot, AmznTraceIDSelf)
+	securityHeaders, err := parseSecurityHeaders(env.string("SECURITY_HEADERS", ""))
+	if err != nil {
+		env.failf("SECURITY_HEADERS: %w", err)
+	}
+	config.SecurityHeaders = securityHeaders
+	maintenance, err := parseMaintenance(env.string("MAINTENANCE", ""))
+	if err != nil {
+		env.failf("MAINTENANCE: %w", err)
+	}
+	config.Maintenance = maintenance
+	orgHeaders, err := parseOrgHeaders(env.string("ORG_HEADERS", ""))
+	if err != nil {
+		env.failf("ORG_HEADERS: %w", err)
+	}
+	config.OrgHeaders = orgHeaders
+	allowedMethods, err := parseAllowedMethods(env.string("ALLOWED_METHODS", ""))
+	if err != nil {
+		env.failf("ALLOWED_METHODS: %w", err)
+	}
+	config.AllowedMethods = allowedMethods
+	responseHeaders, err := parseResponseHeaders(env.string("RESPONSE_HEADERS", ""))
+	if err != nil {
+		env.failf("RESPONSE_HEADERS: %w", err)
+	}
+	config.ResponseHeaders = responseHeaders
+	config.RewriteLocation = env.bool("REWRITE_LOCATION", true)
+	config.RewriteCookieDomain = env.bool("REWRITE_COOKIE_DOMAIN", false)
+	errorMessages, err := parseErrorMessages(env.string("ERROR_MESSAGES", ""))
+	if err != nil {
+		env.failf("ERROR_MESSAGES: %w", err)
+	}
+	config.ErrorMessages = errorMessages
+	if path := env.string("MAINTENANCE_PAGE", ""); path != "" {
+		page, err := template.ParseFiles(path)
+		if err != nil {
+			env.failf("invalid MAINTENANCE_PAGE: %w", err)
+		}
+		config.MaintenancePage = page
+	}
+
+	assumeRoles, err := parseAssumeRoles(env.string("ASSUME_ROLES", ""), config.AWSRegion)
+	if err != nil {
+		env.failf("ASSUME_ROLES: %w", err)
+	}
+	config.AssumeRoles = assumeRoles
+	if config.DiscoveryMode == DiscoveryModeStatic && (config.EventsQueueURL != "" || config.SecondaryCluster != nil || len(config.AssumeRoles) > 0) {
+		env.failf("EVENTS_QUEUE_URL, SECONDARY_CLUSTER and ASSUME_ROLES require DISCOVERY_MODE ecs")
+	}
+	return config
+}
+
+// ConfiguredOrgs returns the orgs the configuration names, which every
+// refresh checks for ambiguity.
+func (c Config) ConfiguredOrgs() []string {
+	var orgs []string
+	for org := range c.OrgTargets {
+		orgs = append(orgs, org)
+	}
+	for org := range c.RateLimitOrgs {
+		orgs = append(orgs, org)
+	}
+	for org := range c.OrgMaxConcurrentOrgs {
+		orgs = append(orgs, org)
+	}
+	for org := range c.Mirrors {
+		orgs = append(orgs, org)
+	}
+	for org := range c.Maintenance {
+		orgs = append(orgs, org)
+	}
+	for org := range c.PortNames.orgs {
+		orgs = append(orgs, org)
+	}
+	return orgs
+}
+
+// NormalizeOrg returns the key of the bucket of org, so org IDs differing
+// in case or surrounding spaces share one.
+func NormalizeOrg(org string) string {
+	return strings.ToLower(strings.TrimSpace(org))
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidation(t *testing.T) {
+	for _, tt := range []struct {
+		key, value string
+		want       string
+	}{
+		{key: "PROXY_PORT", value: "http", want: `invalid PROXY_PORT "http", must be a port from 1 to 65535`},
+		{key: "PROXY_PORT", value: "0", want: `invalid PROXY_PORT "0"`},
+		{key: "PROXY_PORT", value: "65536", want: `invalid PROXY_PORT "65536"`},
+		{key: "PROXY_PORT", value: "-1", want: `invalid PROXY_PORT "-1"`},
+		{key: "REFRESH_INTERVAL", value: "30x", want: `invalid REFRESH_INTERVAL "30x", must be a duration`},
+		{key: "REFRESH_INTERVAL", value: "30", want: `invalid REFRESH_INTERVAL "30"`},
+		{key: "HEALTHCHECK_TIMEOUT", value: "0s", want: `invalid HEALTHCHECK_TIMEOUT "0s", must be at least 1ms`},
+		{key: "UPSTREAM_RETRIES", value: "-1", want: `invalid UPSTREAM_RETRIES "-1", must be an integer of at least 0`},
+		{key: "UPSTREAM_RETRIES", value: "two", want: `invalid UPSTREAM_RETRIES "two"`},
+		{key: "REFRESH_ON_MISS", value: "maybe", want: `invalid REFRESH_ON_MISS "maybe", must be true or false`},
+		{key: "PROXY_MODE", value: "tunnel", want: `invalid PROXY_MODE "tunnel", must be one of redirect, forward`},
+		{key: "LB_STRATEGY", value: "weighted", want: `invalid LB_STRATEGY "weighted", must be one of`},
+		{key: "LOG_FORMAT", value: "JSON", want: `invalid LOG_FORMAT "JSON"`},
+		{key: "ACCESS_LOG", value: "verbose", want: `invalid ACCESS_LOG "verbose", must be one of`},
+		{key: "LOG_LEVEL", value: "verbose", want: `invalid LOG_LEVEL: invalid log level "verbose"`},
+		{key: "TRACE_HEADERS", value: "traceparent,X B3", want: `TRACE_HEADERS: invalid header name "X B3"`},
+		{key: "AMZN_TRACE_ID", value: "always", want: `invalid AMZN_TRACE_ID "always", must be one of`},
+		{key: "TLS_PORT", value: "8443", want: "TLS_PORT requires TLS_CERT_FILE and TLS_KEY_FILE, or ACME_DOMAINS"},
+		{key: "REDIRECT_TO_TLS", value: "true", want: "REDIRECT_TO_TLS requires TLS_PORT"},
+		{key: "PROXY_LISTEN", value: "tcp://127.0.0.1:8080", want: `invalid PROXY_LISTEN "tcp://127.0.0.1:8080", must be unix:///path/to/socket`},
+		{key: "SOCKET_MODE", value: "rw-rw----", want: `invalid SOCKET_MODE "rw-rw----", must be octal permissions`},
+		{key: "READ_TIMEOUT", value: "30", want: `invalid READ_TIMEOUT "30", must be a duration`},
+		{key: "MAX_HEADER_BYTES", value: "1024", want: `invalid MAX_HEADER_BYTES "1024"`},
+		{key: "DEFAULT_ORG_ID", value: "X Org ID", want: `invalid DEFAULT_ORG_ID "X Org ID", must be an HTTP header name`},
+		{key: "DEFAULT_ORG_ID", value: "", want: `invalid DEFAULT_ORG_ID ""`},
+		{key: "REQUEST_ID_HEADER", value: "X-Request-ID:", want: `invalid REQUEST_ID_HEADER`},
+		{key: "HEALTHZ_PATH", value: "healthz", want: `invalid HEALTHZ_PATH "healthz", must start with /`},
+		{key: "OUTLIER_MULTIPLIER", value: "3x", want: `invalid OUTLIER_MULTIPLIER "3x", must be a number`},
+		{key: "SECURITY_HEADERS", value: `{"X-Frame-Options": 1}`, want: "header X-Frame-Options must be a value or an object of value and override"},
+		{key: "SECURITY_HEADERS", value: `{"X Frame": "DENY"}`, want: `invalid header name "X Frame"`},
+		{key: "ECS_CLUSTER", value: "", want: "missing mandatory env ECS_CLUSTER"},
+	} {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			values := map[string]string{"ECS_CLUSTER": "tenants", tt.key: tt.value}
+			_, err := Load(values, "", nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestConfigMandatory is the regression test of the mandatory variables
+// being checked: a missing ECS_CLUSTER used to be let through.
+func TestConfigMandatory(t *testing.T) {
+	t.Setenv("ECS_CLUSTER", "")
+	_, err := Load(nil, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "missing mandatory env ECS_CLUSTER") {
+		t.Fatalf("Load without ECS_CLUSTER = %v", err)
+	}
+
+	// every invalid value is reported at once, not just the first
+	_, err = Load(map[string]string{"PROXY_PORT": "http", "PROXY_MODE": "tunnel", "REFRESH_INTERVAL": "soon"}, "", nil)
+	for _, want := range []string{"ECS_CLUSTER", "PROXY_PORT", "PROXY_MODE", "REFRESH_INTERVAL"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load with several invalid values = %v, want %s reported", err, want)
+		}
+	}
+
+	if _, err := Load(map[string]string{"ECS_CLUSTER": "tenants"}, "", nil); err != nil {
+		t.Errorf("Load with only ECS_CLUSTER set: %v", err)
+	}
+}
+
+// testLoader returns an envLoader of the environment env.
+func testLoader(env map[string]string) *envLoader {
+	return &envLoader{getenv: func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}}
+}
+
+func TestEnvLoaderDuration(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		set     bool
+		want    time.Duration
+		wantErr string
+	}{
+		{value: "1m30s", set: true, want: 90 * time.Second},
+		{value: "1s", set: true, want: time.Second},
+		{set: false, want: 30 * time.Second},
+		{value: "90", set: true, want: 30 * time.Second, wantErr: `invalid INTERVAL "90", must be a duration`},
+		{value: "soon", set: true, want: 30 * time.Second, wantErr: `invalid INTERVAL "soon", must be a duration`},
+		{value: "500ms", set: true, want: 30 * time.Second, wantErr: `invalid INTERVAL "500ms", must be at least 1s`},
+	} {
+		env := map[string]string{}
+		if tt.set {
+			env["INTERVAL"] = tt.value
+		}
+		l := testLoader(env)
+		got := l.duration("INTERVAL", 30*time.Second, time.Second)
+		if got != tt.want {
+			t.Errorf("duration of %q = %v, want %v", tt.value, got, tt.want)
+		}
+		checkLoaderErr(t, l, tt.value, tt.wantErr)
+		if l.effective["INTERVAL"] != tt.want.String() {
+			t.Errorf("effective value of %q = %q, want %q", tt.value, l.effective["INTERVAL"], tt.want)
+		}
+	}
+}
+
+func TestEnvLoaderInt(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		set     bool
+		max     int
+		want    int
+		wantErr string
+	}{
+		{value: "3", set: true, max: 10, want: 3},
+		{value: "0", set: true, max: 10, want: 0},
+		{value: "10", set: true, max: 10, want: 10},
+		{set: false, max: 10, want: 2},
+		{value: "11", set: true, max: 10, want: 2, wantErr: `invalid RETRIES "11", must be an integer from 0 to 10`},
+		{value: "-1", set: true, max: math.MaxInt, want: 2, wantErr: `invalid RETRIES "-1", must be an integer of at least 0`},
+		{value: "2.5", set: true, max: 10, want: 2, wantErr: `invalid RETRIES "2.5"`},
+		{value: "", set: true, max: 10, want: 2, wantErr: `invalid RETRIES ""`},
+	} {
+		env := map[string]string{}
+		if tt.set {
+			env["RETRIES"] = tt.value
+		}
+		l := testLoader(env)
+		if got := l.int("RETRIES", 2, 0, tt.max); got != tt.want {
+			t.Errorf("int of %q = %d, want %d", tt.value, got, tt.want)
+		}
+		checkLoaderErr(t, l, tt.value, tt.wantErr)
+	}
+}
+
+func TestEnvLoaderBool(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		set     bool
+		want    bool
+		wantErr string
+	}{
+		{value: "true", set: true, want: true},
+		{value: "1", set: true, want: true},
+		{value: "FALSE", set: true, want: false},
+		{set: false, want: true},
+		{value: "yes", set: true, want: true, wantErr: `invalid ENABLED "yes", must be true or false`},
+		{value: "", set: true, want: true, wantErr: `invalid ENABLED ""`},
+	} {
+		env := map[string]string{}
+		if tt.set {
+			env["ENABLED"] = tt.value
+		}
+		l := testLoader(env)
+		if got := l.bool("ENABLED", true); got != tt.want {
+			t.Errorf("bool of %q = %v, want %v", tt.value, got, tt.want)
+		}
+		checkLoaderErr(t, l, tt.value, tt.wantErr)
+	}
+}
+
+// checkLoaderErr checks that l failed with wantErr reading value, or didn't
+// fail if wantErr is empty.
+func checkLoaderErr(t *testing.T, l *envLoader, value, wantErr string) {
+	t.Helper()
+	err := l.err()
+	if wantErr == "" && err != nil {
+		t.Errorf("reading %q failed: %v", value, err)
+	}
+	if wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+		t.Errorf("reading %q = %v, want an error containing %q", value, err, wantErr)
+	}
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile reads a YAML or JSON config file. Its keys are the names of
+// the environment variables in lower case, such as proxy_port. Lists are
+// joined with commas, so ecs_cluster and routable_cidrs can be written as
+// lists, assume_roles entries can be maps of role_arn, cluster and
+// external_id, org_targets a map of orgs to maps of scheme, port and
+// path_prefix, rate_limit_orgs a map of orgs to maps of rate and burst,
+// allowed_methods a map of orgs to lists of methods, and security_headers a
+// map of header names to values. It returns the
+// settings by variable name.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		var setting string
+		var err error
+		if targets, ok := value.(map[string]any); ok && key == "org_targets" {
+			setting, err = orgTargetsSetting(targets)
+		} else if limits, ok := value.(map[string]any); ok && key == "rate_limit_orgs" {
+			setting, err = rateLimitOrgsSetting(limits)
+		} else if object, ok := value.(map[string]any); ok && jsonObjectKeys[key] {
+			setting, err = jsonObjectSetting(object)
+		} else {
+			setting, err = configSetting(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		settings[strings.ToUpper(key)] = setting
+	}
+	return settings, nil
+}
+
+// configSetting renders a config file value the way its environment
+// variable would be written.
+func configSetting(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		entries := make([]string, 0, len(value))
+		for _, v := range value {
+			var entry string
+			var err error
+			if role, ok := v.(map[string]any); ok {
+				entry, err = assumeRoleSetting(role)
+			} else {
+				entry, err = configSetting(v)
+			}
+			if err != nil {
+				return "", err
+			}
+			entries = append(entries, entry)
+		}
+		return strings.Join(entries, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("unexpected map")
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// assumeRoleSetting renders an assume_roles entry as role-arn|cluster or
+// role-arn|cluster|external-id.
+func assumeRoleSetting(role map[string]any) (string, error) {
+	for key := range role {
+		switch key {
+		case "role_arn", "cluster", "external_id":
+		default:
+			return "", fmt.Errorf("unexpected key %s in assume role", key)
+		}
+	}
+	setting := fmt.Sprintf("%v|%v", role["role_arn"], role["cluster"])
+	if externalID, ok := role["external_id"]; ok {
+		setting += fmt.Sprintf("|%v", externalID)
+	}
+	return setting, nil
+}
+
+// orgTargetsSetting renders org_targets as org|scheme|port|path-prefix
+// entries, followed by |container if they name one, sorted by org.
+func orgTargetsSetting(targets map[string]any) (string, error) {
+	orgs := make([]string, 0, len(targets))
+	for org := range targets {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	entries := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		target, ok := targets[org].(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("target of org %s is not a map", org)
+		}
+		fields := []string{org, "", "", ""}
+		for key, value := range target {
+			var i int
+			switch key {
+			case "scheme":
+				i = 1
+			case "port":
+				i = 2
+			case "path_prefix":
+				i = 3
+			case "container":
+				fields = append(fields, "")
+				i = 4
+			default:
+				return "", fmt.Errorf("unexpected key %s in target of org %s", key, org)
+			}
+			fields[i] = fmt.Sprint(value)
+		}
+		entries = append(entries, strings.Join(fields, "|"))
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// rateLimitOrgsSetting renders rate_limit_orgs as org|rate|burst entries,
+// sorted by org.
+func rateLimitOrgsSetting(limits map[string]any) (string, error) {
+	orgs := make([]string, 0, len(limits))
+	for org := range limits {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	entries := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		limit, ok := limits[org].(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("rate limit of org %s is not a map", org)
+		}
+		fields := []string{org, "", ""}
+		for key, value := range limit {
+			switch key {
+			case "rate":
+				fields[1] = fmt.Sprint(value)
+			case "burst":
+				fields[2] = fmt.Sprint(value)
+			default:
+				return "", fmt.Errorf("unexpected key %s in rate limit of org %s", key, org)
+			}
+		}
+		entries = append(entries, strings.Join(fields, "|"))
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// jsonObjectKeys are the config file keys whose variable is a JSON object.
+var jsonObjectKeys = map[string]bool{
+	"security_headers": true,
+	"maintenance":      true,
+	"error_messages":   true,
+	"org_headers":      true,
+	"allowed_methods":  true,
+	"response_headers": true,
+}
+
+// jsonObjectSetting renders an object of jsonObjectKeys as the JSON its
+// variable is.
+func jsonObjectSetting(object map[string]any) (string, error) {
+	data, err := json.Marshal(object)
+	return string(data), err
+}
+
+// LogAttrs returns the effective value of every variable as key-value
+// pairs, sorted by name, with the external IDs of assumed roles and the
+// passwords redacted.
+func (c Config) LogAttrs() []any {
+	keys := make([]string, 0, len(c.Settings))
+	for key := range c.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, 0, 2*len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, strings.ToLower(key), SettingValue(key, c.Settings[key]))
+	}
+	return attrs
+}
+
+// SettingValue returns the value of variable key as it can be logged.
+func SettingValue(key, value string) string {
+	switch {
+	case key == "ASSUME_ROLES":
+		return redactExternalIDs(value)
+	case (key == "ADMIN_TOKEN" || key == "ROUTE_STORE_PASSWORD" || key == "API_KEYS") && value != "" && !strings.HasPrefix(value, secretPrefix):
+		return "REDACTED"
+	}
+	return value
+}
+
+// redactExternalIDs replaces the external IDs of ASSUME_ROLES entries.
+func redactExternalIDs(value string) string {
+	entries := strings.Split(value, ",")
+	for i, entry := range entries {
+		parts := strings.Split(entry, "|")
+		if len(parts) > 2 {
+			parts[2] = "REDACTED"
+		}
+		entries[i] = strings.Join(parts, "|")
+	}
+	return strings.Join(entries, ",")
+}
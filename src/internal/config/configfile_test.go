@@ -0,0 +1,85 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigFile(t *testing.T) {
+	file := writeConfigFile(t, `
+ecs_cluster: [tenants, partners]
+proxy_port: 7000
+refresh_interval: 45s
+routable_cidrs:
+  - 10.0.0.0/16
+  - 10.1.0.0/16
+org_targets:
+  contoso: {scheme: https, port: 8443, path_prefix: /legacy}
+`)
+	config, err := Load(nil, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Clusters) != 2 {
+		t.Errorf("Clusters = %+v, want the 2 of the file's list", config.Clusters)
+	}
+	if config.ProxyPort != 7000 || config.RefreshInterval != 45*time.Second {
+		t.Errorf("ProxyPort %d, RefreshInterval %v, want the file's 7000 and 45s", config.ProxyPort, config.RefreshInterval)
+	}
+	wantCIDRs := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("10.1.0.0/16")}
+	if !reflect.DeepEqual(config.RoutableCIDRs, wantCIDRs) {
+		t.Errorf("RoutableCIDRs = %v, want %v", config.RoutableCIDRs, wantCIDRs)
+	}
+	if target := config.OrgTargets["contoso"]; target != (OrgTarget{Scheme: "https", Port: 8443, PathPrefix: "/legacy"}) {
+		t.Errorf("target of contoso = %+v", target)
+	}
+
+	// a JSON file is read the same way
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"ecs_cluster": "tenants", "proxy_port": 7001}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := Load(nil, path, nil); err != nil || config.ProxyPort != 7001 {
+		t.Errorf("Load of a JSON file = %d, %v", config.ProxyPort, err)
+	}
+}
+
+func TestConfigFileEnvOverride(t *testing.T) {
+	file := writeConfigFile(t, "ecs_cluster: tenants\nproxy_port: 7000\nrefresh_interval: 45s\n")
+	t.Setenv("PROXY_PORT", "8000")
+	config, err := Load(nil, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ProxyPort != 8000 {
+		t.Errorf("ProxyPort = %d, want the environment's 8000 over the file's", config.ProxyPort)
+	}
+	if config.RefreshInterval != 45*time.Second {
+		t.Errorf("RefreshInterval = %v, want the file's where the environment has none", config.RefreshInterval)
+	}
+}
+
+func TestConfigFileMalformed(t *testing.T) {
+	for _, content := range []string{
+		"ecs_cluster: [tenants\n",
+		"- tenants\n- partners\n",
+		"org_targets:\n  contoso: https\n",
+		"org_targets:\n  contoso: {weight: 2}\n",
+	} {
+		file := writeConfigFile(t, content)
+		_, err := Load(map[string]string{"ECS_CLUSTER": "tenants"}, file, nil)
+		if err == nil || !strings.HasPrefix(err.Error(), "config file "+file+":") {
+			t.Errorf("Load of %q = %v, want an error naming the file", content, err)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := Load(map[string]string{"ECS_CLUSTER": "tenants"}, missing, nil); err == nil {
+		t.Error("Load of a missing config file succeeded")
+	}
+}
@@ -0,0 +1,301 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// configOption documents a variable for its command-line flag.
+type configOption struct {
+	env   string
+	usage string
+	// boolean options can be given as a flag without a value.
+	boolean bool
+}
+
+// configOptions are the variables that can be set with a flag named after
+// them, such as --proxy-port for PROXY_PORT.
+var configOptions = []configOption{
+	{env: "AWS_REGION", usage: "AWS region of the clusters without one"},
+	{env: "ECS_CLUSTER", usage: "comma separated clusters to discover, as cluster or region:cluster; required with DISCOVERY_MODE ecs"},
+	{env: "ECS_API_TIMEOUT", usage: "how long an ECS API call attempt may take before it is retried, 0 for no limit"},
+	{env: "ECS_ENDPOINT_URL", usage: "ECS API endpoint replacing the one of every region, such as LocalStack's"},
+	{env: "DISCOVERY_MODE", usage: "ecs, or static to read STATIC_ROUTES instead"},
+	{env: "STATIC_ROUTES", usage: "JSON object of org IDs to host:port targets, inline or the path of a file"},
+	{env: "PROXY_PORT", usage: "port to listen on"},
+	{env: "BIND_ADDR", usage: "address of the interface to listen on, all of them if empty"},
+	{env: "PROXY_LISTEN", usage: "unix:///path of a socket to listen on instead of the proxy port"},
+	{env: "SOCKET_MODE", usage: "octal permissions of the PROXY_LISTEN socket"},
+	{env: "TLS_CERT_FILE", usage: "PEM certificate TLS is terminated with"},
+	{env: "TLS_KEY_FILE", usage: "PEM private key of the certificate"},
+	{env: "TLS_RELOAD_INTERVAL", usage: "how often the certificate files are checked for changes, 0 disables"},
+	{env: "TLS_MIN_VERSION", usage: "oldest TLS version accepted, 1.2 or 1.3"},
+	{env: "TLS_CIPHER_SUITES", usage: "comma separated TLS 1.2 cipher suites accepted, all secure ones if empty"},
+	{env: "ACME_DOMAINS", usage: "comma separated host names, or *.domain for its subdomains, to obtain certificates for with ACME"},
+	{env: "ACME_EMAIL", usage: "contact email of the ACME account"},
+	{env: "ACME_CACHE", usage: "directory, or s3://bucket/prefix, the ACME account and certificates are kept in"},
+	{env: "ACME_DIRECTORY_URL", usage: "ACME directory, Let's Encrypt if empty"},
+	{env: "CLIENT_AUTH", usage: "none, request or require-and-verify client certificates"},
+	{env: "CLIENT_CA_FILE", usage: "PEM CA bundle client certificates are verified with"},
+	{env: "CLIENT_ORGS", usage: "comma separated identity=org|org entries of the orgs each client may route, * for all"},
+	{env: "API_KEYS_FILE", usage: "YAML or JSON file of the SHA-256 hashed API keys of each org"},
+	{env: "API_KEYS", usage: "the API keys document itself, such as secretsmanager:<secret>, instead of API_KEYS_FILE"},
+	{env: "API_KEY_HEADER", usage: "header carrying the API key"},
+	{env: "API_KEYS_RELOAD_INTERVAL", usage: "how often the API keys are checked for changes, 0 disables"},
+	{env: "JWT_JWKS_URL", usage: "JWKS the bearer tokens of routed requests are verified with, none if empty"},
+	{env: "JWT_JWKS_TTL", usage: "how long the JWKS is cached"},
+	{env: "JWT_ISSUERS", usage: "comma separated token issuers accepted, any if empty"},
+	{env: "JWT_AUDIENCES", usage: "comma separated token audiences accepted, any if empty"},
+	{env: "JWT_CLOCK_SKEW", usage: "how far token times may be off"},
+	{env: "AUTH_MODE", usage: "none, or sigv4 to require an STS request presigned by the caller"},
+	{env: "SIGV4_HEADER", usage: "header carrying the presigned STS request"},
+	{env: "SIGV4_AUDIENCE", usage: "value presigned requests must sign in X-Ecs-Svc-Proxy-Audience; required with AUTH_MODE sigv4"},
+	{env: "SIGV4_CLOCK_SKEW", usage: "how far presigned request times may be off"},
+	{env: "SIGV4_PRINCIPALS", usage: "comma separated principal=org|org entries of the orgs each IAM principal may route"},
+	{env: "TLS_PORT", usage: "port of a TLS listener served next to a plain proxy port, 0 disables"},
+	{env: "REDIRECT_TO_TLS", usage: "redirect requests on the proxy port to the TLS port", boolean: true},
+	{env: "DEFAULT_ORG_ID", usage: "header used to route requests"},
+	{env: "CONFIG_STRICT", usage: "fail the startup on unknown config file keys", boolean: true},
+	{env: "ASSUME_ROLES", usage: "comma separated role-arn|cluster[|external-id] entries for clusters in other accounts"},
+	{env: "ROUTE_PRIMARY_DEPLOYMENT_ONLY", usage: "only route to tasks of each service's primary deployment", boolean: true},
+	{env: "ROUTE_TASK_SETS", usage: "primary or all task sets of CODE_DEPLOY and EXTERNAL services routed to with ROUTE_PRIMARY_DEPLOYMENT_ONLY"},
+	{env: "TASK_SELECTION", usage: "all, or latest-revision to route only to tasks of the newest task definition revision"},
+	{env: "AMBIGUOUS_MATCH", usage: "first, closest, priority or reject, for an org several service names contain"},
+	{env: "AMBIGUOUS_MATCH_PRIORITY", usage: "comma separated services the priority policy prefers, first to last"},
+	{env: "EVENTS_QUEUE_URL", usage: "SQS queue receiving ECS task state change events"},
+	{env: "PORT_LABEL", usage: "task definition docker label holding the port a container listens on"},
+	{env: "DEFAULT_PORT", usage: "port used for containers without a valid port label"},
+	{env: "TARGET_PORT_NAME", usage: "name of the task definition port mapping containers are reached on"},
+	{env: "TARGET_PORT_NAME_ORGS", usage: "comma separated org|name entries overriding TARGET_PORT_NAME"},
+	{env: "ADDRESS_FAMILY", usage: "ipv4, ipv6, or prefer-ipv6"},
+	{env: "ALLOW_CIDRS", usage: "comma separated CIDRs clients must be in, any if empty"},
+	{env: "DENY_CIDRS", usage: "comma separated CIDRs of clients turned down"},
+	{env: "TRUSTED_PROXIES", usage: "comma separated CIDRs of proxies whose X-Forwarded-For is trusted"},
+	{env: "IP_FILTER_EXEMPT_HEALTH", usage: "let health checks through the address filter", boolean: true},
+	{env: "ROUTABLE_CIDRS", usage: "comma separated CIDRs the proxy can reach"},
+	{env: "BACKEND_ALLOWED_CIDRS", usage: "comma separated CIDRs backends must be in, private ranges by default"},
+	{env: "REFRESH_INTERVAL", usage: "how often routes are rebuilt in the background, 0 disables"},
+	{env: "REFRESH_JITTER_PERCENT", usage: "how much background refreshes are spread either way, in percent of the interval"},
+	{env: "REFRESH_INITIAL_DELAY", usage: "longest random delay before the first background refresh"},
+	{env: "CLUSTER_STAGGER", usage: "delay between starting the discovery of consecutive clusters"},
+	{env: "REFRESH_ON_MISS", usage: "rebuild routes when a request's org isn't found", boolean: true},
+	{env: "MISS_WAIT", usage: "hold requests whose org isn't found for the refresh in flight", boolean: true},
+	{env: "MISS_WAIT_TIMEOUT", usage: "longest a request is held for the refresh in flight"},
+	{env: "MISS_WAIT_MAX_WAITERS", usage: "most requests held for the refresh in flight at once"},
+	{env: "REFRESH_MIN_INTERVAL", usage: "least time between two rebuilds triggered by requests"},
+	{env: "NEGATIVE_TTL", usage: "how long an org that matched no service isn't looked up again"},
+	{env: "NEGATIVE_CACHE_SIZE", usage: "most orgs remembered as matching no service"},
+	{env: "RATE_LIMIT", usage: "requests a second each org may send, 0 disables"},
+	{env: "RATE_LIMIT_BURST", usage: "requests an org may send at once, a second worth by default"},
+	{env: "RATE_LIMIT_ORGS", usage: "comma separated org|rate|burst entries overriding the rate limit"},
+	{env: "RATE_LIMIT_MAX_ORGS", usage: "most orgs whose rate and concurrency limits are tracked"},
+	{env: "ORG_MAX_CONCURRENT", usage: "most requests of an org in flight at once, 0 disables"},
+	{env: "ORG_MAX_CONCURRENT_ORGS", usage: "comma separated org|limit entries overriding the in-flight limit"},
+	{env: "ORG_CONCURRENCY_QUEUE_TIMEOUT", usage: "longest a request over its org's in-flight limit waits for a slot"},
+	{env: "PROXY_MODE", usage: "redirect, or forward to proxy requests to the backend"},
+	{env: "ORG_TARGETS", usage: "comma separated org|scheme|port|path-prefix[|container] entries overriding how orgs reach their backend"},
+	{env: "MIRROR", usage: "comma separated org|target|percent entries mirroring a share of an org's requests to a service or host:port"},
+	{env: "MIRROR_TIMEOUT", usage: "how long a mirrored request may take"},
+	{env: "MIRROR_MAX_BODY", usage: "largest request body mirrored, in bytes"},
+	{env: "RESPONSE_CACHE", usage: "cache the GET and HEAD responses backends allow shared caches to keep", boolean: true},
+	{env: "RESPONSE_CACHE_MAX_BYTES", usage: "most memory the response cache takes, in bytes"},
+	{env: "RESPONSE_CACHE_MAX_ENTRY_BYTES", usage: "largest response cached, in bytes"},
+	{env: "DRY_RUN", usage: "answer requests with the backend they would go to instead of sending them there", boolean: true},
+	{env: "BACKEND_TLS", usage: "forward requests to backends over HTTPS", boolean: true},
+	{env: "BACKEND_TLS_CERT_FILE", usage: "PEM client certificate presented to backends"},
+	{env: "BACKEND_TLS_KEY_FILE", usage: "PEM private key of the backend client certificate"},
+	{env: "BACKEND_TLS_CA_FILE", usage: "PEM CA bundle backend certificates are verified with, the system roots if empty"},
+	{env: "BACKEND_TLS_SERVER_NAMES", usage: "comma separated service=server-name entries backend certificates are verified against"},
+	{env: "LB_STRATEGY", usage: "roundrobin, leastconn or random"},
+	{env: "ECS_HEALTH", usage: "take backends ECS reports UNHEALTHY out of rotation"},
+	{env: "ECS_HEALTH_UNKNOWN", usage: "include or exclude backends ECS reports UNKNOWN"},
+	{env: "SERVICE_COUNTS", usage: "record the desired, running and pending task counts of each service", boolean: true},
+	{env: "SERVICE_ROLE_TAGS", usage: "route to the services tagged proxy.role=live, by their proxy.weight tag", boolean: true},
+	{env: "SCALE_UP_RETRY_AFTER", usage: "Retry-After of requests to a service starting its first tasks"},
+	{env: "ENABLE_WAKE", usage: "start the WAKE_SERVICES scaled to zero when a request comes for them", boolean: true},
+	{env: "WAKE_SERVICES", usage: "comma separated ECS services that may be woken from zero"},
+	{env: "WAKE_DESIRED_COUNT", usage: "desired count a woken service is set to"},
+	{env: "WAKE_INTERVAL", usage: "least time between two wake-ups of a service"},
+	{env: "AZ_AFFINITY", usage: "prefer to pick backends in the proxy's availability zone first, or off"},
+	{env: "AVAILABILITY_ZONE", usage: "availability zone of the proxy, read from the ECS task metadata when empty"},
+	{env: "DISCOVERY_CONCURRENCY", usage: "how many ECS calls a discovery makes at once"},
+	{env: "DISCOVERY_BUDGET", usage: "how long a refresh may spend describing tasks, 0 is unlimited"},
+	{env: "STARTUP_MODE", usage: "failfast, or degraded to listen before discovery succeeded"},
+	{env: "STARTUP_TIMEOUT", usage: "how long a failfast startup retries discovery"},
+	{env: "SNAPSHOT_PATH", usage: "file the routes are saved to and restored from at startup"},
+	{env: "SNAPSHOT_MAX_AGE", usage: "oldest snapshot restored at startup"},
+	{env: "ROUTE_STORE", usage: "local, or redis to share the routes discovered by one replica at a time"},
+	{env: "ROUTE_STORE_ADDR", usage: "host:port of the Redis server of the route store"},
+	{env: "ROUTE_STORE_PASSWORD", usage: "password of the Redis server of the route store"},
+	{env: "ROUTE_STORE_KEY", usage: "prefix of the route store keys"},
+	{env: "ROUTE_STORE_LEASE_TTL", usage: "how long a replica holds the refresh lease"},
+	{env: "ROUTE_STORE_MAX_STALENESS", usage: "oldest shared routes served before a replica discovers its own"},
+	{env: "AUDIT_LOG_PATH", usage: "file every route change is appended to as a JSON line"},
+	{env: "ROUTES_LOG_REDACT_IPS", usage: "mask the backend addresses logged on SIGUSR1 but for their last octet", boolean: true},
+	{env: "HEALTHZ_PATH", usage: "liveness check path"},
+	{env: "READYZ_PATH", usage: "readiness check path"},
+	{env: "READY_MAX_FAILURES", usage: "failed refreshes in a row after which the proxy reports not ready, 0 never does"},
+	{env: "READY_ALLOW_EMPTY", usage: "report ready with an empty route table", boolean: true},
+	{env: "LOG_LEVEL", usage: "debug, info, warn or error"},
+	{env: "LOG_FORMAT", usage: "text or json"},
+	{env: "LOG_SAMPLE_BURST", usage: "how many times a repeated message is logged per window, 0 disables sampling"},
+	{env: "LOG_SAMPLE_WINDOW", usage: "window of the log sampling"},
+	{env: "REQUEST_ID_HEADER", usage: "header carrying the request ID"},
+	{env: "BACKEND_TASK_HEADER", usage: "name the task of the backend in the X-Backend-Task response header", boolean: true},
+	{env: "TRACE_HEADERS", usage: "comma separated tracing headers forwarded verbatim and logged with each request"},
+	{env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP/HTTP collector spans are exported to, none if empty"},
+	{env: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", usage: "OTLP/HTTP traces URL replacing the one of OTEL_EXPORTER_OTLP_ENDPOINT"},
+	{env: "OTEL_SDK_DISABLED", usage: "turn tracing off even with an OTLP endpoint", boolean: true},
+	{env: "AMZN_TRACE_ID", usage: "off, root to give X-Amzn-Trace-Id a Root= when missing, or self to also add a Self="},
+	{env: "SECURITY_HEADERS", usage: "JSON object of headers set on every response, name to value or {value, override}"},
+	{env: "ACCESS_LOG", usage: "off, debug or info"},
+	{env: "MAINTENANCE", usage: "JSON object of orgs under maintenance to {message, retry_after, until}"},
+	{env: "ORG_HEADERS", usage: "JSON object of orgs, or * for all, to headers set on their forwarded requests"},
+	{env: "ALLOWED_METHODS", usage: "JSON object of orgs, or * for the others, to the methods they may use"},
+	{env: "RESPONSE_HEADERS", usage: "JSON object of orgs, or * for all, to headers set on their responses, null to remove one"},
+	{env: "REWRITE_LOCATION", usage: "point Location headers naming the backend at the host the client used"},
+	{env: "REWRITE_COOKIE_DOMAIN", usage: "move cookies scoped to the backend's IP to the host the client used"},
+	{env: "ERROR_MESSAGES", usage: "JSON object of error codes to the template of their message"},
+	{env: "MAINTENANCE_PAGE", usage: "HTML template answering clients of orgs under maintenance that accept HTML"},
+	{env: "MAX_CONCURRENT_REQUESTS", usage: "most routed requests served at once, 0 for no limit"},
+	{env: "CONCURRENCY_QUEUE_TIMEOUT", usage: "how long a request beyond the limit waits for a slot"},
+	{env: "SLOW_REQUEST_THRESHOLD", usage: "duration above which a request is logged with its phases, 0 disables"},
+	{env: "METRICS_SINK", usage: "none, cloudwatch or statsd"},
+	{env: "METRICS_NAMESPACE", usage: "CloudWatch namespace of the metrics"},
+	{env: "METRICS_INTERVAL", usage: "how often metrics are published to the sink"},
+	{env: "STATSD_ADDR", usage: "host:port of the DogStatsD agent"},
+	{env: "METRICS_PATH", usage: "path of the Prometheus metrics"},
+	{env: "ORG_METRICS_MAX", usage: "how many orgs get their own metric series"},
+	{env: "ADMIN_ADDR", usage: "host:port serving the metrics and debug endpoints instead of the proxy port"},
+	{env: "ADMIN_PORT", usage: "port serving the metrics and debug endpoints on every interface, unless ADMIN_ADDR is set"},
+	{env: "ADMIN_TOKEN", usage: "bearer token the admin endpoints require, which also turns on POST /admin/refresh"},
+	{env: "ADMIN_REFRESH_TIMEOUT", usage: "how long POST /admin/refresh waits for discovery"},
+	{env: "DEEP_HEALTH_TIMEOUT", usage: "how long /healthz/deep waits for each ECS call"},
+	{env: "DEEP_HEALTH_STALE_AFTER", usage: "route age after which /healthz/deep reports degraded"},
+	{env: "DEEP_HEALTH_MAX_STALENESS", usage: "route age after which /healthz/deep reports down"},
+	{env: "SECRETS_REFRESH_INTERVAL", usage: "how often the secrets of secretsmanager: values are fetched again, 0 disables"},
+	{env: "ENABLE_PPROF", usage: "serve the pprof profiles on the admin listener", boolean: true},
+	{env: "HEALTHCHECK_INTERVAL", usage: "how often backends are health checked, 0 disables"},
+	{env: "HEALTHCHECK_PATH", usage: "path requested from backends, a TCP connect without it"},
+	{env: "HEALTHCHECK_TIMEOUT", usage: "timeout of a health check"},
+	{env: "HEALTHCHECK_CONCURRENCY", usage: "how many backends are checked at once"},
+	{env: "EJECT_FAILURES", usage: "forwarding failures within the eject window after which a backend is ejected, 0 disables"},
+	{env: "EJECT_WINDOW", usage: "window of the eject failures"},
+	{env: "EJECT_COOLDOWN", usage: "how long an ejected backend is out of rotation"},
+	{env: "BREAKER_FAILURES", usage: "consecutive failures after which a backend's circuit breaker opens, 0 disables"},
+	{env: "BREAKER_OPEN_TIMEOUT", usage: "how long an open circuit breaker fails requests fast"},
+	{env: "RETRY_AFTER", usage: "Retry-After sent with 503 responses"},
+	{env: "UPSTREAM_RETRIES", usage: "how many times a failed idempotent request is retried on another backend"},
+	{env: "RETRY_BUDGET_PERCENT", usage: "most retries per service, in percent of its requests"},
+	{env: "RETRY_BUDGET_WINDOW", usage: "window of the retry budget"},
+	{env: "OUTLIER_MULTIPLIER", usage: "how many times slower than its service a backend is ejected, 0 disables"},
+	{env: "OUTLIER_MIN_SAMPLES", usage: "requests a backend needs before its latency is compared"},
+	{env: "OUTLIER_EJECT_DURATION", usage: "how long a slow backend is ejected"},
+	{env: "SHUTDOWN_DELAY", usage: "how long the readiness check fails before the listener closes on SIGTERM"},
+	{env: "SHUTDOWN_TIMEOUT", usage: "how long requests in flight have to complete on shutdown"},
+	{env: "READ_HEADER_TIMEOUT", usage: "how long a client has to send its request headers, 0 is unlimited"},
+	{env: "READ_TIMEOUT", usage: "how long a client has to send its whole request, 0 is unlimited"},
+	{env: "WRITE_TIMEOUT", usage: "how long a response may take once the headers were read, 0 is unlimited"},
+	{env: "IDLE_TIMEOUT", usage: "how long an idle keep-alive connection is kept open, 0 is unlimited"},
+	{env: "MAX_HEADER_BYTES", usage: "largest request headers accepted"},
+	{env: "SECONDARY_CLUSTER", usage: "standby cluster orgs fail over to, as cluster or region:cluster"},
+	{env: "FAILOVER_STICKY", usage: "how long an org that failed over stays on the secondary cluster"},
+	{env: "ROUTES_FRESH_TTL", usage: "age after which routes are rebuilt in the background, 0 disables"},
+	{env: "ROUTES_MAX_AGE", usage: "age after which requests wait for routes to be rebuilt, 0 disables"},
+}
+
+// flagAliases are short names of the most used flags.
+var flagAliases = map[string]string{
+	"AWS_REGION":     "region",
+	"ECS_CLUSTER":    "cluster",
+	"PROXY_PORT":     "port",
+	"DEFAULT_ORG_ID": "header",
+}
+
+// flagName returns the name of the flag of variable env.
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// optionFlag records the value of a flag under its variable.
+type optionFlag struct {
+	option configOption
+	values map[string]string
+}
+
+func (f *optionFlag) String() string {
+	return ""
+}
+
+func (f *optionFlag) Set(value string) error {
+	f.values[f.option.env] = value
+	return nil
+}
+
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.option.boolean
+}
+
+// CommandLine is the parsed command line.
+type CommandLine struct {
+	// Values holds the variables set by flags.
+	Values      map[string]string
+	ConfigFile  string
+	ShowVersion bool
+}
+
+// ParseFlags parses args, the command line without the program name.
+// configFile is the default of --config. It returns flag.ErrHelp when
+// --help was given, after writing the usage to output.
+func ParseFlags(args []string, configFile string, output io.Writer) (CommandLine, error) {
+	cmd := CommandLine{Values: map[string]string{}}
+	flags := flag.NewFlagSet("ecs-svc-proxy", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&cmd.ConfigFile, "config", configFile, "")
+	flags.BoolVar(&cmd.ShowVersion, "version", false, "")
+	for _, option := range configOptions {
+		value := &optionFlag{option: option, values: cmd.Values}
+		flags.Var(value, flagName(option.env), option.usage)
+		if alias, ok := flagAliases[option.env]; ok {
+			flags.Var(value, alias, option.usage)
+		}
+	}
+	flags.Usage = func() {
+		printUsage(output)
+	}
+	err := flags.Parse(args)
+	if err == nil && flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument %q", flags.Arg(0))
+		fmt.Fprintln(output, err)
+		printUsage(output)
+	}
+	return cmd, err
+}
+
+// printUsage documents every flag with its variable and default.
+func printUsage(w io.Writer) {
+	defaults := configDefaults()
+	fmt.Fprint(w, `Usage: ecs-svc-proxy [flags]
+
+Every option can be set with a flag, its environment variable, or its key in
+the config file, in that order of precedence.
+
+  --config FILE
+        YAML or JSON config file (env CONFIG_FILE)
+  --version
+        print the build and exit
+`)
+	for _, option := range configOptions {
+		names := "--" + flagName(option.env)
+		if alias, ok := flagAliases[option.env]; ok {
+			names += ", --" + alias
+		}
+		details := "env " + option.env
+		if value := defaults[option.env]; value != "" {
+			details += ", default " + value
+		}
+		fmt.Fprintf(w, "  %s\n        %s (%s)\n", names, option.usage, details)
+	}
+}
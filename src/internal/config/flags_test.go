@@ -0,0 +1,152 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes content to a config file in a temporary directory
+// and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "ecs_cluster: from-file\nproxy_port: 7000\nlog_format: json\nrefresh_on_miss: false\n")
+	t.Setenv("PROXY_PORT", "8000")
+	t.Setenv("LOG_FORMAT", "text")
+	cmd, err := ParseFlags([]string{"--port", "9000", "--refresh-on-miss"}, "", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(cmd.Values, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ECSCluster != "from-file" {
+		t.Errorf("ECSCluster = %q, want the file's", config.ECSCluster)
+	}
+	if config.ProxyPort != 9000 {
+		t.Errorf("ProxyPort = %d, want the flag's 9000 over the environment and the file", config.ProxyPort)
+	}
+	if config.LogFormat != LogFormatText {
+		t.Errorf("LogFormat = %q, want the environment's over the file", config.LogFormat)
+	}
+	if !config.RefreshOnMiss {
+		t.Error("RefreshOnMiss = false, want the boolean flag without a value to set it")
+	}
+	if config.HeaderRoutingName != "X-Org-ID" {
+		t.Errorf("HeaderRoutingName = %q, want the default", config.HeaderRoutingName)
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"--no-such-option", "1"},
+		{"--port"},
+		{"stray"},
+	} {
+		var output strings.Builder
+		if _, err := ParseFlags(args, "", &output); err == nil {
+			t.Errorf("parseFlags(%q) succeeded", args)
+		}
+		if !strings.Contains(output.String(), "Usage: ecs-svc-proxy") {
+			t.Errorf("parseFlags(%q) printed no usage:\n%s", args, output.String())
+		}
+	}
+}
+
+func TestParseFlagsHelp(t *testing.T) {
+	var output strings.Builder
+	if _, err := ParseFlags([]string{"--help"}, "", &output); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("parseFlags(--help) = %v, want flag.ErrHelp", err)
+	}
+	for _, want := range []string{"--proxy-port, --port", "env PROXY_PORT, default 8080", "--config-strict"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("usage lacks %q", want)
+		}
+	}
+}
+
+func TestConfigStrict(t *testing.T) {
+	file := writeConfigFile(t, "ecs_cluster: c\nno_such_key: 1\n")
+	config, err := Load(nil, file, nil)
+	if err != nil {
+		t.Fatalf("unknown key without CONFIG_STRICT: %v", err)
+	}
+	if len(config.UnknownKeys) != 1 || config.UnknownKeys[0] != "no_such_key" {
+		t.Errorf("unknownKeys = %q", config.UnknownKeys)
+	}
+
+	for name, flags := range map[string]map[string]string{
+		"flag": {"CONFIG_STRICT": "true"},
+		"file": nil,
+	} {
+		path := file
+		if flags == nil {
+			path = writeConfigFile(t, "ecs_cluster: c\nconfig_strict: true\nno_such_key: 1\n")
+		}
+		if _, err := Load(flags, path, nil); err == nil || !strings.Contains(err.Error(), "unknown config file key no_such_key") {
+			t.Errorf("CONFIG_STRICT from the %s: err = %v", name, err)
+		}
+	}
+}
+
+func TestConfigTracingEndpoint(t *testing.T) {
+	for _, tt := range []struct {
+		flags    map[string]string
+		endpoint string
+	}{
+		{flags: map[string]string{}},
+		{flags: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/"}, endpoint: "http://collector:4318/v1/traces"},
+		{flags: map[string]string{
+			"OTEL_EXPORTER_OTLP_ENDPOINT":        "http://collector:4318",
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://traces:4318/spans",
+		}, endpoint: "http://traces:4318/spans"},
+		{flags: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_SDK_DISABLED": "true"}, endpoint: "http://collector:4318/v1/traces"},
+	} {
+		for _, key := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_SDK_DISABLED"} {
+			if _, ok := tt.flags[key]; !ok {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+		}
+		tt.flags["ECS_CLUSTER"] = "c"
+		config, err := Load(tt.flags, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enabled := tt.endpoint != "" && tt.flags["OTEL_SDK_DISABLED"] != "true"
+		if config.TracingEndpoint != tt.endpoint || config.TracingEnabled != enabled {
+			t.Errorf("flags %v: TracingEndpoint %q, TracingEnabled %t, want %q, %t",
+				tt.flags, config.TracingEndpoint, config.TracingEnabled, tt.endpoint, enabled)
+		}
+	}
+}
+
+func TestConfigClusters(t *testing.T) {
+	config, err := Load(map[string]string{"AWS_REGION": "us-west-2", "ECS_CLUSTER": "tenants, eu-central-1:tenants-eu,"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ClusterConfig{{Region: "us-west-2", Cluster: "tenants"}, {Region: "eu-central-1", Cluster: "tenants-eu"}}
+	if len(config.Clusters) != 2 || config.Clusters[0] != want[0] || config.Clusters[1] != want[1] {
+		t.Errorf("Clusters = %v, want %v", config.Clusters, want)
+	}
+
+	for _, value := range []string{":tenants", "eu-central-1:", ","} {
+		if _, err := Load(map[string]string{"ECS_CLUSTER": value}, "", nil); err == nil {
+			t.Errorf("ECS_CLUSTER=%q accepted", value)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// parseErrorMessages parses ERROR_MESSAGES, a JSON object mapping error
+// codes to the text/template of their message.
+func parseErrorMessages(value string) (map[string]*template.Template, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var messages map[string]string
+	if err := json.Unmarshal([]byte(value), &messages); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of error codes to messages: %w", err)
+	}
+	templates := make(map[string]*template.Template, len(messages))
+	for code, message := range messages {
+		tmpl, err := template.New(code).Option("missingkey=error").Parse(message)
+		if err != nil {
+			return nil, fmt.Errorf("message of %s: %w", code, err)
+		}
+		templates[code] = tmpl
+	}
+	return templates, nil
+}
@@ -0,0 +1,4 @@
+package config
+
+// UnixScheme prefixes the path of a unix domain socket in PROXY_LISTEN.
+const UnixScheme = "unix://"
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaintenanceFromConfig is the Source of the windows of MAINTENANCE.
+const MaintenanceFromConfig = "config"
+
+// MaintenanceWindow answers the requests of an org with a 503 until Until,
+// or until it is lifted if that isn't set. RetryAfter is the Retry-After
+// sent, the time left until Until or RETRY_AFTER when it is zero.
+type MaintenanceWindow struct {
+	Org        string        `json:"org"`
+	Message    string        `json:"message,omitempty"`
+	RetryAfter time.Duration `json:"-"`
+	Until      *time.Time    `json:"until,omitempty"`
+	// Source is config for the windows of MAINTENANCE and admin for the
+	// ones set through the admin endpoints, which come first.
+	Source string `json:"source"`
+	// Caller is the address an admin window was set from.
+	Caller string `json:"caller,omitempty"`
+}
+
+// Expired reports whether the window ended by now.
+func (m MaintenanceWindow) Expired(now time.Time) bool {
+	return m.Until != nil && !now.Before(*m.Until)
+}
+
+// MarshalJSON renders RetryAfter as a duration string.
+func (m MaintenanceWindow) MarshalJSON() ([]byte, error) {
+	type window MaintenanceWindow
+	retryAfter := ""
+	if m.RetryAfter > 0 {
+		retryAfter = m.RetryAfter.String()
+	}
+	return json.Marshal(struct {
+		window
+		RetryAfter string `json:"retry_after,omitempty"`
+	}{window(m), retryAfter})
+}
+
+// UnmarshalJSON reads a window as MarshalJSON writes it.
+func (m *MaintenanceWindow) UnmarshalJSON(data []byte) error {
+	type window MaintenanceWindow
+	var decoded struct {
+		window
+		RetryAfter string `json:"retry_after"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*m = MaintenanceWindow(decoded.window)
+	if decoded.RetryAfter != "" {
+		retryAfter, err := time.ParseDuration(decoded.RetryAfter)
+		if err != nil || retryAfter <= 0 {
+			return fmt.Errorf("invalid retry_after %q, must be a positive duration", decoded.RetryAfter)
+		}
+		m.RetryAfter = retryAfter
+	}
+	return nil
+}
+
+// MaintenanceSpec is a window as written in MAINTENANCE and in the body of
+// POST /admin/maintenance/{org}.
+type MaintenanceSpec struct {
+	Message    string     `json:"message"`
+	RetryAfter string     `json:"retry_after"`
+	Until      *time.Time `json:"until"`
+}
+
+// Window validates spec and returns the window of org it describes.
+func (s MaintenanceSpec) Window(org, source string) (MaintenanceWindow, error) {
+	window := MaintenanceWindow{Org: org, Message: s.Message, Until: s.Until, Source: source}
+	if s.RetryAfter != "" {
+		retryAfter, err := time.ParseDuration(s.RetryAfter)
+		if err != nil || retryAfter <= 0 {
+			return MaintenanceWindow{}, fmt.Errorf("invalid retry_after %q, must be a positive duration", s.RetryAfter)
+		}
+		window.RetryAfter = retryAfter
+	}
+	return window, nil
+}
+
+// parseMaintenance parses MAINTENANCE, a JSON object mapping orgs to their
+// window: an object of message, retry_after and until, each optional. The
+// windows are keyed by normalized org.
+func parseMaintenance(value string) (map[string]MaintenanceWindow, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var specs map[string]MaintenanceSpec
+	if err := json.Unmarshal([]byte(value), &specs); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of orgs to message, retry_after and until: %w", err)
+	}
+	windows := make(map[string]MaintenanceWindow, len(specs))
+	for org, spec := range specs {
+		window, err := spec.Window(org, MaintenanceFromConfig)
+		if err != nil {
+			return nil, fmt.Errorf("org %s: %w", org, err)
+		}
+		key := NormalizeOrg(org)
+		if _, ok := windows[key]; ok {
+			return nil, fmt.Errorf("org %s has several windows", org)
+		}
+		windows[key] = window
+	}
+	return windows, nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MirrorRule sends a share of the requests of an org to a shadow target.
+type MirrorRule struct {
+	// Target is a host:port, or the name of a service picked from the
+	// route table like an org's.
+	Target string
+	// Percent of the requests of the org are mirrored.
+	Percent float64
+}
+
+// parseMirrors parses MIRROR, a comma separated list of org|target|percent
+// entries, such as acme|acme-v2|10 or acme|10.0.3.7:8080|100.
+func parseMirrors(value string) (map[string]MirrorRule, error) {
+	rules := map[string]MirrorRule{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid mirror entry %q, expected org|target|percent", entry)
+		}
+		if strings.Contains(parts[1], ":") {
+			if _, port, err := net.SplitHostPort(parts[1]); err != nil || port == "" {
+				return nil, fmt.Errorf("invalid mirror target %q of org %s, expected host:port or a service name", parts[1], parts[0])
+			}
+		}
+		percent, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percent %q of org %s, must be above 0 and up to 100", parts[2], parts[0])
+		}
+		org := NormalizeOrg(parts[0])
+		if _, ok := rules[org]; ok {
+			return nil, fmt.Errorf("duplicate mirror of org %s", parts[0])
+		}
+		rules[org] = MirrorRule{Target: parts[1], Percent: percent}
+	}
+	return rules, nil
+}
@@ -0,0 +1,153 @@
+package config
+
+// Access log levels for ACCESS_LOG.
+const (
+	AccessLogOff   = "off"
+	AccessLogDebug = "debug"
+	AccessLogInfo  = "info"
+)
+
+// Address family preferences for ADDRESS_FAMILY.
+const (
+	AddressFamilyIPv4       = "ipv4"
+	AddressFamilyIPv6       = "ipv6"
+	AddressFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// Policies for AMBIGUOUS_MATCH, resolving an org ID that no service is named
+// after but several contain.
+const (
+	// AmbiguousMatchFirst routes to the first service discovered, as when
+	// ambiguity wasn't detected.
+	AmbiguousMatchFirst = "first"
+	// AmbiguousMatchClosest routes to the service with the shortest name,
+	// the one with the fewest characters besides the org ID. A tie is
+	// rejected.
+	AmbiguousMatchClosest = "closest"
+	// AmbiguousMatchPriority routes to the service listed first in
+	// AMBIGUOUS_MATCH_PRIORITY. Orgs matching none listed are rejected.
+	AmbiguousMatchPriority = "priority"
+	// AmbiguousMatchReject answers 409 ambiguous_org.
+	AmbiguousMatchReject = "reject"
+)
+
+const (
+	// LBStrategyRoundRobin rotates through the backends of a service.
+	LBStrategyRoundRobin = "roundrobin"
+	// LBStrategyLeastConn picks the backend with the fewest requests in
+	// flight, breaking ties randomly.
+	LBStrategyLeastConn = "leastconn"
+	// LBStrategyRandom picks a backend at random.
+	LBStrategyRandom = "random"
+)
+
+// Client certificate modes of CLIENT_AUTH.
+const (
+	// ClientAuthNone doesn't ask clients for a certificate.
+	ClientAuthNone = "none"
+	// ClientAuthRequest verifies the certificate of the clients that send
+	// one.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire turns down clients without a valid certificate.
+	ClientAuthRequire = "require-and-verify"
+)
+
+// Log formats for LOG_FORMAT.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Metrics sinks for METRICS_SINK.
+const (
+	MetricsSinkNone       = "none"
+	MetricsSinkCloudWatch = "cloudwatch"
+	MetricsSinkStatsD     = "statsd"
+)
+
+const (
+	// ProxyModeRedirect answers with a redirect to the backend.
+	ProxyModeRedirect = "redirect"
+	// ProxyModeForward forwards the request to the backend and relays its
+	// response.
+	ProxyModeForward = "forward"
+)
+
+// Startup modes for STARTUP_MODE.
+const (
+	// StartupModeFailFast opens the listener once discovery succeeded and
+	// exits if it doesn't within the startup timeout.
+	StartupModeFailFast = "failfast"
+	// StartupModeDegraded opens the listener right away, answers 503 and
+	// reports not ready until discovery succeeds.
+	StartupModeDegraded = "degraded"
+)
+
+// Route stores for ROUTE_STORE.
+const (
+	// RouteStoreLocal discovers the routes in every replica.
+	RouteStoreLocal = "local"
+	// RouteStoreRedis shares the routes discovered by one replica at a time
+	// through Redis.
+	RouteStoreRedis = "redis"
+)
+
+// Authentication modes of AUTH_MODE.
+const (
+	// AuthModeNone authenticates requests with API keys and tokens alone,
+	// when those are configured.
+	AuthModeNone = "none"
+	// AuthModeSigV4 requires requests to carry an STS GetCallerIdentity
+	// request presigned with the caller's IAM credentials.
+	AuthModeSigV4 = "sigv4"
+)
+
+// Where routes come from.
+const (
+	// DiscoveryModeECS discovers the tasks of the ECS clusters.
+	DiscoveryModeECS = "ecs"
+	// DiscoveryModeStatic reads them from STATIC_ROUTES, without AWS.
+	DiscoveryModeStatic = "static"
+)
+
+// Task selection policies for TASK_SELECTION.
+const (
+	TaskSelectionAll            = "all"
+	TaskSelectionLatestRevision = "latest-revision"
+)
+
+// ECS_HEALTH_UNKNOWN values.
+const (
+	ECSHealthUnknownInclude = "include"
+	ECSHealthUnknownExclude = "exclude"
+)
+
+// Task set selections for ROUTE_TASK_SETS.
+const (
+	// TaskSetsPrimary routes to the live task set of a service: its PRIMARY
+	// one or, without one, its steady ACTIVE ones of the largest scale.
+	TaskSetsPrimary = "primary"
+	// TaskSetsAll routes to every task set of a service.
+	TaskSetsAll = "all"
+)
+
+// Modes for AMZN_TRACE_ID.
+const (
+	// AmznTraceIDOff forwards X-Amzn-Trace-Id as the client sent it, if at
+	// all.
+	AmznTraceIDOff = "off"
+	// AmznTraceIDRoot gives the requests without a valid Root= a fresh one,
+	// so the backends always log a trace ID.
+	AmznTraceIDRoot = "root"
+	// AmznTraceIDSelf also adds a Self= field for the proxy, replacing the
+	// one of the hop before, as an ALB does.
+	AmznTraceIDSelf = "self"
+)
+
+const (
+	// AZAffinityOff picks backends in every availability zone alike.
+	AZAffinityOff = "off"
+	// AZAffinityPrefer picks backends in the proxy's availability zone
+	// when one of them can take the request.
+	AZAffinityPrefer = "prefer"
+)
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseOrgConcurrency parses ORG_MAX_CONCURRENT_ORGS, a comma separated
+// list of org|limit entries, such as acme|500.
+func parseOrgConcurrency(value string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid concurrency limit entry %q, expected org|limit", entry)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid concurrency limit %q of org %s, must be a positive integer", parts[1], parts[0])
+		}
+		org := NormalizeOrg(parts[0])
+		if _, ok := limits[org]; ok {
+			return nil, fmt.Errorf("duplicate concurrency limit of org %s", parts[0])
+		}
+		limits[org] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// orgHeadersAll is the org of the rule applying to every org.
+const orgHeadersAll = "*"
+
+// orgHeaderOrg is replaced by the normalized org in the values of rules.
+const orgHeaderOrg = "{{org}}"
+
+// orgHeaderReserved are the headers rules can't set, they belong to the
+// connection to the backend.
+var orgHeaderReserved = map[string]bool{
+	"Host":              true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// orgHeader is a header set on the requests forwarded for an org.
+type orgHeader struct {
+	Name  string
+	Value string
+}
+
+// OrgHeaders are the headers of ORG_HEADERS by normalized org, orgHeadersAll
+// for those of every org. A nil orgHeaders sets none.
+type OrgHeaders map[string][]orgHeader
+
+// parseOrgHeaders parses ORG_HEADERS, a JSON object mapping orgs, or * for
+// every org, to an object of header names to values. {{org}} in a value
+// stands for the normalized org. Each rule's headers are sorted by name.
+func parseOrgHeaders(value string) (OrgHeaders, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw map[string]map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of orgs to objects of header names to values: %w", err)
+	}
+	rules := make(OrgHeaders, len(raw))
+	for org, headers := range raw {
+		key := NormalizeOrg(org)
+		if key == "" {
+			return nil, fmt.Errorf("empty org")
+		}
+		if _, ok := rules[key]; ok {
+			return nil, fmt.Errorf("org %s is given twice", org)
+		}
+		rule := make([]orgHeader, 0, len(headers))
+		for name, value := range headers {
+			if !validHeaderName(name) || orgHeaderReserved[http.CanonicalHeaderKey(name)] {
+				return nil, fmt.Errorf("org %s: invalid header name %q", org, name)
+			}
+			if value == "" || strings.ContainsFunc(value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+				return nil, fmt.Errorf("org %s: invalid value %q of header %s", org, value, name)
+			}
+			rule = append(rule, orgHeader{Name: http.CanonicalHeaderKey(name), Value: value})
+		}
+		sort.Slice(rule, func(i, j int) bool { return rule[i].Name < rule[j].Name })
+		rules[key] = rule
+	}
+	return rules, nil
+}
+
+// Apply sets the headers of org on r, those of every org first so the ones
+// of org win. They replace whatever the client sent under the same names,
+// so clients can't pass for another tier or region.
+func (h OrgHeaders) Apply(r *http.Request, org string) {
+	if len(h) == 0 {
+		return
+	}
+	org = NormalizeOrg(org)
+	for _, key := range []string{orgHeadersAll, org} {
+		for _, header := range h[key] {
+			r.Header.Set(header.Name, strings.ReplaceAll(header.Value, orgHeaderOrg, org))
+		}
+	}
+}
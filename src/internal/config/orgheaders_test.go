@@ -0,0 +1,55 @@
+package config
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseOrgHeaders(t *testing.T) {
+	rules, err := parseOrgHeaders(`{"*": {"x-tenant": "{{org}}"}, " ACME ": {"X-Tenant-Tier": "enterprise", "x-data-region": "eu"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the orgs are normalized, the header names canonical and sorted
+	if got := rules["acme"]; len(got) != 2 || got[0] != (orgHeader{Name: "X-Data-Region", Value: "eu"}) || got[1] != (orgHeader{Name: "X-Tenant-Tier", Value: "enterprise"}) {
+		t.Errorf("rule of acme %+v", got)
+	}
+	for _, tt := range []struct {
+		org  string
+		want http.Header
+	}{
+		{org: "Acme", want: http.Header{"X-Tenant": {"acme"}, "X-Tenant-Tier": {"enterprise"}, "X-Data-Region": {"eu"}}},
+		{org: "globex", want: http.Header{"X-Tenant": {"globex"}}},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "http://10.0.0.1:8080/", nil)
+		rules.Apply(r, tt.org)
+		for name, want := range tt.want {
+			if got := r.Header.Get(name); got != want[0] {
+				t.Errorf("%s: %s %q, want %q", tt.org, name, got, want[0])
+			}
+		}
+		if len(r.Header) != len(tt.want) {
+			t.Errorf("%s: headers %v, want %v", tt.org, r.Header, tt.want)
+		}
+	}
+
+	if rules, err := parseOrgHeaders(" "); err != nil || rules != nil {
+		t.Errorf("parseOrgHeaders of nothing = %v, %v", rules, err)
+	}
+	for _, tt := range []struct {
+		value, want string
+	}{
+		{value: "acme=enterprise", want: "must be a JSON object"},
+		{value: `{"acme": {"X-Tier": "a"}, "ACME": {"X-Tier": "b"}}`, want: "is given twice"},
+		{value: `{" ": {"X-Tier": "a"}}`, want: "empty org"},
+		{value: `{"acme": {"Host": "internal"}}`, want: `invalid header name "Host"`},
+		{value: `{"acme": {"X Tier": "a"}}`, want: `invalid header name "X Tier"`},
+		{value: `{"acme": {"X-Tier": ""}}`, want: "invalid value"},
+		{value: `{"acme": {"X-Tier": "a\nb"}}`, want: "invalid value"},
+	} {
+		if _, err := parseOrgHeaders(tt.value); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseOrgHeaders(%q) = %v, want an error containing %q", tt.value, err, tt.want)
+		}
+	}
+}
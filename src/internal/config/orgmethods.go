@@ -0,0 +1,63 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// AllowedMethods are the methods of ALLOWED_METHODS by normalized org,
+// orgHeadersAll for those of the orgs without a rule of their own. A nil
+// allowedMethods allows any.
+type AllowedMethods map[string][]string
+
+// parseAllowedMethods parses ALLOWED_METHODS, a JSON object mapping orgs, or
+// * for every other org, to the list of methods they may use. Methods are
+// upper-cased, and each list is sorted without duplicates.
+func parseAllowedMethods(value string) (AllowedMethods, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of orgs to lists of methods: %w", err)
+	}
+	rules := make(AllowedMethods, len(raw))
+	for org, methods := range raw {
+		key := NormalizeOrg(org)
+		if key == "" {
+			return nil, fmt.Errorf("empty org")
+		}
+		if _, ok := rules[key]; ok {
+			return nil, fmt.Errorf("org %s is given twice", org)
+		}
+		if len(methods) == 0 {
+			return nil, fmt.Errorf("org %s: no methods", org)
+		}
+		rule := make([]string, 0, len(methods))
+		for _, method := range methods {
+			if !validHeaderName(method) {
+				return nil, fmt.Errorf("org %s: invalid method %q", org, method)
+			}
+			rule = append(rule, strings.ToUpper(method))
+		}
+		slices.Sort(rule)
+		rules[key] = slices.Compact(rule)
+	}
+	return rules, nil
+}
+
+// Allowed reports whether org may use method, and returns the methods it
+// may use, nil when it may use any. An org without a rule of its own gets
+// the one of every org.
+func (m AllowedMethods) Allowed(org, method string) ([]string, bool) {
+	rule, ok := m[NormalizeOrg(org)]
+	if !ok {
+		rule = m[orgHeadersAll]
+	}
+	if rule == nil {
+		return nil, true
+	}
+	return rule, slices.Contains(rule, method)
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PortNames are the names of the port mappings containers are reached on:
+// the one of a container, or service, in orgs and name otherwise. The zero
+// PortNames selects no mapping by name.
+type PortNames struct {
+	name string
+	orgs map[string]string
+}
+
+// parsePortNames parses TARGET_PORT_NAME_ORGS, a comma separated list of
+// org|name entries, such as billing|http.
+func parsePortNames(value string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		org, name, ok := strings.Cut(entry, "|")
+		if !ok || org == "" || name == "" || strings.Contains(name, "|") {
+			return nil, fmt.Errorf("invalid port name entry %q, expected org|name", entry)
+		}
+		if _, ok := names[org]; ok {
+			return nil, fmt.Errorf("duplicate port name of org %s", org)
+		}
+		names[org] = name
+	}
+	return names, nil
+}
+
+// Of returns the name of the mapping container is reached on, empty if
+// none.
+func (n PortNames) Of(container string) string {
+	if name, ok := n.orgs[container]; ok {
+		return name
+	}
+	return n.name
+}
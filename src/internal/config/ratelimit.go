@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens a second and
+// holding at most Burst of them.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimits parses RATE_LIMIT_ORGS, a comma separated list of
+// org|rate|burst entries where the burst may be empty, such as acme|50|100
+// or contoso|5|.
+func parseRateLimits(value string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid rate limit entry %q, expected org|rate|burst", entry)
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %q of org %s, must be a positive number", parts[1], parts[0])
+		}
+		limit := RateLimit{Rate: rate, Burst: defaultBurst(rate)}
+		if parts[2] != "" {
+			limit.Burst, err = strconv.Atoi(parts[2])
+			if err != nil || limit.Burst < 1 {
+				return nil, fmt.Errorf("invalid burst %q of org %s, must be a positive integer", parts[2], parts[0])
+			}
+		}
+		org := NormalizeOrg(parts[0])
+		if _, ok := limits[org]; ok {
+			return nil, fmt.Errorf("duplicate rate limit of org %s", parts[0])
+		}
+		limits[org] = limit
+	}
+	return limits, nil
+}
+
+// defaultBurst is the burst of a rate without one, a second worth of
+// requests.
+func defaultBurst(rate float64) int {
+	return max(1, int(math.Ceil(rate)))
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// responseHeader sets a header on the responses of an org, or removes it
+// when Remove is set.
+type responseHeader struct {
+	Name   string
+	Value  string
+	Remove bool
+}
+
+// ResponseHeaders are the rules of RESPONSE_HEADERS by normalized org,
+// orgHeadersAll for those of every org. A nil responseHeaders changes
+// nothing.
+type ResponseHeaders map[string][]responseHeader
+
+// parseResponseHeaders parses RESPONSE_HEADERS, a JSON object mapping orgs,
+// or * for every org, to an object of header names to the value they are
+// set to, or to null to remove them. Each rule's headers are sorted by name.
+func parseResponseHeaders(value string) (ResponseHeaders, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw map[string]map[string]*string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of orgs to objects of header names to values or null: %w", err)
+	}
+	rules := make(ResponseHeaders, len(raw))
+	for org, headers := range raw {
+		key := NormalizeOrg(org)
+		if key == "" {
+			return nil, fmt.Errorf("empty org")
+		}
+		if _, ok := rules[key]; ok {
+			return nil, fmt.Errorf("org %s is given twice", org)
+		}
+		rule := make([]responseHeader, 0, len(headers))
+		for name, value := range headers {
+			if !validHeaderName(name) || orgHeaderReserved[http.CanonicalHeaderKey(name)] {
+				return nil, fmt.Errorf("org %s: invalid header name %q", org, name)
+			}
+			header := responseHeader{Name: http.CanonicalHeaderKey(name), Remove: value == nil}
+			if value != nil {
+				header.Value = *value
+				if header.Value == "" || strings.ContainsFunc(header.Value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+					return nil, fmt.Errorf("org %s: invalid value %q of header %s", org, header.Value, name)
+				}
+			}
+			rule = append(rule, header)
+		}
+		sort.Slice(rule, func(i, j int) bool { return rule[i].Name < rule[j].Name })
+		rules[key] = rule
+	}
+	return rules, nil
+}
+
+// Apply applies the rules of every org, then those of org, to header.
+func (h ResponseHeaders) Apply(header http.Header, org string) {
+	if len(h) == 0 {
+		return
+	}
+	for _, key := range []string{orgHeadersAll, NormalizeOrg(org)} {
+		for _, rule := range h[key] {
+			if rule.Remove {
+				header.Del(rule.Name)
+			} else {
+				header.Set(rule.Name, rule.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// secretPrefix marks a config value read from Secrets Manager, written as
+// secretsmanager:<arn-or-name>[#json-key].
+const secretPrefix = "secretsmanager:"
+
+// secretFetchTimeout bounds each fetch of a secret.
+const secretFetchTimeout = 10 * time.Second
+
+// SecretResolver substitutes the config values that reference a Secrets
+// Manager secret. Each secret is fetched once and cached; Refresh fetches
+// them again, so a rotated secret is picked up by the next reload.
+// newClient returns the client of a region, the default one if it is
+// empty, so Secrets Manager can be faked.
+type SecretResolver struct {
+	newClient func(region string) (SecretsAPI, error)
+
+	mu      sync.Mutex
+	clients map[string]SecretsAPI
+	secrets map[string]cachedSecret
+}
+
+// cachedSecret is the string of a secret and the version it is from.
+type cachedSecret struct {
+	value   string
+	version string
+}
+
+// NewSecretResolver returns a resolver with no secret cached yet.
+func NewSecretResolver(newClient func(region string) (SecretsAPI, error)) *SecretResolver {
+	return &SecretResolver{
+		newClient: newClient,
+		clients:   map[string]SecretsAPI{},
+		secrets:   map[string]cachedSecret{},
+	}
+}
+
+// Resolve returns the value ref, without its prefix, names, and the
+// version of the secret it is from. With a #json-key the secret must be a
+// JSON object and the value is that key's, rendered as JSON unless it is a
+// string. Errors name the secret but never hold its value.
+func (s *SecretResolver) Resolve(ref string) (string, string, error) {
+	id, key, _ := strings.Cut(ref, "#")
+	if id == "" {
+		return "", "", errors.New("empty secret name")
+	}
+	secret, err := s.secret(id)
+	if err != nil {
+		return "", "", err
+	}
+	if key == "" {
+		return secret.value, secret.version, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(secret.value), &fields); err != nil {
+		return "", "", fmt.Errorf("secret %s is not a JSON object", id)
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", "", fmt.Errorf("secret %s has no key %s", id, key)
+	}
+	var value string
+	if json.Unmarshal(field, &value) != nil {
+		value = string(field)
+	}
+	return value, secret.version, nil
+}
+
+// secret returns the cached secret id, fetching it the first time.
+func (s *SecretResolver) secret(id string) (cachedSecret, error) {
+	s.mu.Lock()
+	secret, ok := s.secrets[id]
+	s.mu.Unlock()
+	if ok {
+		return secret, nil
+	}
+	secret, err := s.fetch(id)
+	if err != nil {
+		return cachedSecret{}, err
+	}
+	s.mu.Lock()
+	s.secrets[id] = secret
+	s.mu.Unlock()
+	return secret, nil
+}
+
+// fetch reads the current version of secret id, from the region of its ARN
+// if it is one.
+func (s *SecretResolver) fetch(id string) (cachedSecret, error) {
+	var region string
+	if parts := strings.Split(id, ":"); len(parts) >= 7 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	client, err := s.client(region)
+	if err != nil {
+		return cachedSecret{}, fmt.Errorf("secret %s: %w", id, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		return cachedSecret{}, fmt.Errorf("secret %s: %w", id, err)
+	}
+	if out.SecretString == nil {
+		return cachedSecret{}, fmt.Errorf("secret %s is binary, only string secrets are supported", id)
+	}
+	return cachedSecret{value: *out.SecretString, version: aws.ToString(out.VersionId)}, nil
+}
+
+// client returns the client of region, creating it the first time.
+func (s *SecretResolver) client(region string) (SecretsAPI, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.clients[region]; ok {
+		return client, nil
+	}
+	client, err := s.newClient(region)
+	if err != nil {
+		return nil, err
+	}
+	s.clients[region] = client
+	return client, nil
+}
+
+// Refresh fetches every cached secret again and reports whether one of them
+// changed. A secret that can't be fetched keeps its cached value.
+func (s *SecretResolver) Refresh() (bool, error) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.secrets))
+	for id := range s.secrets {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	changed := false
+	var errs []error
+	for _, id := range ids {
+		secret, err := s.fetch(id)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.mu.Lock()
+		if s.secrets[id] != secret {
+			s.secrets[id], changed = secret, true
+		}
+		s.mu.Unlock()
+	}
+	return changed, errors.Join(errs...)
+}
+
+// Run fetches the secrets again every interval until ctx is done, and calls
+// changed when one of them was rotated.
+func (s *SecretResolver) Run(ctx context.Context, interval time.Duration, changed func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.RefreshAndLog() {
+				changed()
+			}
+		}
+	}
+}
+
+// RefreshAndLog refreshes the secrets, logs the outcome and reports whether one
+// of them changed.
+func (s *SecretResolver) RefreshAndLog() bool {
+	changed, err := s.Refresh()
+	if err != nil {
+		slog.Error("Failed to refresh secrets, keeping the cached ones", "error", err)
+	}
+	if changed {
+		slog.Info("Secrets rotated, reloading the configuration", "audit", true)
+	}
+	return changed
+}
+
+// SecretsAPI is the part of the Secrets Manager client SecretResolver uses.
+type SecretsAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// fakeSecret is a secret of fakeSecretsAPI, binary if value is nil.
+type fakeSecret struct {
+	value   *string
+	version string
+}
+
+// fakeSecretsAPI serves secrets by id, failing every call while err is set.
+type fakeSecretsAPI struct {
+	secrets map[string]fakeSecret
+	err     error
+	calls   int
+}
+
+func (f *fakeSecretsAPI) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	secret, ok := f.secrets[aws.ToString(params.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException: secret not found")
+	}
+	out := &secretsmanager.GetSecretValueOutput{SecretString: secret.value, VersionId: aws.String(secret.version)}
+	if secret.value == nil {
+		out.SecretBinary = []byte("hunter2")
+	}
+	return out, nil
+}
+
+func newFakeSecrets() (*fakeSecretsAPI, *SecretResolver) {
+	client := &fakeSecretsAPI{secrets: map[string]fakeSecret{
+		"proxy/token":  {value: aws.String("hunter2"), version: "v1"},
+		"proxy/keys":   {value: aws.String(`{"token": "hunter2", "port": 8443, "tls": {"on": true}}`), version: "v1"},
+		"proxy/binary": {version: "v1"},
+	}}
+	return client, NewSecretResolver(func(string) (SecretsAPI, error) { return client, nil })
+}
+
+func TestSecretResolverResolve(t *testing.T) {
+	for _, tt := range []struct {
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{ref: "proxy/token", want: "hunter2"},
+		{ref: "proxy/keys#token", want: "hunter2"},
+		{ref: "proxy/keys#port", want: "8443"},
+		{ref: "proxy/keys#tls", want: `{"on": true}`},
+		{ref: "proxy/keys#missing", wantErr: "secret proxy/keys has no key missing"},
+		{ref: "proxy/token#token", wantErr: "secret proxy/token is not a JSON object"},
+		{ref: "proxy/binary", wantErr: "secret proxy/binary is binary, only string secrets are supported"},
+		{ref: "proxy/none", wantErr: "secret proxy/none: ResourceNotFoundException"},
+		{ref: "#token", wantErr: "empty secret name"},
+	} {
+		_, secrets := newFakeSecrets()
+		value, version, err := secrets.Resolve(tt.ref)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Resolve(%q) = %q, %v, want an error %q", tt.ref, value, err, tt.wantErr)
+			} else if strings.Contains(err.Error(), "hunter2") {
+				t.Errorf("Resolve(%q) error holds the secret: %v", tt.ref, err)
+			}
+			continue
+		}
+		if err != nil || value != tt.want || version != "v1" {
+			t.Errorf("Resolve(%q) = %q, %q, %v, want %q of v1", tt.ref, value, version, err, tt.want)
+		}
+	}
+}
+
+func TestSecretResolverRegion(t *testing.T) {
+	var regions []string
+	client, _ := newFakeSecrets()
+	client.secrets["arn:aws:secretsmanager:eu-west-1:123456789012:secret:proxy/token-AbCdEf"] = fakeSecret{value: aws.String("hunter2"), version: "v1"}
+	secrets := NewSecretResolver(func(region string) (SecretsAPI, error) {
+		regions = append(regions, region)
+		return client, nil
+	})
+	for _, ref := range []string{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:proxy/token-AbCdEf", "proxy/token", "proxy/keys#token", "proxy/keys#port"} {
+		if _, _, err := secrets.Resolve(ref); err != nil {
+			t.Fatalf("Resolve(%q): %v", ref, err)
+		}
+	}
+	// a client per region, and each secret fetched once whatever the keys
+	// read from it
+	if strings.Join(regions, ",") != "eu-west-1," {
+		t.Errorf("clients created for regions %q, want eu-west-1 and the default one", regions)
+	}
+	if client.calls != 3 {
+		t.Errorf("%d fetches, want one per secret", client.calls)
+	}
+}
+
+func TestSecretResolverRefresh(t *testing.T) {
+	client, secrets := newFakeSecrets()
+	if _, _, err := secrets.Resolve("proxy/keys#token"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := secrets.Refresh(); changed || err != nil {
+		t.Errorf("Refresh of an unchanged secret = %t, %v", changed, err)
+	}
+
+	client.secrets["proxy/keys"] = fakeSecret{value: aws.String(`{"token": "correct horse"}`), version: "v2"}
+	if changed, err := secrets.Refresh(); !changed || err != nil {
+		t.Errorf("Refresh of a rotated secret = %t, %v", changed, err)
+	}
+	if value, version, _ := secrets.Resolve("proxy/keys#token"); value != "correct horse" || version != "v2" {
+		t.Errorf("after the rotation the token is %q of %s, want the v2 one", value, version)
+	}
+
+	// a failed fetch keeps the cached secret
+	client.err = errors.New("AccessDeniedException")
+	if changed, err := secrets.Refresh(); changed || err == nil || strings.Contains(err.Error(), "correct horse") {
+		t.Errorf("Refresh failing = %t, %v, want an error without the secret", changed, err)
+	}
+	if value, _, _ := secrets.Resolve("proxy/keys#token"); value != "correct horse" {
+		t.Errorf("after a failed refresh the token is %q, want the cached one", value)
+	}
+}
+
+func TestLoadSecretReferences(t *testing.T) {
+	_, secrets := newFakeSecrets()
+	t.Setenv("ECS_CLUSTER", "tenants")
+	t.Setenv("ADMIN_ADDR", "127.0.0.1:9901")
+	config, err := Load(map[string]string{"ADMIN_TOKEN": "secretsmanager:proxy/keys#token", "PROXY_PORT": "secretsmanager:proxy/keys#port"}, "", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AdminToken != "hunter2" || config.ProxyPort != 8443 {
+		t.Errorf("AdminToken %q, ProxyPort %d, want the secret's", config.AdminToken, config.ProxyPort)
+	}
+	if got := config.Settings["ADMIN_TOKEN"]; got != "secretsmanager:proxy/keys#token (version v1)" {
+		t.Errorf("ADMIN_TOKEN recorded as %q, want its reference", got)
+	}
+
+	// a secret that isn't a valid value is reported by its reference
+	_, err = Load(map[string]string{"PROXY_PORT": "secretsmanager:proxy/token", "LOG_FORMAT": "secretsmanager:proxy/keys#token"}, "", secrets)
+	if err == nil || !strings.Contains(err.Error(), "invalid PROXY_PORT") || !strings.Contains(err.Error(), "secretsmanager:proxy/token (version v1)") {
+		t.Errorf("Load with invalid secrets = %v, want PROXY_PORT reported by reference", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Load error holds the secret: %v", err)
+	}
+
+	if _, err := Load(map[string]string{"ADMIN_TOKEN": "secretsmanager:proxy/token"}, "", nil); err == nil {
+		t.Error("Load of a secret reference without a resolver succeeded")
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SecurityHeader is a header set on every response of the proxy listeners.
+type SecurityHeader struct {
+	Name  string
+	Value string
+	// Override replaces the value a backend set, which is kept otherwise.
+	Override bool
+}
+
+// parseSecurityHeaders parses SECURITY_HEADERS, a JSON object mapping
+// header names to their value, or to an object of value and override. The
+// headers are returned sorted by name.
+func parseSecurityHeaders(value string) ([]SecurityHeader, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of header names to values: %w", err)
+	}
+	headers := make([]SecurityHeader, 0, len(raw))
+	for name, spec := range raw {
+		header := SecurityHeader{Name: http.CanonicalHeaderKey(name)}
+		if err := json.Unmarshal(spec, &header.Value); err != nil {
+			var object struct {
+				Value    string `json:"value"`
+				Override bool   `json:"override"`
+			}
+			if err := json.Unmarshal(spec, &object); err != nil {
+				return nil, fmt.Errorf("header %s must be a value or an object of value and override", name)
+			}
+			header.Value, header.Override = object.Value, object.Override
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if header.Value == "" || strings.ContainsFunc(header.Value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+			return nil, fmt.Errorf("invalid value %q of header %s", header.Value, name)
+		}
+		headers = append(headers, header)
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers, nil
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseSigV4Principals parses SIGV4_PRINCIPALS, a comma separated list of
+// principal=org|org entries, where * stands for every org. Role names may
+// contain =, so the orgs follow the last one.
+func parseSigV4Principals(value string) (clientOrgs, error) {
+	var orgs clientOrgs
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid principal entry %q, expected principal=org|org", entry)
+		}
+		if orgs == nil {
+			orgs = clientOrgs{}
+		}
+		orgs[entry[:i]] = append(orgs[entry[:i]], strings.Split(entry[i+1:], "|")...)
+	}
+	return orgs, nil
+}
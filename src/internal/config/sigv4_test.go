@@ -0,0 +1,21 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigSigV4RequiresAudience(t *testing.T) {
+	flags := map[string]string{
+		"ECS_CLUSTER":      "c",
+		"AUTH_MODE":        "sigv4",
+		"SIGV4_PRINCIPALS": "arn:aws:iam::123456789012:role/app=acme",
+	}
+	if _, err := Load(flags, "", nil); err == nil || !strings.Contains(err.Error(), "AUTH_MODE=sigv4 requires SIGV4_AUDIENCE") {
+		t.Errorf("sigv4 without an audience: %v", err)
+	}
+	flags["SIGV4_AUDIENCE"] = "prod"
+	if _, err := Load(flags, "", nil); err != nil {
+		t.Errorf("sigv4 with an audience: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseStaticRoutes parses static routes, a JSON object mapping org IDs to
+// a host:port target or a list of them. It only checks their syntax, hosts
+// are resolved by Load.
+func ParseStaticRoutes(data []byte) (map[string][]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of org IDs to host:port targets: %w", err)
+	}
+	routes := make(map[string][]string, len(raw))
+	for org, value := range raw {
+		var targets []string
+		if err := json.Unmarshal(value, &targets); err != nil {
+			var target string
+			if err := json.Unmarshal(value, &target); err != nil {
+				return nil, fmt.Errorf("org %s: expected a host:port target or a list of them", org)
+			}
+			targets = []string{target}
+		}
+		if strings.TrimSpace(org) == "" {
+			return nil, fmt.Errorf("empty org ID")
+		}
+		for _, target := range targets {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil || host == "" {
+				return nil, fmt.Errorf("org %s: invalid target %q, expected host:port", org, target)
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("org %s: invalid port in %q", org, target)
+			}
+		}
+		routes[org] = targets
+	}
+	return routes, nil
+}
+
+// InlineStaticRoutes reports whether value, of STATIC_ROUTES, is the JSON of
+// the routes rather than the path of a file holding them.
+func InlineStaticRoutes(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), "{")
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OrgTarget overrides how the requests of an org reach its backend, for
+// tenants whose tasks don't take plain HTTP at the root of their port. The
+// zero OrgTarget sends requests to http://ip:port/ of the task.
+type OrgTarget struct {
+	// Scheme is http or https, http if empty.
+	Scheme string
+	// Port replaces the task's port unless it is 0.
+	Port int
+	// PathPrefix is prepended to the path of every request.
+	PathPrefix string
+	// Container names the container of the org's tasks requests go to,
+	// rather than the one the org matched, unless it is empty.
+	Container string
+}
+
+// ParseOrgTargets parses ORG_TARGETS, a comma separated list of
+// org|scheme|port|path-prefix entries, optionally followed by |container,
+// where every field but the org may be empty, such as
+// contoso|https|8443|/legacy or acme||||webhooks. The targets are keyed by
+// normalized org.
+func ParseOrgTargets(value string) (map[string]OrgTarget, error) {
+	targets := map[string]OrgTarget{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) < 4 || len(parts) > 5 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid org target entry %q, expected org|scheme|port|path-prefix[|container]", entry)
+		}
+		target := OrgTarget{Scheme: parts[1], PathPrefix: strings.TrimSuffix(parts[3], "/")}
+		if len(parts) == 5 {
+			target.Container = parts[4]
+		}
+		if target.Scheme != "" && target.Scheme != "http" && target.Scheme != "https" {
+			return nil, fmt.Errorf("invalid scheme %q of org %s, must be http or https", parts[1], parts[0])
+		}
+		if parts[2] != "" {
+			port, err := strconv.Atoi(parts[2])
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port %q of org %s, must be from 1 to 65535", parts[2], parts[0])
+			}
+			target.Port = port
+		}
+		if parts[3] != "" && !strings.HasPrefix(parts[3], "/") {
+			return nil, fmt.Errorf("invalid path prefix %q of org %s, must start with /", parts[3], parts[0])
+		}
+		org := NormalizeOrg(parts[0])
+		if _, ok := targets[org]; ok {
+			return nil, fmt.Errorf("duplicate org target %s", parts[0])
+		}
+		targets[org] = target
+	}
+	return targets, nil
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultTraceHeaders are the TRACE_HEADERS of X-Ray, W3C Trace Context and
+// Zipkin B3.
+const defaultTraceHeaders = "X-Amzn-Trace-Id,traceparent,tracestate,b3,X-B3-TraceId,X-B3-SpanId,X-B3-ParentSpanId,X-B3-Sampled,X-B3-Flags"
+
+// parseTraceHeaders parses TRACE_HEADERS, a comma separated list of header
+// names.
+func parseTraceHeaders(s string) ([]string, error) {
+	var headers []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		headers = append(headers, name)
+	}
+	return headers, nil
+}
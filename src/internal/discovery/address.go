@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"net/netip"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// selectAddress picks the address of a network interface to route to
+// according to the address family preference. It returns an empty string if
+// the interface has no address of an acceptable family.
+func selectAddress(ipv4, ipv6, family string) string {
+	switch family {
+	case config.AddressFamilyIPv6:
+		return ipv6
+	case config.AddressFamilyPreferIPv6:
+		if ipv6 != "" {
+			return ipv6
+		}
+		return ipv4
+	default:
+		return ipv4
+	}
+}
+
+// routable reports whether address is in one of the CIDRs. Every address is
+// routable when no CIDRs are given.
+func routable(address string, cidrs []netip.Prefix) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// containerAddress picks the single address a container is reached on: the
+// address of its first network interface, in attachment order, that is in
+// one of the routable CIDRs. It returns false if no interface qualifies.
+func containerAddress(task types.Task, container types.Container, family string, cidrs []netip.Prefix) (string, bool) {
+	for _, address := range containerAddresses(task, container, family) {
+		if routable(address, cidrs) {
+			return address, true
+		}
+	}
+	return "", false
+}
+
+// containerAddresses returns the addresses of a container's network
+// interfaces, falling back to the task's ENI attachments for containers that
+// don't report their interfaces.
+func containerAddresses(task types.Task, container types.Container, family string) []string {
+	var addresses []string
+	for _, network := range container.NetworkInterfaces {
+		address := selectAddress(aws.ToString(network.PrivateIpv4Address), aws.ToString(network.Ipv6Address), family)
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(container.NetworkInterfaces) > 0 {
+		return addresses
+	}
+
+	for _, attachment := range task.Attachments {
+		if aws.ToString(attachment.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+		var ipv4, ipv6 string
+		for _, detail := range attachment.Details {
+			switch aws.ToString(detail.Name) {
+			case "privateIPv4Address":
+				ipv4 = aws.ToString(detail.Value)
+			case "ipv6Address":
+				ipv6 = aws.ToString(detail.Value)
+			}
+		}
+		if address := selectAddress(ipv4, ipv6, family); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
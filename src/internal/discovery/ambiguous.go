@@ -0,0 +1,180 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrAmbiguousOrg means the org ID matches several services and the policy
+// couldn't pick one.
+var ErrAmbiguousOrg = errors.New("ambiguous org")
+
+// maxWatchedOrgs bounds how many orgs every refresh checks for ambiguity.
+const maxWatchedOrgs = 10000
+
+var (
+	// ambiguousMatches counts the lookups of an org matching several
+	// services per org.
+	ambiguousMatches = expvar.NewMap("ambiguous_matches")
+	// ambiguousLookups counts the lookups of an org matching several
+	// services by how they were resolved: picked or rejected.
+	ambiguousLookups = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_ambiguous_lookups_total",
+		Help: "Lookups of an org matching several services by policy and result (picked, rejected).",
+	}, []string{"policy", "result"})
+	// ambiguousOrgs is the number of known orgs matching several services
+	// as of the last refresh of each table.
+	ambiguousOrgs = promauto.With(telemetry.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecs_svc_proxy_ambiguous_orgs",
+		Help: "Known orgs matching several services as of the last refresh.",
+	}, []string{"table"})
+)
+
+// ambiguityPolicy resolves the org IDs that several services contain.
+type ambiguityPolicy struct {
+	mode     string
+	priority []string
+}
+
+// resolve returns the service of names, every one containing the org ID,
+// that the org routes to, or false if it is rejected.
+func (p ambiguityPolicy) resolve(names []string) (string, bool) {
+	switch p.mode {
+	case config.AmbiguousMatchReject:
+		return "", false
+	case config.AmbiguousMatchClosest:
+		closest, tie := names[0], false
+		for _, name := range names[1:] {
+			switch {
+			case len(name) < len(closest):
+				closest, tie = name, false
+			case len(name) == len(closest):
+				tie = true
+			}
+		}
+		return closest, !tie
+	case config.AmbiguousMatchPriority:
+		for _, preferred := range p.priority {
+			for _, name := range names {
+				if name == preferred {
+					return name, true
+				}
+			}
+		}
+		return "", false
+	default:
+		return names[0], true
+	}
+}
+
+// name returns the policy as configured, AmbiguousMatchFirst by default.
+func (p ambiguityPolicy) name() string {
+	if p.mode == "" {
+		return config.AmbiguousMatchFirst
+	}
+	return p.mode
+}
+
+// ambiguousOrg is an org matching several services, as served by
+// /debug/routes.
+type ambiguousOrg struct {
+	Org      string   `json:"org"`
+	Services []string `json:"services"`
+	// Resolved is the service the org routes to, empty if it is rejected.
+	Resolved string `json:"resolved,omitempty"`
+}
+
+// SetAmbiguity resolves the org IDs several services contain by policy, one
+// of the AmbiguousMatch constants. Every refresh checks watch, the orgs the
+// configuration names, for ambiguity, as well as the orgs routed by part of
+// a service name before. It must be called before the table is shared.
+func (t *RouteTable) SetAmbiguity(policy string, priority []string, watch []string) {
+	t.ambiguity = ambiguityPolicy{mode: policy, priority: priority}
+	for _, org := range watch {
+		t.watched[org] = true
+	}
+}
+
+// match returns the name of the service orgID routes to: the one named
+// orgID or, failing that, the one containing it that the policy picks
+// among those that do, candidates listing them if there are several. The
+// name is empty if none matches or the policy rejects the org. The caller
+// must hold t.mu.
+func (t *RouteTable) match(orgID string) (name string, candidates []string) {
+	if len(t.index[orgID]) > 0 {
+		return orgID, nil
+	}
+	// names that merely contain the org ID still route, at the cost of a scan
+	for _, svc := range t.services {
+		if strings.Contains(svc.Name, orgID) && !slices.Contains(candidates, svc.Name) {
+			candidates = append(candidates, svc.Name)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", nil
+	case 1:
+		return candidates[0], nil
+	}
+	name, _ = t.ambiguity.resolve(candidates)
+	return name, candidates
+}
+
+// ambiguous counts and logs that orgID matched candidates, resolved to name
+// or rejected if it is empty.
+func (t *RouteTable) ambiguous(orgID, name string, candidates []string) {
+	result := "picked"
+	if name == "" {
+		result = "rejected"
+	}
+	ambiguousMatches.Add(orgID, 1)
+	ambiguousLookups.WithLabelValues(t.ambiguity.name(), result).Inc()
+	if telemetry.LogSamples.Allow(context.Background(), slog.LevelWarn, "Org matches several services", orgID) {
+		slog.Warn("Org matches several services", "org", orgID, "services", candidates, "resolved", name, "policy", t.ambiguity.name())
+	}
+}
+
+// watch remembers orgID, routed by part of a service name, so every refresh
+// checks it for ambiguity.
+func (t *RouteTable) watch(orgID string) {
+	t.mu.RLock()
+	watched := t.watched[orgID]
+	t.mu.RUnlock()
+	if watched {
+		return
+	}
+	t.mu.Lock()
+	if len(t.watched) < maxWatchedOrgs {
+		t.watched[orgID] = true
+	}
+	t.mu.Unlock()
+}
+
+// detectAmbiguity checks the watched orgs against the services after a
+// refresh, logging those that became ambiguous. The caller must hold t.mu.
+func (t *RouteTable) detectAmbiguity() {
+	detected := map[string]ambiguousOrg{}
+	for org := range t.watched {
+		name, candidates := t.match(org)
+		if len(candidates) == 0 {
+			continue
+		}
+		detected[org] = ambiguousOrg{Org: org, Services: candidates, Resolved: name}
+		if _, ok := t.ambiguousOrgs[org]; !ok {
+			slog.Warn("Org matches several services, rename them or set AMBIGUOUS_MATCH", "org", org, "services", candidates,
+				"resolved", name, "policy", t.ambiguity.name(), "table", t.auditName)
+		}
+	}
+	t.ambiguousOrgs = detected
+	ambiguousOrgs.WithLabelValues(t.auditName).Set(float64(len(detected)))
+}
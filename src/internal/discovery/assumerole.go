@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// ClientFactory creates ECS clients that act on behalf of an assumed role.
+type ClientFactory interface {
+	ECSClient(role config.AssumeRole) ECSAPI
+}
+
+// STSClientFactory assumes roles through STS. The returned clients refresh
+// their credentials automatically shortly before they expire.
+type STSClientFactory struct {
+	Config aws.Config
+	// STS assumes the roles, usually an *sts.Client made from Config.
+	STS stscreds.AssumeRoleAPIClient
+	// Endpoint replaces the ECS endpoint if set, see ecsOptions.
+	Endpoint string
+}
+
+// ECSClient returns an ECS client whose credentials come from assuming role.
+func (f STSClientFactory) ECSClient(role config.AssumeRole) ECSAPI {
+	provider := stscreds.NewAssumeRoleProvider(f.STS, role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+	creds := aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = time.Minute
+	})
+	return ecs.NewFromConfig(f.Config, ecsOptions(role.Region, f.Endpoint), func(o *ecs.Options) {
+		o.Credentials = creds
+	})
+}
+
+// ecsOptions configures an ECS client for region, sending its calls to
+// endpoint instead of the region's endpoint if it is set.
+func ecsOptions(region, endpoint string) func(*ecs.Options) {
+	return func(o *ecs.Options) {
+		o.Region = region
+		// calls are retried by ECSRetryPolicy
+		o.Retryer = aws.NopRetryer{}
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// fakeAssumeRole is an STS client assuming every role, handing out
+// credentials expiring after ttl.
+type fakeAssumeRole struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	calls []sts.AssumeRoleInput
+	err   error
+}
+
+func (f *fakeAssumeRole) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, *params)
+	if f.err != nil {
+		return nil, f.err
+	}
+	n := len(f.calls)
+	return &sts.AssumeRoleOutput{Credentials: &ststypes.Credentials{
+		AccessKeyId:     aws.String("ASIAASSUMED" + strings.Repeat("X", n)),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("session-" + aws.ToString(params.RoleArn)),
+		Expiration:      aws.Time(time.Now().Add(f.ttl)),
+	}}, nil
+}
+
+func (f *fakeAssumeRole) assumed() []sts.AssumeRoleInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]sts.AssumeRoleInput(nil), f.calls...)
+}
+
+// ecsSignatures serves ListServices with no services and records the
+// access key and session token each call was signed with.
+func ecsSignatures(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var signed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		credential := r.Header.Get("Authorization")
+		if i := strings.Index(credential, "Credential="); i >= 0 {
+			credential = credential[i+len("Credential="):]
+			credential = credential[:strings.Index(credential, "/")]
+		}
+		mu.Lock()
+		signed = append(signed, credential+" "+r.Header.Get("X-Amz-Security-Token"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		io.WriteString(w, `{"serviceArns": []}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), signed...)
+	}
+}
+
+func TestSTSClientFactory(t *testing.T) {
+	server, signed := ecsSignatures(t)
+	fake := &fakeAssumeRole{ttl: time.Hour}
+	var factory ClientFactory = STSClientFactory{
+		Config:   aws.Config{Region: "us-west-2", Credentials: credentials.NewStaticCredentialsProvider("AKIABASE", "base", "")},
+		STS:      fake,
+		Endpoint: server.URL,
+	}
+	role := config.AssumeRole{RoleARN: "arn:aws:iam::111111111111:role/discovery", ExternalID: "secret", Cluster: "tenants", Region: "eu-west-1", Account: "111111111111"}
+	client := factory.ECSClient(role)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.ListServices(context.Background(), &ecs.ListServicesInput{Cluster: aws.String("tenants")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := fake.assumed()
+	if len(calls) != 1 {
+		t.Fatalf("assumed the role %d times for 3 calls, want the credentials cached", len(calls))
+	}
+	if aws.ToString(calls[0].RoleArn) != role.RoleARN || aws.ToString(calls[0].ExternalId) != "secret" {
+		t.Errorf("assumed %s with external id %q", aws.ToString(calls[0].RoleArn), aws.ToString(calls[0].ExternalId))
+	}
+	want := "ASIAASSUMEDX session-" + role.RoleARN
+	for _, got := range signed() {
+		if got != want {
+			t.Errorf("call signed with %q, want the assumed role's %q", got, want)
+		}
+	}
+}
+
+func TestSTSClientFactoryRefresh(t *testing.T) {
+	server, signed := ecsSignatures(t)
+	// credentials expiring within the expiry window are assumed again
+	// before each call
+	fake := &fakeAssumeRole{ttl: 30 * time.Second}
+	factory := STSClientFactory{Config: aws.Config{Region: "us-west-2"}, STS: fake, Endpoint: server.URL}
+	client := factory.ECSClient(config.AssumeRole{RoleARN: "arn:aws:iam::111111111111:role/discovery", Cluster: "tenants", Region: "us-west-2"})
+	for i := 0; i < 2; i++ {
+		if _, err := client.ListServices(context.Background(), &ecs.ListServicesInput{Cluster: aws.String("tenants")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := fake.assumed()
+	if len(calls) != 2 {
+		t.Fatalf("assumed the role %d times, want 2", len(calls))
+	}
+	if calls[0].ExternalId != nil {
+		t.Errorf("external id %q without one configured", aws.ToString(calls[0].ExternalId))
+	}
+	if got := signed(); len(got) != 2 || !strings.HasPrefix(got[1], "ASIAASSUMEDXX ") {
+		t.Errorf("signed with %q, want the second call signed with the refreshed credentials", got)
+	}
+}
+
+func TestSTSClientFactoryDenied(t *testing.T) {
+	server, signed := ecsSignatures(t)
+	fake := &fakeAssumeRole{ttl: time.Hour, err: &ststypes.ExpiredTokenException{Message: aws.String("token expired")}}
+	factory := STSClientFactory{Config: aws.Config{Region: "us-west-2"}, STS: fake, Endpoint: server.URL}
+	client := InstrumentECS(factory.ECSClient(config.AssumeRole{RoleARN: "arn:aws:iam::111111111111:role/discovery", Cluster: "tenants", Region: "us-west-2"}))
+	_, err := client.ListServices(context.Background(), &ecs.ListServicesInput{Cluster: aws.String("tenants")})
+	if err == nil || !strings.Contains(err.Error(), "token expired") {
+		t.Errorf("err = %v, want the STS error", err)
+	}
+	if len(signed()) != 0 {
+		t.Error("call sent without assumed credentials")
+	}
+}
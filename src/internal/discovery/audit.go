@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+)
+
+// Triggers of route changes recorded in the audit log.
+const (
+	TriggerStartup   = "startup"
+	TriggerSnapshot  = "snapshot"
+	TriggerScheduled = "scheduled"
+	TriggerOnMiss    = "on-miss"
+	TriggerStale     = "stale"
+	TriggerEvent     = "event"
+	TriggerAdmin     = "admin"
+	TriggerFile      = "file"
+)
+
+// auditRecord is one route change, written as a line of the audit file.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Table   string    `json:"table"`
+	Trigger string    `json:"trigger"`
+	Change  string    `json:"change"`
+	Service string    `json:"service"`
+	Task    string    `json:"task"`
+	Cluster string    `json:"cluster"`
+	Region  string    `json:"region"`
+	Old     string    `json:"old,omitempty"`
+	New     string    `json:"new,omitempty"`
+}
+
+// AuditLog records every route added, removed or moved to another address,
+// so it can be told when requests for an org started going to a backend.
+// Each change is logged, and appended to a JSONL file if there is one. A nil
+// *AuditLog records nothing.
+type AuditLog struct {
+	clock clock.Clock
+
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewAuditLog returns an audit log appending to the file at path unless it
+// is empty.
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path, clock: clock.System{}}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetClock makes the records dated by clock. It must be called before the
+// log is shared.
+func (a *AuditLog) SetClock(clock clock.Clock) {
+	a.clock = clock
+}
+
+// Reopen reopens the file so a rotated one is replaced by a new file at the
+// same path. It is called on SIGHUP.
+func (a *AuditLog) Reopen() error {
+	if a == nil || a.path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	previous := a.file
+	a.file = file
+	a.mu.Unlock()
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Record records the changes of diff to table. Changes from building the
+// table at startup are only logged at debug level, the file gets them all.
+func (a *AuditLog) Record(table, trigger string, diff RouteDiff) {
+	if a == nil || diff.Empty() {
+		return
+	}
+	now := a.clock.Now()
+	records := make([]auditRecord, 0, len(diff.Added)+len(diff.Removed)+len(diff.Changed))
+	for _, svc := range diff.Added {
+		records = append(records, a.record(now, table, trigger, "added", svc, "", svc.Address()))
+	}
+	for _, svc := range diff.Removed {
+		records = append(records, a.record(now, table, trigger, "removed", svc, svc.Address(), ""))
+	}
+	for _, change := range diff.Changed {
+		records = append(records, a.record(now, table, trigger, "changed", change.New, change.Old.Address(), change.New.Address()))
+	}
+
+	level := slog.LevelInfo
+	if trigger == TriggerStartup || trigger == TriggerSnapshot {
+		level = slog.LevelDebug
+	}
+	for _, record := range records {
+		slog.Log(context.Background(), level, "Route "+record.Change, "audit", true, "table", record.Table, "trigger", record.Trigger,
+			"service", record.Service, "task", record.Task, "cluster", record.Cluster, "region", record.Region,
+			"previous", record.Old, "backend", record.New)
+	}
+	a.write(records)
+}
+
+func (a *AuditLog) record(now time.Time, table, trigger, change string, svc ECSService, old, new string) auditRecord {
+	return auditRecord{
+		Time:    now,
+		Table:   table,
+		Trigger: trigger,
+		Change:  change,
+		Service: svc.Name,
+		Task:    svc.TaskArn,
+		Cluster: svc.Cluster,
+		Region:  svc.Region,
+		Old:     old,
+		New:     new,
+	}
+}
+
+// write appends records to the file, one JSON document per line.
+func (a *AuditLog) write(records []auditRecord) {
+	var buf []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			slog.Error("Failed to encode audit record", "error", err)
+			return
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(buf); err != nil {
+		slog.Error("Failed to write audit log", "path", a.path, "error", err)
+	}
+}
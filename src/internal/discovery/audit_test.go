@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+)
+
+// auditRecords returns the records of the JSONL file at path.
+func auditRecords(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			t.Fatalf("%s: record not ended by a newline: %q", path, line)
+		}
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%s: %v: %q", path, err, line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := clocktest.New()
+	audit.SetClock(clock)
+	acme := ECSService{Name: "acme", IP: "10.0.0.1", Port: 8080, TaskArn: "a1", Cluster: "tenants", Region: "us-west-2"}
+	audit.Record("primary", TriggerScheduled, RouteDiff{Added: []ECSService{acme}})
+
+	// rotated away, records keep going to the old file until it is reopened
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	audit.Record("primary", TriggerOnMiss, RouteDiff{Removed: []ECSService{acme}})
+	if err := audit.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	moved := acme
+	moved.IP = "10.0.0.2"
+	audit.Record("standby", TriggerAdmin, RouteDiff{Changed: []RouteChange{{Old: acme, New: moved}}})
+
+	old := auditRecords(t, rotated)
+	if len(old) != 2 || old[0].Change != "added" || old[1].Change != "removed" || old[1].Old != "10.0.0.1:8080" || old[1].New != "" {
+		t.Errorf("rotated file has %+v, want the records before the reopen", old)
+	}
+	current := auditRecords(t, path)
+	want := auditRecord{
+		Time: clock.Now(), Table: "standby", Trigger: TriggerAdmin, Change: "changed",
+		Service: "acme", Task: "a1", Cluster: "tenants", Region: "us-west-2", Old: "10.0.0.1:8080", New: "10.0.0.2:8080",
+	}
+	if len(current) != 1 || current[0] != want {
+		t.Errorf("reopened file has %+v, want %+v", current, want)
+	}
+}
@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// ObserveAWSCall records a call to operation of the AWS service that
+// started at start and returned err.
+func ObserveAWSCall(service, operation string, start time.Time, err error) {
+	outcome := telemetry.AWSCallSuccess
+	switch {
+	case err == nil:
+	case IsThrottle(err):
+		outcome = telemetry.AWSCallThrottled
+	default:
+		outcome = telemetry.AWSCallError
+	}
+	telemetry.AWSCalls.WithLabelValues(service, operation, outcome).Inc()
+	telemetry.AWSCallDuration.WithLabelValues(service, operation, outcome).Observe(time.Since(start).Seconds())
+}
+
+// InstrumentAWS makes the clients created from cfg record each attempt of
+// their calls. ECS clients are left to InstrumentECS, which the fakes of
+// the tests go through too.
+func InstrumentAWS(cfg *aws.Config) {
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		// after the retries, so each attempt is a call of its own
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("RecordAWSCall", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			if service := awsmiddleware.GetServiceID(ctx); service != ecs.ServiceID {
+				ObserveAWSCall(awsServiceLabel(service), awsmiddleware.GetOperationName(ctx), start, err)
+			}
+			return out, metadata, err
+		}), middleware.After)
+	})
+}
+
+// awsServiceLabel returns the service label of the AWS service with the
+// SDK's serviceID, such as secretsmanager for Secrets Manager.
+func awsServiceLabel(serviceID string) string {
+	return strings.ToLower(strings.ReplaceAll(serviceID, " ", ""))
+}
+
+// instrumentedECS records the calls made through an ECS client, so neither
+// discovery nor the waker need to.
+type instrumentedECS struct {
+	client ECSAPI
+}
+
+// InstrumentECS returns client recording its calls.
+func InstrumentECS(client ECSAPI) ECSAPI {
+	return instrumentedECS{client: client}
+}
+
+func (c instrumentedECS) ListServices(ctx context.Context, params *ecs.ListServicesInput, optFns ...func(*ecs.Options)) (*ecs.ListServicesOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListServices(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "ListServices", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListTasks(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "ListTasks", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	start := time.Now()
+	out, err := c.client.DescribeServices(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "DescribeServices", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+	start := time.Now()
+	out, err := c.client.DescribeClusters(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "DescribeClusters", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	start := time.Now()
+	out, err := c.client.DescribeTasks(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "DescribeTasks", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	start := time.Now()
+	out, err := c.client.DescribeTaskDefinition(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "DescribeTaskDefinition", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) DescribeTaskSets(ctx context.Context, params *ecs.DescribeTaskSetsInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskSetsOutput, error) {
+	start := time.Now()
+	out, err := c.client.DescribeTaskSets(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "DescribeTaskSets", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) ListTagsForResource(ctx context.Context, params *ecs.ListTagsForResourceInput, optFns ...func(*ecs.Options)) (*ecs.ListTagsForResourceOutput, error) {
+	start := time.Now()
+	out, err := c.client.ListTagsForResource(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "ListTagsForResource", start, err)
+	return out, err
+}
+
+func (c instrumentedECS) UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+	start := time.Now()
+	out, err := c.client.UpdateService(ctx, params, optFns...)
+	ObserveAWSCall("ecs", "UpdateService", start, err)
+	return out, err
+}
@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+func TestAWSCallMetricsECS(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.FailNext("ListServices", discoverytest.Throttled(), discoverytest.Throttled())
+	client := InstrumentECS(fake)
+
+	before, timed := telemetrytest.AWSCallCounts(t, "ecs", "ListServices")
+	err := ECSRetryPolicy.call(context.Background(), "ListServices", func(ctx context.Context) error {
+		_, err := client.ListServices(ctx, &ecs.ListServicesInput{Cluster: aws.String("tenants")})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	telemetrytest.CheckAWSCalls(t, "ecs", "ListServices", before, timed, map[string]float64{telemetry.AWSCallThrottled: 2, telemetry.AWSCallSuccess: 1})
+
+	// a final error is recorded as one
+	before, timed = telemetrytest.AWSCallCounts(t, "ecs", "ListServices")
+	fake.FailNext("ListServices", discoverytest.AccessDenied())
+	if _, err := client.ListServices(context.Background(), &ecs.ListServicesInput{Cluster: aws.String("tenants")}); err == nil {
+		t.Fatal("ListServices succeeded")
+	}
+	telemetrytest.CheckAWSCalls(t, "ecs", "ListServices", before, timed, map[string]float64{telemetry.AWSCallError: 1})
+}
+
+func TestAWSCallMetricsMiddleware(t *testing.T) {
+	// Secrets Manager throttles the first call, then answers
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type": "ThrottlingException", "message": "Rate exceeded"}`)
+			return
+		}
+		io.WriteString(w, `{"Name": "proxy/admin", "SecretString": "s3cret", "VersionId": "v1"}`)
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := aws.Config{Region: discoverytest.Region, Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")}
+	InstrumentAWS(&cfg)
+	secrets := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		o.BaseEndpoint = aws.String(server.URL)
+		o.Retryer = retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		})
+	})
+
+	before, timed := telemetrytest.AWSCallCounts(t, "secretsmanager", "GetSecretValue")
+	out, err := secrets.GetSecretValue(context.Background(), &secretsmanager.GetSecretValueInput{SecretId: aws.String("proxy/admin")})
+	if err != nil || aws.ToString(out.SecretString) != "s3cret" {
+		t.Fatalf("GetSecretValue = %v, %v", out, err)
+	}
+	// the SDK's retry is recorded as a call of its own
+	telemetrytest.CheckAWSCalls(t, "secretsmanager", "GetSecretValue", before, timed, map[string]float64{telemetry.AWSCallThrottled: 1, telemetry.AWSCallSuccess: 1})
+
+	// ECS clients made from the same config are recorded once, by
+	// InstrumentECS
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	endpoint := discoverytest.NewEndpoint(t, fake)
+	before, timed = telemetrytest.AWSCallCounts(t, "ecs", "ListServices")
+	if _, err := RegionClients(cfg, endpoint.URL)(discoverytest.Region).ListServices(context.Background(), &ecs.ListServicesInput{Cluster: aws.String("tenants")}); err != nil {
+		t.Fatal(err)
+	}
+	telemetrytest.CheckAWSCalls(t, "ecs", "ListServices", before, timed, map[string]float64{telemetry.AWSCallSuccess: 1})
+}
@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BackendDenied counts the backends a request wasn't sent to because their
+// address is outside BACKEND_ALLOWED_CIDRS.
+var BackendDenied = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_backend_denied_total",
+	Help: "Backends not routed to for an address outside the allowed CIDRs.",
+})
+
+// ErrBackendNotAllowed is returned for a backend outside the allowed CIDRs.
+var ErrBackendNotAllowed = errors.New("backend address is not allowed")
+
+// BackendAllowed reports whether the address of service is in allowed. A
+// backend that isn't is counted and logged as an error: a task or a
+// tampered route reaching outside the VPC is something to look into, not a
+// routine failure.
+func BackendAllowed(ctx context.Context, allowed []netip.Prefix, service ECSService) bool {
+	addr, err := netip.ParseAddr(service.IP)
+	if err == nil && config.ContainsAddr(allowed, addr.Unmap()) {
+		return true
+	}
+	BackendDenied.Inc()
+	if telemetry.LogSamples.Allow(ctx, slog.LevelError, "Backend address not allowed", service.IP) {
+		slog.ErrorContext(ctx, "Backend address not allowed, outside BACKEND_ALLOWED_CIDRS", "service", service.Name, "backend", service.IP)
+	}
+	return false
+}
+
+// addressAllowed reports whether the host of address, a host:port, is in
+// allowed.
+func addressAllowed(allowed []netip.Prefix, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && config.ContainsAddr(allowed, addr.Unmap())
+}
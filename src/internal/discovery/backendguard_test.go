@@ -0,0 +1,29 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+func TestBackendAllowedIPv6(t *testing.T) {
+	allowed, err := config.ParseCIDRs(config.DefaultBackendAllowedCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"fd00:ec2::1":      true,
+		"2600:1f14:abc::1": false,
+		"::ffff:8.8.8.8":   false,
+		"169.254.169.254":  false,
+		"::1":              false,
+		"not-an-ip":        false,
+	} {
+		if got := BackendAllowed(context.Background(), allowed, ECSService{Name: "acme", IP: ip}); got != want {
+			t.Errorf("backendAllowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
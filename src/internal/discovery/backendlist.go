@@ -0,0 +1,126 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BackendsList is the route table with the state of every backend, as
+// served by GET /admin/backends.
+type BackendsList struct {
+	BuiltAt  *time.Time                 `json:"built_at"`
+	Services map[string][]backendStatus `json:"services"`
+}
+
+// backendStatus is a backend and everything the proxy knows of it. State
+// sums up the others as in /debug/routes.
+type backendStatus struct {
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	TaskArn  string `json:"task_arn"`
+	Revision int    `json:"revision,omitempty"`
+	State    string `json:"state"`
+	// Health is the result of the last active check: healthy, unhealthy,
+	// or unchecked.
+	Health         string `json:"health"`
+	Ejected        bool   `json:"ejected"`
+	LatencyOutlier bool   `json:"latency_outlier"`
+	// Breaker is the state of the circuit breaker: closed, open or
+	// half-open.
+	Breaker  string `json:"breaker"`
+	Drained  bool   `json:"drained"`
+	InFlight int64  `json:"in_flight"`
+	// LastSeen is when discovery or an event last confirmed the task.
+	LastSeen time.Time `json:"last_seen"`
+	Source   source    `json:"source"`
+}
+
+// Backends returns the backends of the services matching orgID, by the
+// rules of Lookup, or of every service if it is empty, keeping those whose
+// State is state unless it is empty. The services are read in one go, so a
+// refresh can't change them halfway.
+func (t *RouteTable) Backends(orgID, state string) BackendsList {
+	t.mu.RLock()
+	var services []ECSService
+	if orgID == "" {
+		services = t.services
+	} else {
+		services = t.lookup(orgID)
+	}
+	builtAt := t.builtAt
+	seen := make([]time.Time, len(services))
+	for i, svc := range services {
+		seen[i] = t.lastSeen(svc)
+	}
+	t.mu.RUnlock()
+
+	states := t.backendStates()
+	list := BackendsList{Services: map[string][]backendStatus{}}
+	if !builtAt.IsZero() {
+		list.BuiltAt = &builtAt
+	}
+	for i, svc := range services {
+		address := svc.Address()
+		_, summary := states.state(svc)
+		if state != "" && summary != state {
+			continue
+		}
+		health := "unchecked"
+		if healthy, checked := t.health.State(address); checked && healthy {
+			health = "healthy"
+		} else if checked {
+			health = "unhealthy"
+		}
+		breaker := states.breakers[address]
+		if breaker == "" {
+			breaker = breakerClosed.String()
+		}
+		list.Services[svc.Name] = append(list.Services[svc.Name], backendStatus{
+			IP:             svc.IP,
+			Port:           svc.Port,
+			TaskArn:        svc.TaskArn,
+			Revision:       svc.Revision,
+			State:          summary,
+			Health:         health,
+			Ejected:        t.ejector.Ejected(address),
+			LatencyOutlier: states.slow[address],
+			Breaker:        breaker,
+			Drained:        t.Drained.Drained(svc.IP),
+			InFlight:       t.conns.Active(address),
+			LastSeen:       seen[i],
+			Source:         source{Cluster: svc.Cluster, Region: svc.Region, Account: svc.Account},
+		})
+	}
+	for _, backends := range list.Services {
+		sort.Slice(backends, func(i, j int) bool { return backends[i].TaskArn < backends[j].TaskArn })
+	}
+	return list
+}
+
+// WriteTable writes the backends as a table aligned for a terminal, sorted
+// by service and task.
+func (l BackendsList) WriteTable(w http.ResponseWriter) {
+	names := make([]string, 0, len(l.Services))
+	for name := range l.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVICE\tBACKEND\tSTATE\tHEALTH\tBREAKER\tIN-FLIGHT\tLAST-SEEN\tCLUSTER\tTASK")
+	for _, name := range names {
+		for _, b := range l.Services[name] {
+			cluster := b.Source.Cluster
+			if b.Source.Region != "" {
+				cluster = b.Source.Region + ":" + cluster
+			}
+			task := b.TaskArn[strings.LastIndex(b.TaskArn, "/")+1:]
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", name, ECSService{IP: b.IP, Port: b.Port}.Address(),
+				b.State, b.Health, b.Breaker, b.InFlight, b.LastSeen.Format(time.RFC3339), cluster, task)
+		}
+	}
+	table.Flush()
+}
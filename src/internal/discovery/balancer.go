@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// balancer picks one of the backends of a service for a request.
+type balancer interface {
+	// Select returns one of backends, which is never empty.
+	Select(backends []ECSService) ECSService
+	// Prune drops any state kept for services that are no longer in index.
+	Prune(index map[string][]ECSService)
+}
+
+func newBalancer(strategy string, conns *connTracker) balancer {
+	switch strategy {
+	case config.LBStrategyLeastConn:
+		return &leastConn{conns: conns}
+	case config.LBStrategyRandom:
+		return randomBalancer{}
+	default:
+		return &roundRobin{}
+	}
+}
+
+// roundRobin rotates through the backends of each service. Its counters are
+// keyed by service name rather than by table position, so they survive
+// refreshes, and a change in the number of backends only shifts the rotation.
+type roundRobin struct {
+	counters sync.Map // service name -> *atomic.Uint64
+}
+
+func (b *roundRobin) Select(backends []ECSService) ECSService {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	value, _ := b.counters.LoadOrStore(backends[0].Name, new(atomic.Uint64))
+	next := value.(*atomic.Uint64).Add(1) - 1
+	return backends[next%uint64(len(backends))]
+}
+
+func (b *roundRobin) Prune(index map[string][]ECSService) {
+	b.counters.Range(func(key, _ any) bool {
+		if _, ok := index[key.(string)]; !ok {
+			b.counters.Delete(key)
+		}
+		return true
+	})
+}
+
+// leastConn picks the backend with the fewest requests in flight. Requests
+// are only in flight while they are forwarded, so with redirects every
+// backend is idle and the choice is random.
+type leastConn struct {
+	conns *connTracker
+}
+
+func (b *leastConn) Select(backends []ECSService) ECSService {
+	var selected ECSService
+	var fewest int64
+	ties := 0
+	for _, backend := range backends {
+		active := b.conns.Active(backend.Address())
+		switch {
+		case ties == 0 || active < fewest:
+			selected, fewest, ties = backend, active, 1
+		case active == fewest:
+			// keep each of the tied backends with equal probability
+			ties++
+			if rand.Intn(ties) == 0 {
+				selected = backend
+			}
+		}
+	}
+	return selected
+}
+
+func (b *leastConn) Prune(index map[string][]ECSService) {
+	b.conns.Prune(index)
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Select(backends []ECSService) ECSService {
+	return backends[rand.Intn(len(backends))]
+}
+
+func (randomBalancer) Prune(map[string][]ECSService) {}
+
+// connTracker counts the requests in flight per backend address.
+type connTracker struct {
+	counts sync.Map // address -> *atomic.Int64
+}
+
+// Acquire records a request to address until the returned function is
+// called. Calling it more than once has no further effect.
+func (c *connTracker) Acquire(address string) (release func()) {
+	value, _ := c.counts.LoadOrStore(address, new(atomic.Int64))
+	count := value.(*atomic.Int64)
+	count.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { count.Add(-1) })
+	}
+}
+
+// Active returns the number of requests in flight to address.
+func (c *connTracker) Active(address string) int64 {
+	if value, ok := c.counts.Load(address); ok {
+		return value.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// Prune drops idle addresses that are no longer a backend in index. Counts
+// still in use are kept so their releases stay balanced.
+func (c *connTracker) Prune(index map[string][]ECSService) {
+	addresses := map[string]bool{}
+	for _, backends := range index {
+		for _, backend := range backends {
+			addresses[backend.Address()] = true
+		}
+	}
+	c.counts.Range(func(key, value any) bool {
+		if !addresses[key.(string)] && value.(*atomic.Int64).Load() == 0 {
+			c.counts.Delete(key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+func TestRoundRobinSkipsUnhealthy(t *testing.T) {
+	services := testServices(1, 3)
+	services[1].Health = "UNHEALTHY"
+	routes := NewRouteTable(services, nil, config.LBStrategyRoundRobin)
+	routes.SetECSHealth(true, true)
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		svc, err := routes.Lookup("org0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[svc.IP]++
+	}
+	if counts[services[1].IP] > 0 || counts[services[0].IP] != 5 || counts[services[2].IP] != 5 {
+		t.Errorf("requests went to %v, want the healthy tasks evenly", counts)
+	}
+}
+
+func TestRoundRobinResize(t *testing.T) {
+	routes := NewRouteTable(testServices(1, 5), nil, config.LBStrategyRoundRobin)
+	for i := 0; i < 3; i++ {
+		routes.Lookup("org0")
+	}
+	// the rotation carries on over fewer backends, then more
+	for _, tasks := range []int{2, 1, 4} {
+		routes.Replace(testServices(1, tasks), TriggerScheduled)
+		seen := map[string]bool{}
+		for i := 0; i < tasks; i++ {
+			svc, err := routes.Lookup("org0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[svc.IP] = true
+		}
+		if len(seen) != tasks {
+			t.Errorf("%d lookups over %d tasks reached %d of them", tasks, tasks, len(seen))
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// Tags of the ECS services taking turns at the traffic of an org, read with
+// SERVICE_ROLE_TAGS.
+const (
+	serviceRoleTag   = "proxy.role"
+	serviceWeightTag = "proxy.weight"
+	// ServiceRoleLive is the role of the services taking the traffic of the
+	// orgs they match.
+	ServiceRoleLive = "live"
+	// ServiceRoleStandby is the role of the services discovered but taking
+	// none.
+	ServiceRoleStandby = "standby"
+)
+
+// serviceRole is the blue/green role of an ECS service as its tags last
+// said.
+type serviceRole struct {
+	Service string `json:"service"`
+	Cluster string `json:"cluster"`
+	Region  string `json:"region"`
+	Account string `json:"account,omitempty"`
+	Role    string `json:"role"`
+	// Weight is the proxy.weight tag, nil without one.
+	Weight *int `json:"weight,omitempty"`
+	// Share is the percentage of the org's requests the service takes, only
+	// set in the dump of an org.
+	Share *float64 `json:"share,omitempty"`
+}
+
+// serviceRoleKey identifies an ECS service across clusters.
+type serviceRoleKey struct {
+	Service string
+	Cluster string
+	Region  string
+	Account string
+}
+
+// serviceRoleOf returns the key of the ECS service svc is a task of.
+func serviceRoleOf(svc ECSService) serviceRoleKey {
+	return serviceRoleKey{Service: svc.Service, Cluster: svc.Cluster, Region: svc.Region, Account: svc.Account}
+}
+
+// weight returns the weight of a live service, 100 without a proxy.weight
+// tag.
+func (r serviceRole) weight() int {
+	if r.Weight == nil {
+		return 100
+	}
+	return *r.Weight
+}
+
+// serviceOfGroup returns the ECS service of a task from its group, empty
+// for a task no service started.
+func serviceOfGroup(group string) string {
+	service, ok := strings.CutPrefix(group, "service:")
+	if !ok {
+		return ""
+	}
+	return service
+}
+
+// listServiceRoles reads the tags of the services of the cluster of target,
+// given by ARN, up to concurrency at a time, and returns the roles of those
+// tagged with proxy.role.
+func listServiceRoles(ctx context.Context, target ClusterTarget, services []string, concurrency int) ([]serviceRole, error) {
+	roles := make([]*serviceRole, len(services))
+	errs := make([]error, len(services))
+	sem := make(chan struct{}, max(1, concurrency))
+	var wg sync.WaitGroup
+	for i, arn := range services {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, arn string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var resp *ecs.ListTagsForResourceOutput
+			errs[i] = ECSRetryPolicy.call(ctx, "ListTagsForResource", func(ctx context.Context) (err error) {
+				resp, err = target.Client.ListTagsForResource(ctx, &ecs.ListTagsForResourceInput{
+					ResourceArn: aws.String(arn),
+				})
+				return err
+			})
+			if errs[i] != nil {
+				return
+			}
+			if role, ok := parseServiceRole(arn[strings.LastIndex(arn, "/")+1:], resp.Tags); ok {
+				role.Cluster, role.Region, role.Account = target.Cluster, target.Region, target.Account
+				roles[i] = &role
+			}
+		}(i, arn)
+	}
+	wg.Wait()
+	var tagged []serviceRole
+	for i, role := range roles {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if role != nil {
+			tagged = append(tagged, *role)
+		}
+	}
+	return tagged, nil
+}
+
+// parseServiceRole returns the role of service from its tags, false if it
+// has no valid proxy.role. An invalid proxy.weight is logged and left out.
+func parseServiceRole(service string, tags []types.Tag) (serviceRole, bool) {
+	role := serviceRole{Service: service}
+	var weight string
+	for _, tag := range tags {
+		switch aws.ToString(tag.Key) {
+		case serviceRoleTag:
+			role.Role = strings.ToLower(strings.TrimSpace(aws.ToString(tag.Value)))
+		case serviceWeightTag:
+			weight = strings.TrimSpace(aws.ToString(tag.Value))
+		}
+	}
+	switch role.Role {
+	case ServiceRoleLive, ServiceRoleStandby:
+	case "":
+		return serviceRole{}, false
+	default:
+		slog.Warn("Ignoring the invalid role of a service, it is routed as if untagged", "service", service, "role", role.Role)
+		return serviceRole{}, false
+	}
+	if weight != "" {
+		if n, err := strconv.Atoi(weight); err == nil && n >= 0 && n <= 100 {
+			role.Weight = &n
+		} else {
+			slog.Warn("Ignoring the invalid weight of a service, it must be 0 to 100", "service", service, "weight", weight)
+		}
+	}
+	return role, true
+}
+
+// SetServiceRoles replaces the blue/green roles of the services.
+func (t *RouteTable) SetServiceRoles(roles []serviceRole) {
+	index := make(map[serviceRoleKey]serviceRole, len(roles))
+	for _, role := range roles {
+		index[serviceRoleKey{Service: role.Service, Cluster: role.Cluster, Region: role.Region, Account: role.Account}] = role
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.serviceRoles = roles
+	t.roles = index
+}
+
+// AllServiceRoles returns the roles of every tagged service.
+func (t *RouteTable) AllServiceRoles() []serviceRole {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.serviceRoles
+}
+
+// liveService is a live ECS service an org matches, with its entries.
+type liveService struct {
+	service  string
+	weight   int
+	backends []ECSService
+}
+
+// blueGreen returns the live services among those with the containers name
+// or candidates, the names an org matched, and the roles of the tagged ones.
+// Once one of them is tagged, the untagged ones and the standby ones take
+// none of the org's traffic; without any roles the org is routed as usual.
+// The caller must hold t.mu.
+func (t *RouteTable) blueGreen(name string, candidates []string) (live []liveService, roles []serviceRole) {
+	if len(t.roles) == 0 {
+		return nil, nil
+	}
+	names := candidates
+	if len(names) == 0 && name != "" {
+		names = []string{name}
+	}
+	seen := map[serviceRoleKey]bool{}
+	for _, name := range names {
+		for _, svc := range t.index[name] {
+			key := serviceRoleOf(svc)
+			role, ok := t.roles[key]
+			if !ok {
+				continue
+			}
+			if !seen[key] {
+				seen[key] = true
+				roles = append(roles, role)
+			}
+			if role.Role != ServiceRoleLive {
+				continue
+			}
+			i := 0
+			for i < len(live) && live[i].service != svc.Service {
+				i++
+			}
+			if i == len(live) {
+				live = append(live, liveService{service: svc.Service, weight: role.weight()})
+			}
+			live[i].backends = append(live[i].backends, svc)
+		}
+	}
+	return live, roles
+}
+
+// pickLive returns the entries of one of the live services, picked with
+// random in proportion to their weights, or evenly when those are all 0.
+// It returns nil without a live service.
+func pickLive(live []liveService, random func() float64) []ECSService {
+	shares := liveShares(live)
+	if len(shares) == 0 {
+		return nil
+	}
+	n := random() * 100
+	for i, share := range shares {
+		if n -= share; n < 0 {
+			return live[i].backends
+		}
+	}
+	return live[len(live)-1].backends
+}
+
+// liveShares returns the percentage of the requests each live service
+// takes.
+func liveShares(live []liveService) []float64 {
+	total := 0
+	for _, svc := range live {
+		total += svc.weight
+	}
+	shares := make([]float64, len(live))
+	for i, svc := range live {
+		if total == 0 {
+			shares[i] = 100 / float64(len(live))
+		} else {
+			shares[i] = 100 * float64(svc.weight) / float64(total)
+		}
+	}
+	return shares
+}
+
+// dumpRoles returns roles with the share of the requests each takes, sorted
+// by service and cluster.
+func dumpRoles(live []liveService, roles []serviceRole) []serviceRole {
+	shares := map[string]float64{}
+	for i, share := range liveShares(live) {
+		shares[live[i].service] = share
+	}
+	dumped := make([]serviceRole, len(roles))
+	for i, role := range roles {
+		share := shares[role.Service]
+		if role.Role != ServiceRoleLive {
+			share = 0
+		}
+		role.Share = &share
+		dumped[i] = role
+	}
+	sortServiceRoles(dumped)
+	return dumped
+}
+
+func sortServiceRoles(roles []serviceRole) {
+	sort.Slice(roles, func(i, j int) bool {
+		if roles[i].Service != roles[j].Service {
+			return roles[i].Service < roles[j].Service
+		}
+		return roles[i].Cluster+"/"+roles[i].Region < roles[j].Cluster+"/"+roles[j].Region
+	})
+}
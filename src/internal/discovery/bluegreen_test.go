@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestBlueGreen(t *testing.T) {
+	fake := discoverytest.NewECS()
+	for i, service := range []string{"acme-blue", "acme-green", "initech"} {
+		fake.AddService("tenants", service)
+		fake.AddTasks("tenants", discoverytest.Task("tenants", service, service+"1", fmt.Sprintf("10.0.0.%d", i+1)))
+	}
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	routes.random = rand.New(rand.NewSource(1)).Float64
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080, ServiceRoles: true}, routes, 0)
+	// tag tags the blue and green services and refreshes the routes.
+	tag := func(blue, green map[string]string) {
+		t.Helper()
+		fake.TagService("tenants", "acme-blue", blue)
+		fake.TagService("tenants", "acme-green", green)
+		if _, err := refresher.Rebuild(context.Background(), TriggerScheduled); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// lookups returns how many of 1000 lookups of org went to each service.
+	lookups := func(org string) map[string]int {
+		t.Helper()
+		services := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			svc, err := routes.Lookup(org)
+			if err != nil {
+				t.Fatalf("lookup of %s: %v", org, err)
+			}
+			services[svc.Service]++
+		}
+		return services
+	}
+
+	// a hard cutover, taking effect with the next refresh
+	tag(map[string]string{"proxy.role": "live"}, map[string]string{"proxy.role": "standby"})
+	if services := lookups("acme"); services["acme-blue"] != 1000 {
+		t.Errorf("lookups with blue live went to %v", services)
+	}
+	tag(map[string]string{"proxy.role": "standby"}, map[string]string{"proxy.role": "live"})
+	if services := lookups("acme"); services["acme-green"] != 1000 {
+		t.Errorf("lookups after the cutover to green went to %v", services)
+	}
+
+	// a 70/30 split while shifting
+	tag(map[string]string{"proxy.role": "live", "proxy.weight": "70"}, map[string]string{"proxy.role": "live", "proxy.weight": "30"})
+	if services := lookups("acme"); services["acme-blue"] < 650 || services["acme-blue"] > 750 || services["acme-blue"]+services["acme-green"] != 1000 {
+		t.Errorf("lookups with a 70/30 split went to %v", services)
+	}
+	shares := map[string]float64{}
+	for _, role := range routes.Dump("acme").ServiceRoles {
+		if role.Role != ServiceRoleLive || role.Share == nil {
+			t.Errorf("role of %s in the dump %+v, want live with its share", role.Service, role)
+			continue
+		}
+		shares[role.Service] = *role.Share
+	}
+	if shares["acme-blue"] != 70 || shares["acme-green"] != 30 {
+		t.Errorf("shares in the dump %v, want 70 and 30", shares)
+	}
+
+	// and a service without the tags is routed as usual
+	if services := lookups("initech"); services["initech"] != 1000 {
+		t.Errorf("lookups of the untagged initech went to %v", services)
+	}
+}
@@ -0,0 +1,261 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrBreakerOpen is returned for requests to a backend whose circuit breaker
+// is open.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// breakerStates is the state of the breaker of each backend that opened
+// since it joined the route table, as a breakerState.
+var breakerStates = promauto.With(telemetry.Registry).NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ecs_svc_proxy_breaker_state",
+	Help: "Circuit breaker state by backend: 0 closed, 1 open, 2 half-open.",
+}, []string{"backend"})
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakers keeps a circuit breaker per backend address. A breaker
+// opens after threshold consecutive failed requests, where a failure is a
+// transport error or a 5xx response. Requests to an open backend fail fast
+// until openTimeout has passed, then a single probe request is let through:
+// its success closes the breaker and its failure opens it again. A nil
+// *CircuitBreakers lets every request through.
+type CircuitBreakers struct {
+	mu          sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+	clock       clock.Clock
+	breakers    map[string]*breaker
+}
+
+type breaker struct {
+	state       breakerState
+	consecutive int
+	openedAt    time.Time
+	// probing is set while the half-open probe request is in flight.
+	probing bool
+}
+
+// newCircuitBreakers returns circuit breakers timed by clock, or nil if
+// threshold is zero.
+func newCircuitBreakers(threshold int, openTimeout time.Duration, clock clock.Clock) *CircuitBreakers {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreakers{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		clock:       clock,
+		breakers:    map[string]*breaker{},
+	}
+}
+
+// Allow reports whether a request may be sent to address. When it lets the
+// half-open probe through, the caller must Record its outcome.
+func (c *CircuitBreakers) Allow(address string) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[address]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if c.clock.Now().Sub(b.openedAt) < c.openTimeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		breakerStates.WithLabelValues(address).Set(float64(breakerHalfOpen))
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Open reports whether requests to address would currently fail fast, so
+// another backend should be selected.
+func (c *CircuitBreakers) Open(address string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[address]
+	if !ok {
+		return false
+	}
+	switch b.state {
+	case breakerOpen:
+		return c.clock.Now().Sub(b.openedAt) < c.openTimeout
+	case breakerHalfOpen:
+		return b.probing
+	default:
+		return false
+	}
+}
+
+// Record records the outcome of a request to address.
+func (c *CircuitBreakers) Record(address string, success bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[address]
+	if !ok {
+		if success {
+			return
+		}
+		b = &breaker{}
+		c.breakers[address] = b
+	}
+	switch {
+	case success && b.state == breakerHalfOpen:
+		slog.Info("Closing circuit breaker", "backend", address)
+		delete(c.breakers, address)
+		breakerStates.WithLabelValues(address).Set(float64(breakerClosed))
+	case success:
+		b.consecutive = 0
+	case b.state == breakerHalfOpen:
+		c.open(address, b)
+	case b.state == breakerClosed:
+		b.consecutive++
+		if b.consecutive >= c.threshold {
+			c.open(address, b)
+		}
+	}
+}
+
+func (c *CircuitBreakers) open(address string, b *breaker) {
+	slog.Warn("Opening circuit breaker", "backend", address, "open_timeout", c.openTimeout)
+	telemetry.BreakersOpened.Add(1)
+	b.state = breakerOpen
+	breakerStates.WithLabelValues(address).Set(float64(breakerOpen))
+	b.openedAt = c.clock.Now()
+	b.consecutive = 0
+	b.probing = false
+}
+
+// Release lets another probe through after a request to address ended
+// without an outcome.
+func (c *CircuitBreakers) Release(address string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.breakers[address]; ok {
+		b.probing = false
+	}
+}
+
+// States returns the state of every breaker that isn't closed.
+func (c *CircuitBreakers) States() map[string]string {
+	states := map[string]string{}
+	if c == nil {
+		return states
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, b := range c.breakers {
+		if b.state != breakerClosed {
+			states[address] = b.state.String()
+		}
+	}
+	return states
+}
+
+// Forget drops the breakers of addresses that left the route table.
+func (c *CircuitBreakers) Forget(addresses []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, address := range addresses {
+		delete(c.breakers, address)
+		breakerStates.DeleteLabelValues(address)
+	}
+}
+
+type backendAddressKey struct{}
+
+// WithBackendAddress returns ctx with address as the backend the requests
+// made with it are accounted to. The Address of the ECSService a request is
+// routed to names the backend even when the request is sent to another
+// port, so breakers, ejection and draining agree with the route table.
+func WithBackendAddress(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, backendAddressKey{}, address)
+}
+
+// BackendAddress returns the backend req is accounted to, its URL's host if
+// its context doesn't say.
+func BackendAddress(req *http.Request) string {
+	if address, ok := req.Context().Value(backendAddressKey{}).(string); ok {
+		return address
+	}
+	return req.URL.Host
+}
+
+// BreakerTransport fails requests to backends with an open circuit breaker
+// and records the outcome of the others.
+type BreakerTransport struct {
+	Next     http.RoundTripper
+	Breakers *CircuitBreakers
+}
+
+func (t *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	address := BackendAddress(req)
+	if !t.Breakers.Allow(address) {
+		return nil, ErrBreakerOpen
+	}
+	resp, err := t.Next.RoundTrip(req)
+	// a client going away says nothing about the backend
+	if errors.Is(err, context.Canceled) {
+		t.Breakers.Release(address)
+	} else {
+		t.Breakers.Record(address, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
+	return resp, err
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	clock := clocktest.New()
+	routes := NewRouteTable([]ECSService{{Name: "acme", IP: "10.0.0.1", Port: 8080}}, nil, config.LBStrategyRoundRobin)
+	routes.SetClock(clock)
+	routes.SetBreakers(2, 30*time.Second)
+	breakers := routes.Breakers
+	const backend = "10.0.0.1:8080"
+	check := func(what string, open bool, state breakerState) {
+		t.Helper()
+		if breakers.Open(backend) != open {
+			t.Errorf("%s: Open = %t, want %t", what, !open, open)
+		}
+		if got := telemetrytest.GaugeValue(t, breakerStates.WithLabelValues(backend)); got != float64(state) {
+			t.Errorf("%s: ecs_svc_proxy_breaker_state = %v, want %v (%s)", what, got, float64(state), state)
+		}
+	}
+
+	// closed until threshold consecutive failures
+	breakers.Record(backend, false)
+	breakers.Record(backend, true)
+	breakers.Record(backend, false)
+	check("after failures a success apart", false, breakerClosed)
+	breakers.Record(backend, false)
+	check("after 2 consecutive failures", true, breakerOpen)
+	if breakers.Allow(backend) {
+		t.Error("request let through an open breaker")
+	}
+
+	// half-open once the timeout passed, letting a single probe through
+	clock.Advance(29 * time.Second)
+	if breakers.Allow(backend) {
+		t.Error("request let through before the open timeout passed")
+	}
+	clock.Advance(time.Second)
+	if !breakers.Allow(backend) {
+		t.Fatal("probe not let through after the open timeout")
+	}
+	check("while probing", true, breakerHalfOpen)
+	if breakers.Allow(backend) {
+		t.Error("second probe let through a half-open breaker")
+	}
+
+	// a failed probe opens it again for another timeout
+	breakers.Record(backend, false)
+	check("after a failed probe", true, breakerOpen)
+	clock.Advance(30 * time.Second)
+	if !breakers.Allow(backend) {
+		t.Fatal("probe not let through after the second open timeout")
+	}
+
+	// and a successful one closes it
+	breakers.Record(backend, true)
+	check("after a successful probe", false, breakerClosed)
+	if _, err := routes.Lookup("acme"); err != nil {
+		t.Errorf("closed backend not routed to: %v", err)
+	}
+}
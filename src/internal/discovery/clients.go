@@ -0,0 +1,21 @@
+package discovery
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// RegionClients returns a function returning the ECS client of a region,
+// made from cfg on first use and recording its calls. The clients send
+// their calls to endpoint if it is set, see ecsOptions.
+func RegionClients(cfg aws.Config, endpoint string) func(region string) ECSAPI {
+	clients := map[string]ECSAPI{}
+	return func(region string) ECSAPI {
+		client, ok := clients[region]
+		if !ok {
+			client = InstrumentECS(ecs.NewFromConfig(cfg, ecsOptions(region, endpoint)))
+			clients[region] = client
+		}
+		return client
+	}
+}
@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"errors"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// ErrNoTargetContainer means the tasks of the service an org matches don't
+// run the container its ORG_TARGETS entry names.
+var ErrNoTargetContainer = errors.New("no target container")
+
+// SetTargetContainers sends the requests of the orgs in containers to the
+// container of that name in the tasks of the service they match, rather
+// than to the matched container itself, for tasks running several
+// application containers behind one network interface.
+func (t *RouteTable) SetTargetContainers(containers map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.containers = containers
+}
+
+// inContainer returns the entries of the target container of orgID in the
+// tasks of backends, those tasks not running it left out, or backends if
+// the org has none. The caller must hold t.mu.
+func (t *RouteTable) inContainer(orgID string, backends []ECSService) []ECSService {
+	container := t.containers[config.NormalizeOrg(orgID)]
+	if container == "" {
+		return backends
+	}
+	var targets []ECSService
+	for _, backend := range backends {
+		for _, svc := range t.tasks[backend.TaskArn] {
+			if svc.Name == container {
+				targets = append(targets, svc)
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// buildTaskIndex groups services by task ARN, keeping discovery order.
+func buildTaskIndex(services []ECSService) map[string][]ECSService {
+	index := make(map[string][]ECSService, len(services))
+	for _, svc := range services {
+		index[svc.TaskArn] = append(index[svc.TaskArn], svc)
+	}
+	return index
+}
+
+// OrgContainers returns the target containers of the orgs whose
+// ORG_TARGETS entry names one, by normalized org.
+func OrgContainers(targets map[string]config.OrgTarget) map[string]string {
+	containers := map[string]string{}
+	for org, target := range targets {
+		if target.Container != "" {
+			containers[org] = target.Container
+		}
+	}
+	return containers
+}
@@ -0,0 +1,77 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestTargetContainers(t *testing.T) {
+	fake := discoverytest.NewECS()
+	// the tasks of acme and globex run their api container, a webhooks
+	// container on another port and an envoy sidecar, initech only its api
+	for i, service := range []string{"acme", "globex", "initech"} {
+		ip := "10.0.0." + strconv.Itoa(i+1)
+		task := discoverytest.Task("tenants", service, service+"1", ip)
+		definitions := []types.ContainerDefinition{{Name: aws.String(service), DockerLabels: map[string]string{"proxy.port": "3000"}}}
+		if service != "initech" {
+			api := task.Containers[0]
+			task.Containers = []types.Container{api, api, api}
+			task.Containers[1].Name = aws.String("webhooks")
+			task.Containers[2].Name = aws.String("envoy")
+			definitions = append(definitions,
+				types.ContainerDefinition{Name: aws.String("webhooks"), DockerLabels: map[string]string{"proxy.port": "4000"}},
+				types.ContainerDefinition{Name: aws.String("envoy"), DockerLabels: map[string]string{"proxy.port": "15000"}})
+		}
+		fake.AddService("tenants", service)
+		fake.AddTaskDefinition(service, definitions...)
+		fake.AddTasks("tenants", task)
+	}
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")},
+		Options{PortLabel: "proxy.port", DefaultPort: 8080}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := config.ParseOrgTargets("globex||||webhooks, initech||||webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := NewRouteTable(details, nil, config.LBStrategyRoundRobin)
+	routes.SetTargetContainers(OrgContainers(targets))
+
+	for _, tt := range []struct {
+		org, container, address string
+		err                     error
+	}{
+		// the container the org matches by default
+		{org: "acme", container: "acme", address: "10.0.0.1:3000"},
+		// its target container, on the port of that container
+		{org: "globex", container: "webhooks", address: "10.0.0.2:4000"},
+		// a target container its tasks don't run
+		{org: "initech", err: ErrNoTargetContainer},
+	} {
+		svc, err := routes.Lookup(tt.org)
+		if err != nil || tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("lookup of %s = %v, want %v", tt.org, err, tt.err)
+			}
+			continue
+		}
+		if svc.Name != tt.container || svc.Address() != tt.address {
+			t.Errorf("lookup of %s = %s at %s, want %s at %s", tt.org, svc.Name, svc.Address(), tt.container, tt.address)
+		}
+	}
+
+	// and /debug/routes lists the container of each backend
+	backends := routes.Dump("globex").Services["globex"]
+	if len(backends) != 1 || backends[0].Container != "webhooks" || backends[0].Port != 4000 {
+		t.Errorf("dump of globex %+v, want its webhooks container", backends)
+	}
+}
@@ -0,0 +1,185 @@
+package discovery
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// RoutesDump is the route table as served by /debug/routes.
+type RoutesDump struct {
+	BuiltAt  *time.Time               `json:"built_at"`
+	Services map[string][]backendDump `json:"services"`
+	// Maintenance are the orgs under maintenance.
+	Maintenance []config.MaintenanceWindow `json:"maintenance,omitempty"`
+	// ECSServices are the task counts of the ECS services, when discovery
+	// records them.
+	ECSServices []ServiceTasks `json:"ecs_services,omitempty"`
+	// Ambiguous are the orgs matching several services, those the last
+	// refresh found or the org asked for.
+	Ambiguous []ambiguousOrg `json:"ambiguous,omitempty"`
+	// ServiceRoles are the blue/green roles of the tagged ECS services,
+	// those the org matches with the share of its requests they take.
+	ServiceRoles []serviceRole `json:"service_roles,omitempty"`
+}
+
+type backendDump struct {
+	// Container is the container the backend is, the org's target
+	// container when the org has one.
+	Container string `json:"container"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	PortName  string `json:"port_name,omitempty"`
+	TaskArn   string `json:"task_arn"`
+	// Service is the ECS service that started the task.
+	Service  string `json:"service,omitempty"`
+	Revision int    `json:"revision,omitempty"`
+	// TaskDefinition is the family:revision of the task's definition.
+	TaskDefinition string     `json:"task_definition,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	Zone           string     `json:"zone,omitempty"`
+	// Health is the health status ECS reports for the container.
+	Health string `json:"ecs_health,omitempty"`
+	// Healthy is false when the backend failed its health check, is
+	// ejected or drained, and State says why.
+	Healthy bool   `json:"healthy"`
+	State   string `json:"state"`
+	Source  source `json:"source"`
+}
+
+// source is where a backend was discovered.
+type source struct {
+	Cluster string `json:"cluster"`
+	Region  string `json:"region"`
+	Account string `json:"account,omitempty"`
+}
+
+// Dump returns the services whose name is orgID or, failing that, the one
+// containing it, by the same rules as Lookup, their backends in the org's
+// target container if it has one, or all those it matches when their ECS
+// services are tagged with roles. An empty orgID returns every service.
+func (t *RouteTable) Dump(orgID string) RoutesDump {
+	t.mu.RLock()
+	var name string
+	var services []ECSService
+	var counts []ServiceTasks
+	var ambiguous []ambiguousOrg
+	var roles []serviceRole
+	if orgID == "" {
+		services = t.services
+		counts = t.serviceTasks
+		roles = append(roles, t.serviceRoles...)
+		sortServiceRoles(roles)
+		for _, org := range t.ambiguousOrgs {
+			ambiguous = append(ambiguous, org)
+		}
+	} else {
+		var candidates []string
+		name, candidates = t.match(orgID)
+		services = t.inContainer(orgID, t.index[name])
+		live, tagged := t.blueGreen(name, candidates)
+		if len(tagged) > 0 {
+			roles = dumpRoles(live, tagged)
+			services = nil
+			for _, candidate := range candidates {
+				services = append(services, t.index[candidate]...)
+			}
+			if len(candidates) == 0 {
+				services = t.index[name]
+			}
+			services = t.inContainer(orgID, services)
+		} else if len(candidates) > 0 {
+			ambiguous = []ambiguousOrg{{Org: orgID, Services: candidates, Resolved: name}}
+		}
+		if total, ok := t.matchServiceTasks(orgID); ok {
+			for _, count := range t.serviceTasks {
+				if count.Service == total.Service {
+					counts = append(counts, count)
+				}
+			}
+		}
+	}
+	builtAt := t.builtAt
+	t.mu.RUnlock()
+
+	states := t.backendStates()
+	sort.Slice(ambiguous, func(i, j int) bool { return ambiguous[i].Org < ambiguous[j].Org })
+	dump := RoutesDump{Services: map[string][]backendDump{}, ECSServices: counts, Ambiguous: ambiguous, ServiceRoles: roles}
+	if !builtAt.IsZero() {
+		dump.BuiltAt = &builtAt
+	}
+	for _, svc := range services {
+		healthy, state := states.state(svc)
+		// an org's backends are listed under its service even when they are
+		// another container of its tasks
+		key := svc.Name
+		if name != "" {
+			key = name
+		}
+		var startedAt *time.Time
+		if !svc.StartedAt.IsZero() {
+			startedAt = &svc.StartedAt
+		}
+		dump.Services[key] = append(dump.Services[key], backendDump{
+			Container:      svc.Name,
+			IP:             svc.IP,
+			Port:           svc.Port,
+			PortName:       svc.PortName,
+			TaskArn:        svc.TaskArn,
+			Service:        svc.Service,
+			Revision:       svc.Revision,
+			TaskDefinition: svc.TaskDefinition,
+			StartedAt:      startedAt,
+			Zone:           svc.Zone,
+			Health:         svc.Health,
+			Healthy:        healthy,
+			State:          state,
+			Source:         source{Cluster: svc.Cluster, Region: svc.Region, Account: svc.Account},
+		})
+	}
+	for _, backends := range dump.Services {
+		sort.Slice(backends, func(i, j int) bool { return backends[i].TaskArn < backends[j].TaskArn })
+	}
+	return dump
+}
+
+// backendStates holds what takes backends out of rotation, read once for a
+// whole dump of the table.
+type backendStates struct {
+	t        *RouteTable
+	breakers map[string]string
+	slow     map[string]bool
+}
+
+func (t *RouteTable) backendStates() backendStates {
+	states := backendStates{t: t, breakers: t.Breakers.States(), slow: map[string]bool{}}
+	for _, address := range t.Outliers.Ejected() {
+		states.slow[address] = true
+	}
+	return states
+}
+
+// state returns whether svc takes traffic and, if not, why: healthy,
+// drained, ecs-unhealthy or ecs-unknown, unhealthy, ejected,
+// latency-outlier, or breaker- followed by the state of its circuit breaker,
+// which takes probes when half open.
+func (s backendStates) state(svc ECSService) (bool, string) {
+	address := svc.Address()
+	switch {
+	case s.t.Drained.Drained(svc.IP):
+		return false, "drained"
+	case !s.t.ecsHealth.allows(svc):
+		return false, "ecs-" + strings.ToLower(svc.Health)
+	case !s.t.health.Healthy(address):
+		return false, "unhealthy"
+	case s.t.ejector.Ejected(address):
+		return false, "ejected"
+	case s.slow[address]:
+		return false, "latency-outlier"
+	case s.breakers[address] != "":
+		return s.breakers[address] != breakerOpen.String(), "breaker-" + s.breakers[address]
+	}
+	return true, "healthy"
+}
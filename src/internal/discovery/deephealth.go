@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// BackgroundLoops tracks the loops the proxy runs in the background until
+// shutdown, so the deep health check tells one that stopped early.
+type BackgroundLoops struct {
+	mu    sync.Mutex
+	loops map[string]LoopStatus
+}
+
+// LoopStatus is whether a background loop runs, and since when it does or
+// stopped.
+type LoopStatus struct {
+	Running bool      `json:"running"`
+	Since   time.Time `json:"since"`
+}
+
+// NewBackgroundLoops returns a record with no loops.
+func NewBackgroundLoops() *BackgroundLoops {
+	return &BackgroundLoops{loops: map[string]LoopStatus{}}
+}
+
+// Go runs fn in a goroutine recorded under name.
+func (b *BackgroundLoops) Go(name string, fn func()) {
+	b.set(name, true)
+	go func() {
+		defer b.set(name, false)
+		fn()
+	}()
+}
+
+func (b *BackgroundLoops) set(name string, running bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.loops[name] = LoopStatus{Running: running, Since: time.Now()}
+}
+
+// Status returns the status of every loop by name.
+func (b *BackgroundLoops) Status() map[string]LoopStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := make(map[string]LoopStatus, len(b.loops))
+	for name, loop := range b.loops {
+		status[name] = loop
+	}
+	return status
+}
+
+// NegativeCacheLen returns the number of org IDs remembered as matching
+// nothing, 0 without a negative cache.
+func (t *RouteTable) NegativeCacheLen() int {
+	return t.negative.Len()
+}
@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"sort"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// routeKey identifies an entry across refreshes: a container of a task.
+type routeKey struct {
+	Name    string
+	TaskArn string
+}
+
+// RouteChange is an entry whose address changed between refreshes.
+type RouteChange struct {
+	Old, New ECSService
+}
+
+// RouteDiff is the difference between two route tables.
+type RouteDiff struct {
+	Added   []ECSService
+	Removed []ECSService
+	Changed []RouteChange
+}
+
+// Empty reports whether no route was added, removed or changed.
+func (d RouteDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffRoutes compares two route tables. Entries are sorted by service name
+// and task so the result doesn't depend on discovery order.
+func diffRoutes(old, new []ECSService) RouteDiff {
+	previous := make(map[routeKey]ECSService, len(old))
+	for _, svc := range old {
+		previous[routeKey{svc.Name, svc.TaskArn}] = svc
+	}
+	var diff RouteDiff
+	for _, svc := range new {
+		key := routeKey{svc.Name, svc.TaskArn}
+		before, ok := previous[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, svc)
+		case before.Address() != svc.Address():
+			diff.Changed = append(diff.Changed, RouteChange{Old: before, New: svc})
+		}
+		delete(previous, key)
+	}
+	for _, svc := range previous {
+		diff.Removed = append(diff.Removed, svc)
+	}
+
+	sortRoutes(diff.Added)
+	sortRoutes(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return routeLess(diff.Changed[i].New, diff.Changed[j].New)
+	})
+	return diff
+}
+
+func sortRoutes(services []ECSService) {
+	sort.Slice(services, func(i, j int) bool {
+		return routeLess(services[i], services[j])
+	})
+}
+
+func routeLess(a, b ECSService) bool {
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.TaskArn < b.TaskArn
+}
+
+// count counts the changes.
+func (d RouteDiff) count() {
+	telemetry.RoutesAdded.Add(int64(len(d.Added)))
+	telemetry.RoutesRemoved.Add(int64(len(d.Removed)))
+	telemetry.RoutesChanged.Add(int64(len(d.Changed)))
+}
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	route := func(name, id, ip string) ECSService {
+		return ECSService{Name: name, IP: ip, Port: 8080, TaskArn: discoverytest.TaskARN("tenants", id), Cluster: "tenants", Region: discoverytest.Region}
+	}
+	old := []ECSService{
+		route("globex", "g1", "10.0.1.1"),
+		route("acme", "a1", "10.0.0.1"),
+		route("acme", "a2", "10.0.0.2"),
+		route("initech", "i1", "10.0.2.1"),
+	}
+	healthChanged := route("acme", "a1", "10.0.0.1")
+	healthChanged.Health = "UNHEALTHY"
+	new := []ECSService{
+		route("umbrella", "u1", "10.0.3.1"),
+		route("acme", "a3", "10.0.0.3"),
+		healthChanged,
+		route("globex", "g1", "10.0.1.9"),
+		route("acme", "a0", "10.0.0.4"),
+	}
+	want := RouteDiff{
+		Added:   []ECSService{route("acme", "a0", "10.0.0.4"), route("acme", "a3", "10.0.0.3"), route("umbrella", "u1", "10.0.3.1")},
+		Removed: []ECSService{route("acme", "a2", "10.0.0.2"), route("initech", "i1", "10.0.2.1")},
+		Changed: []RouteChange{{Old: route("globex", "g1", "10.0.1.1"), New: route("globex", "g1", "10.0.1.9")}},
+	}
+	if diff := diffRoutes(old, new); !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff\n%+v\nwant\n%+v", diff, want)
+	}
+	if diff := diffRoutes(old, old[1:]); len(diff.Removed) != 1 || len(diff.Added)+len(diff.Changed) != 0 {
+		t.Errorf("diff after removing one route: %+v", diff)
+	}
+	if diff := diffRoutes(new, new); !diff.Empty() {
+		t.Errorf("diff of a table with itself: %+v", diff)
+	}
+}
+
+func TestReplaceAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.SetClock(clocktest.New())
+	first := []ECSService{
+		{Name: "acme", IP: "10.0.0.1", Port: 8080, TaskArn: "a1", Cluster: "tenants", Region: discoverytest.Region},
+		{Name: "globex", IP: "10.0.1.1", Port: 8080, TaskArn: "g1", Cluster: "tenants", Region: discoverytest.Region},
+	}
+	routes := NewRouteTable(first, nil, config.LBStrategyRoundRobin)
+	routes.SetAudit(audit, "primary")
+
+	second := []ECSService{
+		{Name: "acme", IP: "10.0.0.2", Port: 8080, TaskArn: "a1", Cluster: "tenants", Region: discoverytest.Region},
+		{Name: "initech", IP: "10.0.2.1", Port: 8080, TaskArn: "i1", Cluster: "tenants", Region: discoverytest.Region},
+	}
+	added, removed := telemetry.RoutesAdded.Value(), telemetry.RoutesRemoved.Value()
+	routes.Replace(second, TriggerScheduled)
+	if telemetry.RoutesAdded.Value()-added != 1 || telemetry.RoutesRemoved.Value()-removed != 1 {
+		t.Errorf("counted %d added and %d removed, want 1 and 1", telemetry.RoutesAdded.Value()-added, telemetry.RoutesRemoved.Value()-removed)
+	}
+
+	// the same snapshot again keeps the table as it is
+	before := routes.Services()
+	if diff := routes.Replace(append([]ECSService(nil), second...), TriggerScheduled); !diff.Empty() {
+		t.Errorf("diff of an unchanged snapshot: %+v", diff)
+	}
+	if after := routes.Services(); &after[0] != &before[0] {
+		t.Error("unchanged snapshot swapped in")
+	}
+
+	records, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`{"time":"2024-05-01T12:00:00Z","table":"primary","trigger":"scheduled","change":"added","service":"initech","task":"i1","cluster":"tenants","region":"us-west-2","new":"10.0.2.1:8080"}`,
+		`{"time":"2024-05-01T12:00:00Z","table":"primary","trigger":"scheduled","change":"removed","service":"globex","task":"g1","cluster":"tenants","region":"us-west-2","old":"10.0.1.1:8080"}`,
+		`{"time":"2024-05-01T12:00:00Z","table":"primary","trigger":"scheduled","change":"changed","service":"acme","task":"a1","cluster":"tenants","region":"us-west-2","old":"10.0.0.1:8080","new":"10.0.0.2:8080"}`,
+	}, "\n") + "\n"
+	if string(records) != want {
+		t.Errorf("audit records\n%s\nwant\n%s", records, want)
+	}
+}
@@ -0,0 +1,522 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ECSService is a route entry: a container of a task, named after it. PortName
+// is the name of the port mapping Port comes from, if any, Zone the
+// availability zone of the task if known, and Health the health status ECS
+// reports for the container, refreshed by every discovery.
+type ECSService struct {
+	Name     string
+	IP       string
+	Port     int
+	PortName string
+	TaskArn  string
+	Revision int
+	Cluster  string
+	Region   string
+	Account  string
+	Zone     string
+	Health   string
+	// TaskDefinition is the family:revision of the task's definition and
+	// StartedAt when the task started, zero if it didn't yet.
+	TaskDefinition string
+	StartedAt      time.Time
+	// Service is the ECS service that started the task, empty for a task
+	// started otherwise.
+	Service string
+}
+
+// Address returns the host:port of the service. IPv6 addresses are
+// bracketed.
+func (s ECSService) Address() string {
+	return net.JoinHostPort(s.IP, strconv.Itoa(s.Port))
+}
+
+// ECSAPI is the part of the ECS API discovery, the waker and the deep health
+// check call,
+// implemented by *ecs.Client and by fakes serving canned responses.
+type ECSAPI interface {
+	ecs.ListServicesAPIClient
+	ecs.ListTasksAPIClient
+	DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error)
+	DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error)
+	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
+	DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error)
+	DescribeTaskSets(ctx context.Context, params *ecs.DescribeTaskSetsInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskSetsOutput, error)
+	ListTagsForResource(ctx context.Context, params *ecs.ListTagsForResourceInput, optFns ...func(*ecs.Options)) (*ecs.ListTagsForResourceOutput, error)
+	UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error)
+}
+
+// ClusterTarget is a single cluster to run discovery against.
+type ClusterTarget struct {
+	Client  ECSAPI
+	Cluster string
+	Region  string
+	Account string
+}
+
+func listServices(ctx context.Context, ecsClient ECSAPI, cluster string) ([]string, error) {
+	var services []string
+	paginator := ecs.NewListServicesPaginator(ecsClient, &ecs.ListServicesInput{
+		Cluster: aws.String(cluster),
+	})
+	for paginator.HasMorePages() {
+		var resp *ecs.ListServicesOutput
+		err := ECSRetryPolicy.call(ctx, "ListServices", func(ctx context.Context) (err error) {
+			resp, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, resp.ServiceArns...)
+	}
+	return services, nil
+}
+
+// Options controls which tasks discovery turns into routes.
+type Options struct {
+	PrimaryDeploymentOnly bool
+	// TaskSets selects the task sets of services deployed by CODE_DEPLOY or
+	// an EXTERNAL controller whose tasks PrimaryDeploymentOnly routes to, one
+	// of the TaskSets constants.
+	TaskSets      string
+	TaskSelection string
+	// PortLabel is the docker label holding the port a container listens
+	// on; containers without it use DefaultPort. PortNames select a port
+	// mapping by name instead.
+	PortLabel   string
+	PortNames   config.PortNames
+	DefaultPort int
+	// AddressFamily selects IPv4 or IPv6 addresses, one of the
+	// AddressFamily constants.
+	AddressFamily string
+	// RoutableCIDRs restricts which network interface of a container is
+	// routed to. Without it the first interface is used.
+	RoutableCIDRs []netip.Prefix
+	// Concurrency is how many DescribeTasks batches of a cluster run at
+	// once.
+	Concurrency int
+	// ClusterStagger delays the discovery of each cluster after the first
+	// by this much more than the previous one.
+	ClusterStagger time.Duration
+	// Budget bounds how long tasks are described for. Tasks not described
+	// in time keep their previous entries. Zero means no limit.
+	Budget time.Duration
+	// ServiceCounts records the desired, running and pending task counts
+	// of each service.
+	ServiceCounts bool
+	// ServiceRoles reads the blue/green roles of the services from their
+	// tags.
+	ServiceRoles bool
+}
+
+// listTasks lists the tasks in the cluster, only the tasks started by
+// startedBy when it is not empty and only the tasks of service when it
+// isn't.
+func listTasks(ctx context.Context, ecsClient ECSAPI, cluster, startedBy, service string) ([]string, error) {
+	var tasks []string
+	input := &ecs.ListTasksInput{
+		Cluster: aws.String(cluster),
+	}
+	if startedBy != "" {
+		input.StartedBy = aws.String(startedBy)
+	}
+	if service != "" {
+		input.ServiceName = aws.String(service)
+	}
+	paginator := ecs.NewListTasksPaginator(ecsClient, input)
+	for paginator.HasMorePages() {
+		var resp *ecs.ListTasksOutput
+		err := ECSRetryPolicy.call(ctx, "ListTasks", func(ctx context.Context) (err error) {
+			resp, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, resp.TaskArns...)
+	}
+	return tasks, nil
+}
+
+// describeServices describes the services of the cluster. Services that
+// don't exist are left out.
+func describeServices(ctx context.Context, ecsClient ECSAPI, cluster string, services []string) ([]types.Service, error) {
+	var described []types.Service
+	// DescribeServices accepts at most 10 services per call
+	for start := 0; start < len(services); start += 10 {
+		end := start + 10
+		if end > len(services) {
+			end = len(services)
+		}
+		var resp *ecs.DescribeServicesOutput
+		err := ECSRetryPolicy.call(ctx, "DescribeServices", func(ctx context.Context) (err error) {
+			resp, err = ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+				Cluster:  aws.String(cluster),
+				Services: services[start:end],
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		described = append(described, resp.Services...)
+	}
+	return described, nil
+}
+
+// listPrimaryTasks lists the routable tasks of each of the described
+// services, as routableTasks picks them.
+func listPrimaryTasks(ctx context.Context, ecsClient ECSAPI, cluster string, services []types.Service, taskSets string) ([]string, error) {
+	var tasks []string
+	for _, service := range services {
+		serviceTasks, err := routableTasks(ctx, ecsClient, cluster, service, taskSets)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, serviceTasks...)
+	}
+	return tasks, nil
+}
+
+// buildServiceDetails runs discovery against every target concurrently, so a
+// slow or unavailable region does not hold up the others, and merges the
+// results in target order. A target that fails (for example because its
+// region is down or its role could not be assumed) is logged and keeps its
+// entries from previous, as do tasks that could not be described in time;
+// only a failure of every target is an error. With opts.ServiceCounts the
+// task counts of the services are returned too, a failed target keeping
+// its counts from previousCounts, and with opts.ServiceRoles their roles,
+// a failed target keeping those of previousRoles.
+func buildServiceDetails(ctx context.Context, targets []ClusterTarget, opts Options, previous []ECSService, previousCounts []ServiceTasks, previousRoles []serviceRole) ([]ECSService, []ServiceTasks, []serviceRole, error) {
+	start := time.Now()
+	describeCtx := ctx
+	if opts.Budget > 0 {
+		var cancel context.CancelFunc
+		describeCtx, cancel = context.WithDeadline(ctx, start.Add(opts.Budget))
+		defer cancel()
+	}
+
+	results := make([][]ECSService, len(targets))
+	counts := make([][]ServiceTasks, len(targets))
+	roles := make([][]serviceRole, len(targets))
+	pending := make([][]string, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target ClusterTarget) {
+			defer wg.Done()
+			// staggered starts keep clusters sharing an account from
+			// hitting the API at the same moment
+			if i > 0 && opts.ClusterStagger > 0 {
+				select {
+				case <-ctx.Done():
+					errs[i] = ctx.Err()
+					return
+				case <-time.After(time.Duration(i) * opts.ClusterStagger):
+				}
+			}
+			results[i], counts[i], roles[i], pending[i], errs[i] = discoverCluster(ctx, describeCtx, target, opts)
+		}(i, target)
+	}
+	wg.Wait()
+
+	serviceDetails := []ECSService{}
+	var serviceCounts []ServiceTasks
+	var serviceRoles []serviceRole
+	failures := 0
+	for i, target := range targets {
+		if errs[i] != nil {
+			slog.Error("Failed to discover cluster, keeping its previous routes", "cluster", target.Cluster, "region", target.Region, "account", target.Account, "error", errs[i])
+			failures++
+			for _, svc := range previous {
+				if svc.Cluster == target.Cluster && svc.Region == target.Region && svc.Account == target.Account {
+					serviceDetails = append(serviceDetails, svc)
+				}
+			}
+			for _, count := range previousCounts {
+				if count.Cluster == target.Cluster && count.Region == target.Region && count.Account == target.Account {
+					serviceCounts = append(serviceCounts, count)
+				}
+			}
+			for _, role := range previousRoles {
+				if role.Cluster == target.Cluster && role.Region == target.Region && role.Account == target.Account {
+					serviceRoles = append(serviceRoles, role)
+				}
+			}
+			continue
+		}
+		serviceDetails = append(serviceDetails, results[i]...)
+		serviceCounts = append(serviceCounts, counts[i]...)
+		serviceRoles = append(serviceRoles, roles[i]...)
+		if len(pending[i]) > 0 {
+			slog.Warn("Could not describe tasks, keeping their previous routes", "tasks", len(pending[i]), "cluster", target.Cluster, "region", target.Region)
+			telemetry.DiscoveryPartial.Add(1)
+			undescribed := make(map[string]bool, len(pending[i]))
+			for _, taskArn := range pending[i] {
+				undescribed[taskArn] = true
+			}
+			for _, svc := range previous {
+				if undescribed[svc.TaskArn] {
+					serviceDetails = append(serviceDetails, svc)
+				}
+			}
+		}
+	}
+	if failures == len(targets) {
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		return nil, nil, nil, errors.New("failed to discover any cluster")
+	}
+	slog.Info("Built routes", "routes", len(serviceDetails), "clusters", len(targets)-failures, "targets", len(targets), "duration", time.Since(start))
+	return serviceDetails, serviceCounts, serviceRoles, nil
+}
+
+// discoverCluster lists and describes the tasks of a cluster, with
+// opts.ServiceCounts counts the tasks of its services, and with
+// opts.ServiceRoles reads their roles. Tasks are described under
+// describeCtx, which may expire before ctx; the ARNs of tasks that could
+// not be described are returned as pending.
+func discoverCluster(ctx, describeCtx context.Context, target ClusterTarget, opts Options) (details []ECSService, counts []ServiceTasks, roles []serviceRole, pending []string, err error) {
+	services, err := listServices(ctx, target.Client, target.Cluster)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	if opts.ServiceRoles {
+		if roles, err = listServiceRoles(ctx, target, services, opts.Concurrency); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to list the tags of services: %w", err)
+		}
+	}
+
+	var described []types.Service
+	if opts.PrimaryDeploymentOnly || opts.ServiceCounts {
+		if described, err = describeServices(ctx, target.Client, target.Cluster, services); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to describe services: %w", err)
+		}
+	}
+	if opts.ServiceCounts {
+		counts = countServiceTasks(target, described)
+	}
+
+	var tasks []string
+	if opts.PrimaryDeploymentOnly {
+		tasks, err = listPrimaryTasks(ctx, target.Client, target.Cluster, described, opts.TaskSets)
+	} else {
+		tasks, err = listTasks(ctx, target.Client, target.Cluster, "", "")
+	}
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	slog.Debug("Listed cluster", "services", len(services), "tasks", len(tasks), "cluster", target.Cluster, "region", target.Region)
+
+	details, pending = getServiceDetails(describeCtx, target, tasks, opts)
+	return details, counts, roles, pending, nil
+}
+
+// discoverService lists and describes the tasks of the ECS service named
+// service in the cluster of target. A cluster without the service has no
+// tasks of it. Unlike a full discovery, tasks that couldn't be described
+// are an error, there are no previous entries to fall back on.
+func discoverService(ctx context.Context, target ClusterTarget, service string, opts Options) ([]ECSService, error) {
+	var tasks []string
+	var err error
+	if opts.PrimaryDeploymentOnly {
+		var described []types.Service
+		described, err = describeServices(ctx, target.Client, target.Cluster, []string{service})
+		if err == nil {
+			tasks, err = listPrimaryTasks(ctx, target.Client, target.Cluster, described, opts.TaskSets)
+		}
+	} else {
+		tasks, err = listTasks(ctx, target.Client, target.Cluster, "", service)
+	}
+	var notFound *types.ServiceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	details, pending := getServiceDetails(ctx, target, tasks, opts)
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("failed to describe %d tasks", len(pending))
+	}
+	return details, nil
+}
+
+// describeTasksBatch is the most tasks DescribeTasks accepts per call.
+const describeTasksBatch = 100
+
+// describedTask is what discovery keeps of a described task.
+type describedTask struct {
+	Group    string
+	Revision int
+	Routable bool
+	// Services is nil if a container of the task has no routable address.
+	Services []ECSService
+}
+
+// getServiceDetails describes tasks in batches, running up to
+// opts.Concurrency batches at a time, and turns each batch into route
+// entries as soon as it arrives so the full task descriptions are never held
+// at once. Results keep the order of tasks regardless of which batch
+// finishes first. The ARNs of batches that still fail after retrying, or
+// that ran out of time, are returned as pending.
+func getServiceDetails(ctx context.Context, target ClusterTarget, tasks []string, opts Options) (details []ECSService, pending []string) {
+	var batches [][]string
+	for start := 0; start < len(tasks); start += describeTasksBatch {
+		end := start + describeTasksBatch
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		batches = append(batches, tasks[start:end])
+	}
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ports := newTaskDefinitionPorts(target.Client, opts.PortLabel, opts.PortNames, opts.DefaultPort)
+	names := &interner{}
+	described := make([][]describedTask, len(batches))
+	failed := make([]bool, len(batches))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(batches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				tasks, err := describeTaskBatch(ctx, target.Client, target.Cluster, batches[batch])
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Error("Failed to describe tasks", "tasks", len(batches[batch]), "cluster", target.Cluster, "error", err)
+					}
+					failed[batch] = true
+					continue
+				}
+				for _, task := range tasks {
+					described[batch] = append(described[batch], describeTask(ctx, task, target, ports, names, opts))
+				}
+			}
+		}()
+	}
+	for batch := range batches {
+		jobs <- batch
+	}
+	close(jobs)
+	wg.Wait()
+
+	var merged []describedTask
+	for batch, tasks := range described {
+		if failed[batch] {
+			pending = append(pending, batches[batch]...)
+		}
+		merged = append(merged, tasks...)
+	}
+	if opts.TaskSelection == config.TaskSelectionLatestRevision {
+		merged = selectLatestRevision(merged)
+	}
+	details = []ECSService{}
+	for _, task := range merged {
+		details = append(details, task.Services...)
+	}
+	return details, pending
+}
+
+func describeTaskBatch(ctx context.Context, ecsClient ECSAPI, cluster string, tasks []string) ([]types.Task, error) {
+	var resp *ecs.DescribeTasksOutput
+	err := ECSRetryPolicy.call(ctx, "DescribeTasks", func(ctx context.Context) (err error) {
+		resp, err = ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(cluster),
+			Tasks:   tasks,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tasks, nil
+}
+
+// describeTask turns a task into its route entries, one per container.
+func describeTask(ctx context.Context, task types.Task, target ClusterTarget, ports *taskDefinitionPorts, names *interner, opts Options) describedTask {
+	taskDefinitionArn := aws.ToString(task.TaskDefinitionArn)
+	described := describedTask{
+		Group:    names.intern(aws.ToString(task.Group)),
+		Revision: taskRevision(taskDefinitionArn),
+		Routable: taskRoutable(task),
+	}
+	// every container of the task, and most tasks of a service, share these
+	zone := names.intern(aws.ToString(task.AvailabilityZone))
+	taskDefinition := names.intern(taskDefinitionName(taskDefinitionArn))
+	var containers []ECSService
+	for _, container := range task.Containers {
+		address, ok := containerAddress(task, container, opts.AddressFamily, opts.RoutableCIDRs)
+		if !ok {
+			slog.Debug("Skipping task, no network interface has a routable address", "task", aws.ToString(task.TaskArn))
+			return described
+		}
+		name := names.intern(aws.ToString(container.Name))
+		port, portName := ports.port(ctx, taskDefinitionArn, name)
+		containers = append(containers, ECSService{
+			Name:           name,
+			IP:             address,
+			Port:           port,
+			PortName:       portName,
+			TaskArn:        aws.ToString(task.TaskArn),
+			Revision:       described.Revision,
+			Cluster:        target.Cluster,
+			Region:         target.Region,
+			Account:        target.Account,
+			Zone:           zone,
+			Health:         containerHealth(task, container),
+			TaskDefinition: taskDefinition,
+			StartedAt:      aws.ToTime(task.StartedAt),
+			Service:        serviceOfGroup(described.Group),
+		})
+	}
+	described.Services = containers
+	return described
+}
+
+// interner deduplicates strings that repeat across many tasks, such as
+// container names, service groups, zones and task definitions, so each is
+// held once per refresh.
+type interner struct {
+	mu      sync.Mutex
+	strings map[string]string
+}
+
+func (i *interner) intern(s string) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if interned, ok := i.strings[s]; ok {
+		return interned
+	}
+	if i.strings == nil {
+		i.strings = map[string]string{}
+	}
+	i.strings[s] = s
+	return s
+}
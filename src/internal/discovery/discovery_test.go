@@ -0,0 +1,729 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestBuildServiceDetails(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.PortLabel("acme", 9000)
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"),
+	)
+	opts := Options{PortLabel: "proxy.port", DefaultPort: 8080, AddressFamily: config.AddressFamilyIPv4, Concurrency: 2}
+
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serviceNames(details), "acme=10.0.0.1:9000 acme=10.0.0.2:9000 globex=10.0.1.1:8080"; got != want {
+		t.Fatalf("routes %s, want %s", got, want)
+	}
+	want := ECSService{
+		Name:           "acme",
+		IP:             "10.0.0.1",
+		Port:           9000,
+		TaskArn:        discoverytest.TaskARN("tenants", "a1"),
+		Revision:       1,
+		Cluster:        "tenants",
+		Region:         discoverytest.Region,
+		Zone:           "us-west-2a",
+		Health:         "HEALTHY",
+		TaskDefinition: "acme:1",
+		StartedAt:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Service:        "acme",
+	}
+	if details[0] != want {
+		t.Errorf("first entry\n%+v\nwant\n%+v", details[0], want)
+	}
+	// each task definition is described once per refresh
+	if n := fake.Count("DescribeTaskDefinition"); n != 2 {
+		t.Errorf("DescribeTaskDefinition called %d times, want 2", n)
+	}
+}
+
+func TestBuildServiceDetailsPagination(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.ServicePage = 2
+	fake.TaskPage = 30
+	var want []string
+	for i := 0; i < 5; i++ {
+		fake.AddService("big", fmt.Sprintf("svc%d", i))
+	}
+	for i := 0; i < 250; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/200, i%200+1)
+		fake.AddTasks("big", discoverytest.Task("big", fmt.Sprintf("svc%d", i%5), fmt.Sprint(i), ip))
+		want = append(want, discoverytest.TaskARN("big", fmt.Sprint(i)))
+	}
+
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "big")},
+		Options{DefaultPort: 8080, Concurrency: 3}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Count("ListServices"); n != 3 {
+		t.Errorf("ListServices called %d times for 5 services 2 per page, want 3", n)
+	}
+	if n := fake.Count("ListTasks"); n != 9 {
+		t.Errorf("ListTasks called %d times for 250 tasks 30 per page, want 9", n)
+	}
+	batches := slices.Clone(fake.DescribeBatches)
+	slices.Sort(batches)
+	if !slices.Equal(batches, []int{50, 100, 100}) {
+		t.Errorf("DescribeTasks batches %v, want 100, 100 and 50", batches)
+	}
+	var got []string
+	for _, svc := range details {
+		got = append(got, svc.TaskArn)
+	}
+	// batches run concurrently, their entries still come in listing order
+	if !slices.Equal(got, want) {
+		t.Errorf("got %d entries out of listing order", len(got))
+	}
+}
+
+func TestBuildServiceDetailsErrors(t *testing.T) {
+	previous := []ECSService{
+		{Name: "acme", IP: "10.0.0.9", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "old"), Cluster: "tenants", Region: discoverytest.Region},
+		{Name: "globex", IP: "10.1.0.9", Port: 8080, TaskArn: discoverytest.TaskARN("other", "old"), Cluster: "other", Region: discoverytest.Region},
+	}
+	newFixture := func() *discoverytest.ECS {
+		fake := discoverytest.NewECS()
+		fake.AddService("tenants", "acme")
+		fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+		fake.AddService("other", "globex")
+		fake.AddTasks("other", discoverytest.Task("other", "globex", "g1", "10.1.0.1"))
+		return fake
+	}
+	opts := Options{DefaultPort: 8080}
+
+	t.Run("every target fails", func(t *testing.T) {
+		fake := newFixture()
+		fake.FailNext("ListServices", discoverytest.AccessDenied())
+		_, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, previous, nil, nil)
+		if err == nil {
+			t.Fatal("discovery succeeded with every cluster failing")
+		}
+		if n := fake.Count("ListServices"); n != 1 {
+			t.Errorf("access denied retried: %d calls", n)
+		}
+	})
+
+	t.Run("one target fails", func(t *testing.T) {
+		healthy, failing := newFixture(), newFixture()
+		failing.FailNext("ListServices", discoverytest.AccessDenied())
+		targets := []ClusterTarget{testTarget(healthy, "tenants"), testTarget(failing, "other")}
+		details, _, _, err := buildServiceDetails(context.Background(), targets, opts, previous, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := serviceNames(details), "acme=10.0.0.1:8080 globex=10.1.0.9:8080"; got != want {
+			t.Errorf("routes %s, want the failed cluster's previous ones next to the other's new ones %s", got, want)
+		}
+	})
+
+	t.Run("throttled then succeeds", func(t *testing.T) {
+		fake := newFixture()
+		fake.FailNext("ListTasks", discoverytest.Throttled(), discoverytest.Throttled())
+		details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, previous, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serviceNames(details); got != "acme=10.0.0.1:8080" {
+			t.Errorf("routes %s", got)
+		}
+		if n := fake.Count("ListTasks"); n != 3 {
+			t.Errorf("ListTasks called %d times, want 3", n)
+		}
+	})
+
+	t.Run("describe fails", func(t *testing.T) {
+		fake := newFixture()
+		fake.FailNext("DescribeTasks", discoverytest.AccessDenied())
+		details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, previous[:1], nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the task that couldn't be described isn't the one of previous
+		if got := serviceNames(details); got != "" {
+			t.Errorf("routes %s, want none", got)
+		}
+		fake.FailNext("DescribeTasks", discoverytest.AccessDenied())
+		kept := []ECSService{{Name: "acme", IP: "10.0.0.7", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "a1"), Cluster: "tenants", Region: discoverytest.Region}}
+		details, _, _, err = buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, kept, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serviceNames(details); got != "acme=10.0.0.7:8080" {
+			t.Errorf("routes %s, want the undescribed task's previous entry", got)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		fake := newFixture()
+		fake.Latency = time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, _, _, err := buildServiceDetails(ctx, []ClusterTarget{testTarget(fake, "tenants")}, opts, previous, nil, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want the deadline", err)
+		}
+	})
+}
+
+func TestBuildServiceDetailsPrimaryDeployment(t *testing.T) {
+	for _, tt := range []struct {
+		primaryOnly bool
+		want        string
+	}{
+		{primaryOnly: true, want: "acme=10.0.0.1:8080 acme=10.0.0.3:8080"},
+		// old tasks keep draining traffic unless it is opted in
+		{primaryOnly: false, want: "acme=10.0.0.1:8080 acme=10.0.0.2:8080 acme=10.0.0.3:8080 acme=10.0.0.4:8080"},
+	} {
+		fake := discoverytest.NewECS()
+		fake.AddService("tenants", "acme")
+		fake.Services["tenants"][0].Deployments = []types.Deployment{
+			{Id: aws.String("ecs-svc/new"), Status: aws.String("PRIMARY")},
+			{Id: aws.String("ecs-svc/old"), Status: aws.String("ACTIVE")},
+		}
+		for i, deployment := range []string{"ecs-svc/new", "ecs-svc/old", "ecs-svc/new", "ecs-svc/old"} {
+			task := discoverytest.Task("tenants", "acme", fmt.Sprint(i), fmt.Sprintf("10.0.0.%d", i+1))
+			task.StartedBy = aws.String(deployment)
+			fake.AddTasks("tenants", task)
+		}
+		opts := Options{DefaultPort: 8080, PrimaryDeploymentOnly: tt.primaryOnly}
+		details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serviceNames(details); got != tt.want {
+			t.Errorf("primary only %t: routes %s, want %s", tt.primaryOnly, got, tt.want)
+		}
+		if !tt.primaryOnly {
+			continue
+		}
+		if fake.Count("DescribeServices") == 0 {
+			t.Error("primary deployment found without describing the service")
+		}
+		for _, input := range fake.ListTasksInputs {
+			if aws.ToString(input.StartedBy) != "ecs-svc/new" {
+				t.Errorf("tasks listed for %q, want only the primary deployment", aws.ToString(input.StartedBy))
+			}
+		}
+	}
+}
+
+func TestBuildServiceDetailsLatestRevision(t *testing.T) {
+	fake := discoverytest.NewECS()
+	old := discoverytest.Task("tenants", "acme", "old", "10.0.0.1")
+	current := discoverytest.Task("tenants", "acme", "new", "10.0.0.2")
+	current.TaskDefinitionArn = aws.String(discoverytest.TaskDefinitionARN("acme", 2))
+	pending := discoverytest.Task("tenants", "acme", "pending", "10.0.0.3")
+	pending.TaskDefinitionArn = aws.String(discoverytest.TaskDefinitionARN("acme", 3))
+	pending.LastStatus = aws.String("PROVISIONING")
+	fake.AddTasks("tenants", old, current, pending)
+	opts := Options{DefaultPort: 8080, TaskSelection: config.TaskSelectionLatestRevision}
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revision 3 has no routable task yet
+	if got, want := serviceNames(details), "acme=10.0.0.2:8080"; got != want {
+		t.Errorf("routes %s, want %s", got, want)
+	}
+}
+
+// eni returns a task ENI attachment with the given addresses.
+func eni(ipv4, ipv6 string) types.Attachment {
+	attachment := types.Attachment{Type: aws.String("ElasticNetworkInterface")}
+	if ipv4 != "" {
+		attachment.Details = append(attachment.Details, types.KeyValuePair{Name: aws.String("privateIPv4Address"), Value: aws.String(ipv4)})
+	}
+	if ipv6 != "" {
+		attachment.Details = append(attachment.Details, types.KeyValuePair{Name: aws.String("ipv6Address"), Value: aws.String(ipv6)})
+	}
+	return attachment
+}
+
+func TestContainerAddress(t *testing.T) {
+	routableCIDRs := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("fd00:1::/32")}
+	for _, tt := range []struct {
+		name       string
+		interfaces []types.NetworkInterface
+		eni        []types.Attachment
+		family     string
+		cidrs      []netip.Prefix
+		want       string
+	}{
+		{
+			name:       "ipv4",
+			interfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.0.1")}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "dual stack ipv4",
+			interfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.0.1"), Ipv6Address: aws.String("2600:1f14::1")}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "dual stack ipv6",
+			interfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.0.1"), Ipv6Address: aws.String("2600:1f14::1")}},
+			family:     config.AddressFamilyIPv6,
+			want:       "2600:1f14::1",
+		},
+		{
+			name:       "ipv6 only preferred",
+			interfaces: []types.NetworkInterface{{Ipv6Address: aws.String("2600:1f14::1")}},
+			family:     config.AddressFamilyPreferIPv6,
+			want:       "2600:1f14::1",
+		},
+		{
+			name:       "ipv6 only with ipv4",
+			interfaces: []types.NetworkInterface{{Ipv6Address: aws.String("2600:1f14::1")}},
+		},
+		{
+			name:       "ipv4 only with ipv6",
+			interfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.0.1")}},
+			family:     config.AddressFamilyIPv6,
+		},
+		{
+			name: "second interface routable",
+			interfaces: []types.NetworkInterface{
+				{PrivateIpv4Address: aws.String("10.0.0.1")},
+				{PrivateIpv4Address: aws.String("10.1.0.1")},
+			},
+			cidrs: routableCIDRs,
+			want:  "10.1.0.1",
+		},
+		{
+			name:       "no interface routable",
+			interfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.0.1")}},
+			cidrs:      routableCIDRs,
+		},
+		{
+			name: "attachments",
+			eni:  []types.Attachment{eni("10.0.0.5", "")},
+			want: "10.0.0.5",
+		},
+		{
+			name:  "second attachment routable",
+			eni:   []types.Attachment{eni("10.0.0.5", ""), eni("10.1.0.5", "")},
+			cidrs: routableCIDRs,
+			want:  "10.1.0.5",
+		},
+		{
+			name:   "ipv6 attachment",
+			eni:    []types.Attachment{eni("", "fd00:1::5")},
+			family: config.AddressFamilyIPv6,
+			cidrs:  routableCIDRs,
+			want:   "fd00:1::5",
+		},
+		{
+			name:       "interfaces before attachments",
+			interfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String("10.0.0.1")}},
+			eni:        []types.Attachment{eni("10.1.0.5", "")},
+			cidrs:      routableCIDRs,
+		},
+		{
+			name: "other attachment",
+			eni:  []types.Attachment{{Type: aws.String("ServiceConnect"), Details: eni("10.0.0.5", "").Details}},
+		},
+		{
+			name: "no address",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			family := tt.family
+			if family == "" {
+				family = config.AddressFamilyIPv4
+			}
+			task := types.Task{Attachments: tt.eni}
+			container := types.Container{NetworkInterfaces: tt.interfaces}
+			got, ok := containerAddress(task, container, family, tt.cidrs)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("containerAddress = %q, %t, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeTaskSkipsUnroutable(t *testing.T) {
+	fake := discoverytest.NewECS()
+	sidecar := discoverytest.Task("tenants", "acme", "a1", "10.0.0.1")
+	sidecar.Containers = append(sidecar.Containers, types.Container{Name: aws.String("envoy")})
+	fake.AddTasks("tenants", sidecar, discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	details, pending := getServiceDetails(context.Background(), testTarget(fake, "tenants"),
+		[]string{discoverytest.TaskARN("tenants", "a1"), discoverytest.TaskARN("tenants", "a2")}, Options{DefaultPort: 8080})
+	if len(pending) > 0 {
+		t.Fatalf("pending %v", pending)
+	}
+	// a task with a container without an address is skipped as a whole
+	if got := serviceNames(details); got != "acme=10.0.0.2:8080" {
+		t.Errorf("routes %s", got)
+	}
+}
+
+func TestECSServiceAddress(t *testing.T) {
+	for svc, want := range map[ECSService]string{
+		{IP: "10.0.0.1", Port: 8080}:     "10.0.0.1:8080",
+		{IP: "2600:1f14::1", Port: 8080}: "[2600:1f14::1]:8080",
+	} {
+		if got := svc.Address(); got != want {
+			t.Errorf("Address() = %s, want %s", got, want)
+		}
+	}
+	if strings.Count(ECSService{IP: "fd00::1", Port: 443}.Address(), "]") != 1 {
+		t.Error("IPv6 address not bracketed once")
+	}
+}
+
+func TestRefreshRegions(t *testing.T) {
+	west, central := discoverytest.NewECS(), discoverytest.NewECS()
+	west.AddService("tenants", "acme")
+	west.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	central.AddService("tenants", "globex")
+	central.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.8.0.1"))
+	targets := []ClusterTarget{
+		testTarget(west, "tenants"),
+		{Client: central, Cluster: "tenants", Region: "eu-central-1"},
+	}
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	refresher := NewRefresher(targets, Options{DefaultPort: 8080}, routes, 0)
+	if _, err := refresher.Rebuild(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	// the same cluster name in two regions merges into one table, each
+	// entry recording its region
+	for org, region := range map[string]string{"acme": discoverytest.Region, "globex": "eu-central-1"} {
+		svc, err := routes.Lookup(org)
+		if err != nil {
+			t.Fatalf("Lookup(%s): %v", org, err)
+		}
+		if svc.Region != region {
+			t.Errorf("%s routed in %s, want %s", org, svc.Region, region)
+		}
+	}
+
+	// an outage in one region keeps its routes while the other's follow
+	// the tasks
+	central.FailNext("ListServices", discoverytest.AccessDenied())
+	west.RemoveTask("tenants", discoverytest.TaskARN("tenants", "a1"))
+	west.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	if _, err := refresher.Rebuild(context.Background(), TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serviceNames(routes.Services()), "acme=10.0.0.2:8080 globex=10.8.0.1:8080"; got != want {
+		t.Errorf("routes %s, want %s", got, want)
+	}
+
+	// only an outage in every region fails the refresh, serving the
+	// previous routes
+	west.FailNext("ListServices", discoverytest.AccessDenied())
+	central.FailNext("ListServices", discoverytest.AccessDenied())
+	if _, err := refresher.Rebuild(context.Background(), TriggerScheduled); err == nil {
+		t.Error("refresh succeeded with every region down")
+	}
+	if got, want := serviceNames(routes.Services()), "acme=10.0.0.2:8080 globex=10.8.0.1:8080"; got != want {
+		t.Errorf("routes %s after a failed refresh, want %s", got, want)
+	}
+}
+
+// contextECS is a fake ECS recording whether each call got the context of
+// the discovery it is part of.
+type contextECS struct {
+	*discoverytest.ECS
+	mu       sync.Mutex
+	detached []string
+}
+
+type discoveryKey struct{}
+
+func (c *contextECS) check(ctx context.Context, op string) {
+	_, deadline := ctx.Deadline()
+	if ctx.Value(discoveryKey{}) == nil || !deadline {
+		c.mu.Lock()
+		c.detached = append(c.detached, op)
+		c.mu.Unlock()
+	}
+}
+
+func (c *contextECS) ListServices(ctx context.Context, params *ecs.ListServicesInput, optFns ...func(*ecs.Options)) (*ecs.ListServicesOutput, error) {
+	c.check(ctx, "ListServices")
+	return c.ECS.ListServices(ctx, params, optFns...)
+}
+
+func (c *contextECS) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	c.check(ctx, "ListTasks")
+	return c.ECS.ListTasks(ctx, params, optFns...)
+}
+
+func (c *contextECS) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	c.check(ctx, "DescribeTasks")
+	return c.ECS.DescribeTasks(ctx, params, optFns...)
+}
+
+func (c *contextECS) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	c.check(ctx, "DescribeTaskDefinition")
+	return c.ECS.DescribeTaskDefinition(ctx, params, optFns...)
+}
+
+func TestDiscoveryContext(t *testing.T) {
+	fake := &contextECS{ECS: discoverytest.NewECS()}
+	fake.ServicePage = 1
+	fake.TaskPage = 1
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.PortLabel("acme", 9000)
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"), discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), discoveryKey{}, true), time.Minute)
+	defer cancel()
+	opts := Options{PortLabel: "proxy.port", DefaultPort: 8080, Concurrency: 2}
+	if _, _, _, err := buildServiceDetails(ctx, []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.detached) > 0 {
+		t.Errorf("calls without the discovery's context: %q", fake.detached)
+	}
+}
+
+// hungECS is a fake ECS whose ListServices calls, once hung is set, never
+// return before their context is done.
+type hungECS struct {
+	*discoverytest.ECS
+	hung      atomic.Bool
+	abandoned atomic.Int32
+}
+
+func (h *hungECS) ListServices(ctx context.Context, params *ecs.ListServicesInput, optFns ...func(*ecs.Options)) (*ecs.ListServicesOutput, error) {
+	if !h.hung.Load() {
+		return h.ECS.ListServices(ctx, params, optFns...)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("ListServices called without a deadline")
+	}
+	<-ctx.Done()
+	h.abandoned.Add(1)
+	return nil, ctx.Err()
+}
+
+func TestDiscoveryTimeout(t *testing.T) {
+	policy := ECSRetryPolicy
+	defer func() { ECSRetryPolicy = policy }()
+	ECSRetryPolicy.MaxAttempts = 2
+	ECSRetryPolicy.Timeout = 20 * time.Millisecond
+	fake := &hungECS{ECS: discoverytest.NewECS()}
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, routes, 0)
+	if _, err := refresher.Rebuild(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+
+	// a hung call is abandoned at its deadline and retried, and the refresh
+	// fails rather than hanging, keeping the routes it had
+	timeouts := telemetrytest.CounterValue(t, telemetry.ECSTimeouts.WithLabelValues("ListServices"))
+	fake.hung.Store(true)
+	start := time.Now()
+	if _, err := refresher.Rebuild(context.Background(), TriggerScheduled); err == nil {
+		t.Error("refresh with ListServices hung succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("refresh with ListServices hung took %s", elapsed)
+	}
+	if n := fake.abandoned.Load(); n != 2 {
+		t.Errorf("%d hung calls abandoned, want 2", n)
+	}
+	if n := telemetrytest.CounterValue(t, telemetry.ECSTimeouts.WithLabelValues("ListServices")) - timeouts; n != 2 {
+		t.Errorf("%v ListServices timeouts counted, want 2", n)
+	}
+	if got, want := serviceNames(routes.Services()), "acme=10.0.0.1:8080"; got != want {
+		t.Errorf("routes %s after the hung refresh, want %s", got, want)
+	}
+
+	// and the next refresh recovers once ECS answers again
+	fake.hung.Store(false)
+	fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "a1"))
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	if _, err := refresher.Rebuild(context.Background(), TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serviceNames(routes.Services()), "acme=10.0.0.2:8080"; got != want {
+		t.Errorf("routes %s after ECS recovered, want %s", got, want)
+	}
+}
+
+func TestECSOptions(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if target := r.Header.Get("X-Amz-Target"); target != "AmazonEC2ContainerServiceV20141113.ListServices" {
+			t.Errorf("X-Amz-Target %q", target)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type": "ThrottlingException", "message": "Rate exceeded"}`)
+	}))
+	defer server.Close()
+
+	cfg := aws.Config{Region: "eu-central-1", Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")}
+	client := ecs.NewFromConfig(cfg, ecsOptions(discoverytest.Region, server.URL))
+	_, err := client.ListServices(context.Background(), &ecs.ListServicesInput{Cluster: aws.String("tenants")})
+	if !IsThrottle(err) {
+		t.Fatalf("err = %v, want the throttling error", err)
+	}
+	// the SDK doesn't retry, ECSRetryPolicy does
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d calls, want 1", n)
+	}
+	if client.Options().Region != discoverytest.Region {
+		t.Errorf("client in %s, want the target's region", client.Options().Region)
+	}
+}
+
+func TestBuildServiceDetailsAddressFamily(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	dualStack := discoverytest.Task("tenants", "acme", "dual", "10.0.0.1")
+	dualStack.Containers[0].NetworkInterfaces[0].Ipv6Address = aws.String("2600:1f14::1")
+	ipv6Only := discoverytest.Task("tenants", "acme", "v6", "")
+	ipv6Only.Containers[0].NetworkInterfaces = nil
+	ipv6Only.Attachments = []types.Attachment{eni("", "2600:1f14::2")}
+	fake.AddTasks("tenants", dualStack, ipv6Only)
+
+	for family, want := range map[string]string{
+		config.AddressFamilyIPv4:       "acme=10.0.0.1:8080",
+		config.AddressFamilyIPv6:       "acme=[2600:1f14::1]:8080 acme=[2600:1f14::2]:8080",
+		config.AddressFamilyPreferIPv6: "acme=[2600:1f14::1]:8080 acme=[2600:1f14::2]:8080",
+	} {
+		opts := Options{DefaultPort: 8080, AddressFamily: family}
+		details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serviceNames(details); got != want {
+			t.Errorf("%s: routes %s, want %s", family, got, want)
+		}
+	}
+}
+
+func TestBuildServiceDetailsRoutableCIDRs(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	// the first ENI is on the data-plane network the proxy can't reach
+	twoENIs := discoverytest.Task("tenants", "acme", "a1", "172.16.0.1")
+	twoENIs.Containers[0].NetworkInterfaces = append(twoENIs.Containers[0].NetworkInterfaces, types.NetworkInterface{PrivateIpv4Address: aws.String("10.1.0.1")})
+	attached := discoverytest.Task("tenants", "acme", "a2", "")
+	attached.Containers[0].NetworkInterfaces = nil
+	attached.Attachments = []types.Attachment{eni("172.16.0.2", ""), eni("10.1.0.2", "")}
+	unreachable := discoverytest.Task("tenants", "acme", "a3", "172.16.0.3")
+	fake.AddTasks("tenants", twoENIs, attached, unreachable)
+
+	cfg, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "ROUTABLE_CIDRS": "10.1.0.0/16, fd00::/8"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{DefaultPort: 8080, AddressFamily: config.AddressFamilyIPv4, RoutableCIDRs: cfg.RoutableCIDRs}
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one reachable address per container, the task without one skipped
+	if got, want := serviceNames(details), "acme=10.1.0.1:8080 acme=10.1.0.2:8080"; got != want {
+		t.Errorf("routes %s, want %s", got, want)
+	}
+
+	if _, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "ROUTABLE_CIDRS": "10.1.0.0"}, "", nil); err == nil {
+		t.Error("ROUTABLE_CIDRS without a prefix length accepted")
+	}
+}
+
+// bigCluster returns a fake with tasks tasks of one service.
+func bigCluster(tasks int) *discoverytest.ECS {
+	fake := discoverytest.NewECS()
+	fake.AddService("big", "acme")
+	for i := 0; i < tasks; i++ {
+		fake.AddTasks("big", discoverytest.Task("big", "acme", fmt.Sprint(i), fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)))
+	}
+	return fake
+}
+
+func TestGetServiceDetailsConcurrency(t *testing.T) {
+	fake := bigCluster(1000)
+	arns := make([]string, 1000)
+	for i := range arns {
+		arns[i] = discoverytest.TaskARN("big", fmt.Sprint(i))
+	}
+	fake.Latency = 20 * time.Millisecond
+	run := func(concurrency int) ([]ECSService, time.Duration) {
+		start := time.Now()
+		details, pending := getServiceDetails(context.Background(), testTarget(fake, "big"), arns, Options{DefaultPort: 8080, Concurrency: concurrency})
+		if len(pending) > 0 {
+			t.Fatalf("%d tasks pending", len(pending))
+		}
+		return details, time.Since(start)
+	}
+	serial, serialTime := run(1)
+	parallel, parallelTime := run(5)
+	// ten batches, about 200ms one at a time and 40ms five at a time
+	if parallelTime*2 > serialTime {
+		t.Errorf("describing with 5 workers took %s, with 1 %s", parallelTime, serialTime)
+	}
+	if len(parallel) != 1000 || !slices.Equal(serial, parallel) {
+		t.Error("merged table depends on the concurrency")
+	}
+	for i, svc := range parallel {
+		if svc.TaskArn != arns[i] {
+			t.Fatalf("entry %d is task %s, want the listing order", i, svc.TaskArn)
+		}
+	}
+}
+
+func TestGetServiceDetailsPartialFailure(t *testing.T) {
+	fake := bigCluster(250)
+	arns := make([]string, 250)
+	for i := range arns {
+		arns[i] = discoverytest.TaskARN("big", fmt.Sprint(i))
+	}
+	// the first batch is throttled until its retries run out, the others
+	// go through
+	errs := make([]error, ECSRetryPolicy.MaxAttempts)
+	for i := range errs {
+		errs[i] = discoverytest.Throttled()
+	}
+	fake.FailNext("DescribeTasks", errs...)
+	details, pending := getServiceDetails(context.Background(), testTarget(fake, "big"), arns, Options{DefaultPort: 8080, Concurrency: 1})
+	if !slices.Equal(pending, arns[:100]) {
+		t.Errorf("%d tasks pending, want the first batch", len(pending))
+	}
+	if len(details) != 150 || details[0].TaskArn != arns[100] {
+		t.Errorf("%d entries, want those of the other batches", len(details))
+	}
+}
@@ -0,0 +1,401 @@
+package discoverytest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/smithy-go"
+)
+
+// Account and Region are those of the clusters of ECS.
+const (
+	Account = "123456789012"
+	Region  = "us-west-2"
+)
+
+// ECS is an ECSAPI serving canned clusters. Set it up with the add
+// methods before sharing it; the calls are safe for concurrent use.
+type ECS struct {
+	mu sync.Mutex
+	// Services and tasks are those of each cluster, by cluster name.
+	Services map[string][]types.Service
+	tasks    map[string][]types.Task
+	// taskIndex is the position of each task in tasks, by cluster and task
+	// ARN, so describing a big cluster takes linear time.
+	taskIndex map[string]map[string]int
+	// taskDefinitions are by ARN. Unknown ones are described without
+	// containers, so their containers get the default port.
+	taskDefinitions map[string]types.TaskDefinition
+	// taskSets are by service ARN and tags by resource ARN.
+	taskSets map[string][]types.TaskSet
+	tags     map[string][]types.Tag
+	// ServicePage and TaskPage are how many ARNs a list call returns at
+	// most, 10 and 100 like ECS by default.
+	ServicePage int
+	TaskPage    int
+	// errs are the errors the next calls of an operation fail with, in
+	// order; a nil entry lets the call through.
+	errs map[string][]error
+	// Latency delays every call, until the context is done.
+	Latency time.Duration
+	// Hook, if set, is called with the operation before each call is
+	// answered, with the lock not held.
+	Hook func(op string)
+
+	calls map[string]int
+	// DescribeBatches are the sizes of the DescribeTasks calls.
+	DescribeBatches []int
+	// ListTasksInputs are the inputs of the ListTasks calls.
+	ListTasksInputs []ecs.ListTasksInput
+}
+
+// NewECS returns an ECS without clusters.
+func NewECS() *ECS {
+	return &ECS{
+		Services:        map[string][]types.Service{},
+		tasks:           map[string][]types.Task{},
+		taskIndex:       map[string]map[string]int{},
+		taskDefinitions: map[string]types.TaskDefinition{},
+		taskSets:        map[string][]types.TaskSet{},
+		tags:            map[string][]types.Tag{},
+		errs:            map[string][]error{},
+		calls:           map[string]int{},
+	}
+}
+
+// serviceARN returns the ARN of service in cluster.
+func serviceARN(cluster, service string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:service/%s/%s", Region, Account, cluster, service)
+}
+
+// TaskARN returns the ARN of the task with id in cluster.
+func TaskARN(cluster, id string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:task/%s/%s", Region, Account, cluster, id)
+}
+
+// TaskDefinitionARN returns the ARN of revision of family.
+func TaskDefinitionARN(family string, revision int) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:task-definition/%s:%d", Region, Account, family, revision)
+}
+
+// Task returns a running task of service with id whose single
+// container, named after the service, has ip, in revision 1 of the task
+// definition named after the service.
+func Task(cluster, service, id, ip string) types.Task {
+	return types.Task{
+		TaskArn:           aws.String(TaskARN(cluster, id)),
+		ClusterArn:        aws.String(fmt.Sprintf("arn:aws:ecs:%s:%s:cluster/%s", Region, Account, cluster)),
+		Group:             aws.String("service:" + service),
+		LastStatus:        aws.String("RUNNING"),
+		DesiredStatus:     aws.String("RUNNING"),
+		TaskDefinitionArn: aws.String(TaskDefinitionARN(service, 1)),
+		AvailabilityZone:  aws.String(Region + "a"),
+		StartedAt:         aws.Time(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		HealthStatus:      types.HealthStatusHealthy,
+		Containers: []types.Container{{
+			Name:              aws.String(service),
+			HealthStatus:      types.HealthStatusHealthy,
+			NetworkInterfaces: []types.NetworkInterface{{PrivateIpv4Address: aws.String(ip)}},
+		}},
+	}
+}
+
+// AddService adds the ECS service named service to cluster, with a PRIMARY
+// deployment named after it.
+func (f *ECS) AddService(cluster, service string) {
+	f.Services[cluster] = append(f.Services[cluster], types.Service{
+		ServiceArn:   aws.String(serviceARN(cluster, service)),
+		ServiceName:  aws.String(service),
+		DesiredCount: 1,
+		Deployments: []types.Deployment{{
+			Id:     aws.String("ecs-svc/" + service),
+			Status: aws.String("PRIMARY"),
+		}},
+	})
+}
+
+// AddTasks adds tasks to cluster.
+func (f *ECS) AddTasks(cluster string, tasks ...types.Task) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.taskIndex[cluster] == nil {
+		f.taskIndex[cluster] = map[string]int{}
+	}
+	for _, task := range tasks {
+		f.taskIndex[cluster][aws.ToString(task.TaskArn)] = len(f.tasks[cluster])
+		f.tasks[cluster] = append(f.tasks[cluster], task)
+	}
+}
+
+// RemoveTask removes the task with taskArn from cluster.
+func (f *ECS) RemoveTask(cluster, taskArn string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var kept []types.Task
+	for _, task := range f.tasks[cluster] {
+		if aws.ToString(task.TaskArn) != taskArn {
+			kept = append(kept, task)
+		}
+	}
+	f.tasks[cluster] = kept
+	f.taskIndex[cluster] = map[string]int{}
+	for i, task := range kept {
+		f.taskIndex[cluster][aws.ToString(task.TaskArn)] = i
+	}
+}
+
+// AddTaskSets adds task sets to service in cluster.
+func (f *ECS) AddTaskSets(cluster, service string, sets ...types.TaskSet) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	arn := serviceARN(cluster, service)
+	f.taskSets[arn] = append(f.taskSets[arn], sets...)
+}
+
+// TagService sets the tags of service in cluster.
+func (f *ECS) TagService(cluster, service string, tags map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	arn := serviceARN(cluster, service)
+	f.tags[arn] = nil
+	for key, value := range tags {
+		f.tags[arn] = append(f.tags[arn], types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+}
+
+// PortLabel registers revision 1 of the task definition of service, giving
+// its container port with the proxy.port label.
+func (f *ECS) PortLabel(service string, port int) {
+	f.AddTaskDefinition(service, types.ContainerDefinition{
+		Name:         aws.String(service),
+		DockerLabels: map[string]string{"proxy.port": strconv.Itoa(port)},
+	})
+}
+
+// AddTaskDefinition registers revision 1 of the task definition of service
+// with containers.
+func (f *ECS) AddTaskDefinition(service string, containers ...types.ContainerDefinition) {
+	f.taskDefinitions[TaskDefinitionARN(service, 1)] = types.TaskDefinition{ContainerDefinitions: containers}
+}
+
+// FailNext fails the next calls of op with errs, in order.
+func (f *ECS) FailNext(op string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[op] = append(f.errs[op], errs...)
+}
+
+// Count returns how many times op was called.
+func (f *ECS) Count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// call records a call of op and returns the error it fails with, if any.
+func (f *ECS) call(ctx context.Context, op string) error {
+	if f.Hook != nil {
+		f.Hook(op)
+	}
+	if f.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.Latency):
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[op]++
+	if errs := f.errs[op]; len(errs) > 0 {
+		f.errs[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// page returns the ARNs of the page starting at token, and the token of
+// the next one.
+func page(arns []string, token *string, size int) ([]string, *string) {
+	start, _ := strconv.Atoi(aws.ToString(token))
+	start = min(start, len(arns))
+	end := min(start+size, len(arns))
+	if end == len(arns) {
+		return arns[start:end], nil
+	}
+	return arns[start:end], aws.String(strconv.Itoa(end))
+}
+
+// Throttled is the error of a call ECS throttled.
+func Throttled() error {
+	return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+}
+
+// AccessDenied is the error of a call the caller may not make.
+func AccessDenied() error {
+	return &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}
+}
+
+func (f *ECS) ListServices(ctx context.Context, params *ecs.ListServicesInput, optFns ...func(*ecs.Options)) (*ecs.ListServicesOutput, error) {
+	if err := f.call(ctx, "ListServices"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var arns []string
+	for _, service := range f.Services[aws.ToString(params.Cluster)] {
+		arns = append(arns, aws.ToString(service.ServiceArn))
+	}
+	arns, next := page(arns, params.NextToken, orDefault(f.ServicePage, 10))
+	return &ecs.ListServicesOutput{ServiceArns: arns, NextToken: next}, nil
+}
+
+func (f *ECS) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	if err := f.call(ctx, "ListTasks"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if params.NextToken == nil {
+		f.ListTasksInputs = append(f.ListTasksInputs, *params)
+	}
+	var arns []string
+	for _, task := range f.tasks[aws.ToString(params.Cluster)] {
+		if params.StartedBy != nil && aws.ToString(task.StartedBy) != aws.ToString(params.StartedBy) {
+			continue
+		}
+		if params.ServiceName != nil && aws.ToString(task.Group) != "service:"+aws.ToString(params.ServiceName) {
+			continue
+		}
+		arns = append(arns, aws.ToString(task.TaskArn))
+	}
+	arns, next := page(arns, params.NextToken, orDefault(f.TaskPage, 100))
+	return &ecs.ListTasksOutput{TaskArns: arns, NextToken: next}, nil
+}
+
+func (f *ECS) DescribeServices(ctx context.Context, params *ecs.DescribeServicesInput, optFns ...func(*ecs.Options)) (*ecs.DescribeServicesOutput, error) {
+	if err := f.call(ctx, "DescribeServices"); err != nil {
+		return nil, err
+	}
+	if len(params.Services) > 10 {
+		return nil, &types.InvalidParameterException{Message: aws.String("at most 10 services")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ecs.DescribeServicesOutput{}
+	for _, name := range params.Services {
+		found := false
+		for _, service := range f.Services[aws.ToString(params.Cluster)] {
+			if name == aws.ToString(service.ServiceArn) || name == aws.ToString(service.ServiceName) {
+				out.Services = append(out.Services, service)
+				found = true
+			}
+		}
+		if !found {
+			out.Failures = append(out.Failures, types.Failure{Arn: aws.String(name), Reason: aws.String("MISSING")})
+		}
+	}
+	return out, nil
+}
+
+func (f *ECS) DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+	if err := f.call(ctx, "DescribeClusters"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &ecs.DescribeClustersOutput{}
+	for _, cluster := range params.Clusters {
+		if _, ok := f.tasks[cluster]; !ok {
+			if _, ok := f.Services[cluster]; !ok {
+				out.Failures = append(out.Failures, types.Failure{Arn: aws.String(cluster), Reason: aws.String("MISSING")})
+				continue
+			}
+		}
+		out.Clusters = append(out.Clusters, types.Cluster{ClusterName: aws.String(cluster), Status: aws.String("ACTIVE")})
+	}
+	return out, nil
+}
+
+func (f *ECS) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	if err := f.call(ctx, "DescribeTasks"); err != nil {
+		return nil, err
+	}
+	if len(params.Tasks) > 100 {
+		return nil, &types.InvalidParameterException{Message: aws.String("at most 100 tasks")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.DescribeBatches = append(f.DescribeBatches, len(params.Tasks))
+	cluster := aws.ToString(params.Cluster)
+	out := &ecs.DescribeTasksOutput{}
+	for _, arn := range params.Tasks {
+		if i, ok := f.taskIndex[cluster][arn]; ok {
+			out.Tasks = append(out.Tasks, f.tasks[cluster][i])
+		} else {
+			out.Failures = append(out.Failures, types.Failure{Arn: aws.String(arn), Reason: aws.String("MISSING")})
+		}
+	}
+	return out, nil
+}
+
+func (f *ECS) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	if err := f.call(ctx, "DescribeTaskDefinition"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	definition := f.taskDefinitions[aws.ToString(params.TaskDefinition)]
+	definition.TaskDefinitionArn = params.TaskDefinition
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &definition}, nil
+}
+
+func (f *ECS) DescribeTaskSets(ctx context.Context, params *ecs.DescribeTaskSetsInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskSetsOutput, error) {
+	if err := f.call(ctx, "DescribeTaskSets"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &ecs.DescribeTaskSetsOutput{TaskSets: f.taskSets[aws.ToString(params.Service)]}, nil
+}
+
+func (f *ECS) ListTagsForResource(ctx context.Context, params *ecs.ListTagsForResourceInput, optFns ...func(*ecs.Options)) (*ecs.ListTagsForResourceOutput, error) {
+	if err := f.call(ctx, "ListTagsForResource"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &ecs.ListTagsForResourceOutput{Tags: f.tags[aws.ToString(params.ResourceArn)]}, nil
+}
+
+func (f *ECS) UpdateService(ctx context.Context, params *ecs.UpdateServiceInput, optFns ...func(*ecs.Options)) (*ecs.UpdateServiceOutput, error) {
+	if err := f.call(ctx, "UpdateService"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	services := f.Services[aws.ToString(params.Cluster)]
+	for i, service := range services {
+		if aws.ToString(params.Service) == aws.ToString(service.ServiceName) || aws.ToString(params.Service) == aws.ToString(service.ServiceArn) {
+			if params.DesiredCount != nil {
+				services[i].DesiredCount = *params.DesiredCount
+			}
+			return &ecs.UpdateServiceOutput{Service: &services[i]}, nil
+		}
+	}
+	return nil, &types.ServiceNotFoundException{Message: aws.String("service not found")}
+}
+
+// orDefault returns value, or fallback if it is zero.
+func orDefault(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
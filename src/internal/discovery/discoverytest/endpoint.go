@@ -0,0 +1,185 @@
+package discoverytest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/smithy-go"
+)
+
+// ecsTargetPrefix starts the X-Amz-Target header of the ECS API calls.
+const ecsTargetPrefix = "AmazonEC2ContainerServiceV20141113."
+
+// Endpoint serves a ECS over HTTP in the ECS JSON protocol, so
+// the SDK's clients can be pointed at it with ECS_ENDPOINT_URL.
+type Endpoint struct {
+	*httptest.Server
+	ops map[string]func(ctx context.Context, body []byte) (any, error)
+
+	mu sync.Mutex
+	// malformed are how many of the next responses of an operation are
+	// cut short.
+	malformed map[string]int
+}
+
+// NewEndpoint starts serving fake, until the test ends.
+func NewEndpoint(t *testing.T, fake *ECS) *Endpoint {
+	e := &Endpoint{
+		ops: map[string]func(ctx context.Context, body []byte) (any, error){
+			"ListServices":           ecsOperation(fake.ListServices),
+			"ListTasks":              ecsOperation(fake.ListTasks),
+			"DescribeServices":       ecsOperation(fake.DescribeServices),
+			"DescribeClusters":       ecsOperation(fake.DescribeClusters),
+			"DescribeTasks":          ecsOperation(fake.DescribeTasks),
+			"DescribeTaskDefinition": ecsOperation(fake.DescribeTaskDefinition),
+			"DescribeTaskSets":       ecsOperation(fake.DescribeTaskSets),
+			"ListTagsForResource":    ecsOperation(fake.ListTagsForResource),
+			"UpdateService":          ecsOperation(fake.UpdateService),
+		},
+		malformed: map[string]int{},
+	}
+	e.Server = httptest.NewServer(e)
+	t.Cleanup(e.Close)
+	return e
+}
+
+// ecsOperation decodes the input of an ECS API call for fn and returns its
+// output.
+func ecsOperation[In, Out any](fn func(context.Context, *In, ...func(*ecs.Options)) (*Out, error)) func(ctx context.Context, body []byte) (any, error) {
+	return func(ctx context.Context, body []byte) (any, error) {
+		var in In
+		// member names are matched without regard to case, so the SDK's
+		// structs decode the protocol's camel case
+		if err := json.Unmarshal(body, &in); err != nil {
+			return nil, &smithy.GenericAPIError{Code: "SerializationException", Message: err.Error()}
+		}
+		return fn(ctx, &in)
+	}
+}
+
+// MalformNext cuts the next n responses of op short.
+func (e *Endpoint) MalformNext(op string, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.malformed[op] += n
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	name := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), ecsTargetPrefix)
+	op, ok := e.ops[name]
+	if !ok || r.Method != http.MethodPost {
+		writeECSError(w, &smithy.GenericAPIError{Code: "UnknownOperationException", Message: "unknown operation " + name})
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		writeECSError(w, &smithy.GenericAPIError{Code: "IncompleteSignatureException", Message: "request not signed"})
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	out, err := op(r.Context(), body)
+	if err != nil {
+		writeECSError(w, err)
+		return
+	}
+	e.mu.Lock()
+	malformed := e.malformed[name] > 0
+	if malformed {
+		e.malformed[name]--
+	}
+	e.mu.Unlock()
+	if malformed {
+		io.WriteString(w, `{"serviceArns": ["arn:aws:ecs:`)
+		return
+	}
+	value := ecsJSON(reflect.ValueOf(out))
+	if value == nil {
+		value = map[string]any{}
+	}
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeECSError answers with err the way ECS answers with a client error.
+func writeECSError(w http.ResponseWriter, err error) {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = &smithy.GenericAPIError{Code: "ServerException", Message: err.Error()}
+	}
+	w.Header().Set("X-Amzn-ErrorType", apiErr.ErrorCode())
+	status := http.StatusBadRequest
+	if apiErr.ErrorCode() == "ServerException" {
+		status = http.StatusInternalServerError
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": apiErr.ErrorCode(), "message": apiErr.ErrorMessage()})
+}
+
+// ecsJSON returns v, an ECS API output, as the ECS JSON protocol encodes
+// it: members named in lower camel case, timestamps in epoch seconds, and
+// unset members left out.
+func ecsJSON(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return ecsJSON(v.Elem())
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return float64(t.UnixMilli()) / 1000
+		}
+		out := map[string]any{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if value := ecsJSON(v.Field(i)); value != nil {
+				out[strings.ToLower(field.Name[:1])+field.Name[1:]] = value
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = ecsJSON(v.Index(i))
+		}
+		return out
+	case reflect.Map:
+		if v.Len() == 0 {
+			return nil
+		}
+		out := map[string]any{}
+		for iter := v.MapRange(); iter.Next(); {
+			out[iter.Key().String()] = ecsJSON(iter.Value())
+		}
+		return out
+	case reflect.String:
+		// enums are strings, and empty when unset
+		if v.Len() == 0 {
+			return nil
+		}
+		return v.String()
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,227 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// operatorDrains is the number of backend IPs drained through the admin
+// endpoints.
+var operatorDrains = promauto.With(telemetry.Registry).NewGauge(prometheus.GaugeOpts{
+	Name: "ecs_svc_proxy_backends_operator_drained",
+	Help: "Backend IPs taken out of rotation by an operator.",
+})
+
+var (
+	// ErrUnknownBackend means no entry of the route table has the IP.
+	ErrUnknownBackend = errors.New("no backend has this IP")
+	// ErrLastBackend means draining the IP would leave a service without
+	// a backend in rotation.
+	ErrLastBackend = errors.New("last backend in rotation of service")
+)
+
+// BackendDrain is a backend IP taken out of rotation, until Until if it is
+// set.
+type BackendDrain struct {
+	IP    string     `json:"ip"`
+	Since time.Time  `json:"since"`
+	Until *time.Time `json:"until,omitempty"`
+	// Caller is the address the drain came from.
+	Caller string `json:"caller"`
+}
+
+func (d BackendDrain) expired(now time.Time) bool {
+	return d.Until != nil && !now.Before(*d.Until)
+}
+
+// drainedBackends are the backend IPs an operator took out of rotation.
+// Requests in flight to them complete, new ones go to the other backends.
+// A nil *drainedBackends drains nothing.
+type drainedBackends struct {
+	clock clock.Clock
+
+	mu  sync.Mutex
+	ips map[string]BackendDrain
+}
+
+func newDrainedBackends(clock clock.Clock) *drainedBackends {
+	return &drainedBackends{clock: clock, ips: map[string]BackendDrain{}}
+}
+
+// Drained reports whether ip is out of rotation. A drain found expired is
+// removed.
+func (d *drainedBackends) Drained(ip string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	drain, ok := d.ips[ip]
+	if !ok {
+		return false
+	}
+	if drain.expired(d.clock.Now()) {
+		delete(d.ips, ip)
+		operatorDrains.Set(float64(len(d.ips)))
+		slog.Info("Backend drain expired", "audit", true, "backend", ip, "caller", drain.Caller)
+		return false
+	}
+	return true
+}
+
+func (d *drainedBackends) set(drain BackendDrain) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ips[drain.IP] = drain
+	operatorDrains.Set(float64(len(d.ips)))
+}
+
+// remove enables ip again and returns its drain, false if it wasn't
+// drained.
+func (d *drainedBackends) remove(ip string) (BackendDrain, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	drain, ok := d.ips[ip]
+	delete(d.ips, ip)
+	operatorDrains.Set(float64(len(d.ips)))
+	return drain, ok && !drain.expired(d.clock.Now())
+}
+
+// List returns the drains in effect, sorted by IP. A nil *drainedBackends
+// has none.
+func (d *drainedBackends) List() []BackendDrain {
+	if d == nil {
+		return nil
+	}
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	drains := make([]BackendDrain, 0, len(d.ips))
+	for _, drain := range d.ips {
+		if !drain.expired(now) {
+			drains = append(drains, drain)
+		}
+	}
+	sort.Slice(drains, func(i, j int) bool { return drains[i].IP < drains[j].IP })
+	return drains
+}
+
+// Replace swaps all drains for drains, as imported from an export by caller,
+// dropping the ones that expired. They must have passed ValidateDrains.
+func (d *drainedBackends) Replace(drains []BackendDrain, caller string) {
+	now := d.clock.Now()
+	ips := make(map[string]BackendDrain, len(drains))
+	for _, drain := range drains {
+		if !drain.expired(now) {
+			ips[drain.IP] = drain
+		}
+	}
+	d.mu.Lock()
+	d.ips = ips
+	operatorDrains.Set(float64(len(ips)))
+	d.mu.Unlock()
+	slog.Info("Backend drains replaced", "audit", true, "drains", len(ips), "caller", caller)
+}
+
+// ValidateDrains checks drains to be given to Replace: one per IP, each a
+// plain IP as the admin endpoints take. Unlike Drain it doesn't require a
+// backend to have the IP, the drains of IPs none has are forgotten on the
+// next refresh.
+func ValidateDrains(drains []BackendDrain) error {
+	ips := make(map[string]bool, len(drains))
+	for _, drain := range drains {
+		addr, err := netip.ParseAddr(drain.IP)
+		if err != nil || addr.Unmap().String() != drain.IP {
+			return fmt.Errorf("invalid drained IP %q", drain.IP)
+		}
+		if ips[drain.IP] {
+			return fmt.Errorf("IP %s is drained several times", drain.IP)
+		}
+		ips[drain.IP] = true
+	}
+	return nil
+}
+
+// Retain forgets the drains of the IPs no backend of services has anymore,
+// their tasks are gone.
+func (d *drainedBackends) Retain(services []ECSService) {
+	if d == nil {
+		return
+	}
+	current := make(map[string]bool, len(services))
+	for _, svc := range services {
+		current[svc.IP] = true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ip := range d.ips {
+		if !current[ip] {
+			delete(d.ips, ip)
+			slog.Info("Forgetting drain of removed backend", "backend", ip)
+		}
+	}
+	operatorDrains.Set(float64(len(d.ips)))
+}
+
+// Drain takes the backends on ip out of rotation for ttl, or until they are
+// enabled again if ttl is zero. Unless force is set it refuses to drain the
+// last backend in rotation of a service, which would turn its orgs into
+// 503s.
+func (t *RouteTable) Drain(ip string, ttl time.Duration, force bool, caller string) (BackendDrain, error) {
+	t.mu.RLock()
+	var names []string
+	for _, svc := range t.services {
+		if svc.IP == ip {
+			names = append(names, svc.Name)
+		}
+	}
+	last := ""
+	for _, name := range names {
+		remaining := 0
+		for _, svc := range t.index[name] {
+			if svc.IP != ip && t.available(svc) {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			last = name
+		}
+	}
+	t.mu.RUnlock()
+	if len(names) == 0 {
+		return BackendDrain{}, ErrUnknownBackend
+	}
+	if last != "" && !force {
+		return BackendDrain{}, fmt.Errorf("%w %s", ErrLastBackend, last)
+	}
+	now := t.Drained.clock.Now()
+	drain := BackendDrain{IP: ip, Since: now, Caller: caller}
+	if ttl > 0 {
+		until := now.Add(ttl)
+		drain.Until = &until
+	}
+	t.Drained.set(drain)
+	slog.Info("Backend drained", "audit", true, "backend", ip, "services", names, "ttl", ttl, "forced", last != "", "caller", caller)
+	return drain, nil
+}
+
+// Enable puts the backends on ip back in rotation, and reports whether they
+// were drained.
+func (t *RouteTable) Enable(ip, caller string) bool {
+	drain, ok := t.Drained.remove(ip)
+	if ok {
+		slog.Info("Backend enabled", "audit", true, "backend", ip, "drained_since", drain.Since, "caller", caller)
+	}
+	return ok
+}
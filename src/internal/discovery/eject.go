@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// ejector takes backends out of rotation after repeated forwarding failures.
+// A backend failing threshold times within window is ejected for cooldown,
+// or until it passes an active health check. State is kept per address, so
+// it carries over refreshes that keep the backend.
+type ejector struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	clock     clock.Clock
+	backends  map[string]*ejectState
+}
+
+type ejectState struct {
+	failures     []time.Time
+	ejectedUntil time.Time
+}
+
+// newEjector returns an ejector timed by clock, or nil if threshold is zero.
+// A nil *ejector ejects nothing.
+func newEjector(threshold int, window, cooldown time.Duration, clock clock.Clock) *ejector {
+	if threshold <= 0 {
+		return nil
+	}
+	return &ejector{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		clock:     clock,
+		backends:  map[string]*ejectState{},
+	}
+}
+
+// Failure records a failed request to address.
+func (e *ejector) Failure(address string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.clock.Now()
+	state, ok := e.backends[address]
+	if !ok {
+		state = &ejectState{}
+		e.backends[address] = state
+	}
+	if now.Before(state.ejectedUntil) {
+		return
+	}
+	// drop the failures that slid out of the window
+	recent := state.failures[:0]
+	for _, failure := range state.failures {
+		if now.Sub(failure) < e.window {
+			recent = append(recent, failure)
+		}
+	}
+	state.failures = append(recent, now)
+	if len(state.failures) >= e.threshold {
+		slog.Warn("Ejecting backend", "backend", address, "cooldown", e.cooldown, "failures", len(state.failures), "window", e.window)
+		telemetry.BackendsEjected.Add(1)
+		state.failures = nil
+		state.ejectedUntil = now.Add(e.cooldown)
+	}
+}
+
+// Ejected reports whether address is out of rotation.
+func (e *ejector) Ejected(address string) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	state, ok := e.backends[address]
+	return ok && e.clock.Now().Before(state.ejectedUntil)
+}
+
+// Readmit puts address back into rotation, for example after it passed a
+// health check.
+func (e *ejector) Readmit(address string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if state, ok := e.backends[address]; ok && e.clock.Now().Before(state.ejectedUntil) {
+		slog.Info("Readmitting backend", "backend", address)
+		delete(e.backends, address)
+	}
+}
+
+// Forget drops the state of addresses that left the route table.
+func (e *ejector) Forget(addresses []string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, address := range addresses {
+		delete(e.backends, address)
+	}
+}
@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+)
+
+func TestEjection(t *testing.T) {
+	clock := clocktest.New()
+	routes := NewRouteTable([]ECSService{
+		{Name: "acme", IP: "10.0.0.1", Port: 8080},
+		{Name: "acme", IP: "10.0.0.2", Port: 8080},
+	}, nil, config.LBStrategyRoundRobin)
+	routes.SetClock(clock)
+	routes.SetEjection(3, 10*time.Second, 30*time.Second)
+	const failing = "10.0.0.1:8080"
+	// routed returns the backends of four lookups of acme.
+	routed := func() map[string]bool {
+		t.Helper()
+		backends := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			svc, err := routes.Lookup("acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			backends[svc.Address()] = true
+		}
+		return backends
+	}
+
+	// failures that slid out of the window don't count
+	routes.ReportFailure(failing)
+	routes.ReportFailure(failing)
+	clock.Advance(10 * time.Second)
+	routes.ReportFailure(failing)
+	if !routed()[failing] {
+		t.Fatal("backend ejected for failures spread over more than the window")
+	}
+
+	// the threshold within the window ejects it
+	routes.ReportFailure(failing)
+	if !routed()[failing] {
+		t.Fatal("backend ejected after 2 failures within the window")
+	}
+	routes.ReportFailure(failing)
+	if backends := routed(); backends[failing] || !backends["10.0.0.2:8080"] {
+		t.Fatalf("after 3 failures within the window routed to %v, want only the other backend", backends)
+	}
+
+	// until the cooldown passed
+	clock.Advance(29 * time.Second)
+	if routed()[failing] {
+		t.Error("ejected backend routed to before the cooldown passed")
+	}
+	clock.Advance(time.Second)
+	if !routed()[failing] {
+		t.Error("ejected backend not routed to after the cooldown")
+	}
+}
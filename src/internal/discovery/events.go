@@ -0,0 +1,220 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const taskStateChangeDetailType = "ECS Task State Change"
+
+// taskStateChange is an EventBridge ECS task state change event as delivered
+// to an SQS queue subscribed to the rule.
+type taskStateChange struct {
+	DetailType string `json:"detail-type"`
+	Source     string `json:"source"`
+	Account    string `json:"account"`
+	Region     string `json:"region"`
+	Detail     struct {
+		ClusterArn        string    `json:"clusterArn"`
+		TaskArn           string    `json:"taskArn"`
+		TaskDefinitionArn string    `json:"taskDefinitionArn"`
+		Group             string    `json:"group"`
+		AvailabilityZone  string    `json:"availabilityZone"`
+		StartedAt         time.Time `json:"startedAt"`
+		HealthStatus      string    `json:"healthStatus"`
+		LastStatus        string    `json:"lastStatus"`
+		DesiredStatus     string    `json:"desiredStatus"`
+		Version           int64     `json:"version"`
+		Containers        []struct {
+			Name              string `json:"name"`
+			HealthStatus      string `json:"healthStatus"`
+			NetworkInterfaces []struct {
+				PrivateIpv4Address string `json:"privateIpv4Address"`
+				Ipv6Address        string `json:"ipv6Address"`
+			} `json:"networkInterfaces"`
+		} `json:"containers"`
+	} `json:"detail"`
+}
+
+func parseTaskStateChange(body string) (*taskStateChange, error) {
+	var event taskStateChange
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	if event.DetailType != taskStateChangeDetailType {
+		return nil, fmt.Errorf("unexpected event detail-type %q", event.DetailType)
+	}
+	if event.Detail.TaskArn == "" || event.Detail.ClusterArn == "" {
+		return nil, fmt.Errorf("event is missing the task or cluster arn")
+	}
+	return &event, nil
+}
+
+// clusterName returns the cluster name from the event's cluster ARN.
+func (e *taskStateChange) clusterName() string {
+	return e.Detail.ClusterArn[strings.LastIndex(e.Detail.ClusterArn, "/")+1:]
+}
+
+func (e *taskStateChange) running() bool {
+	return e.Detail.LastStatus == string(types.DesiredStatusRunning) && e.Detail.DesiredStatus == string(types.DesiredStatusRunning)
+}
+
+func (e *taskStateChange) stopping() bool {
+	return e.Detail.LastStatus == string(types.DesiredStatusStopped) || e.Detail.DesiredStatus == string(types.DesiredStatusStopped)
+}
+
+// services returns the route entries for the task described by the event,
+// or nil if one of its containers has no routable address.
+func (e *taskStateChange) services(ctx context.Context, target ClusterTarget, opts Options) []ECSService {
+	var services []ECSService
+	ports := newTaskDefinitionPorts(target.Client, opts.PortLabel, opts.PortNames, opts.DefaultPort)
+	revision := taskRevision(e.Detail.TaskDefinitionArn)
+	for _, container := range e.Detail.Containers {
+		address := ""
+		for _, network := range container.NetworkInterfaces {
+			candidate := selectAddress(network.PrivateIpv4Address, network.Ipv6Address, opts.AddressFamily)
+			if candidate != "" && routable(candidate, opts.RoutableCIDRs) {
+				address = candidate
+				break
+			}
+		}
+		if address == "" {
+			slog.Debug("Skipping task, no network interface has a routable address", "task", e.Detail.TaskArn)
+			return nil
+		}
+		port, portName := ports.port(ctx, e.Detail.TaskDefinitionArn, container.Name)
+		health := container.HealthStatus
+		if health == "" {
+			health = e.Detail.HealthStatus
+		}
+		services = append(services, ECSService{
+			Name:           container.Name,
+			IP:             address,
+			Port:           port,
+			PortName:       portName,
+			TaskArn:        e.Detail.TaskArn,
+			Revision:       revision,
+			Cluster:        target.Cluster,
+			Region:         target.Region,
+			Account:        target.Account,
+			Zone:           e.Detail.AvailabilityZone,
+			Health:         health,
+			TaskDefinition: taskDefinitionName(e.Detail.TaskDefinitionArn),
+			StartedAt:      e.Detail.StartedAt,
+			Service:        serviceOfGroup(e.Detail.Group),
+		})
+	}
+	return services
+}
+
+// sqsAPI is the part of the SQS API the event consumer calls, implemented
+// by *sqs.Client and by fakes serving canned messages.
+type sqsAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// EventConsumer keeps routes up to date from ECS task state change events
+// received through SQS.
+type EventConsumer struct {
+	Client   sqsAPI
+	QueueURL string
+	Targets  []ClusterTarget
+	Opts     Options
+	Routes   *RouteTable
+	// Refresh rebuilds all routes, no more often than the refresh cooldown
+	// allows. It is used when an event can't be applied on its own.
+	Refresh func(ctx context.Context, trigger string)
+	// RetryDelay is how long to wait after failing to receive messages.
+	RetryDelay time.Duration
+}
+
+// target returns the discovery target the event belongs to.
+func (c *EventConsumer) target(event *taskStateChange) (ClusterTarget, bool) {
+	for _, target := range c.Targets {
+		if target.Cluster == event.clusterName() && target.Region == event.Region &&
+			(target.Account == "" || target.Account == event.Account) {
+			return target, true
+		}
+	}
+	return ClusterTarget{}, false
+}
+
+// handle applies a single event to the routes.
+func (c *EventConsumer) handle(ctx context.Context, event *taskStateChange) {
+	target, ok := c.target(event)
+	if !ok {
+		return
+	}
+
+	taskArn := event.Detail.TaskArn
+	switch {
+	case event.stopping():
+		if c.Routes.ReplaceTask(taskArn, event.Detail.Version, nil) {
+			slog.Debug("Removed routes of stopped task", "task", taskArn)
+		}
+	case event.running():
+		// Deployment and revision filtering need the whole service, so
+		// only newly running tasks of unfiltered services are added
+		// directly.
+		if (c.Opts.PrimaryDeploymentOnly || c.Opts.TaskSelection != config.TaskSelectionAll) && !c.Routes.HasTask(taskArn) {
+			slog.Debug("Task started, refreshing routes", "task", taskArn)
+			c.Refresh(ctx, TriggerEvent)
+			return
+		}
+		if c.Routes.ReplaceTask(taskArn, event.Detail.Version, event.services(ctx, target, c.Opts)) {
+			slog.Debug("Updated routes of running task", "task", taskArn)
+		}
+	}
+}
+
+// Run receives events until ctx is canceled. Errors are logged and never
+// stop the consumer.
+func (c *EventConsumer) Run(ctx context.Context) {
+	slog.Info("Consuming task state change events", "queue", c.QueueURL)
+	for ctx.Err() == nil {
+		resp, err := c.Client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(c.QueueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to receive events", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.RetryDelay):
+			}
+			continue
+		}
+
+		for _, message := range resp.Messages {
+			event, err := parseTaskStateChange(aws.ToString(message.Body))
+			if err != nil {
+				slog.Warn("Dropping message", "message", aws.ToString(message.MessageId), "error", err)
+			} else {
+				c.handle(ctx, event)
+			}
+
+			_, err = c.Client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(c.QueueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				slog.Error("Failed to delete message", "message", aws.ToString(message.MessageId), "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// taskEvent returns the body of a task state change event of task id of
+// acme in the tenants cluster.
+func taskEvent(id, ip, status string, version int64) string {
+	return fmt.Sprintf(`{
+	"version": "0",
+	"detail-type": "ECS Task State Change",
+	"source": "aws.ecs",
+	"account": %q,
+	"region": %q,
+	"detail": {
+		"clusterArn": "arn:aws:ecs:%s:%s:cluster/tenants",
+		"taskArn": %q,
+		"taskDefinitionArn": %q,
+		"group": "service:acme",
+		"availabilityZone": "us-west-2a",
+		"startedAt": "2024-05-01T12:00:00Z",
+		"lastStatus": %q,
+		"desiredStatus": %q,
+		"version": %d,
+		"containers": [{
+			"name": "acme",
+			"healthStatus": "HEALTHY",
+			"networkInterfaces": [{"privateIpv4Address": %q}]
+		}]
+	}
+}`, discoverytest.Account, discoverytest.Region, discoverytest.Region, discoverytest.Account, discoverytest.TaskARN("tenants", id), discoverytest.TaskDefinitionARN("acme", 1), status, status, version, ip)
+}
+
+func TestParseTaskStateChange(t *testing.T) {
+	event, err := parseTaskStateChange(taskEvent("a1", "10.0.0.1", "RUNNING", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.clusterName() != "tenants" || !event.running() || event.stopping() || event.Detail.Version != 3 {
+		t.Errorf("parsed %+v", event.Detail)
+	}
+	if stopped, _ := parseTaskStateChange(taskEvent("a1", "10.0.0.1", "STOPPED", 4)); !stopped.stopping() {
+		t.Error("stopped task not stopping")
+	}
+
+	for name, body := range map[string]string{
+		"not json":          "task stopped",
+		"other detail-type": strings.Replace(taskEvent("a1", "10.0.0.1", "RUNNING", 1), "ECS Task State Change", "ECS Service Action", 1),
+		"no task arn":       strings.Replace(taskEvent("a1", "10.0.0.1", "RUNNING", 1), discoverytest.TaskARN("tenants", "a1"), "", 1),
+		"empty":             "",
+	} {
+		if _, err := parseTaskStateChange(body); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+// newTestConsumer returns a consumer of the events of the tenants cluster
+// served by fake, and its routes.
+func newTestConsumer(fake *discoverytest.ECS, opts Options) (*EventConsumer, *RouteTable) {
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	opts.DefaultPort = 8080
+	if opts.TaskSelection == "" {
+		opts.TaskSelection = config.TaskSelectionAll
+	}
+	return &EventConsumer{
+		Targets: []ClusterTarget{testTarget(fake, "tenants")},
+		Opts:    opts,
+		Routes:  routes,
+		Refresh: func(context.Context, string) {},
+	}, routes
+}
+
+// handleEvent parses and applies body.
+func handleEvent(t *testing.T, consumer *EventConsumer, body string) {
+	t.Helper()
+	event, err := parseTaskStateChange(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.handle(context.Background(), event)
+}
+
+func TestEventConsumerHandle(t *testing.T) {
+	consumer, routes := newTestConsumer(discoverytest.NewECS(), Options{})
+	clock := clocktest.New()
+	routes.SetClock(clock)
+	steps := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{"start", taskEvent("a1", "10.0.0.1", "RUNNING", 1), "acme=10.0.0.1:8080"},
+		{"other start", taskEvent("a2", "10.0.0.2", "RUNNING", 1), "acme=10.0.0.1:8080 acme=10.0.0.2:8080"},
+		{"duplicate", taskEvent("a1", "10.0.0.9", "RUNNING", 1), "acme=10.0.0.1:8080 acme=10.0.0.2:8080"},
+		{"newer", taskEvent("a1", "10.0.0.3", "RUNNING", 2), "acme=10.0.0.2:8080 acme=10.0.0.3:8080"},
+		{"stale", taskEvent("a1", "10.0.0.9", "RUNNING", 1), "acme=10.0.0.2:8080 acme=10.0.0.3:8080"},
+		{"stop", taskEvent("a1", "10.0.0.3", "STOPPED", 3), "acme=10.0.0.2:8080"},
+		{"start after stop", taskEvent("a1", "10.0.0.3", "RUNNING", 2), "acme=10.0.0.2:8080"},
+		{"other cluster", strings.ReplaceAll(taskEvent("b1", "10.0.0.4", "RUNNING", 1), "cluster/tenants", "cluster/other"), "acme=10.0.0.2:8080"},
+	}
+	for _, step := range steps {
+		handleEvent(t, consumer, step.event)
+		if got := serviceNames(routes.Services()); got != step.want {
+			t.Fatalf("after %s: routes %s, want %s", step.name, got, step.want)
+		}
+	}
+
+	// a discovery that listed a1 before it stopped doesn't bring it back,
+	// and the versions outlive it
+	listed := []ECSService{
+		{Name: "acme", IP: "10.0.0.3", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "a1"), Cluster: "tenants", Region: discoverytest.Region},
+		{Name: "acme", IP: "10.0.0.2", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "a2"), Cluster: "tenants", Region: discoverytest.Region},
+	}
+	routes.Replace(listed, TriggerScheduled)
+	if got := serviceNames(routes.Services()); got != "acme=10.0.0.2:8080" {
+		t.Fatalf("after a rebuild listing the stopped task: routes %s", got)
+	}
+	handleEvent(t, consumer, taskEvent("a2", "10.0.0.9", "RUNNING", 1))
+	if got := serviceNames(routes.Services()); got != "acme=10.0.0.2:8080" {
+		t.Errorf("stale event applied after a rebuild: routes %s", got)
+	}
+
+	// the tombstone expires long after any discovery that could have
+	// listed the task
+	clock.Advance(taskTombstoneTTL)
+	routes.Replace(listed, TriggerScheduled)
+	if got := serviceNames(routes.Services()); got != "acme=10.0.0.2:8080 acme=10.0.0.3:8080" {
+		t.Errorf("after the tombstone expired: routes %s", got)
+	}
+}
+
+func TestEventConsumerFilteredStart(t *testing.T) {
+	consumer, routes := newTestConsumer(discoverytest.NewECS(), Options{PrimaryDeploymentOnly: true})
+	var refreshes []string
+	consumer.Refresh = func(_ context.Context, trigger string) { refreshes = append(refreshes, trigger) }
+
+	handleEvent(t, consumer, taskEvent("a1", "10.0.0.1", "RUNNING", 1))
+	if len(refreshes) != 1 || refreshes[0] != TriggerEvent {
+		t.Fatalf("refreshes %q, want one for the event", refreshes)
+	}
+	if got := serviceNames(routes.Services()); got != "" {
+		t.Errorf("task of a filtered service added without discovery: %s", got)
+	}
+
+	// a task discovery already routes is updated in place
+	routes.Replace([]ECSService{{Name: "acme", IP: "10.0.0.1", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "a1"), Cluster: "tenants", Region: discoverytest.Region}}, TriggerScheduled)
+	handleEvent(t, consumer, taskEvent("a1", "10.0.0.2", "RUNNING", 2))
+	if len(refreshes) != 1 {
+		t.Errorf("refreshes %q for a routed task", refreshes)
+	}
+	if got := serviceNames(routes.Services()); got != "acme=10.0.0.2:8080" {
+		t.Errorf("routes %s", got)
+	}
+}
+
+func TestRefreshSoon(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	routes.SetClock(clock)
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, routes, time.Minute)
+	refresher.SetClock(clock)
+	consumer, _ := newTestConsumer(fake, Options{PrimaryDeploymentOnly: true})
+	consumer.Routes = routes
+	consumer.Refresh = refresher.RefreshSoon
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	refresher.Refresh(ctx, TriggerStartup)
+	if n := fake.Count("ListServices"); n != 1 {
+		t.Fatalf("%d discoveries at startup", n)
+	}
+
+	// a burst of starts during the cooldown costs one discovery once it
+	// is over
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	for i := 0; i < 20; i++ {
+		handleEvent(t, consumer, taskEvent(fmt.Sprintf("new%d", i), "10.0.1.1", "RUNNING", 1))
+	}
+	clock.WaitForTimers(t, 1)
+	if n := fake.Count("ListServices"); n != 1 {
+		t.Fatalf("%d discoveries during the cooldown", n)
+	}
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for !routes.HasTask(discoverytest.TaskARN("tenants", "a2")) {
+		if time.Now().After(deadline) {
+			t.Fatal("deferred refresh didn't run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := fake.Count("ListServices"); n != 2 {
+		t.Errorf("%d discoveries, want 2", n)
+	}
+
+	// right after it, the next event defers another refresh
+	handleEvent(t, consumer, taskEvent("later", "10.0.1.2", "RUNNING", 1))
+	clock.WaitForTimers(t, 1)
+	if n := fake.Count("ListServices"); n != 2 {
+		t.Errorf("%d discoveries during the next cooldown", n)
+	}
+}
+
+func TestReplaceTaskUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	routes.SetAudit(audit, "primary")
+	arn := discoverytest.TaskARN("tenants", "a1")
+	svc := ECSService{Name: "acme", IP: "10.0.0.1", Port: 8080, TaskArn: arn, Health: "HEALTHY"}
+	if !routes.ReplaceTask(arn, 1, []ECSService{svc}) {
+		t.Fatal("new task not applied")
+	}
+	if routes.ReplaceTask(arn, 2, []ECSService{svc}) {
+		t.Error("unchanged task reported applied")
+	}
+	svc.Health = "UNHEALTHY"
+	if !routes.ReplaceTask(arn, 3, []ECSService{svc}) {
+		t.Error("health change not applied")
+	}
+	if got := routes.Services(); len(got) != 1 || got[0].Health != "UNHEALTHY" {
+		t.Errorf("routes %+v", got)
+	}
+
+	records, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the task being added is audited
+	if n := strings.Count(string(records), "\n"); n != 1 {
+		t.Errorf("%d audit records:\n%s", n, records)
+	}
+}
+
+// fakeSQS is an sqsAPI answering receives from a script, then blocking
+// until the context is done.
+type fakeSQS struct {
+	mu       sync.Mutex
+	receives []func() (*sqs.ReceiveMessageOutput, error)
+	deleted  []string
+	done     chan struct{}
+}
+
+func (f *fakeSQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	if len(f.receives) == 0 {
+		f.mu.Unlock()
+		close(f.done)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	receive := f.receives[0]
+	f.receives = f.receives[1:]
+	f.mu.Unlock()
+	return receive()
+}
+
+func (f *fakeSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, aws.ToString(params.ReceiptHandle))
+	if aws.ToString(params.ReceiptHandle) == "undeletable" {
+		return nil, errors.New("AccessDenied")
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestEventConsumerRun(t *testing.T) {
+	message := func(handle, body string) sqstypes.Message {
+		return sqstypes.Message{MessageId: aws.String(handle), ReceiptHandle: aws.String(handle), Body: aws.String(body)}
+	}
+	client := &fakeSQS{done: make(chan struct{})}
+	client.receives = []func() (*sqs.ReceiveMessageOutput, error){
+		func() (*sqs.ReceiveMessageOutput, error) { return nil, errors.New("connection reset") },
+		func() (*sqs.ReceiveMessageOutput, error) {
+			return &sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+				message("start", taskEvent("a1", "10.0.0.1", "RUNNING", 1)),
+				message("malformed", `{"detail-type": "ECS Task State Change", "detail": [}`),
+				message("undeletable", taskEvent("a2", "10.0.0.2", "RUNNING", 1)),
+			}}, nil
+		},
+	}
+	consumer, routes := newTestConsumer(discoverytest.NewECS(), Options{})
+	consumer.Client = client
+	consumer.QueueURL = "https://sqs.us-west-2.amazonaws.com/123456789012/events"
+	consumer.RetryDelay = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		consumer.Run(ctx)
+		close(stopped)
+	}()
+	<-client.done
+	cancel()
+	<-stopped
+
+	if got := strings.Join(client.deleted, " "); got != "start malformed undeletable" {
+		t.Errorf("deleted %s, want every message, malformed ones too", got)
+	}
+	if got := serviceNames(routes.Services()); got != "acme=10.0.0.1:8080 acme=10.0.0.2:8080" {
+		t.Errorf("routes %s", got)
+	}
+}
+
+func FuzzParseTaskStateChange(f *testing.F) {
+	f.Add(taskEvent("a1", "10.0.0.1", "RUNNING", 1))
+	f.Add(taskEvent("ü路径", "10.0.0.1\r\n", "STOPPED", 2))
+	f.Add(`{"detail-type": "ECS Task State Change", "detail": {"clusterArn": "tenants", "taskArn": "%2F"}}`)
+	f.Add(`{"detail-type": "ECS Task State Change", "detail": {"clusterArn": "arn:aws:ecs:us-west-2:123456789012:cluster/", "taskArn": "x", "containers": [{}]}}`)
+	f.Add(`{"detail-type": "ECS Task State Change", "detail": {"containers": null}}`)
+	f.Add(`{"detail-type": "ECS Task State Change\u0000"}`)
+	f.Add(`[` + strings.Repeat(`{"detail":`, 500))
+	f.Fuzz(func(t *testing.T, body string) {
+		event, err := parseTaskStateChange(body)
+		if err != nil {
+			return
+		}
+		if event.Detail.TaskArn == "" || event.Detail.ClusterArn == "" {
+			t.Errorf("event without a task or cluster ARN: %q", body)
+		}
+		if cluster := event.clusterName(); strings.Contains(cluster, "/") {
+			t.Errorf("cluster %q of %q", cluster, event.Detail.ClusterArn)
+		}
+		event.running()
+		event.stopping()
+	})
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// FailoverRoutes looks up backends in the primary route table and falls back
+// to a standby table when the primary has no routable backend for an org.
+// An org that failed over keeps being served from the standby for sticky, so
+// it doesn't flap back and forth as the primary recovers and fails again.
+// The override of an org comes before either.
+type FailoverRoutes struct {
+	overrides *RouteOverrides
+	primary   *RouteTable
+	// standby is nil when no secondary cluster is configured.
+	standby *RouteTable
+	sticky  time.Duration
+	clock   clock.Clock
+
+	mu sync.Mutex
+	// until maps an org that failed over to when it may return to the
+	// primary.
+	until map[string]time.Time
+}
+
+// NewFailoverRoutes returns routes that use standby for the orgs primary
+// can't serve and keep using it for sticky afterwards.
+func NewFailoverRoutes(overrides *RouteOverrides, primary, standby *RouteTable, sticky time.Duration) *FailoverRoutes {
+	return &FailoverRoutes{
+		overrides: overrides,
+		primary:   primary,
+		standby:   standby,
+		sticky:    sticky,
+		clock:     clock.System{},
+		until:     map[string]time.Time{},
+	}
+}
+
+// SetClock makes the stickiness of failovers timed by clock. It must be
+// called before the routes are shared.
+func (f *FailoverRoutes) SetClock(clock clock.Clock) {
+	f.clock = clock
+}
+
+// Lookup returns a backend for orgID, from the standby if the org failed over
+// recently or the primary has no routable backend for it. Errors are those
+// of the primary.
+func (f *FailoverRoutes) Lookup(orgID string) (ECSService, error) {
+	if service, ok := f.overrides.Lookup(orgID); ok {
+		return service, nil
+	}
+	if f.standby == nil {
+		return f.primary.Lookup(orgID)
+	}
+	if f.failedOver(orgID) {
+		if service, err := f.standby.Lookup(orgID); err == nil {
+			return service, nil
+		}
+	}
+	service, err := f.primary.Lookup(orgID)
+	// an ambiguous org is a naming problem the standby wouldn't solve
+	if err == nil || err == ErrAmbiguousOrg {
+		return service, err
+	}
+	standby, standbyErr := f.standby.Lookup(orgID)
+	if standbyErr != nil {
+		return service, err
+	}
+	slog.Warn("Failing over to the secondary cluster", "org", orgID, "sticky", f.sticky, "error", err)
+	telemetry.Failovers.Add(orgID, 1)
+	f.mu.Lock()
+	f.until[orgID] = f.clock.Now().Add(f.sticky)
+	f.mu.Unlock()
+	return standby, nil
+}
+
+func (f *FailoverRoutes) failedOver(orgID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	until, ok := f.until[orgID]
+	if !ok {
+		return false
+	}
+	if f.clock.Now().Before(until) {
+		return true
+	}
+	delete(f.until, orgID)
+	slog.Info("Returning to the primary cluster", "org", orgID)
+	return false
+}
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+func TestFailoverRoutes(t *testing.T) {
+	clock := clocktest.New()
+	acme := ECSService{Name: "acme", IP: "10.0.0.1", Port: 8080}
+	primary := NewRouteTable([]ECSService{acme}, nil, config.LBStrategyRoundRobin)
+	primary.SetClock(clock)
+	standby := NewRouteTable([]ECSService{
+		{Name: "acme", IP: "10.1.0.1", Port: 8080},
+		{Name: "globex", IP: "10.1.0.2", Port: 8080},
+	}, nil, config.LBStrategyRoundRobin)
+	standby.SetClock(clock)
+	routes := NewFailoverRoutes(NewRouteOverrides(nil), primary, standby, time.Minute)
+	routes.SetClock(clock)
+	// lookup returns the IP org is routed to.
+	lookup := func(org string) string {
+		t.Helper()
+		svc, err := routes.Lookup(org)
+		if err != nil {
+			t.Fatalf("lookup of %s: %v", org, err)
+		}
+		return svc.IP
+	}
+
+	if ip := lookup("acme"); ip != "10.0.0.1" {
+		t.Errorf("acme routed to %s, want the primary", ip)
+	}
+	failovers := failoverCount("globex")
+	if ip := lookup("globex"); ip != "10.1.0.2" {
+		t.Errorf("globex routed to %s, want the standby, the primary having no route for it", ip)
+	}
+	if n := failoverCount("globex") - failovers; n != 1 {
+		t.Errorf("%d failovers of globex counted, want 1", n)
+	}
+
+	// an empty primary fails every org over
+	primary.Replace(nil, TriggerScheduled)
+	if ip := lookup("acme"); ip != "10.1.0.1" {
+		t.Errorf("acme routed to %s with the primary empty, want the standby", ip)
+	}
+
+	// an org the primary recovered stays on the standby until the
+	// failover is no longer sticky
+	primary.Replace([]ECSService{acme, {Name: "globex", IP: "10.0.0.2", Port: 8080}}, TriggerScheduled)
+	if ip := lookup("globex"); ip != "10.1.0.2" {
+		t.Errorf("globex routed to %s within the sticky period, want the standby", ip)
+	}
+	clock.Advance(time.Minute)
+	if ip := lookup("globex"); ip != "10.0.0.2" {
+		t.Errorf("globex routed to %s after the sticky period, want the primary", ip)
+	}
+
+	// an org neither table knows gets the error of the primary
+	if _, err := routes.Lookup("initech"); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("lookup of an org neither table knows = %v, want %v", err, ErrServiceNotFound)
+	}
+}
+
+// failoverCount returns the failovers of org counted so far.
+func failoverCount(org string) int64 {
+	if v, ok := telemetry.Failovers.Get(org).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
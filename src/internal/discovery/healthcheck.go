@@ -0,0 +1,187 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// healthState records which backend addresses passed their last health
+// check. Addresses that were never checked count as healthy unless
+// uncheckedHealthy is false.
+type healthState struct {
+	mu               sync.RWMutex
+	healthy          map[string]bool
+	uncheckedHealthy bool
+}
+
+func newHealthState() *healthState {
+	return &healthState{healthy: map[string]bool{}, uncheckedHealthy: true}
+}
+
+func (h *healthState) Healthy(address string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if healthy, ok := h.healthy[address]; ok {
+		return healthy
+	}
+	return h.uncheckedHealthy
+}
+
+// State returns whether address passed its last check, and whether it was
+// checked at all.
+func (h *healthState) State(address string) (healthy, checked bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	healthy, checked = h.healthy[address]
+	return healthy, checked
+}
+
+// Set records the result of a check and reports whether it changed.
+func (h *healthState) Set(address string, healthy bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous, ok := h.healthy[address]
+	h.healthy[address] = healthy
+	return !ok || previous != healthy
+}
+
+// Retain forgets every address not in addresses.
+func (h *healthState) Retain(addresses []string) {
+	keep := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		keep[address] = true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for address := range h.healthy {
+		if !keep[address] {
+			delete(h.healthy, address)
+		}
+	}
+}
+
+// HealthChecker actively checks every backend in the route table, with an
+// HTTP GET of path if set and a TCP connect otherwise. At most concurrency
+// checks run at once.
+type HealthChecker struct {
+	routes      *RouteTable
+	path        string
+	timeout     time.Duration
+	concurrency int
+	// allowed are the CIDRs a backend must be in to be checked.
+	allowed []netip.Prefix
+	client  *http.Client
+	// changed is signaled when the route table changed so new backends
+	// are checked without waiting for the next interval.
+	changed chan struct{}
+	// clock ticks the interval of Run.
+	clock clock.Clock
+}
+
+// NewHealthChecker returns a checker that probes path on the tasks of routes
+// in allowed, at most concurrency at a time, each within timeout.
+func NewHealthChecker(routes *RouteTable, path string, timeout time.Duration, concurrency int, allowed []netip.Prefix) *HealthChecker {
+	return &HealthChecker{
+		routes:      routes,
+		path:        path,
+		timeout:     timeout,
+		concurrency: concurrency,
+		allowed:     allowed,
+		client: &http.Client{
+			Timeout: timeout,
+			// a redirect still means the backend is serving
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		changed: make(chan struct{}, 1),
+		clock:   clock.System{},
+	}
+}
+
+// Changed schedules a check of all backends soon.
+func (c *HealthChecker) Changed() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks all backends every interval until ctx is canceled.
+func (c *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := c.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		case <-c.changed:
+		}
+		c.CheckAll(ctx)
+	}
+}
+
+// CheckAll checks every backend in the route table once.
+func (c *HealthChecker) CheckAll(ctx context.Context) {
+	addresses := c.routes.Addresses()
+	health := c.routes.health
+	sem := make(chan struct{}, c.concurrency)
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		// requests never reach it, neither do health checks
+		if !addressAllowed(c.allowed, address) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(address string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			healthy := c.check(ctx, address)
+			if healthy {
+				c.routes.ejector.Readmit(address)
+			}
+			if health.Set(address, healthy) {
+				if healthy {
+					slog.Info("Backend is healthy", "backend", address)
+				} else {
+					slog.Warn("Backend failed its health check", "backend", address)
+					telemetry.HealthCheckFailures.Add(1)
+				}
+			}
+		}(address)
+	}
+	wg.Wait()
+	health.Retain(addresses)
+}
+
+func (c *HealthChecker) check(ctx context.Context, address string) bool {
+	if c.path == "" {
+		dialer := net.Dialer{Timeout: c.timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+c.path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusBadRequest
+}
@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// flippingBackend is an httptest backend whose /healthz fails while failing
+// is set.
+func flippingBackend(t *testing.T) (ECSService, *atomic.Bool) {
+	t.Helper()
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+	address := netip.MustParseAddrPort(server.Listener.Addr().String())
+	return ECSService{Name: "acme", IP: address.Addr().String(), Port: int(address.Port())}, &failing
+}
+
+func TestHealthChecks(t *testing.T) {
+	first, firstFailing := flippingBackend(t)
+	second, secondFailing := flippingBackend(t)
+	routes := NewRouteTable([]ECSService{first, second}, nil, config.LBStrategyRoundRobin)
+	checker := NewHealthChecker(routes, "/healthz", time.Second, 1, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	// routed returns the backends of four lookups of acme.
+	routed := func() (map[string]bool, error) {
+		backends := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			svc, err := routes.Lookup("acme")
+			if err != nil {
+				return backends, err
+			}
+			backends[svc.Address()] = true
+		}
+		return backends, nil
+	}
+
+	checker.CheckAll(context.Background())
+	if backends, err := routed(); err != nil || len(backends) != 2 {
+		t.Fatalf("routed to %v, %v with both backends healthy", backends, err)
+	}
+
+	// a failed check takes the backend out of selection
+	firstFailing.Store(true)
+	checker.CheckAll(context.Background())
+	if backends, err := routed(); err != nil || backends[first.Address()] || !backends[second.Address()] {
+		t.Errorf("routed to %v, %v with %s failing, want only %s", backends, err, first.Address(), second.Address())
+	}
+
+	// a known org with every backend failing is unavailable, not unknown
+	secondFailing.Store(true)
+	checker.CheckAll(context.Background())
+	if _, err := routed(); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Errorf("lookup with every backend failing = %v, want %v", err, ErrNoHealthyBackend)
+	}
+
+	// and a passing check puts it back
+	firstFailing.Store(false)
+	checker.CheckAll(context.Background())
+	if backends, err := routed(); err != nil || !backends[first.Address()] || backends[second.Address()] {
+		t.Errorf("routed to %v, %v after %s recovered, want only it", backends, err, first.Address())
+	}
+}
@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestMain(m *testing.M) {
+	// the rejections and failures tests provoke are logged at warn and
+	// error; keep them out of the test output
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	// retry throttled and failed calls of the fakes without waiting long
+	ECSRetryPolicy.BaseDelay = time.Millisecond
+	ECSRetryPolicy.MaxDelay = 5 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// waitFor waits up to 5 seconds for cond to hold, failing with what if it
+// doesn't.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testTarget returns a target for cluster served by client.
+func testTarget(client ECSAPI, cluster string) ClusterTarget {
+	return ClusterTarget{Client: client, Cluster: cluster, Region: discoverytest.Region}
+}
+
+// serviceNames returns the names and addresses of the entries, sorted, in
+// the form name=ip:port.
+func serviceNames(services []ECSService) string {
+	entries := make([]string, len(services))
+	for i, svc := range services {
+		entries[i] = svc.Name + "=" + svc.Address()
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
@@ -0,0 +1,46 @@
+package discovery
+
+import (
+	"math"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RegisterRouteTable publishes the size and last discovery of routes under
+// the table label.
+func RegisterRouteTable(table string, routes *RouteTable) {
+	labels := prometheus.Labels{"table": table}
+	promauto.With(telemetry.Registry).NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ecs_svc_proxy_routes",
+		Help:        "Entries in the route table.",
+		ConstLabels: labels,
+	}, func() float64 {
+		return float64(len(routes.Services()))
+	})
+	promauto.With(telemetry.Registry).NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ecs_svc_proxy_last_refresh_timestamp_seconds",
+		Help:        "Unix time the routes were last discovered, 0 if never.",
+		ConstLabels: labels,
+	}, func() float64 {
+		builtAt := routes.BuiltAt()
+		if builtAt.IsZero() {
+			return 0
+		}
+		return float64(builtAt.UnixNano()) / 1e9
+	})
+	promauto.With(telemetry.Registry).NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ecs_svc_proxy_last_refresh_age_seconds",
+		Help:        "Seconds since the routes were last discovered, +Inf if never.",
+		ConstLabels: labels,
+	}, func() float64 {
+		builtAt := routes.BuiltAt()
+		if builtAt.IsZero() {
+			return math.Inf(1)
+		}
+		return time.Since(builtAt).Seconds()
+	})
+}
@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// NegativeCache remembers org IDs that matched no service so repeated
+// requests for them can be answered without a lookup or a refresh. It holds
+// at most size entries and evicts the least recently used one beyond that,
+// so random org IDs can't grow it without bound. A nil *NegativeCache is
+// disabled.
+type NegativeCache struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front.
+	order *list.List
+}
+
+type negativeEntry struct {
+	orgID   string
+	expires time.Time
+}
+
+// NewNegativeCache returns a cache of at most size org IDs that are
+// remembered for ttl. It returns nil, a disabled cache, if either is zero.
+func NewNegativeCache(ttl time.Duration, size int) *NegativeCache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	return &NegativeCache{
+		clock:   clock.System{},
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Contains reports whether orgID is known to match no service.
+func (c *NegativeCache) Contains(orgID string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[orgID]
+	if !ok {
+		return false
+	}
+	if c.clock.Now().After(element.Value.(*negativeEntry).expires) {
+		c.remove(element)
+		return false
+	}
+	c.order.MoveToFront(element)
+	telemetry.NegativeCacheHits.Add(1)
+	return true
+}
+
+// Add remembers that orgID matched no service.
+func (c *NegativeCache) Add(orgID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.clock.Now().Add(c.ttl)
+	if element, ok := c.entries[orgID]; ok {
+		element.Value.(*negativeEntry).expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[orgID] = c.order.PushFront(&negativeEntry{orgID: orgID, expires: expires})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		telemetry.NegativeCacheEvictions.Add(1)
+	}
+}
+
+// Invalidate forgets every org ID for which found returns true.
+func (c *NegativeCache) Invalidate(found func(orgID string) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for orgID, element := range c.entries {
+		if found(orgID) {
+			c.remove(element)
+		}
+	}
+}
+
+// Len returns the number of entries, including expired ones not yet removed.
+func (c *NegativeCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *NegativeCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*negativeEntry).orgID)
+}
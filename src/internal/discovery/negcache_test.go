@@ -0,0 +1,53 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+func TestNegativeCache(t *testing.T) {
+	clock := clocktest.New()
+	cache := NewNegativeCache(30*time.Second, 2)
+	cache.clock = clock
+	cache.Add("bogus")
+	if !cache.Contains("bogus") || cache.Contains("other") {
+		t.Fatal("Contains doesn't reflect Add")
+	}
+
+	clock.Advance(29 * time.Second)
+	if !cache.Contains("bogus") {
+		t.Error("entry expired before its TTL")
+	}
+	clock.Advance(2 * time.Second)
+	if cache.Contains("bogus") {
+		t.Error("entry outlived its TTL")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expired entry kept, %d entries", cache.Len())
+	}
+
+	// the least recently used entry is evicted beyond the size
+	evictions := telemetry.NegativeCacheEvictions.Value()
+	cache.Add("a")
+	cache.Add("b")
+	cache.Contains("a")
+	cache.Add("c")
+	if !cache.Contains("a") || cache.Contains("b") || !cache.Contains("c") {
+		t.Error("evicted another entry than the least recently used")
+	}
+	if n := telemetry.NegativeCacheEvictions.Value() - evictions; n != 1 {
+		t.Errorf("%d evictions counted, want 1", n)
+	}
+
+	if NewNegativeCache(0, 10) != nil || NewNegativeCache(time.Second, 0) != nil {
+		t.Error("cache enabled without a TTL or a size")
+	}
+	var disabled *NegativeCache
+	disabled.Add("bogus")
+	if disabled.Contains("bogus") {
+		t.Error("disabled cache remembered an org")
+	}
+}
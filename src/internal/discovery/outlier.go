@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// ewmaWeight is the weight of a new latency sample in a backend's moving
+// average.
+const ewmaWeight = 0.2
+
+// LatencyOutliers takes backends out of rotation whose latency is far above
+// that of the other backends of their service. The latency of a backend is
+// an exponentially weighted moving average of its forwarded requests. Once
+// it has minSamples samples and exceeds multiplier times the median of its
+// service, the backend is ejected for ejectFor, after which its average
+// starts over. A nil *LatencyOutliers ejects nothing.
+type LatencyOutliers struct {
+	mu         sync.Mutex
+	multiplier float64
+	minSamples int
+	ejectFor   time.Duration
+	clock      clock.Clock
+	stats      map[string]*latencyStats
+}
+
+type latencyStats struct {
+	ewma         float64 // seconds
+	samples      int
+	ejectedUntil time.Time
+}
+
+// newLatencyOutliers returns an outlier detector timed by clock, or nil if
+// multiplier is zero.
+func newLatencyOutliers(multiplier float64, minSamples int, ejectFor time.Duration, clock clock.Clock) *LatencyOutliers {
+	if multiplier <= 0 {
+		return nil
+	}
+	return &LatencyOutliers{
+		multiplier: multiplier,
+		minSamples: minSamples,
+		ejectFor:   ejectFor,
+		clock:      clock,
+		stats:      map[string]*latencyStats{},
+	}
+}
+
+// Observe records the latency of a request to address.
+func (o *LatencyOutliers) Observe(address string, latency time.Duration) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats, ok := o.stats[address]
+	if !ok {
+		stats = &latencyStats{ewma: latency.Seconds()}
+		o.stats[address] = stats
+	}
+	stats.ewma += ewmaWeight * (latency.Seconds() - stats.ewma)
+	stats.samples++
+}
+
+// Filter returns the backends of a service that aren't latency outliers,
+// ejecting new outliers on the way. A service always keeps at least one
+// backend.
+func (o *LatencyOutliers) Filter(backends []ECSService) []ECSService {
+	if o == nil || len(backends) < 2 {
+		return backends
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.clock.Now()
+
+	var candidates []ECSService
+	var latencies []float64
+	for _, backend := range backends {
+		stats, ok := o.stats[backend.Address()]
+		if !ok || now.Before(stats.ejectedUntil) {
+			continue
+		}
+		if !stats.ejectedUntil.IsZero() {
+			// back from ejection, judge it on fresh samples
+			delete(o.stats, backend.Address())
+			continue
+		}
+		if stats.samples >= o.minSamples {
+			candidates = append(candidates, backend)
+			latencies = append(latencies, stats.ewma)
+		}
+	}
+	if len(latencies) >= 2 {
+		sort.Float64s(latencies)
+		median := latencies[len(latencies)/2]
+		if len(latencies)%2 == 0 {
+			median = (latencies[len(latencies)/2-1] + median) / 2
+		}
+		for _, backend := range candidates {
+			stats := o.stats[backend.Address()]
+			if stats.ewma > o.multiplier*median {
+				slog.Warn("Ejecting backend for its latency", "backend", backend.Address(), "service", backend.Name, "duration", o.ejectFor, "latency", time.Duration(stats.ewma*float64(time.Second)), "multiplier", o.multiplier)
+				telemetry.LatencyEjections.Add(1)
+				stats.ejectedUntil = now.Add(o.ejectFor)
+			}
+		}
+	}
+
+	var selected []ECSService
+	for _, backend := range backends {
+		if stats, ok := o.stats[backend.Address()]; !ok || !now.Before(stats.ejectedUntil) {
+			selected = append(selected, backend)
+		}
+	}
+	if len(selected) == 0 {
+		return backends
+	}
+	return selected
+}
+
+// Ejected returns the addresses currently ejected for their latency.
+func (o *LatencyOutliers) Ejected() []string {
+	var addresses []string
+	if o == nil {
+		return addresses
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.clock.Now()
+	for address, stats := range o.stats {
+		if now.Before(stats.ejectedUntil) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Forget drops the latencies of addresses that left the route table.
+func (o *LatencyOutliers) Forget(addresses []string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, address := range addresses {
+		delete(o.stats, address)
+	}
+}
@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+)
+
+func TestLatencyOutliers(t *testing.T) {
+	clock := clocktest.New()
+	routes := NewRouteTable([]ECSService{
+		{Name: "acme", IP: "10.0.0.1", Port: 8080},
+		{Name: "acme", IP: "10.0.0.2", Port: 8080},
+		{Name: "acme", IP: "10.0.0.3", Port: 8080},
+	}, nil, config.LBStrategyRoundRobin)
+	routes.SetClock(clock)
+	routes.SetOutliers(3, 5, time.Minute)
+	latencies := map[string]time.Duration{"10.0.0.1:8080": 10 * time.Millisecond, "10.0.0.2:8080": 12 * time.Millisecond, "10.0.0.3:8080": 300 * time.Millisecond}
+	observe := func(samples int) {
+		for i := 0; i < samples; i++ {
+			for address, latency := range latencies {
+				routes.Outliers.Observe(address, latency)
+			}
+		}
+	}
+	// routed returns the backends of six lookups of acme.
+	routed := func() map[string]bool {
+		t.Helper()
+		backends := map[string]bool{}
+		for i := 0; i < 6; i++ {
+			svc, err := routes.Lookup("acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			backends[svc.Address()] = true
+		}
+		return backends
+	}
+
+	// too few samples to judge
+	observe(4)
+	if backends := routed(); len(backends) != 3 {
+		t.Fatalf("routed to %v with 4 samples each, want all 3 backends", backends)
+	}
+
+	observe(1)
+	want := map[string]bool{"10.0.0.1:8080": true, "10.0.0.2:8080": true}
+	if backends := routed(); !reflect.DeepEqual(backends, want) {
+		t.Errorf("routed to %v, want the slow backend ejected and the others kept", backends)
+	}
+	if ejected := routes.Outliers.Ejected(); !reflect.DeepEqual(ejected, []string{"10.0.0.3:8080"}) {
+		t.Errorf("Ejected = %v", ejected)
+	}
+
+	// back after the ejection, judged on fresh samples
+	clock.Advance(time.Minute)
+	if backends := routed(); len(backends) != 3 {
+		t.Errorf("routed to %v after the ejection, want all 3 backends", backends)
+	}
+	if ejected := routes.Outliers.Ejected(); len(ejected) != 0 {
+		t.Errorf("Ejected = %v after the ejection", ejected)
+	}
+}
@@ -0,0 +1,247 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// OverrideCluster is the cluster of the backends of route overrides, which
+// aren't tasks of any.
+const OverrideCluster = "override"
+
+// RouteOverride pins the requests of an org to a backend an operator gave,
+// until Expires if it is set.
+type RouteOverride struct {
+	Org     string     `json:"org"`
+	Target  string     `json:"target"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Created time.Time  `json:"created"`
+	// Caller is the address the override was set from.
+	Caller string `json:"caller"`
+}
+
+func (o RouteOverride) expired(now time.Time) bool {
+	return o.Expires != nil && !now.Before(*o.Expires)
+}
+
+// RouteOverrides are the overrides set through the admin endpoints. They
+// take precedence over discovered routes, which never replace them, until
+// they expire or are deleted. The target of each must be in allowed.
+// changed is called after each change, to persist them, and may be nil.
+type RouteOverrides struct {
+	allowed []netip.Prefix
+	clock   clock.Clock
+	changed func()
+
+	mu      sync.Mutex
+	entries map[string]RouteOverride
+}
+
+// NewRouteOverrides returns no overrides; added ones must point at
+// addresses in allowed.
+func NewRouteOverrides(allowed []netip.Prefix) *RouteOverrides {
+	return &RouteOverrides{allowed: allowed, clock: clock.System{}, entries: map[string]RouteOverride{}}
+}
+
+// SetClock makes the overrides expire by clock. It must be called before
+// the overrides are shared.
+func (o *RouteOverrides) SetClock(clock clock.Clock) {
+	o.clock = clock
+}
+
+// OnChange registers fn to be called after the overrides changed. It must
+// be called before the overrides are shared.
+func (o *RouteOverrides) OnChange(fn func()) {
+	o.changed = fn
+}
+
+// Set pins org to target, an IP:port, for ttl, or until it is deleted if
+// ttl is zero, replacing the override org had. caller is logged and kept
+// with it.
+func (o *RouteOverrides) Set(org, target string, ttl time.Duration, caller string) (RouteOverride, error) {
+	if strings.TrimSpace(org) == "" {
+		return RouteOverride{}, errors.New("empty org")
+	}
+	addr, err := o.parseTarget(target)
+	if err != nil {
+		return RouteOverride{}, err
+	}
+	if ttl < 0 {
+		return RouteOverride{}, fmt.Errorf("invalid ttl %v, must be positive", ttl)
+	}
+	now := o.clock.Now()
+	override := RouteOverride{Org: org, Target: addr.String(), Created: now, Caller: caller}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		override.Expires = &expires
+	}
+	o.mu.Lock()
+	previous, replaced := o.entries[org]
+	o.entries[org] = override
+	o.mu.Unlock()
+	args := []any{"audit", true, "org", org, "backend", override.Target, "ttl", ttl, "caller", caller}
+	if replaced {
+		args = append(args, "previous", previous.Target)
+	}
+	slog.Info("Route override set", args...)
+	o.notify()
+	return override, nil
+}
+
+// parseTarget parses an IP:port target, which must be in the allowed CIDRs.
+func (o *RouteOverrides) parseTarget(target string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddrPort(target)
+	if err != nil || addr.Port() == 0 {
+		return netip.AddrPort{}, fmt.Errorf("invalid target %q, expected IP:port", target)
+	}
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	if !config.ContainsAddr(o.allowed, addr.Addr()) {
+		return netip.AddrPort{}, fmt.Errorf("target %s is outside BACKEND_ALLOWED_CIDRS", addr.Addr())
+	}
+	return addr, nil
+}
+
+// Delete removes the override of org, and reports whether it had one.
+func (o *RouteOverrides) Delete(org, caller string) bool {
+	o.mu.Lock()
+	override, ok := o.entries[org]
+	if ok {
+		delete(o.entries, org)
+	}
+	o.mu.Unlock()
+	if !ok || override.expired(o.clock.Now()) {
+		return false
+	}
+	slog.Info("Route override deleted", "audit", true, "org", org, "backend", override.Target, "caller", caller)
+	o.notify()
+	return true
+}
+
+// Lookup returns the backend of the override of org, false if it has none.
+// A nil RouteOverrides has none.
+func (o *RouteOverrides) Lookup(org string) (ECSService, bool) {
+	if o == nil {
+		return ECSService{}, false
+	}
+	o.mu.Lock()
+	override, ok := o.entries[org]
+	o.mu.Unlock()
+	if !ok || o.expire(override) {
+		return ECSService{}, false
+	}
+	addr := netip.MustParseAddrPort(override.Target)
+	return ECSService{Name: org, IP: addr.Addr().String(), Port: int(addr.Port()), Cluster: OverrideCluster}, true
+}
+
+// expire removes override if it expired, and reports whether it did.
+func (o *RouteOverrides) expire(override RouteOverride) bool {
+	if !override.expired(o.clock.Now()) {
+		return false
+	}
+	o.mu.Lock()
+	current, ok := o.entries[override.Org]
+	// it may have been set again meanwhile
+	removed := ok && current == override
+	if removed {
+		delete(o.entries, override.Org)
+	}
+	o.mu.Unlock()
+	if removed {
+		slog.Info("Route override expired", "audit", true, "org", override.Org, "backend", override.Target, "caller", override.Caller)
+		o.notify()
+	}
+	return true
+}
+
+// List returns the overrides that didn't expire, sorted by org. A nil
+// RouteOverrides has none.
+func (o *RouteOverrides) List() []RouteOverride {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	overrides := make([]RouteOverride, 0, len(o.entries))
+	for _, override := range o.entries {
+		overrides = append(overrides, override)
+	}
+	o.mu.Unlock()
+	active := overrides[:0]
+	for _, override := range overrides {
+		if !o.expire(override) {
+			active = append(active, override)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Org < active[j].Org })
+	return active
+}
+
+// Restore sets the overrides saved by a previous run, skipping the ones that
+// expired since and the ones whose target is no longer allowed.
+func (o *RouteOverrides) Restore(overrides []RouteOverride) {
+	now := o.clock.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, override := range overrides {
+		if override.expired(now) {
+			continue
+		}
+		if _, err := o.parseTarget(override.Target); err != nil {
+			slog.Warn("Dropping saved route override", "org", override.Org, "error", err)
+			continue
+		}
+		o.entries[override.Org] = override
+		slog.Info("Restored route override", "org", override.Org, "backend", override.Target, "expires", override.Expires)
+	}
+}
+
+// Replace swaps all overrides for overrides, as imported from an export by
+// caller, dropping the ones that expired. They must have passed validate.
+func (o *RouteOverrides) Replace(overrides []RouteOverride, caller string) {
+	now := o.clock.Now()
+	entries := make(map[string]RouteOverride, len(overrides))
+	for _, override := range overrides {
+		if !override.expired(now) {
+			override.Target = netip.MustParseAddrPort(override.Target).String()
+			entries[override.Org] = override
+		}
+	}
+	o.mu.Lock()
+	o.entries = entries
+	o.mu.Unlock()
+	slog.Info("Route overrides replaced", "audit", true, "overrides", len(entries), "caller", caller)
+	o.notify()
+}
+
+// Validate checks overrides to be given to Replace: one per org, each with a
+// target Set would take.
+func (o *RouteOverrides) Validate(overrides []RouteOverride) error {
+	orgs := make(map[string]bool, len(overrides))
+	for _, override := range overrides {
+		if strings.TrimSpace(override.Org) == "" {
+			return errors.New("override with an empty org")
+		}
+		if orgs[override.Org] {
+			return fmt.Errorf("org %s has several overrides", override.Org)
+		}
+		orgs[override.Org] = true
+		if _, err := o.parseTarget(override.Target); err != nil {
+			return fmt.Errorf("override of org %s: %w", override.Org, err)
+		}
+	}
+	return nil
+}
+
+func (o *RouteOverrides) notify() {
+	if o.changed != nil {
+		o.changed()
+	}
+}
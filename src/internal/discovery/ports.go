@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// portMapping is a named port mapping of a container.
+type portMapping struct {
+	name string
+	port int
+}
+
+// containerPorts are the ports a task definition gives a container: the one
+// of its port label, 0 without, and its port mappings, lowest port first.
+type containerPorts struct {
+	label    int
+	mappings []portMapping
+}
+
+// taskDefinitionPorts resolves the port each container listens on from the
+// port mapping of its name in names, or a docker label in its task
+// definition. Lookups are memoized, so each task definition is described at
+// most once per instance; create one per refresh. It is safe for concurrent
+// use.
+type taskDefinitionPorts struct {
+	mu          sync.Mutex
+	client      ECSAPI
+	label       string
+	names       config.PortNames
+	defaultPort int
+	// ports maps task definition ARN to container name to its ports.
+	ports map[string]map[string]containerPorts
+}
+
+func newTaskDefinitionPorts(client ECSAPI, label string, names config.PortNames, defaultPort int) *taskDefinitionPorts {
+	return &taskDefinitionPorts{
+		client:      client,
+		label:       label,
+		names:       names,
+		defaultPort: defaultPort,
+		ports:       map[string]map[string]containerPorts{},
+	}
+}
+
+// port returns the port of the container and the name of the mapping it
+// comes from. With a port name for the container, the mapping of that name
+// is picked; without one matching, the port label, then the lowest mapping
+// with a warning. Otherwise it is the port label. The default port is the
+// last resort, also when the task definition can't be described.
+func (p *taskDefinitionPorts) port(ctx context.Context, taskDefinitionArn, container string) (int, string) {
+	p.mu.Lock()
+	ports, ok := p.ports[taskDefinitionArn]
+	if !ok {
+		ports = p.describe(ctx, taskDefinitionArn)
+		p.ports[taskDefinitionArn] = ports
+	}
+	p.mu.Unlock()
+	found := ports[container]
+	if want := p.names.Of(container); want != "" {
+		for _, mapping := range found.mappings {
+			if mapping.name == want {
+				return mapping.port, mapping.name
+			}
+		}
+		if found.label == 0 && len(found.mappings) > 0 {
+			lowest := found.mappings[0]
+			if telemetry.LogSamples.Allow(ctx, slog.LevelWarn, "No port mapping of that name", taskDefinitionArn+"/"+container) {
+				slog.WarnContext(ctx, "No port mapping of that name, using the lowest port", "port_name", want, "container", container,
+					"task_definition", taskDefinitionArn, "port", lowest.port)
+			}
+			return lowest.port, lowest.name
+		}
+	}
+	if found.label != 0 {
+		return found.label, ""
+	}
+	return p.defaultPort, ""
+}
+
+func (p *taskDefinitionPorts) describe(ctx context.Context, taskDefinitionArn string) map[string]containerPorts {
+	ports := map[string]containerPorts{}
+	var resp *ecs.DescribeTaskDefinitionOutput
+	err := ECSRetryPolicy.call(ctx, "DescribeTaskDefinition", func(ctx context.Context) (err error) {
+		resp, err = p.client.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(taskDefinitionArn),
+		})
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to describe task definition", "task_definition", taskDefinitionArn, "error", err)
+		return ports
+	}
+
+	for _, container := range resp.TaskDefinition.ContainerDefinitions {
+		var found containerPorts
+		for _, mapping := range container.PortMappings {
+			if port := int(aws.ToInt32(mapping.ContainerPort)); port > 0 {
+				found.mappings = append(found.mappings, portMapping{name: aws.ToString(mapping.Name), port: port})
+			}
+		}
+		sort.SliceStable(found.mappings, func(i, j int) bool { return found.mappings[i].port < found.mappings[j].port })
+		if value, ok := container.DockerLabels[p.label]; ok {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				slog.Warn("Ignoring invalid port label", "label", p.label, "value", value, "container", aws.ToString(container.Name), "task_definition", taskDefinitionArn)
+			} else {
+				found.label = port
+			}
+		}
+		ports[aws.ToString(container.Name)] = found
+	}
+	return ports
+}
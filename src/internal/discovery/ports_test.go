@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestTaskDefinitionPorts(t *testing.T) {
+	fake := discoverytest.NewECS()
+	// container returns the definition of a container with docker labels.
+	container := func(name string, labels map[string]string) types.ContainerDefinition {
+		return types.ContainerDefinition{Name: aws.String(name), DockerLabels: labels}
+	}
+	fake.AddTaskDefinition("acme",
+		container("app", map[string]string{"proxy.port": "3000"}),
+		container("custom", map[string]string{"tenant.port": "9090"}),
+		container("bare", nil),
+		container("word", map[string]string{"proxy.port": "http"}),
+		container("zero", map[string]string{"proxy.port": "0"}),
+		container("huge", map[string]string{"proxy.port": "65536"}))
+	definition := discoverytest.TaskDefinitionARN("acme", 1)
+
+	for _, tt := range []struct {
+		label, container string
+		want             int
+	}{
+		{label: "proxy.port", container: "app", want: 3000},
+		{label: "tenant.port", container: "custom", want: 9090},
+		// the label of another key is not looked at
+		{label: "proxy.port", container: "custom", want: 8080},
+		// a missing or invalid label falls back to the default port
+		{label: "proxy.port", container: "bare", want: 8080},
+		{label: "proxy.port", container: "word", want: 8080},
+		{label: "proxy.port", container: "zero", want: 8080},
+		{label: "proxy.port", container: "huge", want: 8080},
+		{label: "proxy.port", container: "missing", want: 8080},
+	} {
+		ports := newTaskDefinitionPorts(fake, tt.label, config.PortNames{}, 8080)
+		if port, _ := ports.port(context.Background(), definition, tt.container); port != tt.want {
+			t.Errorf("port of %s with the %s label = %d, want %d", tt.container, tt.label, port, tt.want)
+		}
+	}
+
+	// memoized per instance, so each task definition is described once
+	calls := fake.Count("DescribeTaskDefinition")
+	ports := newTaskDefinitionPorts(fake, "proxy.port", config.PortNames{}, 8080)
+	for _, container := range []string{"app", "bare", "app"} {
+		ports.port(context.Background(), definition, container)
+	}
+	if n := fake.Count("DescribeTaskDefinition") - calls; n != 1 {
+		t.Errorf("DescribeTaskDefinition called %d times for one task definition, want 1", n)
+	}
+
+	// a task definition that can't be described gets the default port
+	fake.FailNext("DescribeTaskDefinition", discoverytest.AccessDenied())
+	ports = newTaskDefinitionPorts(fake, "proxy.port", config.PortNames{}, 8080)
+	if port, _ := ports.port(context.Background(), definition, "app"); port != 8080 {
+		t.Errorf("port with DescribeTaskDefinition failing = %d, want the default 8080", port)
+	}
+}
+
+func TestTaskDefinitionPortNames(t *testing.T) {
+	fake := discoverytest.NewECS()
+	// mappings returns the definition of a container with port mappings,
+	// name=port or an unnamed port each.
+	mappings := func(name string, labels map[string]string, ports ...string) types.ContainerDefinition {
+		container := types.ContainerDefinition{Name: aws.String(name), DockerLabels: labels}
+		for _, port := range ports {
+			mapping := types.PortMapping{}
+			if portName, number, ok := strings.Cut(port, "="); ok {
+				mapping.Name, port = aws.String(portName), number
+			}
+			n, _ := strconv.Atoi(port)
+			mapping.ContainerPort = aws.Int32(int32(n))
+			container.PortMappings = append(container.PortMappings, mapping)
+		}
+		return container
+	}
+	for _, container := range []types.ContainerDefinition{
+		mappings("acme", nil, "admin=9090", "http=3000", "8081"),
+		// the override of globex takes precedence over TARGET_PORT_NAME
+		mappings("globex", nil, "http=3000", "admin=9090"),
+		// no mapping of that name: the lowest port, or the label if any
+		mappings("initech", nil, "metrics=9100", "4000"),
+		mappings("hooli", map[string]string{"proxy.port": "5000"}, "4000", "metrics=9100"),
+	} {
+		service := aws.ToString(container.Name)
+		fake.AddService("tenants", service)
+		fake.AddTaskDefinition(service, container)
+		fake.AddTasks("tenants", discoverytest.Task("tenants", service, service+"1", "10.0.0.1"))
+	}
+	cfg, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "TARGET_PORT_NAME": "http", "TARGET_PORT_NAME_ORGS": "globex|admin"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{PortLabel: "proxy.port", PortNames: cfg.PortNames, DefaultPort: 8080}
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := map[string]string{}
+	for _, svc := range details {
+		ports[svc.Name] = fmt.Sprintf("%s=%d", svc.PortName, svc.Port)
+	}
+	if want := map[string]string{"acme": "http=3000", "globex": "admin=9090", "initech": "=4000", "hooli": "=5000"}; !maps.Equal(ports, want) {
+		t.Errorf("ports %v, want %v", ports, want)
+	}
+
+	// and the chosen port shows in /debug/routes
+	routes := NewRouteTable(details, nil, config.LBStrategyRoundRobin)
+	if backends := routes.Dump("globex").Services["globex"]; len(backends) != 1 || backends[0].Port != 9090 || backends[0].PortName != "admin" {
+		t.Errorf("dump of globex %+v, want its admin port", backends)
+	}
+
+	for _, orgs := range []string{"globex", "globex|", "globex|admin,globex|http"} {
+		if _, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "TARGET_PORT_NAME_ORGS": orgs}, "", nil); err == nil {
+			t.Errorf("TARGET_PORT_NAME_ORGS=%s accepted", orgs)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisClient is the part of Redis the shared route store uses, implemented
+// by *RESPClient and by fakes or an in-memory server in tests.
+type redisClient interface {
+	// SetNX sets key to value for ttl unless it exists, and reports whether
+	// it did.
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// Get returns the value of key, or nil if it doesn't exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte) error
+	Publish(ctx context.Context, channel, message string) error
+	// Subscribe returns the messages published to channel until ctx is
+	// done or the connection is lost, when the channel is closed.
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
+}
+
+// errRedisNil is the null reply of a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+// RESPClient speaks RESP to a single Redis server over one connection for
+// commands, dialled again after an error, and one per subscription.
+type RESPClient struct {
+	addr     string
+	password string
+	// timeout bounds each command that has no earlier deadline.
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *respConn
+}
+
+// NewRESPClient returns a client of the Redis server at addr. Every command
+// fails after timeout unless its context ends sooner.
+func NewRESPClient(addr, password string, timeout time.Duration) *RESPClient {
+	return &RESPClient{addr: addr, password: password, timeout: timeout}
+}
+
+// respConn is a connection to Redis.
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dial connects to the server and authenticates.
+func (c *RESPClient) dial(ctx context.Context) (*respConn, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{Conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		c.setDeadline(ctx, rc)
+		if _, err := rc.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+	return rc, nil
+}
+
+func (c *RESPClient) setDeadline(ctx context.Context, conn *respConn) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+}
+
+// do runs a command on the shared connection, dropping it after an error
+// other than a Redis error reply so the next command dials again. A
+// connection the server closed while it was idle, when it restarted say,
+// fails the first command sent on it; that command is sent again on a new
+// connection, unless it timed out.
+func (c *RESPClient) do(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for reused := c.conn != nil; ; reused = false {
+		if c.conn == nil {
+			conn, err := c.dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			c.conn = conn
+		}
+		c.setDeadline(ctx, c.conn)
+		reply, err := c.conn.do(args...)
+		var replyErr redisError
+		if err == nil || err == errRedisNil || errors.As(err, &replyErr) {
+			return reply, err
+		}
+		c.conn.Close()
+		c.conn = nil
+		var netErr net.Error
+		if !reused || ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return reply, err
+		}
+	}
+}
+
+// SetNX sets key to value with a time to live of ttl unless key is set. It
+// reports whether it set the key.
+func (c *RESPClient) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	_, err := c.do(ctx, "SET", key, value, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err == errRedisNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get returns the value of key, or nil if key isn't set.
+func (c *RESPClient) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, "GET", key)
+	if err == errRedisNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T to GET", reply)
+	}
+	return value, nil
+}
+
+// Set sets key to value without expiry.
+func (c *RESPClient) Set(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, "SET", key, string(value))
+	return err
+}
+
+// Publish sends message to the subscribers of channel.
+func (c *RESPClient) Publish(ctx context.Context, channel, message string) error {
+	_, err := c.do(ctx, "PUBLISH", channel, message)
+	return err
+}
+
+// Subscribe returns the messages published to channel on a connection of
+// its own. The channel is closed when ctx is done or the connection fails.
+func (c *RESPClient) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.setDeadline(ctx, conn)
+	if _, err := conn.do("SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// a subscription waits for messages as long as it takes
+	conn.SetDeadline(time.Time{})
+	messages := make(chan string)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		defer close(messages)
+		defer conn.Close()
+		for {
+			reply, err := conn.read()
+			if err != nil {
+				return
+			}
+			// message replies are [message, channel, payload]
+			parts, ok := reply.([]any)
+			if !ok || len(parts) != 3 {
+				continue
+			}
+			kind, _ := parts[0].([]byte)
+			payload, _ := parts[2].([]byte)
+			if string(kind) != "message" {
+				continue
+			}
+			select {
+			case messages <- string(payload):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends a command and reads its reply.
+func (c *respConn) do(args ...string) (any, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read reads a reply: a string or bulk string as []byte, an integer as
+// int64, an array as []any, a null as errRedisNil and an error reply as
+// redisError.
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		value := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, value); err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,251 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testRedisPassword = "s3cret"
+
+// newMiniredis starts an in-memory Redis requiring testRedisPassword, until
+// the test ends.
+func newMiniredis(t *testing.T) *miniredis.Miniredis {
+	server := miniredis.RunT(t)
+	server.RequireAuth(testRedisPassword)
+	return server
+}
+
+// newReplica returns a refresher of the tenants cluster of fake, its routes
+// discovered, then shared as id through server and updated by its
+// subscription until the test ends. The lease lasts 30 seconds, and shared
+// routes more than a minute old are stale.
+func newReplica(t *testing.T, fake *discoverytest.ECS, clock *clocktest.Clock, server *miniredis.Miniredis, id string) *Refresher {
+	t.Helper()
+	refresher := newTestRefresher(t, fake, clock, 0)
+	shared := NewSharedRoutes(NewRESPClient(server.Addr(), testRedisPassword, time.Second), "proxy", 30*time.Second, time.Minute)
+	shared.id = id
+	shared.clock = clock
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	refresher.SetShared(ctx, shared)
+	return refresher
+}
+
+func TestRESPClient(t *testing.T) {
+	server := newMiniredis(t)
+	ctx := context.Background()
+
+	if _, err := NewRESPClient(server.Addr(), "guess", time.Second).Get(ctx, "key"); err == nil || !strings.Contains(err.Error(), "auth") {
+		t.Errorf("wrong password: err = %v", err)
+	}
+
+	client := NewRESPClient(server.Addr(), testRedisPassword, time.Second)
+	if ok, err := client.SetNX(ctx, "lease", "a", 30*time.Second); !ok || err != nil {
+		t.Fatalf("SetNX = %v, %v, want the lease taken", ok, err)
+	}
+	if ok, err := client.SetNX(ctx, "lease", "b", 30*time.Second); ok || err != nil {
+		t.Errorf("SetNX of a held lease = %v, %v", ok, err)
+	}
+	if owner, _ := server.Get("lease"); owner != "a" || server.TTL("lease") != 30*time.Second {
+		t.Errorf("lease held by %q for %v", owner, server.TTL("lease"))
+	}
+	if value, err := client.Get(ctx, "missing"); value != nil || err != nil {
+		t.Errorf("Get of a missing key = %q, %v", value, err)
+	}
+	// values are binary safe
+	value := "{\"services\":\r\n[]}\x00"
+	if err := client.Set(ctx, "routes", []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Get(ctx, "routes"); string(got) != value || err != nil {
+		t.Errorf("Get = %q, %v, want %q", got, err, value)
+	}
+
+	// an error reply is returned as one, and the connection kept
+	server.Lpush("list", "x")
+	var reply redisError
+	if _, err := client.Get(ctx, "list"); !errors.As(err, &reply) {
+		t.Errorf("Get of a list: err = %v, want an error reply", err)
+	}
+	// a lost connection is dialled again on the next command
+	server.Close()
+	if _, err := client.Get(ctx, "routes"); err == nil {
+		t.Error("Get succeeded with the server down")
+	}
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Get(ctx, "routes"); string(got) != value || err != nil {
+		t.Errorf("Get after a restart = %q, %v", got, err)
+	}
+	// a connection the server closed while idle doesn't fail a command
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.Get(ctx, "routes"); string(got) != value || err != nil {
+		t.Errorf("first Get on a connection closed by a restart = %q, %v", got, err)
+	}
+}
+
+func TestSharedRoutesLeaseTakeover(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	server := newMiniredis(t)
+	a := newReplica(t, fake, clock, server, "a")
+	b := newReplica(t, fake, clock, server, "b")
+	ctx := context.Background()
+
+	// a takes the lease and discovers the routes for both
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	clock.Advance(time.Second)
+	discoveries := fake.Count("ListServices")
+	if _, err := a.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := server.Get("proxy:lease"); owner != "a" || fake.Count("ListServices") != discoveries+1 {
+		t.Fatalf("lease held by %q after %d discoveries, want a after 1", owner, fake.Count("ListServices")-discoveries)
+	}
+
+	// b loads them without asking ECS
+	loaded := telemetrytest.CounterValue(t, sharedRoutesResults.WithLabelValues("loaded"))
+	clock.Advance(time.Second)
+	if _, err := b.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Count("ListServices") - discoveries; n != 1 {
+		t.Errorf("b discovered the routes itself, %d discoveries", n)
+	}
+	if got := serviceNames(b.routes.Services()); got != "acme=10.0.0.1:8080 globex=10.0.1.1:8080" {
+		t.Errorf("b routes %s", got)
+	}
+	if n := telemetrytest.CounterValue(t, sharedRoutesResults.WithLabelValues("loaded")) - loaded; n != 1 {
+		t.Errorf("counted %v loaded routes, want 1", n)
+	}
+
+	// a discovers them again while it holds the lease
+	clock.Advance(time.Second)
+	if _, err := a.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Count("ListServices") - discoveries; n != 2 {
+		t.Errorf("%d discoveries, want a to discover the routes again", n)
+	}
+
+	// a stops refreshing; once its lease expires b takes over
+	server.FastForward(30 * time.Second)
+	fake.AddService("tenants", "initech")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "initech", "i1", "10.0.2.1"))
+	if _, err := b.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := server.Get("proxy:lease"); owner != "b" || fake.Count("ListServices") != discoveries+3 {
+		t.Errorf("lease held by %q after %d discoveries, want b after 3", owner, fake.Count("ListServices")-discoveries)
+	}
+	if got := serviceNames(b.routes.Services()); !strings.Contains(got, "initech=") {
+		t.Errorf("b routes %s, without initech", got)
+	}
+}
+
+func TestSharedRoutesPropagation(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	server := newMiniredis(t)
+	a := newReplica(t, fake, clock, server, "a")
+	b := newReplica(t, fake, clock, server, "b")
+	ctx := context.Background()
+	subscribed := func() bool { return server.PubSubNumSub("proxy:updates")["proxy:updates"] == 2 }
+	waitFor(t, "both replicas to subscribe", subscribed)
+
+	// routes a publishes reach b without b refreshing
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	clock.Advance(time.Second)
+	if _, err := a.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to apply the routes a published", func() bool {
+		return serviceNames(b.routes.Services()) == "acme=10.0.0.1:8080 globex=10.0.1.1:8080"
+	})
+	if !b.routes.BuiltAt().Equal(a.routes.BuiltAt()) {
+		t.Errorf("b routes built at %v, a's at %v", b.routes.BuiltAt(), a.routes.BuiltAt())
+	}
+
+	// the replicas subscribe again after losing the connection
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	clock.WaitForTimers(t, 2)
+	clock.Advance(time.Second)
+	waitFor(t, "both replicas to subscribe again", subscribed)
+	fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "g1"))
+	clock.Advance(time.Second)
+	if _, err := a.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to apply the routes a published after the restart", func() bool {
+		return serviceNames(b.routes.Services()) == "acme=10.0.0.1:8080"
+	})
+}
+
+func TestSharedRoutesFallback(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	server := newMiniredis(t)
+	a := newReplica(t, fake, clock, server, "a")
+	b := newReplica(t, fake, clock, server, "b")
+	ctx := context.Background()
+	if _, err := a.Rebuild(ctx, TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		fail   func()
+		result string
+	}{
+		// a holds the lease but stopped publishing
+		{name: "stale", fail: func() { clock.Advance(2 * time.Minute) }, result: "stale"},
+		{name: "corrupted", fail: func() { server.Set("proxy:routes", "{") }, result: "unavailable"},
+		{name: "unreachable", fail: server.Close, result: "unavailable"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fail()
+			server.Set("proxy:lease", "a")
+			fallbacks := telemetrytest.CounterValue(t, sharedRoutesResults.WithLabelValues(tt.result))
+			discoveries := fake.Count("ListServices")
+			fake.AddService("tenants", tt.name)
+			fake.AddTasks("tenants", discoverytest.Task("tenants", tt.name, tt.name, "10.0.9.9"))
+			// b discovers the routes itself rather than serve old ones
+			if _, err := b.Rebuild(ctx, TriggerScheduled); err != nil {
+				t.Fatal(err)
+			}
+			if n := fake.Count("ListServices") - discoveries; n != 1 {
+				t.Errorf("%d discoveries, want b to discover the routes", n)
+			}
+			if got := serviceNames(b.routes.Services()); !strings.Contains(got, tt.name+"=") {
+				t.Errorf("b routes %s, without %s", got, tt.name)
+			}
+			if n := telemetrytest.CounterValue(t, sharedRoutesResults.WithLabelValues(tt.result)) - fallbacks; n != 1 {
+				t.Errorf("counted %v %s results, want 1", n, tt.result)
+			}
+		})
+	}
+}
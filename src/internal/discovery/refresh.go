@@ -0,0 +1,478 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Refresher rebuilds the route table from ECS. Concurrent refreshes, whether
+// triggered by lookup misses, events, or the background loop, share a single
+// discovery pass.
+type Refresher struct {
+	targets []ClusterTarget
+	opts    Options
+	routes  *RouteTable
+	group   singleflight.Group
+	// minInterval is the cooldown after a rebuild, or a failed attempt at
+	// one, during which lookup misses don't trigger another one.
+	minInterval time.Duration
+	// lastAttempt is when the last discovery started, in Unix nanoseconds.
+	lastAttempt atomic.Int64
+	// failures counts the discoveries that failed since the last success.
+	failures atomic.Int64
+	// freshTTL and maxAge bound how old the routes may get before a lookup
+	// revalidates them, see Revalidate.
+	freshTTL time.Duration
+	maxAge   time.Duration
+	// revalidating is set while a background revalidation runs.
+	revalidating atomic.Bool
+	// deferred is set while a refresh waits for the cooldown to be over,
+	// see RefreshSoon.
+	deferred atomic.Bool
+	// inFlight is closed once the full refresh in flight, if any, is done
+	// and its routes are published.
+	inFlightMu sync.Mutex
+	inFlight   chan struct{}
+	// jitterPercent and initialDelay spread background refreshes, see
+	// SetJitter. random returns a number in [0, n) and is replaceable for
+	// deterministic schedules.
+	jitterPercent int
+	initialDelay  time.Duration
+	random        func(n int64) int64
+	// snapshotPath is where the routes and overrides are saved after each
+	// successful discovery, if set. snapshotMu serializes the saves.
+	snapshotPath string
+	overrides    *RouteOverrides
+	snapshotMu   sync.Mutex
+	// name labels the refresher's metrics.
+	name string
+	// clock times the cooldown, the staleness of the routes and the
+	// background refreshes.
+	clock clock.Clock
+	// static replaces discovery with the routes of DiscoveryModeStatic, if
+	// set.
+	static *StaticRoutes
+	// shared shares the routes with the other replicas, nil when each
+	// discovers its own.
+	shared *SharedRoutes
+}
+
+// NewRefresher returns a refresher that discovers the services of targets
+// into routes, with minInterval as the cooldown after each attempt.
+func NewRefresher(targets []ClusterTarget, opts Options, routes *RouteTable, minInterval time.Duration) *Refresher {
+	return &Refresher{targets: targets, opts: opts, routes: routes, minInterval: minInterval, random: rand.Int63n, name: "primary", clock: clock.System{}}
+}
+
+// SetClock makes the refresher tell the time with clock. It must be called
+// before the refresher is shared.
+func (r *Refresher) SetClock(clock clock.Clock) {
+	r.clock = clock
+}
+
+// SetStatic makes the refresher read routes from static instead of
+// discovering the targets.
+func (r *Refresher) SetStatic(static *StaticRoutes) {
+	r.static = static
+}
+
+// discover returns the routes of the targets, or the static ones. The task
+// counts and roles of the services, when discovery records them, are
+// updated along the way.
+func (r *Refresher) discover(ctx context.Context, previous []ECSService) ([]ECSService, error) {
+	if r.static != nil {
+		return r.static.Load(ctx)
+	}
+	details, counts, roles, err := buildServiceDetails(ctx, r.targets, r.opts, previous, r.routes.AllServiceTasks(), r.routes.AllServiceRoles())
+	if err == nil && r.opts.ServiceCounts {
+		r.routes.SetServiceTasks(counts)
+		publishServiceTasks(r.name, counts)
+	}
+	if err == nil && r.opts.ServiceRoles {
+		r.routes.SetServiceRoles(roles)
+	}
+	return details, err
+}
+
+// SetName sets the name of the table the refresher's metrics are labeled
+// with, primary by default.
+func (r *Refresher) SetName(name string) {
+	r.name = name
+}
+
+// SetStaleness makes lookups revalidate routes older than freshTTL in the
+// background and wait for routes older than maxAge to be rebuilt. Zero
+// disables either.
+func (r *Refresher) SetStaleness(freshTTL, maxAge time.Duration) {
+	r.freshTTL, r.maxAge = freshTTL, maxAge
+}
+
+const (
+	routesFresh   = "fresh"
+	routesStale   = "stale"
+	routesExpired = "expired"
+)
+
+// State returns whether the routes are fresh, stale, or expired.
+func (r *Refresher) State() string {
+	builtAt := r.routes.BuiltAt()
+	age := r.clock.Now().Sub(builtAt)
+	switch {
+	case r.maxAge > 0 && (builtAt.IsZero() || age >= r.maxAge):
+		return routesExpired
+	case r.freshTTL > 0 && (builtAt.IsZero() || age >= r.freshTTL):
+		return routesStale
+	default:
+		return routesFresh
+	}
+}
+
+// Revalidate is called before a lookup. Stale routes are served as they are
+// while a single background refresh rebuilds them; expired routes are
+// rebuilt before returning. Either is skipped during the cooldown after the
+// last attempt, so a failing ECS gets the stale routes served rather than a
+// refresh per request.
+func (r *Refresher) Revalidate(ctx context.Context) {
+	state := r.State()
+	if state == routesFresh || r.coolingDown() {
+		return
+	}
+	if state == routesExpired {
+		r.Refresh(ctx, TriggerStale)
+		return
+	}
+	if r.revalidating.CompareAndSwap(false, true) {
+		go func() {
+			defer r.revalidating.Store(false)
+			r.Refresh(context.WithoutCancel(ctx), TriggerStale)
+		}()
+	}
+}
+
+// coolingDown reports whether the routes were rebuilt, or a rebuild was
+// attempted, less than the cooldown ago.
+func (r *Refresher) coolingDown() bool {
+	return r.cooldownLeft() > 0
+}
+
+// cooldownLeft returns how long until the cooldown after the last rebuild,
+// or attempt at one, is over, zero or less if it is.
+func (r *Refresher) cooldownLeft() time.Duration {
+	last := r.routes.BuiltAt()
+	if attempt := time.Unix(0, r.lastAttempt.Load()); attempt.After(last) {
+		last = attempt
+	}
+	return r.minInterval - r.clock.Now().Sub(last)
+}
+
+// Refresh rebuilds the route table, or waits for the refresh already in
+// flight. If discovery fails or is abandoned the current routes keep being
+// served. trigger is what the changes are attributed to in the audit log,
+// the one of the caller that started the refresh when it is shared.
+//
+// The shared discovery doesn't stop when the caller that started it goes
+// away, since other callers may be waiting on it.
+func (r *Refresher) Refresh(ctx context.Context, trigger string) {
+	r.Rebuild(ctx, trigger)
+}
+
+// Rebuild is Refresh returning what changed, why discovery failed, or
+// ctx.Err() if ctx is done before the refresh.
+func (r *Refresher) Rebuild(ctx context.Context, trigger string) (RouteDiff, error) {
+	ch := r.group.DoChan("refresh", func() (interface{}, error) {
+		defer r.startRefresh()()
+		start := r.clock.Now()
+		r.lastAttempt.Store(start.UnixNano())
+		// another replica holding the lease discovers the routes for all
+		if snapshot, ok := r.shared.follow(context.WithoutCancel(ctx)); ok {
+			return r.applyShared(snapshot), nil
+		}
+		details, err := r.discover(context.WithoutCancel(ctx), r.routes.Services())
+		if err != nil {
+			if telemetry.LogSamples.Allow(ctx, slog.LevelError, "Failed to refresh routes, serving the previous ones", r.name) {
+				slog.Error("Failed to refresh routes, serving the previous ones", "error", err)
+			}
+			telemetry.RefreshFailures.Add(1)
+			telemetry.RefreshFailuresTotal.WithLabelValues(r.name).Inc()
+			r.failures.Add(1)
+			return nil, err
+		}
+		diff := r.replace(details, trigger)
+		telemetry.RefreshDuration.WithLabelValues(r.name).Set(r.clock.Now().Sub(start).Seconds())
+		r.shared.publish(context.WithoutCancel(ctx), r.routes.Services(), r.routes.BuiltAt())
+		return diff, nil
+	})
+	select {
+	case <-ctx.Done():
+		return RouteDiff{}, ctx.Err()
+	case result := <-ch:
+		if result.Shared {
+			telemetry.RefreshesCoalesced.Add(1)
+		}
+		diff, _ := result.Val.(RouteDiff)
+		return diff, result.Err
+	}
+}
+
+// startRefresh records that a full refresh is in flight and returns the
+// func recording that it is done.
+func (r *Refresher) startRefresh() (done func()) {
+	ch := make(chan struct{})
+	r.inFlightMu.Lock()
+	r.inFlight = ch
+	r.inFlightMu.Unlock()
+	return func() {
+		r.inFlightMu.Lock()
+		r.inFlight = nil
+		r.inFlightMu.Unlock()
+		close(ch)
+	}
+}
+
+// Refreshing reports whether a full refresh is in flight.
+func (r *Refresher) Refreshing() bool {
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+	return r.inFlight != nil
+}
+
+// AwaitRefresh waits for the full refresh in flight, if any, to be done,
+// until ctx is done. It reports whether one was in flight and is done,
+// whether or not it succeeded.
+func (r *Refresher) AwaitRefresh(ctx context.Context) bool {
+	r.inFlightMu.Lock()
+	ch := r.inFlight
+	r.inFlightMu.Unlock()
+	if ch == nil {
+		return false
+	}
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// RefreshService rediscovers the tasks of the ECS service named service in
+// every cluster, which is much cheaper than a full discovery, and returns
+// what changed. The entries replaced are those of the tasks found and of
+// the containers they run, or named after the service, in the clusters that
+// could be asked; the others keep their entries. Concurrent calls for the
+// same service share one discovery, like Refresh. Static routes are all
+// read again.
+func (r *Refresher) RefreshService(ctx context.Context, service, trigger string) (RouteDiff, error) {
+	if r.static != nil {
+		return r.Rebuild(ctx, trigger)
+	}
+	ch := r.group.DoChan("service:"+service, func() (interface{}, error) {
+		results := make([][]ECSService, len(r.targets))
+		errs := make([]error, len(r.targets))
+		var wg sync.WaitGroup
+		for i, target := range r.targets {
+			wg.Add(1)
+			go func(i int, target ClusterTarget) {
+				defer wg.Done()
+				results[i], errs[i] = discoverService(context.WithoutCancel(ctx), target, service, r.opts)
+			}(i, target)
+		}
+		wg.Wait()
+
+		var details []ECSService
+		discovered := map[ClusterTarget]bool{}
+		names := map[string]bool{service: true}
+		tasks := map[string]bool{}
+		for i, target := range r.targets {
+			if errs[i] != nil {
+				slog.Error("Failed to discover service, keeping its previous routes", "service", service, "cluster", target.Cluster, "region", target.Region, "account", target.Account, "error", errs[i])
+				continue
+			}
+			discovered[clusterKey(target)] = true
+			for _, svc := range results[i] {
+				names[svc.Name] = true
+				tasks[svc.TaskArn] = true
+			}
+			details = append(details, results[i]...)
+		}
+		if len(discovered) == 0 {
+			return nil, errors.New("failed to discover the service in any cluster")
+		}
+		stale := func(svc ECSService) bool {
+			target := ClusterTarget{Cluster: svc.Cluster, Region: svc.Region, Account: svc.Account}
+			return discovered[target] && (names[svc.Name] || tasks[svc.TaskArn])
+		}
+		return r.routes.ReplaceWhere(stale, details, trigger), nil
+	})
+	select {
+	case <-ctx.Done():
+		return RouteDiff{}, ctx.Err()
+	case result := <-ch:
+		diff, _ := result.Val.(RouteDiff)
+		return diff, result.Err
+	}
+}
+
+// clusterKey returns the cluster of target without its client, so it can
+// be compared with the cluster of an entry.
+func clusterKey(target ClusterTarget) ClusterTarget {
+	return ClusterTarget{Cluster: target.Cluster, Region: target.Region, Account: target.Account}
+}
+
+// RefreshOnMiss refreshes the route table after a lookup missed, unless it
+// was rebuilt less than the cooldown ago. Unknown org IDs are under the
+// client's control, so this keeps them from forcing constant rediscovery.
+// It returns false if the refresh was suppressed.
+func (r *Refresher) RefreshOnMiss(ctx context.Context) bool {
+	if r.coolingDown() {
+		telemetry.RefreshesSuppressed.Add(1)
+		return false
+	}
+	r.Refresh(ctx, TriggerOnMiss)
+	return true
+}
+
+// RefreshSoon refreshes the route table right away, or once the cooldown is
+// over if it isn't yet, without waiting for it then. Calls during the
+// cooldown share the one deferred refresh, so a burst of events costs at
+// most one discovery per cooldown and none is lost.
+func (r *Refresher) RefreshSoon(ctx context.Context, trigger string) {
+	if !r.coolingDown() {
+		r.Refresh(ctx, trigger)
+		return
+	}
+	telemetry.RefreshesSuppressed.Add(1)
+	if !r.deferred.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.deferred.Store(false)
+			return
+		case <-r.clock.After(r.cooldownLeft()):
+		}
+		// a call from now on may have come after the discovery listed
+		// the tasks, it defers another refresh
+		r.deferred.Store(false)
+		r.Refresh(ctx, trigger)
+	}()
+}
+
+// WarmUp builds the route table for the first time, retrying discovery with
+// backoff until it succeeds, ctx is canceled, or timeout passes. A zero
+// timeout retries indefinitely.
+func (r *Refresher) WarmUp(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		// a background refresh may have got there first
+		if !r.routes.BuiltAt().IsZero() {
+			return nil
+		}
+		slog.Info("Discovering services", "attempt", attempt)
+		start := r.clock.Now()
+		r.lastAttempt.Store(start.UnixNano())
+		if snapshot, ok := r.shared.follow(ctx); ok {
+			r.applyShared(snapshot)
+			return nil
+		}
+		details, err := r.discover(ctx, nil)
+		if err == nil {
+			r.replace(details, TriggerStartup)
+			r.shared.publish(ctx, r.routes.Services(), r.routes.BuiltAt())
+			return nil
+		}
+		r.failures.Add(1)
+		slog.Warn("Discovery failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		case <-r.clock.After(delay):
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// SetSnapshotPath saves the routes and overrides to path after each
+// successful discovery.
+func (r *Refresher) SetSnapshotPath(path string, overrides *RouteOverrides) {
+	r.snapshotPath, r.overrides = path, overrides
+}
+
+// replace publishes freshly discovered routes, saves a snapshot of them and
+// returns what changed.
+func (r *Refresher) replace(details []ECSService, trigger string) RouteDiff {
+	diff := r.routes.Replace(details, trigger)
+	r.failures.Store(0)
+	r.SaveSnapshot()
+	return diff
+}
+
+// SaveSnapshot saves the routes and overrides, if a snapshot path is set.
+// Routes that were never built aren't saved, there is nothing to restore.
+func (r *Refresher) SaveSnapshot() {
+	builtAt := r.routes.BuiltAt()
+	if r.snapshotPath == "" || builtAt.IsZero() {
+		return
+	}
+	// listing may expire an override, which saves the snapshot again
+	overrides := r.overrides.List()
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+	if err := saveSnapshot(r.snapshotPath, r.routes.Services(), builtAt, overrides); err != nil {
+		slog.Error("Failed to save route snapshot", "path", r.snapshotPath, "error", err)
+	}
+}
+
+// Failures returns the number of discoveries that failed since the last one
+// that succeeded.
+func (r *Refresher) Failures() int64 {
+	return r.failures.Load()
+}
+
+// SetJitter spreads background refreshes by up to percent of the interval
+// either way, and delays the first one by a random duration up to
+// initialDelay, so replicas started together drift apart.
+func (r *Refresher) SetJitter(percent int, initialDelay time.Duration) {
+	r.jitterPercent, r.initialDelay = percent, initialDelay
+}
+
+// nextInterval returns interval shifted by a random amount within the jitter.
+func (r *Refresher) nextInterval(interval time.Duration) time.Duration {
+	spread := int64(interval) * int64(r.jitterPercent) / 100
+	if spread <= 0 {
+		return interval
+	}
+	return interval - time.Duration(spread) + time.Duration(r.random(2*spread+1))
+}
+
+// Run refreshes the route table about every interval until ctx is canceled.
+func (r *Refresher) Run(ctx context.Context, interval time.Duration) {
+	delay := r.nextInterval(interval)
+	if r.initialDelay > 0 {
+		delay += time.Duration(r.random(int64(r.initialDelay)))
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.clock.After(delay):
+			r.Refresh(ctx, TriggerScheduled)
+			delay = r.nextInterval(interval)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+// newTestRefresher returns a refresher of the tenants cluster served by
+// fake, its routes discovered, telling the time with clock.
+func newTestRefresher(t *testing.T, fake *discoverytest.ECS, clock *clocktest.Clock, minInterval time.Duration) *Refresher {
+	t.Helper()
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	routes.SetClock(clock)
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, routes, minInterval)
+	refresher.SetClock(clock)
+	if _, err := refresher.Rebuild(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	return refresher
+}
+
+func TestRevalidate(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	refresher := newTestRefresher(t, fake, clock, 10*time.Second)
+	refresher.SetStaleness(time.Minute, 5*time.Minute)
+	discoveries := fake.Count("ListServices")
+
+	// fresh routes are served as they are
+	clock.Advance(59 * time.Second)
+	refresher.Revalidate(context.Background())
+	if state := refresher.State(); state != routesFresh || fake.Count("ListServices") != discoveries {
+		t.Fatalf("fresh routes: state %s, %d discoveries", state, fake.Count("ListServices")-discoveries)
+	}
+
+	// stale ones are too, while a single refresh runs in the background
+	clock.Advance(time.Second)
+	if state := refresher.State(); state != routesStale {
+		t.Fatalf("state %s after the fresh TTL", state)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	fake.Hook = func(op string) {
+		if op == "ListServices" {
+			started <- struct{}{}
+			<-release
+		}
+	}
+	for i := 0; i < 5; i++ {
+		refresher.Revalidate(context.Background())
+	}
+	<-started
+	if refresher.State() != routesStale {
+		t.Error("stale routes rebuilt before the lookup went on")
+	}
+	close(release)
+	refresher.AwaitRefresh(context.Background())
+	fake.Hook = nil
+	if n := fake.Count("ListServices") - discoveries; n != 1 {
+		t.Errorf("%d background refreshes of stale routes, want 1", n)
+	}
+	if state := refresher.State(); state != routesFresh {
+		t.Errorf("state %s after the background refresh", state)
+	}
+
+	// expired ones are rebuilt before the lookup
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	clock.Advance(5 * time.Minute)
+	if state := refresher.State(); state != routesExpired {
+		t.Fatalf("state %s after the max age", state)
+	}
+	refresher.Revalidate(context.Background())
+	if !refresher.routes.HasTask(discoverytest.TaskARN("tenants", "a2")) {
+		t.Error("expired routes served without rebuilding them")
+	}
+	if state := refresher.State(); state != routesFresh {
+		t.Errorf("state %s after rebuilding expired routes", state)
+	}
+}
+
+func TestRevalidateFailing(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	refresher := newTestRefresher(t, fake, clock, 10*time.Second)
+	refresher.SetStaleness(time.Minute, 5*time.Minute)
+	discoveries := fake.Count("ListServices")
+
+	// a failing ECS is asked once per cooldown, not once per lookup
+	clock.Advance(5 * time.Minute)
+	fake.FailNext("ListServices", discoverytest.AccessDenied())
+	for i := 0; i < 10; i++ {
+		refresher.Revalidate(context.Background())
+	}
+	if n := fake.Count("ListServices") - discoveries; n != 1 {
+		t.Errorf("%d refreshes of expired routes with ECS failing, want 1", n)
+	}
+	if _, err := refresher.routes.Lookup("acme"); err != nil {
+		t.Errorf("expired routes not served when they can't be rebuilt: %v", err)
+	}
+}
+
+func TestFakeClockIntervalsAndTTLs(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	clock := clocktest.New()
+	refresher := newTestRefresher(t, fake, clock, 0)
+	routes := refresher.routes
+	overrides := NewRouteOverrides([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	overrides.SetClock(clock)
+	start := time.Now()
+
+	// the background refresh waits for the clock, not the wall clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	discoveries := fake.Count("ListServices")
+	go refresher.Run(ctx, time.Hour)
+	clock.WaitForTimers(t, 1)
+	clock.Advance(time.Hour - time.Second)
+	if n := fake.Count("ListServices") - discoveries; n != 0 {
+		t.Errorf("%d refreshes before the interval passed", n)
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "the refresh of the interval", func() bool { return fake.Count("ListServices") > discoveries })
+
+	// and the drains and overrides expire by it
+	if _, err := routes.Drain("10.0.0.1", time.Minute, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := overrides.Set("acme", "10.0.9.9:8080", time.Minute, "test"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(59 * time.Second)
+	if !routes.Drained.Drained("10.0.0.1") {
+		t.Error("drain of a minute expired after 59s")
+	}
+	if _, ok := overrides.Lookup("acme"); !ok {
+		t.Error("override of a minute expired after 59s")
+	}
+	clock.Advance(time.Second)
+	if routes.Drained.Drained("10.0.0.1") {
+		t.Error("drain of a minute still in effect after a minute")
+	}
+	if _, ok := overrides.Lookup("acme"); ok {
+		t.Error("override of a minute still in effect after a minute")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("an hour of fake time took %v", elapsed)
+	}
+}
+
+func TestRun(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	refresher := newTestRefresher(t, fake, clock, 0)
+	discoveries := fake.Count("ListServices")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		refresher.Run(ctx, 30*time.Second)
+		close(done)
+	}()
+
+	// a refresh per interval, each picking up the replaced tasks
+	for i, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", fmt.Sprintf("a%d", i+1)))
+		fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", fmt.Sprintf("a%d", i+2), ip))
+		clock.WaitForTimers(t, 1)
+		clock.Advance(30 * time.Second)
+		waitFor(t, "the refresh of interval "+fmt.Sprint(i+1), func() bool {
+			svc, err := refresher.routes.Lookup("acme")
+			return err == nil && svc.IP == ip
+		})
+		if n := fake.Count("ListServices") - discoveries; n != i+1 {
+			t.Errorf("%d refreshes after %d intervals", n, i+1)
+		}
+	}
+
+	// and none once canceled
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return once its context was canceled")
+	}
+	clock.Advance(time.Hour)
+	if n := fake.Count("ListServices") - discoveries; n != 3 {
+		t.Errorf("%d refreshes after the cancellation, want 3", n)
+	}
+}
+
+func TestRefreshJitter(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	refresher := newTestRefresher(t, fake, clock, 0)
+	refresher.random = rand.New(rand.NewSource(1)).Int63n
+	refresher.SetJitter(20, 10*time.Second)
+
+	// the intervals spread over ±20% of 30s
+	shortest, longest := time.Duration(math.MaxInt64), time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		interval := refresher.nextInterval(30 * time.Second)
+		if interval < 24*time.Second || interval > 36*time.Second {
+			t.Fatalf("interval %v outside [24s, 36s]", interval)
+		}
+		shortest, longest = min(shortest, interval), max(longest, interval)
+	}
+	if shortest > 25*time.Second || longest < 35*time.Second {
+		t.Errorf("intervals within [%v, %v], want them spread over [24s, 36s]", shortest, longest)
+	}
+
+	// and the first refresh is delayed by up to 10s more
+	discoveries := fake.Count("ListServices")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go refresher.Run(ctx, 30*time.Second)
+	clock.WaitForTimers(t, 1)
+	clock.Advance(24*time.Second - time.Nanosecond)
+	if fake.Count("ListServices") != discoveries {
+		t.Error("refreshed before the shortest interval")
+	}
+	clock.Advance(22 * time.Second)
+	waitFor(t, "the first refresh within 46s", func() bool { return fake.Count("ListServices") > discoveries })
+}
+
+func TestWarmUp(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	clock := clocktest.New()
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	routes.SetClock(clock)
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, routes, 0)
+	refresher.SetClock(clock)
+
+	// ECS fails twice, and the warm-up only returns, letting the listener
+	// open, once it answers
+	fake.FailNext("ListServices", discoverytest.AccessDenied(), discoverytest.AccessDenied())
+	done := make(chan error, 1)
+	go func() { done <- refresher.WarmUp(context.Background(), 0) }()
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		clock.WaitForTimers(t, 1)
+		select {
+		case err := <-done:
+			t.Fatalf("warm-up returned %v after %d failed attempts", err, i+1)
+		default:
+		}
+		if n := refresher.Failures(); n != int64(i+1) {
+			t.Errorf("%d failures after %d failed attempts", n, i+1)
+		}
+		// the retries back off
+		clock.Advance(delay - time.Nanosecond)
+		if n := fake.Count("ListServices"); n != i+1 {
+			t.Fatalf("%d attempts before the delay of %v passed", n, delay)
+		}
+		clock.Advance(time.Nanosecond)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("warm-up didn't return once ECS answered")
+	}
+	if n := fake.Count("ListServices"); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+	if _, err := routes.Lookup("acme"); err != nil || refresher.Failures() != 0 {
+		t.Errorf("after the warm-up: lookup %v, %d failures", err, refresher.Failures())
+	}
+
+	// a warm-up that never succeeds gives up when told to
+	failing := discoverytest.NewECS()
+	failing.FailNext("ListServices", discoverytest.AccessDenied(), discoverytest.AccessDenied())
+	refresher = NewRefresher([]ClusterTarget{testTarget(failing, "tenants")}, Options{DefaultPort: 8080}, NewRouteTable(nil, nil, config.LBStrategyRoundRobin), 0)
+	refresher.SetClock(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- refresher.WarmUp(ctx, 0) }()
+	clock.WaitForTimers(t, 1)
+	cancel()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "gave up after 1 attempts") {
+		t.Errorf("canceled warm-up = %v", err)
+	}
+}
+
+// tenantsCluster returns a fake with tasks tasks in the tenants cluster,
+// perService tasks per service.
+func tenantsCluster(tasks, perService int) *discoverytest.ECS {
+	fake := discoverytest.NewECS()
+	for i := 0; i < tasks; i++ {
+		service := fmt.Sprintf("org%d", i/perService)
+		if i%perService == 0 {
+			fake.AddService("tenants", service)
+		}
+		fake.AddTasks("tenants", discoverytest.Task("tenants", service, fmt.Sprint(i), fmt.Sprintf("10.%d.%d.%d", i/65536, i/256%256, i%256)))
+	}
+	return fake
+}
+
+// BenchmarkRefresh rebuilds the routes of a cluster of N tasks into an empty
+// table, reporting the time and allocations of a refresh.
+func BenchmarkRefresh(b *testing.B) {
+	for _, tasks := range []int{500, 2000, 5000} {
+		b.Run(fmt.Sprintf("N=%d", tasks), func(b *testing.B) {
+			fake := tenantsCluster(tasks, 10)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+				refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080, Concurrency: 5}, routes, 0)
+				diff, err := refresher.Rebuild(context.Background(), TriggerStartup)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(diff.Added) != tasks {
+					b.Fatalf("added %d routes, want %d", len(diff.Added), tasks)
+				}
+			}
+		})
+	}
+}
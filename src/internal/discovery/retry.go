@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// RetryPolicy bounds how ECS API calls are retried.
+type RetryPolicy struct {
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry. It doubles with
+	// every attempt up to MaxDelay and is jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Budget is the total time spent on a call including retries.
+	Budget time.Duration
+	// Timeout bounds each attempt, so a hung call is abandoned and retried.
+	// Zero leaves attempts to the caller's context and Budget.
+	Timeout time.Duration
+}
+
+// ECSRetryPolicy retries the ECS API calls made outside the SDK's own
+// retryer. Tests shorten its delays.
+var ECSRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	Budget:      30 * time.Second,
+	Timeout:     10 * time.Second,
+}
+
+// RetryError is returned when an ECS API call failed after exhausting its
+// attempts or time budget.
+type RetryError struct {
+	Op       string
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempts: %v", e.Op, e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	throttles  = retry.IsErrorThrottles(retry.DefaultThrottles)
+	retryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+)
+
+// IsThrottle reports whether err is ECS rejecting a call for exceeding its
+// request rate.
+func IsThrottle(err error) bool {
+	return throttles.IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// isRetryable reports whether err is a throttle, a 5xx, or a connection
+// error. Errors such as access denied or invalid parameters are final.
+func isRetryable(err error) bool {
+	return IsThrottle(err) || retryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// call calls fn until it succeeds, fails with an error that isn't
+// retryable, or the policy's attempts or budget run out. An attempt running
+// past the policy's Timeout is abandoned and retried like a connection
+// error. The ECS clients don't retry on their own so attempts aren't
+// multiplied.
+func (p RetryPolicy) call(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	deadline := time.Now().Add(p.Budget)
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		timedOut, err := p.attempt(ctx, fn)
+		if err == nil {
+			return nil
+		}
+		if IsThrottle(err) {
+			telemetry.ECSThrottles.Add(1)
+		}
+		if timedOut {
+			telemetry.ECSTimeouts.WithLabelValues(op).Inc()
+			err = fmt.Errorf("timed out after %v: %w", p.Timeout, err)
+		} else if !isRetryable(err) {
+			return err
+		}
+		// full jitter spreads the retries of concurrent callers
+		wait := time.Duration(rand.Int63n(int64(delay) + 1))
+		if attempt >= p.MaxAttempts || time.Now().Add(wait).After(deadline) {
+			return &RetryError{Op: op, Attempts: attempt, Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			return &RetryError{Op: op, Attempts: attempt, Err: err}
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, p.MaxDelay)
+	}
+}
+
+// attempt calls fn once within the policy's Timeout, and reports whether it
+// ran out of it while ctx is still live.
+func (p RetryPolicy) attempt(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	if p.Timeout <= 0 {
+		return false, fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	err := fn(attemptCtx)
+	return err != nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil, err
+}
@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// scripted returns a call failing with errs in order, then succeeding, and
+// the number of attempts made.
+func scripted(errs ...error) (func(context.Context) error, *int) {
+	attempts := 0
+	return func(context.Context) error {
+		attempts++
+		if attempts <= len(errs) {
+			return errs[attempts-1]
+		}
+		return nil
+	}, &attempts
+}
+
+// statusError is an error of an HTTP response with its status code.
+type statusError int
+
+func (e statusError) Error() string       { return "status " + http.StatusText(int(e)) }
+func (e statusError) HTTPStatusCode() int { return int(e) }
+
+func TestRetryPolicyCall(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, Budget: time.Second}
+
+	throttledCalls := telemetry.ECSThrottles.Value()
+	fn, attempts := scripted(discoverytest.Throttled(), discoverytest.Throttled())
+	if err := policy.call(context.Background(), "ListTasks", fn); err != nil {
+		t.Fatalf("throttled twice: %v", err)
+	}
+	if *attempts != 3 {
+		t.Errorf("%d attempts, want 3", *attempts)
+	}
+	if n := telemetry.ECSThrottles.Value() - throttledCalls; n != 2 {
+		t.Errorf("%d throttles counted, want 2", n)
+	}
+
+	fn, attempts = scripted(statusError(http.StatusServiceUnavailable))
+	if err := policy.call(context.Background(), "ListTasks", fn); err != nil || *attempts != 2 {
+		t.Errorf("5xx: %v after %d attempts, want a retry", err, *attempts)
+	}
+
+	denied := discoverytest.AccessDenied()
+	fn, attempts = scripted(denied, denied)
+	err := policy.call(context.Background(), "ListTasks", fn)
+	var retryErr *RetryError
+	if !errors.Is(err, denied) || errors.As(err, &retryErr) || *attempts != 1 {
+		t.Errorf("access denied: %v after %d attempts, want it right away", err, *attempts)
+	}
+}
+
+func TestRetryPolicyExhausted(t *testing.T) {
+	always := func(context.Context) error { return discoverytest.Throttled() }
+
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Budget: time.Minute}
+	err := policy.call(context.Background(), "DescribeTasks", always)
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("err = %v, want a *RetryError", err)
+	}
+	if retryErr.Op != "DescribeTasks" || retryErr.Attempts != 4 || !IsThrottle(retryErr.Err) {
+		t.Errorf("RetryError %+v, want 4 throttled attempts of DescribeTasks", retryErr)
+	}
+
+	// the budget ends the retries before the attempts run out
+	policy = RetryPolicy{MaxAttempts: 1000, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond, Budget: 100 * time.Millisecond}
+	start := time.Now()
+	err = policy.call(context.Background(), "DescribeTasks", always)
+	if elapsed := time.Since(start); elapsed > policy.Budget+50*time.Millisecond {
+		t.Errorf("retried for %s with a budget of %s", elapsed, policy.Budget)
+	}
+	if !errors.As(err, &retryErr) || retryErr.Attempts >= 1000 {
+		t.Errorf("err = %v, want a *RetryError before the attempts ran out", err)
+	}
+
+	// so does the caller going away
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	policy.Budget = time.Minute
+	if err := policy.call(ctx, "DescribeTasks", always); !errors.As(err, &retryErr) {
+		t.Errorf("err = %v, want a *RetryError", err)
+	}
+}
+
+func TestRetryPolicyTimeout(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Budget: time.Second, Timeout: 10 * time.Millisecond}
+	attempts := 0
+	err := policy.call(context.Background(), "ListServices", func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			// the first attempt hangs
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("hung attempt: %v after %d attempts, want it retried", err, attempts)
+	}
+}
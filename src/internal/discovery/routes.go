@@ -0,0 +1,648 @@
+package discovery
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// RouteTable holds the discovered services. It is safe for concurrent use by
+// the request handler, the refresher, and the task state change consumer.
+type RouteTable struct {
+	mu sync.RWMutex
+	// services is never modified in place, changes build a new slice.
+	services []ECSService
+	// index maps a container name to its entries. It is rebuilt together
+	// with services.
+	index map[string][]ECSService
+	// tasks maps a task ARN to the entries of its containers. It is
+	// rebuilt together with services.
+	tasks map[string][]ECSService
+	// known holds every container name that had entries since startup, so
+	// a service that lost all of its tasks is told apart from an unknown
+	// org.
+	known map[string]bool
+	// versions records the detail version of the last task state change
+	// applied per task ARN so duplicate and out of order events are ignored.
+	// It outlives full rebuilds for the tasks still routed or stopped.
+	versions map[string]int64
+	// stopped records when events removed a task, by task ARN, so a
+	// discovery that listed the task before it stopped doesn't bring it
+	// back. Tombstones are dropped after taskTombstoneTTL.
+	stopped map[string]time.Time
+	// builtAt is when the services were last replaced by a full discovery.
+	builtAt time.Time
+	// seen records when a task was last updated since then, by an event or
+	// the discovery of its service, by task ARN.
+	seen map[string]time.Time
+	// negative remembers org IDs that matched nothing after a refresh.
+	negative *NegativeCache
+	// balancer spreads requests over the backends of a service.
+	balancer balancer
+	// conns counts the requests in flight per backend.
+	conns *connTracker
+	// onRemove is called with the addresses removed from the table.
+	onRemove func(addresses []string)
+	// health holds the results of active health checks.
+	health *healthState
+	// ejector takes backends that keep failing out of rotation.
+	ejector *ejector
+	// Breakers fail requests fast to backends that keep failing.
+	Breakers *CircuitBreakers
+	// Outliers takes backends much slower than their peers out of
+	// rotation.
+	Outliers *LatencyOutliers
+	// Drained holds the backend IPs an operator took out of rotation.
+	Drained *drainedBackends
+	// onChange is called after the services changed.
+	onChange func()
+	// audit records the route changes, under the table's name.
+	audit     *AuditLog
+	auditName string
+	// clock dates the builds and the sightings of tasks.
+	clock clock.Clock
+	// zone is the availability zone whose backends are preferred, empty
+	// for none.
+	zone string
+	// ecsHealth takes the backends ECS reports unhealthy out of rotation.
+	ecsHealth ecsHealth
+	// serviceTasks holds the task counts of the ECS services, if discovery
+	// records them.
+	serviceTasks []ServiceTasks
+	// ambiguity resolves org IDs several services contain. watched are the
+	// orgs checked for it after every refresh, and ambiguousOrgs those the
+	// last one found, by org.
+	ambiguity     ambiguityPolicy
+	watched       map[string]bool
+	ambiguousOrgs map[string]ambiguousOrg
+	// containers are the target containers of the orgs routed to another
+	// container of the tasks they match, by org.
+	containers map[string]string
+	// serviceRoles are the blue/green roles of the tagged ECS services, if
+	// discovery reads them, and roles the same by service.
+	serviceRoles []serviceRole
+	roles        map[serviceRoleKey]serviceRole
+	// random returns a number in [0, 1) to pick a live service by, and is
+	// replaceable for tests.
+	random func() float64
+}
+
+// taskTombstoneTTL is how long a task stopped by an event is kept out of
+// the table, longer than any discovery takes.
+const taskTombstoneTTL = time.Hour
+
+// NewRouteTable returns a route table holding services that picks backends
+// with the given LBStrategy. services is nil if discovery failed. negative may be nil to disable negative
+// caching.
+func NewRouteTable(services []ECSService, negative *NegativeCache, strategy string) *RouteTable {
+	conns := &connTracker{}
+	t := &RouteTable{
+		services: services,
+		index:    buildIndex(services),
+		tasks:    buildTaskIndex(services),
+		known:    map[string]bool{},
+		versions: map[string]int64{},
+		stopped:  map[string]time.Time{},
+		seen:     map[string]time.Time{},
+		watched:  map[string]bool{},
+		negative: negative,
+		balancer: newBalancer(strategy, conns),
+		conns:    conns,
+		health:   newHealthState(),
+		clock:    clock.System{},
+		random:   rand.Float64,
+	}
+	t.Drained = newDrainedBackends(t.clock)
+	for name := range t.index {
+		t.known[name] = true
+	}
+	// a nil table comes from a failed discovery and was never built
+	if services != nil {
+		t.builtAt = t.clock.Now()
+	}
+	return t
+}
+
+// buildIndex groups services by container name, keeping discovery order.
+func buildIndex(services []ECSService) map[string][]ECSService {
+	index := make(map[string][]ECSService, len(services))
+	for _, svc := range services {
+		index[svc.Name] = append(index[svc.Name], svc)
+	}
+	return index
+}
+
+var (
+	// ErrServiceNotFound means no service matches the org ID.
+	ErrServiceNotFound = errors.New("service not found")
+	// ErrNoRunningTasks means the org ID matches a service that had tasks
+	// before but has none now, e.g. because it is scaled to zero.
+	ErrNoRunningTasks = errors.New("no running tasks")
+	// ErrNoHealthyBackend means a service matches the org ID but none of
+	// its backends passed its health check.
+	ErrNoHealthyBackend = errors.New("no healthy backend")
+)
+
+// Lookup returns a healthy backend of the service named orgID or, failing
+// that, of the service whose name contains orgID, picked by the ambiguity
+// policy when several do, or the org's target container in its tasks.
+// When the ECS services of those are tagged with roles, one of the live ones
+// is picked by weight instead. Consecutive lookups rotate through the
+// backends of the service.
+func (t *RouteTable) Lookup(orgID string) (ECSService, error) {
+	t.mu.RLock()
+	name, candidates := t.match(orgID)
+	matched := t.index[name]
+	live, roles := t.blueGreen(name, candidates)
+	tagged := len(roles) > 0
+	if tagged {
+		matched = pickLive(live, t.random)
+	}
+	backends := t.inContainer(orgID, matched)
+	known := name == "" && len(candidates) == 0 && t.knownName(orgID)
+	t.mu.RUnlock()
+	// the roles pick among the services an org matches, it isn't ambiguous
+	if len(candidates) > 0 && !tagged {
+		t.ambiguous(orgID, name, candidates)
+	}
+	// rejected orgs too, so the next refresh reports them
+	if name != orgID && (name != "" || len(candidates) > 0) {
+		t.watch(orgID)
+	}
+	if known {
+		return ECSService{}, ErrNoRunningTasks
+	}
+	if name == "" && len(candidates) > 0 && !tagged {
+		return ECSService{}, ErrAmbiguousOrg
+	}
+	if tagged && len(matched) == 0 {
+		// every service the org matches is on standby
+		return ECSService{}, ErrNoHealthyBackend
+	}
+	if len(matched) > 0 && len(backends) == 0 {
+		return ECSService{}, ErrNoTargetContainer
+	}
+	if len(backends) == 0 {
+		return ECSService{}, ErrServiceNotFound
+	}
+	healthy := backends
+	for i, backend := range backends {
+		if t.available(backend) {
+			continue
+		}
+		// copy the healthy ones only once one turns out not to be
+		healthy = append([]ECSService{}, backends[:i]...)
+		for _, backend := range backends[i+1:] {
+			if t.available(backend) {
+				healthy = append(healthy, backend)
+			}
+		}
+		break
+	}
+	if len(healthy) == 0 {
+		return ECSService{}, ErrNoHealthyBackend
+	}
+	healthy = t.Outliers.Filter(healthy)
+	healthy = preferZone(healthy, t.zone)
+	backend := t.balancer.Select(healthy)
+	telemetry.BackendSelections.Add(backend.Address(), 1)
+	return backend, nil
+}
+
+// available reports whether backend passed its health checks, ECS's and the
+// proxy's, and is neither ejected nor behind an open circuit breaker.
+func (t *RouteTable) available(backend ECSService) bool {
+	address := backend.Address()
+	return t.ecsHealth.allows(backend) && t.health.Healthy(address) && !t.ejector.Ejected(address) && !t.Breakers.Open(address) &&
+		!t.Drained.Drained(backend.IP)
+}
+
+// ReportFailure records that forwarding a request to address failed.
+func (t *RouteTable) ReportFailure(address string) {
+	t.ejector.Failure(address)
+}
+
+// SetEjection ejects backends after threshold forwarding failures within
+// window for cooldown. It must be called before the table is shared.
+func (t *RouteTable) SetEjection(threshold int, window, cooldown time.Duration) {
+	t.ejector = newEjector(threshold, window, cooldown, t.clock)
+}
+
+// SetBreakers opens a backend's circuit breaker after threshold consecutive
+// failures for openTimeout. It must be called before the table is shared.
+func (t *RouteTable) SetBreakers(threshold int, openTimeout time.Duration) {
+	t.Breakers = newCircuitBreakers(threshold, openTimeout, t.clock)
+}
+
+// SetOutliers ejects backends whose latency exceeds multiplier times the
+// median of their service for ejectFor. It must be called before the table
+// is shared.
+func (t *RouteTable) SetOutliers(multiplier float64, minSamples int, ejectFor time.Duration) {
+	t.Outliers = newLatencyOutliers(multiplier, minSamples, ejectFor, t.clock)
+}
+
+// SetECSHealth takes the backends ECS reports UNHEALTHY out of rotation
+// when enabled, and those it reports UNKNOWN too unless includeUnknown. It
+// must be called before the table is shared.
+func (t *RouteTable) SetECSHealth(enabled, includeUnknown bool) {
+	t.ecsHealth = ecsHealth{enabled: enabled, includeUnknown: includeUnknown}
+}
+
+// SetZone prefers the backends in zone, those of other availability zones
+// only taking requests when none of them can. It must be called before the
+// table is shared.
+func (t *RouteTable) SetZone(zone string) {
+	t.zone = zone
+}
+
+// Addresses returns the distinct backend addresses in the table.
+func (t *RouteTable) Addresses() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	seen := make(map[string]bool, len(t.services))
+	var addresses []string
+	for _, svc := range t.services {
+		if address := svc.Address(); !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// SetHealthChecked makes backends that weren't health checked yet count as
+// unhealthy, and calls changed whenever the table changes so new backends
+// can be checked. It must be called before the table is shared.
+func (t *RouteTable) SetHealthChecked(changed func()) {
+	t.health.uncheckedHealthy = false
+	t.onChange = changed
+}
+
+// SetAudit records every route change of the table to audit under name. It
+// must be called before the table is shared.
+func (t *RouteTable) SetAudit(audit *AuditLog, name string) {
+	t.audit, t.auditName = audit, name
+}
+
+// SetClock makes the table, its negative cache and the breakers, ejections
+// and drains of its backends tell the time with clock. It must be called
+// before the table is shared.
+func (t *RouteTable) SetClock(clock clock.Clock) {
+	t.clock = clock
+	if t.negative != nil {
+		t.negative.clock = clock
+	}
+	if t.ejector != nil {
+		t.ejector.clock = clock
+	}
+	if t.Breakers != nil {
+		t.Breakers.clock = clock
+	}
+	if t.Outliers != nil {
+		t.Outliers.clock = clock
+	}
+	t.Drained.clock = clock
+}
+
+// Track records a request in flight to backend until the returned function
+// is called.
+func (t *RouteTable) Track(backend ECSService) (release func()) {
+	return t.conns.Acquire(backend.Address())
+}
+
+// ServiceBackends returns the backends of the service backend, a backend of
+// orgID, belongs to, healthy or not, in its cluster. Those of an org with a
+// target container are that container in the tasks of its service.
+func (t *RouteTable) ServiceBackends(orgID string, backend ECSService) []ECSService {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	candidates := t.index[backend.Name]
+	if t.containers[config.NormalizeOrg(orgID)] != "" {
+		candidates = t.lookup(orgID)
+	}
+	var backends []ECSService
+	for _, svc := range candidates {
+		if svc.Cluster == backend.Cluster {
+			backends = append(backends, svc)
+		}
+	}
+	return backends
+}
+
+// lookup returns all backends of the service matching orgID, in its target
+// container if it has one, none if it is ambiguous and the policy rejects
+// it. The caller must hold t.mu.
+func (t *RouteTable) lookup(orgID string) []ECSService {
+	name, _ := t.match(orgID)
+	return t.inContainer(orgID, t.index[name])
+}
+
+// knownName reports whether orgID matches a service that had entries before,
+// by the same rules as lookup. The caller must hold t.mu.
+func (t *RouteTable) knownName(orgID string) bool {
+	if t.known[orgID] {
+		return true
+	}
+	for name := range t.known {
+		if strings.Contains(name, orgID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether orgID matches a service, by the same rules as
+// Lookup, whether or not it has tasks. An ambiguous org matches.
+func (t *RouteTable) Matches(orgID string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	name, candidates := t.match(orgID)
+	return name != "" || len(candidates) > 0 || t.knownName(orgID)
+}
+
+// KnownMissing reports whether orgID recently matched no service even after
+// a refresh.
+func (t *RouteTable) KnownMissing(orgID string) bool {
+	return t.negative.Contains(orgID)
+}
+
+// RememberMissing records that orgID matched no service after a refresh.
+func (t *RouteTable) RememberMissing(orgID string) {
+	t.negative.Add(orgID)
+}
+
+// invalidateMissing forgets remembered org IDs that now match a service. The
+// caller must hold t.mu.
+func (t *RouteTable) invalidateMissing() {
+	t.negative.Invalidate(func(orgID string) bool {
+		return len(t.lookup(orgID)) > 0
+	})
+}
+
+// Services returns the current services. The returned slice must not be
+// modified.
+func (t *RouteTable) Services() []ECSService {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.services
+}
+
+// Replace replaces all services after a full discovery and audits what
+// changed since the previous one, attributing it to trigger. If nothing did
+// the table is kept as it is, only its build time is updated. It returns
+// what changed.
+func (t *RouteTable) Replace(services []ECSService, trigger string) RouteDiff {
+	return t.ReplaceBuilt(services, t.clock.Now(), trigger)
+}
+
+// ReplaceBuilt is Replace with services discovered at builtAt, such as by
+// another replica.
+func (t *RouteTable) ReplaceBuilt(services []ECSService, builtAt time.Time, trigger string) RouteDiff {
+	t.mu.Lock()
+	services = t.withoutStopped(services)
+	diff := diffRoutes(t.services, services)
+	if diff.Empty() {
+		// the addresses are the same, not necessarily what ECS reports of
+		// them, such as their health status
+		if !slices.Equal(t.services, services) {
+			t.setServices(services)
+		}
+		t.builtAt = builtAt
+		t.seen = map[string]time.Time{}
+		t.forgetTasks()
+		// orgs watched since the last refresh are checked all the same
+		t.detectAmbiguity()
+		t.mu.Unlock()
+		return diff
+	}
+	// the first build adds everything, which isn't worth counting
+	if !t.builtAt.IsZero() {
+		diff.count()
+	}
+	removed := t.setServices(services)
+	t.forgetTasks()
+	t.builtAt = builtAt
+	t.seen = map[string]time.Time{}
+	t.balancer.Prune(t.index)
+	t.invalidateMissing()
+	t.detectAmbiguity()
+	t.mu.Unlock()
+	t.audit.Record(t.auditName, trigger, diff)
+	t.drain(removed)
+	return diff
+}
+
+// ReplaceWhere replaces the entries stale reports with services after the
+// discovery of part of the routes, and audits and returns what changed. The
+// build time is kept, it is that of the last full discovery.
+func (t *RouteTable) ReplaceWhere(stale func(ECSService) bool, services []ECSService, trigger string) RouteDiff {
+	t.mu.Lock()
+	services = t.withoutStopped(services)
+	updated := make([]ECSService, 0, len(t.services)+len(services))
+	var previous []ECSService
+	for _, svc := range t.services {
+		if stale(svc) {
+			previous = append(previous, svc)
+		} else {
+			updated = append(updated, svc)
+		}
+	}
+	now := t.clock.Now()
+	for _, svc := range services {
+		t.seen[svc.TaskArn] = now
+	}
+	diff := diffRoutes(previous, services)
+	if diff.Empty() {
+		if !slices.Equal(previous, services) {
+			t.setServices(append(updated, services...))
+		}
+		t.mu.Unlock()
+		return diff
+	}
+	diff.count()
+	removed := t.setServices(append(updated, services...))
+	t.balancer.Prune(t.index)
+	t.invalidateMissing()
+	t.detectAmbiguity()
+	t.mu.Unlock()
+	t.audit.Record(t.auditName, trigger, diff)
+	t.drain(removed)
+	return diff
+}
+
+// Restore fills a table that was never built with routes built at builtAt,
+// such as a snapshot from a previous run.
+func (t *RouteTable) Restore(services []ECSService, builtAt time.Time) {
+	t.mu.Lock()
+	diff := diffRoutes(t.services, services)
+	t.setServices(services)
+	t.builtAt = builtAt
+	t.seen = map[string]time.Time{}
+	t.invalidateMissing()
+	t.detectAmbiguity()
+	t.mu.Unlock()
+	t.audit.Record(t.auditName, TriggerSnapshot, diff)
+}
+
+// lastSeen returns when the task of svc was last updated, by a full
+// discovery or since. The caller must hold t.mu.
+func (t *RouteTable) lastSeen(svc ECSService) time.Time {
+	if seen, ok := t.seen[svc.TaskArn]; ok && seen.After(t.builtAt) {
+		return seen
+	}
+	return t.builtAt
+}
+
+// BuiltAt returns when the table was last rebuilt by a full discovery, or
+// the zero time if it never was.
+func (t *RouteTable) BuiltAt() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.builtAt
+}
+
+// ReplaceTask replaces the entries of a task with services, or removes them
+// when services is empty, for good since a stopped task doesn't start
+// again. It returns false if the change was already applied or changed
+// nothing.
+func (t *RouteTable) ReplaceTask(taskArn string, version int64, services []ECSService) bool {
+	t.mu.Lock()
+	if last, ok := t.versions[taskArn]; ok && version <= last {
+		t.mu.Unlock()
+		return false
+	}
+	t.versions[taskArn] = version
+	now := t.clock.Now()
+	if len(services) > 0 {
+		t.seen[taskArn] = now
+	} else {
+		delete(t.seen, taskArn)
+		t.stopped[taskArn] = now
+	}
+
+	updated := make([]ECSService, 0, len(t.services)+len(services))
+	var previous []ECSService
+	for _, svc := range t.services {
+		if svc.TaskArn != taskArn {
+			updated = append(updated, svc)
+		} else {
+			previous = append(previous, svc)
+		}
+	}
+	diff := diffRoutes(previous, services)
+	if diff.Empty() && slices.Equal(previous, services) {
+		t.mu.Unlock()
+		return false
+	}
+	removed := t.setServices(append(updated, services...))
+	t.balancer.Prune(t.index)
+	if len(services) > 0 {
+		t.invalidateMissing()
+	}
+	t.detectAmbiguity()
+	t.mu.Unlock()
+	// only the health of the entries changed otherwise
+	if !diff.Empty() {
+		t.audit.Record(t.auditName, TriggerEvent, diff)
+	}
+	t.drain(removed)
+	return true
+}
+
+// withoutStopped returns services without the entries of the tasks events
+// reported stopped. The caller must hold t.mu.
+func (t *RouteTable) withoutStopped(services []ECSService) []ECSService {
+	if len(t.stopped) == 0 {
+		return services
+	}
+	now := t.clock.Now()
+	kept := make([]ECSService, 0, len(services))
+	for _, svc := range services {
+		if stopped, ok := t.stopped[svc.TaskArn]; !ok || now.Sub(stopped) >= taskTombstoneTTL {
+			kept = append(kept, svc)
+		}
+	}
+	return kept
+}
+
+// forgetTasks drops the expired tombstones, and the event versions of the
+// tasks that are neither routed nor tombstoned, after a full rebuild. The
+// caller must hold t.mu.
+func (t *RouteTable) forgetTasks() {
+	now := t.clock.Now()
+	for taskArn, stopped := range t.stopped {
+		if now.Sub(stopped) >= taskTombstoneTTL {
+			delete(t.stopped, taskArn)
+		}
+	}
+	for taskArn := range t.versions {
+		_, routed := t.tasks[taskArn]
+		_, stopped := t.stopped[taskArn]
+		if !routed && !stopped {
+			delete(t.versions, taskArn)
+		}
+	}
+}
+
+// OnRemove registers fn to be called with the addresses of backends that
+// are no longer in the table after it changed. It must be called before the
+// table is shared.
+func (t *RouteTable) OnRemove(fn func(addresses []string)) {
+	t.onRemove = fn
+}
+
+// setServices replaces the services and their index and returns the
+// addresses that are no longer routed to. The caller must hold t.mu.
+func (t *RouteTable) setServices(services []ECSService) (removed []string) {
+	current := make(map[string]bool, len(services))
+	for _, svc := range services {
+		current[svc.Address()] = true
+	}
+	for _, svc := range t.services {
+		if address := svc.Address(); !current[address] {
+			current[address] = true
+			removed = append(removed, address)
+		}
+	}
+	t.services = services
+	t.index = buildIndex(services)
+	t.tasks = buildTaskIndex(services)
+	for name := range t.index {
+		t.known[name] = true
+	}
+	return removed
+}
+
+// drain runs the hooks for a change of the services that removed
+// addresses. The caller must not hold t.mu.
+func (t *RouteTable) drain(addresses []string) {
+	if t.onRemove != nil && len(addresses) > 0 {
+		t.onRemove(addresses)
+	}
+	t.ejector.Forget(addresses)
+	t.Breakers.Forget(addresses)
+	t.Outliers.Forget(addresses)
+	t.Drained.Retain(t.Services())
+	if t.onChange != nil {
+		t.onChange()
+	}
+}
+
+// HasTask reports whether the task has any entries.
+func (t *RouteTable) HasTask(taskArn string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, svc := range t.services {
+		if svc.TaskArn == taskArn {
+			return true
+		}
+	}
+	return false
+}
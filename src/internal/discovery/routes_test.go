@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+// testServices returns n services named org0 to org<n-1>, each with tasks
+// tasks in the tenants cluster.
+func testServices(n, tasks int) []ECSService {
+	services := make([]ECSService, 0, n*tasks)
+	for i := 0; i < n; i++ {
+		for j := 0; j < tasks; j++ {
+			services = append(services, ECSService{
+				Name:    fmt.Sprintf("org%d", i),
+				IP:      fmt.Sprintf("10.%d.%d.%d", i/250, i%250, j+1),
+				Port:    8080,
+				TaskArn: discoverytest.TaskARN("tenants", fmt.Sprintf("%d-%d", i, j)),
+				Cluster: "tenants",
+				Region:  discoverytest.Region,
+			})
+		}
+	}
+	return services
+}
+
+func TestRouteTableConcurrentReplace(t *testing.T) {
+	small, large := testServices(5, 1), testServices(50, 3)
+	routes := NewRouteTable(small, nil, config.LBStrategyRoundRobin)
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			next := small
+			if i%2 == 0 {
+				next = large
+			}
+			routes.Replace(next, TriggerScheduled)
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		for i := int64(1); ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			svc := ECSService{Name: "org1", IP: "10.9.9.9", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "event")}
+			routes.ReplaceTask(svc.TaskArn, i, []ECSService{svc})
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for j := 0; j < 2000; j++ {
+				// org0 to org4 are in both tables
+				svc, err := routes.Lookup(fmt.Sprintf("org%d", j%5))
+				if err != nil {
+					t.Errorf("Lookup: %v", err)
+					return
+				}
+				if svc.Port != 8080 {
+					t.Errorf("Lookup returned %+v", svc)
+					return
+				}
+				routes.Services()
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	writers.Wait()
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	routes := NewRouteTable(testServices(3, 1), nil, config.LBStrategyRoundRobin)
+	if svc, err := routes.Lookup("org1"); err != nil || svc.IP != "10.0.1.1" {
+		t.Errorf("Lookup(org1) = %+v, %v", svc, err)
+	}
+	if _, err := routes.Lookup("globex"); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Lookup(globex) = %v, want errServiceNotFound", err)
+	}
+	// a service whose tasks are gone was known
+	routes.Replace(testServices(1, 1), TriggerScheduled)
+	if _, err := routes.Lookup("org2"); !errors.Is(err, ErrNoRunningTasks) {
+		t.Errorf("Lookup(org2) = %v, want errNoRunningTasks", err)
+	}
+}
+
+// scanLookup is the lookup before the index: the first service whose name
+// contains orgID.
+func scanLookup(services []ECSService, orgID string) (ECSService, bool) {
+	for _, svc := range services {
+		if strings.Contains(svc.Name, orgID) {
+			return svc, true
+		}
+	}
+	return ECSService{}, false
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		services := testServices(n, 1)
+		orgs := make([]string, n)
+		for i := range orgs {
+			orgs[i] = fmt.Sprintf("org%d", i)
+		}
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := scanLookup(services, orgs[i%n]); !ok {
+					b.Fatal("not found")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("map/%d", n), func(b *testing.B) {
+			routes := NewRouteTable(services, nil, config.LBStrategyRoundRobin)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := routes.Lookup(orgs[i%n]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzRouteTableLookup(f *testing.F) {
+	services := testServices(20, 2)
+	services = append(services, ECSService{Name: "société", IP: "fd00::1", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "s1")})
+	ips := map[string]bool{}
+	for _, svc := range services {
+		ips[svc.IP] = true
+	}
+	routes := NewRouteTable(services, nil, config.LBStrategyRoundRobin)
+	for _, seed := range []string{"org1", "org", "rg1", "org19", "org20", "ORG1", "soc", "société", "org1\r\n", "org%31", "", strings.Repeat("org1", 100)} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, org string) {
+		svc, err := routes.Lookup(org)
+		if err != nil {
+			return
+		}
+		// only a task of the table is routed to, of a service named after
+		// the org
+		if !ips[svc.IP] || !strings.Contains(svc.Name, org) {
+			t.Errorf("Lookup(%q) = %s at %s", org, svc.Name, svc.IP)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// routesLogChunk is the most backends a record of a routes log holds, so a
+// large table is logged as many records of bounded size rather than one.
+const routesLogChunk = 100
+
+// serviceLog is a service as logged by logRoutes.
+type serviceLog struct {
+	Service  string `json:"service"`
+	Backends int    `json:"backends"`
+	// Addresses are the host:port of the backends and States their state
+	// as in /debug/routes, in the same order.
+	Addresses []string `json:"addresses"`
+	States    []string `json:"states"`
+}
+
+// logRoutes logs the routes of dump and the route overrides, with the
+// addresses reduced to the last octet if redact. A summary record comes
+// first, then the services in records of at most routesLogChunk backends,
+// then the overrides.
+func logRoutes(logger *slog.Logger, table string, dump RoutesDump, overrides []RouteOverride, redact bool, now time.Time) {
+	names := make([]string, 0, len(dump.Services))
+	backends := 0
+	for name, services := range dump.Services {
+		names = append(names, name)
+		backends += len(services)
+	}
+	sort.Strings(names)
+
+	var chunks [][]serviceLog
+	var chunk []serviceLog
+	size := 0
+	for _, name := range names {
+		services := dump.Services[name]
+		// a service with more backends than fit in a record is split
+		for start, end := 0, 0; start < len(services); start = end {
+			end = min(len(services), start+routesLogChunk-size)
+			entry := serviceLog{Service: name, Backends: len(services)}
+			for _, backend := range services[start:end] {
+				entry.Addresses = append(entry.Addresses, logAddress(net.JoinHostPort(backend.IP, strconv.Itoa(backend.Port)), redact))
+				entry.States = append(entry.States, backend.State)
+			}
+			chunk = append(chunk, entry)
+			if size += end - start; size == routesLogChunk {
+				chunks = append(chunks, chunk)
+				chunk, size = nil, 0
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	attrs := []any{"table", table, "services", len(names), "backends", backends, "overrides", len(overrides), "records", len(chunks)}
+	if dump.BuiltAt != nil {
+		attrs = append(attrs, "built_at", *dump.BuiltAt, "age", now.Sub(*dump.BuiltAt).Round(time.Millisecond))
+	}
+	logger.Info("Routing table", attrs...)
+	for i, chunk := range chunks {
+		logger.Info("Routing table services", "table", table, "record", i+1, "records", len(chunks), "services", chunk)
+	}
+	if len(overrides) > 0 {
+		logged := make([]RouteOverride, len(overrides))
+		for i, override := range overrides {
+			override.Target = logAddress(override.Target, redact)
+			logged[i] = override
+		}
+		logger.Info("Routing table overrides", "table", table, "overrides", logged)
+	}
+}
+
+// logAddress returns the host:port address, with all of the host but its
+// last octet, or last group for IPv6, masked if redact.
+func logAddress(address string, redact bool) string {
+	if !redact {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "REDACTED"
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "REDACTED:" + port
+	}
+	if ip.Is4() {
+		octets := strings.Split(ip.String(), ".")
+		return net.JoinHostPort("x.x.x."+octets[3], port)
+	}
+	groups := strings.Split(ip.StringExpanded(), ":")
+	return net.JoinHostPort("x:x:x:x:x:x:x:"+groups[7], port)
+}
+
+// LogRoutesOnSignal logs the routes of the table and the overrides on
+// every SIGUSR1, for operators who can't reach the admin listener, until
+// ctx is done.
+func LogRoutesOnSignal(ctx context.Context, routes *RouteTable, overrides *RouteOverrides, redact bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			// the dump reads the table at once, never halfway through a
+			// refresh swapping it
+			logRoutes(slog.Default(), "primary", routes.Dump(""), overrides.List(), redact, time.Now())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+func TestLogRoutes(t *testing.T) {
+	builtAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	// 180 backends in records of 100: org0 and part of org1, then the rest
+	routes.ReplaceBuilt(testServices(3, 60), builtAt, TriggerScheduled)
+	overrides := []RouteOverride{{Org: "acme", Target: "10.9.0.7:8080", Created: builtAt, Caller: "192.0.2.7"}}
+	for _, redact := range []bool{false, true} {
+		var buf bytes.Buffer
+		logRoutes(slog.New(slog.NewJSONHandler(&buf, nil)), "primary", routes.Dump(""), overrides, redact, builtAt.Add(90*time.Second))
+		var records []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("record %q: %v", line, err)
+			}
+			records = append(records, record)
+		}
+		if len(records) != 4 {
+			t.Fatalf("redact %t: %d records, want the summary, 2 of services and the overrides", redact, len(records))
+		}
+
+		// the summary comes first
+		summary := records[0]
+		for key, want := range map[string]any{
+			"msg": "Routing table", "table": "primary", "services": float64(3), "backends": float64(180),
+			"overrides": float64(1), "records": float64(2), "built_at": "2024-05-01T12:00:00Z", "age": float64(90 * time.Second),
+		} {
+			if summary[key] != want {
+				t.Errorf("redact %t: summary %s %v, want %v", redact, key, summary[key], want)
+			}
+		}
+
+		// then the services, split across records, each address with its
+		// state
+		var backends []string
+		for i, record := range records[1:3] {
+			if record["msg"] != "Routing table services" || record["record"] != float64(i+1) || record["records"] != float64(2) {
+				t.Errorf("redact %t: record %d %v", redact, i+1, record)
+			}
+			size := 0
+			for _, entry := range record["services"].([]any) {
+				service := entry.(map[string]any)
+				addresses, states := service["addresses"].([]any), service["states"].([]any)
+				if service["backends"] != float64(60) || len(addresses) != len(states) {
+					t.Errorf("redact %t: service %v, want 60 backends each with a state", redact, service)
+				}
+				for _, address := range addresses {
+					backends = append(backends, service["service"].(string)+"="+address.(string))
+				}
+				size += len(addresses)
+			}
+			if want := []int{100, 80}[i]; size != want {
+				t.Errorf("redact %t: record %d holds %d backends, want %d", redact, i+1, size, want)
+			}
+		}
+		want := []string{"org0=10.0.0.1:8080", "org1=10.0.1.41:8080", "org2=10.0.2.60:8080"}
+		if redact {
+			want = []string{"org0=x.x.x.1:8080", "org1=x.x.x.41:8080", "org2=x.x.x.60:8080"}
+		}
+		if len(backends) != 180 || !strings.HasPrefix(backends[0], "org0=") || !strings.HasPrefix(backends[100], "org1=") || !strings.HasPrefix(backends[179], "org2=") {
+			t.Errorf("redact %t: %d backends logged, want the 180 in order of service", redact, len(backends))
+		}
+		for _, backend := range want {
+			if !slices.Contains(backends, backend) {
+				t.Errorf("redact %t: %s not logged", redact, backend)
+			}
+		}
+
+		// the overrides come last
+		last := records[3]
+		logged, _ := last["overrides"].([]any)
+		target := "10.9.0.7:8080"
+		if redact {
+			target = "x.x.x.7:8080"
+		}
+		if last["msg"] != "Routing table overrides" || len(logged) != 1 || logged[0].(map[string]any)["target"] != target {
+			t.Errorf("redact %t: overrides %v, want acme's to %s", redact, last, target)
+		}
+	}
+	if overrides[0].Target != "10.9.0.7:8080" {
+		t.Errorf("redacting changed the override to %s", overrides[0].Target)
+	}
+}
+
+func TestLogAddress(t *testing.T) {
+	for _, tt := range []struct {
+		address string
+		redact  bool
+		want    string
+	}{
+		{address: "10.0.3.17:8080", want: "10.0.3.17:8080"},
+		{address: "10.0.3.17:8080", redact: true, want: "x.x.x.17:8080"},
+		{address: "[2001:db8::a:1f]:443", redact: true, want: "[x:x:x:x:x:x:x:001f]:443"},
+		{address: "backend.internal:80", redact: true, want: "REDACTED:80"},
+		{address: "10.0.3.17", redact: true, want: "REDACTED"},
+	} {
+		if got := logAddress(tt.address, tt.redact); got != tt.want {
+			t.Errorf("logAddress(%q, %t) = %q, want %q", tt.address, tt.redact, got, tt.want)
+		}
+	}
+}
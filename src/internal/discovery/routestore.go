@@ -0,0 +1,202 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// TriggerShared attributes route changes to a table another replica
+// published.
+const TriggerShared = "shared"
+
+// sharedRoutesResults counts the refreshes of replicas sharing routes by
+// result: published after discovering them, loaded from another replica,
+// stale or unavailable when the replica fell back to its own discovery.
+var sharedRoutesResults = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_shared_routes_total",
+	Help: "Refreshes sharing routes through the route store by result (published, loaded, stale, unavailable).",
+}, []string{"result"})
+
+// SharedRoutes shares the route table between replicas. The replica holding
+// the refresh lease discovers the routes and publishes them, in the snapshot
+// format, to a key and a notification to a channel; the others load them
+// from the key. A replica falls back to discovering the routes itself when
+// the store can't be reached or the published routes are older than
+// maxStaleness.
+type SharedRoutes struct {
+	client redisClient
+	// id names the replica in the lease.
+	id string
+	// leaseKey, routesKey and channel are derived from the configured
+	// prefix.
+	leaseKey  string
+	routesKey string
+	channel   string
+	// leaseTTL is how long a replica holds the lease once it took it, the
+	// longest a refresh of a replica that died holds up the others.
+	leaseTTL     time.Duration
+	maxStaleness time.Duration
+	clock        clock.Clock
+}
+
+// NewSharedRoutes returns the shared routes stored under prefix in client.
+func NewSharedRoutes(client redisClient, prefix string, leaseTTL, maxStaleness time.Duration) *SharedRoutes {
+	host, _ := os.Hostname()
+	return &SharedRoutes{
+		client:       client,
+		id:           host + ":" + strconv.Itoa(os.Getpid()),
+		leaseKey:     prefix + ":lease",
+		routesKey:    prefix + ":routes",
+		channel:      prefix + ":updates",
+		leaseTTL:     leaseTTL,
+		maxStaleness: maxStaleness,
+		clock:        clock.System{},
+	}
+}
+
+// follow returns the routes another replica published when it holds the
+// lease and they are fresh. It returns false when this replica must
+// discover the routes itself: it holds the lease, or the store can't be
+// reached, or holds no routes fresh enough, or s is nil.
+func (s *SharedRoutes) follow(ctx context.Context) (RouteSnapshot, bool) {
+	if s == nil {
+		return RouteSnapshot{}, false
+	}
+	acquired, err := s.client.SetNX(ctx, s.leaseKey, s.id, s.leaseTTL)
+	var owner []byte
+	if err == nil && !acquired {
+		// the lease may be this replica's, taken by an earlier refresh
+		owner, err = s.client.Get(ctx, s.leaseKey)
+	}
+	if err != nil {
+		slog.Warn("Route store unavailable, discovering the routes", "error", err)
+		sharedRoutesResults.WithLabelValues("unavailable").Inc()
+		return RouteSnapshot{}, false
+	}
+	if acquired || string(owner) == s.id {
+		return RouteSnapshot{}, false
+	}
+	snapshot, err := s.load(ctx)
+	if err != nil {
+		slog.Warn("No fresh shared routes, discovering the routes", "error", err)
+		result := "stale"
+		if _, ok := err.(staleRoutesError); !ok {
+			result = "unavailable"
+		}
+		sharedRoutesResults.WithLabelValues(result).Inc()
+		return RouteSnapshot{}, false
+	}
+	sharedRoutesResults.WithLabelValues("loaded").Inc()
+	return snapshot, true
+}
+
+// staleRoutesError means the store holds no routes, or none fresh enough.
+type staleRoutesError string
+
+func (e staleRoutesError) Error() string {
+	return string(e)
+}
+
+// load returns the published routes if they are fresh enough.
+func (s *SharedRoutes) load(ctx context.Context) (RouteSnapshot, error) {
+	var snapshot RouteSnapshot
+	data, err := s.client.Get(ctx, s.routesKey)
+	if err != nil {
+		return snapshot, err
+	}
+	if data == nil {
+		return snapshot, staleRoutesError("no routes published")
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("corrupted shared routes: %w", err)
+	}
+	if snapshot.BuiltAt.IsZero() || snapshot.Services == nil {
+		return snapshot, fmt.Errorf("incomplete shared routes")
+	}
+	if age := s.clock.Now().Sub(snapshot.BuiltAt); age > s.maxStaleness {
+		return snapshot, staleRoutesError(fmt.Sprintf("shared routes are %v old, more than %v", age.Round(time.Second), s.maxStaleness))
+	}
+	return snapshot, nil
+}
+
+// publish stores the routes discovered at builtAt and notifies the other
+// replicas, if s isn't nil.
+func (s *SharedRoutes) publish(ctx context.Context, services []ECSService, builtAt time.Time) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(RouteSnapshot{BuiltAt: builtAt, Services: services})
+	if err == nil {
+		err = s.client.Set(ctx, s.routesKey, data)
+	}
+	if err == nil {
+		err = s.client.Publish(ctx, s.channel, builtAt.Format(time.RFC3339Nano))
+	}
+	if err != nil {
+		slog.Warn("Failed to publish the routes to the route store", "error", err)
+		return
+	}
+	sharedRoutesResults.WithLabelValues("published").Inc()
+}
+
+// Run applies the routes other replicas publish as they are notified,
+// subscribing again with backoff when the connection is lost, until ctx is
+// done.
+func (s *SharedRoutes) Run(ctx context.Context, apply func(RouteSnapshot)) {
+	delay := time.Second
+	for {
+		messages, err := s.client.Subscribe(ctx, s.channel)
+		if err == nil {
+			delay = time.Second
+			for range messages {
+				snapshot, err := s.load(ctx)
+				if err != nil {
+					slog.Warn("Failed to load the shared routes", "error", err)
+					continue
+				}
+				apply(snapshot)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Lost the route store subscription, subscribing again", "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(delay):
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// SetShared makes the refresher share the routes through the route store,
+// and apply those the other replicas publish until ctx is done. It must be
+// called before the refresher is shared.
+func (r *Refresher) SetShared(ctx context.Context, shared *SharedRoutes) {
+	r.shared = shared
+	go shared.Run(ctx, func(snapshot RouteSnapshot) { r.applyShared(snapshot) })
+}
+
+// applyShared replaces the routes with those another replica published,
+// unless they are older than the current ones.
+func (r *Refresher) applyShared(snapshot RouteSnapshot) RouteDiff {
+	if !snapshot.BuiltAt.After(r.routes.BuiltAt()) {
+		return RouteDiff{}
+	}
+	diff := r.routes.ReplaceBuilt(snapshot.Services, snapshot.BuiltAt, TriggerShared)
+	r.failures.Store(0)
+	r.SaveSnapshot()
+	return diff
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"strings"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// serviceTaskCount is the number of tasks of each ECS service, by table,
+// service and state: desired, running or pending.
+var serviceTaskCount = promauto.With(telemetry.Registry).NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ecs_svc_proxy_service_tasks",
+	Help: "Tasks of each ECS service as last described, by table, service and state (desired, running, pending).",
+}, []string{"table", "service", "state"})
+
+// ServiceTasks is the task counts of an ECS service as last described.
+type ServiceTasks struct {
+	Service string `json:"service"`
+	Cluster string `json:"cluster"`
+	Region  string `json:"region"`
+	Account string `json:"account,omitempty"`
+	Desired int    `json:"desired"`
+	Running int    `json:"running"`
+	Pending int    `json:"pending"`
+}
+
+// ScalingUp reports whether the service has no task running yet but ECS is
+// about to start some.
+func (s ServiceTasks) ScalingUp() bool {
+	return s.Running == 0 && (s.Desired > 0 || s.Pending > 0)
+}
+
+// countServiceTasks returns the task counts of the described services of
+// target.
+func countServiceTasks(target ClusterTarget, services []types.Service) []ServiceTasks {
+	counts := make([]ServiceTasks, 0, len(services))
+	for _, service := range services {
+		counts = append(counts, ServiceTasks{
+			Service: aws.ToString(service.ServiceName),
+			Cluster: target.Cluster,
+			Region:  target.Region,
+			Account: target.Account,
+			Desired: int(service.DesiredCount),
+			Running: int(service.RunningCount),
+			Pending: int(service.PendingCount),
+		})
+	}
+	return counts
+}
+
+// SetServiceTasks replaces the task counts of the services.
+func (t *RouteTable) SetServiceTasks(counts []ServiceTasks) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.serviceTasks = counts
+}
+
+// publishServiceTasks sets the task count metrics of the table named table
+// to counts. A service deployed to several clusters is counted once, in
+// total.
+func publishServiceTasks(table string, counts []ServiceTasks) {
+	serviceTaskCount.DeletePartialMatch(prometheus.Labels{"table": table})
+	totals := map[string]ServiceTasks{}
+	for _, count := range counts {
+		total := totals[count.Service]
+		total.Desired += count.Desired
+		total.Running += count.Running
+		total.Pending += count.Pending
+		totals[count.Service] = total
+	}
+	for service, total := range totals {
+		serviceTaskCount.WithLabelValues(table, service, "desired").Set(float64(total.Desired))
+		serviceTaskCount.WithLabelValues(table, service, "running").Set(float64(total.Running))
+		serviceTaskCount.WithLabelValues(table, service, "pending").Set(float64(total.Pending))
+	}
+}
+
+// AllServiceTasks returns the task counts of every service. The returned
+// slice must not be modified.
+func (t *RouteTable) AllServiceTasks() []ServiceTasks {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.serviceTasks
+}
+
+// ServiceTasks returns the task counts of the ECS service named orgID or,
+// failing that, of the first one containing it, like Lookup, summed over
+// the clusters running it. It returns false if no service matches.
+func (t *RouteTable) ServiceTasks(orgID string) (ServiceTasks, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.matchServiceTasks(orgID)
+}
+
+// matchServiceTasks is ServiceTasks. The caller must hold t.mu.
+func (t *RouteTable) matchServiceTasks(orgID string) (ServiceTasks, bool) {
+	name := ""
+	for _, count := range t.serviceTasks {
+		if count.Service == orgID {
+			name = orgID
+			break
+		}
+	}
+	if name == "" {
+		for _, count := range t.serviceTasks {
+			if strings.Contains(count.Service, orgID) {
+				name = count.Service
+				break
+			}
+		}
+	}
+	if name == "" {
+		return ServiceTasks{}, false
+	}
+	total := ServiceTasks{Service: name}
+	for _, count := range t.serviceTasks {
+		if count.Service == name {
+			total.Desired += count.Desired
+			total.Running += count.Running
+			total.Pending += count.Pending
+		}
+	}
+	return total, true
+}
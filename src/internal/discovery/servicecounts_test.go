@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestServiceTasks(t *testing.T) {
+	fake := discoverytest.NewECS()
+	// acme is steady, globex scaling up from zero and initech scaled to
+	// zero
+	for _, service := range []string{"acme", "globex", "initech"} {
+		fake.AddService("tenants", service)
+	}
+	services := fake.Services["tenants"]
+	services[0].DesiredCount, services[0].RunningCount = 2, 2
+	services[1].DesiredCount, services[1].PendingCount = 4, 2
+	services[2].DesiredCount = 0
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080, ServiceCounts: true}, routes, 0)
+	refresher.SetName("service-tasks-test")
+	if _, err := refresher.Rebuild(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		org                       string
+		desired, running, pending int
+		scalingUp                 bool
+	}{
+		{org: "acme", desired: 2, running: 2},
+		{org: "globex", desired: 4, pending: 2, scalingUp: true},
+		{org: "initech"},
+	} {
+		tasks, ok := routes.ServiceTasks(tt.org)
+		if !ok || tasks.Desired != tt.desired || tasks.Running != tt.running || tasks.Pending != tt.pending || tasks.ScalingUp() != tt.scalingUp {
+			t.Errorf("tasks of %s %+v, %t, want %d desired, %d running, %d pending, scaling up %t",
+				tt.org, tasks, ok, tt.desired, tt.running, tt.pending, tt.scalingUp)
+		}
+		for state, want := range map[string]int{"desired": tt.desired, "running": tt.running, "pending": tt.pending} {
+			if n := telemetrytest.GaugeValue(t, serviceTaskCount.WithLabelValues("service-tasks-test", tt.org, state)); n != float64(want) {
+				t.Errorf("%s tasks of %s %v, want %d", state, tt.org, n, want)
+			}
+		}
+	}
+	if _, ok := routes.ServiceTasks("hooli"); ok {
+		t.Error("tasks of hooli, which has no service, found")
+	}
+
+	// /debug/routes shows the counts of the org's service
+	if counts := routes.Dump("globex").ECSServices; len(counts) != 1 || counts[0].Service != "globex" || counts[0].Desired != 4 || counts[0].Pending != 2 {
+		t.Errorf("task counts of globex in the dump %+v", counts)
+	}
+}
@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RouteSnapshot is the route table as persisted to disk so a restarted proxy
+// can serve before its first discovery completes.
+type RouteSnapshot struct {
+	BuiltAt   time.Time       `json:"built_at"`
+	Services  []ECSService    `json:"services"`
+	Overrides []RouteOverride `json:"overrides,omitempty"`
+}
+
+// saveSnapshot writes the routes and overrides to path. The file is
+// replaced atomically so a crash mid-write never leaves a truncated
+// snapshot behind.
+func saveSnapshot(path string, services []ECSService, builtAt time.Time, overrides []RouteOverride) error {
+	data, err := json.Marshal(RouteSnapshot{BuiltAt: builtAt, Services: services, Overrides: overrides})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot reads the routes saved at path. It fails if the snapshot is
+// unreadable, corrupted, or older than maxAge.
+func LoadSnapshot(path string, maxAge time.Duration) (RouteSnapshot, error) {
+	var snapshot RouteSnapshot
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("corrupted snapshot: %w", err)
+	}
+	if snapshot.BuiltAt.IsZero() || snapshot.Services == nil {
+		return snapshot, fmt.Errorf("incomplete snapshot")
+	}
+	if age := time.Since(snapshot.BuiltAt); age > maxAge {
+		return snapshot, fmt.Errorf("snapshot is %v old, more than %v", age.Round(time.Second), maxAge)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestSnapshot(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	path := filepath.Join(t.TempDir(), "routes.json")
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	overrides := NewRouteOverrides(allowed)
+	refresher := NewRefresher([]ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, routes, 0)
+	refresher.SetSnapshotPath(path, overrides)
+	overrides.OnChange(refresher.SaveSnapshot)
+	if _, err := refresher.Rebuild(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := overrides.Set("globex", "10.0.9.9:8080", time.Hour, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart restores the routes and overrides saved
+	snapshot, err := LoadSnapshot(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	restored.Restore(snapshot.Services, snapshot.BuiltAt)
+	if !restored.BuiltAt().Equal(routes.BuiltAt()) || len(restored.Services()) != 2 {
+		t.Errorf("restored %d routes built at %v, want the 2 built at %v", len(restored.Services()), restored.BuiltAt(), routes.BuiltAt())
+	}
+	for _, task := range []string{"a1", "a2"} {
+		if !restored.HasTask(discoverytest.TaskARN("tenants", task)) {
+			t.Errorf("task %s not restored", task)
+		}
+	}
+	restoredOverrides := NewRouteOverrides(allowed)
+	restoredOverrides.Restore(snapshot.Overrides)
+	if svc, ok := restoredOverrides.Lookup("globex"); !ok || svc.Address() != "10.0.9.9:8080" {
+		t.Errorf("override of globex restored as %v, %t", svc, ok)
+	}
+
+	// too old to route with
+	if _, err := LoadSnapshot(path, time.Nanosecond); err == nil || !strings.Contains(err.Error(), "old, more than") {
+		t.Errorf("LoadSnapshot of an old snapshot = %v", err)
+	}
+	// missing
+	if _, err := LoadSnapshot(filepath.Join(t.TempDir(), "missing.json"), time.Hour); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadSnapshot of a missing file = %v, want %v", err, fs.ErrNotExist)
+	}
+	// corrupt, such as cut short
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		content []byte
+		want    string
+	}{
+		{content: data[:len(data)/2], want: "corrupted snapshot"},
+		{content: []byte("not json"), want: "corrupted snapshot"},
+		{content: []byte("{}"), want: "incomplete snapshot"},
+	} {
+		if err := os.WriteFile(path, tt.content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSnapshot(path, time.Hour); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadSnapshot of %.20q = %v, want %s", tt.content, err, tt.want)
+		}
+	}
+}
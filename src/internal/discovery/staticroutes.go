@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// staticCluster is the cluster of the backends of static routes.
+const staticCluster = "static"
+
+// staticRoutesPollInterval is how often the file of STATIC_ROUTES is checked
+// for changes.
+const staticRoutesPollInterval = 2 * time.Second
+
+// StaticRoutes are the routes of DiscoveryModeStatic: the JSON of
+// STATIC_ROUTES itself, or the file it names, read again on every refresh.
+type StaticRoutes struct {
+	// Path is the file of the routes, empty when they are inline.
+	Path   string
+	inline string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewStaticRoutes returns the routes of value, inline JSON if it starts with
+// a brace and the path of a JSON file otherwise.
+func NewStaticRoutes(value string) *StaticRoutes {
+	if config.InlineStaticRoutes(value) {
+		return &StaticRoutes{inline: value}
+	}
+	return &StaticRoutes{Path: value}
+}
+
+// Load reads the routes and resolves their hosts, so the backends are IPs as
+// discovered ones are. Each org becomes a service of that name, each of its
+// targets a task.
+func (s *StaticRoutes) Load(ctx context.Context) ([]ECSService, error) {
+	data := []byte(s.inline)
+	if s.Path != "" {
+		info, err := os.Stat(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = os.ReadFile(s.Path); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.modTime, s.size = info.ModTime(), info.Size()
+		s.mu.Unlock()
+	}
+	routes, err := config.ParseStaticRoutes(data)
+	if err != nil {
+		return nil, err
+	}
+	services := []ECSService{}
+	for org, targets := range routes {
+		for _, target := range targets {
+			host, port, _ := net.SplitHostPort(target)
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, fmt.Errorf("org %s: %w", org, err)
+			}
+			n, _ := strconv.Atoi(port)
+			services = append(services, ECSService{
+				Name:    org,
+				IP:      addrs[0],
+				Port:    n,
+				TaskArn: staticCluster + "/" + org + "/" + target,
+				Cluster: staticCluster,
+			})
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].TaskArn < services[j].TaskArn })
+	return services, nil
+}
+
+// changed reports whether the file of the routes changed since it was last
+// loaded.
+func (s *StaticRoutes) changed() bool {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// Run refreshes the routes with refresh each time their file changes, until
+// ctx is done. Inline routes never change.
+func (s *StaticRoutes) Run(ctx context.Context, refresh func(context.Context, string)) {
+	if s.Path == "" {
+		return
+	}
+	ticker := time.NewTicker(staticRoutesPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.changed() {
+				slog.Info("Static routes changed, reloading", "path", s.Path)
+				refresh(ctx, TriggerFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+func TestStaticRoutes(t *testing.T) {
+	static := NewStaticRoutes(`{"acme": "127.0.0.1:9000", "globex": ["localhost:9001", "127.0.0.2:9002"]}`)
+	if static.Path != "" {
+		t.Errorf("inline routes read from %q", static.Path)
+	}
+	services, err := static.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 3 {
+		t.Fatalf("routes %s, want the 3 targets", serviceNames(services))
+	}
+	// hosts are resolved, each target is a task of the org's service
+	localhost := services[2]
+	if localhost.TaskArn != "static/globex/localhost:9001" || services[0].Address() != "127.0.0.1:9000" || services[1].Address() != "127.0.0.2:9002" {
+		t.Errorf("routes %s, want acme and globex's two targets", serviceNames(services))
+	}
+	if ip, err := netip.ParseAddr(localhost.IP); err != nil || !ip.IsLoopback() || localhost.Port != 9001 {
+		t.Errorf("localhost:9001 resolved to %s:%d", localhost.IP, localhost.Port)
+	}
+	for _, svc := range services {
+		if svc.Cluster != staticCluster || !strings.HasPrefix(svc.TaskArn, staticCluster+"/"+svc.Name+"/") {
+			t.Errorf("backend %+v, want a task of the static cluster", svc)
+		}
+	}
+
+	// a file is read again once it changed
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(`{"acme": "127.0.0.1:9000"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	static = NewStaticRoutes(path)
+	if static.Path != path {
+		t.Fatalf("routes read from %q, want %s", static.Path, path)
+	}
+	routes := NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	refresher := NewRefresher(nil, Options{}, routes, 0)
+	refresher.SetStatic(static)
+	if _, err := refresher.Rebuild(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	if static.changed() {
+		t.Error("file changed just after it was read")
+	}
+	if err := os.WriteFile(path, []byte(`{"acme": "127.0.0.1:9000", "globex": "127.0.0.2:9002"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !static.changed() {
+		t.Error("file rewritten isn't seen as changed")
+	}
+	if _, err := refresher.RefreshService(context.Background(), "globex", TriggerFile); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serviceNames(routes.Services()), "acme=127.0.0.1:9000 globex=127.0.0.2:9002"; got != want {
+		t.Errorf("routes %s after the file changed, want %s", got, want)
+	}
+
+	// a broken file leaves the routes in place
+	for _, content := range []string{`{"acme": "127.0.0.1"}`, `{"acme": `} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := refresher.Rebuild(context.Background(), TriggerFile); err == nil {
+			t.Errorf("refresh from %q succeeded", content)
+		}
+		if got := len(routes.Services()); got != 2 {
+			t.Errorf("%d routes after reading %q, want the 2 read before", got, content)
+		}
+	}
+	os.Remove(path)
+	if _, err := static.Load(context.Background()); !os.IsNotExist(err) {
+		t.Errorf("Load of a missing file = %v", err)
+	}
+}
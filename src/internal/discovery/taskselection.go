@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// taskRevision parses the revision number out of a task definition ARN such
+// as arn:aws:ecs:us-west-2:123456789012:task-definition/acme:42.
+func taskRevision(taskDefinitionArn string) int {
+	i := strings.LastIndex(taskDefinitionArn, ":")
+	if i < 0 {
+		return 0
+	}
+	revision, err := strconv.Atoi(taskDefinitionArn[i+1:])
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+// taskDefinitionName returns the family:revision of a task definition ARN,
+// such as acme:42.
+func taskDefinitionName(taskDefinitionArn string) string {
+	return taskDefinitionArn[strings.LastIndex(taskDefinitionArn, "/")+1:]
+}
+
+// TaskID returns the ID a task ARN ends with, empty for an empty ARN.
+func TaskID(taskArn string) string {
+	return taskArn[strings.LastIndex(taskArn, "/")+1:]
+}
+
+// taskRoutable reports whether a task can receive traffic.
+func taskRoutable(task types.Task) bool {
+	return aws.ToString(task.LastStatus) == string(types.DesiredStatusRunning) &&
+		task.HealthStatus != types.HealthStatusUnhealthy
+}
+
+// ecsHealth takes the backends whose container ECS reports UNHEALTHY out of
+// rotation when enabled, and those it reports UNKNOWN too unless
+// includeUnknown. Containers without a health check report UNKNOWN. The
+// zero ecsHealth routes to every backend.
+type ecsHealth struct {
+	enabled        bool
+	includeUnknown bool
+}
+
+// allows reports whether svc can take requests as far as its ECS health
+// status goes. Backends without one, such as static routes, always can.
+func (h ecsHealth) allows(svc ECSService) bool {
+	switch types.HealthStatus(svc.Health) {
+	case types.HealthStatusUnhealthy:
+		return !h.enabled
+	case types.HealthStatusUnknown:
+		return !h.enabled || h.includeUnknown
+	}
+	return true
+}
+
+// containerHealth returns the health status ECS reports for container, the
+// one of its task if the container has none.
+func containerHealth(task types.Task, container types.Container) string {
+	if container.HealthStatus != "" {
+		return string(container.HealthStatus)
+	}
+	return string(task.HealthStatus)
+}
+
+// selectLatestRevision keeps, per service, only the tasks running the highest
+// task definition revision that has at least one routable task. Services
+// without any routable task keep all of their tasks.
+func selectLatestRevision(tasks []describedTask) []describedTask {
+	latest := map[string]int{}
+	for _, task := range tasks {
+		if task.Routable && task.Revision > latest[task.Group] {
+			latest[task.Group] = task.Revision
+		}
+	}
+
+	var selected []describedTask
+	for _, task := range tasks {
+		revision, ok := latest[task.Group]
+		if !ok || task.Revision == revision {
+			selected = append(selected, task)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestECSHealth(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	// task returns a task of service whose container ECS reports health
+	// for, or only the task when the container has no health check.
+	task := func(service, id, ip string, health types.HealthStatus, container bool) types.Task {
+		task := discoverytest.Task("tenants", service, id, ip)
+		task.HealthStatus = health
+		task.Containers[0].HealthStatus = ""
+		if container {
+			task.Containers[0].HealthStatus = health
+		}
+		return task
+	}
+	fake.AddTasks("tenants",
+		task("acme", "a1", "10.0.0.1", types.HealthStatusHealthy, true),
+		task("acme", "a2", "10.0.0.2", types.HealthStatusUnhealthy, true),
+		task("acme", "a3", "10.0.0.3", types.HealthStatusUnknown, false),
+		task("globex", "g1", "10.0.1.1", types.HealthStatusUnhealthy, true),
+		task("globex", "g2", "10.0.1.2", types.HealthStatusUnhealthy, false))
+	details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		enabled, includeUnknown bool
+		want                    string
+	}{
+		{enabled: true, includeUnknown: true, want: "map[10.0.0.1:5 10.0.0.3:5]"},
+		{enabled: true, want: "map[10.0.0.1:10]"},
+		{includeUnknown: true, want: "map[10.0.0.1:4 10.0.0.2:3 10.0.0.3:3]"},
+	} {
+		routes := NewRouteTable(details, nil, config.LBStrategyRoundRobin)
+		routes.SetECSHealth(tt.enabled, tt.includeUnknown)
+		ips := map[string]int{}
+		for i := 0; i < 10; i++ {
+			svc, err := routes.Lookup("acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips[svc.IP]++
+		}
+		if got := fmt.Sprint(ips); got != tt.want {
+			t.Errorf("lookups with ECS health %t, UNKNOWN included %t went to %s, want %s", tt.enabled, tt.includeUnknown, got, tt.want)
+		}
+	}
+
+	// no backend is left of a service ECS reports wholly unhealthy
+	routes := NewRouteTable(details, nil, config.LBStrategyRoundRobin)
+	routes.SetECSHealth(true, true)
+	if _, err := routes.Lookup("globex"); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Errorf("lookup of globex = %v, want %v", err, ErrNoHealthyBackend)
+	}
+
+	// /debug/routes shows the status and why a backend is out of rotation
+	states := map[string]string{}
+	for _, backend := range routes.Dump("acme").Services["acme"] {
+		states[backend.IP] = backend.Health + " " + backend.State
+	}
+	if got, want := fmt.Sprint(states), "map[10.0.0.1:HEALTHY healthy 10.0.0.2:UNHEALTHY ecs-unhealthy 10.0.0.3:UNKNOWN healthy]"; got != want {
+		t.Errorf("backends of acme in the dump %s, want %s", got, want)
+	}
+
+	// and the status is refreshed with the routes
+	fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "g1"))
+	fake.AddTasks("tenants", task("globex", "g1", "10.0.1.1", types.HealthStatusHealthy, true))
+	details, _, _, err = buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, Options{DefaultPort: 8080}, details, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.Replace(details, TriggerScheduled)
+	if svc, err := routes.Lookup("globex"); err != nil || svc.IP != "10.0.1.1" {
+		t.Errorf("lookup of globex once its task is healthy = %s, %v", svc.IP, err)
+	}
+}
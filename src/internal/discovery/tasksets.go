@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// routableTasks lists the tasks of service that ROUTE_PRIMARY_DEPLOYMENT_ONLY
+// routes to. A service deployed by ECS runs them in deployments, and those
+// of its PRIMARY deployment are. One deployed by CODE_DEPLOY or an EXTERNAL
+// controller runs them in task sets instead, and those of the task sets
+// taskSets selects are. Tasks carry the ID of the deployment or task set
+// that started them as their startedBy value.
+func routableTasks(ctx context.Context, ecsClient ECSAPI, cluster string, service types.Service, taskSets string) ([]string, error) {
+	var startedBy []string
+	switch deploymentController(service) {
+	case types.DeploymentControllerTypeCodeDeploy, types.DeploymentControllerTypeExternal:
+		sets, err := describeTaskSets(ctx, ecsClient, cluster, aws.ToString(service.ServiceArn))
+		if err != nil {
+			return nil, err
+		}
+		if taskSets != config.TaskSetsAll {
+			sets = liveTaskSets(sets)
+		}
+		for _, set := range sets {
+			startedBy = append(startedBy, aws.ToString(set.Id))
+		}
+	default:
+		for _, deployment := range service.Deployments {
+			if aws.ToString(deployment.Status) == "PRIMARY" {
+				startedBy = append(startedBy, aws.ToString(deployment.Id))
+			}
+		}
+	}
+	var tasks []string
+	for _, id := range startedBy {
+		started, err := listTasks(ctx, ecsClient, cluster, id, "")
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, started...)
+	}
+	return tasks, nil
+}
+
+// deploymentController returns the type of the deployment controller of
+// service, ECS if it names none.
+func deploymentController(service types.Service) types.DeploymentControllerType {
+	if service.DeploymentController == nil || service.DeploymentController.Type == "" {
+		return types.DeploymentControllerTypeEcs
+	}
+	return service.DeploymentController.Type
+}
+
+// describeTaskSets describes the task sets of the service.
+func describeTaskSets(ctx context.Context, ecsClient ECSAPI, cluster, service string) ([]types.TaskSet, error) {
+	var resp *ecs.DescribeTaskSetsOutput
+	err := ECSRetryPolicy.call(ctx, "DescribeTaskSets", func(ctx context.Context) (err error) {
+		resp, err = ecsClient.DescribeTaskSets(ctx, &ecs.DescribeTaskSetsInput{
+			Cluster: aws.String(cluster),
+			Service: aws.String(service),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.TaskSets, nil
+}
+
+// liveTaskSets returns the task sets taking the traffic of their service:
+// the PRIMARY one, or while an EXTERNAL controller has none, the ACTIVE ones
+// in a steady state scaled the largest.
+func liveTaskSets(sets []types.TaskSet) []types.TaskSet {
+	var live []types.TaskSet
+	for _, set := range sets {
+		if aws.ToString(set.Status) == "PRIMARY" {
+			live = append(live, set)
+		}
+	}
+	if len(live) > 0 {
+		return live
+	}
+	largest := -1.0
+	for _, set := range sets {
+		if aws.ToString(set.Status) != "ACTIVE" || set.StabilityStatus != types.StabilityStatusSteadyState {
+			continue
+		}
+		scale := 0.0
+		if set.Scale != nil {
+			scale = set.Scale.Value
+		}
+		switch {
+		case scale > largest:
+			live, largest = []types.TaskSet{set}, scale
+		case scale == largest:
+			live = append(live, set)
+		}
+	}
+	return live
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestRoutableTasks(t *testing.T) {
+	// taskSet returns a task set with status, steady or not, at scale
+	// percent.
+	taskSet := func(id, status string, steady bool, scale float64) types.TaskSet {
+		stability := types.StabilityStatusStabilizing
+		if steady {
+			stability = types.StabilityStatusSteadyState
+		}
+		return types.TaskSet{Id: aws.String(id), Status: aws.String(status), StabilityStatus: stability,
+			Scale: &types.Scale{Value: scale, Unit: types.ScaleUnitPercent}}
+	}
+	for _, tt := range []struct {
+		name       string
+		controller types.DeploymentControllerType
+		sets       []types.TaskSet
+		taskSets   string
+		want       string
+	}{
+		{name: "ECS", controller: types.DeploymentControllerTypeEcs, want: "acme=10.0.0.1:8080"},
+		{
+			name:       "CODE_DEPLOY",
+			controller: types.DeploymentControllerTypeCodeDeploy,
+			sets:       []types.TaskSet{taskSet("ecs-svc/new", "PRIMARY", true, 100), taskSet("ecs-svc/old", "ACTIVE", true, 100)},
+			want:       "acme=10.0.0.1:8080",
+		},
+		{
+			name:       "EXTERNAL without a PRIMARY task set",
+			controller: types.DeploymentControllerTypeExternal,
+			sets:       []types.TaskSet{taskSet("ecs-svc/new", "ACTIVE", false, 100), taskSet("ecs-svc/old", "ACTIVE", true, 100)},
+			want:       "acme=10.0.0.2:8080",
+		},
+		{
+			name:       "EXTERNAL scaled",
+			controller: types.DeploymentControllerTypeExternal,
+			sets:       []types.TaskSet{taskSet("ecs-svc/new", "ACTIVE", true, 100), taskSet("ecs-svc/old", "ACTIVE", true, 20)},
+			want:       "acme=10.0.0.1:8080",
+		},
+		{
+			name:       "EXTERNAL with every task set",
+			controller: types.DeploymentControllerTypeExternal,
+			sets:       []types.TaskSet{taskSet("ecs-svc/new", "PRIMARY", true, 100), taskSet("ecs-svc/old", "DRAINING", false, 0)},
+			taskSets:   config.TaskSetsAll,
+			want:       "acme=10.0.0.1:8080 acme=10.0.0.2:8080",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := discoverytest.NewECS()
+			fake.AddService("tenants", "acme")
+			service := &fake.Services["tenants"][0]
+			service.DeploymentController = &types.DeploymentController{Type: tt.controller}
+			if tt.sets == nil {
+				service.Deployments = []types.Deployment{
+					{Id: aws.String("ecs-svc/new"), Status: aws.String("PRIMARY")},
+					{Id: aws.String("ecs-svc/old"), Status: aws.String("ACTIVE")},
+				}
+			} else {
+				service.Deployments = nil
+				fake.AddTaskSets("tenants", "acme", tt.sets...)
+			}
+			for i, startedBy := range []string{"ecs-svc/new", "ecs-svc/old"} {
+				task := discoverytest.Task("tenants", "acme", fmt.Sprint(i), fmt.Sprintf("10.0.0.%d", i+1))
+				task.StartedBy = aws.String(startedBy)
+				fake.AddTasks("tenants", task)
+			}
+			opts := Options{DefaultPort: 8080, PrimaryDeploymentOnly: true, TaskSets: tt.taskSets}
+			details, _, _, err := buildServiceDetails(context.Background(), []ClusterTarget{testTarget(fake, "tenants")}, opts, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := serviceNames(details); got != tt.want {
+				t.Errorf("routes %s, want %s", got, tt.want)
+			}
+			if n := fake.Count("DescribeTaskSets"); (n > 0) != (tt.sets != nil) {
+				t.Errorf("DescribeTaskSets called %d times", n)
+			}
+			// the tasks of a task set are still those of the service
+			for _, svc := range details {
+				if svc.Service != "acme" {
+					t.Errorf("task %s of service %q, want acme", svc.TaskArn, svc.Service)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// wakeups counts the UpdateService calls starting services scaled to zero,
+// by service and result: ok or error.
+var wakeups = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_wakeups_total",
+	Help: "UpdateService calls starting services scaled to zero, by service and result.",
+}, []string{"service", "result"})
+
+// Waker starts the services of the allow-list that are scaled to zero when
+// a request comes for them, by setting their desired count with
+// UpdateService. A service is woken at most once per window, however many
+// requests arrive before its task starts. A nil waker wakes nothing.
+type Waker struct {
+	targets  []ClusterTarget
+	routes   *RouteTable
+	services map[string]bool
+	desired  int32
+	window   time.Duration
+	clock    clock.Clock
+
+	mu sync.Mutex
+	// woken holds the last wake-up of each service.
+	woken map[string]wakeup
+}
+
+// wakeup is a wake-up of a service: when, and whether UpdateService failed.
+type wakeup struct {
+	at     time.Time
+	failed bool
+}
+
+// NewWaker returns a waker of services, nil if there are none. The counts
+// of routes tell which services are scaled to zero and in which cluster of
+// targets.
+func NewWaker(targets []ClusterTarget, routes *RouteTable, services []string, desired int, window time.Duration) *Waker {
+	if len(services) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool, len(services))
+	for _, service := range services {
+		allowed[service] = true
+	}
+	return &Waker{
+		targets:  targets,
+		routes:   routes,
+		services: allowed,
+		desired:  int32(desired),
+		window:   window,
+		clock:    clock.System{},
+		woken:    map[string]wakeup{},
+	}
+}
+
+// SetClock makes the window of wake-ups timed by clock. It must be called
+// before the waker is shared.
+func (w *Waker) SetClock(clock clock.Clock) {
+	w.clock = clock
+}
+
+// Wake starts the service orgID resolves to when it is on the allow-list
+// and scaled to zero, in the first cluster running it. It reports whether
+// the service was woken, now or earlier in the window, and may take a task
+// to start; false means the request is to be answered as if there was no
+// waker.
+func (w *Waker) Wake(ctx context.Context, orgID string) bool {
+	if w == nil {
+		return false
+	}
+	tasks, ok := w.routes.ServiceTasks(orgID)
+	if !ok || !w.services[tasks.Service] || tasks.Desired > 0 || tasks.Running > 0 || tasks.Pending > 0 {
+		return false
+	}
+	var count ServiceTasks
+	for _, candidate := range w.routes.AllServiceTasks() {
+		if candidate.Service == tasks.Service {
+			count = candidate
+			break
+		}
+	}
+	target, ok := w.target(count)
+	if !ok {
+		return false
+	}
+
+	now := w.clock.Now()
+	w.mu.Lock()
+	last, seen := w.woken[tasks.Service]
+	if seen && now.Sub(last.at) < w.window {
+		w.mu.Unlock()
+		return !last.failed
+	}
+	// recorded before the call, so the requests arriving meanwhile don't
+	// make their own
+	w.woken[tasks.Service] = wakeup{at: now}
+	w.mu.Unlock()
+
+	err := ECSRetryPolicy.call(ctx, "UpdateService", func(ctx context.Context) error {
+		_, err := target.Client.UpdateService(ctx, &ecs.UpdateServiceInput{
+			Cluster:      aws.String(target.Cluster),
+			Service:      aws.String(count.Service),
+			DesiredCount: aws.Int32(w.desired),
+		})
+		return err
+	})
+	if err != nil {
+		wakeups.WithLabelValues(tasks.Service, "error").Inc()
+		slog.ErrorContext(ctx, "Failed to wake service", "service", tasks.Service, "cluster", target.Cluster, "region", target.Region, "error", err)
+		w.mu.Lock()
+		w.woken[tasks.Service] = wakeup{at: now, failed: true}
+		w.mu.Unlock()
+		return false
+	}
+	wakeups.WithLabelValues(tasks.Service, "ok").Inc()
+	slog.InfoContext(ctx, "Woke service scaled to zero", "org", orgID, "service", tasks.Service, "cluster", target.Cluster,
+		"region", target.Region, "desired", w.desired, "audit", true)
+	return true
+}
+
+// target returns the discovery target of the cluster count was described
+// in.
+func (w *Waker) target(count ServiceTasks) (ClusterTarget, bool) {
+	for _, target := range w.targets {
+		if target.Cluster == count.Cluster && target.Region == count.Region && target.Account == count.Account {
+			return target, true
+		}
+	}
+	return ClusterTarget{}, false
+}
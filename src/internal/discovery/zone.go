@@ -0,0 +1,77 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// azSpillover counts the lookups that went to other availability zones for
+// lack of a healthy backend in the proxy's.
+var azSpillover = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_az_spillover_total",
+	Help: "Lookups sent to another availability zone for lack of a healthy backend in the proxy's.",
+})
+
+// DetectZone returns the availability zone of the task running the proxy,
+// from the ECS task metadata endpoint.
+func DetectZone(ctx context.Context) (string, error) {
+	endpoint := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if endpoint == "" {
+		return "", errors.New("ECS_CONTAINER_METADATA_URI_V4 is not set, not running on ECS")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/task", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("task metadata endpoint answered %s", resp.Status)
+	}
+	var metadata struct {
+		AvailabilityZone string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return "", fmt.Errorf("invalid task metadata: %w", err)
+	}
+	if metadata.AvailabilityZone == "" {
+		return "", errors.New("task metadata has no availability zone")
+	}
+	return metadata.AvailabilityZone, nil
+}
+
+// preferZone returns the backends in zone, or all of them when none is.
+// Falling back is counted as a spillover unless none of the backends has a
+// known zone, such as static routes.
+func preferZone(backends []ECSService, zone string) []ECSService {
+	if zone == "" {
+		return backends
+	}
+	var local []ECSService
+	known := false
+	for _, backend := range backends {
+		known = known || backend.Zone != ""
+		if backend.Zone == zone {
+			local = append(local, backend)
+		}
+	}
+	if len(local) > 0 {
+		return local
+	}
+	if known {
+		azSpillover.Inc()
+	}
+	return backends
+}
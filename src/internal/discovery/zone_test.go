@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestZoneAffinity(t *testing.T) {
+	// acme has two tasks in each of two zones
+	var services []ECSService
+	for i, zone := range []string{"us-west-2a", "us-west-2a", "us-west-2b", "us-west-2b"} {
+		services = append(services, ECSService{
+			Name:    "acme",
+			IP:      fmt.Sprintf("10.0.0.%d", i+1),
+			Port:    8080,
+			TaskArn: discoverytest.TaskARN("tenants", fmt.Sprint(i)),
+			Zone:    zone,
+		})
+	}
+	routes := NewRouteTable(services, nil, config.LBStrategyRoundRobin)
+	routes.SetZone("us-west-2a")
+	// lookups returns how many of n lookups of acme went to each IP.
+	lookups := func(n int) map[string]int {
+		t.Helper()
+		ips := map[string]int{}
+		for i := 0; i < n; i++ {
+			svc, err := routes.Lookup("acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips[svc.IP]++
+		}
+		return ips
+	}
+
+	// the backends of the proxy's zone take every request, evenly
+	spillover := telemetrytest.CounterValue(t, azSpillover)
+	if ips := lookups(20); len(ips) != 2 || ips["10.0.0.1"] != 10 || ips["10.0.0.2"] != 10 {
+		t.Errorf("lookups with both zones healthy went to %v, want 10 to each backend of us-west-2a", ips)
+	}
+	if n := telemetrytest.CounterValue(t, azSpillover) - spillover; n != 0 {
+		t.Errorf("%v spillovers counted with the local zone healthy", n)
+	}
+
+	// and spill over once they are all drained
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, err := routes.Drain(ip, 0, true, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ips := lookups(20); len(ips) != 2 || ips["10.0.0.3"] != 10 || ips["10.0.0.4"] != 10 {
+		t.Errorf("lookups with us-west-2a drained went to %v, want 10 to each backend of us-west-2b", ips)
+	}
+	if n := telemetrytest.CounterValue(t, azSpillover) - spillover; n != 20 {
+		t.Errorf("%v spillovers counted, want 20", n)
+	}
+
+	// without a zone every backend is used
+	routes = NewRouteTable(services, nil, config.LBStrategyRoundRobin)
+	if ips := lookups(20); len(ips) != 4 {
+		t.Errorf("lookups without a zone went to %v, want every backend", ips)
+	}
+}
+
+func TestDetectZone(t *testing.T) {
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/task" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"Cluster": "proxy", "AvailabilityZone": "us-west-2b"}`)
+	}))
+	defer metadata.Close()
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", metadata.URL)
+	if zone, err := DetectZone(context.Background()); err != nil || zone != "us-west-2b" {
+		t.Errorf("DetectZone() = %q, %v, want us-west-2b", zone, err)
+	}
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", "")
+	if _, err := DetectZone(context.Background()); err == nil {
+		t.Error("DetectZone() off ECS succeeded")
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// requestInfo is what the handlers learn about a request that the
+// middlewares around them report.
+type requestInfo struct {
+	outcome string
+	backend string
+	// task is the ID of the task of the backend.
+	task string
+	// org is set once the request was routed.
+	org string
+	// debugTarget is the task the debug headers pinned the request to.
+	debugTarget string
+	// lookup, refresh and upstream are the time spent routing the request,
+	// the part of it refreshing the routes, and waiting for backends.
+	lookup, refresh, upstream time.Duration
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns r carrying a requestInfo, the one it already
+// carries if any.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return r, info
+	}
+	info := &requestInfo{outcome: telemetry.OutcomeHit}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// setOutcome records the routing outcome of a request.
+func setOutcome(r *http.Request, outcome string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.outcome = outcome
+	}
+}
+
+// setBackend records the backend a request of org was sent to, at address
+// in the task of taskArn.
+func setBackend(r *http.Request, org, address, taskArn string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.org, info.backend, info.task = org, address, discovery.TaskID(taskArn)
+	}
+}
+
+// AccessLog logs one event per request at level with its method, path,
+// client address, org taken from header, backend and its task, tracing
+// headers, status, response size and duration. Query strings, bodies and other headers are
+// left out as they may carry credentials.
+func AccessLog(next http.Handler, header string, level slog.Level) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		slog.Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"client_ip", clientIP(r),
+			"org", strings.TrimSpace(r.Header.Get(header)),
+			"backend", info.backend,
+			"task", info.task,
+			"debug_target", info.debugTarget,
+			slog.Group("trace", traceLogAttrs(traceHeadersFrom(r.Context()))...),
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration", time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status and size of the response written to
+// a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// maxLoggedPathLength is the longest path logged for slow requests.
+const maxLoggedPathLength = 256
+
+// LogSlowRequests logs at warn every request that took longer than
+// threshold in total, or whose backend did, with the time spent in each
+// phase.
+func LogSlowRequests(next http.Handler, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		total := time.Since(start)
+		if total <= threshold && info.upstream <= threshold {
+			return
+		}
+		path := r.URL.Path
+		if len(path) > maxLoggedPathLength {
+			path = path[:maxLoggedPathLength] + "..."
+		}
+		slog.WarnContext(r.Context(), "Slow request",
+			"org", info.org,
+			"backend", info.backend,
+			"path", path,
+			"status", recorder.status,
+			"duration", total,
+			"lookup", info.lookup,
+			"refresh", info.refresh,
+			"upstream", info.upstream)
+	})
+}
+
+// addUpstream adds the time a backend took to answer to the request's
+// upstream phase.
+func addUpstream(r *http.Request, d time.Duration) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.upstream += d
+	}
+}
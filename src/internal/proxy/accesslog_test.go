@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestAccessLog(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": config.ProxyModeForward})
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("hello")), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(transport, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	handler := AccessLog(proxy.Handler, "X-Org-ID", slog.LevelInfo)
+
+	for _, tt := range []struct {
+		name    string
+		org     string
+		status  int
+		backend string
+		task    string
+	}{
+		{name: "routed", org: "acme", status: http.StatusOK, backend: "10.0.0.1:80", task: "a1"},
+		{name: "missing header", status: http.StatusBadRequest},
+		{name: "unknown org", org: "initech", status: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logged.Reset()
+			r := httptest.NewRequest(http.MethodPost, "http://proxy.example.com/orders?token=s3cr3t", strings.NewReader(`{"card":"4111"}`))
+			if tt.org != "" {
+				r.Header.Set("X-Org-ID", tt.org)
+			}
+			r.Header.Set("Authorization", "Bearer s3cr3t")
+			r.Header.Set("Cookie", "session=s3cr3t")
+			r.RemoteAddr = "192.0.2.7:51234"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d: %s, want %d", w.Code, w.Body, tt.status)
+			}
+			// the refresh of a miss logs too
+			var records []map[string]any
+			for _, record := range logRecords(t, &logged) {
+				if record["msg"] == "Request" {
+					records = append(records, record)
+				}
+			}
+			if len(records) != 1 {
+				t.Fatalf("%d access records, want one per request: %s", len(records), &logged)
+			}
+			record := records[0]
+			for key, want := range map[string]any{
+				"level":     "INFO",
+				"method":    http.MethodPost,
+				"path":      "/orders",
+				"client_ip": "192.0.2.7",
+				"org":       tt.org,
+				"backend":   tt.backend,
+				"task":      tt.task,
+				"status":    float64(tt.status),
+				"bytes":     float64(w.Body.Len()),
+			} {
+				if record[key] != want {
+					t.Errorf("%s %v, want %v", key, record[key], want)
+				}
+			}
+			if _, ok := record["duration"].(float64); !ok {
+				t.Errorf("duration %v, want it logged", record["duration"])
+			}
+			// the query, body and credentials stay out
+			if strings.Contains(logged.String(), "s3cr3t") || strings.Contains(logged.String(), "4111") {
+				t.Errorf("record %s gives the request's secrets away", &logged)
+			}
+		})
+	}
+
+	// at debug, production loggers drop the access log
+	logged.Reset()
+	quiet := AccessLog(proxy.Handler, "X-Org-ID", slog.LevelDebug)
+	quiet.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil))
+	if logged.Len() > 0 {
+		t.Errorf("debug access log written at info: %s", &logged)
+	}
+}
+
+func TestLogSlowRequests(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": config.ProxyModeForward})
+	// the backend of globex is slow
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Hostname() == "10.0.1.1" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(&LatencyTransport{Next: transport}, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	handler := LogSlowRequests(proxy.Handler, 20*time.Millisecond)
+	// send sends a request of org for path and returns the slow request
+	// records logged.
+	send := func(org, path string) []map[string]any {
+		t.Helper()
+		logged.Reset()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com"+path, nil)
+		r.Header.Set("X-Org-ID", org)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", org, w.Code, w.Body)
+		}
+		return logRecords(t, &logged)
+	}
+	// phase returns the duration of a phase in record.
+	phase := func(record map[string]any, name string) time.Duration {
+		d, _ := record[name].(float64)
+		return time.Duration(d)
+	}
+
+	if records := send("acme", "/orders"); len(records) != 0 {
+		t.Errorf("fast request logged as slow: %v", records)
+	}
+
+	// a slow backend, its path cut short
+	records := send("globex", "/"+strings.Repeat("a", 300))
+	if len(records) != 1 {
+		t.Fatalf("%d records of a slow backend, want 1", len(records))
+	}
+	record := records[0]
+	if record["level"] != "WARN" || record["msg"] != "Slow request" || record["org"] != "globex" || record["backend"] != "10.0.1.1:80" || record["status"] != float64(http.StatusOK) {
+		t.Errorf("slow backend logged %v", record)
+	}
+	if path, _ := record["path"].(string); len(path) != maxLoggedPathLength+3 || !strings.HasSuffix(path, "...") {
+		t.Errorf("path %q, want it cut at %d", path, maxLoggedPathLength)
+	}
+	if upstream, total := phase(record, "upstream"), phase(record, "duration"); upstream < 60*time.Millisecond || total < upstream || phase(record, "lookup") >= upstream || phase(record, "refresh") != 0 {
+		t.Errorf("phases of a slow backend: %v", record)
+	}
+
+	// a slow refresh of a miss
+	fake.Latency = 10 * time.Millisecond
+	fake.AddService("tenants", "hooli")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "hooli", "h1", "10.0.2.1"))
+	records = send("hooli", "/orders")
+	if len(records) != 1 {
+		t.Fatalf("%d records of a slow refresh, want 1", len(records))
+	}
+	record = records[0]
+	if refresh, lookup := phase(record, "refresh"), phase(record, "lookup"); refresh < 20*time.Millisecond || lookup < refresh || phase(record, "upstream") >= refresh {
+		t.Errorf("phases of a slow refresh: %v", record)
+	}
+}
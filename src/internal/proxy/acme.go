@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeHostPolicy allows certificates for the host names of domains only, so
+// a client sending any other SNI name can't make the proxy request one.
+func acmeHostPolicy(domains []string) autocert.HostPolicy {
+	exact := map[string]bool{}
+	var wildcards []string
+	for _, domain := range domains {
+		if suffix, ok := strings.CutPrefix(domain, "*"); ok {
+			wildcards = append(wildcards, suffix)
+		} else {
+			exact[domain] = true
+		}
+	}
+	return func(_ context.Context, host string) error {
+		host = strings.ToLower(host)
+		if exact[host] {
+			return nil
+		}
+		for _, suffix := range wildcards {
+			// the wildcard stands for exactly one label
+			if label, ok := strings.CutSuffix(host, suffix); ok && label != "" && !strings.Contains(label, ".") {
+				return nil
+			}
+		}
+		return fmt.Errorf("host %q is not in ACME_DOMAINS", host)
+	}
+}
+
+// NewACMEManager returns a manager obtaining certificates for domains from
+// the ACME directory at directoryURL, Let's Encrypt if it is empty, and
+// keeping them in cache.
+func NewACMEManager(domains []string, email, directoryURL string, cache autocert.Cache) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: acmeHostPolicy(domains),
+		Cache:      cache,
+		Email:      email,
+	}
+	if directoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return manager
+}
+
+// NewACMECache returns the cache of ACME_CACHE, an S3 location or a
+// directory. The S3 client is only created for an S3 location.
+func NewACMECache(location string, client func() S3API) autocert.Cache {
+	path, ok := strings.CutPrefix(location, config.S3CacheScheme)
+	if !ok {
+		return autocert.DirCache(location)
+	}
+	bucket, prefix, _ := strings.Cut(path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &s3Cache{client: client(), bucket: bucket, prefix: prefix}
+}
+
+// S3API is the part of the S3 client s3Cache uses.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// s3Cache keeps the ACME account key and certificates as objects under
+// prefix in bucket, so the replicas of the proxy share them instead of each
+// requesting its own and running into the issuance rate limits.
+type s3Cache struct {
+	client S3API
+	bucket string
+	prefix string
+}
+
+func (c *s3Cache) Get(ctx context.Context, name string) ([]byte, error) {
+	out, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.prefix + name),
+	})
+	var missing *types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (c *s3Cache) Put(ctx context.Context, name string, data []byte) error {
+	_, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.prefix + name),
+		Body:   bytes.NewReader(data),
+		// the objects hold private keys
+		ServerSideEncryption: types.ServerSideEncryptionAes256,
+	})
+	return err
+}
+
+func (c *s3Cache) Delete(ctx context.Context, name string) error {
+	_, err := c.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(c.prefix + name),
+	})
+	return err
+}
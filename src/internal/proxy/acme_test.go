@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// fakeS3 keeps the objects of s3Cache in memory, by bucket/key.
+type fakeS3 struct {
+	objects map[string][]byte
+	// encrypted are the objects put with server side encryption.
+	encrypted map[string]bool
+}
+
+func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	key := aws.ToString(params.Bucket) + "/" + aws.ToString(params.Key)
+	f.objects[key] = data
+	f.encrypted[key] = params.ServerSideEncryption == types.ServerSideEncryptionAes256
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(_ context.Context, params *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestNewACMEManager(t *testing.T) {
+	// the directory is never reached for the hosts the policy turns down
+	var directoryCalls int
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		directoryCalls++
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(directory.Close)
+	dir := t.TempDir()
+	cfg, err := config.Load(map[string]string{
+		"ECS_CLUSTER":        "tenants",
+		"ACME_DOMAINS":       "Proxy.Example.com, *.tenants.example.com",
+		"ACME_EMAIL":         "ops@example.com",
+		"ACME_CACHE":         dir,
+		"ACME_DIRECTORY_URL": directory.URL,
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Created := false
+	cache := NewACMECache(cfg.ACMECache, func() S3API {
+		s3Created = true
+		return nil
+	})
+	manager := NewACMEManager(cfg.ACMEDomains, cfg.ACMEEmail, cfg.ACMEDirectoryURL, cache)
+	if manager.Email != "ops@example.com" || manager.Client == nil || manager.Client.DirectoryURL != directory.URL || manager.Prompt == nil || !manager.Prompt("https://example.com/tos") {
+		t.Errorf("manager %+v, want the email, directory and terms accepted", manager)
+	}
+	if _, ok := cache.(autocert.DirCache); !ok || s3Created {
+		t.Errorf("cache of a directory %T, S3 client created %t", cache, s3Created)
+	}
+	if NewACMEManager(cfg.ACMEDomains, "", "", cache).Client != nil {
+		t.Error("manager without a directory doesn't default to Let's Encrypt")
+	}
+
+	for host, allowed := range map[string]bool{
+		"proxy.example.com":          true,
+		"PROXY.example.com":          true,
+		"acme.tenants.example.com":   true,
+		"tenants.example.com":        false,
+		"a.acme.tenants.example.com": false,
+		"other.example.com":          false,
+		"proxy.example.com.evil.io":  false,
+	} {
+		if err := manager.HostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("policy for %s = %v, want allowed %t", host, err, allowed)
+		}
+	}
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil || directoryCalls != 0 {
+		t.Errorf("certificate of a host out of ACME_DOMAINS = %v, %d calls to the directory", err, directoryCalls)
+	}
+
+	// the directory cache keeps the keys and certificates as files
+	if err := cache.Put(context.Background(), "proxy.example.com", []byte("pem")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "proxy.example.com")); err != nil || string(data) != "pem" {
+		t.Errorf("cached file %q, %v", data, err)
+	}
+}
+
+func TestACMES3Cache(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, encrypted: map[string]bool{}}
+	ctx := context.Background()
+	for location, want := range map[string]string{
+		"s3://certs/ecs-svc-proxy/acme": "certs/ecs-svc-proxy/acme/",
+		"s3://certs/acme/":              "certs/acme/",
+		"s3://certs":                    "certs/",
+	} {
+		cache := NewACMECache(location, func() S3API { return fake })
+		if _, err := cache.Get(ctx, "acme_account+key"); !errors.Is(err, autocert.ErrCacheMiss) {
+			t.Errorf("%s: Get of a missing object = %v, want a cache miss", location, err)
+		}
+		if err := cache.Put(ctx, "acme_account+key", []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+		if string(fake.objects[want+"acme_account+key"]) != "key" || !fake.encrypted[want+"acme_account+key"] {
+			t.Errorf("%s: objects %v, want the key encrypted under %s", location, fake.objects, want)
+		}
+		if data, err := cache.Get(ctx, "acme_account+key"); err != nil || string(data) != "key" {
+			t.Errorf("%s: Get = %q, %v", location, data, err)
+		}
+		if err := cache.Delete(ctx, "acme_account+key"); err != nil || len(fake.objects) != 0 {
+			t.Errorf("%s: Delete = %v, objects left %v", location, err, fake.objects)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/buildinfo"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// NewAdminHandler serves the operator endpoints of the admin listener: the
+// Prometheus metrics at metricsPath, the expvar counters, the route table,
+// the state of every backend, an export of the routing state, the build, the
+// deep health check, and the pprof profiles when enablePprof is set. Only the
+// metrics are also served by the tenant-facing listener, when there is no
+// admin port.
+//
+// With a token every endpoint requires it as a bearer token, and the ones
+// changing the proxy's state, POST /admin/refresh, /admin/overrides,
+// /admin/backends, /admin/maintenance and /admin/import, are served.
+// Without one they don't exist, so they can't be left open by mistake. A
+// refresh is waited for up to refreshTimeout.
+func NewAdminHandler(metricsPath string, routes *discovery.RouteTable, refresher *discovery.Refresher, overrides *discovery.RouteOverrides, maintenance *MaintenanceWindows, enablePprof bool, token string, refreshTimeout time.Duration, deep http.Handler) http.Handler {
+	transfer := &stateTransfer{routes: routes, overrides: overrides, maintenance: maintenance}
+	admin := http.NewServeMux()
+	admin.Handle(metricsPath, telemetry.MetricsHandler())
+	admin.Handle("/debug/vars", expvar.Handler())
+	admin.Handle("/debug/routes", routesHandler(routes, maintenance))
+	admin.Handle("/admin/backends", backendsListHandler(routes))
+	admin.Handle("/admin/export", exportHandler(transfer))
+	admin.HandleFunc("/version", serveVersion)
+	admin.Handle("/healthz/deep", deep)
+	if enablePprof {
+		admin.HandleFunc("/debug/pprof/", pprof.Index)
+		admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	if token == "" {
+		return admin
+	}
+	admin.Handle("/admin/refresh", refreshHandler(routes, refresher, refreshTimeout))
+	admin.Handle("/admin/overrides", overridesHandler(overrides))
+	admin.Handle("/admin/overrides/", overridesHandler(overrides))
+	admin.Handle("/admin/backends/", backendsHandler(routes))
+	admin.Handle("/admin/maintenance", maintenanceHandler(maintenance))
+	admin.Handle("/admin/maintenance/", maintenanceHandler(maintenance))
+	admin.Handle("/admin/import", importHandler(transfer))
+	return requireAdminToken(admin, token)
+}
+
+// refreshResponse is the outcome of an admin refresh.
+type refreshResponse struct {
+	// Service is the ECS service refreshed, empty for a full refresh.
+	Service    string         `json:"service,omitempty"`
+	BuiltAt    time.Time      `json:"built_at"`
+	Routes     int            `json:"routes"`
+	DurationMS int64          `json:"duration_ms"`
+	Added      []refreshEntry `json:"added"`
+	Removed    []refreshEntry `json:"removed"`
+	Changed    []refreshEntry `json:"changed"`
+}
+
+// refreshEntry is a route entry a refresh changed. Previous is the address
+// it had before, for a changed one.
+type refreshEntry struct {
+	Service  string `json:"service"`
+	Task     string `json:"task"`
+	Backend  string `json:"backend"`
+	Previous string `json:"previous,omitempty"`
+	Cluster  string `json:"cluster"`
+	Region   string `json:"region"`
+}
+
+func newRefreshEntry(svc discovery.ECSService, previous string) refreshEntry {
+	return refreshEntry{Service: svc.Name, Task: svc.TaskArn, Backend: svc.Address(), Previous: previous, Cluster: svc.Cluster, Region: svc.Region}
+}
+
+// refreshHandler rediscovers the routes on POST, sharing a refresh already
+// in flight, or only the tasks of the ECS service named by the service
+// query parameter. It waits up to timeout and answers with what changed, a
+// 502 if discovery failed, in which case the routes are kept, or a 504 if
+// it is still running, in which case it goes on in the background.
+func refreshHandler(routes *discovery.RouteTable, refresher *discovery.Refresher, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST is allowed")
+			return
+		}
+		service := r.URL.Query().Get("service")
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		start := time.Now()
+		var diff discovery.RouteDiff
+		var err error
+		if service == "" {
+			diff, err = refresher.Rebuild(ctx, discovery.TriggerAdmin)
+		} else {
+			diff, err = refresher.RefreshService(ctx, service, discovery.TriggerAdmin)
+		}
+		duration := time.Since(start)
+		if r.Context().Err() != nil {
+			// the operator went away, no one to answer
+			return
+		}
+		switch {
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil:
+			slog.WarnContext(r.Context(), "Admin refresh timed out, it goes on in the background", "service", service, "timeout", timeout, "audit", true)
+			writeError(w, r, http.StatusGatewayTimeout, errCodeRefreshTimeout, "Refresh didn't finish in "+timeout.String()+", it goes on in the background")
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Admin refresh failed, serving the previous routes", "service", service, "error", err, "audit", true)
+			writeError(w, r, http.StatusBadGateway, errCodeDiscoveryFailed, "Discovery failed: "+err.Error())
+			return
+		}
+		slog.InfoContext(r.Context(), "Admin refresh", "service", service, "added", len(diff.Added), "removed", len(diff.Removed),
+			"changed", len(diff.Changed), "duration", duration, "audit", true)
+		response := refreshResponse{
+			Service:    service,
+			BuiltAt:    routes.BuiltAt(),
+			Routes:     len(routes.Services()),
+			DurationMS: duration.Milliseconds(),
+			Added:      []refreshEntry{},
+			Removed:    []refreshEntry{},
+			Changed:    []refreshEntry{},
+		}
+		for _, svc := range diff.Added {
+			response.Added = append(response.Added, newRefreshEntry(svc, ""))
+		}
+		for _, svc := range diff.Removed {
+			response.Removed = append(response.Removed, newRefreshEntry(svc, ""))
+		}
+		for _, change := range diff.Changed {
+			response.Changed = append(response.Changed, newRefreshEntry(change.New, change.Old.Address()))
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+// requireAdminToken answers admin requests without token as their bearer
+// token with a 401, and logs the others to the audit log with the address
+// they came from. Hashing both sides makes the comparison take as long
+// whatever the length of the token sent.
+func requireAdminToken(next http.Handler, token string) http.Handler {
+	want := sha256.Sum256([]byte(token))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := adminSource(r)
+		sent, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || sent == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized, errCodeMissingToken, "Missing admin token")
+			return
+		}
+		got := sha256.Sum256([]byte(sent))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Rejected admin token", source) {
+				slog.WarnContext(r.Context(), "Rejected admin token", "action", r.Method+" "+r.URL.Path, "source", source)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidToken, "Invalid admin token")
+			return
+		}
+		slog.InfoContext(r.Context(), "Admin call", "action", r.Method+" "+r.URL.Path, "source", source, "audit", true)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminSource returns the address an admin request came from.
+func adminSource(r *http.Request) string {
+	return clientIP(r)
+}
+
+// serveVersion answers with the build of the proxy as JSON.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildinfo.Get())
+}
@@ -0,0 +1,515 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/buildinfo"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+func TestAdminToken(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, nil)
+	protected, open := proxy.admin("s3cret"), proxy.admin("")
+
+	// the audit log records the authenticated calls
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+
+	for _, tt := range []struct {
+		name string
+		// protected is whether the proxy has a token.
+		protected bool
+		method    string
+		path      string
+		token     string
+		want      int
+		// challenge is the WWW-Authenticate header of a 401.
+		challenge string
+	}{
+		{name: "read with the token", protected: true, method: http.MethodGet, path: "/debug/routes", token: "s3cret", want: http.StatusOK},
+		{name: "read with an invalid token", protected: true, method: http.MethodGet, path: "/debug/routes", token: "guess", want: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "read with a token's prefix", protected: true, method: http.MethodGet, path: "/debug/routes", token: "s3c", want: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "read without a token", protected: true, method: http.MethodGet, path: "/debug/routes", want: http.StatusUnauthorized, challenge: "Bearer"},
+		{name: "read with no token set", method: http.MethodGet, path: "/debug/routes", want: http.StatusOK},
+		{name: "refresh with the token", protected: true, method: http.MethodPost, path: "/admin/refresh", token: "s3cret", want: http.StatusOK},
+		{name: "refresh with an invalid token", protected: true, method: http.MethodPost, path: "/admin/refresh", token: "guess", want: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "refresh without a token", protected: true, method: http.MethodPost, path: "/admin/refresh", want: http.StatusUnauthorized, challenge: "Bearer"},
+		// without a token the mutating endpoints don't exist
+		{name: "refresh with no token set", method: http.MethodPost, path: "/admin/refresh", want: http.StatusNotFound},
+		{name: "refresh with a token and no token set", method: http.MethodPost, path: "/admin/refresh", token: "s3cret", want: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logged.Reset()
+			listed := fake.Count("ListServices")
+			r := httptest.NewRequest(tt.method, "http://admin.example.com"+tt.path, nil)
+			r.RemoteAddr = "192.0.2.7:41000"
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler := open
+			if tt.protected {
+				handler = protected
+			}
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("WWW-Authenticate %q, want %q", got, tt.challenge)
+			}
+			refreshed := fake.Count("ListServices") > listed
+			if want := tt.path == "/admin/refresh" && tt.want == http.StatusOK; refreshed != want {
+				t.Errorf("refreshed = %v, want %v", refreshed, want)
+			}
+			audited := strings.Contains(logged.String(), `msg="Admin call" action="`+tt.method+" "+tt.path+`" source=192.0.2.7 audit=true`)
+			if want := tt.protected && tt.want != http.StatusUnauthorized; audited != want {
+				t.Errorf("audited = %v, want %v; logged:\n%s", audited, want, logged.String())
+			}
+		})
+	}
+}
+
+// admin returns the admin handler of the proxy requiring token.
+func (p *testProxy) admin(token string) http.Handler {
+	deep := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	return NewAdminHandler("/metrics", p.Routes, p.Refresher, p.overrides, p.Live.Maintenance(), false, token, time.Second, deep)
+}
+
+// adminDo sends a method request of path with body, if any, to admin with
+// token as its bearer token.
+func adminDo(admin http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://admin.example.com"+path, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.7:41000"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminRefresh(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, nil)
+	admin := proxy.admin("s3cret")
+
+	for _, tt := range []struct {
+		name, method, path, token string
+		want                      int
+	}{
+		{name: "GET", method: http.MethodGet, path: "/admin/refresh", token: "s3cret", want: http.StatusMethodNotAllowed},
+		{name: "without the token", method: http.MethodPost, path: "/admin/refresh", want: http.StatusUnauthorized},
+		{name: "with another token", method: http.MethodPost, path: "/admin/refresh", token: "guess", want: http.StatusUnauthorized},
+		{name: "outside /admin/", method: http.MethodPost, path: "/refresh", token: "s3cret", want: http.StatusNotFound},
+	} {
+		listed := fake.Count("ListServices")
+		w := adminDo(admin, tt.method, tt.path, tt.token, "")
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+		if tt.want == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("%s: Allow %q", tt.name, w.Header().Get("Allow"))
+		}
+		if fake.Count("ListServices") != listed {
+			t.Errorf("%s: refreshed the routes", tt.name)
+		}
+	}
+
+	// a refresh answers with what changed
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "a1"))
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	w := adminDo(admin, http.MethodPost, "/admin/refresh", "s3cret", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var response refreshResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	backends := func(entries []refreshEntry) []string {
+		var backends []string
+		for _, entry := range entries {
+			backends = append(backends, entry.Service+" "+entry.Backend)
+		}
+		sort.Strings(backends)
+		return backends
+	}
+	if response.Routes != 2 || response.BuiltAt.IsZero() || response.Service != "" {
+		t.Errorf("response %+v, want the 2 routes of a full refresh", response)
+	}
+	if got := backends(response.Added); !reflect.DeepEqual(got, []string{"acme 10.0.0.2:80", "globex 10.0.1.1:80"}) {
+		t.Errorf("added %v", got)
+	}
+	if got := backends(response.Removed); !reflect.DeepEqual(got, []string{"acme 10.0.0.1:80"}) {
+		t.Errorf("removed %v", got)
+	}
+	if len(response.Changed) != 0 {
+		t.Errorf("changed %v, want none", response.Changed)
+	}
+	if w := proxy.get("/orders", "globex"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("globex after the refresh: status %d", w.Code)
+	}
+
+	// so does the refresh of one service, which fails like discovery
+	fake.FailNext("ListTasks", discoverytest.AccessDenied())
+	if w := adminDo(admin, http.MethodPost, "/admin/refresh?service=acme", "s3cret", ""); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), errCodeDiscoveryFailed) {
+		t.Errorf("failed refresh: status %d: %s", w.Code, w.Body)
+	}
+	if w := adminDo(admin, http.MethodPost, "/admin/refresh?service=acme", "s3cret", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"service":"acme"`) {
+		t.Errorf("refresh of acme: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminOverrides(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, nil)
+	admin := proxy.admin("s3cret")
+	location := func() string {
+		return proxy.get("/orders", "acme").Header().Get("Location")
+	}
+
+	w := adminDo(admin, http.MethodPut, "/admin/overrides/acme", "s3cret", `{"target": "10.9.9.9:8080", "ttl": "30m"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"target":"10.9.9.9:8080"`) {
+		t.Fatalf("PUT: status %d: %s", w.Code, w.Body)
+	}
+	if got := location(); got != "http://10.9.9.9:8080/orders" {
+		t.Errorf("Location %q with the override", got)
+	}
+	w = adminDo(admin, http.MethodGet, "/admin/overrides", "s3cret", "")
+	var listed []discovery.RouteOverride
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].Org != "acme" || listed[0].Expires == nil || listed[0].Caller != "192.0.2.7" {
+		t.Errorf("GET: %s, %v", w.Body, err)
+	}
+
+	for _, tt := range []struct {
+		name, method, path, body string
+		want                     int
+		code                     string
+	}{
+		{name: "malformed body", method: http.MethodPut, path: "/admin/overrides/acme", body: `{"target":`, want: http.StatusBadRequest, code: errCodeInvalidOverride},
+		{name: "target without port", method: http.MethodPut, path: "/admin/overrides/acme", body: `{"target": "10.9.9.8"}`, want: http.StatusBadRequest, code: errCodeInvalidOverride},
+		{name: "public target", method: http.MethodPut, path: "/admin/overrides/acme", body: `{"target": "8.8.8.8:80"}`, want: http.StatusBadRequest, code: errCodeInvalidOverride},
+		{name: "negative ttl", method: http.MethodPut, path: "/admin/overrides/acme", body: `{"target": "10.9.9.8:80", "ttl": "-1m"}`, want: http.StatusBadRequest, code: errCodeInvalidOverride},
+		{name: "POST", method: http.MethodPost, path: "/admin/overrides/acme", body: `{"target": "10.9.9.8:80"}`, want: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed},
+		{name: "outside /admin/", method: http.MethodPut, path: "/overrides/acme", body: `{"target": "10.9.9.8:80"}`, want: http.StatusNotFound},
+	} {
+		w := adminDo(admin, tt.method, tt.path, "s3cret", tt.body)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+			t.Errorf("%s: status %d, want %d %s: %s", tt.name, w.Code, tt.want, tt.code, w.Body)
+		}
+	}
+	// the override in place is kept
+	if got := location(); got != "http://10.9.9.9:8080/orders" {
+		t.Errorf("Location %q after the invalid changes", got)
+	}
+
+	if w := adminDo(admin, http.MethodDelete, "/admin/overrides/acme", "s3cret", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: status %d: %s", w.Code, w.Body)
+	}
+	if got := location(); got != "http://10.0.0.1:80/orders" {
+		t.Errorf("Location %q once the override is removed, want the discovered task", got)
+	}
+	if w := adminDo(admin, http.MethodDelete, "/admin/overrides/acme", "s3cret", ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), errCodeUnknownOverride) {
+		t.Errorf("DELETE without an override: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	proxy := newTestProxy(t, fake, nil)
+	admin := proxy.admin("s3cret")
+	selected := func() map[string]int {
+		selected := map[string]int{}
+		for i := 0; i < 10; i++ {
+			selected[proxy.get("/orders", "acme").Header().Get("Location")]++
+		}
+		return selected
+	}
+
+	w := adminDo(admin, http.MethodPost, "/admin/backends/10.0.0.1/drain", "s3cret", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ip":"10.0.0.1"`) {
+		t.Fatalf("drain: status %d: %s", w.Code, w.Body)
+	}
+	if got := selected(); got["http://10.0.0.2:80/orders"] != 10 {
+		t.Errorf("selected %v while 10.0.0.1 is drained, want 10.0.0.2 only", got)
+	}
+
+	for _, tt := range []struct {
+		name, method, path string
+		want               int
+		code               string
+	}{
+		{name: "last backend", method: http.MethodPost, path: "/admin/backends/10.0.0.2/drain", want: http.StatusConflict, code: errCodeLastBackend},
+		{name: "invalid ttl", method: http.MethodPost, path: "/admin/backends/10.0.0.2/drain?ttl=soon", want: http.StatusBadRequest, code: errCodeInvalidDrain},
+		{name: "unknown IP", method: http.MethodPost, path: "/admin/backends/10.0.0.9/drain", want: http.StatusNotFound, code: errCodeUnknownBackend},
+		{name: "not an IP", method: http.MethodPost, path: "/admin/backends/acme/drain", want: http.StatusNotFound, code: errCodeUnknownBackend},
+		{name: "unknown action", method: http.MethodPost, path: "/admin/backends/10.0.0.2/stop", want: http.StatusNotFound, code: errCodeUnknownBackend},
+		{name: "GET", method: http.MethodGet, path: "/admin/backends/10.0.0.2/drain", want: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed},
+		{name: "outside /admin/", method: http.MethodPost, path: "/backends/10.0.0.2/drain", want: http.StatusNotFound},
+	} {
+		w := adminDo(admin, tt.method, tt.path, "s3cret", "")
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+			t.Errorf("%s: status %d, want %d %s: %s", tt.name, w.Code, tt.want, tt.code, w.Body)
+		}
+	}
+	if got := selected(); got["http://10.0.0.2:80/orders"] != 10 {
+		t.Errorf("selected %v after the rejected drains, want 10.0.0.2 only", got)
+	}
+
+	if w := adminDo(admin, http.MethodPost, "/admin/backends/10.0.0.1/enable", "s3cret", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("enable: status %d: %s", w.Code, w.Body)
+	}
+	if got := selected(); got["http://10.0.0.1:80/orders"] == 0 || got["http://10.0.0.2:80/orders"] == 0 {
+		t.Errorf("selected %v once 10.0.0.1 is enabled, want both", got)
+	}
+	if w := adminDo(admin, http.MethodPost, "/admin/backends/10.0.0.1/enable", "s3cret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("enable of a backend in rotation: status %d", w.Code)
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	// acme's task fails its health check, globex's isn't checked and is
+	// drained
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.PortLabel("acme", port)
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "127.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, nil)
+	admin := proxy.admin("s3cret")
+	discovery.NewHealthChecker(proxy.Routes, "/healthz", time.Second, 1, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}).CheckAll(context.Background())
+	if w := adminDo(admin, http.MethodPost, "/admin/backends/10.0.1.1/drain?force=true", "s3cret", ""); w.Code != http.StatusOK {
+		t.Fatalf("drain: status %d: %s", w.Code, w.Body)
+	}
+
+	w := adminDo(admin, http.MethodGet, "/admin/backends", "s3cret", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var list struct {
+		BuiltAt  *time.Time                  `json:"built_at"`
+		Services map[string][]map[string]any `json:"services"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.BuiltAt == nil || len(list.Services) != 2 || len(list.Services["acme"]) != 1 || len(list.Services["globex"]) != 1 {
+		t.Fatalf("backends %s, want one of acme and one of globex", w.Body)
+	}
+	for _, tt := range []struct {
+		service string
+		want    map[string]any
+	}{
+		{service: "acme", want: map[string]any{
+			"ip": "127.0.0.1", "port": float64(port), "task_arn": discoverytest.TaskARN("tenants", "a1"), "revision": 1.0,
+			"state": "unhealthy", "health": "unhealthy", "ejected": false, "latency_outlier": false,
+			"breaker": "closed", "drained": false, "in_flight": 0.0,
+			"source": map[string]any{"cluster": "tenants", "region": discoverytest.Region},
+		}},
+		{service: "globex", want: map[string]any{
+			"ip": "10.0.1.1", "health": "unchecked", "state": "drained", "drained": true, "breaker": "closed",
+		}},
+	} {
+		backend := list.Services[tt.service][0]
+		for field, want := range tt.want {
+			if got := backend[field]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s = %v, want %v", tt.service, field, got, want)
+			}
+		}
+		if seen, err := time.Parse(time.RFC3339Nano, fmt.Sprint(backend["last_seen"])); err != nil || seen.IsZero() {
+			t.Errorf("%s last_seen = %v", tt.service, backend["last_seen"])
+		}
+	}
+
+	// and narrowed to an org or a state
+	for query, want := range map[string]string{"?org=acme": "acme", "?state=drained": "globex", "?state=unhealthy": "acme"} {
+		w := adminDo(admin, http.MethodGet, "/admin/backends"+query, "s3cret", "")
+		var list struct {
+			Services map[string]json.RawMessage `json:"services"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Services) != 1 || list.Services[want] == nil {
+			t.Errorf("%s: %s, want %s's backends only", query, w.Body, want)
+		}
+	}
+	if w := adminDo(admin, http.MethodGet, "/admin/backends?format=table", "s3cret", ""); !strings.HasPrefix(w.Body.String(), "SERVICE") || !strings.Contains(w.Body.String(), "10.0.1.1:80") {
+		t.Errorf("table:\n%s", w.Body)
+	}
+	if w := adminDo(admin, http.MethodGet, "/admin/backends?format=xml", "s3cret", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d", w.Code)
+	}
+	if w := adminDo(admin, http.MethodGet, "/backends", "s3cret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("outside /admin/: status %d", w.Code)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	fake := discoverytest.NewECS()
+	for _, service := range []string{"acme", "globex", "initech"} {
+		fake.AddService("tenants", service)
+		fake.AddTasks("tenants", discoverytest.Task("tenants", service, service[:1]+"1", "10.0.0."+fmt.Sprint(len(service))))
+	}
+	proxy := newTestProxy(t, fake, map[string]string{
+		"RETRY_AFTER": "30s",
+		"MAINTENANCE": `{" Initech ": {"message": "Moving to a new region"}}`,
+		"ORG_TARGETS": "ACME||9000|",
+	})
+	admin := proxy.admin("s3cret")
+
+	w := adminDo(admin, http.MethodPost, "/admin/maintenance/Acme", "s3cret", `{"message": "Migrating, back at 6", "retry_after": "10m"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"source":"admin"`) {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	if w := adminDo(admin, http.MethodPost, "/admin/maintenance/globex", "s3cret", ""); w.Code != http.StatusOK {
+		t.Fatalf("POST without a body: status %d: %s", w.Code, w.Body)
+	}
+	for _, tt := range []struct {
+		org, message, retryAfter string
+	}{
+		{org: "acme", message: "Migrating, back at 6", retryAfter: "600"},
+		{org: "ACME", message: "Migrating, back at 6", retryAfter: "600"},
+		{org: "globex", message: defaultMaintenanceMessage, retryAfter: "30"},
+		{org: "initech", message: "Moving to a new region", retryAfter: "30"},
+		{org: "INITECH", message: "Moving to a new region", retryAfter: "30"},
+	} {
+		w := proxy.get("/orders", tt.org)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("%s: status %d, Retry-After %q, want 503 after %s", tt.org, w.Code, w.Header().Get("Retry-After"), tt.retryAfter)
+		}
+		if body := w.Body.String(); !strings.Contains(body, `"code":"`+errCodeMaintenance+`"`) || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: body %s, want the message %q", tt.org, body, tt.message)
+		}
+	}
+	var listed []config.MaintenanceWindow
+	w = adminDo(admin, http.MethodGet, "/admin/maintenance", "s3cret", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 3 {
+		t.Errorf("GET: %s, %v, want the 3 windows", w.Body, err)
+	}
+
+	for _, tt := range []struct {
+		name, method, path, body string
+		want                     int
+		code                     string
+	}{
+		{name: "malformed body", method: http.MethodPost, path: "/admin/maintenance/acme", body: `{"message":`, want: http.StatusBadRequest, code: errCodeBadMaintenance},
+		{name: "invalid retry_after", method: http.MethodPost, path: "/admin/maintenance/acme", body: `{"retry_after": "soon"}`, want: http.StatusBadRequest, code: errCodeBadMaintenance},
+		{name: "past until", method: http.MethodPost, path: "/admin/maintenance/acme", body: `{"until": "2020-01-01T00:00:00Z"}`, want: http.StatusBadRequest, code: errCodeBadMaintenance},
+		{name: "configured window", method: http.MethodDelete, path: "/admin/maintenance/initech", want: http.StatusNotFound, code: errCodeNoMaintenance},
+		{name: "PUT", method: http.MethodPut, path: "/admin/maintenance/acme", want: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed},
+		{name: "outside /admin/", method: http.MethodPost, path: "/maintenance/initech", want: http.StatusNotFound},
+	} {
+		w := adminDo(admin, tt.method, tt.path, "s3cret", tt.body)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.code) {
+			t.Errorf("%s: status %d, want %d %s: %s", tt.name, w.Code, tt.want, tt.code, w.Body)
+		}
+	}
+
+	// lifting is case insensitive too, and the org's target applies again
+	if w := adminDo(admin, http.MethodDelete, "/admin/maintenance/ACME", "s3cret", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: status %d: %s", w.Code, w.Body)
+	}
+	if w := proxy.get("/orders", "acme"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://10.0.0.4:9000/orders" {
+		t.Errorf("acme once lifted: status %d to %q, want its ORG_TARGETS port", w.Code, w.Header().Get("Location"))
+	}
+	if w := adminDo(admin, http.MethodDelete, "/admin/maintenance/acme", "s3cret", ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), errCodeNoMaintenance) {
+		t.Errorf("DELETE once lifted: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminTokenSecret(t *testing.T) {
+	load := func(client config.SecretsAPI) (config.Config, error) {
+		secrets := config.NewSecretResolver(func(string) (config.SecretsAPI, error) { return client, nil })
+		return config.Load(map[string]string{
+			"ECS_CLUSTER": "tenants",
+			"ADMIN_ADDR":  "127.0.0.1:9901",
+			"ADMIN_TOKEN": "secretsmanager:proxy/admin",
+		}, "", secrets)
+	}
+	cfg, err := load(&fakeSecrets{value: " s3cret\n", version: "v1"})
+	if err != nil || cfg.AdminToken != "s3cret" {
+		t.Errorf("ADMIN_TOKEN = %q, %v", cfg.AdminToken, err)
+	}
+	if got := cfg.Settings["ADMIN_TOKEN"]; got != "secretsmanager:proxy/admin (version v1)" {
+		t.Errorf("ADMIN_TOKEN setting %q, want the reference", got)
+	}
+	if _, err := load(&fakeSecrets{value: "\n"}); err == nil {
+		t.Error("empty secret accepted as the admin token")
+	}
+	// a secret that can't be read fails startup rather than leave the
+	// mutating endpoints off
+	if _, err := load(failingSecrets{}); err == nil {
+		t.Error("unreadable secret accepted")
+	}
+}
+
+type failingSecrets struct{}
+
+func (failingSecrets) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	return nil, errors.New("access denied to " + aws.ToString(params.SecretId))
+}
+
+func TestAdminVersion(t *testing.T) {
+	fake := discoverytest.NewECS()
+	proxy := newTestProxy(t, fake, nil)
+	admin := proxy.admin("s3cret")
+
+	w := adminDo(admin, http.MethodGet, "/version", "s3cret", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var build buildinfo.Info
+	if err := json.Unmarshal(w.Body.Bytes(), &build); err != nil || build != buildinfo.Get() {
+		t.Errorf("build %s, %v, want %+v", w.Body, err, buildinfo.Get())
+	}
+	if w := adminDo(admin, http.MethodPost, "/version", "s3cret", ""); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodGet {
+		t.Errorf("POST: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	// the metrics carry the same build
+	scrape := httptest.NewRecorder()
+	telemetry.MetricsHandler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if series := fmt.Sprintf(`ecs_svc_proxy_build_info{date=%q,revision=%q,version=%q} 1`, build.Date, build.Commit, build.Version); !strings.Contains(scrape.Body.String(), series) {
+		t.Errorf("scrape has no %s", series)
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errMissingAPIKey = errors.New("missing API key")
+	errInvalidAPIKey = errors.New("invalid API key")
+)
+
+// authFailures counts the requests turned down for their API key, by org
+// and reason. Orgs without keys share the unknown label, so clients can't
+// grow the series.
+var authFailures = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_auth_failures_total",
+	Help: "Requests turned down for a missing or invalid API key, by org and reason.",
+}, []string{"org", "reason"})
+
+// APIKeys checks that a request carries an API key of the org it routes
+// to. Only SHA-256 hashes of the keys are held, and they are read again
+// when their source changes so a rotated key takes effect without a
+// restart. Keys are expected to be long random strings, which a fast hash
+// protects as well as a slow one.
+type APIKeys struct {
+	// load returns the keys document and a version that changes with it.
+	load   func(ctx context.Context) ([]byte, string, error)
+	source string
+
+	mu      sync.RWMutex
+	keys    map[string][][sha256.Size]byte
+	version string
+}
+
+// NewAPIKeys returns the keys read from load, failing if they can't be.
+// source names where they come from in logs.
+func NewAPIKeys(ctx context.Context, source string, load func(ctx context.Context) ([]byte, string, error)) (*APIKeys, error) {
+	k := &APIKeys{load: load, source: source}
+	if _, err := k.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// APIKeysFile loads the keys from the file at path, versioned by its
+// modification time.
+func APIKeysFile(path string) func(ctx context.Context) ([]byte, string, error) {
+	return func(context.Context) ([]byte, string, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := os.ReadFile(path)
+		return data, info.ModTime().String(), err
+	}
+}
+
+// APIKeysValue loads the keys from the document value returns, such as the
+// API_KEYS of the last configuration loaded, versioned by its hash.
+func APIKeysValue(value func() string) func(ctx context.Context) ([]byte, string, error) {
+	return func(context.Context) ([]byte, string, error) {
+		data := []byte(value())
+		sum := sha256.Sum256(data)
+		return data, hex.EncodeToString(sum[:]), nil
+	}
+}
+
+// parseAPIKeys parses a YAML or JSON document mapping orgs to the SHA-256
+// hash of their key, or a list of them while a key is rotated, in hex and
+// optionally prefixed with sha256:.
+func parseAPIKeys(data []byte) (map[string][][sha256.Size]byte, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	keys := make(map[string][][sha256.Size]byte, len(raw))
+	for org, value := range raw {
+		var hashes []any
+		switch value := value.(type) {
+		case string:
+			hashes = []any{value}
+		case []any:
+			hashes = value
+		default:
+			return nil, fmt.Errorf("keys of org %s must be a hash or a list of hashes", org)
+		}
+		for _, hash := range hashes {
+			text, _ := hash.(string)
+			sum, err := hex.DecodeString(strings.TrimPrefix(text, "sha256:"))
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid key hash of org %s, expected sha256:<64 hex digits>", org)
+			}
+			keys[org] = append(keys[org], [sha256.Size]byte(sum))
+		}
+	}
+	return keys, nil
+}
+
+// Check returns nil if key is one of the keys of org, errMissingAPIKey if
+// it is empty, and errInvalidAPIKey otherwise, orgs without keys included.
+func (k *APIKeys) Check(org, key string) error {
+	if key == "" {
+		return errMissingAPIKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	k.mu.RLock()
+	hashes := k.keys[org]
+	k.mu.RUnlock()
+	match := 0
+	for _, hash := range hashes {
+		match |= subtle.ConstantTimeCompare(sum[:], hash[:])
+	}
+	if match == 0 {
+		return errInvalidAPIKey
+	}
+	return nil
+}
+
+// Known reports whether org has keys.
+func (k *APIKeys) Known(org string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys[org]) > 0
+}
+
+// Reload reads the keys again if their version changed, and reports
+// whether they were replaced. On error the current keys are kept.
+func (k *APIKeys) Reload(ctx context.Context) (bool, error) {
+	data, version, err := k.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	k.mu.RLock()
+	unchanged := k.keys != nil && version == k.version
+	k.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	keys, err := parseAPIKeys(data)
+	if err != nil {
+		return false, err
+	}
+	k.mu.Lock()
+	k.keys, k.version = keys, version
+	k.mu.Unlock()
+	return true, nil
+}
+
+// Run checks the source every interval until ctx is done.
+func (k *APIKeys) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.ReloadAndLog(ctx)
+		}
+	}
+}
+
+// ReloadAndLog reloads the keys and logs the outcome.
+func (k *APIKeys) ReloadAndLog(ctx context.Context) {
+	reloaded, err := k.Reload(ctx)
+	if err != nil {
+		slog.Error("Failed to reload the API keys, keeping the current ones", "source", k.source, "error", err)
+		return
+	}
+	if reloaded {
+		slog.Info("Reloaded the API keys", "source", k.source, "audit", true)
+	}
+}
+
+// reject answers a request of org turned down by Check with err, and counts
+// and logs it with the address it came from.
+func (k *APIKeys) reject(w http.ResponseWriter, r *http.Request, org string, err error) {
+	label, reason := orgLabelUnknown, "invalid"
+	if k.Known(org) {
+		label = org
+	}
+	if err == errMissingAPIKey {
+		reason = "missing"
+	}
+	authFailures.WithLabelValues(label, reason).Inc()
+	source := clientIP(r)
+	if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Rejected API key", source) {
+		slog.WarnContext(r.Context(), "Rejected API key", "org", org, "source", source, "reason", reason)
+	}
+	if err == errMissingAPIKey {
+		setOutcome(r, telemetry.OutcomeUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, errCodeMissingAPIKey, "Missing API key")
+		return
+	}
+	setOutcome(r, telemetry.OutcomeForbidden)
+	writeError(w, r, http.StatusForbidden, errCodeInvalidAPIKey, "Invalid API key for Org-ID")
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// keysFile writes a keys file giving each org the hash of its key, dated
+// modified so a rewrite is told apart within the file system's precision.
+func keysFile(t *testing.T, path string, modified time.Time, keys map[string]string) {
+	t.Helper()
+	var data string
+	for org, key := range keys {
+		sum := sha256.Sum256([]byte(key))
+		data += fmt.Sprintf("%s: sha256:%s\n", org, hex.EncodeToString(sum[:]))
+	}
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"), discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, nil)
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	modified := time.Now().Add(-time.Hour)
+	keysFile(t, path, modified, map[string]string{"acme": "acme-key-1", "globex": "globex-key"})
+	keys, err := NewAPIKeys(context.Background(), path, APIKeysFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Keys = keys
+
+	send := func(org, key string) int {
+		r, _ := http.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header.Set("X-Org-ID", org)
+		if key != "" {
+			r.Header.Set("X-Api-Key", key)
+		}
+		w := proxy.do(r)
+		return w.Code
+	}
+	invalid := telemetrytest.CounterValue(t, authFailures.WithLabelValues("acme", "invalid"))
+	missing := telemetrytest.CounterValue(t, authFailures.WithLabelValues("acme", "missing"))
+	listed := fake.Count("ListServices")
+
+	for _, tt := range []struct {
+		name, org, key string
+		want           int
+	}{
+		{name: "valid key", org: "acme", key: "acme-key-1", want: http.StatusTemporaryRedirect},
+		{name: "wrong org's key", org: "acme", key: "globex-key", want: http.StatusForbidden},
+		{name: "missing key", org: "acme", want: http.StatusUnauthorized},
+		{name: "unknown org", org: "initech", key: "acme-key-1", want: http.StatusForbidden},
+	} {
+		if got := send(tt.org, tt.key); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if n := telemetrytest.CounterValue(t, authFailures.WithLabelValues("acme", "invalid")) - invalid; n != 1 {
+		t.Errorf("counted %v invalid keys for acme, want 1", n)
+	}
+	if n := telemetrytest.CounterValue(t, authFailures.WithLabelValues("acme", "missing")) - missing; n != 1 {
+		t.Errorf("counted %v missing keys for acme, want 1", n)
+	}
+	// the unknown org was turned down before its lookup could refresh
+	if n := fake.Count("ListServices") - listed; n != 0 {
+		t.Errorf("listed services %d times for rejected requests", n)
+	}
+
+	// a rotated key takes effect once the file is read again
+	keysFile(t, path, modified.Add(time.Minute), map[string]string{"acme": "acme-key-2", "globex": "globex-key"})
+	if reloaded, err := keys.Reload(context.Background()); err != nil || !reloaded {
+		t.Fatalf("Reload = %v, %v", reloaded, err)
+	}
+	if got := send("acme", "acme-key-2"); got != http.StatusTemporaryRedirect {
+		t.Errorf("rotated key: status %d", got)
+	}
+	if got := send("acme", "acme-key-1"); got != http.StatusForbidden {
+		t.Errorf("replaced key: status %d", got)
+	}
+	if reloaded, err := keys.Reload(context.Background()); err != nil || reloaded {
+		t.Errorf("Reload of unchanged keys = %v, %v", reloaded, err)
+	}
+
+	// keys that fail to parse leave the current ones in place
+	if err := os.WriteFile(path, []byte("acme: not-a-hash\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Reload(context.Background()); err == nil {
+		t.Error("Reload of invalid keys succeeded")
+	}
+	if got := send("acme", "acme-key-2"); got != http.StatusTemporaryRedirect {
+		t.Errorf("after a failed reload: status %d", got)
+	}
+}
+
+// fakeSecrets is a Secrets Manager holding one secret.
+type fakeSecrets struct {
+	value, version string
+}
+
+func (f *fakeSecrets) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(f.value), VersionId: aws.String(f.version)}, nil
+}
+
+func TestAPIKeysSecretRotation(t *testing.T) {
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	secrets := &fakeSecrets{value: `{"acme": "` + hash("old") + `"}`, version: "v1"}
+	resolver := config.NewSecretResolver(func(string) (config.SecretsAPI, error) { return secrets, nil })
+	load := func() (config.Config, error) {
+		return config.Load(map[string]string{"ECS_CLUSTER": "tenants", "API_KEYS": "secretsmanager:proxy/keys"}, "", resolver)
+	}
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := NewLiveConfig(cfg)
+	reloader := NewReloader(cfg, live, load)
+	keys, err := NewAPIKeys(context.Background(), "API_KEYS", APIKeysValue(live.APIKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rotation is picked up by the refresh of the secrets and the reload
+	// that follows
+	rotate := func(value, version string) {
+		t.Helper()
+		secrets.value, secrets.version = value, version
+		if changed, err := resolver.Refresh(); err != nil || !changed {
+			t.Fatalf("Refresh = %v, %v", changed, err)
+		}
+		reloader.Reload()
+		if reloaded, err := keys.Reload(context.Background()); err != nil || !reloaded {
+			t.Fatalf("Reload = %v, %v", reloaded, err)
+		}
+	}
+	// during a rotation the org has both keys
+	rotate(`{"acme": ["`+hash("old")+`", "`+hash("new")+`"]}`, "v2")
+	if keys.Check("acme", "old") != nil || keys.Check("acme", "new") != nil {
+		t.Error("key of an org rotating its keys turned down")
+	}
+	rotate(`{"acme": "`+hash("new")+`"}`, "v3")
+	if err := keys.Check("acme", "old"); err != errInvalidAPIKey {
+		t.Errorf("Check of the rotated out key = %v", err)
+	}
+	if err := keys.Check("acme", ""); err != errMissingAPIKey {
+		t.Errorf("Check of no key = %v", err)
+	}
+}
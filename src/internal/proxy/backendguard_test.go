@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestBackendAllowedCIDRs(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddService("tenants", "initech")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"),
+		// a task in a subnet outside the allowed CIDRs
+		discoverytest.Task("tenants", "initech", "i1", "203.0.113.5"),
+	)
+	proxy := newTestProxy(t, fake, map[string]string{"ROUTABLE_CIDRS": ""})
+
+	// overrides saved by a previous run, one of them to a public address
+	// that must have been tampered with
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	data, err := json.Marshal(discovery.RouteSnapshot{
+		BuiltAt:  time.Now(),
+		Services: proxy.Routes.Services(),
+		Overrides: []discovery.RouteOverride{
+			{Org: "acme", Target: "10.0.5.5:8080", Created: time.Now()},
+			{Org: "globex", Target: "8.8.8.8:80", Created: time.Now()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := discovery.LoadSnapshot(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides := discovery.NewRouteOverrides(proxy.Config.BackendAllowedCIDRs)
+	overrides.Restore(snapshot.Overrides)
+	proxy.Lookup = discovery.NewFailoverRoutes(overrides, proxy.Routes, nil, 0)
+
+	denied := telemetrytest.CounterValue(t, discovery.BackendDenied)
+	for _, tt := range []struct {
+		org      string
+		status   int
+		location string
+	}{
+		{org: "acme", status: http.StatusTemporaryRedirect, location: "http://10.0.5.5:8080/orders"},
+		// the override from the file was dropped, the discovered task
+		// serves the org
+		{org: "globex", status: http.StatusTemporaryRedirect, location: "http://10.0.1.1:80/orders"},
+		{org: "initech", status: http.StatusBadGateway},
+	} {
+		w := proxy.get("/orders", tt.org)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: status %d to %q, want %d to %q", tt.org, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+		if tt.status == http.StatusBadGateway && !strings.Contains(w.Body.String(), errCodeBackendDenied) {
+			t.Errorf("%s: body %s, want the %s error code", tt.org, w.Body, errCodeBackendDenied)
+		}
+	}
+	if n := telemetrytest.CounterValue(t, discovery.BackendDenied) - denied; n != 1 {
+		t.Errorf("counted %v denied backends, want 1", n)
+	}
+	if got := overrides.List(); len(got) != 1 || got[0].Org != "acme" {
+		t.Errorf("restored overrides %+v, want acme's only", got)
+	}
+
+	// an override let through by a wider list is still checked when routed
+	wide := discovery.NewRouteOverrides([]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})
+	if _, err := wide.Set("globex", "8.8.8.8:80", 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	proxy.Lookup = discovery.NewFailoverRoutes(wide, proxy.Routes, nil, 0)
+	if w := proxy.get("/orders", "globex"); w.Code != http.StatusBadGateway {
+		t.Errorf("override outside the allowed CIDRs: status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := overrides.Set("globex", "8.8.8.8:80", 0, "test"); err == nil {
+		t.Error("override outside the allowed CIDRs set")
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// backendsListHandler serves the backends as JSON, filtered to one org with
+// ?org= and to one state with ?state=, or as a plain text table with
+// ?format=table.
+func backendsListHandler(routes *discovery.RouteTable) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+			return
+		}
+		query := r.URL.Query()
+		list := routes.Backends(query.Get("org"), query.Get("state"))
+		switch query.Get("format") {
+		case "", "json":
+			writeJSON(w, http.StatusOK, list)
+		case "table":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			list.WriteTable(w)
+		default:
+			writeError(w, r, http.StatusBadRequest, errCodeBadFormat, "Format must be json or table")
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+)
+
+// errNoBackendCertificate is a backend accepting TLS without a certificate.
+var errNoBackendCertificate = errors.New("backend presented no certificate")
+
+// BackendTLS is how the proxy authenticates backends reached over HTTPS and
+// itself to them. Backends are reached by IP, so their certificate is
+// verified against the name their service maps to instead of the address.
+// The client certificate and the CA bundle are read again when their files
+// change, like the listener certificate.
+type BackendTLS struct {
+	// certs is the client certificate presented, nil for none.
+	certs *CertReloader
+	// roots verifies backend certificates, the system roots if nil.
+	roots *CABundle
+	// serverNames maps services to the name their certificates are issued
+	// for, the service name if it isn't listed.
+	serverNames map[string]string
+}
+
+// NewBackendTLS returns the backend TLS of the files, failing if they can't
+// be read. Every file may be empty.
+func NewBackendTLS(certFile, keyFile, caFile string, serverNames map[string]string) (*BackendTLS, error) {
+	b := &BackendTLS{serverNames: serverNames}
+	if certFile != "" {
+		certs, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		b.certs = certs
+	}
+	if caFile != "" {
+		roots, err := NewCABundle(caFile)
+		if err != nil {
+			return nil, err
+		}
+		b.roots = roots
+	}
+	return b, nil
+}
+
+// Config returns the TLS configuration of the connections to the backends
+// of service.
+func (b *BackendTLS) Config(service string) *tls.Config {
+	serverName := service
+	if name, ok := b.serverNames[service]; ok {
+		serverName = name
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the chain is verified by VerifyConnection, against the roots
+		// current at the time of the handshake
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return b.verify(state, serverName)
+		},
+	}
+	if b.certs != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return b.certs.GetCertificate(nil)
+		}
+	}
+	return config
+}
+
+// verify checks the certificate chain of a backend against the roots and
+// serverName.
+func (b *BackendTLS) verify(state tls.ConnectionState, serverName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errNoBackendCertificate
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	if b.roots != nil {
+		opts.Roots = b.roots.Pool()
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// Run checks the files every interval until ctx is done.
+func (b *BackendTLS) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.ReloadAndLog()
+		}
+	}
+}
+
+// ReloadAndLog reloads the files and logs the outcome.
+func (b *BackendTLS) ReloadAndLog() {
+	if b.certs != nil {
+		b.certs.ReloadAndLog()
+	}
+	if b.roots != nil {
+		b.roots.ReloadAndLog()
+	}
+}
+
+// isTLSError reports whether err is a failed TLS handshake with a backend,
+// as opposed to it being unreachable or failing the request.
+func isTLSError(err error) bool {
+	var (
+		record       tls.RecordHeaderError
+		verification *tls.CertificateVerificationError
+		authority    x509.UnknownAuthorityError
+		hostname     x509.HostnameError
+		invalid      x509.CertificateInvalidError
+		op           *net.OpError
+	)
+	// alerts from the backend, such as one requiring a client certificate
+	if errors.As(err, &op) && op.Op == "remote error" {
+		return true
+	}
+	return errors.Is(err, errNoBackendCertificate) || errors.As(err, &record) || errors.As(err, &verification) ||
+		errors.As(err, &authority) || errors.As(err, &hostname) || errors.As(err, &invalid)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestProxyRoundRobin(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"),
+		discoverytest.Task("tenants", "acme", "a3", "10.0.0.3"),
+	)
+	proxy := newTestProxy(t, fake, nil)
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		w := proxy.get("/", "acme")
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("status %d", w.Code)
+		}
+		counts[w.Header().Get("Location")]++
+	}
+	if len(counts) != 3 {
+		t.Fatalf("requests went to %v, want all 3 tasks", counts)
+	}
+	for location, n := range counts {
+		if n < 33 || n > 34 {
+			t.Errorf("%s got %d of 100 requests", location, n)
+		}
+	}
+}
+
+func TestProxyLeastConnections(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"),
+		discoverytest.Task("tenants", "acme", "a3", "10.0.0.3"),
+	)
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": "forward", "LB_STRATEGY": "leastconn"})
+	// each backend holds its requests until its release is closed
+	releases := map[string]chan struct{}{}
+	for _, address := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"} {
+		releases[address] = make(chan struct{})
+	}
+	started := make(chan string)
+	proxy.Forwarder = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		address := discovery.BackendAddress(r)
+		started <- address
+		<-releases[address]
+	})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer func() {
+		for _, release := range releases {
+			select {
+			case <-release:
+			default:
+				close(release)
+			}
+		}
+	}()
+	// send starts a request and returns its backend, and a channel closed
+	// once it is done.
+	send := func() (string, chan struct{}) {
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			proxy.get("/orders", "acme")
+		}()
+		return <-started, done
+	}
+
+	// a request held on each backend
+	held := map[string]bool{}
+	first, firstDone := send()
+	held[first] = true
+	for i := 0; i < 2; i++ {
+		address, _ := send()
+		held[address] = true
+	}
+	if len(held) != 3 {
+		t.Fatalf("3 requests held on %v, want one per backend", held)
+	}
+
+	// once a backend's request is done it has the fewest in flight, and
+	// every request goes to it while the others stay busy
+	close(releases[first])
+	<-firstDone
+	for i := 0; i < 20; i++ {
+		address, done := send()
+		if address != first {
+			t.Fatalf("request %d went to %s with a request in flight, want the idle %s", i, address, first)
+		}
+		<-done
+	}
+}
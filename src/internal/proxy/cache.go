@@ -0,0 +1,535 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// cacheHits and cacheMisses count the cacheable requests answered from
+	// the response cache and sent to a backend, cacheRevalidations the
+	// expired entries a backend confirmed with a 304, and cacheEvictions
+	// the entries dropped to stay within the memory cap. cacheBytes is the
+	// memory the entries take.
+	cacheHits = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_cache_hits_total",
+		Help: "Requests answered from the response cache.",
+	})
+	cacheMisses = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_cache_misses_total",
+		Help: "Cacheable requests sent to a backend.",
+	})
+	cacheRevalidations = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_cache_revalidations_total",
+		Help: "Expired response cache entries a backend confirmed as unchanged.",
+	})
+	cacheEvictions = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_cache_evictions_total",
+		Help: "Response cache entries evicted to stay within the memory cap.",
+	})
+	cacheBytes = promauto.With(telemetry.Registry).NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_svc_proxy_cache_bytes",
+		Help: "Memory taken by the response cache entries.",
+	})
+)
+
+// cacheHeader tells whether a response came from the cache, HIT, or from a
+// backend, MISS.
+const cacheHeader = "X-Cache"
+
+// uncachedHeaders are the response headers of a connection, or of a single
+// response, not stored with an entry.
+var uncachedHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Age", cacheHeader}
+
+// ResponseCache keeps the GET and HEAD responses backends allow shared
+// caches to keep, by org, method, host, URL and the request headers they
+// vary on, for as long as their Cache-Control says. It holds at most
+// maxBytes, evicting the least recently used entries beyond that, and no
+// entry larger than maxEntry. Expired entries with an ETag are revalidated
+// with If-None-Match. A nil ResponseCache caches nothing.
+type ResponseCache struct {
+	maxBytes int64
+	maxEntry int64
+	clock    clock.Clock
+
+	mu    sync.Mutex
+	bytes int64
+	// entries holds the entries by key, the least recently used at the
+	// back of order.
+	entries map[string]*list.Element
+	order   *list.List
+	// vary holds the request headers the responses of each resource vary
+	// on, and variants how many entries it has.
+	vary     map[string][]string
+	variants map[string]int
+}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	key      string
+	resource string
+	status   int
+	header   http.Header
+	body     []byte
+	size     int64
+	// stored is when the response was stored or last revalidated, age its
+	// age then and ttl how long it stays fresh from then.
+	stored time.Time
+	age    time.Duration
+	ttl    time.Duration
+}
+
+// NewResponseCache returns an empty cache of at most maxBytes.
+func NewResponseCache(maxBytes, maxEntry int64) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		maxEntry: maxEntry,
+		clock:    clock.System{},
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		vary:     map[string][]string{},
+		variants: map[string]int{},
+	}
+}
+
+// SetClock makes the entries age by clock. It must be called before the
+// cache is shared.
+func (c *ResponseCache) SetClock(clock clock.Clock) {
+	c.clock = clock
+}
+
+// cacheLookup is what the cache has for a request: a fresh entry to answer
+// it with, or an expired one to revalidate, or nothing. A nil cacheLookup
+// is a request the cache stays out of.
+type cacheLookup struct {
+	cache    *ResponseCache
+	resource string
+	entry    *cacheEntry
+	fresh    bool
+}
+
+// Lookup returns what the cache has for r, a request of org, nil if r
+// isn't cacheable: not a GET or HEAD, an upgrade, or a request with
+// Cache-Control: no-store.
+func (c *ResponseCache) Lookup(r *http.Request, org string) *cacheLookup {
+	if c == nil || r.Method != http.MethodGet && r.Method != http.MethodHead || r.Header.Get("Upgrade") != "" {
+		return nil
+	}
+	directives := cacheControl(r.Header)
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+	lookup := &cacheLookup{
+		cache:    c,
+		resource: config.NormalizeOrg(org) + "\x00" + r.Method + "\x00" + r.Host + "\x00" + r.URL.RequestURI(),
+	}
+	// the client wants an answer from the backend, which may still be kept
+	_, noCache := directives["no-cache"]
+	if noCache || directives["max-age"] == "0" {
+		cacheMisses.Inc()
+		return lookup
+	}
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[c.key(lookup.resource, r.Header)]; ok {
+		entry := element.Value.(*cacheEntry)
+		lookup.entry = entry
+		lookup.fresh = now.Sub(entry.stored) < entry.ttl
+		if lookup.fresh {
+			c.order.MoveToFront(element)
+		}
+	}
+	if lookup.fresh {
+		cacheHits.Inc()
+	} else {
+		cacheMisses.Inc()
+	}
+	return lookup
+}
+
+// key returns the key of the variant of resource the request headers
+// select. The caller must hold c.mu.
+func (c *ResponseCache) key(resource string, header http.Header) string {
+	var key strings.Builder
+	key.WriteString(resource)
+	for _, name := range c.vary[resource] {
+		key.WriteString("\x00")
+		key.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// Fresh reports whether the request is answered from the cache.
+func (l *cacheLookup) Fresh() bool {
+	return l != nil && l.fresh
+}
+
+// Serve answers r with the fresh entry.
+func (l *cacheLookup) Serve(w http.ResponseWriter, r *http.Request) {
+	l.cache.serve(w, r, l.entry)
+}
+
+// serve answers r with entry, or a 304 when its ETag matches the
+// If-None-Match of r.
+func (c *ResponseCache) serve(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	c.mu.Lock()
+	header, status, body := entry.header.Clone(), entry.status, entry.body
+	age := entry.age + c.clock.Now().Sub(entry.stored)
+	c.mu.Unlock()
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	w.Header().Set(cacheHeader, "HIT")
+	if etag := header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// Forward sends r to its backend with forward, revalidating the expired
+// entry it has with If-None-Match unless the client sent conditions of its
+// own, and stores the response if it may be kept.
+func (l *cacheLookup) Forward(w http.ResponseWriter, r *http.Request, forward func(http.ResponseWriter, *http.Request)) {
+	if l == nil {
+		forward(w, r)
+		return
+	}
+	recorder := &cacheWriter{ResponseWriter: w, header: http.Header{}, max: l.cache.maxEntry}
+	if l.entry != nil && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		if etag := l.entry.header.Get("ETag"); etag != "" {
+			r.Header.Set("If-None-Match", etag)
+			recorder.revalidating = true
+		}
+	}
+	forward(recorder, r)
+	recorder.finish()
+	if recorder.revalidating {
+		// the condition was the cache's, not the client's
+		r.Header.Del("If-None-Match")
+	}
+	if recorder.notModified {
+		cacheRevalidations.Inc()
+		l.cache.revalidated(l.entry, recorder.header)
+		l.cache.serve(w, r, l.entry)
+		return
+	}
+	if recorder.status == http.StatusOK && !recorder.over {
+		l.cache.store(r, l.resource, recorder.header, recorder.body.Bytes())
+	}
+}
+
+// revalidated makes entry fresh again for the lifetime the 304 confirming
+// it gives, or the one it had, and drops it if the 304 forbids keeping it.
+func (c *ResponseCache) revalidated(entry *cacheEntry, header http.Header) {
+	ttl, ok := responseTTL(header, false)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, stored := c.entries[entry.key]; !stored {
+		return
+	}
+	if !ok && cacheControlHas(header, "no-store", "private", "no-cache") {
+		c.remove(c.entries[entry.key])
+		return
+	}
+	if ok {
+		entry.ttl = ttl
+	}
+	entry.stored, entry.age = c.clock.Now(), responseAge(header)
+}
+
+// store keeps the response to r, a request of resource, if its headers
+// allow a shared cache to.
+func (c *ResponseCache) store(r *http.Request, resource string, header http.Header, body []byte) {
+	ttl, ok := responseTTL(header, r.Header.Get("Authorization") != "")
+	// trailers come after the body and aren't stored with it
+	if !ok || header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return
+	}
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	stored := header.Clone()
+	for _, name := range uncachedHeaders {
+		stored.Del(name)
+	}
+	entry := &cacheEntry{
+		resource: resource,
+		status:   http.StatusOK,
+		header:   stored,
+		body:     bytes.Clone(body),
+		stored:   c.clock.Now(),
+		age:      responseAge(header),
+		ttl:      ttl,
+	}
+	entry.size = int64(len(entry.body) + len(resource))
+	for name, values := range stored {
+		for _, value := range values {
+			entry.size += int64(len(name) + len(value))
+		}
+	}
+	if entry.size > c.maxEntry {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the variants stored so far are selected by the headers the resource
+	// varied on then
+	if !equalStrings(c.vary[resource], vary) {
+		c.removeResource(resource)
+		c.vary[resource] = vary
+	}
+	entry.key = c.key(resource, r.Header)
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.variants[resource]++
+	c.bytes += entry.size
+	for c.bytes > c.maxBytes && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+		cacheEvictions.Inc()
+	}
+	cacheBytes.Set(float64(c.bytes))
+}
+
+// remove drops the entry of element. The caller must hold c.mu.
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+	if c.variants[entry.resource]--; c.variants[entry.resource] <= 0 {
+		delete(c.variants, entry.resource)
+		delete(c.vary, entry.resource)
+	}
+	cacheBytes.Set(float64(c.bytes))
+}
+
+// removeResource drops every variant of resource. The caller must hold
+// c.mu.
+func (c *ResponseCache) removeResource(resource string) {
+	for element := c.order.Front(); element != nil && c.variants[resource] > 0; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).resource == resource {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+// responseTTL returns how long a response with header stays fresh in a
+// shared cache, from its s-maxage or max-age less its Age, and false if it
+// may not be kept. A response to a request with credentials is only kept
+// when it is public or has an s-maxage.
+func responseTTL(header http.Header, authorized bool) (time.Duration, bool) {
+	directives := cacheControl(header)
+	for _, forbidden := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[forbidden]; ok {
+			return 0, false
+		}
+	}
+	_, public := directives["public"]
+	maxAge, shared := directives["s-maxage"]
+	if !shared {
+		if authorized && !public {
+			return 0, false
+		}
+		maxAge = directives["max-age"]
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil {
+		return 0, false
+	}
+	ttl := time.Duration(seconds)*time.Second - responseAge(header)
+	return ttl, ttl > 0
+}
+
+// responseAge returns the Age of a response, zero if it has none.
+func responseAge(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Age"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheControl returns the Cache-Control directives of header by lower
+// case name, with their unquoted value if they have one.
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// cacheControlHas reports whether the Cache-Control of header has one of
+// the directives.
+func cacheControlHas(header http.Header, names ...string) bool {
+	directives := cacheControl(header)
+	for _, name := range names {
+		if _, ok := directives[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match value names etag, comparing
+// weakly as If-None-Match does.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheWriter passes a forwarded response on to the client, marked with
+// X-Cache: MISS, and copies up to max bytes of its body to store it. The
+// backend's headers are kept apart from those the proxy set on the
+// response, so only the backend's are stored. While revalidating, a 304
+// answers the cache's own condition and isn't passed on.
+type cacheWriter struct {
+	http.ResponseWriter
+	header       http.Header
+	status       int
+	wroteHeader  bool
+	revalidating bool
+	notModified  bool
+	// passed holds the header names passed on with the response header,
+	// so the trailers set after the body can be told apart.
+	passed map[string]bool
+	body   bytes.Buffer
+	max    int64
+	over   bool
+}
+
+func (w *cacheWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		// informational responses carry their own headers
+		w.copyHeader()
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.status, w.wroteHeader = status, true
+	if w.revalidating && status == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+	w.copyHeader()
+	w.ResponseWriter.Header().Set(cacheHeader, "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(p), nil
+	}
+	if !w.over {
+		if int64(w.body.Len()+len(p)) > w.max {
+			w.over = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// copyHeader sets the headers written so far on the client's response.
+func (w *cacheWriter) copyHeader() {
+	if w.passed == nil {
+		w.passed = map[string]bool{}
+	}
+	header := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		header[name] = values
+		w.passed[name] = true
+	}
+}
+
+// finish passes on the trailers set once the body was written.
+func (w *cacheWriter) finish() {
+	if !w.wroteHeader || w.notModified {
+		return
+	}
+	header := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		if !w.passed[name] {
+			header[name] = values
+		}
+	}
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection.
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
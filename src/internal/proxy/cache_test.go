@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+// cacheBackend is a backend serving responses for the response cache to
+// keep or not, by path, counting the requests it gets.
+type cacheBackend struct {
+	mu    sync.Mutex
+	calls map[string]int
+	// conditional are the If-None-Match headers it got.
+	conditional []string
+}
+
+func (b *cacheBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.calls[r.URL.Path]++
+	if condition := r.Header.Get("If-None-Match"); condition != "" {
+		b.conditional = append(b.conditional, condition)
+	}
+	b.mu.Unlock()
+	switch {
+	case r.URL.Path == "/config":
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "config")
+	case r.URL.Path == "/no-store":
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, "secret")
+	case r.URL.Path == "/private":
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		io.WriteString(w, "mine")
+	case r.URL.Path == "/cookie":
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "session=1")
+		io.WriteString(w, "cookie")
+	case r.URL.Path == "/error":
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusInternalServerError)
+	case r.URL.Path == "/vary":
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		io.WriteString(w, "encoding:"+r.Header.Get("Accept-Encoding"))
+	case strings.HasPrefix(r.URL.Path, "/blob/"):
+		var size int
+		fmt.Sscanf(r.URL.Path, "/blob/%d", &size)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, strings.Repeat("x", size))
+	default:
+		io.WriteString(w, "uncached")
+	}
+}
+
+func (b *cacheBackend) called(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[path]
+}
+
+// newTestCache returns a cache of maxBytes, entries up to maxEntry,
+// telling the time with a fake clock, in front of a cacheBackend.
+func newTestCache(maxBytes, maxEntry int64) (*ResponseCache, *cacheBackend, *clocktest.Clock) {
+	cache := NewResponseCache(maxBytes, maxEntry)
+	clock := clocktest.New()
+	cache.SetClock(clock)
+	return cache, &cacheBackend{calls: map[string]int{}}, clock
+}
+
+// fetch sends r for org through cache to backend like the proxy does.
+func fetch(cache *ResponseCache, backend http.Handler, r *http.Request, org string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	lookup := cache.Lookup(r, org)
+	if lookup.Fresh() {
+		lookup.Serve(w, r)
+	} else {
+		lookup.Forward(w, r, backend.ServeHTTP)
+	}
+	return w
+}
+
+func cacheRequest(method, path string, header ...string) *http.Request {
+	r := httptest.NewRequest(method, "http://proxy.example.com"+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestResponseCacheCacheable(t *testing.T) {
+	cache, backend, clock := newTestCache(1<<20, 1<<10)
+	hits := telemetrytest.CounterValue(t, cacheHits)
+
+	w := fetch(cache, backend, cacheRequest(http.MethodGet, "/config"), "acme")
+	if w.Body.String() != "config" || w.Header().Get(cacheHeader) != "MISS" {
+		t.Fatalf("first request: %q, X-Cache %q", w.Body, w.Header().Get(cacheHeader))
+	}
+	clock.Advance(10 * time.Second)
+	w = fetch(cache, backend, cacheRequest(http.MethodGet, "/config"), "acme")
+	if w.Code != http.StatusOK || w.Body.String() != "config" || w.Header().Get(cacheHeader) != "HIT" || w.Header().Get("Age") != "10" {
+		t.Errorf("second request: %d %q, X-Cache %q, Age %q", w.Code, w.Body, w.Header().Get(cacheHeader), w.Header().Get("Age"))
+	}
+	if w.Header().Get("ETag") != `"v1"` {
+		t.Errorf("cached response without its ETag: %v", w.Header())
+	}
+	// a client's own condition is answered from the cache
+	w = fetch(cache, backend, cacheRequest(http.MethodGet, "/config", "If-None-Match", `"v1"`), "acme")
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("conditional request: %d %q", w.Code, w.Body)
+	}
+	if n := backend.called("/config"); n != 1 {
+		t.Errorf("backend got %d requests, want 1", n)
+	}
+	if n := telemetrytest.CounterValue(t, cacheHits) - hits; n != 2 {
+		t.Errorf("counted %v hits, want 2", n)
+	}
+
+	// orgs and methods don't share entries
+	fetch(cache, backend, cacheRequest(http.MethodGet, "/config"), "globex")
+	fetch(cache, backend, cacheRequest(http.MethodHead, "/config"), "acme")
+	if n := backend.called("/config"); n != 3 {
+		t.Errorf("backend got %d requests, want another per org and method", n)
+	}
+
+	// an expired entry is revalidated, and served again once confirmed
+	revalidations := telemetrytest.CounterValue(t, cacheRevalidations)
+	clock.Advance(time.Minute)
+	w = fetch(cache, backend, cacheRequest(http.MethodGet, "/config"), "acme")
+	if w.Code != http.StatusOK || w.Body.String() != "config" {
+		t.Errorf("revalidated request: %d %q", w.Code, w.Body)
+	}
+	if backend.conditional[len(backend.conditional)-1] != `"v1"` {
+		t.Errorf("backend got If-None-Match %q", backend.conditional)
+	}
+	if n := telemetrytest.CounterValue(t, cacheRevalidations) - revalidations; n != 1 {
+		t.Errorf("counted %v revalidations, want 1", n)
+	}
+	if w := fetch(cache, backend, cacheRequest(http.MethodGet, "/config"), "acme"); w.Header().Get(cacheHeader) != "HIT" {
+		t.Error("revalidated entry not fresh again")
+	}
+}
+
+func TestResponseCacheNotCacheable(t *testing.T) {
+	cache, backend, _ := newTestCache(1<<20, 1<<10)
+	for _, tt := range []struct {
+		name string
+		r    func() *http.Request
+	}{
+		{name: "no-store", r: func() *http.Request { return cacheRequest(http.MethodGet, "/no-store") }},
+		{name: "private", r: func() *http.Request { return cacheRequest(http.MethodGet, "/private") }},
+		{name: "without Cache-Control", r: func() *http.Request { return cacheRequest(http.MethodGet, "/plain") }},
+		{name: "setting a cookie", r: func() *http.Request { return cacheRequest(http.MethodGet, "/cookie") }},
+		{name: "error", r: func() *http.Request { return cacheRequest(http.MethodGet, "/error") }},
+		{name: "POST", r: func() *http.Request { return cacheRequest(http.MethodPost, "/config") }},
+		{name: "client's no-store", r: func() *http.Request { return cacheRequest(http.MethodGet, "/blob/10", "Cache-Control", "no-store") }},
+		{name: "credentials", r: func() *http.Request { return cacheRequest(http.MethodGet, "/blob/20", "Authorization", "Bearer token") }},
+		{name: "over the entry limit", r: func() *http.Request { return cacheRequest(http.MethodGet, "/blob/2048") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.r().URL.Path
+			before := backend.called(path)
+			for i := 0; i < 2; i++ {
+				if w := fetch(cache, backend, tt.r(), "acme"); w.Header().Get(cacheHeader) == "HIT" {
+					t.Error("answered from the cache")
+				}
+			}
+			if n := backend.called(path) - before; n != 2 {
+				t.Errorf("backend got %d of 2 requests", n)
+			}
+		})
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	cache, backend, _ := newTestCache(1<<20, 1<<10)
+	for _, tt := range []struct {
+		encoding, body, cache string
+	}{
+		{encoding: "gzip", body: "encoding:gzip", cache: "MISS"},
+		{encoding: "br", body: "encoding:br", cache: "MISS"},
+		{encoding: "gzip", body: "encoding:gzip", cache: "HIT"},
+		{encoding: "", body: "encoding:", cache: "MISS"},
+		{encoding: "br", body: "encoding:br", cache: "HIT"},
+		{encoding: "", body: "encoding:", cache: "HIT"},
+	} {
+		w := fetch(cache, backend, cacheRequest(http.MethodGet, "/vary", "Accept-Encoding", tt.encoding), "acme")
+		if w.Body.String() != tt.body || w.Header().Get(cacheHeader) != tt.cache {
+			t.Errorf("Accept-Encoding %q: %q %s, want %q %s", tt.encoding, w.Body, w.Header().Get(cacheHeader), tt.body, tt.cache)
+		}
+	}
+	if n := backend.called("/vary"); n != 3 {
+		t.Errorf("backend got %d requests, want one per variant", n)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	// room for three entries of a 300 byte body and their headers
+	cache, backend, _ := newTestCache(1200, 1200)
+	evictions := telemetrytest.CounterValue(t, cacheEvictions)
+	for _, path := range []string{"/blob/300?a", "/blob/300?b", "/blob/300?c"} {
+		fetch(cache, backend, cacheRequest(http.MethodGet, path), "acme")
+	}
+	// a is used again, so b is the least recently used
+	fetch(cache, backend, cacheRequest(http.MethodGet, "/blob/300?a"), "acme")
+	fetch(cache, backend, cacheRequest(http.MethodGet, "/blob/300?d"), "acme")
+	if n := telemetrytest.CounterValue(t, cacheEvictions) - evictions; n != 1 {
+		t.Errorf("evicted %v entries, want 1", n)
+	}
+	// b last, as fetching it again evicts another entry
+	for _, tt := range []struct{ path, cache string }{
+		{"/blob/300?a", "HIT"}, {"/blob/300?c", "HIT"}, {"/blob/300?d", "HIT"}, {"/blob/300?b", "MISS"},
+	} {
+		if w := fetch(cache, backend, cacheRequest(http.MethodGet, tt.path), "acme"); w.Header().Get(cacheHeader) != tt.cache {
+			t.Errorf("%s: X-Cache %s, want %s", tt.path, w.Header().Get(cacheHeader), tt.cache)
+		}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.bytes > cache.maxBytes || cache.order.Len() != 3 {
+		t.Errorf("%d entries of %d bytes, over the cap of %d", cache.order.Len(), cache.bytes, cache.maxBytes)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"slices"
+
+	"ecs-svc-proxy/src/internal/config"
+
+	"golang.org/x/crypto/acme"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	config.ClientAuthNone:    tls.NoClientCert,
+	config.ClientAuthRequest: tls.VerifyClientCertIfGiven,
+	config.ClientAuthRequire: tls.RequireAndVerifyClientCert,
+}
+
+// SetClientAuth makes config verify client certificates against the current
+// certificates of cas. A handshake failing verification is turned down
+// before any request is read. ACME TLS-ALPN challenges are exempt, the CA
+// has no client certificate.
+func SetClientAuth(config *tls.Config, mode string, cas *CABundle) {
+	base := config.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		handshake := base.Clone()
+		if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			handshake.ClientAuth = clientAuthTypes[mode]
+			handshake.ClientCAs = cas.Pool()
+		}
+		return handshake, nil
+	}
+}
+
+type clientIdentityKey struct{}
+
+// clientIdentityFrom returns the identity stored in ctx by
+// WithClientIdentity, empty if the client sent no verified certificate.
+func clientIdentityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(clientIdentityKey{}).(string)
+	return identity
+}
+
+// WithClientIdentity stores the identity of the verified client certificate
+// of a request on its context, so it is logged with the request.
+func WithClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			identity := clientIdentity(r.TLS.VerifiedChains[0][0])
+			r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, identity))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIdentity returns the SPIFFE ID of cert if it has one, and its
+// common name otherwise.
+func clientIdentity(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+type clientAddrKey struct{}
+
+// clientAddress is the client of a request. It is the TCP peer, or, when
+// the peer is a trusted proxy, the rightmost X-Forwarded-For entry that
+// isn't one.
+type clientAddress struct {
+	// addr is invalid when the peer isn't an IP address, a unix socket,
+	// and no trusted proxy forwarded the request.
+	addr netip.Addr
+	// known is false when the client couldn't be told: addr is invalid or,
+	// an entry of X-Forwarded-For being garbage, it is the peer.
+	known bool
+	// forwarded are the X-Forwarded-For entries from the client to the
+	// last trusted proxy, the part of the chain worth passing on.
+	forwarded []string
+}
+
+// resolveClientAddr returns the client of r, given the proxies trusted to
+// forward. Requests on a unix socket come from a local process, which is
+// trusted to forward when trusted proxies are set. When every hop is
+// trusted the leftmost is as far as the chain goes.
+func resolveClientAddr(r *http.Request, trusted []netip.Prefix) clientAddress {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err == nil {
+		peer = peer.Unmap()
+	}
+	direct := clientAddress{addr: peer, known: err == nil}
+	if err == nil && !config.ContainsAddr(trusted, peer) || err != nil && len(trusted) == 0 {
+		return direct
+	}
+	var entries []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	client := direct
+	for i := len(entries) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(entries[i])
+		if err != nil {
+			return clientAddress{addr: peer}
+		}
+		client = clientAddress{addr: addr.Unmap(), known: true, forwarded: entries[i:]}
+		if !config.ContainsAddr(trusted, client.addr) {
+			break
+		}
+	}
+	return client
+}
+
+// WithClientAddr stores the client of each request, as resolveClientAddr
+// tells it with trusted, for clientAddr to return.
+func WithClientAddr(next http.Handler, trusted []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := resolveClientAddr(r, trusted)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, client)))
+	})
+}
+
+// clientAddr returns the client of r stored by WithClientAddr, the peer if
+// r didn't go through it.
+func clientAddr(r *http.Request) clientAddress {
+	if client, ok := r.Context().Value(clientAddrKey{}).(clientAddress); ok {
+		return client
+	}
+	return resolveClientAddr(r, nil)
+}
+
+// clientIP returns the address of the client of r for logs, its remote
+// address when it isn't an IP.
+func clientIP(r *http.Request) string {
+	if client := clientAddr(r); client.addr.IsValid() {
+		return client.addr.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+var testTrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+
+func TestResolveClientAddr(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		remote string
+		xff    []string
+		// addr is empty when the client's address is invalid.
+		addr      string
+		known     bool
+		forwarded []string
+	}{
+		{name: "direct", remote: "203.0.113.9:41000", addr: "203.0.113.9", known: true},
+		{name: "spoofed from an untrusted peer", remote: "203.0.113.9:41000", xff: []string{"198.51.100.7"}, addr: "203.0.113.9", known: true},
+		{name: "through a trusted proxy", remote: "10.0.0.5:41000", xff: []string{"198.51.100.7"}, addr: "198.51.100.7", known: true, forwarded: []string{"198.51.100.7"}},
+		{name: "spoofed through a trusted proxy", remote: "10.0.0.5:41000", xff: []string{"1.2.3.4, 198.51.100.7"}, addr: "198.51.100.7", known: true, forwarded: []string{"198.51.100.7"}},
+		{name: "several trusted hops", remote: "10.0.0.5:41000", xff: []string{"1.2.3.4, 198.51.100.7, 10.0.1.1, 10.0.2.2"}, addr: "198.51.100.7", known: true, forwarded: []string{"198.51.100.7", "10.0.1.1", "10.0.2.2"}},
+		{name: "several headers", remote: "10.0.0.5:41000", xff: []string{"1.2.3.4, 198.51.100.7", "10.0.1.1"}, addr: "198.51.100.7", known: true, forwarded: []string{"198.51.100.7", "10.0.1.1"}},
+		{name: "every hop trusted", remote: "10.0.0.5:41000", xff: []string{"10.0.3.3, 10.0.1.1"}, addr: "10.0.3.3", known: true, forwarded: []string{"10.0.3.3", "10.0.1.1"}},
+		{name: "trusted proxy without the header", remote: "10.0.0.5:41000", addr: "10.0.0.5", known: true},
+		{name: "IPv6 through a trusted proxy", remote: "[fd00::5]:41000", xff: []string{"2001:db8::7"}, addr: "2001:db8::7", known: true, forwarded: []string{"2001:db8::7"}},
+		{name: "IPv6 through IPv6 trusted hops", remote: "[fd00::5]:41000", xff: []string{"2001:db8::7, fd00::6"}, addr: "2001:db8::7", known: true, forwarded: []string{"2001:db8::7", "fd00::6"}},
+		{name: "spoofed from an untrusted IPv6 peer", remote: "[2001:db8::9]:41000", xff: []string{"2001:db8::7"}, addr: "2001:db8::9", known: true},
+		{name: "IPv4-mapped", remote: "[::ffff:10.0.0.5]:41000", xff: []string{"::ffff:198.51.100.7"}, addr: "198.51.100.7", known: true, forwarded: []string{"::ffff:198.51.100.7"}},
+		{name: "garbage", remote: "10.0.0.5:41000", xff: []string{"garbage"}, addr: "10.0.0.5"},
+		{name: "garbage after the client", remote: "10.0.0.5:41000", xff: []string{"198.51.100.7, garbage"}, addr: "10.0.0.5"},
+		{name: "garbage before the client", remote: "10.0.0.5:41000", xff: []string{"garbage, 198.51.100.7"}, addr: "198.51.100.7", known: true, forwarded: []string{"198.51.100.7"}},
+		{name: "garbage behind trusted hops", remote: "10.0.0.5:41000", xff: []string{"garbage, 10.0.1.1"}, addr: "10.0.0.5"},
+		{name: "entry with a port", remote: "10.0.0.5:41000", xff: []string{"198.51.100.7:1234"}, addr: "10.0.0.5"},
+		{name: "empty entry", remote: "10.0.0.5:41000", xff: []string{"198.51.100.7, "}, addr: "10.0.0.5"},
+		{name: "unix socket", remote: "@", xff: []string{"198.51.100.7"}, addr: "198.51.100.7", known: true, forwarded: []string{"198.51.100.7"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.xff {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			client := resolveClientAddr(r, testTrustedProxies)
+			addr := ""
+			if client.addr.IsValid() {
+				addr = client.addr.String()
+			}
+			if addr != tt.addr || client.known != tt.known || !slices.Equal(client.forwarded, tt.forwarded) {
+				t.Errorf("client %q known %v forwarded %q, want %q known %v forwarded %q", addr, client.known, client.forwarded, tt.addr, tt.known, tt.forwarded)
+			}
+		})
+	}
+}
+
+func TestResolveClientAddrUntrusted(t *testing.T) {
+	// without trusted proxies the header is never believed, a unix socket
+	// peer included
+	r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if client := resolveClientAddr(r, nil); client.addr.IsValid() || client.known {
+		t.Errorf("client %v known %v, want unknown", client.addr, client.known)
+	}
+	if got := clientIP(r); got != "@" {
+		t.Errorf("clientIP = %q, want the remote address", got)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	var sent string
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent = strings.Join(r.Header.Values("X-Forwarded-For"), "|")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}, Request: r}, nil
+	})
+	forwarder := NewForwarder(transport, func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{})
+	var logged string
+	handler := WithClientAddr(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logged = clientIP(r)
+		service := discovery.ECSService{Name: "acme", IP: "10.0.9.9", Port: 8080}
+		forwarder.ServeHTTP(w, withBackend(r, "acme", service, config.OrgTarget{}, nil))
+	}), testTrustedProxies)
+
+	for _, tt := range []struct {
+		name, remote, xff string
+		// logged is the client as logged, sent the X-Forwarded-For the
+		// backend gets.
+		logged, sent string
+	}{
+		{name: "spoofed from an untrusted peer", remote: "203.0.113.9:41000", xff: "1.2.3.4", logged: "203.0.113.9", sent: "203.0.113.9"},
+		{name: "spoofed through a trusted proxy", remote: "10.0.0.5:41000", xff: "1.2.3.4, 198.51.100.7", logged: "198.51.100.7", sent: "198.51.100.7, 10.0.0.5"},
+		{name: "several trusted hops", remote: "10.0.0.5:41000", xff: "198.51.100.7, 10.0.1.1", logged: "198.51.100.7", sent: "198.51.100.7, 10.0.1.1, 10.0.0.5"},
+		{name: "IPv6", remote: "[fd00::5]:41000", xff: "2001:db8::7", logged: "2001:db8::7", sent: "2001:db8::7, fd00::5"},
+		{name: "garbage", remote: "10.0.0.5:41000", xff: "198.51.100.7, garbage", logged: "10.0.0.5", sent: "10.0.0.5"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-For", tt.xff)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if logged != tt.logged || sent != tt.sent {
+				t.Errorf("logged %q and sent %q, want %q and %q", logged, sent, tt.logged, tt.sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// requestsInFlight and requestsQueued are the routed requests being
+	// served and waiting for a slot, and requestsShed counts the ones
+	// turned down for the lack of one.
+	requestsInFlight = promauto.With(telemetry.Registry).NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_svc_proxy_requests_in_flight",
+		Help: "Routed requests being served.",
+	})
+	requestsQueued = promauto.With(telemetry.Registry).NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_svc_proxy_requests_queued",
+		Help: "Routed requests waiting for the concurrency limit.",
+	})
+	requestsShed = promauto.With(telemetry.Registry).NewCounter(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_requests_shed_total",
+		Help: "Routed requests turned down by the concurrency limit.",
+	})
+)
+
+// LimitConcurrency lets at most limit requests into next at once. A request
+// beyond that waits up to queueTimeout for another to finish, and is then
+// answered with a 503 telling the client to retry after retryAfter, so a
+// spike of slow requests can't pile up until the proxy runs out of memory.
+func LimitConcurrency(next http.Handler, limit int, queueTimeout time.Duration, retryAfter func() time.Duration) http.Handler {
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if !waitForSlot(r, slots, queueTimeout) {
+				if r.Context().Err() != nil {
+					// the client went away while queued, no one to answer
+					return
+				}
+				requestsShed.Inc()
+				if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Concurrency limit reached", "") {
+					slog.WarnContext(r.Context(), "Concurrency limit reached", "limit", limit)
+				}
+				setOutcome(r, telemetry.OutcomeOverloaded)
+				writeUnavailable(w, r, retryAfter(), errCodeOverloaded, "Too many requests in flight")
+				return
+			}
+		}
+		requestsInFlight.Inc()
+		defer func() {
+			requestsInFlight.Dec()
+			<-slots
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitForSlot waits up to timeout for a slot, and reports whether it got
+// one.
+func waitForSlot(r *http.Request, slots chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	requestsQueued.Inc()
+	defer requestsQueued.Dec()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+// blockingHandler is a handler holding its requests until release is
+// closed, signaling each one it got on started.
+func blockingHandler() (handler http.Handler, started chan struct{}, release chan struct{}) {
+	started, release = make(chan struct{}, 100), make(chan struct{})
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	return handler, started, release
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		queueTimeout time.Duration
+	}{
+		{name: "without a queue"},
+		{name: "queued until the timeout", queueTimeout: 50 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next, started, release := blockingHandler()
+			handler := LimitConcurrency(next, 3, tt.queueTimeout, func() time.Duration { return 5 * time.Second })
+			shed := telemetrytest.CounterValue(t, requestsShed)
+
+			var wg sync.WaitGroup
+			codes := make([]int, 3)
+			for i := range codes {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil))
+					codes[i] = w.Code
+				}(i)
+			}
+			for range codes {
+				<-started
+			}
+			if n := telemetrytest.GaugeValue(t, requestsInFlight); n != 3 {
+				t.Errorf("%v requests in flight, want 3", n)
+			}
+
+			// the N+1th request is turned down while the N others are served
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil))
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" || !strings.Contains(w.Body.String(), errCodeOverloaded) {
+				t.Errorf("request over the limit: status %d, Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+			}
+			if n := telemetrytest.CounterValue(t, requestsShed) - shed; n != 1 {
+				t.Errorf("%v requests shed, want 1", n)
+			}
+
+			close(release)
+			wg.Wait()
+			for i, code := range codes {
+				if code != http.StatusOK {
+					t.Errorf("request %d within the limit: status %d", i, code)
+				}
+			}
+			if n := telemetrytest.GaugeValue(t, requestsInFlight); n != 0 {
+				t.Errorf("%v requests in flight once done, want 0", n)
+			}
+		})
+	}
+}
+
+func TestLimitConcurrencyQueue(t *testing.T) {
+	next, started, release := blockingHandler()
+	handler := LimitConcurrency(next, 1, 5*time.Second, func() time.Duration { return time.Second })
+	served := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil))
+			served <- w.Code
+		}()
+	}
+
+	// the second request waits for the slot of the first rather than being
+	// turned down
+	<-started
+	select {
+	case <-started:
+		t.Fatal("both requests served at once with a limit of 1")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-served; code != http.StatusOK {
+			t.Errorf("status %d, want the queued request served once a slot freed", code)
+		}
+	}
+}
+
+func TestProxyOrgConcurrency(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": "forward", "ORG_MAX_CONCURRENT": "2", "ORG_MAX_CONCURRENT_ORGS": "globex|1"})
+	proxy.InFlight = NewOrgConcurrencyLimiter(proxy.Config.OrgMaxConcurrent, proxy.Config.OrgMaxConcurrentOrgs, 0, proxy.Config.RateLimitMaxOrgs)
+	forwarder, started, release := blockingHandler()
+	proxy.Forwarder = forwarder
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	for _, org := range []string{"acme", "acme", "globex"} {
+		wg.Add(1)
+		go func(org string) {
+			defer wg.Done()
+			codes <- proxy.get("/orders", org).Code
+		}(org)
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	// each org is turned down past its own limit, not the other's
+	for _, org := range []string{"acme", "globex"} {
+		limited := telemetrytest.CounterValue(t, orgConcurrencyLimited.WithLabelValues(orgLabelOther))
+		w := proxy.get("/orders", org)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "5" || !strings.Contains(w.Body.String(), errCodeOrgConcurrency) {
+			t.Errorf("%s request over its limit: status %d, Retry-After %q: %s", org, w.Code, w.Header().Get("Retry-After"), w.Body)
+		}
+		if n := telemetrytest.CounterValue(t, orgConcurrencyLimited.WithLabelValues(orgLabelOther)) - limited; n != 1 {
+			t.Errorf("%v %s requests counted as limited, want 1", n, org)
+		}
+	}
+
+	// and a slot given back lets the next request in
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request within the limit: status %d", code)
+		}
+	}
+	if w := proxy.get("/orders", "globex"); w.Code != http.StatusOK {
+		t.Errorf("request once the slots were given back: status %d", w.Code)
+	}
+}
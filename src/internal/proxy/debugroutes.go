@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// routesHandler serves the route table as JSON, filtered to one org with
+// ?org= and indented with ?pretty=1. It exposes private addresses and is only
+// mounted on the admin listener.
+func routesHandler(routes *discovery.RouteTable, maintenance *MaintenanceWindows) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+			return
+		}
+		org := r.URL.Query().Get("org")
+		dump := routes.Dump(org)
+		for _, window := range maintenance.List() {
+			if org == "" || window.Org == org {
+				dump.Maintenance = append(dump.Maintenance, window)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		if r.URL.Query().Get("pretty") == "1" {
+			encoder.SetIndent("", "  ")
+		}
+		encoder.Encode(dump)
+	})
+}
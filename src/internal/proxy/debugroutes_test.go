@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"MAINTENANCE": `{"globex": {"message": "Moving to a new region"}}`})
+	admin := proxy.admin("")
+	// get returns the dump served for path.
+	get := func(path string) (*discovery.RoutesDump, string) {
+		t.Helper()
+		w := adminDo(admin, http.MethodGet, path, "", "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: status %d, Content-Type %q: %s", path, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+		var dump discovery.RoutesDump
+		if err := json.Unmarshal(w.Body.Bytes(), &dump); err != nil {
+			t.Fatalf("%s: %s: %v", path, w.Body, err)
+		}
+		return &dump, w.Body.String()
+	}
+
+	// every service, its backends with their task and state
+	dump, body := get("/debug/routes")
+	if dump.BuiltAt == nil || len(dump.Services) != 2 || len(dump.Services["acme"]) != 2 || len(dump.Services["globex"]) != 1 {
+		t.Fatalf("dump %s, want the 3 backends of acme and globex", body)
+	}
+	backend := dump.Services["globex"][0]
+	if backend.IP != "10.0.1.1" || backend.Port != 80 || !strings.HasSuffix(backend.TaskArn, "/g1") || !backend.Healthy || backend.Source.Cluster != "tenants" || backend.Source.Region != discoverytest.Region {
+		t.Errorf("backend of globex %+v", backend)
+	}
+	if len(dump.Maintenance) != 1 || dump.Maintenance[0].Org != "globex" {
+		t.Errorf("maintenance %+v, want globex's window", dump.Maintenance)
+	}
+	if strings.Contains(body, "\n  ") {
+		t.Errorf("dump indented without ?pretty=1: %s", body)
+	}
+
+	// one org, indented
+	dump, body = get("/debug/routes?org=acme&pretty=1")
+	if len(dump.Services) != 1 || len(dump.Services["acme"]) != 2 || len(dump.Maintenance) != 0 {
+		t.Errorf("dump of acme %s, want its 2 backends only", body)
+	}
+	if !strings.Contains(body, "\n  \"services\": {") {
+		t.Errorf("dump not indented with ?pretty=1: %s", body)
+	}
+	if dump, body := get("/debug/routes?org=initech"); len(dump.Services) != 0 {
+		t.Errorf("dump of an unknown org %s, want no service", body)
+	}
+
+	// the dump is read-only
+	w := adminDo(admin, http.MethodPost, "/debug/routes", "", "")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodGet {
+		t.Errorf("POST: status %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// The debug headers. Together with the admin token in debugTokenHeader,
+// debugTaskHeader and debugRevisionHeader pin a request to a task of the
+// service its org resolves to.
+const (
+	debugTokenHeader    = "X-Debug-Token"
+	debugTaskHeader     = "X-Debug-Target-Task"
+	debugRevisionHeader = "X-Debug-Target-Revision"
+)
+
+var (
+	// errInvalidDebugTarget means a debug header holds a value that can't
+	// match a task.
+	errInvalidDebugTarget = errors.New("invalid debug target")
+	// errNoDebugTarget means no task of the service matches the debug
+	// headers.
+	errNoDebugTarget = errors.New("no task matches the debug target")
+)
+
+// DebugTargets honours the debug headers of the requests carrying the admin
+// token, so an engineer can send a request to the one task under suspicion
+// without touching the routing. A nil DebugTargets, without admin token,
+// honours none.
+type DebugTargets struct {
+	token [sha256.Size]byte
+}
+
+// NewDebugTargets returns the DebugTargets of the admin token, nil if there
+// is none.
+func NewDebugTargets(token string) *DebugTargets {
+	if token == "" {
+		return nil
+	}
+	return &DebugTargets{token: sha256.Sum256([]byte(token))}
+}
+
+// debugTarget is the task a request is pinned to: its ARN or the trailing
+// part of it, such as the task ID, its revision, or both.
+type debugTarget struct {
+	task     string
+	revision int
+}
+
+func (t debugTarget) String() string {
+	var parts []string
+	if t.task != "" {
+		parts = append(parts, "task="+t.task)
+	}
+	if t.revision != 0 {
+		parts = append(parts, "revision="+strconv.Itoa(t.revision))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Take removes the debug headers from r, so neither they nor the token
+// reach backends, and returns the target they name when r carries the admin
+// token. Requests without it have their headers ignored, false.
+func (d *DebugTargets) Take(r *http.Request) (debugTarget, bool, error) {
+	sent := r.Header.Get(debugTokenHeader)
+	task := strings.TrimSpace(r.Header.Get(debugTaskHeader))
+	revision := strings.TrimSpace(r.Header.Get(debugRevisionHeader))
+	for _, name := range []string{debugTokenHeader, debugTaskHeader, debugRevisionHeader} {
+		r.Header.Del(name)
+	}
+	if d == nil || sent == "" || task == "" && revision == "" {
+		return debugTarget{}, false, nil
+	}
+	// hashing both sides makes the comparison take as long whatever the
+	// length of the token sent
+	got := sha256.Sum256([]byte(sent))
+	if subtle.ConstantTimeCompare(got[:], d.token[:]) != 1 {
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Rejected debug token", clientIP(r)) {
+			slog.WarnContext(r.Context(), "Rejected debug token, ignoring the debug target", "source", clientIP(r))
+		}
+		return debugTarget{}, false, nil
+	}
+	target := debugTarget{task: task}
+	if revision != "" {
+		n, err := strconv.Atoi(revision)
+		if err != nil || n < 1 {
+			return debugTarget{}, false, fmt.Errorf("%w: %s must be a positive revision number", errInvalidDebugTarget, debugRevisionHeader)
+		}
+		target.revision = n
+	}
+	return target, true, nil
+}
+
+// pick returns the task of services, the backends of the service a request
+// resolved to, that target names. It is picked whatever its health, since
+// the point is reaching a task that may be misbehaving; with several
+// matching, the first by ARN is.
+func (t debugTarget) pick(services []discovery.ECSService) (discovery.ECSService, error) {
+	var matches []discovery.ECSService
+	for _, service := range services {
+		if t.task != "" && service.TaskArn != t.task && !strings.HasSuffix(service.TaskArn, "/"+t.task) {
+			continue
+		}
+		if t.revision != 0 && service.Revision != t.revision {
+			continue
+		}
+		matches = append(matches, service)
+	}
+	if len(matches) == 0 {
+		return discovery.ECSService{}, errNoDebugTarget
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].TaskArn < matches[j].TaskArn })
+	return matches[0], nil
+}
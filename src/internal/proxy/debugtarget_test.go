@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestProxyDebugTarget(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	// a2 runs revision 2 of the task definition
+	a2 := discoverytest.Task("tenants", "acme", "a2", "10.0.0.2")
+	a2.TaskDefinitionArn = aws.String(discoverytest.TaskDefinitionARN("acme", 2))
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"), a2)
+	proxy := newTestProxy(t, fake, nil)
+	proxy.Debug = NewDebugTargets("s3cret")
+	// send sends a request for acme with the debug headers, and checks none
+	// of them is left on it.
+	send := func(headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header.Set("X-Org-ID", "acme")
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := proxy.do(r)
+		for _, name := range []string{debugTokenHeader, debugTaskHeader, debugRevisionHeader} {
+			if value := r.Header.Get(name); value != "" {
+				t.Errorf("%s: %s left on the request", name, value)
+			}
+		}
+		return w
+	}
+
+	for _, tt := range []struct {
+		name    string
+		headers map[string]string
+		status  int
+		// location is the backend the request is sent to, any of them if
+		// empty
+		location string
+		code     string
+	}{
+		{
+			name:     "task",
+			headers:  map[string]string{debugTokenHeader: "s3cret", debugTaskHeader: "a2"},
+			status:   http.StatusTemporaryRedirect,
+			location: "http://10.0.0.2:80/orders",
+		},
+		{
+			name:     "task ARN",
+			headers:  map[string]string{debugTokenHeader: "s3cret", debugTaskHeader: discoverytest.TaskARN("tenants", "a1")},
+			status:   http.StatusTemporaryRedirect,
+			location: "http://10.0.0.1:80/orders",
+		},
+		{
+			name:     "revision",
+			headers:  map[string]string{debugTokenHeader: "s3cret", debugRevisionHeader: "2"},
+			status:   http.StatusTemporaryRedirect,
+			location: "http://10.0.0.2:80/orders",
+		},
+		{
+			name:    "nonexistent task",
+			headers: map[string]string{debugTokenHeader: "s3cret", debugTaskHeader: "a9"},
+			status:  http.StatusNotFound,
+			code:    errCodeNoDebugTarget,
+		},
+		{
+			name:    "task of another revision",
+			headers: map[string]string{debugTokenHeader: "s3cret", debugTaskHeader: "a1", debugRevisionHeader: "2"},
+			status:  http.StatusNotFound,
+			code:    errCodeNoDebugTarget,
+		},
+		{
+			name:    "invalid revision",
+			headers: map[string]string{debugTokenHeader: "s3cret", debugRevisionHeader: "latest"},
+			status:  http.StatusBadRequest,
+			code:    errCodeBadDebugTarget,
+		},
+		// unauthorized, the headers are stripped and routing is as usual
+		{name: "wrong token", headers: map[string]string{debugTokenHeader: "guess", debugTaskHeader: "a9"}, status: http.StatusTemporaryRedirect},
+		{name: "anonymous", headers: map[string]string{debugTaskHeader: "a9"}, status: http.StatusTemporaryRedirect},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.headers)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("status %d: %s, want %d %s", w.Code, w.Body, tt.status, tt.code)
+			}
+			if tt.location != "" && w.Header().Get("Location") != tt.location {
+				t.Errorf("sent to %s, want %s", w.Header().Get("Location"), tt.location)
+			}
+		})
+	}
+
+	// the override is audited
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	send(map[string]string{debugTokenHeader: "s3cret", debugTaskHeader: "a2"})
+	if entry := logged.String(); !strings.Contains(entry, `"msg":"Debug target override"`) || !strings.Contains(entry, `"audit":true`) ||
+		!strings.Contains(entry, `"task":"`+discoverytest.TaskARN("tenants", "a2")+`"`) {
+		t.Errorf("logged %s, want the override audited", entry)
+	}
+
+	// and without an admin token the proxy honours no debug header
+	proxy.Debug = NewDebugTargets("")
+	if w := send(map[string]string{debugTokenHeader: "s3cret", debugTaskHeader: "a9"}); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("request with debug headers, debug targets disabled: status %d: %s", w.Code, w.Body)
+	}
+}
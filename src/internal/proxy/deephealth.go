@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// ecsProbe is the outcome of a DescribeClusters call on a discovered cluster.
+type ecsProbe struct {
+	Cluster   string `json:"cluster"`
+	Region    string `json:"region"`
+	Reachable bool   `json:"reachable"`
+	Throttled bool   `json:"throttled,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type deepHealthStatus struct {
+	// Status is ok, degraded or down, and Reasons say why it isn't ok.
+	Status              string                          `json:"status"`
+	Degraded            bool                            `json:"degraded"`
+	Reasons             []string                        `json:"reasons,omitempty"`
+	ECS                 []ecsProbe                      `json:"ecs"`
+	LastRefresh         *time.Time                      `json:"last_refresh"`
+	AgeSeconds          *float64                        `json:"age_seconds"`
+	Routes              int                             `json:"routes"`
+	ConsecutiveFailures int64                           `json:"consecutive_failures"`
+	NegativeCache       int                             `json:"negative_cache"`
+	Goroutines          map[string]discovery.LoopStatus `json:"goroutines"`
+}
+
+// DeepHealth reports whether the proxy is healthy and how stale its routes
+// are. It answers 503 when it is down: shutting down, without routes, with
+// routes older than maxStaleness, or with a background loop stopped. It
+// answers 200 with degraded set when ECS can't be reached within timeout,
+// discovery failed since the routes were built or they are older than
+// StaleAfter, 0 for never, so monitoring tells degraded from down.
+type DeepHealth struct {
+	Targets      []discovery.ClusterTarget
+	Routes       *discovery.RouteTable
+	Refresher    *discovery.Refresher
+	Loops        *discovery.BackgroundLoops
+	Draining     *atomic.Bool
+	Timeout      time.Duration
+	StaleAfter   time.Duration
+	MaxStaleness time.Duration
+}
+
+func (h DeepHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+		return
+	}
+	status := deepHealthStatus{
+		ECS:                 h.probe(r.Context()),
+		Routes:              len(h.Routes.Services()),
+		ConsecutiveFailures: h.Refresher.Failures(),
+		NegativeCache:       h.Routes.NegativeCacheLen(),
+		Goroutines:          h.Loops.Status(),
+	}
+	var down, degraded []string
+	builtAt := h.Routes.BuiltAt()
+	if builtAt.IsZero() {
+		down = append(down, "routes not discovered yet")
+	} else {
+		age := time.Since(builtAt)
+		seconds := age.Seconds()
+		status.LastRefresh, status.AgeSeconds = &builtAt, &seconds
+		switch {
+		case age > h.MaxStaleness:
+			down = append(down, fmt.Sprintf("routes are %v old, more than %v", age.Round(time.Second), h.MaxStaleness))
+		case h.StaleAfter > 0 && age > h.StaleAfter:
+			degraded = append(degraded, fmt.Sprintf("routes are %v old", age.Round(time.Second)))
+		}
+	}
+	if h.Draining.Load() {
+		down = append(down, "shutting down")
+	}
+	for name, loop := range status.Goroutines {
+		if !loop.Running {
+			down = append(down, name+" stopped")
+		}
+	}
+	for _, probe := range status.ECS {
+		switch {
+		case probe.Throttled:
+			degraded = append(degraded, fmt.Sprintf("ECS throttled in %s/%s", probe.Region, probe.Cluster))
+		case !probe.Reachable:
+			degraded = append(degraded, fmt.Sprintf("ECS unreachable in %s/%s", probe.Region, probe.Cluster))
+		}
+	}
+	if status.ConsecutiveFailures > 0 {
+		degraded = append(degraded, "discovery is failing")
+	}
+	status.Reasons = append(down, degraded...)
+	if len(down) > 0 {
+		status.Status = "down"
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	status.Status = "ok"
+	if len(degraded) > 0 {
+		status.Status, status.Degraded = "degraded", true
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// probe calls DescribeClusters on every discovered cluster at once, without
+// retries, each call bounded by h.timeout.
+func (h DeepHealth) probe(ctx context.Context) []ecsProbe {
+	probes := make([]ecsProbe, len(h.Targets))
+	var wg sync.WaitGroup
+	for i, target := range h.Targets {
+		wg.Add(1)
+		go func(i int, target discovery.ClusterTarget) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+			defer cancel()
+			start := time.Now()
+			_, err := target.Client.DescribeClusters(ctx, &ecs.DescribeClustersInput{
+				Clusters: []string{target.Cluster},
+			})
+			probes[i] = ecsProbe{
+				Cluster:   target.Cluster,
+				Region:    target.Region,
+				Reachable: err == nil,
+				Throttled: err != nil && discovery.IsThrottle(err),
+				LatencyMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				probes[i].Error = err.Error()
+			}
+		}(i, target)
+	}
+	wg.Wait()
+	return probes
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// backendsHandler drains a backend IP on POST /admin/backends/{ip}/drain,
+// for the duration of the optional ttl query parameter, and puts it back in
+// rotation on POST /admin/backends/{ip}/enable. Draining the last backend
+// of a service requires force=true.
+func backendsHandler(routes *discovery.RouteTable) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/admin/backends/")
+		value, action, _ := strings.Cut(rest, "/")
+		if action != "drain" && action != "enable" {
+			writeError(w, r, http.StatusNotFound, errCodeUnknownBackend, "Use /admin/backends/<ip>/drain or /admin/backends/<ip>/enable")
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST is allowed")
+			return
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, errCodeUnknownBackend, "Not a backend IP")
+			return
+		}
+		ip := addr.Unmap().String()
+		if action == "enable" {
+			if !routes.Enable(ip, adminSource(r)) {
+				writeError(w, r, http.StatusNotFound, errCodeUnknownBackend, "Backend isn't drained")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		query := r.URL.Query()
+		var ttl time.Duration
+		if value := query.Get("ttl"); value != "" {
+			if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+				writeError(w, r, http.StatusBadRequest, errCodeInvalidDrain, fmt.Sprintf("Invalid ttl %q, must be a positive duration", value))
+				return
+			}
+		}
+		force, _ := strconv.ParseBool(query.Get("force"))
+		drain, err := routes.Drain(ip, ttl, force, adminSource(r))
+		switch {
+		case errors.Is(err, discovery.ErrUnknownBackend):
+			writeError(w, r, http.StatusNotFound, errCodeUnknownBackend, "No backend has this IP")
+		case errors.Is(err, discovery.ErrLastBackend):
+			writeError(w, r, http.StatusConflict, errCodeLastBackend, "IP is the "+err.Error()+", confirm with force=true")
+		case err != nil:
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error())
+		default:
+			writeJSON(w, http.StatusOK, drain)
+		}
+	})
+}
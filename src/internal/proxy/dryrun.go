@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// dryRunResponse describes where a request would have been sent.
+type dryRunResponse struct {
+	Org string `json:"org"`
+	// Outcome is how the backend was found, hit or miss-refresh-hit.
+	Outcome string `json:"outcome"`
+	Service string `json:"service"`
+	Task    string `json:"task"`
+	Backend string `json:"backend"`
+	// URL is where the request would have been sent.
+	URL string `json:"url"`
+	// Cluster and Region are where the service was discovered, which tells
+	// a failover to the secondary cluster apart.
+	Cluster string `json:"cluster"`
+	Region  string `json:"region"`
+}
+
+// writeDryRun answers a request routed to service, reached as target says,
+// with the routing decision instead of redirecting or forwarding it, and
+// logs the decision. The request is counted under the dry-run outcome so it
+// doesn't skew the real ones.
+func writeDryRun(w http.ResponseWriter, r *http.Request, orgID string, service discovery.ECSService, target config.OrgTarget) {
+	decision := dryRunResponse{
+		Org:     orgID,
+		Outcome: telemetry.OutcomeHit,
+		Service: service.Name,
+		Task:    service.TaskArn,
+		Backend: targetHost(target, service),
+		URL:     resolveTarget(target, service, r.URL),
+		Cluster: service.Cluster,
+		Region:  service.Region,
+	}
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		decision.Outcome = info.outcome
+	}
+	setOutcome(r, telemetry.OutcomeDryRun)
+	slog.InfoContext(r.Context(), "Dry run", "org", decision.Org, "outcome", decision.Outcome, "service", decision.Service,
+		"task", decision.Task, "backend", decision.Backend, "url", decision.URL, "cluster", decision.Cluster, "region", decision.Region)
+	writeJSON(w, http.StatusOK, decision)
+}
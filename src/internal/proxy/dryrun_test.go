@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+func TestProxyDryRun(t *testing.T) {
+	for _, mode := range []string{config.ProxyModeRedirect, config.ProxyModeForward} {
+		t.Run(mode, func(t *testing.T) {
+			fake := discoverytest.NewECS()
+			fake.AddService("tenants", "acme")
+			fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+			proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": mode, "DRY_RUN": "true", "REFRESH_MIN_INTERVAL": "10s"})
+			proxy.Forwarder = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("dry run forwarded %s", r.URL)
+			})
+			// initech is only known to the standby cluster
+			standby := discovery.NewRouteTable([]discovery.ECSService{{
+				Name: "initech", IP: "10.1.0.1", Port: 8080, TaskArn: discoverytest.TaskARN("standby", "i1"), Cluster: "standby", Region: "us-east-1",
+			}}, nil, config.LBStrategyRoundRobin)
+			proxy.Lookup = discovery.NewFailoverRoutes(proxy.overrides, proxy.Routes, standby, time.Minute)
+			// a service deployed since startup is found by the refresh its
+			// first request triggers
+			fake.AddService("tenants", "globex")
+			fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+			defer slog.SetDefault(slog.Default())
+
+			for _, tt := range []struct {
+				name, org string
+				want      dryRunResponse
+			}{
+				{name: "hit", org: "acme", want: dryRunResponse{
+					Org: "acme", Outcome: telemetry.OutcomeHit, Service: "acme", Task: discoverytest.TaskARN("tenants", "a1"),
+					Backend: "10.0.0.1:80", URL: "http://10.0.0.1:80/orders?id=1", Cluster: "tenants", Region: discoverytest.Region,
+				}},
+				{name: "miss", org: "globex", want: dryRunResponse{
+					Org: "globex", Outcome: telemetry.OutcomeMissRefreshHit, Service: "globex", Task: discoverytest.TaskARN("tenants", "g1"),
+					Backend: "10.0.1.1:80", URL: "http://10.0.1.1:80/orders?id=1", Cluster: "tenants", Region: discoverytest.Region,
+				}},
+				{name: "failover", org: "initech", want: dryRunResponse{
+					Org: "initech", Outcome: telemetry.OutcomeHit, Service: "initech", Task: discoverytest.TaskARN("standby", "i1"),
+					Backend: "10.1.0.1:8080", URL: "http://10.1.0.1:8080/orders?id=1", Cluster: "standby", Region: "us-east-1",
+				}},
+			} {
+				var logged bytes.Buffer
+				slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+				r, info := withRequestInfo(httptest.NewRequest(http.MethodPost, "http://proxy.example.com/orders?id=1", strings.NewReader("{}")))
+				r.Header.Set("X-Org-ID", tt.org)
+				w := proxy.do(r)
+				if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+					t.Fatalf("%s: status %d to %q: %s, want the decision", tt.name, w.Code, w.Header().Get("Location"), w.Body)
+				}
+				var decision dryRunResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &decision); err != nil {
+					t.Fatalf("%s: body %s: %v", tt.name, w.Body, err)
+				}
+				if decision != tt.want {
+					t.Errorf("%s: decision %+v, want %+v", tt.name, decision, tt.want)
+				}
+				// counted apart from the real requests
+				if info.outcome != telemetry.OutcomeDryRun {
+					t.Errorf("%s: outcome %s, want %s", tt.name, info.outcome, telemetry.OutcomeDryRun)
+				}
+				// and logged, after the refresh of a miss
+				lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+				var entry struct{ Msg, Org, Outcome, Backend, URL string }
+				if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+					t.Fatalf("%s: log %q: %v", tt.name, &logged, err)
+				}
+				if entry.Msg != "Dry run" || entry.Org != tt.org || entry.Outcome != tt.want.Outcome || entry.Backend != tt.want.Backend || entry.URL != tt.want.URL {
+					t.Errorf("%s: logged %+v, want the decision", tt.name, entry)
+				}
+			}
+
+			// an org no cluster knows gets its error as usual
+			if w := proxy.get("/orders", "hooli"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), errCodeUnknownOrg) {
+				t.Errorf("unknown org: status %d: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
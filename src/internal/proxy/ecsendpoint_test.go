@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestECSEndpoint(t *testing.T) {
+	fake := discoverytest.NewECS()
+	// small pages so discovery follows the next tokens
+	fake.ServicePage, fake.TaskPage = 2, 2
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddService("tenants", "initech")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"),
+		discoverytest.Task("tenants", "initech", "i1", "10.0.2.1"),
+	)
+	endpoint := discoverytest.NewEndpoint(t, fake)
+	awsConfig := aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")}
+	// the ECS clients are the ones of the proxy, sending their calls to
+	// ECS_ENDPOINT_URL
+	proxy := startTestProxy(t, map[string]string{"ECS_ENDPOINT_URL": endpoint.URL, "REFRESH_MIN_INTERVAL": "10s"}, func(config config.Config) discovery.ECSAPI {
+		return discovery.RegionClients(awsConfig, config.ECSEndpointURL)(discoverytest.Region)
+	})
+	// route checks that org is routed to one of locations
+	route := func(org string, locations ...string) {
+		t.Helper()
+		w := proxy.get("/orders", org)
+		for _, location := range locations {
+			if w.Code == http.StatusTemporaryRedirect && w.Header().Get("Location") == location {
+				return
+			}
+		}
+		t.Errorf("%s: status %d to %q, want one of %q", org, w.Code, w.Header().Get("Location"), locations)
+	}
+	// refresh discovers the cluster again once the cooldown is over
+	refresh := func() error {
+		proxy.clock.Advance(10 * time.Second)
+		_, err := proxy.Refresher.Rebuild(context.Background(), discovery.TriggerScheduled)
+		return err
+	}
+
+	// startup discovered every page of services and tasks
+	route("acme", "http://10.0.0.1:80/orders", "http://10.0.0.2:80/orders")
+	route("globex", "http://10.0.1.1:80/orders")
+	route("initech", "http://10.0.2.1:80/orders")
+	if n := fake.Count("ListServices"); n != 2 {
+		t.Errorf("%d ListServices calls, want one per page of 2", n)
+	}
+
+	t.Run("task added", func(t *testing.T) {
+		fake.AddService("tenants", "hooli")
+		fake.AddTasks("tenants", discoverytest.Task("tenants", "hooli", "h1", "10.0.3.1"))
+		// found by the refresh its first request triggers
+		route("hooli", "http://10.0.3.1:80/orders")
+	})
+
+	t.Run("task removed", func(t *testing.T) {
+		fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "a1"))
+		if err := refresh(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			route("acme", "http://10.0.0.2:80/orders")
+		}
+	})
+
+	t.Run("throttle burst", func(t *testing.T) {
+		throttles := telemetry.ECSThrottles.Value()
+		fake.FailNext("ListServices", discoverytest.Throttled(), discoverytest.Throttled(), discoverytest.Throttled())
+		fake.FailNext("DescribeTasks", discoverytest.Throttled())
+		if err := refresh(); err != nil {
+			t.Fatalf("refresh failed through the throttles: %v", err)
+		}
+		if n := telemetry.ECSThrottles.Value() - throttles; n != 4 {
+			t.Errorf("counted %d throttles, want 4", n)
+		}
+		route("globex", "http://10.0.1.1:80/orders")
+	})
+
+	t.Run("malformed response", func(t *testing.T) {
+		fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "g1"))
+		endpoint.MalformNext("ListServices", 1)
+		if err := refresh(); err == nil {
+			t.Fatal("refresh succeeded with a response that doesn't decode")
+		}
+		// the routes are kept until discovery succeeds again
+		route("globex", "http://10.0.1.1:80/orders")
+		if err := refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if w := proxy.get("/orders", "globex"); w.Code == http.StatusTemporaryRedirect {
+			t.Errorf("removed task still routed to %q", w.Header().Get("Location"))
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Handler routes every request by its org header, whatever the path:
+// it authorizes the org, looks its backend up, refreshing the routes on a
+// miss, and redirects or forwards the request to it. Authentication,
+// logging and metrics wrap it as ordinary middleware.
+type Handler struct {
+	Config config.Config
+	Live   *LiveConfig
+	Routes *discovery.RouteTable
+	// Lookup picks the backends, from routes, the standby table and the
+	// route overrides.
+	Lookup    *discovery.FailoverRoutes
+	Refresher *discovery.Refresher
+	// Keys and limiter are nil when API keys or rate limiting are off.
+	Keys    *APIKeys
+	Limiter RateLimiter
+	Orgs    *OrgLabels
+	// InFlight caps the requests in flight per org, nil without a cap.
+	InFlight *OrgConcurrencyLimiter
+	// Debug honours the debug headers of requests carrying the admin
+	// token, nil without one.
+	Debug *DebugTargets
+	// Forwarder sends the requests of ProxyModeForward, and mirror a copy
+	// of some to a shadow target; mirror is nil when none are.
+	Forwarder http.Handler
+	Mirror    *Mirror
+	// Waker starts services scaled to zero, nil when wake-up is off.
+	Waker *discovery.Waker
+	// MissWait holds missed lookups for the refresh in flight, nil when
+	// they are answered right away.
+	MissWait *MissWait
+	// Cache answers cacheable requests of ProxyModeForward, nil when
+	// responses aren't cached.
+	Cache *ResponseCache
+}
+
+// maxOrgIDLength is the length of the longest org ID, that of the longest
+// ECS service name.
+const maxOrgIDLength = 255
+
+// parseOrgHeader returns the org ID of the values of the routing header, empty
+// if there is none, and an error if it is malformed: sent again with
+// another value, blank, longer than maxOrgIDLength or holding control
+// characters.
+func parseOrgHeader(values []string) (string, error) {
+	if len(values) == 0 || values[0] == "" {
+		return "", nil
+	}
+	org := values[0]
+	for _, value := range values[1:] {
+		if value != org {
+			return org, errors.New("sent with several values")
+		}
+	}
+	if strings.TrimSpace(org) == "" {
+		return org, errors.New("blank")
+	}
+	if len(org) > maxOrgIDLength {
+		return org, fmt.Errorf("longer than %d bytes", maxOrgIDLength)
+	}
+	if strings.IndexFunc(org, unicode.IsControl) >= 0 {
+		return org, errors.New("control character")
+	}
+	return org, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	orgID, err := parseOrgHeader(r.Header.Values(h.Config.HeaderRoutingName))
+	if orgID == "" {
+		setOutcome(r, telemetry.OutcomeBadRequest)
+		writeError(w, r, http.StatusBadRequest, errCodeMissingHeader, fmt.Sprintf("missing required header %s", h.Config.HeaderRoutingName))
+		return
+	}
+	if err != nil {
+		setOutcome(r, telemetry.OutcomeBadRequest)
+		writeError(w, r, http.StatusBadRequest, errCodeInvalidHeader, fmt.Sprintf("invalid header %s: %v", h.Config.HeaderRoutingName, err))
+		return
+	}
+
+	// taken off every request, so they never reach backends
+	pin, pinned, err := h.Debug.Take(r)
+	if err != nil {
+		setOutcome(r, telemetry.OutcomeBadRequest)
+		writeError(w, r, http.StatusBadRequest, errCodeBadDebugTarget, err.Error())
+		return
+	}
+
+	if !h.Config.ClientOrgs.Allowed(clientIdentityFrom(r.Context()), orgID) {
+		setOutcome(r, telemetry.OutcomeForbidden)
+		writeError(w, r, http.StatusForbidden, errCodeOrgNotAllowed, "Client is not allowed to route this Org-ID")
+		return
+	}
+
+	if !h.Config.SigV4Principals.Allowed(sigv4PrincipalFrom(r.Context()), orgID) {
+		setOutcome(r, telemetry.OutcomeForbidden)
+		writeError(w, r, http.StatusForbidden, errCodePrincipalDenied, "Principal is not allowed to route this Org-ID")
+		return
+	}
+
+	if h.Keys != nil {
+		if err := h.Keys.Check(orgID, r.Header.Get(h.Config.APIKeyHeader)); err != nil {
+			h.Keys.reject(w, r, orgID, err)
+			return
+		}
+		// the key is the proxy's business, backends don't get it
+		r.Header.Del(h.Config.APIKeyHeader)
+	}
+
+	// read-only integrations using another method hint at stolen credentials
+	if allow, ok := h.Live.AllowedMethods().Allowed(orgID, r.Method); !ok {
+		rejectMethod(w, r, h.Orgs, orgID, !h.Routes.Matches(orgID), allow)
+		return
+	}
+
+	maintenance := h.Live.Maintenance()
+	if window, ok := maintenance.Active(orgID); ok {
+		writeMaintenance(w, r, window, h.Config.MaintenancePage, h.Live.RetryAfter(), maintenance.clock.Now())
+		return
+	}
+
+	// the org is checked before its bucket is picked so unknown orgs
+	// can't grow the buckets, they share one
+	if h.Limiter != nil || h.InFlight != nil {
+		shared := !h.Routes.Matches(orgID)
+		key := rateLimitShared
+		if !shared {
+			key = config.NormalizeOrg(orgID)
+		}
+		if h.Limiter != nil {
+			if ok, wait := h.Limiter.Allow(key); !ok {
+				rejectRateLimited(w, r, h.Orgs, orgID, shared, wait)
+				return
+			}
+		}
+		if h.InFlight != nil {
+			label := limitLabel(h.Orgs, orgID, shared)
+			release, ok := h.InFlight.Acquire(r.Context(), key, label)
+			if !ok {
+				if r.Context().Err() != nil {
+					// the client went away while queued, no one to answer
+					return
+				}
+				rejectOrgConcurrency(w, r, orgID, label, h.Live.RetryAfter())
+				return
+			}
+			// deferred so the slot is given back however the request
+			// ends, panics included
+			defer release()
+		}
+	}
+
+	if h.Routes.BuiltAt().IsZero() {
+		setOutcome(r, telemetry.OutcomeNotReady)
+		writeUnavailable(w, r, h.Live.RetryAfter(), errCodeRoutesNotReady, "Routes are not discovered yet")
+		return
+	}
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attrOrg.String(orgID))
+	// requests pinned to a task or answered with the routing decision
+	// must reach the routing
+	var cached *cacheLookup
+	if !pinned && !h.Config.DryRun {
+		if cached = h.Cache.Lookup(r, orgID); cached.Fresh() {
+			setOutcome(r, telemetry.OutcomeCacheHit)
+			cached.Serve(w, r)
+			return
+		}
+	}
+	_, info := withRequestInfo(r)
+	lookupStart := time.Now()
+	ctx, lookupSpan := tracer.Start(r.Context(), "lookup")
+	h.Refresher.Revalidate(ctx)
+	service, err := h.Lookup.Lookup(orgID)
+	// orgs that recently matched nothing after a refresh don't refresh again
+	missed := err == discovery.ErrServiceNotFound && !h.Routes.KnownMissing(orgID) || err == discovery.ErrNoRunningTasks
+	if missed && h.Live.RefreshOnMiss() {
+		// try sync with the cluster, abandoned if the client goes away
+		refreshStart := time.Now()
+		refreshCtx, refreshSpan := tracer.Start(ctx, "refresh")
+		if h.Refresher.RefreshOnMiss(refreshCtx) {
+			service, err = h.Lookup.Lookup(orgID)
+			if err == discovery.ErrServiceNotFound {
+				h.Routes.RememberMissing(orgID)
+			}
+			setOutcome(r, telemetry.OutcomeMissRefreshHit)
+		}
+		refreshSpan.End()
+		info.refresh = time.Since(refreshStart)
+	}
+	if err == discovery.ErrServiceNotFound || err == discovery.ErrNoRunningTasks {
+		// a refresh the miss didn't start, or that started a moment ago,
+		// may be about to publish the org
+		waitStart := time.Now()
+		waitCtx, waitSpan := tracer.Start(ctx, "miss-wait")
+		if h.MissWait.Wait(waitCtx, h.Refresher) {
+			if service, err = h.Lookup.Lookup(orgID); err == nil {
+				setOutcome(r, telemetry.OutcomeMissRefreshHit)
+			}
+		}
+		waitSpan.End()
+		info.refresh += time.Since(waitStart)
+	}
+	lookupSpan.End()
+	info.lookup = time.Since(lookupStart)
+	if err == discovery.ErrServiceNotFound || err == discovery.ErrNoRunningTasks {
+		if h.Waker.Wake(r.Context(), orgID) {
+			setOutcome(r, telemetry.OutcomeNoBackend)
+			writeUnavailable(w, r, h.Config.ScaleUpRetryAfter, errCodeScalingUp, "Service of Org-ID is starting its tasks")
+			return
+		}
+		if tasks, ok := h.Routes.ServiceTasks(orgID); ok && tasks.ScalingUp() {
+			setOutcome(r, telemetry.OutcomeNoBackend)
+			if telemetry.LogSamples.Allow(r.Context(), slog.LevelDebug, "Service scaling up", orgID) {
+				slog.DebugContext(r.Context(), "Service scaling up", "org", orgID, "service", tasks.Service,
+					"desired", tasks.Desired, "pending", tasks.Pending)
+			}
+			writeUnavailable(w, r, h.Config.ScaleUpRetryAfter, errCodeScalingUp, "Service of Org-ID is starting its tasks")
+			return
+		}
+	}
+	switch err {
+	case nil:
+	case discovery.ErrNoRunningTasks:
+		setOutcome(r, telemetry.OutcomeNoBackend)
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelDebug, "No running tasks", orgID) {
+			slog.DebugContext(r.Context(), "No running tasks", "org", orgID)
+		}
+		writeUnavailable(w, r, h.Live.RetryAfter(), errCodeNoRunningTasks, "No running tasks for Org-ID")
+		return
+	case discovery.ErrAmbiguousOrg:
+		setOutcome(r, telemetry.OutcomeAmbiguous)
+		writeError(w, r, http.StatusConflict, errCodeAmbiguousOrg, "Org-ID matches several services")
+		return
+	case discovery.ErrNoTargetContainer:
+		setOutcome(r, telemetry.OutcomeNoBackend)
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "No target container", orgID) {
+			slog.WarnContext(r.Context(), "No task of the org's service runs its target container", "org", orgID,
+				"container", h.Live.OrgTarget(orgID).Container)
+		}
+		writeError(w, r, http.StatusBadGateway, errCodeNoContainer, "No task of the service of Org-ID runs its target container")
+		return
+	case discovery.ErrNoHealthyBackend:
+		setOutcome(r, telemetry.OutcomeNoBackend)
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelDebug, "No healthy backend", orgID) {
+			slog.DebugContext(r.Context(), "No healthy backend", "org", orgID)
+		}
+		writeUnavailable(w, r, h.Live.RetryAfter(), errCodeNoHealthyBackend, "No healthy backend for Org-ID")
+		return
+	default:
+		setOutcome(r, telemetry.OutcomeNotFound)
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelDebug, "Service not found", orgID) {
+			slog.DebugContext(r.Context(), "Service not found", "org", orgID)
+		}
+		writeError(w, r, http.StatusNotFound, errCodeUnknownOrg, "Service not found for Org-ID")
+		return
+	}
+	if pinned {
+		resolved := service
+		if service, err = pin.pick(h.Routes.ServiceBackends(orgID, resolved)); err != nil {
+			setOutcome(r, telemetry.OutcomeNotFound)
+			writeError(w, r, http.StatusNotFound, errCodeNoDebugTarget, fmt.Sprintf("No task of service %s matches the debug target %s", resolved.Name, pin))
+			return
+		}
+		info.debugTarget = service.TaskArn
+		slog.InfoContext(r.Context(), "Debug target override", "org", orgID, "service", service.Name, "task", service.TaskArn,
+			"target", pin.String(), "caller", clientIP(r), "audit", true)
+	}
+
+	target := h.Live.OrgTarget(orgID)
+	if service.Cluster == discovery.OverrideCluster {
+		// the override names the port
+		target.Port = 0
+	}
+	if target.Scheme == "" && h.Config.BackendTLS {
+		target.Scheme = "https"
+	}
+	if !discovery.BackendAllowed(r.Context(), h.Config.BackendAllowedCIDRs, service) {
+		setOutcome(r, telemetry.OutcomeBackendError)
+		writeError(w, r, http.StatusBadGateway, errCodeBackendDenied, "Backend address is not allowed")
+		return
+	}
+	// a forwarded request's header is set on its response, in case a retry
+	// goes to another task
+	if h.Config.BackendTaskHeader && service.TaskArn != "" && (h.Config.DryRun || h.Config.ProxyMode != config.ProxyModeForward) {
+		w.Header().Set(backendTaskHeader, discovery.TaskID(service.TaskArn))
+	}
+	if h.Config.DryRun {
+		setBackend(r, orgID, targetHost(target, service), service.TaskArn)
+		span.SetAttributes(attrService.String(service.Name), attrBackend.String(targetHost(target, service)))
+		writeDryRun(w, r, orgID, service, target)
+		return
+	}
+	if h.Config.ProxyMode == config.ProxyModeForward {
+		release := h.Routes.Track(service)
+		defer func() { release() }()
+		// a retry is tracked on the backend it goes to
+		retarget := func() (discovery.ECSService, error) {
+			next, err := h.Lookup.Lookup(orgID)
+			if err == nil && !discovery.BackendAllowed(r.Context(), h.Config.BackendAllowedCIDRs, next) {
+				return next, discovery.ErrBackendNotAllowed
+			}
+			if err == nil {
+				release()
+				release = h.Routes.Track(next)
+			}
+			return next, err
+		}
+		if pinned {
+			// retries would go elsewhere
+			retarget = nil
+		}
+		h.Live.OrgHeaders().Apply(r, orgID)
+		mirrored := h.Mirror.Start(r, orgID)
+		setBackend(r, orgID, targetHost(target, service), service.TaskArn)
+		span.SetAttributes(attrService.String(service.Name), attrBackend.String(targetHost(target, service)))
+		cached.Forward(w, withBackend(r, orgID, service, target, retarget), h.Forwarder.ServeHTTP)
+		mirrored()
+		return
+	}
+	setBackend(r, orgID, targetHost(target, service), service.TaskArn)
+	span.SetAttributes(attrService.String(service.Name), attrBackend.String(targetHost(target, service)))
+	http.Redirect(w, r, resolveTarget(target, service, r.URL), http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,762 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// testProxy is a Handler discovering the tenants cluster of a fake
+// ECS, telling the time with a fake clock.
+type testProxy struct {
+	*Handler
+	ecs       *discoverytest.ECS
+	clock     *clocktest.Clock
+	overrides *discovery.RouteOverrides
+}
+
+// newTestProxy returns a proxy configured by flags on top of the defaults,
+// with its routes discovered. The clock is past the refresh cooldown.
+func newTestProxy(t *testing.T, fake *discoverytest.ECS, flags map[string]string) *testProxy {
+	t.Helper()
+	proxy := startTestProxy(t, flags, func(config.Config) discovery.ECSAPI { return fake })
+	proxy.ecs = fake
+	return proxy
+}
+
+// startTestProxy is newTestProxy discovering the tenants cluster through
+// the client returns for the proxy's configuration.
+func startTestProxy(t *testing.T, flags map[string]string, client func(config.Config) discovery.ECSAPI) *testProxy {
+	t.Helper()
+	proxy := coldTestProxy(t, flags, client)
+	if _, err := proxy.Refresher.Rebuild(context.Background(), discovery.TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	proxy.clock.Advance(proxy.Config.RefreshMinInterval)
+	return proxy
+}
+
+// coldTestProxy is startTestProxy before its routes are discovered.
+func coldTestProxy(t *testing.T, flags map[string]string, client func(config.Config) discovery.ECSAPI) *testProxy {
+	t.Helper()
+	values := map[string]string{"ECS_CLUSTER": "tenants"}
+	for name, value := range flags {
+		values[name] = value
+	}
+	cfg, err := config.Load(values, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := clocktest.New()
+	routes := discovery.NewRouteTable(nil, discovery.NewNegativeCache(cfg.NegativeTTL, cfg.NegativeCacheSize), cfg.LBStrategy)
+	routes.SetClock(clock)
+	routes.SetAmbiguity(cfg.AmbiguousMatch, cfg.AmbiguousMatchPriority, cfg.ConfiguredOrgs())
+	opts := discovery.Options{
+		TaskSelection: cfg.TaskSelection,
+		PortLabel:     cfg.PortLabel,
+		DefaultPort:   cfg.DefaultPort,
+		AddressFamily: cfg.AddressFamily,
+		Concurrency:   cfg.DiscoveryConcurrency,
+		ServiceCounts: cfg.ServiceCounts,
+	}
+	refresher := discovery.NewRefresher([]discovery.ClusterTarget{{Client: client(cfg), Cluster: "tenants", Region: discoverytest.Region}}, opts, routes, cfg.RefreshMinInterval)
+	refresher.SetClock(clock)
+	live := NewLiveConfig(cfg)
+	live.Maintenance().SetClock(clock)
+	live.OnOrgTargets(func(targets map[string]config.OrgTarget) {
+		routes.SetTargetContainers(discovery.OrgContainers(targets))
+	})
+	overrides := discovery.NewRouteOverrides(cfg.BackendAllowedCIDRs)
+	overrides.SetClock(clock)
+	lookup := discovery.NewFailoverRoutes(overrides, routes, nil, 0)
+	lookup.SetClock(clock)
+	var held *MissWait
+	if cfg.MissWait {
+		held = NewMissWait(cfg.MissWaitTimeout, cfg.MissWaitMaxWaiters)
+	}
+	return &testProxy{
+		Handler: &Handler{
+			Config:    cfg,
+			Live:      live,
+			Routes:    routes,
+			Lookup:    lookup,
+			Refresher: refresher,
+			MissWait:  held,
+		},
+		clock:     clock,
+		overrides: overrides,
+	}
+}
+
+// get sends a GET of path for org to the proxy, without the org header if
+// org is empty.
+func (p *testProxy) get(path, org string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com"+path, nil)
+	if org != "" {
+		r.Header.Set("X-Org-ID", org)
+	}
+	return p.do(r)
+}
+
+// do sends r to the proxy and returns its response.
+func (p *testProxy) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyOrgHeader(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, nil)
+	for _, tt := range []struct {
+		name   string
+		values []string
+		status int
+		// code is the error code of a 400, location the Location of a
+		// redirect.
+		code, location string
+	}{
+		{name: "missing", status: http.StatusBadRequest, code: errCodeMissingHeader},
+		{name: "empty", values: []string{""}, status: http.StatusBadRequest, code: errCodeMissingHeader},
+		{name: "blank", values: []string{"  "}, status: http.StatusBadRequest, code: errCodeInvalidHeader},
+		{name: "several values", values: []string{"acme", "globex"}, status: http.StatusBadRequest, code: errCodeInvalidHeader},
+		{name: "control character", values: []string{"ac\x00me"}, status: http.StatusBadRequest, code: errCodeInvalidHeader},
+		{name: "too long", values: []string{strings.Repeat("a", maxOrgIDLength+1)}, status: http.StatusBadRequest, code: errCodeInvalidHeader},
+		{name: "known", values: []string{"acme"}, status: http.StatusTemporaryRedirect, location: "http://10.0.0.1:80/orders?id=1"},
+		{name: "repeated", values: []string{"acme", "acme"}, status: http.StatusTemporaryRedirect, location: "http://10.0.0.1:80/orders?id=1"},
+		{name: "unknown", values: []string{"initech"}, status: http.StatusNotFound, code: errCodeUnknownOrg},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders?id=1", nil)
+			for _, value := range tt.values {
+				r.Header.Add("X-Org-ID", value)
+			}
+			w := proxy.do(r)
+			if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+				t.Fatalf("status %d to %q, want %d to %q: %s", w.Code, w.Header().Get("Location"), tt.status, tt.location, w.Body)
+			}
+			if tt.code != "" && !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+				t.Errorf("body %s, want the %s error code", w.Body, tt.code)
+			}
+		})
+	}
+}
+
+func TestProxyMissRefresh(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"REFRESH_MIN_INTERVAL": "10s"})
+
+	// a service deployed since startup is found by the refresh its first
+	// request triggers
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	if w := proxy.get("/orders", "globex"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://10.0.1.1:80/orders" {
+		t.Errorf("miss with a successful refresh: status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// one deployed while ECS fails isn't, and the org gets a 404
+	proxy.clock.Advance(10 * time.Second)
+	fake.AddService("tenants", "initech")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "initech", "i1", "10.0.2.1"))
+	fake.FailNext("ListServices", discoverytest.AccessDenied())
+	w := proxy.get("/orders", "initech")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), errCodeUnknownOrg) {
+		t.Errorf("miss with a failed refresh: status %d: %s", w.Code, w.Body)
+	}
+	// the routes it had are kept
+	if w := proxy.get("/orders", "globex"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("known org after a failed refresh: status %d", w.Code)
+	}
+}
+
+func TestProxyConcurrentMisses(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		flags map[string]string
+		// routed is whether the requests that missed while the first
+		// one's refresh was in flight are routed once it is done.
+		routed bool
+	}{
+		{name: "answered right away", flags: nil},
+		{name: "held for the refresh", flags: map[string]string{"MISS_WAIT": "true", "MISS_WAIT_TIMEOUT": "10s"}, routed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := discoverytest.NewECS()
+			fake.AddService("tenants", "acme")
+			fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+			proxy := newTestProxy(t, fake, tt.flags)
+			discoveries := fake.Count("ListServices")
+
+			// globex is deployed, then a burst of its requests arrives
+			fake.AddService("tenants", "globex")
+			fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+			fake.Latency = 100 * time.Millisecond
+			start := make(chan struct{})
+			codes := make([]int, 50)
+			var wg sync.WaitGroup
+			for i := range codes {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+					w := proxy.get("/orders", "globex")
+					codes[i] = w.Code
+					if w.Code == http.StatusTemporaryRedirect && w.Header().Get("Location") != "http://10.0.1.1:80/orders" {
+						t.Errorf("Location %s", w.Header().Get("Location"))
+					}
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+
+			if n := fake.Count("ListServices") - discoveries; n != 1 {
+				t.Errorf("%d discoveries for 50 concurrent misses, want 1", n)
+			}
+			routed := 0
+			for _, code := range codes {
+				if code == http.StatusTemporaryRedirect {
+					routed++
+				}
+			}
+			// the request that started the refresh waits for it either way
+			want := 1
+			if tt.routed {
+				want = len(codes)
+			}
+			if routed < want {
+				t.Errorf("%d requests routed, want %d", routed, want)
+			}
+		})
+	}
+}
+
+func TestProxyMissCooldown(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	// without the negative cache every bogus org misses
+	proxy := newTestProxy(t, fake, map[string]string{"REFRESH_MIN_INTERVAL": "10s", "NEGATIVE_TTL": "0"})
+	discoveries := fake.Count("ListServices")
+	suppressed := telemetry.RefreshesSuppressed.Value()
+
+	for window := 1; window <= 3; window++ {
+		for i := 0; i < 100; i++ {
+			if w := proxy.get("/", fmt.Sprintf("bogus-%d-%d", window, i)); w.Code != http.StatusNotFound {
+				t.Fatalf("bogus org: status %d", w.Code)
+			}
+		}
+		if n := fake.Count("ListServices") - discoveries; n != window {
+			t.Fatalf("%d discoveries after %d cooldown windows of bogus orgs, want one per window", n, window)
+		}
+		proxy.clock.Advance(10 * time.Second)
+	}
+	if n := telemetry.RefreshesSuppressed.Value() - suppressed; n != 3*99 {
+		t.Errorf("%d refreshes suppressed, want %d", n, 3*99)
+	}
+
+	// a legitimate miss right after the cooldown refreshes exactly once
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	before := fake.Count("ListServices")
+	if w := proxy.get("/", "globex"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("new org after the cooldown: status %d", w.Code)
+	}
+	if n := fake.Count("ListServices") - before; n != 1 {
+		t.Errorf("%d discoveries for the new org, want 1", n)
+	}
+}
+
+func TestProxyServesStaleRoutes(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, nil)
+
+	// ECS goes away after the initial load
+	errs := make([]error, 10)
+	for i := range errs {
+		errs[i] = discoverytest.AccessDenied()
+	}
+	fake.FailNext("ListServices", errs...)
+	failures := telemetry.RefreshFailures.Value()
+	if w := proxy.get("/", "globex"); w.Code != http.StatusNotFound {
+		t.Errorf("miss with a failing refresh: status %d", w.Code)
+	}
+	if telemetry.RefreshFailures.Value() == failures {
+		t.Error("failed refresh not counted")
+	}
+	if _, err := proxy.Refresher.Rebuild(context.Background(), discovery.TriggerScheduled); err == nil {
+		t.Error("scheduled refresh succeeded against a failing ECS")
+	}
+	if w := proxy.get("/orders", "acme"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://10.0.0.1:80/orders" {
+		t.Errorf("known org after failed refreshes: status %d, Location %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func FuzzParseOrgHeader(f *testing.F) {
+	f.Add("acme", "")
+	f.Add("acme", "acme")
+	f.Add("acme", "globex")
+	f.Add("acme\r\nX-Injected: 1", "")
+	f.Add("ac%0d%0ame", "")
+	f.Add("société-générale", "")
+	f.Add(strings.Repeat("é", maxOrgIDLength), "")
+	f.Add(" \t", "")
+	f.Fuzz(func(t *testing.T, first, second string) {
+		values := []string{first}
+		if second != "" {
+			values = append(values, second)
+		}
+		org, err := parseOrgHeader(values)
+		if err != nil || org == "" {
+			return
+		}
+		// an org that got through can't be empty, oversized, or split a
+		// log line or a header
+		if org != first || strings.TrimSpace(org) == "" || len(org) > maxOrgIDLength || strings.ContainsAny(org, "\r\n\x00") {
+			t.Errorf("parseOrgHeader(%q) = %q", values, org)
+		}
+		if normalized := config.NormalizeOrg(org); config.NormalizeOrg(normalized) != normalized || normalized != strings.TrimSpace(normalized) {
+			t.Errorf("normalizeOrg(%q) = %q, not normalized", org, normalized)
+		}
+	})
+}
+
+func TestProxyUnroutableOrgs(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddService("tenants", "hooli")
+	unhealthy := discoverytest.Task("tenants", "hooli", "h1", "10.0.2.1")
+	unhealthy.Containers[0].HealthStatus = types.HealthStatusUnhealthy
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"),
+		unhealthy)
+	proxy := newTestProxy(t, fake, map[string]string{"RETRY_AFTER": "7s"})
+	proxy.Routes.SetECSHealth(true, true)
+	// globex is scaled to zero
+	fake.RemoveTask("tenants", discoverytest.TaskARN("tenants", "g1"))
+	if _, err := proxy.Refresher.Rebuild(context.Background(), discovery.TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, org  string
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{name: "unknown org", org: "initech", status: http.StatusNotFound, code: errCodeUnknownOrg},
+		{name: "known org without running tasks", org: "globex", status: http.StatusServiceUnavailable, code: errCodeNoRunningTasks, retryAfter: "7"},
+		{name: "org whose tasks ECS reports unhealthy", org: "hooli", status: http.StatusServiceUnavailable, code: errCodeNoHealthyBackend, retryAfter: "7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := proxy.get("/orders", tt.org)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+				t.Errorf("status %d: %s, want %d with the %s error code", w.Code, w.Body, tt.status, tt.code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestProxyAmbiguousOrg(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme-api")
+	fake.AddService("tenants", "acme-worker")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme-api", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme-worker", "w1", "10.0.0.2"))
+	for _, tt := range []struct {
+		policy, priority string
+		// ip is the backend acme is sent to, none if it is rejected
+		ip string
+	}{
+		{policy: config.AmbiguousMatchFirst, ip: "10.0.0.1"},
+		{policy: config.AmbiguousMatchClosest, ip: "10.0.0.1"},
+		{policy: config.AmbiguousMatchPriority, priority: "acme-worker,acme-api", ip: "10.0.0.2"},
+		{policy: config.AmbiguousMatchPriority, priority: "acme-billing"},
+		{policy: config.AmbiguousMatchReject},
+	} {
+		t.Run(tt.policy+" "+tt.priority, func(t *testing.T) {
+			proxy := newTestProxy(t, fake, map[string]string{"AMBIGUOUS_MATCH": tt.policy, "AMBIGUOUS_MATCH_PRIORITY": tt.priority})
+			r, info := withRequestInfo(httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil))
+			r.Header.Set("X-Org-ID", "acme")
+			w := proxy.do(r)
+			if tt.ip != "" {
+				if want := "http://" + tt.ip + ":80/orders"; w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != want {
+					t.Errorf("status %d to %s, want a redirect to %s", w.Code, w.Header().Get("Location"), want)
+				}
+			} else if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), errCodeAmbiguousOrg) || info.outcome != telemetry.OutcomeAmbiguous {
+				t.Errorf("status %d, outcome %s: %s, want the org rejected as ambiguous", w.Code, info.outcome, w.Body)
+			}
+			// an org naming a service exactly is never ambiguous
+			if w := proxy.get("/orders", "acme-worker"); w.Header().Get("Location") != "http://10.0.0.2:80/orders" {
+				t.Errorf("acme-worker: status %d to %s", w.Code, w.Header().Get("Location"))
+			}
+
+			// and the next refresh reports the org in /debug/routes
+			proxy.clock.Advance(proxy.Config.RefreshMinInterval)
+			if _, err := proxy.Refresher.Rebuild(context.Background(), discovery.TriggerScheduled); err != nil {
+				t.Fatal(err)
+			}
+			ambiguous := proxy.Routes.Dump("").Ambiguous
+			if len(ambiguous) != 1 || ambiguous[0].Org != "acme" || len(ambiguous[0].Services) != 2 {
+				t.Errorf("ambiguous orgs in the dump %+v, want acme", ambiguous)
+			}
+		})
+	}
+}
+
+func TestProxyTaskMetadata(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+
+	// the metadata of the task shows in /debug/routes
+	proxy := newTestProxy(t, fake, nil)
+	backends := proxy.Routes.Dump("acme").Services["acme"]
+	if len(backends) != 1 {
+		t.Fatalf("backends of acme in the dump %+v", backends)
+	}
+	backend := backends[0]
+	if backend.TaskArn != discoverytest.TaskARN("tenants", "a1") || backend.Zone != "us-west-2a" || backend.TaskDefinition != "acme:1" ||
+		backend.StartedAt == nil || !backend.StartedAt.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) || backend.Source.Cluster != "tenants" {
+		t.Errorf("backend of acme in the dump %+v, want the metadata of its task", backend)
+	}
+
+	// the task is logged, and named in X-Backend-Task only when enabled
+	defer slog.SetDefault(slog.Default())
+	for _, tt := range []struct {
+		mode    string
+		enabled bool
+	}{
+		{mode: config.ProxyModeRedirect},
+		{mode: config.ProxyModeRedirect, enabled: true},
+		{mode: config.ProxyModeForward},
+		{mode: config.ProxyModeForward, enabled: true},
+	} {
+		proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": tt.mode, "BACKEND_TASK_HEADER": fmt.Sprint(tt.enabled)})
+		transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}, Request: r}, nil
+		})
+		proxy.Forwarder = NewForwarder(transport, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{BackendTask: proxy.Config.BackendTaskHeader})
+		var logged bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header.Set("X-Org-ID", "acme")
+		AccessLog(proxy.Handler, "X-Org-ID", slog.LevelInfo).ServeHTTP(w, r)
+		want := ""
+		if tt.enabled {
+			want = "a1"
+		}
+		if got := w.Header().Get(backendTaskHeader); got != want {
+			t.Errorf("%s mode, header enabled %t: %s %q, want %q", tt.mode, tt.enabled, backendTaskHeader, got, want)
+		}
+		if !strings.Contains(logged.String(), `"task":"a1"`) {
+			t.Errorf("%s mode: access log %s, want the task", tt.mode, &logged)
+		}
+	}
+}
+
+func TestProxyOrgHeaders(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	values := map[string]string{
+		"ECS_CLUSTER": "tenants",
+		"PROXY_MODE":  config.ProxyModeForward,
+		"ORG_HEADERS": `{"*": {"X-Tenant": "{{org}}"}, "ACME": {"X-Tenant-Tier": "enterprise", "X-Data-Region": "eu"}}`,
+	}
+	proxy := newTestProxy(t, fake, values)
+	var forwarded http.Header
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwarded = r.Header.Clone()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{"X-Served-By": {"backend"}}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(transport, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	// send forwards a request of org with the client headers given and
+	// returns the response.
+	send := func(org string, headers http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header = headers
+		r.Header.Set("X-Org-ID", org)
+		w := proxy.do(r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", org, w.Code, w.Body)
+		}
+		return w
+	}
+
+	// the headers of the org and of every org reach the backend, replacing
+	// those the client sent under the same names
+	w := send("acme", http.Header{"X-Tenant-Tier": {"free"}, "X-Tenant": {"globex"}, "Accept": {"application/json"}})
+	for name, want := range map[string]string{"X-Tenant": "acme", "X-Tenant-Tier": "enterprise", "X-Data-Region": "eu", "Accept": "application/json"} {
+		if got := forwarded.Values(name); len(got) != 1 || got[0] != want {
+			t.Errorf("acme: %s %q forwarded, want %q", name, got, want)
+		}
+	}
+	// and aren't added to the response
+	for _, name := range []string{"X-Tenant", "X-Tenant-Tier", "X-Data-Region"} {
+		if got := w.Header().Get(name); got != "" {
+			t.Errorf("acme: response header %s %q", name, got)
+		}
+	}
+	if got := w.Header().Get("X-Served-By"); got != "backend" {
+		t.Errorf("response header X-Served-By %q, want the backend's", got)
+	}
+	send("globex", http.Header{})
+	if got, tier := forwarded.Get("X-Tenant"), forwarded.Get("X-Tenant-Tier"); got != "globex" || tier != "" {
+		t.Errorf("globex: X-Tenant %q, X-Tenant-Tier %q forwarded, want only the rule of every org", got, tier)
+	}
+
+	// a reload applies the new rules to the next request
+	reloader := NewReloader(proxy.Config, proxy.Live, func() (config.Config, error) {
+		return config.Load(values, "", nil)
+	})
+	values["ORG_HEADERS"] = `{"globex": {"X-Tenant-Tier": "startup"}}`
+	reloader.Reload()
+	send("globex", http.Header{})
+	if got, tier := forwarded.Get("X-Tenant"), forwarded.Get("X-Tenant-Tier"); got != "" || tier != "startup" {
+		t.Errorf("globex after the reload: X-Tenant %q, X-Tenant-Tier %q forwarded, want the new rule", got, tier)
+	}
+}
+
+func TestProxyScalingUp(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddService("tenants", "initech")
+	services := fake.Services["tenants"]
+	services[0].RunningCount = 1
+	// globex is starting its first tasks, initech scaled to zero
+	services[1].DesiredCount, services[1].PendingCount = 2, 1
+	services[2].DesiredCount = 0
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"SERVICE_COUNTS": "true", "SCALE_UP_RETRY_AFTER": "20s", "RETRY_AFTER": "7s"})
+
+	for _, tt := range []struct {
+		org        string
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{org: "acme", status: http.StatusTemporaryRedirect},
+		{org: "globex", status: http.StatusServiceUnavailable, code: errCodeScalingUp, retryAfter: "20"},
+		{org: "initech", status: http.StatusNotFound, code: errCodeUnknownOrg},
+	} {
+		w := proxy.get("/orders", tt.org)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.code) {
+			t.Errorf("%s: status %d: %s, want %d %s", tt.org, w.Code, w.Body, tt.status, tt.code)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: Retry-After %q, want %q", tt.org, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestProxyWake(t *testing.T) {
+	fake := discoverytest.NewECS()
+	// both services are scaled to zero, acme only may be woken
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.Services["tenants"][0].DesiredCount = 0
+	fake.Services["tenants"][1].DesiredCount = 0
+	proxy := newTestProxy(t, fake, map[string]string{"SERVICE_COUNTS": "true", "ENABLE_WAKE": "true", "WAKE_SERVICES": "acme",
+		"WAKE_DESIRED_COUNT": "2", "WAKE_INTERVAL": "1m", "SCALE_UP_RETRY_AFTER": "20s"})
+	targets := []discovery.ClusterTarget{{Client: fake, Cluster: "tenants", Region: discoverytest.Region}}
+	proxy.Waker = discovery.NewWaker(targets, proxy.Routes, proxy.Config.WakeServices, proxy.Config.WakeDesiredCount, proxy.Config.WakeInterval)
+	proxy.Waker.SetClock(proxy.clock)
+
+	// a burst of requests for acme wakes it once, each answered with a 503
+	// while its task starts
+	var wg sync.WaitGroup
+	responses := make(chan *httptest.ResponseRecorder, 20)
+	for i := 0; i < cap(responses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses <- proxy.get("/orders", "acme")
+		}()
+	}
+	wg.Wait()
+	close(responses)
+	for w := range responses {
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "20" || !strings.Contains(w.Body.String(), errCodeScalingUp) {
+			t.Errorf("request for acme scaled to zero: status %d, Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+		}
+	}
+	if n := fake.Count("UpdateService"); n != 1 {
+		t.Errorf("UpdateService called %d times, want 1", n)
+	}
+	if desired := fake.Services["tenants"][0].DesiredCount; desired != 2 {
+		t.Errorf("desired count of acme %d, want 2", desired)
+	}
+
+	// a service off the allow-list isn't woken
+	if w := proxy.get("/orders", "globex"); w.Code != http.StatusNotFound {
+		t.Errorf("request for globex: status %d: %s, want a 404", w.Code, w.Body)
+	}
+	if n := fake.Count("UpdateService"); n != 1 {
+		t.Errorf("UpdateService called %d times after a request for globex, want 1", n)
+	}
+
+	// and a service still scaled to zero once the window is over is woken
+	// again
+	proxy.clock.Advance(time.Minute)
+	fake.Services["tenants"][0].DesiredCount = 0
+	proxy.get("/orders", "acme")
+	if n := fake.Count("UpdateService"); n != 2 {
+		t.Errorf("UpdateService called %d times after the window, want 2", n)
+	}
+}
+
+func TestProxyStaticRoutes(t *testing.T) {
+	// backend answers with name.
+	backend := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	acme, globex := backend("acme"), backend("globex")
+	path := filepath.Join(t.TempDir(), "routes.json")
+	// writeRoutes writes the routes of org to the file of STATIC_ROUTES.
+	writeRoutes := func(routes map[string]*httptest.Server) {
+		t.Helper()
+		targets := map[string]string{}
+		for org, server := range routes {
+			targets[org] = strings.TrimPrefix(server.URL, "http://")
+		}
+		data, _ := json.Marshal(targets)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRoutes(map[string]*httptest.Server{"acme": acme})
+
+	// no cluster nor ECS client is needed
+	cfg, err := config.Load(map[string]string{
+		"DISCOVERY_MODE":        config.DiscoveryModeStatic,
+		"STATIC_ROUTES":         path,
+		"PROXY_MODE":            config.ProxyModeForward,
+		"BACKEND_ALLOWED_CIDRS": "127.0.0.0/8",
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Clusters) != 0 {
+		t.Errorf("clusters %v with static routes", cfg.Clusters)
+	}
+	routes := discovery.NewRouteTable(nil, nil, cfg.LBStrategy)
+	refresher := discovery.NewRefresher(nil, discovery.Options{DefaultPort: cfg.DefaultPort}, routes, 0)
+	refresher.SetStatic(discovery.NewStaticRoutes(cfg.StaticRoutes))
+	if _, err := refresher.Rebuild(context.Background(), discovery.TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	handler := &Handler{
+		Config:    cfg,
+		Live:      NewLiveConfig(cfg),
+		Routes:    routes,
+		Lookup:    discovery.NewFailoverRoutes(discovery.NewRouteOverrides(cfg.BackendAllowedCIDRs), routes, nil, 0),
+		Refresher: refresher,
+		Forwarder: NewForwarder(NewBackendTransports(nil), routes.ReportFailure, func() time.Duration { return time.Second }, ResponseRewriter{}),
+	}
+	proxy := &testProxy{Handler: handler}
+	// send returns the status and body of a request of org.
+	send := func(org string) (int, string) {
+		w := proxy.get("/orders", org)
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := send("acme"); code != http.StatusOK || body != "acme /orders" {
+		t.Errorf("acme: status %d: %s, want its backend's answer", code, body)
+	}
+	if code, body := send("globex"); code != http.StatusNotFound || !strings.Contains(body, errCodeUnknownOrg) {
+		t.Errorf("globex before it is added: status %d: %s", code, body)
+	}
+
+	// a tenant added to the file is routed once it is read again, without
+	// a restart
+	writeRoutes(map[string]*httptest.Server{"acme": acme, "globex": globex})
+	refresher.Refresh(context.Background(), discovery.TriggerFile)
+	if code, body := send("globex"); code != http.StatusOK || body != "globex /orders" {
+		t.Errorf("globex once added: status %d: %s, want its backend's answer", code, body)
+	}
+	if code, body := send("acme"); code != http.StatusOK || body != "acme /orders" {
+		t.Errorf("acme after the reload: status %d: %s", code, body)
+	}
+}
+
+func TestProxyStartupModes(t *testing.T) {
+	t.Run("failfast", func(t *testing.T) {
+		fake := discoverytest.NewECS()
+		fake.FailNext("ListServices", discoverytest.AccessDenied(), discoverytest.AccessDenied(), discoverytest.AccessDenied())
+		proxy := coldTestProxy(t, map[string]string{"STARTUP_MODE": "failfast", "STARTUP_TIMEOUT": "1s"}, func(config.Config) discovery.ECSAPI { return fake })
+		// the warm-up gives up after the startup timeout, failing the
+		// startup before the listener opens
+		start := time.Now()
+		err := proxy.Refresher.WarmUp(context.Background(), proxy.Config.StartupTimeout)
+		if err == nil || !strings.Contains(err.Error(), "gave up") {
+			t.Errorf("warm-up = %v, want it to give up", err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+			t.Errorf("gave up after %v, want the startup timeout of 1s", elapsed)
+		}
+	})
+
+	t.Run("degraded", func(t *testing.T) {
+		fake := discoverytest.NewECS()
+		fake.AddService("tenants", "acme")
+		fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+		fake.FailNext("ListServices", discoverytest.AccessDenied())
+		proxy := coldTestProxy(t, map[string]string{"STARTUP_MODE": "degraded", "RETRY_AFTER": "3s"}, func(config.Config) discovery.ECSAPI { return fake })
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go proxy.Refresher.WarmUp(ctx, 0)
+		proxy.clock.WaitForTimers(t, 1)
+
+		// requests are answered while discovery fails, with a 503
+		w := proxy.get("/orders", "acme")
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "3" || !strings.Contains(w.Body.String(), errCodeRoutesNotReady) {
+			t.Errorf("request before discovery succeeded: status %d, Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+		}
+
+		// and routed once the retry succeeds
+		proxy.clock.Advance(time.Second)
+		waitFor(t, "the routes of the retry", func() bool { return !proxy.Routes.BuiltAt().IsZero() })
+		if w := proxy.get("/orders", "acme"); w.Code != http.StatusTemporaryRedirect {
+			t.Errorf("request after discovery succeeded: status %d: %s", w.Code, w.Body)
+		}
+	})
+}
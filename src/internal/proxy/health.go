@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Healthz reports that the process is up, whatever the state of discovery.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness reports whether the proxy should receive traffic: it isn't
+// draining, routes were discovered at least once, the table isn't empty
+// unless AllowEmpty, and discovery hasn't failed MaxFailures times in a row.
+// A zero MaxFailures ignores failures.
+type Readiness struct {
+	Routes      *discovery.RouteTable
+	Refresher   *discovery.Refresher
+	MaxFailures int
+	AllowEmpty  bool
+	Draining    *atomic.Bool
+}
+
+type readinessStatus struct {
+	Status              string     `json:"status"`
+	Reason              string     `json:"reason,omitempty"`
+	LastRefresh         *time.Time `json:"last_refresh"`
+	Routes              int        `json:"routes"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+}
+
+func (h Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := readinessStatus{
+		Status:              "ready",
+		Routes:              len(h.Routes.Services()),
+		ConsecutiveFailures: h.Refresher.Failures(),
+	}
+	if builtAt := h.Routes.BuiltAt(); !builtAt.IsZero() {
+		status.LastRefresh = &builtAt
+	}
+	switch {
+	case h.Draining.Load():
+		status.Reason = "shutting down"
+	case status.LastRefresh == nil:
+		status.Reason = "routes not discovered yet"
+	case status.Routes == 0 && !h.AllowEmpty:
+		status.Reason = "no routes"
+	case h.MaxFailures > 0 && status.ConsecutiveFailures >= int64(h.MaxFailures):
+		status.Reason = "discovery is failing"
+	}
+	if status.Reason != "" {
+		status.Status = "not ready"
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
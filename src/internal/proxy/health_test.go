@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, nil)
+	var draining atomic.Bool
+	ready := Readiness{Routes: proxy.Routes, Refresher: proxy.Refresher, Draining: &draining}
+	proxied, started, release := blockingHandler()
+	server := NewServer(NewRouter(proxy.Config, ready, proxied), proxy.Config)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	url := "http://" + listener.Addr().String()
+	// readiness returns the status and reason of the readiness check.
+	readiness := func() (int, string) {
+		resp, err := http.Get(url + proxy.Config.ReadyzPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status readinessStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status.Reason
+	}
+	if code, reason := readiness(); code != http.StatusOK {
+		t.Fatalf("readiness before the shutdown: status %d: %s", code, reason)
+	}
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/orders")
+		if err != nil {
+			t.Error(err)
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-started
+
+	// readiness fails through the shutdown delay, while the listener still
+	// serves
+	draining.Store(true)
+	if code, reason := readiness(); code != http.StatusServiceUnavailable || reason != "shutting down" {
+		t.Errorf("readiness while draining: status %d: %s", code, reason)
+	}
+
+	// and the shutdown waits for the request in flight
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("request in flight during the shutdown: status %d", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	// the process is up whatever the state of discovery, with no route
+	// discovered here
+	cfg, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "HEALTHZ_PATH": "/livez"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(cfg, http.NotFoundHandler(), http.NotFoundHandler())
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://proxy.example.com/livez", nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s /livez: status %d, Content-Type %q", method, w.Code, w.Header().Get("Content-Type"))
+		}
+		if method == http.MethodGet && strings.TrimSpace(w.Body.String()) != `{"status":"ok"}` {
+			t.Errorf("GET /livez: body %s", w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://proxy.example.com/livez", nil))
+	if w.Code == http.StatusOK {
+		t.Error("POST /livez answered like a health check")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	routes := discovery.NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+	refresher := discovery.NewRefresher([]discovery.ClusterTarget{{Client: fake, Cluster: "tenants", Region: discoverytest.Region}}, discovery.Options{DefaultPort: 8080}, routes, 0)
+	var draining atomic.Bool
+	ready := Readiness{Routes: routes, Refresher: refresher, MaxFailures: 2, Draining: &draining}
+	// check returns the readiness status.
+	check := func() (int, readinessStatus) {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/readyz", nil))
+		var status readinessStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("body %s: %v", w.Body, err)
+		}
+		return w.Code, status
+	}
+
+	// not ready until the first sync
+	if code, status := check(); code != http.StatusServiceUnavailable || status.Reason != "routes not discovered yet" || status.LastRefresh != nil {
+		t.Errorf("before the first sync: status %d: %+v", code, status)
+	}
+	fake.FailNext("ListServices", discoverytest.AccessDenied())
+	if _, err := refresher.Rebuild(context.Background(), discovery.TriggerStartup); err == nil {
+		t.Fatal("rebuild with ECS failing succeeded")
+	}
+	if code, status := check(); code != http.StatusServiceUnavailable || status.Reason != "routes not discovered yet" {
+		t.Errorf("after a failed first sync: status %d: %+v", code, status)
+	}
+	if _, err := refresher.Rebuild(context.Background(), discovery.TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	if code, status := check(); code != http.StatusOK || status.Status != "ready" || status.Routes != 1 || status.LastRefresh == nil {
+		t.Errorf("after the first sync: status %d: %+v", code, status)
+	}
+
+	// and no longer once discovery keeps failing
+	fake.FailNext("ListServices", discoverytest.AccessDenied(), discoverytest.AccessDenied())
+	refresher.Rebuild(context.Background(), discovery.TriggerScheduled)
+	if code, _ := check(); code != http.StatusOK {
+		t.Errorf("after a failed refresh: status %d, want ready until %d", code, ready.MaxFailures)
+	}
+	refresher.Rebuild(context.Background(), discovery.TriggerScheduled)
+	if code, status := check(); code != http.StatusServiceUnavailable || status.Reason != "discovery is failing" || status.ConsecutiveFailures != 2 {
+		t.Errorf("after %d failed refreshes: status %d: %+v", ready.MaxFailures, code, status)
+	}
+}
+
+// unreachableECS is an ECS whose DescribeClusters calls never return.
+type unreachableECS struct {
+	discovery.ECSAPI
+}
+
+func (unreachableECS) DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDeepHealth(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	// deepHealth returns the deep health status of routes built age ago,
+	// probing ECS through client.
+	deepHealth := func(client discovery.ECSAPI, age time.Duration) (int, deepHealthStatus) {
+		t.Helper()
+		targets := []discovery.ClusterTarget{{Client: client, Cluster: "tenants", Region: discoverytest.Region}}
+		routes := discovery.NewRouteTable(nil, nil, config.LBStrategyRoundRobin)
+		routes.SetClock(clocktest.NewAt(time.Now().Add(-age)))
+		refresher := discovery.NewRefresher(targets, discovery.Options{DefaultPort: 8080}, routes, 0)
+		if _, err := refresher.Rebuild(context.Background(), discovery.TriggerStartup); err != nil {
+			t.Fatal(err)
+		}
+		h := DeepHealth{
+			Targets:      targets,
+			Routes:       routes,
+			Refresher:    refresher,
+			Loops:        discovery.NewBackgroundLoops(),
+			Draining:     new(atomic.Bool),
+			Timeout:      50 * time.Millisecond,
+			StaleAfter:   5 * time.Minute,
+			MaxStaleness: 15 * time.Minute,
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://admin.example.com/healthz/deep", nil))
+		var status deepHealthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("body %s: %v", w.Body, err)
+		}
+		return w.Code, status
+	}
+
+	if code, status := deepHealth(fake, time.Minute); code != http.StatusOK || status.Status != "ok" || len(status.ECS) != 1 || !status.ECS[0].Reachable {
+		t.Errorf("fresh routes and ECS reachable: status %d: %+v", code, status)
+	}
+
+	// ECS failing or not answering in time degrades the proxy, which keeps
+	// serving the routes it has
+	fake.FailNext("DescribeClusters", discoverytest.AccessDenied())
+	if code, status := deepHealth(fake, time.Minute); code != http.StatusOK || status.Status != "degraded" || !slices.Equal(status.Reasons, []string{"ECS unreachable in us-west-2/tenants"}) {
+		t.Errorf("ECS failing: status %d: %+v", code, status)
+	}
+	fake.FailNext("DescribeClusters", discoverytest.Throttled())
+	if code, status := deepHealth(fake, time.Minute); code != http.StatusOK || status.Status != "degraded" || !slices.Equal(status.Reasons, []string{"ECS throttled in us-west-2/tenants"}) {
+		t.Errorf("ECS throttling: status %d: %+v", code, status)
+	}
+	code, status := deepHealth(unreachableECS{fake}, time.Minute)
+	if code != http.StatusOK || status.Status != "degraded" || !slices.Equal(status.Reasons, []string{"ECS unreachable in us-west-2/tenants"}) {
+		t.Errorf("ECS not answering: status %d: %+v", code, status)
+	}
+	if probe := status.ECS[0]; probe.Reachable || !strings.Contains(probe.Error, "deadline exceeded") {
+		t.Errorf("probe of ECS not answering: %+v, want it timed out", probe)
+	}
+
+	// stale routes degrade it, and past the max staleness take it down
+	if code, status := deepHealth(fake, 10*time.Minute); code != http.StatusOK || status.Status != "degraded" || len(status.Reasons) != 1 || !strings.HasPrefix(status.Reasons[0], "routes are 10m0s old") {
+		t.Errorf("routes older than StaleAfter: status %d: %+v", code, status)
+	}
+	if code, status := deepHealth(fake, 20*time.Minute); code != http.StatusServiceUnavailable || status.Status != "down" || len(status.Reasons) != 1 || !strings.Contains(status.Reasons[0], "more than 15m0s") {
+		t.Errorf("routes older than MaxStaleness: status %d: %+v", code, status)
+	}
+}
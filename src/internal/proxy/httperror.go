@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Error codes of the JSON error responses, stable for clients to match on.
+const (
+	errCodeMissingHeader    = "missing_header"
+	errCodeInvalidHeader    = "invalid_header"
+	errCodeOrgNotAllowed    = "org_not_allowed"
+	errCodeIPNotAllowed     = "ip_not_allowed"
+	errCodeMissingAPIKey    = "missing_api_key"
+	errCodeInvalidAPIKey    = "invalid_api_key"
+	errCodeMissingToken     = "missing_token"
+	errCodeInvalidToken     = "invalid_token"
+	errCodeMissingSignature = "missing_signature"
+	errCodeInvalidSignature = "invalid_signature"
+	errCodeSignatureExpired = "signature_expired"
+	errCodePrincipalDenied  = "principal_not_allowed"
+	errCodeSTSUnavailable   = "sts_unavailable"
+	errCodeRateLimited      = "rate_limited"
+	errCodeOrgConcurrency   = "too_many_in_flight"
+	errCodeOverloaded       = "overloaded"
+	errCodeRoutesNotReady   = "routes_not_ready"
+	errCodeUnknownOrg       = "unknown_org"
+	errCodeAmbiguousOrg     = "ambiguous_org"
+	errCodeNoRunningTasks   = "no_running_tasks"
+	errCodeScalingUp        = "scaling_up"
+	errCodeNoHealthyBackend = "no_healthy_backend"
+	errCodeBackendOpen      = "backend_unavailable"
+	errCodeBadGateway       = "bad_gateway"
+	errCodeBackendTLS       = "backend_tls_error"
+	errCodeBackendTimeout   = "backend_timeout"
+	errCodeBackendDenied    = "backend_not_allowed"
+	errCodeNoContainer      = "no_target_container"
+	errCodeInternal         = "internal_error"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeDiscoveryFailed  = "discovery_failed"
+	errCodeRefreshTimeout   = "refresh_timeout"
+	errCodeInvalidOverride  = "invalid_override"
+	errCodeUnknownOverride  = "unknown_override"
+	errCodeUnknownBackend   = "unknown_backend"
+	errCodeInvalidDrain     = "invalid_drain"
+	errCodeLastBackend      = "last_backend"
+	errCodeBadFormat        = "bad_format"
+	errCodeMaintenance      = "maintenance"
+	errCodeBadMaintenance   = "invalid_maintenance"
+	errCodeNoMaintenance    = "unknown_maintenance"
+	errCodeInvalidImport    = "invalid_import"
+	errCodeBadDebugTarget   = "invalid_debug_target"
+	errCodeNoDebugTarget    = "unknown_debug_target"
+)
+
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorMessages are the templates of ERROR_MESSAGES replacing the message of
+// some codes, swapped on reload.
+var errorMessages atomic.Pointer[map[string]*template.Template]
+
+// errorMessage is what a template of ERROR_MESSAGES is executed with.
+type errorMessage struct {
+	Code      string
+	Message   string
+	RequestID string
+}
+
+// writeError writes an error response with a machine readable code and the
+// ID of r, as JSON unless the client only accepts plain text. The message is
+// replaced by the one of ERROR_MESSAGES for code if it has one.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	resp := errorResponse{Code: code, Message: message, RequestID: requestIDFrom(r.Context())}
+	if messages := errorMessages.Load(); messages != nil {
+		if tmpl, ok := (*messages)[code]; ok {
+			var custom strings.Builder
+			err := tmpl.Execute(&custom, errorMessage{Code: code, Message: message, RequestID: resp.RequestID})
+			if err == nil {
+				resp.Message = custom.String()
+			} else {
+				slog.ErrorContext(r.Context(), "Failed to render an error message of ERROR_MESSAGES", "code", code, "error", err)
+			}
+		}
+	}
+	if !prefersPlainText(r.Header.Get("Accept")) {
+		writeJSON(w, status, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if resp.RequestID != "" {
+		fmt.Fprintf(w, "%s (%s, request %s)\n", resp.Message, resp.Code, resp.RequestID)
+		return
+	}
+	fmt.Fprintf(w, "%s (%s)\n", resp.Message, resp.Code)
+}
+
+// prefersPlainText reports whether an Accept header names plain text and
+// not JSON. Without either, as with a bare */*, clients get JSON.
+func prefersPlainText(accept string) bool {
+	plain := false
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(mediaRange, ";")
+		switch mediaType = strings.ToLower(strings.TrimSpace(mediaType)); {
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			return false
+		case mediaType == "text/plain", mediaType == "text/*":
+			plain = true
+		}
+	}
+	return plain
+}
+
+// writeUnavailable writes a 503 telling the client to retry after retryAfter.
+func writeUnavailable(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, code, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second)/time.Second)))
+	writeError(w, r, http.StatusServiceUnavailable, code, message)
+}
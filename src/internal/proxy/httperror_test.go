@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// decodeError decodes the JSON error response of w, failing on fields the
+// schema doesn't have.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) errorResponse {
+	t.Helper()
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q, want JSON", got)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+	decoder.DisallowUnknownFields()
+	var resp errorResponse
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatalf("body %s: %v", w.Body, err)
+	}
+	return resp
+}
+
+func TestWriteError(t *testing.T) {
+	handler := WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, errCodeUnknownOrg, "Service not found for Org-ID")
+	}), "X-Request-ID")
+	for _, tt := range []struct {
+		accept string
+		plain  bool
+	}{
+		{accept: ""},
+		{accept: "*/*"},
+		{accept: "application/json"},
+		{accept: "application/problem+json"},
+		{accept: "text/plain", plain: true},
+		{accept: "text/html, text/plain;q=0.9", plain: true},
+		{accept: "text/*", plain: true},
+		// JSON wins over plain text when both are named
+		{accept: "text/plain, application/json"},
+		{accept: "text/html"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		id := w.Header().Get("X-Request-ID")
+		if w.Code != http.StatusNotFound || id == "" {
+			t.Fatalf("Accept %q: status %d, request ID %q", tt.accept, w.Code, id)
+		}
+		if tt.plain {
+			want := "Service not found for Org-ID (unknown_org, request " + id + ")\n"
+			if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Body.String() != want {
+				t.Errorf("Accept %q: Content-Type %q: %q, want %q", tt.accept, w.Header().Get("Content-Type"), w.Body, want)
+			}
+			continue
+		}
+		want := errorResponse{Code: errCodeUnknownOrg, Message: "Service not found for Org-ID", RequestID: id}
+		if resp := decodeError(t, w); resp != want {
+			t.Errorf("Accept %q: %+v, want %+v", tt.accept, resp, want)
+		}
+	}
+
+	// without a request ID, it is left out
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil), http.StatusBadRequest, errCodeMissingHeader, "Missing X-Org-ID header")
+	if strings.Contains(w.Body.String(), "request_id") {
+		t.Errorf("body %s, want no request ID", w.Body)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	cfg, err := config.Load(map[string]string{
+		"ECS_CLUSTER": "tenants",
+		"ERROR_MESSAGES": `{
+			"unknown_org": "No such tenant at Example Cloud, quote {{.RequestID}} to support",
+			"rate_limited": "{{.Message}}, slow down",
+			"internal_error": "{{.Missing}}"
+		}`,
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewLiveConfig(cfg)
+	defer errorMessages.Store(nil)
+	handler := WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("code")
+		writeError(w, r, http.StatusServiceUnavailable, code, "Proxy message of "+code)
+	}), "X-Request-ID")
+	for _, tt := range []struct {
+		code, want string
+	}{
+		{code: errCodeUnknownOrg, want: "No such tenant at Example Cloud, quote req-1 to support"},
+		{code: errCodeRateLimited, want: "Proxy message of rate_limited, slow down"},
+		// a template failing to render keeps the proxy's message
+		{code: errCodeInternal, want: "Proxy message of internal_error"},
+		{code: errCodeBadGateway, want: "Proxy message of bad_gateway"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/?code="+tt.code, nil)
+		r.Header.Set("X-Request-ID", "req-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if resp := decodeError(t, w); resp.Code != tt.code || resp.Message != tt.want || resp.RequestID != "req-1" {
+			t.Errorf("%s: %+v, want the message %q", tt.code, resp, tt.want)
+		}
+	}
+
+	for _, value := range []string{`["unknown_org"]`, `{"unknown_org": "{{.Message"}`} {
+		if _, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "ERROR_MESSAGES": value}, "", nil); err == nil || !strings.Contains(err.Error(), "ERROR_MESSAGES") {
+			t.Errorf("Load of ERROR_MESSAGES %s = %v", value, err)
+		}
+	}
+}
+
+func TestProxyErrorClasses(t *testing.T) {
+	fake := discoverytest.NewECS()
+	for _, org := range []string{"acme", "globex", "hooli"} {
+		fake.AddService("tenants", org)
+	}
+	unhealthy := discoverytest.Task("tenants", "hooli", "h1", "10.0.2.1")
+	unhealthy.Containers[0].HealthStatus = types.HealthStatusUnhealthy
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"),
+		unhealthy)
+	proxy := newTestProxy(t, fake, map[string]string{
+		"PROXY_MODE":       config.ProxyModeForward,
+		"RETRY_AFTER":      "7s",
+		"RATE_LIMIT":       "1000",
+		"RATE_LIMIT_BURST": "1000",
+		"RATE_LIMIT_ORGS":  "acme|0.5|1",
+	})
+	proxy.Routes.SetECSHealth(true, true)
+	limiter := NewLocalRateLimiter(proxy.Config.RateLimit, proxy.Config.RateLimitOrgs, proxy.Config.RateLimitMaxOrgs)
+	limiter.SetClock(proxy.clock)
+	proxy.Limiter = limiter
+	// globex's backend doesn't answer in time
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Hostname() == "10.0.1.1" {
+			return nil, context.DeadlineExceeded
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(transport, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	handler := WithRequestID(proxy.Handler, "X-Request-ID")
+	if w := proxy.get("/orders", "acme"); w.Code != http.StatusOK {
+		t.Fatalf("acme within its rate limit: status %d: %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		name, org  string
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{name: "missing header", status: http.StatusBadRequest, code: errCodeMissingHeader},
+		{name: "invalid org", org: "ac\x00me", status: http.StatusBadRequest, code: errCodeInvalidHeader},
+		{name: "not found", org: "initech", status: http.StatusNotFound, code: errCodeUnknownOrg},
+		{name: "no healthy backend", org: "hooli", status: http.StatusServiceUnavailable, code: errCodeNoHealthyBackend, retryAfter: "7"},
+		{name: "upstream timeout", org: "globex", status: http.StatusGatewayTimeout, code: errCodeBackendTimeout},
+		{name: "rate limited", org: "acme", status: http.StatusTooManyRequests, code: errCodeRateLimited, retryAfter: "2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+			if tt.org != "" {
+				r.Header.Set("X-Org-ID", tt.org)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d: %s, want %d", w.Code, w.Body, tt.status)
+			}
+			resp := decodeError(t, w)
+			if resp.Code != tt.code || resp.Message == "" || resp.RequestID != w.Header().Get("X-Request-ID") {
+				t.Errorf("%+v, want the %s code, a message and the request ID %s", resp, tt.code, w.Header().Get("X-Request-ID"))
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ipDenied counts the requests turned down for their client address, by
+// reason: denied, not_allowed, or unknown when it couldn't be told.
+var ipDenied = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_ip_denied_total",
+	Help: "Requests turned down for their client address, by reason.",
+}, []string{"reason"})
+
+// IPFilter turns down requests by client address, as WithClientAddr told
+// it. A deny match wins over an allow one, and with allow set only the
+// addresses in it get through. Requests whose client couldn't be told are
+// turned down too. Requests for exempt paths are never filtered.
+type IPFilter struct {
+	Allow  []netip.Prefix
+	Deny   []netip.Prefix
+	Exempt []string
+}
+
+// Wrap answers the requests next mustn't see with a 403.
+func (f *IPFilter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(f.Exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := clientAddr(r)
+		addr, ok := client.addr, client.known
+		reason := ""
+		switch {
+		case !ok:
+			reason = "unknown"
+		case config.ContainsAddr(f.Deny, addr):
+			reason = "denied"
+		case len(f.Allow) > 0 && !config.ContainsAddr(f.Allow, addr):
+			reason = "not_allowed"
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		ipDenied.WithLabelValues(reason).Inc()
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Rejected client address", clientIP(r)) {
+			slog.WarnContext(r.Context(), "Rejected client address", "client_ip", clientIP(r), "reason", reason)
+		}
+		setOutcome(r, telemetry.OutcomeForbidden)
+		writeError(w, r, http.StatusForbidden, errCodeIPNotAllowed, "Client address is not allowed")
+	})
+}
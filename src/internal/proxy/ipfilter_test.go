@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestIPFilter(t *testing.T) {
+	filter := &IPFilter{
+		Allow:  []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24"), netip.MustParsePrefix("2001:db8::/32")},
+		Deny:   []netip.Prefix{netip.MustParsePrefix("198.51.100.66/32")},
+		Exempt: []string{"/healthz"},
+	}
+	handler := WithClientAddr(filter.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), testTrustedProxies)
+	for _, tt := range []struct {
+		name, path, remote, xff string
+		// reason is the one the request is turned down for, empty if it
+		// gets through.
+		reason string
+	}{
+		{name: "allowed", remote: "198.51.100.7:41000"},
+		{name: "allowed IPv6", remote: "[2001:db8::7]:41000"},
+		{name: "not allowed", remote: "203.0.113.9:41000", reason: "not_allowed"},
+		{name: "denied within the allowed", remote: "198.51.100.66:41000", reason: "denied"},
+		{name: "allowed through a trusted proxy", remote: "10.0.0.5:41000", xff: "198.51.100.7"},
+		{name: "denied through a trusted proxy", remote: "10.0.0.5:41000", xff: "198.51.100.66", reason: "denied"},
+		{name: "spoofed through a trusted proxy", remote: "10.0.0.5:41000", xff: "198.51.100.7, 203.0.113.9", reason: "not_allowed"},
+		{name: "spoofed from an untrusted peer", remote: "203.0.113.9:41000", xff: "198.51.100.7", reason: "not_allowed"},
+		{name: "malformed header", remote: "10.0.0.5:41000", xff: "198.51.100.7, garbage", reason: "unknown"},
+		{name: "malformed header from an untrusted peer", remote: "198.51.100.7:41000", xff: "garbage"},
+		{name: "exempt", path: "/healthz", remote: "203.0.113.9:41000"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path
+			if path == "" {
+				path = "/orders"
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com"+path, nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			var denied float64
+			if tt.reason != "" {
+				denied = telemetrytest.CounterValue(t, ipDenied.WithLabelValues(tt.reason))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if tt.reason == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("status %d, want the request through: %s", w.Code, w.Body)
+				}
+				return
+			}
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), errCodeIPNotAllowed) {
+				t.Errorf("status %d: %s, want a 403 with the %s error code", w.Code, w.Body, errCodeIPNotAllowed)
+			}
+			if n := telemetrytest.CounterValue(t, ipDenied.WithLabelValues(tt.reason)) - denied; n != 1 {
+				t.Errorf("%v requests counted as %s, want 1", n, tt.reason)
+			}
+		})
+	}
+}
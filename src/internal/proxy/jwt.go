@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMinRefresh is the least time between two fetches of the JWKS caused by
+// tokens signed with an unknown key, so forged key IDs can't hammer the
+// identity provider.
+const jwksMinRefresh = 10 * time.Second
+
+// JWKS caches the public keys of a JSON Web Key Set by key ID. The set is
+// fetched again once it is older than ttl, or when a token names a key it
+// doesn't hold, which is how a rotated key is picked up.
+type JWKS struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	clock  clock.Clock
+	group  singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+}
+
+// NewJWKS returns the key set at url, fetched on first use.
+func NewJWKS(url string, ttl time.Duration) *JWKS {
+	return &JWKS{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		clock:  clock.System{},
+	}
+}
+
+// SetClock makes the age of the set told by clock. It must be called before
+// the set is shared.
+func (j *JWKS) SetClock(clock clock.Clock) {
+	j.clock = clock
+}
+
+// Key returns the public key kid names.
+func (j *JWKS) Key(ctx context.Context, kid string) (any, error) {
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	stale := j.clock.Now().Sub(j.fetched) > j.ttl
+	// an unknown key only refetches once in a while
+	refetch := stale || !ok && j.clock.Now().Sub(j.fetched) > jwksMinRefresh
+	j.mu.Unlock()
+	if !refetch {
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key, nil
+	}
+	if err := j.Refresh(ctx); err != nil {
+		// keep verifying with the cached keys while the provider is down
+		if ok {
+			slog.WarnContext(ctx, "Failed to refresh the JWKS, using the cached keys", "url", j.url, "error", err)
+			return key, nil
+		}
+		return nil, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if key, ok = j.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// Refresh fetches the set, concurrent callers sharing one fetch.
+func (j *JWKS) Refresh(ctx context.Context) error {
+	_, err, _ := j.group.Do("", func() (any, error) {
+		keys, err := j.fetch(context.WithoutCancel(ctx))
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		// a failed fetch waits jwksMinRefresh before the next one too
+		j.fetched = j.clock.Now()
+		if err != nil {
+			return nil, err
+		}
+		j.keys = keys
+		return nil, nil
+	})
+	return err
+}
+
+func (j *JWKS) fetch(ctx context.Context) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", j.url, resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", j.url, err)
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		// encryption keys and unsupported types are skipped
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("Skipping JWKS key", "url", j.url, "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// jsonWebKey is an RSA or EC public key of a JWKS, RFC 7517.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid coordinates")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// JWTVerifier verifies bearer tokens signed by a key of its JWKS, issued by
+// one of issuers for one of audiences. Either list may be empty to accept
+// any.
+type JWTVerifier struct {
+	keys      *JWKS
+	issuers   []string
+	audiences []string
+	parser    *jwt.Parser
+}
+
+// NewJWTVerifier returns a verifier tolerating skew on the times of a
+// token.
+func NewJWTVerifier(keys *JWKS, issuers, audiences []string, skew time.Duration) *JWTVerifier {
+	return &JWTVerifier{
+		keys:      keys,
+		issuers:   issuers,
+		audiences: audiences,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+			jwt.WithLeeway(skew),
+			jwt.WithExpirationRequired(),
+		),
+	}
+}
+
+// Verify returns the claims of token if it is valid.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if issuer, _ := claims.GetIssuer(); len(v.issuers) > 0 && !slices.Contains(v.issuers, issuer) {
+		return nil, fmt.Errorf("issuer %q not accepted", issuer)
+	}
+	if len(v.audiences) > 0 {
+		audiences, _ := claims.GetAudience()
+		if !slices.ContainsFunc(audiences, func(audience string) bool { return slices.Contains(v.audiences, audience) }) {
+			return nil, errors.New("audience not accepted")
+		}
+	}
+	return claims, nil
+}
+
+type jwtClaimsKey struct{}
+
+// jwtClaimsFrom returns the claims stored in ctx by RequireJWT, nil if the
+// request wasn't verified.
+func jwtClaimsFrom(ctx context.Context) jwt.MapClaims {
+	claims, _ := ctx.Value(jwtClaimsKey{}).(jwt.MapClaims)
+	return claims
+}
+
+// RequireJWT answers requests without a valid bearer token with a 401
+// before next sees them, and stores the claims of valid ones on the
+// request context.
+func RequireJWT(next http.Handler, verifier *JWTVerifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			setOutcome(r, telemetry.OutcomeUnauthorized)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized, errCodeMissingToken, "Missing bearer token")
+			return
+		}
+		claims, err := verifier.Verify(r.Context(), token)
+		if err != nil {
+			setOutcome(r, telemetry.OutcomeUnauthorized)
+			slog.DebugContext(r.Context(), "Rejected bearer token", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidToken, "Invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtClaimsKey{}, claims)))
+	})
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeJWKS serves the public keys of a JSON Web Key Set, counting fetches.
+type fakeJWKS struct {
+	*httptest.Server
+	fetches atomic.Int64
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+func newFakeJWKS(t *testing.T) *fakeJWKS {
+	f := &fakeJWKS{keys: map[string]crypto.PublicKey{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.fetches.Add(1)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		set := struct {
+			Keys []jsonWebKey `json:"keys"`
+		}{Keys: []jsonWebKey{}}
+		encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+		for kid, key := range f.keys {
+			switch key := key.(type) {
+			case *rsa.PublicKey:
+				set.Keys = append(set.Keys, jsonWebKey{Kid: kid, Kty: "RSA", Use: "sig", N: encode(key.N), E: encode(big.NewInt(int64(key.E)))})
+			case *ecdsa.PublicKey:
+				set.Keys = append(set.Keys, jsonWebKey{Kid: kid, Kty: "EC", Crv: key.Curve.Params().Name, X: encode(key.X), Y: encode(key.Y)})
+			}
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// publish adds the public key of signer to the set under kid.
+func (f *fakeJWKS) publish(kid string, signer crypto.Signer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[kid] = signer.Public()
+}
+
+// signToken returns a token of claims signed by key with method, naming kid.
+func signToken(t *testing.T, method jwt.SigningMethod, key crypto.Signer, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestRequireJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newFakeJWKS(t)
+	set.publish("rsa", rsaKey)
+	set.publish("ec", ecKey)
+
+	keys := NewJWKS(set.URL, time.Hour)
+	verifier := NewJWTVerifier(keys, []string{"https://idp.example.com"}, []string{"ecs-svc-proxy"}, 30*time.Second)
+	var claims jwt.MapClaims
+	handler := RequireJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = jwtClaimsFrom(r.Context())
+	}), verifier)
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"iss": "https://idp.example.com", "aud": "ecs-svc-proxy", "sub": "client", "org": "acme", "exp": now.Add(time.Hour).Unix()}
+	}
+	with := func(name string, value any) jwt.MapClaims {
+		c := valid()
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	for _, tt := range []struct {
+		name  string
+		token string
+		// challenge is the WWW-Authenticate header of a 401, empty if
+		// the token is accepted.
+		challenge string
+	}{
+		{name: "RSA", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid())},
+		{name: "EC", token: signToken(t, jwt.SigningMethodES256, ecKey, "ec", valid())},
+		{name: "expired within the skew", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("exp", now.Add(-10*time.Second).Unix()))},
+		{name: "one of the audiences", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("aud", []string{"other", "ecs-svc-proxy"}))},
+		{name: "missing", challenge: "Bearer"},
+		{name: "malformed", token: "not.a.token", challenge: `Bearer error="invalid_token"`},
+		{name: "expired", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("exp", now.Add(-time.Minute).Unix())), challenge: `Bearer error="invalid_token"`},
+		{name: "without expiry", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("exp", nil)), challenge: `Bearer error="invalid_token"`},
+		{name: "not yet valid", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("nbf", now.Add(time.Minute).Unix())), challenge: `Bearer error="invalid_token"`},
+		{name: "other issuer", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("iss", "https://evil.example.com")), challenge: `Bearer error="invalid_token"`},
+		{name: "other audience", token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", with("aud", "other")), challenge: `Bearer error="invalid_token"`},
+		{name: "forged signature", token: signToken(t, jwt.SigningMethodRS256, forger, "rsa", valid()), challenge: `Bearer error="invalid_token"`},
+		{name: "EC token naming the RSA key", token: signToken(t, jwt.SigningMethodES256, ecKey, "rsa", valid()), challenge: `Bearer error="invalid_token"`},
+		{name: "unsigned", token: func() string {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return token
+		}(), challenge: `Bearer error="invalid_token"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			claims = nil
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if tt.challenge == "" {
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				if claims["org"] != "acme" || claims["sub"] != "client" {
+					t.Errorf("claims %v on the request context", claims)
+				}
+				return
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want 401", w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("WWW-Authenticate %q, want %q", got, tt.challenge)
+			}
+			if claims != nil {
+				t.Error("rejected request reached the next handler")
+			}
+		})
+	}
+	if n := set.fetches.Load(); n != 1 {
+		t.Errorf("fetched the JWKS %d times, want once", n)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	old, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newFakeJWKS(t)
+	set.publish("old", old)
+	clock := clocktest.New()
+	keys := NewJWKS(set.URL, time.Hour)
+	keys.SetClock(clock)
+	verifier := NewJWTVerifier(keys, nil, nil, 0)
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	verify := func(token string) error {
+		_, err := verifier.Verify(context.Background(), token)
+		return err
+	}
+	if err := verify(signToken(t, jwt.SigningMethodES256, old, "old", claims)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a token signed with a key the cache doesn't hold yet fetches the
+	// set again, but not more than once in a while
+	set.publish("new", rotated)
+	clock.Advance(jwksMinRefresh + time.Second)
+	token := signToken(t, jwt.SigningMethodES384, rotated, "new", claims)
+	if err := verify(token); err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := verify(signToken(t, jwt.SigningMethodES384, rotated, "forged", claims)); err == nil {
+			t.Fatal("token naming an unknown key verified")
+		}
+	}
+	if n := set.fetches.Load(); n != 2 {
+		t.Errorf("fetched the JWKS %d times, want twice", n)
+	}
+
+	// the cached keys outlive an identity provider going down
+	set.Close()
+	clock.Advance(2 * time.Hour)
+	if err := verify(token); err != nil {
+		t.Errorf("cached key with the JWKS unavailable: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// Listen listens on address, a TCP host:port or a unix:// socket path. A
+// socket left behind by a previous run is removed first, and the new one
+// gets mode. Closing the listener removes the socket.
+func Listen(address string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, config.UnixScheme)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// only a socket is removed, never a file that happens to be there
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// NewServer returns a server of handler with the connection timeouts and
+// header limit of config, so a client trickling its headers or holding an
+// idle connection can't keep a goroutine forever.
+func NewServer(handler http.Handler, config config.Config) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+// serve runs server on listener until the test ends.
+func serve(t *testing.T, server *http.Server, listener net.Listener) {
+	t.Helper()
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+}
+
+// listenLocal listens on a free port of 127.0.0.1.
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func TestPlainAndTLSListeners(t *testing.T) {
+	ca := newTestCA(t, "servers")
+	certFile, keyFile := ca.issueFiles(t, "proxy.example.com")
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool()}},
+		// the redirects are the answers under test
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	// get sends a GET of url for org, none if empty, and returns the status
+	// and Location of the response.
+	get := func(url, org string) (int, string) {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if org != "" {
+			r.Header.Set("X-Org-ID", org)
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+
+	for _, redirect := range []bool{false, true} {
+		plainListener, tlsListener := listenLocal(t), listenLocal(t)
+		tlsPort := tlsListener.Addr().(*net.TCPAddr).Port
+		proxy := newTestProxy(t, fake, map[string]string{
+			"TLS_CERT_FILE":   certFile,
+			"TLS_KEY_FILE":    keyFile,
+			"TLS_PORT":        strconv.Itoa(tlsPort),
+			"REDIRECT_TO_TLS": strconv.FormatBool(redirect),
+		})
+		certs, err := NewCertReloader(proxy.Config.TLSCertFile, proxy.Config.TLSKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// wired as main does: the TLS port serves the routes, the plain
+		// one too or redirects to it
+		var handler http.Handler = NewRouter(proxy.Config, http.HandlerFunc(Healthz), proxy.Handler)
+		tlsConfig := NewTLSConfig(certs.GetCertificate, proxy.Config.TLSMinVersion, proxy.Config.TLSCipherSuites)
+		serve(t, NewServer(handler, proxy.Config), tls.NewListener(tlsListener, tlsConfig))
+		if proxy.Config.RedirectToTLS {
+			handler = RedirectToTLS(handler, proxy.Config.TLSPort, proxy.Config.HealthzPath, proxy.Config.ReadyzPath)
+		}
+		serve(t, NewServer(handler, proxy.Config), plainListener)
+		plain := "http://" + plainListener.Addr().String()
+		secure := "https://127.0.0.1:" + strconv.Itoa(tlsPort)
+
+		if status, location := get(secure+"/orders?page=2", "acme"); status != http.StatusTemporaryRedirect || location != "http://10.0.0.1:80/orders?page=2" {
+			t.Errorf("redirect %t: TLS port: status %d to %q, want acme's backend", redirect, status, location)
+		}
+		status, location := get(plain+"/orders?page=2", "acme")
+		switch {
+		case !redirect && (status != http.StatusTemporaryRedirect || location != "http://10.0.0.1:80/orders?page=2"):
+			t.Errorf("plain port: status %d to %q, want acme's backend", status, location)
+		case redirect && (status != http.StatusPermanentRedirect || location != secure+"/orders?page=2"):
+			t.Errorf("plain port redirecting: status %d to %q, want the TLS port", status, location)
+		}
+		// the health checks of the plain port are answered either way
+		for _, path := range []string{proxy.Config.HealthzPath, proxy.Config.ReadyzPath} {
+			if status, _ := get(plain+path, ""); status != http.StatusOK {
+				t.Errorf("redirect %t: plain %s: status %d", redirect, path, status)
+			}
+		}
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.sock")
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_LISTEN": config.UnixScheme + path, "SOCKET_MODE": "0600"})
+
+	// a socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := Listen(proxy.Config.ProxyListen, proxy.Config.SocketMode)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket %v, %v, want one of mode 0600", info.Mode(), err)
+	}
+	serve(t, NewServer(NewRouter(proxy.Config, http.HandlerFunc(Healthz), proxy.Handler), proxy.Config), listener)
+
+	// requests over the socket are routed like those of the proxy port
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	r, _ := http.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+	r.Header.Set("X-Org-ID", "acme")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "http://10.0.0.1:80/orders" {
+		t.Errorf("over the socket: status %d to %q, want acme's backend", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	client.CloseIdleConnections()
+
+	// closing the listener removes the socket
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket after Close: %v", err)
+	}
+
+	// a file that isn't a socket is never removed
+	file := filepath.Join(dir, "proxy.conf")
+	if err := os.WriteFile(file, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := Listen(config.UnixScheme+file, 0o600); err == nil {
+		listener.Close()
+		t.Error("Listen over a regular file succeeded")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Errorf("file under the socket path %q, %v, want it untouched", data, err)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+
+	// the defaults bound the headers and idle connections only
+	server := NewServer(http.NotFoundHandler(), newTestProxy(t, fake, nil).Config)
+	if server.ReadHeaderTimeout != 10*time.Second || server.ReadTimeout != 0 || server.WriteTimeout != 0 || server.IdleTimeout != 120*time.Second || server.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("default server %+v", server)
+	}
+
+	proxy := newTestProxy(t, fake, map[string]string{
+		"READ_HEADER_TIMEOUT": "100ms",
+		"READ_TIMEOUT":        "30s",
+		"WRITE_TIMEOUT":       "1m",
+		"IDLE_TIMEOUT":        "5m",
+		"MAX_HEADER_BYTES":    "4096",
+	})
+	server = NewServer(NewRouter(proxy.Config, http.HandlerFunc(Healthz), proxy.Handler), proxy.Config)
+	if server.ReadHeaderTimeout != 100*time.Millisecond || server.ReadTimeout != 30*time.Second || server.WriteTimeout != time.Minute || server.IdleTimeout != 5*time.Minute || server.MaxHeaderBytes != 4096 {
+		t.Errorf("server %+v, want the configured timeouts and header limit", server)
+	}
+	listener := listenLocal(t)
+	serve(t, server, listener)
+	// send writes request on a new connection and returns what the proxy
+	// answers before it closes the connection.
+	send := func(request string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		answer, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("answer to %.40q: %v", request, err)
+		}
+		return string(answer)
+	}
+
+	// a client trickling its headers is cut off
+	start := time.Now()
+	if answer := send("GET /orders HTTP/1.1\r\nHost: proxy.example.com\r\nX-Org-ID: ac"); strings.Contains(answer, "307") || time.Since(start) > 2*time.Second {
+		t.Errorf("incomplete headers answered %q after %s, want the connection closed", answer, time.Since(start))
+	}
+	// headers over the limit are turned down
+	if answer := send("GET /orders HTTP/1.1\r\nHost: proxy.example.com\r\nX-Org-ID: acme\r\nX-Padding: " + strings.Repeat("a", 8192) + "\r\nConnection: close\r\n\r\n"); !strings.HasPrefix(answer, "HTTP/1.1 431 ") {
+		t.Errorf("large headers answered %.40q, want a 431", answer)
+	}
+	// the rest is served
+	if answer := send("GET /orders HTTP/1.1\r\nHost: proxy.example.com\r\nX-Org-ID: acme\r\nConnection: close\r\n\r\n"); !strings.HasPrefix(answer, "HTTP/1.1 307 ") {
+		t.Errorf("request answered %.40q, want acme's redirect", answer)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+
+	"ecs-svc-proxy/src/buildinfo"
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// NewLogger returns a logger writing records of at least level to w in the
+// given LOG_FORMAT. Every record carries the version of the build, and
+// records logged with the context of a request carry its request ID.
+func NewLogger(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if format == config.LogFormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(requestIDHandler{handler}).With("version", buildinfo.Version)
+}
+
+// requestIDHandler adds the request ID, client identity, token subject and
+// IAM principal of the record's context to records.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if client := clientIdentityFrom(ctx); client != "" {
+		record.AddAttrs(slog.String("client", client))
+	}
+	if subject, _ := jwtClaimsFrom(ctx).GetSubject(); subject != "" {
+		record.AddAttrs(slog.String("subject", subject))
+	}
+	if principal := sigv4PrincipalFrom(ctx); principal != "" {
+		record.AddAttrs(slog.String("principal", principal))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
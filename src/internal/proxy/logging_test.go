@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/buildinfo"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+// logRecords returns the JSON records written to buf.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewLogger(t *testing.T) {
+	values := map[string]string{"ECS_CLUSTER": "tenants", "LOG_FORMAT": "json", "LOG_LEVEL": "info"}
+	cfg, err := config.Load(values, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := NewLiveConfig(cfg)
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, cfg.LogFormat, live.LogLevel())
+	// logged logs a routing decision with the context of a request.
+	logged := WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.DebugContext(r.Context(), "Routing request", "org", "acme")
+		logger.InfoContext(r.Context(), "Routed request", "org", "acme", "status", 200)
+	}), "X-Request-ID")
+	send := func() {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header.Set("X-Request-ID", "req-1")
+		logged.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// records are key-value JSON, debug ones dropped at info
+	send()
+	records := logRecords(t, &buf)
+	if len(records) != 1 {
+		t.Fatalf("%d records at info, want the info one: %s", len(records), &buf)
+	}
+	record := records[0]
+	for key, want := range map[string]any{"level": "INFO", "msg": "Routed request", "org": "acme", "status": float64(200), "request_id": "req-1", "version": buildinfo.Version} {
+		if record[key] != want {
+			t.Errorf("%s %v, want %v", key, record[key], want)
+		}
+	}
+
+	// a reload lowering the level takes effect on the running logger
+	reloader := NewReloader(cfg, live, func() (config.Config, error) { return config.Load(values, "", nil) })
+	values["LOG_LEVEL"] = "DEBUG"
+	reloader.Reload()
+	buf.Reset()
+	send()
+	if records := logRecords(t, &buf); len(records) != 2 || records[0]["level"] != "DEBUG" {
+		t.Errorf("records at debug %s, want the debug one too", &buf)
+	}
+
+	// the text format carries the same fields
+	buf.Reset()
+	text := NewLogger(&buf, config.LogFormatText, slog.LevelInfo)
+	text.Info("Routed request", "org", "acme")
+	for _, want := range []string{"level=INFO", `msg="Routed request"`, "org=acme", "version=" + buildinfo.Version} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("text record %q has no %s", &buf, want)
+		}
+	}
+}
+
+func TestDiscoveryLogging(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	defer slog.SetDefault(slog.Default())
+	for _, tt := range []struct {
+		level slog.Level
+		// debug is whether the per-cluster records are logged
+		debug bool
+	}{
+		{level: slog.LevelInfo},
+		{level: slog.LevelDebug, debug: true},
+	} {
+		var buf bytes.Buffer
+		slog.SetDefault(NewLogger(&buf, config.LogFormatJSON, tt.level))
+		refresher := discovery.NewRefresher([]discovery.ClusterTarget{{Client: fake, Cluster: "tenants", Region: discoverytest.Region}},
+			discovery.Options{DefaultPort: 8080}, discovery.NewRouteTable(nil, nil, config.LBStrategyRoundRobin), 0)
+		if _, err := refresher.Rebuild(context.Background(), discovery.TriggerStartup); err != nil {
+			t.Fatal(err)
+		}
+		var built, listed map[string]any
+		for _, record := range logRecords(t, &buf) {
+			switch record["msg"] {
+			case "Built routes":
+				built = record
+			case "Listed cluster":
+				listed = record
+			}
+		}
+		// the summary of a discovery is a record of its own
+		if built == nil || built["routes"] != float64(1) || built["clusters"] != float64(1) || built["duration"] == nil {
+			t.Errorf("%s: summary %v, want the routes, clusters and duration", tt.level, built)
+		}
+		if (listed != nil) != tt.debug {
+			t.Errorf("%s: per-cluster record %v, want it logged %t", tt.level, listed, tt.debug)
+		}
+		// backends' addresses stay out of info
+		if !tt.debug && strings.Contains(buf.String(), "10.0.0.1") {
+			t.Errorf("%s: records %s give the backend's address away", tt.level, &buf)
+		}
+	}
+}
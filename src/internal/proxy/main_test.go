@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+func TestMain(m *testing.M) {
+	// the rejections and failures tests provoke are logged at warn and
+	// error; keep them out of the test output
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	// retry throttled and failed calls of the fakes without waiting long
+	discovery.ECSRetryPolicy.BaseDelay = time.Millisecond
+	discovery.ECSRetryPolicy.MaxDelay = 5 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// waitFor waits up to 5 seconds for cond to hold, failing with what if it
+// doesn't.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// Sources of maintenance windows.
+const (
+	maintenanceFromAdmin = "admin"
+)
+
+// defaultMaintenanceMessage answers the requests of an org under
+// maintenance when its window has no message.
+const defaultMaintenanceMessage = "Org-ID is under maintenance"
+
+// MaintenanceWindows are the orgs under maintenance, from MAINTENANCE,
+// replaced on each reload, and from the admin endpoints. A nil
+// *MaintenanceWindows has none.
+type MaintenanceWindows struct {
+	clock clock.Clock
+
+	mu         sync.Mutex
+	configured map[string]config.MaintenanceWindow
+	admin      map[string]config.MaintenanceWindow
+}
+
+func newMaintenanceWindows() *MaintenanceWindows {
+	return &MaintenanceWindows{clock: clock.System{}, admin: map[string]config.MaintenanceWindow{}}
+}
+
+// SetClock makes the windows expire by clock. It must be called before the
+// windows are shared.
+func (m *MaintenanceWindows) SetClock(clock clock.Clock) {
+	m.clock = clock
+}
+
+// configure replaces the windows of MAINTENANCE.
+func (m *MaintenanceWindows) configure(windows map[string]config.MaintenanceWindow) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configured = windows
+}
+
+// Active returns the window org is under, false if it isn't under one. Orgs
+// differing in case or surrounding spaces share their windows. An expired
+// admin window is lifted.
+func (m *MaintenanceWindows) Active(org string) (config.MaintenanceWindow, bool) {
+	if m == nil {
+		return config.MaintenanceWindow{}, false
+	}
+	org = config.NormalizeOrg(org)
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if window, ok := m.admin[org]; ok {
+		if !window.Expired(now) {
+			return window, true
+		}
+		delete(m.admin, org)
+		slog.Info("Maintenance window ended", "audit", true, "org", window.Org, "caller", window.Caller)
+	}
+	window, ok := m.configured[org]
+	if !ok || window.Expired(now) {
+		return config.MaintenanceWindow{}, false
+	}
+	return window, true
+}
+
+// Set puts org under maintenance, replacing the admin window it had.
+func (m *MaintenanceWindows) Set(window config.MaintenanceWindow) {
+	m.mu.Lock()
+	m.admin[config.NormalizeOrg(window.Org)] = window
+	m.mu.Unlock()
+	slog.Info("Maintenance window set", "audit", true, "org", window.Org, "message", window.Message, "until", window.Until, "caller", window.Caller)
+}
+
+// Lift ends the admin window of org, and reports whether it had one.
+func (m *MaintenanceWindows) Lift(org, caller string) bool {
+	key := config.NormalizeOrg(org)
+	m.mu.Lock()
+	window, ok := m.admin[key]
+	delete(m.admin, key)
+	m.mu.Unlock()
+	if !ok || window.Expired(m.clock.Now()) {
+		return false
+	}
+	slog.Info("Maintenance window lifted", "audit", true, "org", org, "caller", caller)
+	return true
+}
+
+// List returns the windows in effect, sorted by org, the admin window of an
+// org hiding its configured one.
+func (m *MaintenanceWindows) List() []config.MaintenanceWindow {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	orgs := map[string]bool{}
+	for org := range m.configured {
+		orgs[org] = true
+	}
+	for org := range m.admin {
+		orgs[org] = true
+	}
+	m.mu.Unlock()
+	windows := []config.MaintenanceWindow{}
+	for org := range orgs {
+		if window, ok := m.Active(org); ok {
+			windows = append(windows, window)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Org < windows[j].Org })
+	return windows
+}
+
+// ReplaceAdmin swaps the admin windows for the ones of windows whose source
+// is admin, as imported from an export by caller, dropping the ones that
+// expired. The configured windows stay those of MAINTENANCE. windows must
+// have passed validateMaintenance.
+func (m *MaintenanceWindows) ReplaceAdmin(windows []config.MaintenanceWindow, caller string) {
+	now := m.clock.Now()
+	admin := map[string]config.MaintenanceWindow{}
+	for _, window := range windows {
+		if window.Source == maintenanceFromAdmin && !window.Expired(now) {
+			admin[config.NormalizeOrg(window.Org)] = window
+		}
+	}
+	m.mu.Lock()
+	m.admin = admin
+	m.mu.Unlock()
+	slog.Info("Maintenance windows replaced", "audit", true, "windows", len(admin), "caller", caller)
+}
+
+// validateMaintenance checks windows to be given to ReplaceAdmin: each of an
+// org and a known source, and one admin window per org.
+func validateMaintenance(windows []config.MaintenanceWindow) error {
+	orgs := map[string]bool{}
+	for _, window := range windows {
+		if strings.TrimSpace(window.Org) == "" {
+			return errors.New("maintenance window with an empty org")
+		}
+		switch window.Source {
+		case config.MaintenanceFromConfig:
+		case maintenanceFromAdmin:
+			key := config.NormalizeOrg(window.Org)
+			if orgs[key] {
+				return fmt.Errorf("org %s has several maintenance windows", window.Org)
+			}
+			orgs[key] = true
+		default:
+			return fmt.Errorf("maintenance window of org %s has unknown source %q", window.Org, window.Source)
+		}
+	}
+	return nil
+}
+
+// maintenancePage is what the HTML template of MAINTENANCE_PAGE is
+// executed with.
+type maintenancePage struct {
+	Org        string
+	Message    string
+	Until      *time.Time
+	RetryAfter time.Duration
+}
+
+// writeMaintenance answers a request of an org under window with a 503 and
+// a Retry-After, with page rendered as HTML when the client accepts it and
+// page is set, and as a JSON error otherwise, now being the time of the
+// request.
+func writeMaintenance(w http.ResponseWriter, r *http.Request, window config.MaintenanceWindow, page *template.Template, retryAfter time.Duration, now time.Time) {
+	if window.RetryAfter > 0 {
+		retryAfter = window.RetryAfter
+	} else if window.Until != nil {
+		retryAfter = max(time.Second, window.Until.Sub(now).Round(time.Second))
+	}
+	message := window.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	setOutcome(r, telemetry.OutcomeMaintenance)
+	if page != nil && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		err := page.Execute(w, maintenancePage{Org: window.Org, Message: message, Until: window.Until, RetryAfter: retryAfter})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to render the maintenance page", "error", err)
+		}
+		return
+	}
+	writeUnavailable(w, r, retryAfter, errCodeMaintenance, message)
+}
+
+// maintenanceHandler serves the maintenance windows: GET /admin/maintenance
+// lists them, POST /admin/maintenance/{org} with an optional JSON object of
+// message, retry_after and until puts the org under maintenance, and DELETE
+// /admin/maintenance/{org} lifts it.
+func maintenanceHandler(windows *MaintenanceWindows) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		org, named := strings.CutPrefix(r.URL.Path, "/admin/maintenance/")
+		if !named || org == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+				return
+			}
+			writeJSON(w, http.StatusOK, windows.List())
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			var spec config.MaintenanceSpec
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&spec); err != nil {
+					writeError(w, r, http.StatusBadRequest, errCodeBadMaintenance, "Body must be a JSON object of message, retry_after and until")
+					return
+				}
+			}
+			window, err := spec.Window(org, maintenanceFromAdmin)
+			if err == nil && window.Expired(windows.clock.Now()) {
+				err = fmt.Errorf("until %s has passed", window.Until.Format(time.RFC3339))
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, errCodeBadMaintenance, "Invalid maintenance window: "+err.Error())
+				return
+			}
+			window.Caller = adminSource(r)
+			windows.Set(window)
+			writeJSON(w, http.StatusOK, window)
+		case http.MethodDelete:
+			if !windows.Lift(org, adminSource(r)) {
+				writeError(w, r, http.StatusNotFound, errCodeNoMaintenance, "Org-ID has no maintenance window set through the admin endpoints")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", http.MethodPost+", "+http.MethodDelete)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST and DELETE are allowed")
+		}
+	})
+}
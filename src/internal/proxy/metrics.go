@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// InstrumentRequests counts and times the requests served by next under the
+// outcome next sets with setOutcome, and counts them per org.
+func InstrumentRequests(orgs *OrgLabels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		code := strconv.Itoa(recorder.status/100) + "xx"
+		telemetry.Requests.WithLabelValues(code, info.outcome).Inc()
+		telemetry.RequestDuration.WithLabelValues(code, info.outcome).Observe(time.Since(start).Seconds())
+		orgs.ObserveRequest(info.org, code)
+	})
+}
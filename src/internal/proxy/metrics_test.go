@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	endpoint := discoverytest.NewEndpoint(t, fake)
+	awsConfig := aws.Config{Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", "")}
+	discovery.InstrumentAWS(&awsConfig)
+	proxy := startTestProxy(t, map[string]string{"ECS_ENDPOINT_URL": endpoint.URL}, func(config config.Config) discovery.ECSAPI {
+		return discovery.RegionClients(awsConfig, config.ECSEndpointURL)(discoverytest.Region)
+	})
+	discovery.RegisterRouteTable("metrics-test", proxy.Routes)
+	router := NewRouter(proxy.Config, http.HandlerFunc(Healthz), InstrumentRequests(nil, proxy.Handler))
+	// get sends a GET of path for org to the router, without the org header
+	// if org is empty.
+	get := func(path, org string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com"+path, nil)
+		if org != "" {
+			r.Header.Set("X-Org-ID", org)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// a hit, a miss found by a refresh, an org no refresh finds, and a
+	// request without an org
+	get("/orders", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	get("/orders", "globex")
+	get("/orders", "initech")
+	get("/orders", "")
+
+	// the scrape needs no org header
+	w := get(proxy.Config.MetricsPath, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", proxy.Config.MetricsPath, w.Code, w.Body)
+	}
+	scrape := w.Body.String()
+	for _, series := range []string{
+		`ecs_svc_proxy_requests_total{code="3xx",outcome="hit"}`,
+		`ecs_svc_proxy_requests_total{code="3xx",outcome="miss-refresh-hit"}`,
+		`ecs_svc_proxy_requests_total{code="4xx",outcome="not-found"}`,
+		`ecs_svc_proxy_requests_total{code="4xx",outcome="bad-request"}`,
+		`ecs_svc_proxy_request_duration_seconds_bucket{code="3xx",outcome="hit",le="+Inf"}`,
+		`ecs_svc_proxy_request_duration_seconds_count{code="4xx",outcome="not-found"}`,
+		`ecs_svc_proxy_routes{table="metrics-test"} 2`,
+		`ecs_svc_proxy_last_refresh_timestamp_seconds{table="metrics-test"}`,
+		`ecs_svc_proxy_last_refresh_age_seconds{table="metrics-test"}`,
+		`ecs_svc_proxy_last_refresh_duration_seconds{table="primary"}`,
+		`ecs_svc_proxy_aws_api_calls_total{operation="ListServices",outcome="success",service="ecs"}`,
+		`ecs_svc_proxy_aws_api_calls_total{operation="DescribeTasks",outcome="success",service="ecs"}`,
+		`ecs_svc_proxy_aws_api_call_duration_seconds_count{operation="ListTasks",outcome="success",service="ecs"}`,
+		`ecs_svc_proxy_build_info{date=`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(scrape, "\n"+series) {
+			t.Errorf("scrape has no %s", series)
+		}
+	}
+}
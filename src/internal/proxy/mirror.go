@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// mirrorRequests counts the copies sent to each shadow target,
+	// mirrorErrors those that failed or got a 5xx, and mirrorDuration how
+	// long the shadow took to answer.
+	mirrorRequests = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_mirror_requests_total",
+		Help: "Requests mirrored to each shadow target.",
+	}, []string{"target"})
+	mirrorErrors = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_mirror_errors_total",
+		Help: "Mirrored requests that failed or got a 5xx, by shadow target.",
+	}, []string{"target"})
+	mirrorDuration = promauto.With(telemetry.Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ecs_svc_proxy_mirror_duration_seconds",
+		Help:    "Time shadow targets took to answer mirrored requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target"})
+	// mirrorSkipped counts the sampled requests that weren't mirrored, by
+	// reason: body_too_large, body_unread, busy or no_backend.
+	mirrorSkipped = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_mirror_skipped_total",
+		Help: "Sampled requests that weren't mirrored, by shadow target and reason.",
+	}, []string{"target", "reason"})
+)
+
+// mirrorMaxInFlight is how many mirrored requests may be outstanding at
+// once. Beyond it copies are dropped, so a slow shadow can't pile up
+// goroutines and memory.
+const mirrorMaxInFlight = 100
+
+// mirrorHopHeaders are the headers of the connection to the proxy, not
+// copied to the shadow.
+var mirrorHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// Mirror sends copies of the requests of orgs with a rule to their shadow
+// target once the primary request is done, and discards the answers. The
+// copies carry X-Shadow: true. Nothing about them, errors, latency or
+// panics, reaches the primary response. A nil Mirror mirrors nothing.
+type Mirror struct {
+	rules map[string]config.MirrorRule
+	// routes resolves the targets naming a service, whose backends must be
+	// in allowed.
+	routes  *discovery.RouteTable
+	allowed []netip.Prefix
+	client  *http.Client
+	maxBody int64
+	// inFlight holds a slot per outstanding copy.
+	inFlight chan struct{}
+	random   func() float64
+}
+
+// NewMirror returns a mirror of the orgs of rules, giving up on a copy after
+// timeout and copying bodies of at most maxBody. It returns nil if there are
+// no rules.
+func NewMirror(rules map[string]config.MirrorRule, routes *discovery.RouteTable, allowed []netip.Prefix, timeout time.Duration, maxBody int64) *Mirror {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &Mirror{
+		rules:   rules,
+		routes:  routes,
+		allowed: allowed,
+		client: &http.Client{
+			Timeout: timeout,
+			// a redirect is the shadow's answer, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		maxBody:  maxBody,
+		inFlight: make(chan struct{}, mirrorMaxInFlight),
+		random:   rand.Float64,
+	}
+}
+
+// Start samples r, a request of org about to be forwarded, and if it is to
+// be mirrored copies its headers and has its body copied as the primary
+// forward reads it. The returned func, never nil, sends the copy and must
+// be called once the primary request is done.
+func (m *Mirror) Start(r *http.Request, org string) func() {
+	if m == nil {
+		return func() {}
+	}
+	rule, ok := m.rules[config.NormalizeOrg(org)]
+	if !ok || m.random()*100 >= rule.Percent || r.Header.Get("Upgrade") != "" {
+		return func() {}
+	}
+	if r.ContentLength > m.maxBody {
+		mirrorSkipped.WithLabelValues(rule.Target, "body_too_large").Inc()
+		return func() {}
+	}
+	header := r.Header.Clone()
+	for _, name := range mirrorHopHeaders {
+		header.Del(name)
+	}
+	header.Set("X-Shadow", "true")
+	var body *mirrorBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &mirrorBody{ReadCloser: r.Body, max: m.maxBody}
+		r.Body = body
+	}
+	method, host, uri := r.Method, r.Host, r.URL.RequestURI()
+	return func() {
+		var data []byte
+		if body != nil {
+			var reason string
+			data, reason = body.copied()
+			if reason != "" {
+				mirrorSkipped.WithLabelValues(rule.Target, reason).Inc()
+				return
+			}
+		}
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			mirrorSkipped.WithLabelValues(rule.Target, "busy").Inc()
+			return
+		}
+		go func() {
+			defer func() { <-m.inFlight }()
+			m.send(rule.Target, method, host, uri, header, data)
+		}()
+	}
+}
+
+// send sends a copy to target and discards the answer.
+func (m *Mirror) send(target, method, host, uri string, header http.Header, body []byte) {
+	defer func() {
+		if err := recover(); err != nil {
+			mirrorErrors.WithLabelValues(target).Inc()
+			slog.Error("Panic mirroring a request", "target", target, "panic", err)
+		}
+	}()
+	address, ok := m.resolve(target)
+	if !ok {
+		mirrorSkipped.WithLabelValues(target, "no_backend").Inc()
+		return
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, "http://"+address+uri, bytes.NewReader(body))
+	if err != nil {
+		mirrorErrors.WithLabelValues(target).Inc()
+		return
+	}
+	req.Header = header
+	req.Host = host
+	mirrorRequests.WithLabelValues(target).Inc()
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	mirrorDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		mirrorErrors.WithLabelValues(target).Inc()
+		if err != nil && telemetry.LogSamples.Allow(context.Background(), slog.LevelDebug, "Failed to mirror request", target) {
+			slog.Debug("Failed to mirror request", "target", target, "error", err)
+		}
+	}
+}
+
+// resolve returns the host:port of target, a backend of the service it
+// names unless it is one already.
+func (m *Mirror) resolve(target string) (string, bool) {
+	if strings.Contains(target, ":") {
+		return target, true
+	}
+	service, err := m.routes.Lookup(target)
+	if err != nil || !discovery.BackendAllowed(context.Background(), m.allowed, service) {
+		return "", false
+	}
+	return service.Address(), true
+}
+
+// mirrorBody copies up to max bytes of a request body as it is read.
+type mirrorBody struct {
+	io.ReadCloser
+	max int64
+
+	// the transport may still be reading when the primary request is done
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	over bool
+	eof  bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.max {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// copied returns the body read, or why there is none to mirror: it was
+// larger than max, or the primary forward didn't read all of it.
+func (b *mirrorBody) copied() ([]byte, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.over:
+		return nil, "body_too_large"
+	case !b.eof:
+		return nil, "body_unread"
+	}
+	return bytes.Clone(b.buf.Bytes()), ""
+}
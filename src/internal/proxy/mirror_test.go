@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+// shadowRequest is a request a shadow target got.
+type shadowRequest struct {
+	method, uri, body, shadow string
+}
+
+func TestMirrorIsolation(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Shadow") != "" {
+			t.Error("primary request marked as a shadow")
+		}
+		io.WriteString(w, "primary:"+string(body))
+	}))
+	t.Cleanup(primary.Close)
+
+	got := make(chan shadowRequest, 10)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- shadowRequest{method: r.Method, uri: r.RequestURI, body: string(body), shadow: r.Header.Get("X-Shadow")}
+	}))
+	t.Cleanup(healthy.Close)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	// the slow shadow never answers within the mirror timeout
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	aborting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(aborting.Close)
+
+	host := func(server *httptest.Server) string { return strings.TrimPrefix(server.URL, "http://") }
+	rules := map[string]config.MirrorRule{
+		"acme":     {Target: host(healthy), Percent: 100},
+		"globex":   {Target: host(failing), Percent: 100},
+		"initech":  {Target: host(slow), Percent: 100},
+		"hooli":    {Target: host(down), Percent: 100},
+		"umbrella": {Target: host(aborting), Percent: 100},
+	}
+	const timeout = time.Second
+	m := NewMirror(rules, nil, nil, timeout, 1<<10)
+	forwarder := NewForwarder(NewBackendTransports(nil), func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{})
+	backend := serverBackend(primary, "primary", "p1")
+
+	// send forwards a POST of body for org to the primary like the proxy
+	// does, and checks its response is the primary's, undelayed by the
+	// shadow
+	send := func(org, body string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "http://proxy.example.com/orders?id=1", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		start := time.Now()
+		mirrored := m.Start(r, org)
+		forwarder.ServeHTTP(w, withBackend(r, org, backend, config.OrgTarget{}, nil))
+		mirrored()
+		if elapsed := time.Since(start); elapsed >= timeout/2 {
+			t.Errorf("%s: primary request took %v", org, elapsed)
+		}
+		if w.Code != http.StatusOK || w.Body.String() != "primary:"+body {
+			t.Errorf("%s: primary answered %d %q", org, w.Code, w.Body)
+		}
+	}
+
+	send("acme", "hello")
+	select {
+	case shadow := <-got:
+		want := shadowRequest{method: http.MethodPost, uri: "/orders?id=1", body: "hello", shadow: "true"}
+		if shadow != want {
+			t.Errorf("shadow got %+v, want %+v", shadow, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow got no copy")
+	}
+
+	// failures of the shadow are counted, and only that
+	for _, org := range []string{"globex", "initech", "hooli", "umbrella"} {
+		target := rules[org].Target
+		failed := telemetrytest.CounterValue(t, mirrorErrors.WithLabelValues(target))
+		send(org, "hello")
+		waitFor(t, "the failure of "+org+"'s shadow", func() bool {
+			return telemetrytest.CounterValue(t, mirrorErrors.WithLabelValues(target)) > failed
+		})
+	}
+
+	// a body over the cap reaches the primary whole and isn't mirrored
+	skipped := telemetrytest.CounterValue(t, mirrorSkipped.WithLabelValues(rules["acme"].Target, "body_too_large"))
+	send("acme", strings.Repeat("x", 2<<10))
+	if n := telemetrytest.CounterValue(t, mirrorSkipped.WithLabelValues(rules["acme"].Target, "body_too_large")) - skipped; n != 1 {
+		t.Errorf("skipped %v copies with a body over the cap, want 1", n)
+	}
+	select {
+	case shadow := <-got:
+		t.Errorf("shadow got %d bytes over the cap", len(shadow.body))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMirrorBusy(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	defer close(release)
+	target := strings.TrimPrefix(slow.URL, "http://")
+	m := NewMirror(map[string]config.MirrorRule{"acme": {Target: target, Percent: 100}}, nil, nil, time.Minute, 1<<10)
+
+	busy := telemetrytest.CounterValue(t, mirrorSkipped.WithLabelValues(target, "busy"))
+	// copies beyond the ones in flight are dropped rather than queued
+	for i := 0; i < mirrorMaxInFlight+5; i++ {
+		m.Start(httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil), "acme")()
+	}
+	if n := telemetrytest.CounterValue(t, mirrorSkipped.WithLabelValues(target, "busy")) - busy; n != 5 {
+		t.Errorf("dropped %v copies, want 5", n)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// missWaits counts the lookup misses held for the refresh in flight, by
+// result: refreshed when it was done in time, timeout, canceled when the
+// client went away, or full when too many requests were waiting already.
+var missWaits = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_miss_waits_total",
+	Help: "Lookup misses held for the refresh in flight, by result (refreshed, timeout, canceled, full).",
+}, []string{"result"})
+
+// MissWait holds the requests whose org missed while a refresh is in flight
+// until it publishes its routes, so they are looked up again rather than
+// answered a moment before the new routes would have matched. A nil
+// MissWait holds none.
+type MissWait struct {
+	timeout    time.Duration
+	maxWaiters int64
+	waiters    atomic.Int64
+}
+
+// NewMissWait returns a MissWait holding up to maxWaiters requests for at
+// most timeout each.
+func NewMissWait(timeout time.Duration, maxWaiters int) *MissWait {
+	return &MissWait{timeout: timeout, maxWaiters: int64(maxWaiters)}
+}
+
+// Wait waits for the full refresh of refresher in flight, if any, for up to
+// the timeout or until ctx is done. It reports whether the refresh is done
+// and the lookup is worth retrying.
+func (m *MissWait) Wait(ctx context.Context, refresher *discovery.Refresher) bool {
+	if m == nil || !refresher.Refreshing() {
+		return false
+	}
+	if m.waiters.Add(1) > m.maxWaiters {
+		m.waiters.Add(-1)
+		missWaits.WithLabelValues("full").Inc()
+		return false
+	}
+	defer m.waiters.Add(-1)
+	waitCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	// a refresh done before AwaitRefresh looked is as good
+	if refresher.AwaitRefresh(waitCtx) || waitCtx.Err() == nil {
+		missWaits.WithLabelValues("refreshed").Inc()
+		return true
+	}
+	if ctx.Err() != nil {
+		missWaits.WithLabelValues("canceled").Inc()
+	} else {
+		missWaits.WithLabelValues("timeout").Inc()
+	}
+	return false
+}
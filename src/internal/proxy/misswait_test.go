@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestProxyMissWait(t *testing.T) {
+	// slowRefresh returns a proxy whose next refresh, started in the
+	// background, lists the services only once release is closed, and the
+	// channel the refresh is done on. globex is added meanwhile.
+	slowRefresh := func(t *testing.T, timeout string) (proxy *testProxy, release, refreshed chan struct{}) {
+		fake := discoverytest.NewECS()
+		fake.AddService("tenants", "acme")
+		fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+		proxy = newTestProxy(t, fake, map[string]string{"REFRESH_ON_MISS": "false", "MISS_WAIT": "true", "MISS_WAIT_TIMEOUT": timeout})
+		fake.AddService("tenants", "globex")
+		fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+		release, refreshed = make(chan struct{}), make(chan struct{})
+		fake.Hook = func(op string) {
+			if op == "ListServices" {
+				<-release
+			}
+		}
+		go func() {
+			defer close(refreshed)
+			proxy.Refresher.Refresh(context.Background(), discovery.TriggerScheduled)
+		}()
+		waitFor(t, "the refresh to start", proxy.Refresher.Refreshing)
+		return proxy, release, refreshed
+	}
+	// held returns the count of lookup misses held with result.
+	held := func(t *testing.T, result string) float64 {
+		return telemetrytest.CounterValue(t, missWaits.WithLabelValues(result))
+	}
+
+	t.Run("refreshed", func(t *testing.T) {
+		proxy, release, refreshed := slowRefresh(t, "5s")
+		before := held(t, "refreshed")
+		codes := make(chan int, 1)
+		go func() { codes <- proxy.get("/orders", "globex").Code }()
+		waitFor(t, "the request to be held", func() bool { return proxy.MissWait.waiters.Load() == 1 })
+		// the request arrived mid-refresh gets the org it publishes
+		close(release)
+		if code := <-codes; code != http.StatusTemporaryRedirect {
+			t.Errorf("request held for the refresh: status %d, want a redirect to globex", code)
+		}
+		if n := held(t, "refreshed") - before; n != 1 {
+			t.Errorf("%v misses held until refreshed, want 1", n)
+		}
+		<-refreshed
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		proxy, release, refreshed := slowRefresh(t, "50ms")
+		defer func() {
+			close(release)
+			<-refreshed
+		}()
+		before := held(t, "timeout")
+		start := time.Now()
+		w := proxy.get("/orders", "globex")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("request held past the timeout: status %d: %s, want a 404", w.Code, w.Body)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("request answered after %v, want the 50ms timeout", elapsed)
+		}
+		if n := held(t, "timeout") - before; n != 1 {
+			t.Errorf("%v misses held until the timeout, want 1", n)
+		}
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		proxy, release, refreshed := slowRefresh(t, "5s")
+		defer func() {
+			close(release)
+			<-refreshed
+		}()
+		before := held(t, "canceled")
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil).WithContext(ctx)
+		r.Header.Set("X-Org-ID", "globex")
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			proxy.do(r)
+		}()
+		waitFor(t, "the request to be held", func() bool { return proxy.MissWait.waiters.Load() == 1 })
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("request still held once its client went away")
+		}
+		if n := held(t, "canceled") - before; n != 1 {
+			t.Errorf("%v misses held until canceled, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+func TestProxyNegativeCache(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"REFRESH_MIN_INTERVAL": "10s", "NEGATIVE_TTL": "30s"})
+
+	// an org still missing after its refresh is remembered
+	if w := proxy.get("/", "globex"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown org: status %d", w.Code)
+	}
+	discoveries := fake.Count("ListServices")
+	hits := telemetry.NegativeCacheHits.Value()
+	proxy.clock.Advance(10 * time.Second)
+	if w := proxy.get("/", "globex"); w.Code != http.StatusNotFound {
+		t.Fatalf("remembered org: status %d", w.Code)
+	}
+	if fake.Count("ListServices") != discoveries {
+		t.Error("remembered org refreshed after the cooldown")
+	}
+	if telemetry.NegativeCacheHits.Value() == hits {
+		t.Error("negative cache hit not counted")
+	}
+
+	// it is forgotten once it expires
+	proxy.clock.Advance(30 * time.Second)
+	proxy.get("/", "globex")
+	if n := fake.Count("ListServices") - discoveries; n != 1 {
+		t.Fatalf("%d discoveries once the entry expired, want 1", n)
+	}
+
+	// and as soon as a refresh finds the org, whatever triggered it
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	if !proxy.Routes.KnownMissing("globex") {
+		t.Fatal("org not remembered after its second miss")
+	}
+	if _, err := proxy.Refresher.Rebuild(context.Background(), discovery.TriggerScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Routes.KnownMissing("globex") {
+		t.Error("org found by a refresh still remembered as missing")
+	}
+	if w := proxy.get("/", "globex"); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("discovered org: status %d", w.Code)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// orgRequestsInFlight is the routed requests being served per org
+	// label, and orgConcurrencyLimited counts those turned down for the
+	// in-flight limit of their org.
+	orgRequestsInFlight = promauto.With(telemetry.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecs_svc_proxy_org_requests_in_flight",
+		Help: "Routed requests being served, by org.",
+	}, []string{"org"})
+	orgConcurrencyLimited = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_org_concurrency_limited_total",
+		Help: "Requests turned down for exceeding the in-flight limit of their org.",
+	}, []string{"org"})
+)
+
+// OrgConcurrencyLimiter caps the requests in flight per key, at the
+// override of the key if it has one and at limit otherwise. A request
+// beyond the cap waits up to queueTimeout for another one of its key to
+// finish. Its slots are kept like the buckets of LocalRateLimiter, at most
+// size keys, but keys with requests in flight or waiting are never
+// evicted.
+type OrgConcurrencyLimiter struct {
+	limit        int
+	overrides    map[string]int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	slots *orgLRU[*orgSlots]
+}
+
+// orgSlots holds a slot per request in flight of a key, and counts the
+// requests waiting for one. waiting is guarded by the limiter's mu.
+type orgSlots struct {
+	slots   chan struct{}
+	waiting int
+}
+
+// NewOrgConcurrencyLimiter returns a limiter with no request in flight.
+func NewOrgConcurrencyLimiter(limit int, overrides map[string]int, queueTimeout time.Duration, size int) *OrgConcurrencyLimiter {
+	return &OrgConcurrencyLimiter{
+		limit:        limit,
+		overrides:    overrides,
+		queueTimeout: queueTimeout,
+		slots: newOrgLRU(size, func(s *orgSlots) bool {
+			return len(s.slots) > 0 || s.waiting > 0
+		}),
+	}
+}
+
+// Acquire takes a slot of key, waiting for one up to the queue timeout or
+// until ctx is done, and counts the request in flight under label. The
+// returned func gives the slot back and must be called once the request is
+// done, whichever way it ends. It returns false if no slot was free.
+func (l *OrgConcurrencyLimiter) Acquire(ctx context.Context, key, label string) (release func(), ok bool) {
+	l.mu.Lock()
+	slots := l.slots.get(key, func() *orgSlots {
+		limit, ok := l.overrides[key]
+		if !ok {
+			limit = l.limit
+		}
+		return &orgSlots{slots: make(chan struct{}, limit)}
+	})
+	select {
+	case slots.slots <- struct{}{}:
+		ok = true
+	default:
+		if l.queueTimeout > 0 {
+			slots.waiting++
+		}
+	}
+	l.mu.Unlock()
+
+	if !ok && l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		select {
+		case slots.slots <- struct{}{}:
+			ok = true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		l.mu.Lock()
+		slots.waiting--
+		l.mu.Unlock()
+	}
+	if !ok {
+		return nil, false
+	}
+	gauge := orgRequestsInFlight.WithLabelValues(label)
+	gauge.Inc()
+	return func() {
+		gauge.Dec()
+		<-slots.slots
+	}, true
+}
+
+// rejectOrgConcurrency answers a request of org over the in-flight limit of
+// its key with a 429 telling the client to retry after retryAfter, and
+// counts it under label.
+func rejectOrgConcurrency(w http.ResponseWriter, r *http.Request, org, label string, retryAfter time.Duration) {
+	orgConcurrencyLimited.WithLabelValues(label).Inc()
+	if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Org concurrency limit reached", org) {
+		slog.WarnContext(r.Context(), "Org concurrency limit reached", "org", org)
+	}
+	setOutcome(r, telemetry.OutcomeRateLimited)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(retryAfter.Round(time.Second)/time.Second))))
+	writeError(w, r, http.StatusTooManyRequests, errCodeOrgConcurrency, "Too many requests in flight for Org-ID")
+}
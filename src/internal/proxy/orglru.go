@@ -0,0 +1,47 @@
+package proxy
+
+import "container/list"
+
+// orgLRU holds a value per org key, at most size of them beyond the busy
+// ones, evicting the least recently used value that isn't busy once it
+// holds more, so random org IDs can't grow it without bound. It isn't safe
+// for concurrent use, its users hold their own lock.
+type orgLRU[V any] struct {
+	size int
+	// busy reports whether a value is in use and must be kept, nil if any
+	// can be evicted.
+	busy    func(V) bool
+	entries map[string]*list.Element
+	// order has the most recently used value at the front.
+	order *list.List
+}
+
+type orgLRUEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newOrgLRU[V any](size int, busy func(V) bool) *orgLRU[V] {
+	return &orgLRU[V]{size: size, busy: busy, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the value of key, made with create if it had none, as the
+// most recently used one.
+func (c *orgLRU[V]) get(key string, create func() V) V {
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*orgLRUEntry[V]).value
+	}
+	value := create()
+	c.entries[key] = c.order.PushFront(&orgLRUEntry[V]{key: key, value: value})
+	for element := c.order.Back(); c.order.Len() > c.size && element != nil; {
+		entry := element.Value.(*orgLRUEntry[V])
+		previous := element.Prev()
+		if c.busy == nil || !c.busy(entry.value) {
+			c.order.Remove(element)
+			delete(c.entries, entry.key)
+		}
+		element = previous
+	}
+	return value
+}
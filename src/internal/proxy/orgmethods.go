@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// methodDenied counts the requests turned down with a 405, by org label.
+var methodDenied = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_method_not_allowed_total",
+	Help: "Requests turned down for a method their org may not use.",
+}, []string{"org"})
+
+// rejectMethod answers a request of org using a method it may not with a 405
+// listing allow, and logs and counts it under the label of org, unknown for
+// orgs matching no service.
+func rejectMethod(w http.ResponseWriter, r *http.Request, orgs *OrgLabels, org string, shared bool, allow []string) {
+	methodDenied.WithLabelValues(limitLabel(orgs, org, shared)).Inc()
+	if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Method not allowed", org) {
+		slog.WarnContext(r.Context(), "Method not allowed for org", "org", org, "method", r.Method,
+			"allowed", allow, "caller", clientIP(r))
+	}
+	setOutcome(r, telemetry.OutcomeMethodNotAllowed)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, fmt.Sprintf("Method %s is not allowed for Org-ID", r.Method))
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+)
+
+func TestProxyAllowedMethods(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	values := map[string]string{
+		"ECS_CLUSTER":     "tenants",
+		"ALLOWED_METHODS": `{"ACME": ["get", "HEAD", "GET"], "*": ["GET", "HEAD", "POST", "PUT", "DELETE"]}`,
+	}
+	proxy := newTestProxy(t, fake, values)
+	for _, tt := range []struct {
+		org, method string
+		// allow is the Allow header of a 405, empty for a method let
+		// through
+		allow string
+		label string
+	}{
+		{org: "acme", method: http.MethodGet},
+		{org: "acme", method: http.MethodHead},
+		{org: "acme", method: http.MethodPost, allow: "GET, HEAD", label: orgLabelOther},
+		{org: "acme", method: http.MethodDelete, allow: "GET, HEAD", label: orgLabelOther},
+		// orgs without a rule of their own get the one of every org
+		{org: "globex", method: http.MethodPost},
+		{org: "globex", method: http.MethodPatch, allow: "DELETE, GET, HEAD, POST, PUT", label: orgLabelOther},
+		// an org matching no service is counted as unknown
+		{org: "initech", method: http.MethodPatch, allow: "DELETE, GET, HEAD, POST, PUT", label: orgLabelUnknown},
+	} {
+		t.Run(tt.org+" "+tt.method, func(t *testing.T) {
+			var denied float64
+			if tt.label != "" {
+				denied = telemetrytest.CounterValue(t, methodDenied.WithLabelValues(tt.label))
+			}
+			r, info := withRequestInfo(httptest.NewRequest(tt.method, "http://proxy.example.com/orders", nil))
+			r.Header.Set("X-Org-ID", tt.org)
+			w := proxy.do(r)
+			if tt.allow == "" {
+				if w.Code != http.StatusTemporaryRedirect {
+					t.Errorf("status %d: %s, want the request redirected", w.Code, w.Body)
+				}
+				return
+			}
+			if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tt.allow || !strings.Contains(w.Body.String(), `"code":"`+errCodeMethodNotAllowed+`"`) {
+				t.Errorf("status %d, Allow %q: %s, want a 405 allowing %s", w.Code, w.Header().Get("Allow"), w.Body, tt.allow)
+			}
+			if info.outcome != telemetry.OutcomeMethodNotAllowed {
+				t.Errorf("outcome %s, want %s", info.outcome, telemetry.OutcomeMethodNotAllowed)
+			}
+			if n := telemetrytest.CounterValue(t, methodDenied.WithLabelValues(tt.label)) - denied; n != 1 {
+				t.Errorf("%v requests counted as denied under %s, want 1", n, tt.label)
+			}
+		})
+	}
+
+	// a reload applies the new rules to the next request, and taking them
+	// away allows any method
+	reloader := NewReloader(proxy.Config, proxy.Live, func() (config.Config, error) {
+		return config.Load(values, "", nil)
+	})
+	values["ALLOWED_METHODS"] = `{"acme": ["GET", "POST"]}`
+	reloader.Reload()
+	r := httptest.NewRequest(http.MethodPost, "http://proxy.example.com/orders", nil)
+	r.Header.Set("X-Org-ID", "acme")
+	if w := proxy.do(r); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("acme POST after the reload: status %d: %s", w.Code, w.Body)
+	}
+	delete(values, "ALLOWED_METHODS")
+	reloader.Reload()
+	r = httptest.NewRequest(http.MethodPatch, "http://proxy.example.com/orders", nil)
+	r.Header.Set("X-Org-ID", "globex")
+	if w := proxy.do(r); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("globex PATCH without rules: status %d: %s", w.Code, w.Body)
+	}
+}
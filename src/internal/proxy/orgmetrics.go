@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// orgRequests counts the routed requests of each org by status class
+	// and orgUpstreamDuration observes how long its backends took to answer.
+	orgRequests = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_org_requests_total",
+		Help: "Routed requests by org and status class.",
+	}, []string{"org", "code"})
+	orgUpstreamDuration = promauto.With(telemetry.Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ecs_svc_proxy_org_upstream_duration_seconds",
+		Help:    "Time until the backend answered, by org.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"org"})
+)
+
+// Org labels standing for more than one org.
+const (
+	// orgLabelUnknown is the label of requests that matched no service.
+	orgLabelUnknown = "unknown"
+	// orgLabelOther is the label of the orgs beyond the cardinality cap.
+	orgLabelOther = "other"
+)
+
+// OrgLabels bounds the cardinality of the org label: the first max orgs
+// that routed successfully get their own label and later ones share
+// orgLabelOther. A nil *OrgLabels disables the per-org series.
+type OrgLabels struct {
+	mu   sync.Mutex
+	max  int
+	orgs map[string]bool
+}
+
+// NewOrgLabels returns org labels capped at max, or nil if max is zero.
+func NewOrgLabels(max int) *OrgLabels {
+	if max <= 0 {
+		return nil
+	}
+	return &OrgLabels{max: max, orgs: map[string]bool{}}
+}
+
+// label returns the label of org, which is empty for rejected requests.
+func (l *OrgLabels) label(org string) string {
+	if org == "" {
+		return orgLabelUnknown
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.orgs[org] {
+		return org
+	}
+	if len(l.orgs) >= l.max {
+		return orgLabelOther
+	}
+	l.orgs[org] = true
+	return org
+}
+
+// ObserveRequest counts a request of org answered with the status class
+// code.
+func (l *OrgLabels) ObserveRequest(org, code string) {
+	if l == nil {
+		return
+	}
+	orgRequests.WithLabelValues(l.label(org), code).Inc()
+}
+
+// ObserveUpstream records how long the backend took to answer a request of
+// the org routed by req.
+func (l *OrgLabels) ObserveUpstream(req *http.Request, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	_, info := withRequestInfo(req)
+	orgUpstreamDuration.WithLabelValues(l.label(info.org)).Observe(latency.Seconds())
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry/telemetrytest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// upstreamCount returns how many upstream latencies were observed under
+// label.
+func upstreamCount(t *testing.T, label string) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := orgUpstreamDuration.WithLabelValues(label).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// orgMetricsProxy returns a proxy forwarding the requests of acme, globex
+// and initech, counting them under orgs. The backend of globex fails.
+func orgMetricsProxy(t *testing.T, orgs *OrgLabels) http.Handler {
+	t.Helper()
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddService("tenants", "initech")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"),
+		discoverytest.Task("tenants", "initech", "i1", "10.0.2.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": config.ProxyModeForward})
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		if r.URL.Hostname() == "10.0.1.1" {
+			status = http.StatusInternalServerError
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("ok")), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(&LatencyTransport{Next: transport, Outliers: proxy.Routes.Outliers, Orgs: orgs}, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	return InstrumentRequests(orgs, proxy.Handler)
+}
+
+// sendOrg sends a request of org to handler.
+func sendOrg(handler http.Handler, org string) {
+	r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+	r.Header.Set("X-Org-ID", org)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestOrgMetrics(t *testing.T) {
+	handler := orgMetricsProxy(t, NewOrgLabels(10))
+	type series struct{ label, code string }
+	want := map[series]float64{
+		{"acme", "2xx"}:          2,
+		{"globex", "5xx"}:        1,
+		{"initech", "2xx"}:       1,
+		{orgLabelUnknown, "4xx"}: 1,
+	}
+	before := map[series]float64{}
+	for s := range want {
+		before[s] = telemetrytest.CounterValue(t, orgRequests.WithLabelValues(s.label, s.code))
+	}
+	upstreamBefore := map[string]uint64{}
+	for _, label := range []string{"acme", "globex", "initech"} {
+		upstreamBefore[label] = upstreamCount(t, label)
+	}
+
+	for _, org := range []string{"acme", "acme", "globex", "initech", "hooli"} {
+		sendOrg(handler, org)
+	}
+	// requests are counted by org and status class, rejected ones under
+	// unknown
+	for s, n := range want {
+		if got := telemetrytest.CounterValue(t, orgRequests.WithLabelValues(s.label, s.code)) - before[s]; got != n {
+			t.Errorf("%v %s requests of %s counted, want %v", got, s.code, s.label, n)
+		}
+	}
+	// and the backends of each org timed
+	for label, n := range map[string]uint64{"acme": 2, "globex": 1, "initech": 1} {
+		if got := upstreamCount(t, label) - upstreamBefore[label]; got != n {
+			t.Errorf("%d upstream latencies of %s observed, want %d", got, label, n)
+		}
+	}
+	if got := upstreamCount(t, "hooli") + upstreamCount(t, orgLabelUnknown); got != 0 {
+		t.Errorf("%d upstream latencies of a rejected org observed", got)
+	}
+}
+
+func TestOrgMetricsCardinalityCap(t *testing.T) {
+	handler := orgMetricsProxy(t, NewOrgLabels(2))
+	other := telemetrytest.CounterValue(t, orgRequests.WithLabelValues(orgLabelOther, "2xx"))
+	otherUpstream := upstreamCount(t, orgLabelOther)
+	acme := telemetrytest.CounterValue(t, orgRequests.WithLabelValues("acme", "2xx"))
+
+	// the first two orgs keep their own label, the third shares other
+	for _, org := range []string{"acme", "globex", "initech", "initech", "acme"} {
+		sendOrg(handler, org)
+	}
+	if n := telemetrytest.CounterValue(t, orgRequests.WithLabelValues(orgLabelOther, "2xx")) - other; n != 2 {
+		t.Errorf("%v requests counted under %s, want the 2 of initech", n, orgLabelOther)
+	}
+	if n := upstreamCount(t, orgLabelOther) - otherUpstream; n != 2 {
+		t.Errorf("%d upstream latencies observed under %s, want the 2 of initech", n, orgLabelOther)
+	}
+	if n := telemetrytest.CounterValue(t, orgRequests.WithLabelValues("acme", "2xx")) - acme; n != 2 {
+		t.Errorf("%v requests of acme counted, want 2 under its own label", n)
+	}
+
+	// nil disables the per-org series
+	if NewOrgLabels(0) != nil {
+		t.Error("ORG_METRICS_MAX=0 still labels orgs")
+	}
+}
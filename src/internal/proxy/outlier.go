@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// LatencyTransport records how long backends take to answer, per backend
+// and per org.
+type LatencyTransport struct {
+	Next     http.RoundTripper
+	Outliers *discovery.LatencyOutliers
+	Orgs     *OrgLabels
+}
+
+func (t *LatencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.Next.RoundTrip(req)
+	if err == nil {
+		latency := time.Since(start)
+		t.Outliers.Observe(discovery.BackendAddress(req), latency)
+		t.Orgs.ObserveUpstream(req, latency)
+		addUpstream(req, latency)
+	}
+	return resp, err
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// overridesHandler serves the route overrides: GET /admin/overrides lists
+// them, PUT /admin/overrides/{org} with a JSON object of target and an
+// optional ttl sets the one of an org, and DELETE /admin/overrides/{org}
+// removes it.
+func overridesHandler(overrides *discovery.RouteOverrides) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		org, named := strings.CutPrefix(r.URL.Path, "/admin/overrides/")
+		if !named || org == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+				return
+			}
+			writeJSON(w, http.StatusOK, overrides.List())
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				Target string `json:"target"`
+				TTL    string `json:"ttl"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+				writeError(w, r, http.StatusBadRequest, errCodeInvalidOverride, "Body must be a JSON object of target and ttl")
+				return
+			}
+			var ttl time.Duration
+			if body.TTL != "" {
+				var err error
+				if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl <= 0 {
+					writeError(w, r, http.StatusBadRequest, errCodeInvalidOverride, fmt.Sprintf("Invalid ttl %q, must be a positive duration", body.TTL))
+					return
+				}
+			}
+			override, err := overrides.Set(org, body.Target, ttl, adminSource(r))
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, errCodeInvalidOverride, "Invalid override: "+err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, override)
+		case http.MethodDelete:
+			if !overrides.Delete(org, adminSource(r)) {
+				writeError(w, r, http.StatusNotFound, errCodeUnknownOverride, "No override for Org-ID")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", http.MethodPut+", "+http.MethodDelete)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only PUT and DELETE are allowed")
+		}
+	})
+}
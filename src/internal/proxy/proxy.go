@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+type backendKey struct{}
+
+// backend is the backend a request is forwarded to.
+type backend struct {
+	url     *url.URL
+	service string
+	org     string
+	// task is the ID of the task of the backend, the one of the last
+	// attempt once the request was retried.
+	task string
+	// target is how the org's requests reach the service, retries included.
+	target config.OrgTarget
+	// retarget picks the backend a retry goes to, nil if the request
+	// mustn't be retried.
+	retarget func() (discovery.ECSService, error)
+}
+
+// NewForwarder returns a reverse proxy that sends each request to the backend
+// stored in its context by withBackend. failed is called with the address of
+// a backend the request could not be forwarded to. Requests refused by a
+// circuit breaker get a 503 with retryAfter. rewrite rewrites the responses
+// of backends.
+func NewForwarder(transport http.RoundTripper, failed func(address string), retryAfter func() time.Duration, rewrite ResponseRewriter) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport:      transport,
+		ModifyResponse: rewrite.Modify,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(r.In.Context().Value(backendKey{}).(*backend).url)
+			r.SetXForwarded()
+			// the chain a trusted proxy passed on is kept, a client's own
+			// X-Forwarded-For isn't
+			if forwarded := clientAddr(r.In).forwarded; len(forwarded) > 0 {
+				chain := strings.Join(forwarded, ", ")
+				if peer := r.Out.Header.Get("X-Forwarded-For"); peer != "" {
+					chain += ", " + peer
+				}
+				r.Out.Header.Set("X-Forwarded-For", chain)
+			}
+			restoreTraceHeaders(r.Out.Header, traceHeadersFrom(r.In.Context()))
+			r.Out.Host = r.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			setOutcome(r, telemetry.OutcomeBackendError)
+			if errors.Is(err, discovery.ErrBreakerOpen) {
+				writeUnavailable(w, r, retryAfter(), errCodeBackendOpen, "Backend is unavailable")
+				return
+			}
+			address := discovery.BackendAddress(r)
+			var retried *backendError
+			if errors.As(err, &retried) {
+				address, err = retried.Address, retried.Err
+			}
+			if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Failed to forward request", address) {
+				slog.WarnContext(r.Context(), "Failed to forward request", "backend", address, "error", err)
+			}
+			// a client going away says nothing about the backend
+			if !errors.Is(err, context.Canceled) {
+				failed(address)
+			}
+			if isTLSError(err) {
+				telemetry.BackendTLSFailures.Add(1)
+				writeError(w, r, http.StatusBadGateway, errCodeBackendTLS, "TLS handshake with backend failed")
+				return
+			}
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+				writeError(w, r, http.StatusGatewayTimeout, errCodeBackendTimeout, "Backend timed out")
+				return
+			}
+			writeError(w, r, http.StatusBadGateway, errCodeBadGateway, "Failed to reach backend")
+		},
+	}
+}
+
+// withBackend returns r with service as the backend NewForwarder sends it
+// to for org, reached as target says. retarget picks the backend of a retry
+// and may be nil.
+func withBackend(r *http.Request, org string, service discovery.ECSService, target config.OrgTarget, retarget func() (discovery.ECSService, error)) *http.Request {
+	b := &backend{
+		url:      targetURL(target, service),
+		service:  service.Name,
+		org:      org,
+		task:     discovery.TaskID(service.TaskArn),
+		target:   target,
+		retarget: retarget,
+	}
+	ctx := discovery.WithBackendAddress(r.Context(), service.Address())
+	return r.WithContext(context.WithValue(ctx, backendKey{}, b))
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rateLimited counts the requests turned down with a 429, by org label.
+var rateLimited = promauto.With(telemetry.Registry).NewCounterVec(prometheus.CounterOpts{
+	Name: "ecs_svc_proxy_rate_limited_total",
+	Help: "Requests turned down for exceeding the rate limit of their org.",
+}, []string{"org"})
+
+// rateLimitShared is the key of the bucket shared by the requests of orgs
+// that match no service.
+const rateLimitShared = ""
+
+// RateLimiter decides whether a request may go through the limit of its
+// key. The buckets of LocalRateLimiter live in the replica; another
+// implementation could keep them in a store shared by every replica.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key, and otherwise returns
+	// how long until one is available.
+	Allow(key string) (bool, time.Duration)
+}
+
+// LocalRateLimiter keeps a token bucket per key in memory, limited by the
+// override of the key if it has one and by limit otherwise. It holds at
+// most size buckets and evicts the least recently used one beyond that, so
+// random org IDs can't grow it without bound; an evicted key starts again
+// with a full bucket.
+type LocalRateLimiter struct {
+	limit     config.RateLimit
+	overrides map[string]config.RateLimit
+	clock     clock.Clock
+
+	mu      sync.Mutex
+	buckets *orgLRU[*tokenBucket]
+}
+
+type tokenBucket struct {
+	limit   config.RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// NewLocalRateLimiter returns a limiter whose buckets start full.
+func NewLocalRateLimiter(limit config.RateLimit, overrides map[string]config.RateLimit, size int) *LocalRateLimiter {
+	return &LocalRateLimiter{
+		limit:     limit,
+		overrides: overrides,
+		clock:     clock.System{},
+		buckets:   newOrgLRU[*tokenBucket](size, nil),
+	}
+}
+
+// SetClock makes the buckets refill by clock. It must be called before the
+// limiter is shared.
+func (l *LocalRateLimiter) SetClock(clock clock.Clock) {
+	l.clock = clock
+}
+
+// Allow implements RateLimiter.
+func (l *LocalRateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	bucket := l.bucket(key, now)
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = min(float64(bucket.limit.Burst), bucket.tokens+max(0, elapsed)*bucket.limit.Rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := (1 - bucket.tokens) / bucket.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// bucket returns the bucket of key, a full one if it had none. The caller
+// must hold l.mu.
+func (l *LocalRateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	return l.buckets.get(key, func() *tokenBucket {
+		limit, ok := l.overrides[key]
+		if !ok {
+			limit = l.limit
+		}
+		return &tokenBucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+	})
+}
+
+// limitLabel returns the label the limits of org are counted under,
+// unknown for the orgs sharing a bucket.
+func limitLabel(orgs *OrgLabels, org string, shared bool) string {
+	switch {
+	case shared:
+		return orgLabelUnknown
+	case orgs != nil:
+		return orgs.label(org)
+	}
+	return orgLabelOther
+}
+
+// rejectRateLimited answers a request of org over the limit of its bucket
+// with a 429 telling the client to retry after wait, and counts it under
+// the label of org, unknown for the shared bucket.
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, orgs *OrgLabels, org string, shared bool, wait time.Duration) {
+	rateLimited.WithLabelValues(limitLabel(orgs, org, shared)).Inc()
+	if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Rate limited", org) {
+		slog.WarnContext(r.Context(), "Rate limited", "org", org, "shared", shared)
+	}
+	setOutcome(r, telemetry.OutcomeRateLimited)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	writeError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "Rate limit exceeded for Org-ID")
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestProxyRateLimit(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"RATE_LIMIT": "0.5", "RATE_LIMIT_BURST": "3", "RATE_LIMIT_ORGS": "globex|10|5"})
+	limiter := NewLocalRateLimiter(proxy.Config.RateLimit, proxy.Config.RateLimitOrgs, proxy.Config.RateLimitMaxOrgs)
+	limiter.SetClock(proxy.clock)
+	proxy.Limiter = limiter
+	// burst sends n requests of org and returns how many got through.
+	burst := func(org string, n int) int {
+		through := 0
+		for i := 0; i < n; i++ {
+			if w := proxy.get("/orders", org); w.Code != http.StatusTooManyRequests {
+				through++
+			}
+		}
+		return through
+	}
+
+	if n := burst("acme", 3); n != 3 {
+		t.Fatalf("%d of a burst of 3 got through", n)
+	}
+	w := proxy.get("/orders", "acme")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("request over the burst: status %d, Retry-After %q, want a 429 to retry after 2s", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// another org has its own bucket, sized by its override
+	if n := burst("globex", 6); n != 5 {
+		t.Errorf("%d of a burst of 6 of globex got through, want its 5", n)
+	}
+	// and orgs matching no service share one
+	through := 0
+	for i := 0; i < 4; i++ {
+		if w := proxy.get("/orders", fmt.Sprintf("bogus-%d", i)); w.Code != http.StatusTooManyRequests {
+			through++
+		}
+	}
+	if through != 3 {
+		t.Errorf("%d of 4 requests of unknown orgs got through, want the shared burst of 3", through)
+	}
+
+	// the bucket refills by the clock
+	proxy.clock.Advance(time.Second)
+	if n := burst("acme", 1); n != 0 {
+		t.Error("request got through after half a token refilled")
+	}
+	proxy.clock.Advance(time.Second)
+	if n := burst("acme", 2); n != 1 {
+		t.Errorf("%d requests got through after a token refilled, want 1", n)
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// RecoverPanics answers requests whose handler panicked with a 500 instead of
+// dropping the connection, logging the stack together with the request and
+// its org taken from header. http.ErrAbortHandler is passed on, it is how
+// handlers deliberately abort a response.
+func RecoverPanics(next http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			telemetry.Panics.Add(1)
+			slog.ErrorContext(r.Context(), "Panic serving request", "method", r.Method, "path", r.URL.Path, "org", r.Header.Get(header), "error", err, "stack", string(debug.Stack()))
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
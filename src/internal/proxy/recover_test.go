@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	server := httptest.NewServer(RecoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			var routes map[string]string
+			routes["acme"] = "10.0.0.1"
+		case "/abort":
+			io.WriteString(w, "partial")
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, "ok")
+	}), "X-Org-ID"))
+	defer server.Close()
+	get := func(path string) (*http.Response, string, error) {
+		r, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		r.Header.Set("X-Org-ID", "acme")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, string(body), err
+	}
+
+	panics := telemetry.Panics.Value()
+	resp, body, err := get("/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body, errCodeInternal) {
+		t.Errorf("panicking handler: status %d: %s, want a 500", resp.StatusCode, body)
+	}
+	if n := telemetry.Panics.Value() - panics; n != 1 {
+		t.Errorf("%d panics counted, want 1", n)
+	}
+	var entry struct {
+		Msg, Method, Path, Org, Error, Stack string
+	}
+	if err := json.Unmarshal(logged.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry %q: %v", logged.String(), err)
+	}
+	if entry.Msg != "Panic serving request" || entry.Path != "/panic" || entry.Org != "acme" ||
+		!strings.Contains(entry.Error, "nil map") || !strings.Contains(entry.Stack, "recover_test.go") {
+		t.Errorf("logged %+v, want the request, its org, the error and the stack", entry)
+	}
+
+	// a deliberate abort is left to the server, which drops the connection
+	logged.Reset()
+	if _, _, err := get("/abort"); err == nil {
+		t.Error("aborted response read in full")
+	}
+	if logged.Len() > 0 {
+		t.Errorf("aborted response logged as a panic: %s", &logged)
+	}
+
+	// and the server keeps serving
+	if resp, body, err := get("/"); err != nil || resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("request after the panics: %v, %q", err, body)
+	}
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// reloadable are the variables a reload applies. The others, such as the
+// ports the proxy listens on, only take effect after a restart.
+var reloadable = map[string]bool{
+	"LOG_LEVEL":        true,
+	"RETRY_AFTER":      true,
+	"REFRESH_ON_MISS":  true,
+	"SHUTDOWN_DELAY":   true,
+	"SHUTDOWN_TIMEOUT": true,
+	"MAINTENANCE":      true,
+	"ERROR_MESSAGES":   true,
+	"ORG_HEADERS":      true,
+	"ALLOWED_METHODS":  true,
+	"RESPONSE_HEADERS": true,
+	"ORG_TARGETS":      true,
+	"API_KEYS":         true,
+}
+
+// LiveConfig holds the settings that can change while the proxy runs. It is
+// safe for concurrent use.
+type LiveConfig struct {
+	logLevel        slog.LevelVar
+	retryAfter      atomic.Int64
+	refreshOnMiss   atomic.Bool
+	shutdownDelay   atomic.Int64
+	shutdownTimeout atomic.Int64
+	maintenance     *MaintenanceWindows
+	orgHeaders      atomic.Pointer[config.OrgHeaders]
+	allowedMethods  atomic.Pointer[config.AllowedMethods]
+	responseHeaders atomic.Pointer[config.ResponseHeaders]
+	orgTargets      atomic.Pointer[map[string]config.OrgTarget]
+	apiKeys         atomic.Pointer[string]
+	// onOrgTargets are called with the org targets each time they are
+	// applied, holding mu.
+	mu           sync.Mutex
+	onOrgTargets []func(map[string]config.OrgTarget)
+}
+
+// NewLiveConfig returns the live settings of config.
+func NewLiveConfig(config config.Config) *LiveConfig {
+	c := &LiveConfig{maintenance: newMaintenanceWindows()}
+	c.apply(config)
+	return c
+}
+
+// apply makes the reloadable settings of config the live ones.
+func (c *LiveConfig) apply(config config.Config) {
+	c.logLevel.Set(config.LogLevel)
+	c.retryAfter.Store(int64(config.RetryAfter))
+	c.refreshOnMiss.Store(config.RefreshOnMiss)
+	c.shutdownDelay.Store(int64(config.ShutdownDelay))
+	c.shutdownTimeout.Store(int64(config.ShutdownTimeout))
+	c.maintenance.configure(config.Maintenance)
+	errorMessages.Store(&config.ErrorMessages)
+	c.orgHeaders.Store(&config.OrgHeaders)
+	c.allowedMethods.Store(&config.AllowedMethods)
+	c.responseHeaders.Store(&config.ResponseHeaders)
+	c.apiKeys.Store(&config.APIKeys)
+	c.orgTargets.Store(&config.OrgTargets)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fn := range c.onOrgTargets {
+		fn(config.OrgTargets)
+	}
+}
+
+// LogLevel returns the level of LOG_LEVEL, following reloads.
+func (c *LiveConfig) LogLevel() slog.Leveler {
+	return &c.logLevel
+}
+
+// RetryAfter returns the Retry-After sent with 503 responses.
+func (c *LiveConfig) RetryAfter() time.Duration {
+	return time.Duration(c.retryAfter.Load())
+}
+
+// RefreshOnMiss reports whether a lookup miss triggers a refresh.
+func (c *LiveConfig) RefreshOnMiss() bool {
+	return c.refreshOnMiss.Load()
+}
+
+// ShutdownDelay returns how long readiness fails before the listener closes
+// on SIGTERM.
+func (c *LiveConfig) ShutdownDelay() time.Duration {
+	return time.Duration(c.shutdownDelay.Load())
+}
+
+// ShutdownTimeout returns how long requests in flight have to finish once
+// the listener closed.
+func (c *LiveConfig) ShutdownTimeout() time.Duration {
+	return time.Duration(c.shutdownTimeout.Load())
+}
+
+// OrgHeaders returns the headers set on the requests forwarded for each org.
+func (c *LiveConfig) OrgHeaders() config.OrgHeaders {
+	return *c.orgHeaders.Load()
+}
+
+// AllowedMethods returns the methods each org may use.
+func (c *LiveConfig) AllowedMethods() config.AllowedMethods {
+	return *c.allowedMethods.Load()
+}
+
+// ResponseHeaders returns the rules of the responses relayed for each org.
+func (c *LiveConfig) ResponseHeaders() config.ResponseHeaders {
+	return *c.responseHeaders.Load()
+}
+
+// OrgTargets returns the scheme, port, path prefix and container overrides
+// of the orgs of ORG_TARGETS, by normalized org.
+func (c *LiveConfig) OrgTargets() map[string]config.OrgTarget {
+	return *c.orgTargets.Load()
+}
+
+// OrgTarget returns the ORG_TARGETS entry of org, the zero OrgTarget if it
+// has none. Orgs differing in case or surrounding spaces share one.
+func (c *LiveConfig) OrgTarget(org string) config.OrgTarget {
+	return c.OrgTargets()[config.NormalizeOrg(org)]
+}
+
+// OnOrgTargets calls fn with the org targets now and each time a reload
+// applies them.
+func (c *LiveConfig) OnOrgTargets(fn func(map[string]config.OrgTarget)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onOrgTargets = append(c.onOrgTargets, fn)
+	fn(c.OrgTargets())
+}
+
+// APIKeys returns the API keys document of API_KEYS.
+func (c *LiveConfig) APIKeys() string {
+	return *c.apiKeys.Load()
+}
+
+// Maintenance returns the maintenance windows, those of MAINTENANCE and the
+// ones set through the admin endpoints.
+func (c *LiveConfig) Maintenance() *MaintenanceWindows {
+	return c.maintenance
+}
+
+// Reloader loads the configuration again on SIGHUP, or when a secret it
+// references was rotated, and applies what can change without a restart.
+type Reloader struct {
+	load func() (config.Config, error)
+	live *LiveConfig
+	// mu serializes reloads, running holds the settings in use by variable
+	// name.
+	mu      sync.Mutex
+	running map[string]string
+}
+
+// NewReloader returns a reloader applying to live the configurations load
+// returns, config being the one running.
+func NewReloader(config config.Config, live *LiveConfig, load func() (config.Config, error)) *Reloader {
+	running := make(map[string]string, len(config.Settings))
+	for key, value := range config.Settings {
+		running[key] = value
+	}
+	return &Reloader{load: load, live: live, running: running}
+}
+
+// Reload loads the configuration and applies the reloadable settings that
+// changed, logging each of them. An invalid configuration is rejected as a
+// whole, and changes that need a restart are logged and left out.
+func (r *Reloader) Reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loaded, err := r.load()
+	if err != nil {
+		slog.Error("Rejected invalid configuration, keeping the running one", "error", err)
+		return
+	}
+	changed := changedSettings(r.running, loaded.Settings)
+	if len(changed) == 0 {
+		slog.Info("Reloaded configuration, nothing changed")
+		return
+	}
+	r.live.apply(loaded)
+	for _, key := range changed {
+		previous, value := config.SettingValue(key, r.running[key]), config.SettingValue(key, loaded.Settings[key])
+		if !reloadable[key] {
+			slog.Warn("Ignoring configuration change, it needs a restart", "setting", strings.ToLower(key), "running", previous, "configured", value)
+			continue
+		}
+		slog.Info("Configuration changed", "audit", true, "setting", strings.ToLower(key), "previous", previous, "value", value)
+		r.running[key] = loaded.Settings[key]
+	}
+}
+
+// changedSettings returns the variables whose value differs between
+// previous and current, sorted.
+func changedSettings(previous, current map[string]string) []string {
+	var changed []string
+	for key, value := range current {
+		if previous[key] != value {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestReloadOrgTargets(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	values := map[string]string{"ECS_CLUSTER": "tenants", "ORG_TARGETS": "acme||9000|"}
+	proxy := newTestProxy(t, fake, values)
+	reloader := NewReloader(proxy.Config, proxy.Live, func() (config.Config, error) {
+		return config.Load(values, "", nil)
+	})
+	location := func() string {
+		t.Helper()
+		w := proxy.get("/orders", "acme")
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		return w.Header().Get("Location")
+	}
+	if got := location(); got != "http://10.0.0.1:9000/orders" {
+		t.Fatalf("Location %q before the reload", got)
+	}
+
+	// the next request after a reload uses the new rule
+	values["ORG_TARGETS"] = "acme|https|8443|/v2"
+	reloader.Reload()
+	if got := location(); got != "https://10.0.0.1:8443/v2/orders" {
+		t.Errorf("Location %q after the reload, want the new target", got)
+	}
+
+	// an invalid configuration is rejected as a whole, the new rule of a
+	// valid ORG_TARGETS included
+	for _, invalid := range []map[string]string{
+		{"ORG_TARGETS": "acme|ftp||"},
+		{"ORG_TARGETS": "acme||7000|", "RETRY_AFTER": "soon"},
+	} {
+		for name, value := range invalid {
+			values[name] = value
+		}
+		reloader.Reload()
+		if got := location(); got != "https://10.0.0.1:8443/v2/orders" {
+			t.Errorf("Location %q after reloading %v, want the running target", got, invalid)
+		}
+		delete(values, "RETRY_AFTER")
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+// uuidV4 matches the IDs newRequestID generates.
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestWithRequestID(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": config.ProxyModeForward})
+	// the backend answers with the ID it was sent
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(r.Header.Get("X-Correlation-ID"))), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(transport, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	var records bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(NewLogger(&records, config.LogFormatJSON, slog.LevelInfo))
+	handler := WithRequestID(AccessLog(proxy.Handler, "X-Org-ID", slog.LevelInfo), "X-Correlation-ID")
+	// send sends a request of org with the ID id, none if empty, and returns
+	// the response and the ID of its access record.
+	send := func(org, id string) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		records.Reset()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header.Set("X-Org-ID", org)
+		if id != "" {
+			r.Header.Set("X-Correlation-ID", id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		for _, record := range logRecords(t, &records) {
+			if record["msg"] == "Request" {
+				id, _ := record["request_id"].(string)
+				return w, id
+			}
+		}
+		t.Fatalf("no access record: %s", &records)
+		return nil, ""
+	}
+
+	// a valid client ID goes through as is
+	w, logged := send("acme", "trace-7:span/2")
+	if w.Header().Get("X-Correlation-ID") != "trace-7:span/2" || w.Body.String() != "trace-7:span/2" || logged != "trace-7:span/2" {
+		t.Errorf("client ID answered %q, forwarded %q, logged %q", w.Header().Get("X-Correlation-ID"), w.Body, logged)
+	}
+
+	// a missing or invalid one is replaced by a fresh UUID, the same in the
+	// response, upstream and the log
+	seen := map[string]bool{}
+	for _, id := range []string{"", "", "two words", "id\n", strings.Repeat("a", maxRequestIDLength+1)} {
+		w, logged := send("acme", id)
+		generated := w.Header().Get("X-Correlation-ID")
+		if !uuidV4.MatchString(generated) || w.Body.String() != generated || logged != generated {
+			t.Errorf("ID %q answered %q, forwarded %q, logged %q, want one generated ID", id, generated, w.Body, logged)
+		}
+		if seen[generated] {
+			t.Errorf("ID %s generated twice", generated)
+		}
+		seen[generated] = true
+	}
+	if id := strings.Repeat("a", maxRequestIDLength); !validRequestID(id) {
+		t.Errorf("ID of %d characters rejected", maxRequestIDLength)
+	}
+
+	// errors carry the ID too
+	w, _ = send("initech", "req-404")
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Correlation-ID") != "req-404" {
+		t.Fatalf("status %d, ID %q", w.Code, w.Header().Get("X-Correlation-ID"))
+	}
+	if resp := decodeError(t, w); resp.RequestID != "req-404" {
+		t.Errorf("error of request %q, want req-404", resp.RequestID)
+	}
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// backendTaskHeader names the task a response came from with
+// BACKEND_TASK_HEADER.
+const backendTaskHeader = "X-Backend-Task"
+
+// ResponseRewriter rewrites the responses relayed from backends so they
+// don't give their private address away: Location headers pointing at the
+// backend and, when CookieDomain is set, cookies scoped to its IP are moved
+// to the host the client asked for. headers returns the live header rules.
+type ResponseRewriter struct {
+	Location     bool
+	CookieDomain bool
+	Headers      func() config.ResponseHeaders
+	// BackendTask names the task that answered in X-Backend-Task.
+	BackendTask bool
+}
+
+// Modify rewrites resp, the response to the forwarded request
+// resp.Request.
+func (rw ResponseRewriter) Modify(resp *http.Response) error {
+	b, _ := resp.Request.Context().Value(backendKey{}).(*backend)
+	if b == nil {
+		return nil
+	}
+	if rw.Location {
+		if location := resp.Header.Get("Location"); location != "" {
+			resp.Header.Set("Location", rewriteLocation(location, resp.Request, b.target.PathPrefix))
+		}
+	}
+	if rw.CookieDomain && resp.Request.Host != "" {
+		backendHost, _, _ := net.SplitHostPort(resp.Request.URL.Host)
+		cookies := resp.Header.Values("Set-Cookie")
+		for i, cookie := range cookies {
+			cookies[i] = rewriteCookieDomain(cookie, backendHost, publicHostname(resp.Request.Host))
+		}
+	}
+	if rw.Headers != nil {
+		rw.Headers().Apply(resp.Header, b.org)
+	}
+	if rw.BackendTask && b.task != "" {
+		resp.Header.Set(backendTaskHeader, b.task)
+	}
+	return nil
+}
+
+// rewriteLocation maps a Location given by the backend request was sent to,
+// onto the host the client used: an absolute URL on the backend's address
+// gets the public scheme and host, and the path prefix of the org's target
+// is taken off its path as off the one of a relative URL. Other locations
+// are returned as they are.
+func rewriteLocation(location string, request *http.Request, prefix string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.Host != "" {
+		if !sameHostPort(u, request.URL) || request.Host == "" {
+			return location
+		}
+		u.Scheme = "http"
+		if request.Header.Get("X-Forwarded-Proto") == "https" {
+			u.Scheme = "https"
+		}
+		u.Host = request.Host
+	} else if u.Scheme != "" || !strings.HasPrefix(u.Path, "/") {
+		// another scheme, or a path relative to the request's
+		return location
+	}
+	if prefix != "" && (u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")) {
+		u.Path = strings.TrimPrefix(u.Path, prefix)
+		u.RawPath = ""
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	return u.String()
+}
+
+// sameHostPort reports whether a and b name the same host and port, the
+// port defaulting to the one of their scheme.
+func sameHostPort(a, b *url.URL) bool {
+	port := func(u *url.URL) string {
+		if p := u.Port(); p != "" {
+			return p
+		}
+		if u.Scheme == "https" {
+			return "443"
+		}
+		return "80"
+	}
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && port(a) == port(b)
+}
+
+// publicHostname returns host, a Host header, without its port.
+func publicHostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return host
+}
+
+// rewriteCookieDomain replaces the Domain attribute of a Set-Cookie value
+// when it is backendHost, leaving the rest of it as the backend wrote it.
+func rewriteCookieDomain(cookie, backendHost, publicHost string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts[1:] {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(name, "domain") {
+			continue
+		}
+		if strings.EqualFold(strings.TrimPrefix(value, "."), backendHost) {
+			parts[i+1] = " Domain=" + publicHost
+		}
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// redirectingBackend is a backend answering every request with a redirect
+// to location, setting cookies and the headers that give it away.
+func redirectingBackend(location string, cookies ...string) http.RoundTripper {
+	return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		header := http.Header{
+			"Location":     {location},
+			"Server":       {"gunicorn"},
+			"X-Powered-By": {"Flask"},
+			"Content-Type": {"text/html"},
+			"Set-Cookie":   cookies,
+		}
+		return &http.Response{StatusCode: http.StatusFound, Body: http.NoBody, Header: header, Request: r}, nil
+	})
+}
+
+func TestResponseRewriterLocation(t *testing.T) {
+	service := discovery.ECSService{Name: "acme", IP: "10.0.0.1", Port: 8080}
+	for _, tt := range []struct {
+		name     string
+		target   config.OrgTarget
+		request  string
+		location string
+		want     string
+	}{
+		{name: "absolute on the backend", request: "http://proxy.example.com/orders", location: "http://10.0.0.1:8080/login?next=%2Forders", want: "http://proxy.example.com/login?next=%2Forders"},
+		{name: "public host with a port", request: "http://proxy.example.com:8000/orders", location: "http://10.0.0.1:8080/login", want: "http://proxy.example.com:8000/login"},
+		{name: "client on https", request: "https://proxy.example.com/orders", location: "http://10.0.0.1:8080/login", want: "https://proxy.example.com/login"},
+		{name: "relative", request: "http://proxy.example.com/orders", location: "/login", want: "/login"},
+		{name: "relative to the path", request: "http://proxy.example.com/orders", location: "login", want: "login"},
+		{name: "another host", request: "http://proxy.example.com/orders", location: "https://sso.example.com/auth", want: "https://sso.example.com/auth"},
+		{name: "another port of the backend", request: "http://proxy.example.com/orders", location: "http://10.0.0.1:9090/login", want: "http://10.0.0.1:9090/login"},
+		{name: "https upstream", target: config.OrgTarget{Scheme: "https", Port: 8443}, request: "https://proxy.example.com/orders", location: "https://10.0.0.1:8443/login", want: "https://proxy.example.com/login"},
+		{name: "https upstream on its default port", target: config.OrgTarget{Scheme: "https", Port: 443}, request: "https://proxy.example.com/orders", location: "https://10.0.0.1/login", want: "https://proxy.example.com/login"},
+		{name: "path prefix", target: config.OrgTarget{PathPrefix: "/legacy"}, request: "http://proxy.example.com/orders", location: "/legacy/login", want: "/login"},
+		{name: "path prefix alone", target: config.OrgTarget{PathPrefix: "/legacy"}, request: "http://proxy.example.com/orders", location: "http://10.0.0.1:8080/legacy", want: "http://proxy.example.com/"},
+		{name: "outside the path prefix", target: config.OrgTarget{PathPrefix: "/legacy"}, request: "http://proxy.example.com/orders", location: "/legacyapp", want: "/legacyapp"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, enabled := range []bool{true, false} {
+				forwarder := NewForwarder(redirectingBackend(tt.location), func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{Location: enabled})
+				w := httptest.NewRecorder()
+				forwarder.ServeHTTP(w, withBackend(httptest.NewRequest(http.MethodGet, tt.request, nil), "acme", service, tt.target, nil))
+				want := tt.location
+				if enabled {
+					want = tt.want
+				}
+				if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != want {
+					t.Errorf("rewriting %t: status %d to %q, want %q", enabled, w.Code, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseRewriterCookieDomain(t *testing.T) {
+	service := discovery.ECSService{Name: "acme", IP: "10.0.0.1", Port: 8080}
+	cookies := []string{"sid=1; Domain=10.0.0.1; Path=/; HttpOnly", "seen=1; Domain=.10.0.0.1", "theme=dark; Domain=example.org", "lang=en"}
+	for _, tt := range []struct {
+		enabled bool
+		want    []string
+	}{
+		{enabled: false, want: cookies},
+		{enabled: true, want: []string{"sid=1; Domain=proxy.example.com; Path=/; HttpOnly", "seen=1; Domain=proxy.example.com", "theme=dark; Domain=example.org", "lang=en"}},
+	} {
+		forwarder := NewForwarder(redirectingBackend("/", slices.Clone(cookies)...), func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{CookieDomain: tt.enabled})
+		w := httptest.NewRecorder()
+		forwarder.ServeHTTP(w, withBackend(httptest.NewRequest(http.MethodGet, "http://proxy.example.com:8000/", nil), "acme", service, config.OrgTarget{}, nil))
+		if got := w.Header().Values("Set-Cookie"); !slices.Equal(got, tt.want) {
+			t.Errorf("rewriting %t: Set-Cookie %q, want %q", tt.enabled, got, tt.want)
+		}
+	}
+}
+
+func TestResponseRewriterHeaders(t *testing.T) {
+	cfg, err := config.Load(map[string]string{
+		"ECS_CLUSTER":      "tenants",
+		"RESPONSE_HEADERS": `{"*": {"Server": null, "X-Powered-By": null}, "ACME": {"Strict-Transport-Security": "max-age=63072000", "Server": "acme"}}`,
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewriter := ResponseRewriter{Headers: func() config.ResponseHeaders { return cfg.ResponseHeaders }}
+	forwarder := NewForwarder(redirectingBackend("/"), func(string) {}, func() time.Duration { return time.Second }, rewriter)
+	for _, tt := range []struct {
+		org  string
+		want http.Header
+	}{
+		// the rules of every org strip the headers, those of acme apply
+		// after them
+		{org: "acme", want: http.Header{"Server": {"acme"}, "Strict-Transport-Security": {"max-age=63072000"}}},
+		{org: "globex", want: http.Header{}},
+	} {
+		service := discovery.ECSService{Name: tt.org, IP: "10.0.0.1", Port: 8080}
+		w := httptest.NewRecorder()
+		forwarder.ServeHTTP(w, withBackend(httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil), tt.org, service, config.OrgTarget{}, nil))
+		for _, name := range []string{"Server", "X-Powered-By", "Strict-Transport-Security"} {
+			if got, want := w.Header().Get(name), tt.want.Get(name); got != want {
+				t.Errorf("%s: %s %q, want %q", tt.org, name, got, want)
+			}
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/html" {
+			t.Errorf("%s: Content-Type %q, want the backend's left alone", tt.org, got)
+		}
+	}
+}
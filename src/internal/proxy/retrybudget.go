@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// budgetBuckets is the number of buckets a retry budget window is split in.
+const budgetBuckets = 10
+
+// RetryBudget caps upstream retries per service so a failing backend can't
+// multiply the traffic sent to its service. A retry is only allowed while
+// the retries over the sliding window stay within percent of the original
+// requests. A nil *RetryBudget allows no retries.
+type RetryBudget struct {
+	mu       sync.Mutex
+	percent  int
+	bucket   time.Duration
+	clock    clock.Clock
+	services map[string]*budgetWindow
+}
+
+// budgetWindow counts requests and retries in buckets of the window, each
+// tagged with the period it counts so stale buckets are recognized.
+type budgetWindow struct {
+	buckets [budgetBuckets]budgetBucket
+}
+
+type budgetBucket struct {
+	period            int64
+	requests, retries int
+}
+
+// NewRetryBudget returns a retry budget over window, or nil if percent is
+// zero.
+func NewRetryBudget(percent int, window time.Duration) *RetryBudget {
+	if percent <= 0 {
+		return nil
+	}
+	return &RetryBudget{
+		percent:  percent,
+		bucket:   window / budgetBuckets,
+		clock:    clock.System{},
+		services: map[string]*budgetWindow{},
+	}
+}
+
+// SetClock makes the window slide by clock. It must be called before the
+// budget is shared.
+func (b *RetryBudget) SetClock(clock clock.Clock) {
+	b.clock = clock
+}
+
+// Request records an original request to service.
+func (b *RetryBudget) Request(service string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current(service).requests++
+}
+
+// Withdraw reports whether a request to service may be retried, and records
+// the retry if so.
+func (b *RetryBudget) Withdraw(service string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, retries := b.totals(service)
+	if (retries+1)*100 > requests*b.percent {
+		return false
+	}
+	b.current(service).retries++
+	return true
+}
+
+// Usage returns the share of its budget each service used over the window,
+// in percent. Services without requests in the window are dropped.
+func (b *RetryBudget) Usage() map[string]float64 {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := map[string]float64{}
+	for service := range b.services {
+		requests, retries := b.totals(service)
+		if requests == 0 {
+			delete(b.services, service)
+			continue
+		}
+		usage[service] = float64(retries*100) / float64(requests*b.percent) * 100
+	}
+	return usage
+}
+
+func (b *RetryBudget) period() int64 {
+	return b.clock.Now().UnixNano() / int64(b.bucket)
+}
+
+// current returns the bucket of service counting the current period.
+func (b *RetryBudget) current(service string) *budgetBucket {
+	window, ok := b.services[service]
+	if !ok {
+		window = &budgetWindow{}
+		b.services[service] = window
+	}
+	period := b.period()
+	bucket := &window.buckets[period%budgetBuckets]
+	if bucket.period != period {
+		bucket.period, bucket.requests, bucket.retries = period, 0, 0
+	}
+	return bucket
+}
+
+// totals sums the requests and retries to service within the window.
+func (b *RetryBudget) totals(service string) (requests, retries int) {
+	window, ok := b.services[service]
+	if !ok {
+		return 0, 0
+	}
+	period := b.period()
+	for _, bucket := range window.buckets {
+		if period-bucket.period < budgetBuckets {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return requests, retries
+}
+
+// backendError is the error of the last backend a request was sent to,
+// which isn't the one it was first routed to once it has been retried.
+type backendError struct {
+	Address string
+	Err     error
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Address, e.Err)
+}
+
+func (e *backendError) Unwrap() error {
+	return e.Err
+}
+
+// RetryTransport retries idempotent requests without a body that failed
+// or got a 502, 503 or 504, up to retries times within the budget of their
+// service. Each retry goes to the backend the request's retarget function
+// picks, so a retry usually lands on another task. failed is called with
+// the address of every failed attempt that was retried.
+type RetryTransport struct {
+	Next    http.RoundTripper
+	Retries int
+	Budget  *RetryBudget
+	Failed  func(address string)
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := req.Context().Value(backendKey{}).(*backend)
+	if target == nil || t.Retries == 0 {
+		return t.Next.RoundTrip(req)
+	}
+	t.Budget.Request(target.service)
+	attempt := req
+	for retry := 0; ; retry++ {
+		resp, err := t.Next.RoundTrip(attempt)
+		if err != nil && attempt != req {
+			err = &backendError{Address: discovery.BackendAddress(attempt), Err: err}
+		}
+		if !retriable(req, resp, err) || retry == t.Retries || target.retarget == nil {
+			return resp, err
+		}
+		if !t.Budget.Withdraw(target.service) {
+			telemetry.RetriesBudgetExhausted.Add(1)
+			return resp, err
+		}
+		service, lookupErr := target.retarget()
+		if lookupErr != nil {
+			// nothing to retry on, answer with this attempt's outcome
+			return resp, err
+		}
+		if err != nil {
+			if !errors.Is(err, discovery.ErrBreakerOpen) {
+				t.Failed(discovery.BackendAddress(attempt))
+			}
+		} else {
+			resp.Body.Close()
+		}
+		address := targetHost(target.target, service)
+		slog.DebugContext(req.Context(), "Retrying request", "method", req.Method, "path", req.URL.Path, "backend", address, "failed", discovery.BackendAddress(attempt))
+		telemetry.UpstreamRetries.Add(1)
+		attempt = req.Clone(discovery.WithBackendAddress(req.Context(), service.Address()))
+		attempt.URL.Host = address
+		target.task = discovery.TaskID(service.TaskArn)
+		_, info := withRequestInfo(req)
+		setBackend(req, info.org, address, service.TaskArn)
+	}
+}
+
+// retriable reports whether the outcome of a request is worth another
+// attempt. Only idempotent requests without a body can be replayed.
+func retriable(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	if err != nil {
+		// the client went away
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// failureWave is a RetryTransport over backends answering 503 to the
+// services in failing, with a retry budget telling the time with clock.
+type failureWave struct {
+	*RetryTransport
+	clock *clocktest.Clock
+
+	mu       sync.Mutex
+	failing  map[string]bool
+	attempts map[string]int
+}
+
+func newFailureWave(percent, retries int) *failureWave {
+	w := &failureWave{clock: clocktest.New(), failing: map[string]bool{}, attempts: map[string]int{}}
+	budget := NewRetryBudget(percent, 10*time.Second)
+	budget.SetClock(w.clock)
+	w.RetryTransport = &RetryTransport{
+		Next: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			service := r.Context().Value(backendKey{}).(*backend).service
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.attempts[service]++
+			status := http.StatusOK
+			if w.failing[service] {
+				status = http.StatusServiceUnavailable
+			}
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}, Request: r}, nil
+		}),
+		Retries: retries,
+		Budget:  budget,
+		Failed:  func(string) {},
+	}
+	return w
+}
+
+// send sends a GET to service and returns its status.
+func (w *failureWave) send(t *testing.T, service string) int {
+	t.Helper()
+	task := discovery.ECSService{Name: service, IP: "10.0.0.1", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", service+"-1")}
+	retarget := func() (discovery.ECSService, error) {
+		return discovery.ECSService{Name: service, IP: "10.0.0.2", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", service+"-2")}, nil
+	}
+	r := withBackend(httptest.NewRequest(http.MethodGet, "http://10.0.0.1:8080/", nil), service, task, config.OrgTarget{}, retarget)
+	resp, err := w.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// attempted returns and resets the number of attempts sent to service.
+func (w *failureWave) attempted(service string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.attempts[service]
+	w.attempts[service] = 0
+	return n
+}
+
+func TestRetryBudgetFailureWave(t *testing.T) {
+	wave := newFailureWave(20, 2)
+	wave.failing["acme"] = true
+
+	exhausted := telemetry.RetriesBudgetExhausted.Value()
+	for i := 0; i < 100; i++ {
+		if status := wave.send(t, "acme"); status != http.StatusServiceUnavailable {
+			t.Fatalf("status %d", status)
+		}
+	}
+	// without a budget the 100 requests would have been sent 300 times
+	if n := wave.attempted("acme"); n != 120 {
+		t.Errorf("%d attempts for 100 requests, want 120 with retries clamped to 20%%", n)
+	}
+	if n := telemetry.RetriesBudgetExhausted.Value() - exhausted; n < 80 {
+		t.Errorf("%d requests failed with the budget exhausted, want at least 80", n)
+	}
+	if usage := wave.Budget.Usage()["acme"]; usage != 100 {
+		t.Errorf("acme used %v%% of its budget, want 100", usage)
+	}
+
+	// another service's budget is untouched
+	wave.failing["globex"] = true
+	wave.send(t, "globex")
+	if n := wave.attempted("globex"); n != 1 {
+		t.Errorf("%d attempts for a first request to globex, want 1 as it has no budget yet", n)
+	}
+	for i := 0; i < 9; i++ {
+		wave.send(t, "globex")
+	}
+	if n := wave.attempted("globex"); n != 11 {
+		t.Errorf("%d attempts for 9 more requests to globex, want 11", n)
+	}
+
+	// the wave still going, acme gets no retries until its window slides
+	wave.send(t, "acme")
+	if n := wave.attempted("acme"); n != 1 {
+		t.Errorf("%d attempts with the budget exhausted, want 1", n)
+	}
+	wave.clock.Advance(11 * time.Second)
+	for i := 0; i < 10; i++ {
+		wave.send(t, "acme")
+	}
+	if n := wave.attempted("acme"); n != 12 {
+		t.Errorf("%d attempts for 10 requests after the window slid, want 12", n)
+	}
+}
+
+func TestRetryBudgetRecovery(t *testing.T) {
+	wave := newFailureWave(20, 2)
+	for i := 0; i < 50; i++ {
+		wave.send(t, "acme")
+	}
+	// a backend failing after healthy traffic is retried within the
+	// budget the healthy requests earned
+	wave.failing["acme"] = true
+	if status := wave.send(t, "acme"); status != http.StatusServiceUnavailable {
+		t.Fatalf("status %d", status)
+	}
+	if n := wave.attempted("acme"); n != 53 {
+		t.Errorf("%d attempts, want 50 and 3 for the failing request", n)
+	}
+	wave.failing["acme"] = false
+	if status := wave.send(t, "acme"); status != http.StatusOK {
+		t.Errorf("status %d after recovering", status)
+	}
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net/http"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/gorilla/mux"
+)
+
+// NewRouter routes the tenant-facing listener. The health checks don't carry
+// the org header and must never be routed, the metrics are served only when
+// there is no admin listener, and every other path goes to proxied, the org
+// header alone picking the backend. The other operator endpoints are only
+// served by NewAdminHandler.
+func NewRouter(cfg config.Config, ready http.Handler, proxied http.Handler) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc(cfg.HealthzPath, Healthz).Methods(http.MethodGet, http.MethodHead)
+	r.Handle(cfg.ReadyzPath, ready).Methods(http.MethodGet, http.MethodHead)
+	if cfg.AdminAddr == "" {
+		r.Handle(cfg.MetricsPath, telemetry.MetricsHandler()).Methods(http.MethodGet)
+	}
+	r.PathPrefix("/").Handler(proxied)
+	return r
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestRouterOperatorEndpoints(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		admin string
+		// metrics is whether the tenant listener serves the metrics.
+		metrics bool
+	}{
+		{name: "without an admin listener", metrics: true},
+		{name: "with an admin listener", admin: "127.0.0.1:9901"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := discoverytest.NewECS()
+			fake.AddService("tenants", "acme")
+			fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+			proxy := newTestProxy(t, fake, map[string]string{"ADMIN_ADDR": tt.admin})
+			router := NewRouter(proxy.Config, http.HandlerFunc(Healthz), proxy.Handler)
+			get := func(path, org string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com"+path, nil)
+				if org != "" {
+					r.Header.Set("X-Org-ID", org)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				return w
+			}
+
+			// the expvar counters are never served to tenants, the path is
+			// routed like any other
+			if w := get("/debug/vars", "initech"); w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "memstats") {
+				t.Errorf("/debug/vars for an unknown org: status %d: %.100s", w.Code, w.Body)
+			}
+			if w := get("/debug/vars", ""); strings.Contains(w.Body.String(), "memstats") {
+				t.Errorf("/debug/vars without an org header served the expvar counters")
+			}
+			if w := get("/debug/vars", "acme"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://10.0.0.1:80/debug/vars" {
+				t.Errorf("/debug/vars for acme: status %d to %q, want it routed", w.Code, w.Header().Get("Location"))
+			}
+
+			w := get(proxy.Config.MetricsPath, "")
+			if served := w.Code == http.StatusOK && strings.Contains(w.Body.String(), "# TYPE"); served != tt.metrics {
+				t.Errorf("%s: status %d, served %t, want %t", proxy.Config.MetricsPath, w.Code, served, tt.metrics)
+			}
+		})
+	}
+}
+
+func TestRouterAdminPaths(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	for _, admin := range []string{"", "127.0.0.1:9901"} {
+		flags := map[string]string{"ADMIN_ADDR": admin}
+		if admin != "" {
+			flags["ENABLE_PPROF"] = "true"
+		}
+		proxy := newTestProxy(t, fake, flags)
+		router := NewRouter(proxy.Config, http.HandlerFunc(Healthz), proxy.Handler)
+		for _, tt := range []struct{ method, path string }{
+			{http.MethodGet, "/debug/routes"},
+			{http.MethodGet, "/debug/pprof/"},
+			{http.MethodGet, "/version"},
+			{http.MethodGet, "/healthz/deep"},
+			{http.MethodGet, "/admin/backends"},
+			{http.MethodGet, "/admin/export"},
+			{http.MethodPost, "/admin/refresh"},
+			{http.MethodPut, "/admin/overrides/acme"},
+			{http.MethodPost, "/admin/maintenance/acme"},
+			{http.MethodPost, "/admin/import"},
+		} {
+			// the operator endpoints are routed like any path, to the org's
+			// backend
+			listed := fake.Count("ListServices")
+			r := httptest.NewRequest(tt.method, "http://proxy.example.com"+tt.path, nil)
+			r.Header.Set("X-Org-ID", "acme")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://10.0.0.1:80"+tt.path {
+				t.Errorf("ADMIN_ADDR %q: %s %s for acme: status %d to %q, want it routed", admin, tt.method, tt.path, w.Code, w.Header().Get("Location"))
+			}
+			// and without an org header they are rejected, not served
+			r = httptest.NewRequest(tt.method, "http://proxy.example.com"+tt.path, nil)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("ADMIN_ADDR %q: %s %s without an org: status %d: %.100s", admin, tt.method, tt.path, w.Code, w.Body)
+			}
+			if n := fake.Count("ListServices") - listed; n != 0 {
+				t.Errorf("ADMIN_ADDR %q: %s %s refreshed the routes %d times", admin, tt.method, tt.path, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// hstsHeader is only set on responses served over TLS, browsers ignore it
+// on plain HTTP.
+const hstsHeader = "Strict-Transport-Security"
+
+// WithSecurityHeaders sets headers on the responses of next, the ones the
+// proxy writes itself and the ones it forwards.
+func WithSecurityHeaders(next http.Handler, headers []config.SecurityHeader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&securityHeaderWriter{ResponseWriter: w, headers: headers, tls: r.TLS != nil}, r)
+	})
+}
+
+// securityHeaderWriter sets its headers when the final response header is
+// written, once a forwarded response has copied the backend's.
+type securityHeaderWriter struct {
+	http.ResponseWriter
+	headers     []config.SecurityHeader
+	tls         bool
+	wroteHeader bool
+}
+
+func (w *securityHeaderWriter) WriteHeader(status int) {
+	// informational responses come before the backend's headers
+	if !w.wroteHeader && status >= http.StatusOK {
+		w.setHeaders()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *securityHeaderWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.setHeaders()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *securityHeaderWriter) setHeaders() {
+	w.wroteHeader = true
+	header := w.Header()
+	for _, h := range w.headers {
+		if h.Name == hstsHeader && !w.tls {
+			continue
+		}
+		if h.Override || header.Get(h.Name) == "" {
+			header.Set(h.Name, h.Value)
+		}
+	}
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection.
+func (w *securityHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+func TestWithSecurityHeaders(t *testing.T) {
+	cfg, err := config.Load(map[string]string{
+		"ECS_CLUSTER": "tenants",
+		"SECURITY_HEADERS": `{
+			"strict-transport-security": "max-age=63072000; includeSubDomains",
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options": {"value": "DENY", "override": true},
+			"Referrer-Policy": "no-referrer"
+		}`,
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the backend sets headers of its own, one of them overridden
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		header := http.Header{"X-Frame-Options": {"SAMEORIGIN"}, "Referrer-Policy": {"same-origin"}}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Header: header, Request: r}, nil
+	})
+	forwarder := NewForwarder(transport, func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{})
+	handler := WithSecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			writeError(w, r, http.StatusNotFound, errCodeUnknownOrg, "Service not found for Org-ID")
+		case "/body":
+			// a body written without a status
+			io.WriteString(w, "ok")
+		default:
+			forwarder.ServeHTTP(w, withBackend(r, "acme", discovery.ECSService{Name: "acme", IP: "10.0.0.1", Port: 8080}, config.OrgTarget{}, nil))
+		}
+	}), cfg.SecurityHeaders)
+
+	for _, tt := range []struct {
+		name string
+		url  string
+		want map[string]string
+	}{
+		{name: "error of the proxy", url: "http://proxy.example.com/error", want: map[string]string{
+			"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer", hstsHeader: "",
+		}},
+		{name: "body without a status", url: "http://proxy.example.com/body", want: map[string]string{
+			"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer",
+		}},
+		// HSTS only goes over TLS
+		{name: "error over TLS", url: "https://proxy.example.com/error", want: map[string]string{
+			hstsHeader: "max-age=63072000; includeSubDomains", "X-Content-Type-Options": "nosniff",
+		}},
+		// the backend's headers are kept unless overridden
+		{name: "forwarded", url: "https://proxy.example.com/orders", want: map[string]string{
+			"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Referrer-Policy": "same-origin", hstsHeader: "max-age=63072000; includeSubDomains",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			for name, want := range tt.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
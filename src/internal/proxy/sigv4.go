@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/clock"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/aws/smithy-go"
+	"golang.org/x/sync/singleflight"
+)
+
+// sigv4AudienceHeader is the header a presigned request must have signed
+// with Config.SigV4Audience, so one presigned for another service can't be
+// replayed against the proxy.
+const sigv4AudienceHeader = "X-Ecs-Svc-Proxy-Audience"
+
+// sigv4MaxExpires is the longest validity a presigned request may ask for,
+// and the one of requests that don't say.
+const sigv4MaxExpires = 15 * time.Minute
+
+// sigv4CacheSize bounds the verified requests kept, expired ones are
+// dropped first once it is reached.
+const sigv4CacheSize = 10000
+
+// stsHost matches the global and regional STS endpoints, the only ones a
+// presigned request is sent to.
+var stsHost = regexp.MustCompile(`^sts(\.[a-z0-9-]+)?\.amazonaws\.com(\.cn)?$`)
+
+var (
+	errMissingSignature = errors.New("missing signature")
+	errSignatureExpired = errors.New("signature expired")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// SigV4Verifier resolves the IAM principal of a caller from an STS
+// GetCallerIdentity request the caller presigned. Only the caller and AWS
+// hold the secret a SigV4 signature is computed with, so STS checks the
+// signature; the verifier checks the request is one to STS, for the
+// caller's identity, and current, before sending it. Principals are cached
+// by presigned request until it expires.
+type SigV4Verifier struct {
+	audience string
+	skew     time.Duration
+	client   *http.Client
+	clock    clock.Clock
+	group    singleflight.Group
+
+	mu    sync.Mutex
+	cache map[string]sigv4Principal
+}
+
+type sigv4Principal struct {
+	arn     string
+	expires time.Time
+}
+
+// NewSigV4Verifier returns a verifier of presigned requests for audience,
+// tolerating skew on their signing time.
+func NewSigV4Verifier(audience string, skew time.Duration) *SigV4Verifier {
+	return &SigV4Verifier{
+		audience: audience,
+		skew:     skew,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			// a presigned request must not lead anywhere but STS
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		clock: clock.System{},
+		cache: map[string]sigv4Principal{},
+	}
+}
+
+// SetClock makes the signing times and the cached principals checked by
+// clock. It must be called before the verifier is shared.
+func (v *SigV4Verifier) SetClock(clock clock.Clock) {
+	v.clock = clock
+}
+
+// Verify returns the principal that presigned token, a GetCallerIdentity
+// URL. It fails with errMissingSignature, errSignatureExpired or
+// errInvalidSignature when the caller is at fault, and with another error
+// when STS couldn't be asked.
+func (v *SigV4Verifier) Verify(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", errMissingSignature
+	}
+	u, err := url.Parse(token)
+	if err != nil || u.Scheme != "https" || !stsHost.MatchString(u.Host) || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("%w: not an STS URL", errInvalidSignature)
+	}
+	query := u.Query()
+	if query.Get("Action") != "GetCallerIdentity" || query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" || query.Get("X-Amz-Signature") == "" {
+		return "", fmt.Errorf("%w: not a presigned GetCallerIdentity request", errInvalidSignature)
+	}
+	signed, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid X-Amz-Date", errInvalidSignature)
+	}
+	// the SDKs leave X-Amz-Expires out, STS then takes the maximum
+	validity := sigv4MaxExpires
+	if value := query.Get("X-Amz-Expires"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > sigv4MaxExpires {
+			return "", fmt.Errorf("%w: X-Amz-Expires must be at most %s", errInvalidSignature, sigv4MaxExpires)
+		}
+		validity = time.Duration(seconds) * time.Second
+	}
+	now := v.clock.Now()
+	expires := signed.Add(validity + v.skew)
+	if now.Before(signed.Add(-v.skew)) || now.After(expires) {
+		return "", errSignatureExpired
+	}
+	if v.audience != "" && !slices.Contains(strings.Split(query.Get("X-Amz-SignedHeaders"), ";"), strings.ToLower(sigv4AudienceHeader)) {
+		return "", fmt.Errorf("%w: %s is not signed", errInvalidSignature, sigv4AudienceHeader)
+	}
+
+	v.mu.Lock()
+	cached, ok := v.cache[token]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.arn, nil
+	}
+	// callers presigning once share the call, which must outlive the first
+	// of them giving up; each waits on its own context instead
+	identity := v.group.DoChan(token, func() (any, error) {
+		return v.callerIdentity(context.WithoutCancel(ctx), u)
+	})
+	var result singleflight.Result
+	select {
+	case result = <-identity:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if result.Err != nil {
+		return "", result.Err
+	}
+	principal := principalARN(result.Val.(string))
+	v.store(token, sigv4Principal{arn: principal, expires: expires})
+	return principal, nil
+}
+
+// store caches principal under token, making room when the cache is full.
+func (v *SigV4Verifier) store(token string, principal sigv4Principal) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= sigv4CacheSize {
+		now := v.clock.Now()
+		for key, cached := range v.cache {
+			if now.After(cached.expires) {
+				delete(v.cache, key)
+			}
+		}
+		// still full of current requests, start over rather than grow
+		if len(v.cache) >= sigv4CacheSize {
+			clear(v.cache)
+		}
+	}
+	v.cache[token] = principal
+}
+
+// callerIdentityResponse is the JSON answer of GetCallerIdentity.
+type callerIdentityResponse struct {
+	GetCallerIdentityResponse struct {
+		GetCallerIdentityResult struct {
+			Arn string
+		}
+	}
+}
+
+// stsErrorResponse is the JSON answer of STS to a call that failed.
+type stsErrorResponse struct {
+	Error struct {
+		Code    string
+		Message string
+	}
+}
+
+// callerIdentity sends the presigned request u to STS and returns the ARN
+// of the caller. The call is recorded like those of the SDK's clients.
+func (v *SigV4Verifier) callerIdentity(ctx context.Context, u *url.URL) (arn string, err error) {
+	start := time.Now()
+	defer func() { discovery.ObserveAWSCall("sts", "GetCallerIdentity", start, err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidSignature, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if v.audience != "" {
+		req.Header.Set(sigv4AudienceHeader, v.audience)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		return "", fmt.Errorf("STS answered %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		var failure stsErrorResponse
+		json.Unmarshal(body, &failure)
+		apiErr := &smithy.GenericAPIError{Code: failure.Error.Code, Message: failure.Error.Message}
+		if discovery.IsThrottle(apiErr) {
+			// STS being busy is no fault of the caller
+			return "", fmt.Errorf("STS answered %s: %w", resp.Status, apiErr)
+		}
+		// a bad signature, an expired or revoked session
+		return "", fmt.Errorf("%w: STS answered %s", errInvalidSignature, resp.Status)
+	}
+	var identity callerIdentityResponse
+	if err := json.Unmarshal(body, &identity); err != nil {
+		return "", fmt.Errorf("decoding the caller identity: %w", err)
+	}
+	arn = identity.GetCallerIdentityResponse.GetCallerIdentityResult.Arn
+	if arn == "" {
+		return "", errors.New("STS answered without a caller ARN")
+	}
+	return arn, nil
+}
+
+// principalARN returns the principal of the caller arn names, the role for
+// an assumed role session. STS doesn't return the path of the role, so the
+// role ARN has none.
+func principalARN(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) == 6 && parts[2] == "sts" {
+		if session, ok := strings.CutPrefix(parts[5], "assumed-role/"); ok {
+			role, _, _ := strings.Cut(session, "/")
+			return fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], parts[4], role)
+		}
+	}
+	return arn
+}
+
+type sigv4PrincipalKey struct{}
+
+// sigv4PrincipalFrom returns the principal stored in ctx by RequireSigV4,
+// empty if the request wasn't verified.
+func sigv4PrincipalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(sigv4PrincipalKey{}).(string)
+	return principal
+}
+
+// RequireSigV4 answers requests without a valid presigned request in
+// header with a 403 before next sees them, and stores the principal of
+// valid ones on the request context. The header is removed before next.
+func RequireSigV4(next http.Handler, verifier *SigV4Verifier, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := verifier.Verify(r.Context(), r.Header.Get(header))
+		if err == nil {
+			r.Header.Del(header)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sigv4PrincipalKey{}, principal)))
+			return
+		}
+		code, message := errCodeInvalidSignature, "Invalid SigV4 signature"
+		switch {
+		case errors.Is(err, errMissingSignature):
+			code, message = errCodeMissingSignature, "Missing SigV4 signature"
+		case errors.Is(err, errSignatureExpired):
+			code, message = errCodeSignatureExpired, "SigV4 signature expired or not yet valid"
+		case !errors.Is(err, errInvalidSignature):
+			slog.ErrorContext(r.Context(), "Failed to verify a SigV4 signature with STS", "error", err)
+			setOutcome(r, telemetry.OutcomeAuthUnavailable)
+			writeUnavailable(w, r, time.Second, errCodeSTSUnavailable, "Could not verify the signature")
+			return
+		}
+		source := clientIP(r)
+		if telemetry.LogSamples.Allow(r.Context(), slog.LevelWarn, "Rejected SigV4 signature", source) {
+			slog.WarnContext(r.Context(), "Rejected SigV4 signature", "source", source, "reason", code, "error", err)
+		}
+		setOutcome(r, telemetry.OutcomeForbidden)
+		writeError(w, r, http.StatusForbidden, code, message)
+	})
+}
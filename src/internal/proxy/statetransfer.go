@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// stateVersion is the schema version of the routing state documents, bumped
+// on changes older proxies couldn't import.
+const stateVersion = 1
+
+// routingState is the routing state of a proxy as served by GET
+// /admin/export and taken by POST /admin/import. Services are the discovered
+// routes, exported to reproduce a routing but never imported: discovery owns
+// them. The maintenance windows of both sources are exported, only the admin
+// ones are imported.
+type routingState struct {
+	Version     int                        `json:"version"`
+	BuiltAt     *time.Time                 `json:"built_at"`
+	Services    []discovery.ECSService     `json:"services"`
+	Overrides   []discovery.RouteOverride  `json:"overrides"`
+	Maintenance []config.MaintenanceWindow `json:"maintenance"`
+	Drains      []discovery.BackendDrain   `json:"drains"`
+}
+
+// stateTransfer exports and imports the routing state. Imports are
+// serialized so two can't interleave.
+type stateTransfer struct {
+	routes      *discovery.RouteTable
+	overrides   *discovery.RouteOverrides
+	maintenance *MaintenanceWindows
+
+	importMu sync.Mutex
+}
+
+// Export returns the routing state.
+func (s *stateTransfer) Export() routingState {
+	state := routingState{
+		Version:     stateVersion,
+		Services:    s.routes.Services(),
+		Overrides:   s.overrides.List(),
+		Maintenance: s.maintenance.List(),
+		Drains:      s.routes.Drained.List(),
+	}
+	if builtAt := s.routes.BuiltAt(); !builtAt.IsZero() {
+		state.BuiltAt = &builtAt
+	}
+	if state.Services == nil {
+		state.Services = []discovery.ECSService{}
+	}
+	if state.Overrides == nil {
+		state.Overrides = []discovery.RouteOverride{}
+	}
+	return state
+}
+
+// Import replaces the overrides, the admin maintenance windows and the
+// drains with those of state, leaving the discovered routes alone. The
+// whole document is validated first: if any part is invalid nothing is
+// applied.
+func (s *stateTransfer) Import(state routingState, caller string) error {
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported version %d, expected %d", state.Version, stateVersion)
+	}
+	if err := s.overrides.Validate(state.Overrides); err != nil {
+		return err
+	}
+	if err := validateMaintenance(state.Maintenance); err != nil {
+		return err
+	}
+	if err := discovery.ValidateDrains(state.Drains); err != nil {
+		return err
+	}
+	s.importMu.Lock()
+	defer s.importMu.Unlock()
+	s.overrides.Replace(state.Overrides, caller)
+	s.maintenance.ReplaceAdmin(state.Maintenance, caller)
+	s.routes.Drained.Replace(state.Drains, caller)
+	slog.Info("Routing state imported", "audit", true, "overrides", len(state.Overrides), "maintenance", len(state.Maintenance), "drains", len(state.Drains), "caller", caller)
+	return nil
+}
+
+// exportHandler serves the routing state on GET. It exposes private
+// addresses like /debug/routes.
+func exportHandler(transfer *stateTransfer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET is allowed")
+			return
+		}
+		state := transfer.Export()
+		slog.Info("Routing state exported", "audit", true, "services", len(state.Services), "caller", adminSource(r))
+		writeJSON(w, http.StatusOK, state)
+	})
+}
+
+// importHandler applies the routing state in the body of a POST, as
+// exported by GET /admin/export, and answers with the state that results.
+func importHandler(transfer *stateTransfer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST is allowed")
+			return
+		}
+		var state routingState
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&state); err != nil {
+			writeError(w, r, http.StatusBadRequest, errCodeInvalidImport, "Body must be a routing state exported by /admin/export: "+err.Error())
+			return
+		}
+		if err := transfer.Import(state, adminSource(r)); err != nil {
+			writeError(w, r, http.StatusBadRequest, errCodeInvalidImport, "Invalid routing state, nothing was imported: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, transfer.Export())
+	})
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+// newTransferProxy returns a proxy of acme's two tasks and globex's one.
+func newTransferProxy(t *testing.T) *testProxy {
+	t.Helper()
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	return newTestProxy(t, fake, map[string]string{"MAINTENANCE": `{"initech": {"message": "Configured"}}`})
+}
+
+// exported returns the routing state admin exports.
+func exported(t *testing.T, admin http.Handler) routingState {
+	t.Helper()
+	w := adminDo(admin, http.MethodGet, "/admin/export", "s3cret", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status %d: %s", w.Code, w.Body)
+	}
+	var state routingState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestStateTransferRoundTrip(t *testing.T) {
+	source := newTransferProxy(t)
+	admin := source.admin("s3cret")
+	for _, change := range []struct{ method, path, body string }{
+		{http.MethodPut, "/admin/overrides/globex", `{"target": "10.9.9.9:8080", "ttl": "1h"}`},
+		{http.MethodPost, "/admin/maintenance/acme", `{"message": "Migrating", "retry_after": "5m"}`},
+		{http.MethodPost, "/admin/backends/10.0.0.2/drain", ""},
+	} {
+		if w := adminDo(admin, change.method, change.path, "s3cret", change.body); w.Code >= 300 {
+			t.Fatalf("%s %s: status %d: %s", change.method, change.path, w.Code, w.Body)
+		}
+	}
+	state := exported(t, admin)
+	if state.Version != stateVersion || len(state.Services) != 3 || len(state.Overrides) != 1 || len(state.Maintenance) != 2 || len(state.Drains) != 1 {
+		t.Fatalf("exported %+v", state)
+	}
+	body, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh proxy ends up with the same overrides, admin windows and
+	// drains, and routes accordingly
+	target := newTransferProxy(t)
+	targetAdmin := target.admin("s3cret")
+	if w := adminDo(targetAdmin, http.MethodPost, "/admin/import", "s3cret", string(body)); w.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", w.Code, w.Body)
+	}
+	imported := exported(t, targetAdmin)
+	for name, pair := range map[string][2]any{
+		"services":    {state.Services, imported.Services},
+		"overrides":   {state.Overrides, imported.Overrides},
+		"maintenance": {state.Maintenance, imported.Maintenance},
+		"drains":      {state.Drains, imported.Drains},
+	} {
+		if !reflect.DeepEqual(pair[0], pair[1]) {
+			t.Errorf("%s exported %+v, imported %+v", name, pair[0], pair[1])
+		}
+	}
+	if w := target.get("/orders", "globex"); w.Header().Get("Location") != "http://10.9.9.9:8080/orders" {
+		t.Errorf("globex routed to %q, want its imported override", w.Header().Get("Location"))
+	}
+	if w := target.get("/orders", "acme"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Migrating") {
+		t.Errorf("acme: status %d, want its imported maintenance window", w.Code)
+	}
+	// lifting it shows the drain was imported
+	adminDo(targetAdmin, http.MethodDelete, "/admin/maintenance/acme", "s3cret", "")
+	for i := 0; i < 5; i++ {
+		if w := target.get("/orders", "acme"); w.Header().Get("Location") != "http://10.0.0.1:80/orders" {
+			t.Fatalf("acme routed to %q, want the task that isn't drained", w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestStateTransferRejectsMalformed(t *testing.T) {
+	proxy := newTransferProxy(t)
+	admin := proxy.admin("s3cret")
+	adminDo(admin, http.MethodPut, "/admin/overrides/globex", "s3cret", `{"target": "10.9.9.9:8080"}`)
+	before := exported(t, admin)
+
+	for _, tt := range []struct{ name, body string }{
+		{name: "not JSON", body: `routes: all`},
+		{name: "truncated", body: `{"version": 1, "overrides": [`},
+		{name: "unknown field", body: `{"version": 1, "routes": []}`},
+		{name: "other version", body: `{"version": 2}`},
+		{name: "public override", body: `{"version": 1, "overrides": [{"org": "acme", "target": "8.8.8.8:80"}]}`},
+		{name: "duplicate window", body: `{"version": 1, "maintenance": [{"org": "acme", "source": "admin"}, {"org": "ACME", "source": "admin"}]}`},
+		{name: "invalid drain", body: `{"version": 1, "drains": [{"ip": "10.0.0"}]}`},
+		// a valid part isn't applied when another is invalid
+		{name: "partly valid", body: `{"version": 1, "overrides": [], "drains": [{"ip": "::ffff:10.0.0.1"}]}`},
+	} {
+		w := adminDo(admin, http.MethodPost, "/admin/import", "s3cret", tt.body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"`+errCodeInvalidImport+`"`) {
+			t.Errorf("%s: status %d: %s", tt.name, w.Code, w.Body)
+		}
+	}
+	if after := exported(t, admin); !reflect.DeepEqual(after, before) {
+		t.Errorf("state changed by rejected imports: %+v, was %+v", after, before)
+	}
+	if w := adminDo(admin, http.MethodGet, "/admin/import", "s3cret", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/import: status %d", w.Code)
+	}
+	if w := adminDo(admin, http.MethodGet, "/export", "s3cret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("/export outside /admin/: status %d", w.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+)
+
+// targetHost returns the host:port the requests target sends to service
+// go to.
+func targetHost(target config.OrgTarget, service discovery.ECSService) string {
+	if target.Port == 0 {
+		return service.Address()
+	}
+	return net.JoinHostPort(service.IP, strconv.Itoa(target.Port))
+}
+
+// targetURL returns the URL of service that request paths are appended to
+// for target. IPv6 addresses are bracketed.
+func targetURL(target config.OrgTarget, service discovery.ECSService) *url.URL {
+	scheme := target.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return &url.URL{Scheme: scheme, Host: targetHost(target, service), Path: target.PathPrefix}
+}
+
+// resolveTarget returns the URL request goes to on service for target, its
+// path appended to the prefix without doubling the slash and its query
+// kept.
+func resolveTarget(target config.OrgTarget, service discovery.ECSService, request *url.URL) string {
+	u := targetURL(target, service)
+	u.Path += "/" + strings.TrimPrefix(request.Path, "/")
+	if request.RawPath != "" {
+		u.RawPath = target.PathPrefix + "/" + strings.TrimPrefix(request.RawPath, "/")
+	}
+	// a # the client sent raw is part of the query, not a fragment
+	u.RawQuery = strings.ReplaceAll(request.RawQuery, "#", "%23")
+	return u.String()
+}
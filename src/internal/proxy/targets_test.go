@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestOrgTargetResolve(t *testing.T) {
+	ipv4 := discovery.ECSService{IP: "10.0.0.1", Port: 8080}
+	ipv6 := discovery.ECSService{IP: "2600:1f14:abc::1", Port: 8080}
+	for _, tt := range []struct {
+		target  config.OrgTarget
+		service discovery.ECSService
+		request string
+		want    string
+	}{
+		{service: ipv4, request: "/orders?id=1", want: "http://10.0.0.1:8080/orders?id=1"},
+		{service: ipv6, request: "/orders?id=1", want: "http://[2600:1f14:abc::1]:8080/orders?id=1"},
+		{target: config.OrgTarget{Scheme: "https", Port: 8443}, service: ipv6, request: "/", want: "https://[2600:1f14:abc::1]:8443/"},
+		{target: config.OrgTarget{PathPrefix: "/legacy"}, service: ipv6, request: "/a%2Fb", want: "http://[2600:1f14:abc::1]:8080/legacy/a%2Fb"},
+		{target: config.OrgTarget{PathPrefix: "/legacy"}, service: ipv4, request: "", want: "http://10.0.0.1:8080/legacy/"},
+	} {
+		request, err := url.Parse(tt.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resolveTarget(tt.target, tt.service, request); got != tt.want {
+			t.Errorf("resolve(%s, %q) = %s, want %s", tt.service.IP, tt.request, got, tt.want)
+		}
+	}
+}
+
+func TestForwardIPv6(t *testing.T) {
+	var sent *url.URL
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent = r.URL
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Header: http.Header{}, Request: r}, nil
+	})
+	forwarder := NewForwarder(transport, func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{})
+
+	service := discovery.ECSService{Name: "acme", IP: "2600:1f14:abc::1", Port: 8080, TaskArn: discoverytest.TaskARN("tenants", "a1")}
+	r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders?id=1", nil)
+	w := httptest.NewRecorder()
+	forwarder.ServeHTTP(w, withBackend(r, "acme", service, config.OrgTarget{}, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if sent == nil || sent.String() != "http://[2600:1f14:abc::1]:8080/orders?id=1" {
+		t.Errorf("forwarded to %v", sent)
+	}
+}
+
+func TestPortOverrideBreaker(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"), discoverytest.Task("tenants", "acme", "a2", "10.0.0.2"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": "forward", "ORG_TARGETS": "acme||9000|"})
+	proxy.Routes.SetBreakers(2, time.Minute)
+	var mu sync.Mutex
+	sent := map[string]int{}
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		sent[r.URL.Host]++
+		mu.Unlock()
+		if r.URL.Hostname() == "10.0.0.1" {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(&discovery.BreakerTransport{Next: transport, Breakers: proxy.Routes.Breakers}, proxy.Routes.ReportFailure, proxy.Live.RetryAfter, ResponseRewriter{})
+
+	// round-robin sends every other request to the failing task until its
+	// breaker, kept under the task's address rather than the overridden
+	// port, opens
+	for i := 0; i < 4; i++ {
+		proxy.get("/orders", "acme")
+	}
+	if !proxy.Routes.Breakers.Open("10.0.0.1:80") {
+		t.Fatal("breaker of the failing task isn't open under its address")
+	}
+	for i := 0; i < 10; i++ {
+		if w := proxy.get("/orders", "acme"); w.Code != http.StatusOK {
+			t.Fatalf("request %d after the breaker opened: status %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if sent["10.0.0.1:9000"] != 2 || sent["10.0.0.2:9000"] != 12 || len(sent) != 2 {
+		t.Errorf("sent %v, want the failing task skipped once its breaker opened", sent)
+	}
+}
+
+func FuzzOrgTargetResolve(f *testing.F) {
+	for _, seed := range []struct{ entry, uri string }{
+		{"acme||||", "/orders?id=1"},
+		{"acme|https|8443|/legacy", "/orders/%2F..%2Fadmin?q=a%20b"},
+		{"acme|||/prefix/", "//evil.example.com/path"},
+		{"acme|||/präfix", "/ünïcode/路径?x=ü"},
+		{"acme|||/a%2Fb", "/%0d%0aX-Injected:%201"},
+		{"acme|||", "/" + strings.Repeat("a/", 2000)},
+		{"acme|http|80|/x?y#z", "/p?q#frag"},
+	} {
+		f.Add(seed.entry, seed.uri)
+	}
+	services := []discovery.ECSService{{IP: "10.0.0.1", Port: 8080}, {IP: "2600:1f14:abc::1", Port: 8080}}
+	f.Fuzz(func(t *testing.T, entry, uri string) {
+		targets, err := config.ParseOrgTargets(entry)
+		if err != nil || len(targets) != 1 {
+			return
+		}
+		request, err := url.ParseRequestURI(uri)
+		if err != nil {
+			return
+		}
+		for _, target := range targets {
+			for _, svc := range services {
+				resolved := resolveTarget(target, svc, request)
+				u, err := url.Parse(resolved)
+				if err != nil {
+					t.Fatalf("%+v resolved %q to %q, which doesn't parse: %v", target, uri, resolved, err)
+				}
+				// the request can't change where it goes
+				if u.Host != targetHost(target, svc) || u.Hostname() != svc.IP || u.Fragment != "" {
+					t.Errorf("%+v resolved %q to %q, host %q fragment %q", target, uri, resolved, u.Host, u.Fragment)
+				}
+				// and keeps its query, escaped
+				if strings.ReplaceAll(u.RawQuery, "%23", "#") != strings.ReplaceAll(request.RawQuery, "%23", "#") {
+					t.Errorf("%+v resolved %q to %q, query %q", target, uri, resolved, u.RawQuery)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NewTLSConfig returns the TLS configuration of the listeners terminating
+// TLS, serving the certificates getCertificate returns. cipherSuites
+// restricts the TLS 1.2 suites unless it is empty; TLS 1.3 ones can't be
+// restricted. nextProtos are the ALPN protocols offered.
+func NewTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), minVersion uint16, cipherSuites []uint16, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		NextProtos:     nextProtos,
+	}
+}
+
+// CertReloader serves a certificate and key read from PEM files, and reads
+// them again when either file changes, so a certificate rotated on disk is
+// picked up without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// modified are the modification times of the files cert was read
+	// from.
+	modified [2]time.Time
+}
+
+// NewCertReloader returns a reloader of the files, failing if they can't be
+// read or the key doesn't match the certificate.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// Reload reads the files again if either changed since they were last read,
+// and reports whether the certificate was replaced. On error the current
+// certificate is kept, so a rotation that wrote only one of the files yet
+// is retried on the next call.
+func (c *CertReloader) Reload() (bool, error) {
+	modified, err := c.modTimes()
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	unchanged := c.cert != nil && modified == c.modified
+	c.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cert, c.modified = &cert, modified
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *CertReloader) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
+
+// Run checks the files every interval until ctx is done.
+func (c *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.ReloadAndLog()
+		}
+	}
+}
+
+// ReloadAndLog reloads the files and logs the outcome.
+func (c *CertReloader) ReloadAndLog() {
+	reloaded, err := c.Reload()
+	if err != nil {
+		slog.Error("Failed to reload the TLS certificate, keeping the current one", "cert", c.certFile, "key", c.keyFile, "error", err)
+		return
+	}
+	if reloaded {
+		slog.Info("Reloaded the TLS certificate", "cert", c.certFile, "audit", true)
+	}
+}
+
+// CABundle holds the certificates of a PEM CA bundle, and reads the file
+// again when it changes.
+type CABundle struct {
+	file string
+
+	mu       sync.Mutex
+	pool     *x509.CertPool
+	modified time.Time
+}
+
+// NewCABundle returns the bundle of file, failing if it holds no
+// certificate.
+func NewCABundle(file string) (*CABundle, error) {
+	b := &CABundle{file: file}
+	if _, err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Pool returns the current certificates.
+func (b *CABundle) Pool() *x509.CertPool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pool
+}
+
+// Reload reads the file again if it changed since it was last read, and
+// reports whether the certificates were replaced. On error the current ones
+// are kept.
+func (b *CABundle) Reload() (bool, error) {
+	info, err := os.Stat(b.file)
+	if err != nil {
+		return false, err
+	}
+	b.mu.Lock()
+	unchanged := b.pool != nil && info.ModTime().Equal(b.modified)
+	b.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(b.file)
+	if err != nil {
+		return false, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return false, fmt.Errorf("no certificate found in %s", b.file)
+	}
+	b.mu.Lock()
+	b.pool, b.modified = pool, info.ModTime()
+	b.mu.Unlock()
+	return true, nil
+}
+
+// Run checks the file every interval until ctx is done.
+func (b *CABundle) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.ReloadAndLog()
+		}
+	}
+}
+
+// ReloadAndLog reloads the file and logs the outcome.
+func (b *CABundle) ReloadAndLog() {
+	reloaded, err := b.Reload()
+	if err != nil {
+		slog.Error("Failed to reload the CA bundle, keeping the current one", "ca", b.file, "error", err)
+		return
+	}
+	if reloaded {
+		slog.Info("Reloaded the CA bundle", "ca", b.file, "audit", true)
+	}
+}
+
+// RedirectToTLS answers requests with a 308 to the same host and path on
+// tlsPort, except for the health check paths, which next serves so load
+// balancers checking the plain port keep working. A 308 keeps the method and
+// body, and clients following it resend their headers, the org one
+// included, unless they drop them on a redirect.
+func RedirectToTLS(next http.Handler, tlsPort int, healthPaths ...string) http.Handler {
+	port := strconv.Itoa(tlsPort)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range healthPaths {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		http.Redirect(w, r, "https://"+net.JoinHostPort(host, port)+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// testCA is a certificate authority issuing the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// file is the PEM file of its certificate.
+	file string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(t.TempDir(), name+".pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// pool returns a pool of the CA's certificate.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate for name, valid for servers of name and
+// 127.0.0.1 and for clients.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// issueFiles writes a certificate for name to PEM files and returns their
+// paths.
+func (ca *testCA) issueFiles(t *testing.T, name string) (certFile, keyFile string) {
+	t.Helper()
+	cert := ca.issue(t, name)
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", cert.Certificate[0])
+	writePEM(t, keyFile, "EC PRIVATE KEY", key)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendClientCertificate(t *testing.T) {
+	ca := newTestCA(t, "backends")
+	var requests int
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "acme")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+	service := serverBackend(backend, "acme", "a1")
+	certFile, keyFile := ca.issueFiles(t, "ecs-svc-proxy")
+	// forward sends a request to the backend authenticated by backendTLS.
+	forward := func(backendTLS *BackendTLS) *httptest.ResponseRecorder {
+		forwarder := NewForwarder(NewBackendTransports(backendTLS), func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{})
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+		w := httptest.NewRecorder()
+		forwarder.ServeHTTP(w, withBackend(r, "acme", service, config.OrgTarget{Scheme: "https"}, nil))
+		return w
+	}
+
+	withCert, err := NewBackendTLS(certFile, keyFile, ca.file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := forward(withCert); w.Code != http.StatusOK || w.Body.String() != "ecs-svc-proxy" {
+		t.Errorf("with the client certificate: status %d: %s", w.Code, w.Body)
+	}
+
+	// a backend requiring one turns the proxy down without it
+	withoutCert, err := NewBackendTLS("", "", ca.file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := forward(withoutCert); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), errCodeBackendTLS) {
+		t.Errorf("without the client certificate: status %d: %s", w.Code, w.Body)
+	}
+	if requests != 1 {
+		t.Errorf("backend served %d requests, want only the authenticated one", requests)
+	}
+}
+
+func TestListenerClientAuth(t *testing.T) {
+	clients := newTestCA(t, "clients")
+	other := newTestCA(t, "other")
+	servers := newTestCA(t, "servers")
+	cas, err := NewCABundle(clients.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert := servers.issue(t, "proxy.example.com")
+	for _, tt := range []struct {
+		mode string
+		// issuer issued the client certificate presented, nil for none.
+		issuer *testCA
+		// identity is the one the request is served with, empty if the
+		// handshake must fail.
+		identity string
+	}{
+		{mode: config.ClientAuthRequire, issuer: clients, identity: "billing"},
+		{mode: config.ClientAuthRequire},
+		{mode: config.ClientAuthRequire, issuer: other},
+		{mode: config.ClientAuthRequest, issuer: clients, identity: "billing"},
+		{mode: config.ClientAuthRequest, identity: "anonymous"},
+		{mode: config.ClientAuthRequest, issuer: other},
+	} {
+		name := tt.mode + " without a certificate"
+		if tt.issuer != nil {
+			name = tt.mode + " with a certificate of " + tt.issuer.cert.Subject.CommonName
+		}
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(WithClientIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity := clientIdentityFrom(r.Context())
+				if identity == "" {
+					identity = "anonymous"
+				}
+				io.WriteString(w, identity)
+			})))
+			server.TLS = NewTLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &serverCert, nil }, tls.VersionTLS12, nil)
+			SetClientAuth(server.TLS, tt.mode, cas)
+			server.Config.ErrorLog = log.New(io.Discard, "", 0)
+			server.StartTLS()
+			defer server.Close()
+			clientTLS := &tls.Config{RootCAs: servers.pool(), ServerName: "proxy.example.com"}
+			if tt.issuer != nil {
+				// sent whatever CAs the proxy asks for
+				cert := tt.issuer.issue(t, "billing")
+				clientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+
+			resp, err := client.Get(server.URL)
+			if tt.identity == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("handshake succeeded with status %d, want it turned down", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != tt.identity {
+				t.Errorf("status %d as %q, want %q", resp.StatusCode, body, tt.identity)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t, "servers")
+	certFile, keyFile := ca.issueFiles(t, "proxy.example.com")
+	cfg, err := config.Load(map[string]string{"ECS_CLUSTER": "tenants", "TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := listenLocal(t)
+	server := NewServer(http.NotFoundHandler(), cfg)
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	serve(t, server, tls.NewListener(listener, NewTLSConfig(certs.GetCertificate, cfg.TLSMinVersion, cfg.TLSCipherSuites)))
+	// served returns the name of the certificate a new connection to
+	// 127.0.0.1, which every certificate of the CA is valid for, is served
+	// with.
+	served := func(maxVersion uint16) (string, error) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: ca.pool(), MaxVersion: maxVersion})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+	// rotate writes the files of a certificate for name over those served,
+	// dated later so the change is seen.
+	rotate := func(name string, files ...string) {
+		t.Helper()
+		newCert, newKey := ca.issueFiles(t, name)
+		for i, src := range []string{newCert, newKey}[:len(files)] {
+			data, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(files[i], data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			later := time.Now().Add(time.Duration(i+1) * time.Minute)
+			if err := os.Chtimes(files[i], later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if name, err := served(0); err != nil || name != "proxy.example.com" {
+		t.Fatalf("served %q, %v", name, err)
+	}
+	if reloaded, err := certs.Reload(); reloaded || err != nil {
+		t.Errorf("Reload of unchanged files = %t, %v", reloaded, err)
+	}
+
+	// a rotation on disk is picked up by the next handshake
+	rotate("rotated.example.com", certFile, keyFile)
+	if reloaded, err := certs.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload of rotated files = %t, %v", reloaded, err)
+	}
+	if name, err := served(0); err != nil || name != "rotated.example.com" {
+		t.Errorf("served %q, %v after the rotation, want the rotated certificate", name, err)
+	}
+
+	// a rotation halfway through keeps the current certificate
+	rotate("half.example.com", certFile)
+	if reloaded, err := certs.Reload(); reloaded || err == nil {
+		t.Errorf("Reload of a certificate without its key = %t, %v", reloaded, err)
+	}
+	if name, err := served(0); err != nil || name != "rotated.example.com" {
+		t.Errorf("served %q, %v after a failed reload, want the current certificate", name, err)
+	}
+
+	// clients below TLS_MIN_VERSION are turned down
+	if _, err := served(tls.VersionTLS11); err == nil {
+		t.Error("TLS 1.1 handshake succeeded")
+	}
+
+	// the files must exist and match
+	if _, err := NewCertReloader(certFile, filepath.Join(t.TempDir(), "missing.key")); err == nil {
+		t.Error("NewCertReloader of a missing key succeeded")
+	}
+	if _, err := NewCertReloader(certFile, keyFile); err == nil {
+		t.Error("NewCertReloader of a certificate and another's key succeeded")
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+)
+
+// amznTraceIDHeader is the trace header of AWS load balancers and X-Ray.
+const amznTraceIDHeader = "X-Amzn-Trace-Id"
+
+// maxTraceHeaderLength is the longest X-Amzn-Trace-Id whose fields are kept
+// when a Root= or Self= is added, and the longest trace header logged.
+const maxTraceHeaderLength = 512
+
+// traceHeader is a tracing header of a request as it arrived, once
+// X-Amzn-Trace-Id was given its Root= and Self=.
+type traceHeader struct {
+	name   string
+	values []string
+}
+
+type traceHeadersKey struct{}
+
+// traceHeadersFrom returns the tracing headers stored in ctx by
+// WithTraceHeaders, if any.
+func traceHeadersFrom(ctx context.Context) []traceHeader {
+	headers, _ := ctx.Value(traceHeadersKey{}).([]traceHeader)
+	return headers
+}
+
+// WithTraceHeaders stores the request's tracing headers among headers on the
+// request context, for the access log and for the forwarder to pass them on
+// verbatim. Unless amzn is AmznTraceIDOff, X-Amzn-Trace-Id is given a Root=
+// first, and a Self= if it is AmznTraceIDSelf.
+func WithTraceHeaders(next http.Handler, headers []string, amzn string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if amzn != config.AmznTraceIDOff {
+			r.Header.Set(amznTraceIDHeader, amznTraceID(r.Header.Get(amznTraceIDHeader), amzn == config.AmznTraceIDSelf, time.Now()))
+		}
+		var trace []traceHeader
+		for _, name := range headers {
+			if values := r.Header.Values(name); len(values) > 0 {
+				trace = append(trace, traceHeader{name: name, values: slices.Clone(values)})
+			}
+		}
+		if len(trace) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), traceHeadersKey{}, trace))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// amznTraceID returns the X-Amzn-Trace-Id value with a fresh Root= if it has
+// no valid one, and a fresh Self= in place of any other if self. A value
+// with a valid root is returned as is unless self.
+func amznTraceID(value string, self bool, now time.Time) string {
+	var fields []string
+	root := false
+	// the fields of an overlong value aren't worth keeping
+	if len(value) <= maxTraceHeaderLength {
+		for _, field := range strings.Split(value, ";") {
+			field = strings.TrimSpace(field)
+			key, id, _ := strings.Cut(field, "=")
+			switch {
+			case field == "", key == "Root" && !validTraceID(id), key == "Self" && self:
+				continue
+			case key == "Root":
+				root = true
+			}
+			fields = append(fields, field)
+		}
+	}
+	if root && !self {
+		return value
+	}
+	if !root {
+		fields = append([]string{"Root=" + newTraceID(now)}, fields...)
+	}
+	if self {
+		fields = append([]string{"Self=" + newTraceID(now)}, fields...)
+	}
+	return strings.Join(fields, ";")
+}
+
+// validTraceID reports whether id is an X-Ray trace ID: the version 1, the
+// epoch seconds in 8 hex digits and 24 random hex digits.
+func validTraceID(id string) bool {
+	if len(id) != 35 || id[:2] != "1-" || id[10] != '-' {
+		return false
+	}
+	for i, c := range []byte(id[2:]) {
+		if i == 8 {
+			continue
+		}
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceID returns a random X-Ray trace ID started at now.
+func newTraceID(now time.Time) string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("1-%08x-%x", uint32(now.Unix()), b)
+}
+
+// restoreTraceHeaders sets the tracing headers in header back to the values
+// the request arrived with, over any ORG_HEADERS set.
+func restoreTraceHeaders(header http.Header, trace []traceHeader) {
+	for _, h := range trace {
+		header.Del(h.name)
+		for _, value := range h.values {
+			header.Add(h.name, value)
+		}
+	}
+}
+
+// traceLogAttrs returns the tracing headers as attributes named after them
+// in lower case, truncated to maxTraceHeaderLength.
+func traceLogAttrs(trace []traceHeader) []any {
+	attrs := make([]any, 0, len(trace))
+	for _, h := range trace {
+		value := strings.Join(h.values, ", ")
+		if len(value) > maxTraceHeaderLength {
+			value = value[:maxTraceHeaderLength] + "..."
+		}
+		attrs = append(attrs, slog.String(strings.ToLower(h.name), value))
+	}
+	return attrs
+}
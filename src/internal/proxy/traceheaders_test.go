@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+)
+
+func TestAmznTraceID(t *testing.T) {
+	now := time.Unix(0x5759e988, 0)
+	const root = "Root=1-5759e988-bd862e3fe1be46a994272793"
+	for _, tt := range []struct {
+		name, value string
+		self        bool
+		// want is the value returned, with R and S standing for the fresh
+		// root and self
+		want string
+	}{
+		{name: "missing", want: "R"},
+		{name: "valid root", value: root + ";Parent=53995c3f42cd8ad8;Sampled=1", want: root + ";Parent=53995c3f42cd8ad8;Sampled=1"},
+		{name: "invalid root", value: "Root=1-xyz;Sampled=1", want: "R;Sampled=1"},
+		{name: "no root", value: "Parent=53995c3f42cd8ad8", want: "R;Parent=53995c3f42cd8ad8"},
+		{name: "self", value: root + ";Self=1-5759e988-000000000000000000000000;Sampled=1", self: true, want: "S;" + root + ";Sampled=1"},
+		{name: "self without root", self: true, want: "S;R"},
+		{name: "overlong", value: root + ";" + strings.Repeat("x", maxTraceHeaderLength), want: "R"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Split(amznTraceID(tt.value, tt.self, now), ";")
+			want := strings.Split(tt.want, ";")
+			if len(got) != len(want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+			for i, field := range want {
+				key, id, _ := strings.Cut(got[i], "=")
+				switch {
+				case field == "R" && key == "Root", field == "S" && key == "Self":
+					if !validTraceID(id) || !strings.HasPrefix(id, "1-5759e988-") {
+						t.Errorf("%s %q, want an ID started now", key, id)
+					}
+				case field != got[i]:
+					t.Errorf("field %d %q, want %q", i, got[i], field)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyTraceHeaders(t *testing.T) {
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"))
+	proxy := newTestProxy(t, fake, map[string]string{
+		"PROXY_MODE":  config.ProxyModeForward,
+		"ORG_HEADERS": `{"*": {"traceparent": "00-{{org}}", "X-Tenant": "{{org}}"}}`,
+	})
+	var forwarded http.Header
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		forwarded = r.Header.Clone()
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("ok")), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(transport, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	headers := []string{"X-Amzn-Trace-Id", "traceparent", "tracestate", "b3"}
+	// send sends a request of acme with the client headers given through
+	// the trace headers completed as amzn says, and returns its access
+	// record's trace.
+	send := func(amzn string, client http.Header) map[string]any {
+		t.Helper()
+		logged.Reset()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header = client
+		r.Header.Set("X-Org-ID", "acme")
+		w := httptest.NewRecorder()
+		WithTraceHeaders(AccessLog(proxy.Handler, "X-Org-ID", slog.LevelInfo), headers, amzn).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		for _, record := range logRecords(t, &logged) {
+			if record["msg"] == "Request" {
+				trace, _ := record["trace"].(map[string]any)
+				return trace
+			}
+		}
+		t.Fatalf("no access record: %s", &logged)
+		return nil
+	}
+
+	// the tracing headers reach the backend as the client sent them, over
+	// the org's headers, and are logged
+	const root = "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1"
+	trace := send(config.AmznTraceIDRoot, http.Header{
+		"X-Amzn-Trace-Id": {root},
+		"Traceparent":     {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"Tracestate":      {"congo=t61rcWkgMzE", "rojo=00f067aa0ba902b7"},
+		"X-B3-Traceid":    {"80f198ee56343ba8"},
+	})
+	for name, want := range map[string][]string{
+		"X-Amzn-Trace-Id": {root},
+		"Traceparent":     {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"Tracestate":      {"congo=t61rcWkgMzE", "rojo=00f067aa0ba902b7"},
+		"X-B3-Traceid":    {"80f198ee56343ba8"},
+		"X-Tenant":        {"acme"},
+	} {
+		if got := forwarded.Values(name); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s %q forwarded, want %q", name, got, want)
+		}
+	}
+	for name, want := range map[string]any{
+		"x-amzn-trace-id": root,
+		"traceparent":     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"tracestate":      "congo=t61rcWkgMzE, rojo=00f067aa0ba902b7",
+	} {
+		if trace[name] != want {
+			t.Errorf("logged %s %v, want %v", name, trace[name], want)
+		}
+	}
+	// only the headers listed are
+	if _, ok := trace["x-b3-traceid"]; ok || len(trace) != 3 {
+		t.Errorf("logged trace %v, want the 3 listed headers sent", trace)
+	}
+
+	// a request without a root is given one, unless off
+	trace = send(config.AmznTraceIDRoot, http.Header{})
+	if id, _ := strings.CutPrefix(forwarded.Get("X-Amzn-Trace-Id"), "Root="); !validTraceID(id) || trace["x-amzn-trace-id"] != forwarded.Get("X-Amzn-Trace-Id") {
+		t.Errorf("X-Amzn-Trace-Id %q forwarded, %v logged, want a fresh root", forwarded.Get("X-Amzn-Trace-Id"), trace["x-amzn-trace-id"])
+	}
+	if got := forwarded.Get("Traceparent"); got != "00-acme" {
+		t.Errorf("traceparent %q forwarded without one sent, want the org's", got)
+	}
+	send(config.AmznTraceIDOff, http.Header{})
+	if got := forwarded.Values("X-Amzn-Trace-Id"); len(got) != 0 {
+		t.Errorf("X-Amzn-Trace-Id %q forwarded while off", got)
+	}
+	send(config.AmznTraceIDSelf, http.Header{"X-Amzn-Trace-Id": {root}})
+	if got := forwarded.Get("X-Amzn-Trace-Id"); !strings.HasPrefix(got, "Self=1-") || !strings.HasSuffix(got, ";"+root) {
+		t.Errorf("X-Amzn-Trace-Id %q forwarded, want a Self= before the client's", got)
+	}
+}
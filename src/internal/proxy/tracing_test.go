@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans installs a tracer provider keeping the ended spans in memory
+// and returns them, emptied. The proxy's tracer only delegates to the first
+// provider installed, so every test shares it.
+func recordSpans() *tracetest.InMemoryExporter {
+	spansOnce.Do(func() {
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spans.Reset()
+	return spans
+}
+
+// spanAttr returns the value of the attribute key of span.
+func spanAttr(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := recordSpans()
+	fake := discoverytest.NewECS()
+	fake.AddService("tenants", "acme")
+	fake.AddService("tenants", "globex")
+	fake.AddTasks("tenants",
+		discoverytest.Task("tenants", "acme", "a1", "10.0.0.1"),
+		discoverytest.Task("tenants", "globex", "g1", "10.0.1.1"))
+	proxy := newTestProxy(t, fake, map[string]string{"PROXY_MODE": config.ProxyModeForward})
+	// the backend of globex fails, each backend answers with the trace it
+	// was sent
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		if r.URL.Hostname() == "10.0.1.1" {
+			status = http.StatusInternalServerError
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(r.Header.Get("Traceparent"))), Header: http.Header{}, Request: r}, nil
+	})
+	proxy.Forwarder = NewForwarder(&TracingTransport{Next: transport}, func(string) {}, proxy.Live.RetryAfter, ResponseRewriter{})
+	handler := TraceRequests(proxy.Handler)
+	// send sends a request of org, in the trace of traceparent if not empty,
+	// and returns the spans ended by name.
+	send := func(org, traceparent string) (*httptest.ResponseRecorder, map[string]tracetest.SpanStub) {
+		t.Helper()
+		exporter.Reset()
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/orders", nil)
+		r.Header.Set("X-Org-ID", org)
+		if traceparent != "" {
+			r.Header.Set("Traceparent", traceparent)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		ended := map[string]tracetest.SpanStub{}
+		for _, span := range exporter.GetSpans() {
+			ended[span.Name] = span
+		}
+		return w, ended
+	}
+
+	// a hit continues the client's trace down to the backend
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	w, ended := send("acme", "00-"+traceID+"-00f067aa0ba902b7-01")
+	server, lookup, upstream := ended["proxy GET"], ended["lookup"], ended["upstream GET"]
+	if len(ended) != 3 || !server.SpanContext.IsValid() || !lookup.SpanContext.IsValid() || !upstream.SpanContext.IsValid() {
+		t.Fatalf("spans of a hit %v, want the server, lookup and upstream ones", ended)
+	}
+	if server.SpanContext.TraceID().String() != traceID || server.Parent.SpanID().String() != "00f067aa0ba902b7" || !server.Parent.IsRemote() {
+		t.Errorf("server span in trace %s under %s, want the client's", server.SpanContext.TraceID(), server.Parent.SpanID())
+	}
+	if server.SpanKind != trace.SpanKindServer || upstream.SpanKind != trace.SpanKindClient {
+		t.Errorf("span kinds %s and %s, want server and client", server.SpanKind, upstream.SpanKind)
+	}
+	for _, child := range []tracetest.SpanStub{lookup, upstream} {
+		if child.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("%s span not a child of the server span", child.Name)
+		}
+	}
+	for key, want := range map[attribute.Key]attribute.Value{
+		attrOrg:                     attribute.StringValue("acme"),
+		attrService:                 attribute.StringValue("acme"),
+		attrBackend:                 attribute.StringValue("10.0.0.1:80"),
+		attrOutcome:                 attribute.StringValue("hit"),
+		"http.request.method":       attribute.StringValue(http.MethodGet),
+		"url.path":                  attribute.StringValue("/orders"),
+		"http.response.status_code": attribute.IntValue(http.StatusOK),
+	} {
+		if got := spanAttr(server, key); got != want {
+			t.Errorf("server span %s %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+	if got := spanAttr(upstream, attrBackend); got.AsString() != "10.0.0.1:80" {
+		t.Errorf("upstream span backend %q", got.AsString())
+	}
+	// the backend is in the trace, under the upstream span
+	if want := "00-" + traceID + "-" + upstream.SpanContext.SpanID().String() + "-01"; w.Body.String() != want {
+		t.Errorf("backend sent traceparent %q, want %q", w.Body, want)
+	}
+
+	// a failing backend marks both spans failed
+	_, ended = send("globex", "")
+	if server, upstream := ended["proxy GET"], ended["upstream GET"]; server.Status.Code != codes.Error || upstream.Status.Code != codes.Error {
+		t.Errorf("spans of a failing backend %v and %v, want errors", server.Status, upstream.Status)
+	}
+	if server := ended["proxy GET"]; server.Parent.IsValid() {
+		t.Errorf("request without a trace continued %s", server.Parent.TraceID())
+	}
+
+	// a miss times its refresh under the lookup
+	fake.AddService("tenants", "initech")
+	fake.AddTasks("tenants", discoverytest.Task("tenants", "initech", "i1", "10.0.2.1"))
+	_, ended = send("initech", "")
+	lookup, refresh := ended["lookup"], ended["refresh"]
+	if !refresh.SpanContext.IsValid() || refresh.Parent.SpanID() != lookup.SpanContext.SpanID() {
+		t.Errorf("spans of a miss %v, want a refresh under the lookup", ended)
+	}
+	if got := spanAttr(ended["proxy GET"], attrOutcome); got.AsString() != "miss-refresh-hit" {
+		t.Errorf("outcome of a miss %q", got.AsString())
+	}
+}
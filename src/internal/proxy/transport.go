@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// BackendTransports keeps a separate connection pool per backend address so
+// the keep-alive connections of a backend that left the route table can be
+// closed without disturbing the others.
+type BackendTransports struct {
+	// tls authenticates backends reached over HTTPS, with the default
+	// configuration if nil.
+	tls *BackendTLS
+
+	mu         sync.Mutex
+	transports map[string]*backendTransport
+}
+
+// NewBackendTransports returns transports authenticating HTTPS backends
+// with tls.
+func NewBackendTransports(tls *BackendTLS) *BackendTransports {
+	return &BackendTransports{tls: tls, transports: map[string]*backendTransport{}}
+}
+
+func (b *BackendTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	address := discovery.BackendAddress(req)
+	b.mu.Lock()
+	transport, ok := b.transports[address]
+	if !ok {
+		transport = &backendTransport{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+		// an address belongs to a single service, whose name its
+		// certificate is verified against
+		if target, _ := req.Context().Value(backendKey{}).(*backend); b.tls != nil && target != nil {
+			transport.TLSClientConfig = b.tls.Config(target.service)
+		}
+		b.transports[address] = transport
+	}
+	b.mu.Unlock()
+	return transport.RoundTrip(req)
+}
+
+// Drain closes the idle connections to addresses and forgets their pools.
+// Requests still in flight to them complete, and their connections are
+// closed instead of being kept alive.
+func (b *BackendTransports) Drain(addresses []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, address := range addresses {
+		transport, ok := b.transports[address]
+		if !ok {
+			continue
+		}
+		delete(b.transports, address)
+		transport.drained.Store(true)
+		transport.CloseIdleConnections()
+		telemetry.BackendsDrained.Add(1)
+	}
+}
+
+type backendTransport struct {
+	*http.Transport
+	drained atomic.Bool
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	// upgraded connections need their body to stay an io.ReadWriteCloser
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	resp.Body = &drainingBody{ReadCloser: resp.Body, transport: t}
+	return resp, nil
+}
+
+// drainingBody closes the connection it was read from once the response is
+// done if its backend was drained meanwhile, rather than returning it to the
+// idle pool.
+type drainingBody struct {
+	io.ReadCloser
+	transport *backendTransport
+}
+
+func (b *drainingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.transport.drained.Load() {
+		b.transport.CloseIdleConnections()
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/discovery/discoverytest"
+	"ecs-svc-proxy/src/internal/telemetry"
+)
+
+// countingBackend is a backend counting the requests sent to it, those sent
+// after the route table swap, and its open connections.
+type countingBackend struct {
+	*httptest.Server
+	service discovery.ECSService
+
+	requests  atomic.Int64
+	afterSwap atomic.Int64
+	open      atomic.Int64
+}
+
+func newCountingBackend(t *testing.T, task string) *countingBackend {
+	b := &countingBackend{}
+	b.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.requests.Add(1)
+		if r.Header.Get("X-Swapped") == "true" {
+			b.afterSwap.Add(1)
+		}
+		io.WriteString(w, "ok")
+	}))
+	b.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			b.open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			b.open.Add(-1)
+		}
+	}
+	b.Start()
+	t.Cleanup(b.Close)
+	b.service = serverBackend(b.Server, "acme", task)
+	return b
+}
+
+// serverBackend returns a backend of service served by server.
+func serverBackend(server *httptest.Server, service, task string) discovery.ECSService {
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return discovery.ECSService{Name: service, IP: u.Hostname(), Port: port, TaskArn: discoverytest.TaskARN("tenants", task)}
+}
+
+func TestDrainRemovedBackend(t *testing.T) {
+	kept, removed := newCountingBackend(t, "a1"), newCountingBackend(t, "a2")
+	routes := discovery.NewRouteTable([]discovery.ECSService{kept.service, removed.service}, nil, config.LBStrategyRoundRobin)
+	transports := NewBackendTransports(nil)
+	routes.OnRemove(transports.Drain)
+	forwarder := NewForwarder(transports, func(string) {}, func() time.Duration { return time.Second }, ResponseRewriter{})
+
+	var swapped atomic.Bool
+	send := func() {
+		// a request looked up after the swap is marked, so the removed
+		// backend can tell it mustn't have received it
+		after := swapped.Load()
+		service, err := routes.Lookup("acme")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+		r.Header.Set("X-Swapped", strconv.FormatBool(after))
+		w := httptest.NewRecorder()
+		forwarder.ServeHTTP(w, withBackend(r, "acme", service, config.OrgTarget{}, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					send()
+				}
+			}
+		}()
+	}
+	for removed.requests.Load() < 20 || kept.requests.Load() < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	drained := telemetry.BackendsDrained.Value()
+	routes.Replace([]discovery.ECSService{kept.service}, discovery.TriggerScheduled)
+	swapped.Store(true)
+	// traffic carries on after the swap
+	for n := kept.requests.Load(); kept.requests.Load() < n+50; {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if n := removed.afterSwap.Load(); n > 0 {
+		t.Errorf("removed backend got %d requests after the swap", n)
+	}
+	if kept.afterSwap.Load() == 0 {
+		t.Error("kept backend got no requests after the swap")
+	}
+	if n := telemetry.BackendsDrained.Value() - drained; n != 1 {
+		t.Errorf("drained %d backends, want 1", n)
+	}
+	// the removed backend's connections are closed once the requests in
+	// flight when it was drained are done; the kept one's stay open
+	deadline := time.Now().Add(5 * time.Second)
+	for removed.open.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections to the removed backend still open", removed.open.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if kept.open.Load() == 0 {
+		t.Error("connections to the kept backend closed")
+	}
+}
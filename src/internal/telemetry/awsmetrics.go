@@ -0,0 +1,28 @@
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of an AWS API call.
+const (
+	AWSCallSuccess   = "success"
+	AWSCallThrottled = "throttled"
+	AWSCallError     = "error"
+)
+
+var (
+	// AWSCalls counts the AWS API calls and AWSCallDuration times them, by
+	// service, operation and outcome: success, throttled or error. Each
+	// retry is a call of its own.
+	AWSCalls = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_aws_api_calls_total",
+		Help: "AWS API calls by service, operation and outcome (success, throttled, error).",
+	}, []string{"service", "operation", "outcome"})
+	AWSCallDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ecs_svc_proxy_aws_api_call_duration_seconds",
+		Help:    "Duration of AWS API calls by service, operation and outcome (success, throttled, error).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "operation", "outcome"})
+)
@@ -0,0 +1,256 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"ecs-svc-proxy/src/internal/clock"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// EMFSink writes the request, route table and refresh metrics of the
+// Prometheus registry as CloudWatch Embedded Metric Format documents, one JSON
+// line per dimension set, for the CloudWatch agent or Lambda/ECS log drivers
+// to turn into metrics. Counters and latencies cover the time since the
+// previous flush.
+type EMFSink struct {
+	w         io.Writer
+	namespace string
+	cluster   string
+	gatherer  prometheus.Gatherer
+	clock     clock.Clock
+	cumulative
+}
+
+// NewEMFSink returns a sink writing the documents of the metrics of
+// gatherer to w under namespace, with a cluster dimension.
+func NewEMFSink(w io.Writer, namespace, cluster string, gatherer prometheus.Gatherer) *EMFSink {
+	return &EMFSink{
+		w:          w,
+		namespace:  namespace,
+		cluster:    cluster,
+		gatherer:   gatherer,
+		clock:      clock.System{},
+		cumulative: newCumulative(),
+	}
+}
+
+// SetClock makes the documents timestamped by clock. It must be called
+// before the sink is flushed.
+func (s *EMFSink) SetClock(clock clock.Clock) {
+	s.clock = clock
+}
+
+// emfOutcome aggregates the requests of a routing outcome over status
+// classes.
+type emfOutcome struct {
+	requests, errors float64
+	histogramDelta
+}
+
+// Flush writes the metrics accumulated since the previous flush.
+func (s *EMFSink) Flush() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	outcomes := map[string]*emfOutcome{}
+	outcome := func(name string) *emfOutcome {
+		o, ok := outcomes[name]
+		if !ok {
+			o = &emfOutcome{}
+			outcomes[name] = o
+		}
+		return o
+	}
+	var routes, refreshFailures float64
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := metricLabels(metric)
+			key := family.GetName() + labelsKey(labels)
+			switch family.GetName() {
+			case "ecs_svc_proxy_requests_total":
+				delta := s.delta(key, metric.GetCounter().GetValue())
+				o := outcome(labels["outcome"])
+				o.requests += delta
+				if labels["code"] == "5xx" {
+					o.errors += delta
+				}
+			case "ecs_svc_proxy_request_duration_seconds":
+				o := outcome(labels["outcome"])
+				s.addBuckets(key, &o.histogramDelta, metric.GetHistogram())
+			case "ecs_svc_proxy_routes":
+				if labels["table"] == "primary" {
+					routes = metric.GetGauge().GetValue()
+				}
+			case "ecs_svc_proxy_refresh_failures_total":
+				refreshFailures += s.delta(key, metric.GetCounter().GetValue())
+			}
+		}
+	}
+
+	timestamp := s.clock.Now().UnixMilli()
+	encoder := json.NewEncoder(s.w)
+	err = encoder.Encode(s.document(timestamp, []string{"Cluster"}, map[string]any{
+		"Cluster":         s.cluster,
+		"RouteTableSize":  routes,
+		"RefreshFailures": refreshFailures,
+	}, map[string]string{"RouteTableSize": "Count", "RefreshFailures": "Count"}))
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(outcomes))
+	for name := range outcomes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := outcomes[name]
+		if o.requests == 0 {
+			continue
+		}
+		err := encoder.Encode(s.document(timestamp, []string{"Cluster", "Outcome"}, map[string]any{
+			"Cluster":    s.cluster,
+			"Outcome":    name,
+			"Requests":   o.requests,
+			"Errors":     o.errors,
+			"LatencyP50": quantile(0.5, o.bounds, o.buckets) * 1000,
+			"LatencyP99": quantile(0.99, o.bounds, o.buckets) * 1000,
+		}, map[string]string{
+			"Requests":   "Count",
+			"Errors":     "Count",
+			"LatencyP50": "Milliseconds",
+			"LatencyP99": "Milliseconds",
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// document builds an EMF document of the metrics in units, whose values
+// and dimensions are in fields.
+func (s *EMFSink) document(timestamp int64, dimensions []string, fields map[string]any, units map[string]string) map[string]any {
+	metrics := make([]map[string]string, 0, len(units))
+	for name, unit := range units {
+		metrics = append(metrics, map[string]string{"Name": name, "Unit": unit})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i]["Name"] < metrics[j]["Name"] })
+	fields["_aws"] = map[string]any{
+		"Timestamp": timestamp,
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  s.namespace,
+			"Dimensions": [][]string{dimensions},
+			"Metrics":    metrics,
+		}},
+	}
+	return fields
+}
+
+// cumulative holds the cumulative values of the previous flush by series,
+// for sinks reporting deltas.
+type cumulative struct {
+	counts  map[string]float64
+	buckets map[string][]uint64
+}
+
+func newCumulative() cumulative {
+	return cumulative{counts: map[string]float64{}, buckets: map[string][]uint64{}}
+}
+
+// histogramDelta sums the bucket counts of histogram series since the
+// previous flush. Every series of a histogram shares its bucket bounds.
+type histogramDelta struct {
+	bounds  []float64
+	buckets []uint64
+}
+
+// delta returns how much the counter key grew since the previous flush.
+func (c cumulative) delta(key string, value float64) float64 {
+	previous := c.counts[key]
+	c.counts[key] = value
+	if value < previous {
+		return value
+	}
+	return value - previous
+}
+
+// addBuckets adds the observations of histogram since the previous flush to
+// h.
+func (c cumulative) addBuckets(key string, h *histogramDelta, histogram *dto.Histogram) {
+	// the implicit +Inf bucket counts every observation
+	bounds := []float64{}
+	current := []uint64{}
+	for _, bucket := range histogram.GetBucket() {
+		bounds = append(bounds, bucket.GetUpperBound())
+		current = append(current, bucket.GetCumulativeCount())
+	}
+	bounds = append(bounds, math.Inf(1))
+	current = append(current, histogram.GetSampleCount())
+
+	previous := c.buckets[key]
+	if h.bounds == nil {
+		h.bounds = bounds
+		h.buckets = make([]uint64, len(current))
+	}
+	for i := range current {
+		delta := current[i]
+		if i < len(previous) && previous[i] <= current[i] {
+			delta -= previous[i]
+		}
+		h.buckets[i] += delta
+	}
+	c.buckets[key] = current
+}
+
+// quantile estimates the q quantile from cumulative bucket counts,
+// interpolating linearly within the bucket it falls in.
+func quantile(q float64, bounds []float64, cumulative []uint64) float64 {
+	if len(cumulative) == 0 {
+		return 0
+	}
+	total := cumulative[len(cumulative)-1]
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	lower, below := 0.0, uint64(0)
+	for i, count := range cumulative {
+		if float64(count) >= rank {
+			if math.IsInf(bounds[i], 1) {
+				// beyond the last bound, which is the best estimate left
+				return lower
+			}
+			if count == below {
+				return bounds[i]
+			}
+			return lower + (bounds[i]-lower)*(rank-float64(below))/float64(count-below)
+		}
+		lower, below = bounds[i], count
+	}
+	return lower
+}
+
+func metricLabels(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(metric.GetLabel()))
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
+
+// labelsKey renders labels in a stable order.
+func labelsKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,100 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"ecs-svc-proxy/src/internal/clock/clocktest"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEMFSink(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ecs_svc_proxy_requests_total"}, []string{"code", "outcome"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "ecs_svc_proxy_request_duration_seconds", Buckets: []float64{0.1, 1}}, []string{"code", "outcome"})
+	routes := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ecs_svc_proxy_routes"}, []string{"table"})
+	registry.MustRegister(requests, duration, routes)
+
+	var out bytes.Buffer
+	sink := NewEMFSink(&out, "ECSServiceProxy", "tenants", registry)
+	sink.SetClock(clocktest.New())
+	requests.WithLabelValues("2xx", "routed").Add(3)
+	requests.WithLabelValues("5xx", "routed").Add(1)
+	duration.WithLabelValues("2xx", "routed").Observe(0.05)
+	routes.WithLabelValues("primary").Set(4)
+	routes.WithLabelValues("secondary").Set(9)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var documents []map[string]any
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var document map[string]any
+		if err := decoder.Decode(&document); err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, document)
+	}
+	if len(documents) != 2 {
+		t.Fatalf("%d documents, want the cluster's and the routed outcome's", len(documents))
+	}
+	cluster, routed := documents[0], documents[1]
+	if cluster["Cluster"] != "tenants" || cluster["RouteTableSize"] != 4.0 {
+		t.Errorf("cluster document = %v, want the primary table's 4 routes", cluster)
+	}
+	aws := cluster["_aws"].(map[string]any)
+	if aws["Timestamp"] != 1714564800000.0 {
+		t.Errorf("Timestamp = %v", aws["Timestamp"])
+	}
+	directive := aws["CloudWatchMetrics"].([]any)[0].(map[string]any)
+	if directive["Namespace"] != "ECSServiceProxy" {
+		t.Errorf("Namespace = %v", directive["Namespace"])
+	}
+	if routed["Outcome"] != "routed" || routed["Requests"] != 4.0 || routed["Errors"] != 1.0 {
+		t.Errorf("outcome document = %v, want 4 requests and 1 error", routed)
+	}
+	if p50 := routed["LatencyP50"].(float64); p50 <= 0 || p50 > 100 {
+		t.Errorf("LatencyP50 = %v ms, want within the first bucket", p50)
+	}
+
+	// the next flush only counts what happened since
+	out.Reset()
+	requests.WithLabelValues("2xx", "routed").Add(2)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("%d documents in the second flush, want 2", len(lines))
+	}
+	var document map[string]any
+	if err := json.Unmarshal(lines[1], &document); err != nil {
+		t.Fatal(err)
+	}
+	if document["Requests"] != 2.0 || document["Errors"] != 0.0 {
+		t.Errorf("second outcome document = %v, want 2 requests and no error", document)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	bounds := []float64{0.1, 1, math.Inf(1)}
+	for _, test := range []struct {
+		q          float64
+		cumulative []uint64
+		want       float64
+	}{
+		{0.5, []uint64{0, 0, 0}, 0},
+		{0.5, []uint64{10, 10, 10}, 0.05},
+		{0.5, []uint64{0, 10, 10}, 0.55},
+		// beyond the last bound the last one is the estimate
+		{0.99, []uint64{0, 0, 10}, 1},
+	} {
+		if got := quantile(test.q, bounds, test.cumulative); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("quantile(%v, %v) = %v, want %v", test.q, test.cumulative, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LogSampler keeps a flood of the same message from drowning out the
+// others. Each message is logged for the first burst occurrences per key in
+// a window, and the occurrences suppressed beyond that are summed up in one
+// line per message when the window ends. A nil *LogSampler allows every
+// message. It is safe for concurrent use.
+type LogSampler struct {
+	burst  int
+	window time.Duration
+
+	mu sync.Mutex
+	// seen counts the occurrences of each message and key in the current
+	// window, suppressed the occurrences not logged per message.
+	seen       map[sampleKey]int
+	suppressed map[string]*suppressedMessage
+}
+
+type suppressedMessage struct {
+	level slog.Level
+	count int
+}
+
+type sampleKey struct {
+	message, key string
+}
+
+// NewLogSampler returns a sampler logging burst occurrences per window, or
+// nil if burst is zero.
+func NewLogSampler(burst int, window time.Duration) *LogSampler {
+	if burst <= 0 {
+		return nil
+	}
+	return &LogSampler{
+		burst:      burst,
+		window:     window,
+		seen:       map[sampleKey]int{},
+		suppressed: map[string]*suppressedMessage{},
+	}
+}
+
+// LogSamples samples the messages a misbehaving client or a failing
+// dependency can repeat at request rate. It allows everything until main
+// sets it up.
+var LogSamples *LogSampler
+
+// Allow reports whether message should be logged at level for key, such as
+// an org ID, and counts it as suppressed if not. Messages below the level
+// of the default logger are neither logged nor counted.
+func (s *LogSampler) Allow(ctx context.Context, level slog.Level, message, key string) bool {
+	if s == nil {
+		return true
+	}
+	if !slog.Default().Enabled(ctx, level) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := sampleKey{message, key}
+	s.seen[k]++
+	if s.seen[k] <= s.burst {
+		return true
+	}
+	suppressed, ok := s.suppressed[message]
+	if !ok {
+		suppressed = &suppressedMessage{level: level}
+		s.suppressed[message] = suppressed
+	}
+	suppressed.count++
+	return false
+}
+
+// Run starts a new window every window until ctx is done.
+func (s *LogSampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Flush()
+		}
+	}
+}
+
+// Flush logs how many occurrences of each message were suppressed in the
+// current window, at the level of the message, and starts a new one.
+func (s *LogSampler) Flush() {
+	s.mu.Lock()
+	suppressed := s.suppressed
+	s.seen = map[sampleKey]int{}
+	s.suppressed = map[string]*suppressedMessage{}
+	s.mu.Unlock()
+	messages := make([]string, 0, len(suppressed))
+	for message := range suppressed {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+	for _, message := range messages {
+		slog.Log(context.Background(), suppressed[message].level, "Suppressed similar messages", "message", message, "suppressed", suppressed[message].count, "window", s.window)
+	}
+}
@@ -0,0 +1,53 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	ctx := context.Background()
+	sampler := NewLogSampler(2, time.Minute)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if sampler.Allow(ctx, slog.LevelWarn, "No route", "acme") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("%d of 5 occurrences allowed, want the burst of 2", allowed)
+	}
+	if !sampler.Allow(ctx, slog.LevelWarn, "No route", "globex") {
+		t.Error("another key was suppressed by the burst of the first")
+	}
+	if sampler.Allow(ctx, slog.LevelDebug, "Retrying", "acme") {
+		t.Error("a message below the logger's level was allowed")
+	}
+
+	sampler.Flush()
+	if got := out.String(); !strings.Contains(got, `msg="Suppressed similar messages"`) || !strings.Contains(got, `message="No route" suppressed=3`) || !strings.Contains(got, "level=WARN") {
+		t.Errorf("flush logged %q, want the 3 suppressed occurrences at the message's level", got)
+	}
+	if strings.Contains(out.String(), "Retrying") {
+		t.Error("a message below the logger's level was counted")
+	}
+	if !sampler.Allow(ctx, slog.LevelWarn, "No route", "acme") {
+		t.Error("the burst didn't start again after the window")
+	}
+
+	if NewLogSampler(0, time.Minute) != nil {
+		t.Error("sampler enabled without a burst")
+	}
+	var disabled *LogSampler
+	if !disabled.Allow(ctx, slog.LevelDebug, "No route", "acme") {
+		t.Error("disabled sampler suppressed a message")
+	}
+}
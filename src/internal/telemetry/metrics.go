@@ -0,0 +1,174 @@
+package telemetry
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"ecs-svc-proxy/src/buildinfo"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RefreshesCoalesced counts refreshes that waited on a discovery
+	// already in flight instead of starting their own.
+	RefreshesCoalesced = expvar.NewInt("refreshes_coalesced")
+	// RefreshFailures counts refreshes that failed and left the previous
+	// routes in place.
+	RefreshFailures = expvar.NewInt("refresh_failures")
+	// DiscoveryPartial counts cluster discoveries that couldn't describe
+	// every task and kept previous routes for the rest.
+	DiscoveryPartial = expvar.NewInt("discovery_partial")
+	// RoutesAdded, RoutesRemoved and RoutesChanged count the entries that
+	// appeared, disappeared, or changed address between refreshes.
+	RoutesAdded   = expvar.NewInt("routes_added")
+	RoutesRemoved = expvar.NewInt("routes_removed")
+	RoutesChanged = expvar.NewInt("routes_changed")
+	// RefreshesSuppressed counts lookup misses and events that didn't
+	// refresh right away because of the refresh cooldown.
+	RefreshesSuppressed = expvar.NewInt("refreshes_suppressed")
+	// NegativeCacheHits counts requests answered from the negative cache.
+	NegativeCacheHits = expvar.NewInt("negative_cache_hits")
+	// NegativeCacheEvictions counts negative cache entries evicted to stay
+	// within its size.
+	NegativeCacheEvictions = expvar.NewInt("negative_cache_evictions")
+	// BackendSelections counts the requests routed to each backend address.
+	BackendSelections = expvar.NewMap("backend_selections")
+	// BackendsDrained counts backends whose connections were closed after
+	// they left the route table.
+	BackendsDrained = expvar.NewInt("backends_drained")
+	// HealthCheckFailures counts backends turning unhealthy.
+	HealthCheckFailures = expvar.NewInt("health_check_failures")
+	// BackendsEjected counts backends taken out of rotation after repeated
+	// forwarding failures.
+	BackendsEjected = expvar.NewInt("backends_ejected")
+	// BreakersOpened counts circuit breakers opening.
+	BreakersOpened = expvar.NewInt("breakers_opened")
+	// Failovers counts the failovers to the secondary cluster per org.
+	Failovers = expvar.NewMap("failovers")
+	// LatencyEjections counts backends ejected for being much slower than
+	// the other backends of their service.
+	LatencyEjections = expvar.NewInt("latency_ejections")
+	// BackendTLSFailures counts forwarded requests that failed the TLS
+	// handshake with their backend.
+	BackendTLSFailures = expvar.NewInt("backend_tls_failures")
+	// UpstreamRetries counts forwarded requests retried on another backend.
+	UpstreamRetries = expvar.NewInt("upstream_retries")
+	// RetriesBudgetExhausted counts failed requests that weren't retried
+	// because their service used up its retry budget.
+	RetriesBudgetExhausted = expvar.NewInt("retries_budget_exhausted")
+	// Panics counts requests whose handler panicked.
+	Panics = expvar.NewInt("panics")
+	// ECSThrottles counts ECS API calls rejected for exceeding the request
+	// rate.
+	ECSThrottles = expvar.NewInt("ecs_throttles")
+)
+
+// Registry holds the Prometheus series served at /metrics. New series are
+// registered here with promauto.With(registry).
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Requests counts the routed requests by status class and routing
+	// outcome, and RequestDuration observes how long they took.
+	Requests = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_requests_total",
+		Help: "Routed requests by status class and routing outcome.",
+	}, []string{"code", "outcome"})
+	RequestDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ecs_svc_proxy_request_duration_seconds",
+		Help:    "Duration of routed requests by status class and routing outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"code", "outcome"})
+	// RefreshDuration is how long the last successful discovery of each
+	// route table took.
+	RefreshDuration = promauto.With(Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecs_svc_proxy_last_refresh_duration_seconds",
+		Help: "Duration of the last successful discovery.",
+	}, []string{"table"})
+	// RefreshFailuresTotal counts the failed discoveries of each route
+	// table.
+	RefreshFailuresTotal = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_refresh_failures_total",
+		Help: "Discoveries that failed and left the previous routes in place.",
+	}, []string{"table"})
+	// ECSTimeouts counts the ECS API call attempts abandoned after
+	// ECS_API_TIMEOUT, by operation.
+	ECSTimeouts = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_svc_proxy_ecs_api_timeouts_total",
+		Help: "ECS API call attempts abandoned after the per-call timeout by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	build := buildinfo.Get()
+	promauto.With(Registry).NewGauge(prometheus.GaugeOpts{
+		Name:        "ecs_svc_proxy_build_info",
+		Help:        "Build information, always 1.",
+		ConstLabels: prometheus.Labels{"version": build.Version, "revision": build.Commit, "date": build.Date},
+	}).Set(1)
+}
+
+// MetricsHandler serves the Prometheus series.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// MetricsSink pushes the series of the registry somewhere they can't be
+// scraped from. Each flush covers the time since the previous one.
+type MetricsSink interface {
+	Flush() error
+}
+
+// RunSink flushes sink every interval until ctx is done.
+func RunSink(ctx context.Context, sink MetricsSink, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sink.Flush(); err != nil {
+				slog.Error("Failed to publish metrics", "error", err)
+			}
+		}
+	}
+}
+
+// Routing outcomes of the requests metric.
+const (
+	OutcomeHit            = "hit"
+	OutcomeMissRefreshHit = "miss-refresh-hit"
+	OutcomeCacheHit       = "cache-hit"
+	OutcomeNotFound       = "not-found"
+	OutcomeAmbiguous      = "ambiguous"
+	OutcomeNoBackend      = "no-backend"
+	OutcomeBackendError   = "backend-error"
+	OutcomeNotReady       = "not-ready"
+	OutcomeBadRequest     = "bad-request"
+	OutcomeForbidden      = "forbidden"
+	OutcomeUnauthorized   = "unauthorized"
+	OutcomeRateLimited    = "rate-limited"
+	OutcomeOverloaded     = "overloaded"
+	OutcomeMaintenance    = "maintenance"
+	// OutcomeMethodNotAllowed is a request using a method its org may not,
+	// see Config.AllowedMethods.
+	OutcomeMethodNotAllowed = "method-not-allowed"
+	// OutcomeAuthUnavailable is a request that couldn't be authenticated
+	// because STS couldn't be asked, see AuthModeSigV4.
+	OutcomeAuthUnavailable = "auth-unavailable"
+	// OutcomeDryRun is a request that was routed but answered with the
+	// routing decision, see Config.DryRun.
+	OutcomeDryRun = "dry-run"
+)
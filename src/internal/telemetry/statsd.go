@@ -0,0 +1,140 @@
+package telemetry
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdPacketSize is the most a datagram to the agent holds, which keeps it
+// within an Ethernet MTU.
+const statsdPacketSize = 1432
+
+// statsdTags renames labels to the tags Datadog dashboards expect.
+var statsdTags = map[string]string{"code": "status_class"}
+
+// StatsDSink sends the proxy's series of the Prometheus registry to a StatsD
+// agent in the DogStatsD format, with labels as tags. Counters are sent as
+// the increase since the previous flush, gauges as they are, and histograms
+// as their count and their p50 and p99 over the interval.
+//
+// Since the registry already aggregates requests, a flush sends one line per
+// series however many requests there were, batched in as few datagrams as
+// fit.
+type StatsDSink struct {
+	w        io.Writer
+	tags     []string
+	gatherer prometheus.Gatherer
+	cumulative
+}
+
+// NewStatsDSink returns a sink writing datagrams to w, typically a UDP
+// connection, adding the cluster tag to every line.
+func NewStatsDSink(w io.Writer, cluster string, gatherer prometheus.Gatherer) *StatsDSink {
+	return &StatsDSink{
+		w:          w,
+		tags:       []string{"cluster:" + cluster},
+		gatherer:   gatherer,
+		cumulative: newCumulative(),
+	}
+}
+
+// Flush sends the metrics accumulated since the previous flush.
+func (s *StatsDSink) Flush() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	batch := &statsdBatch{w: s.w}
+	for _, family := range families {
+		name := family.GetName()
+		// the Go runtime and process series are Prometheus specific
+		if !strings.HasPrefix(name, "ecs_svc_proxy_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := metricLabels(metric)
+			key := name + labelsKey(labels)
+			tags := s.tagsOf(labels)
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				if delta := s.delta(key, metric.GetCounter().GetValue()); delta > 0 {
+					batch.add(name, delta, "c", tags)
+				}
+			case dto.MetricType_GAUGE:
+				batch.add(name, metric.GetGauge().GetValue(), "g", tags)
+			case dto.MetricType_HISTOGRAM:
+				var h histogramDelta
+				s.addBuckets(key, &h, metric.GetHistogram())
+				count := h.buckets[len(h.buckets)-1]
+				if count == 0 {
+					continue
+				}
+				batch.add(name+".count", float64(count), "c", tags)
+				batch.add(name+".p50", quantile(0.5, h.bounds, h.buckets), "g", tags)
+				batch.add(name+".p99", quantile(0.99, h.bounds, h.buckets), "g", tags)
+			}
+		}
+	}
+	return batch.flush()
+}
+
+// tagsOf returns the tags of a series, the sink's own ones first.
+func (s *StatsDSink) tagsOf(labels map[string]string) []string {
+	tags := append([]string{}, s.tags...)
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if labels[name] == "" {
+			continue
+		}
+		tag := name
+		if renamed, ok := statsdTags[name]; ok {
+			tag = renamed
+		}
+		tags = append(tags, tag+":"+labels[name])
+	}
+	return tags
+}
+
+// statsdBatch packs lines into datagrams of up to statsdPacketSize bytes.
+type statsdBatch struct {
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+// add appends a name:value|type|#tags line, sending the datagram first if
+// the line doesn't fit in it anymore.
+func (b *statsdBatch) add(name string, value float64, kind string, tags []string) {
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	if len(b.buf) > 0 && len(b.buf)+1+len(line) > statsdPacketSize {
+		b.flush()
+	}
+	if len(b.buf) > 0 {
+		b.buf = append(b.buf, '\n')
+	}
+	b.buf = append(b.buf, line...)
+}
+
+// flush sends the pending datagram and returns the first error a send
+// failed with.
+func (b *statsdBatch) flush() error {
+	if len(b.buf) > 0 {
+		if _, err := b.w.Write(b.buf); err != nil && b.err == nil {
+			b.err = err
+		}
+		b.buf = b.buf[:0]
+	}
+	return b.err
+}
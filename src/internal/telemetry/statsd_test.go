@@ -0,0 +1,128 @@
+package telemetry
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// datagrams records each write as a datagram.
+type datagrams [][]byte
+
+func (d *datagrams) Write(b []byte) (int, error) {
+	*d = append(*d, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (d datagrams) lines() []string {
+	var lines []string
+	for _, datagram := range d {
+		lines = append(lines, strings.Split(string(datagram), "\n")...)
+	}
+	return lines
+}
+
+// listenUDP returns a connection to a UDP listener and a function flushing
+// the sink and returning the lines the listener received.
+func listenUDP(t *testing.T) (net.Conn, func(flush func() error) string) {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	receive := func(flush func() error) string {
+		t.Helper()
+		if err := flush(); err != nil {
+			t.Fatal(err)
+		}
+		var received datagrams
+		buf := make([]byte, 64<<10)
+		for {
+			listener.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			received.Write(buf[:n])
+		}
+		return strings.Join(received.lines(), "\n")
+	}
+	return conn, receive
+}
+
+func TestStatsDSink(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ecs_svc_proxy_requests_total"}, []string{"code", "outcome"})
+	routes := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ecs_svc_proxy_routes"}, []string{"table"})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "ecs_svc_proxy_request_duration_seconds", Buckets: []float64{0.1, 1}})
+	other := prometheus.NewCounter(prometheus.CounterOpts{Name: "go_other_total"})
+	registry.MustRegister(requests, routes, duration, other)
+
+	conn, receive := listenUDP(t)
+	sink := NewStatsDSink(conn, "tenants", registry)
+	requests.WithLabelValues("2xx", "routed").Add(3)
+	routes.WithLabelValues("primary").Set(7)
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	other.Inc()
+	got := receive(sink.Flush)
+	for _, want := range []string{
+		"ecs_svc_proxy_requests_total:3|c|#cluster:tenants,status_class:2xx,outcome:routed",
+		"ecs_svc_proxy_routes:7|g|#cluster:tenants,table:primary",
+		"ecs_svc_proxy_request_duration_seconds.count:2|c|#cluster:tenants",
+		"ecs_svc_proxy_request_duration_seconds.p50:0.1|g|#cluster:tenants",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("first flush lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "go_other_total") {
+		t.Errorf("first flush sent a series of another namespace:\n%s", got)
+	}
+
+	// counters and histograms are sent as their increase, and not at all
+	// without one
+	requests.WithLabelValues("2xx", "routed").Add(2)
+	got = receive(sink.Flush)
+	if !strings.Contains(got, "ecs_svc_proxy_requests_total:2|c|") {
+		t.Errorf("second flush didn't send the increase of 2:\n%s", got)
+	}
+	if strings.Contains(got, "request_duration_seconds") {
+		t.Errorf("second flush sent a histogram without observations:\n%s", got)
+	}
+}
+
+func TestStatsDBatch(t *testing.T) {
+	var sent datagrams
+	batch := &statsdBatch{w: &sent}
+	for i := 0; i < 100; i++ {
+		batch.add("ecs_svc_proxy_requests_total", 1, "c", []string{"cluster:tenants"})
+	}
+	if err := batch.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) < 2 {
+		t.Fatalf("%d datagrams sent, want the lines split over several", len(sent))
+	}
+	for _, datagram := range sent {
+		if len(datagram) > statsdPacketSize {
+			t.Errorf("datagram of %d bytes, more than %d", len(datagram), statsdPacketSize)
+		}
+		if bytes.HasSuffix(datagram, []byte("\n")) {
+			t.Error("datagram ends with a newline")
+		}
+	}
+	if n := len(sent.lines()); n != 100 {
+		t.Errorf("%d lines sent, want 100", n)
+	}
+}
@@ -0,0 +1,64 @@
+package telemetrytest
+
+import (
+	"testing"
+
+	"ecs-svc-proxy/src/internal/telemetry"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CounterValue returns the value of counter.
+func CounterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+// GaugeValue returns the value of gauge.
+func GaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+// AWSCallCounts returns the calls recorded for operation of service, by
+// outcome, and how many of them were timed.
+func AWSCallCounts(t *testing.T, service, operation string) (map[string]float64, uint64) {
+	t.Helper()
+	counts := map[string]float64{}
+	var timed uint64
+	for _, outcome := range []string{telemetry.AWSCallSuccess, telemetry.AWSCallThrottled, telemetry.AWSCallError} {
+		counts[outcome] = CounterValue(t, telemetry.AWSCalls.WithLabelValues(service, operation, outcome))
+		var metric dto.Metric
+		if err := telemetry.AWSCallDuration.WithLabelValues(service, operation, outcome).(prometheus.Histogram).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		timed += metric.GetHistogram().GetSampleCount()
+	}
+	return counts, timed
+}
+
+// CheckAWSCalls checks the calls recorded for operation of service since
+// before are want, by outcome, each of them timed.
+func CheckAWSCalls(t *testing.T, service, operation string, before map[string]float64, timedBefore uint64, want map[string]float64) {
+	t.Helper()
+	after, timed := AWSCallCounts(t, service, operation)
+	var total float64
+	for _, outcome := range []string{telemetry.AWSCallSuccess, telemetry.AWSCallThrottled, telemetry.AWSCallError} {
+		if n := after[outcome] - before[outcome]; n != want[outcome] {
+			t.Errorf("%s %s: %v calls with outcome %s, want %v", service, operation, n, outcome, want[outcome])
+		}
+		total += want[outcome]
+	}
+	if n := timed - timedBefore; float64(n) != total {
+		t.Errorf("%s %s: %d calls timed, want %v", service, operation, n, total)
+	}
+}
@@ -1,156 +1,631 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecs"
-	"github.com/gorilla/mux"
-)
-
-type ECSService struct {
-	Name string
-	IP   string
-}
+	"ecs-svc-proxy/src/buildinfo"
+	"ecs-svc-proxy/src/internal/config"
+	"ecs-svc-proxy/src/internal/discovery"
+	"ecs-svc-proxy/src/internal/proxy"
+	"ecs-svc-proxy/src/internal/telemetry"
 
-type Config struct {
-	AWSRegion         string
-	ECSCluster        string
-	ProxyPort         string
-	HeaderRoutingName string
-}
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
 
-func getEnv(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	} else if value == "" && defaultValue == "" {
-		panic(fmt.Errorf("missing mandatory env %s", key))
+func main() {
+	cmd, err := config.ParseFlags(os.Args[1:], os.Getenv("CONFIG_FILE"), os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if cmd.ShowVersion {
+		build := buildinfo.Get()
+		fmt.Printf("ecs-svc-proxy %s (commit %s, built %s, %s)\n", build.Version, build.Commit, build.Date, build.GoVersion)
+		return
+	}
+	// secrets are read with the default region unless their ARN names one,
+	// the AWS config of the proxy depends on the configuration
+	secrets := config.NewSecretResolver(func(region string) (config.SecretsAPI, error) {
+		cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(region))
+		if err != nil {
+			return nil, err
+		}
+		discovery.InstrumentAWS(&cfg)
+		return secretsmanager.NewFromConfig(cfg), nil
+	})
+	cfg, err := config.Load(cmd.Values, cmd.ConfigFile, secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	live := proxy.NewLiveConfig(cfg)
+	slog.SetDefault(proxy.NewLogger(os.Stderr, cfg.LogFormat, live.LogLevel()))
+	for _, key := range cfg.UnknownKeys {
+		slog.Warn("Ignoring unknown config file key", "key", key, "path", cmd.ConfigFile)
+	}
+	slog.Info("Configuration", cfg.LogAttrs()...)
+	telemetry.LogSamples = telemetry.NewLogSampler(cfg.LogSampleBurst, cfg.LogSampleWindow)
+	discovery.ECSRetryPolicy.Timeout = cfg.ECSAPITimeout
+	if cfg.TracingEnabled {
+		shutdownTracing, err := proxy.SetupTracing(context.Background(), cfg.TracingEndpoint)
+		if err != nil {
+			slog.Error("Failed to set up tracing", "error", err)
+			os.Exit(1)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				slog.Error("Failed to flush spans", "error", err)
+			}
+		}()
+	}
+	// the background work stops when a shutdown is requested
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if telemetry.LogSamples != nil {
+		go telemetry.LogSamples.Run(ctx)
 	}
-	return defaultValue
-}
 
-func LoadConfig() Config {
-	return Config{
-		AWSRegion:         getEnv("AWS_REGION", "us-west-2"),
-		ECSCluster:        getEnv("ECS_CLUSTER", ""),
-		ProxyPort:         getEnv("PROXY_PORT", "8080"),
-		HeaderRoutingName: getEnv("DEFAULT_ORG_ID", "X-Org-ID"),
+	// the default credential chain covers env, shared config and SSO
+	// profiles, web identity, and the ECS and EC2 (IMDSv2) metadata endpoints
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.AWSRegion))
+	if err != nil {
+		slog.Error("Failed to load AWS config", "error", err)
+		os.Exit(1)
 	}
-}
+	discovery.InstrumentAWS(&awsConfig)
+	build := buildinfo.Get()
+	slog.Info("Starting", "commit", build.Commit, "built", build.Date, "region", cfg.AWSRegion, "clusters", cfg.Clusters)
 
-func main() {
-	config := LoadConfig()
+	regionClient := discovery.RegionClients(awsConfig, cfg.ECSEndpointURL)
+	// static routes need no ECS client, config.Clusters is empty with them
+	var targets []discovery.ClusterTarget
+	for _, cluster := range cfg.Clusters {
+		targets = append(targets, discovery.ClusterTarget{
+			Client:  regionClient(cluster.Region),
+			Cluster: cluster.Cluster,
+			Region:  cluster.Region,
+		})
+	}
+	var factory discovery.ClientFactory = discovery.STSClientFactory{Config: awsConfig, STS: sts.NewFromConfig(awsConfig), Endpoint: cfg.ECSEndpointURL}
+	for _, role := range cfg.AssumeRoles {
+		slog.Info("Assuming role", "role", role.RoleARN, "cluster", role.Cluster, "account", role.Account)
+		targets = append(targets, discovery.ClusterTarget{
+			Client:  discovery.InstrumentECS(factory.ECSClient(role)),
+			Cluster: role.Cluster,
+			Region:  role.Region,
+			Account: role.Account,
+		})
+	}
 
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(config.AWSRegion),
+	opts := discovery.Options{
+		PrimaryDeploymentOnly: cfg.PrimaryDeploymentOnly,
+		TaskSets:              cfg.TaskSets,
+		TaskSelection:         cfg.TaskSelection,
+		PortLabel:             cfg.PortLabel,
+		PortNames:             cfg.PortNames,
+		DefaultPort:           cfg.DefaultPort,
+		AddressFamily:         cfg.AddressFamily,
+		RoutableCIDRs:         cfg.RoutableCIDRs,
+		Concurrency:           cfg.DiscoveryConcurrency,
+		ClusterStagger:        cfg.ClusterStagger,
+		Budget:                cfg.DiscoveryBudget,
+		ServiceCounts:         cfg.ServiceCounts,
+		ServiceRoles:          cfg.ServiceRoleTags,
+	}
+	audit, err := discovery.NewAuditLog(cfg.AuditLogPath)
+	if err != nil {
+		slog.Error("Failed to open audit log", "path", cfg.AuditLogPath, "error", err)
+		os.Exit(1)
+	}
+	// the certificate is checked before discovery so a bad one fails fast
+	var certs *proxy.CertReloader
+	if cfg.TLSCertFile != "" {
+		certs, err = proxy.NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			slog.Error("Failed to load the TLS certificate", "cert", cfg.TLSCertFile, "key", cfg.TLSKeyFile, "error", err)
+			os.Exit(1)
+		}
+		if cfg.TLSReloadInterval > 0 {
+			go certs.Run(ctx, cfg.TLSReloadInterval)
+		}
+	}
+	var backendCerts *proxy.BackendTLS
+	if cfg.BackendTLS || cfg.BackendTLSCertFile != "" || cfg.BackendTLSCAFile != "" {
+		backendCerts, err = proxy.NewBackendTLS(cfg.BackendTLSCertFile, cfg.BackendTLSKeyFile, cfg.BackendTLSCAFile, cfg.BackendTLSServerNames)
+		if err != nil {
+			slog.Error("Failed to load the backend TLS files", "cert", cfg.BackendTLSCertFile, "key", cfg.BackendTLSKeyFile, "ca", cfg.BackendTLSCAFile, "error", err)
+			os.Exit(1)
+		}
+		if cfg.TLSReloadInterval > 0 {
+			go backendCerts.Run(ctx, cfg.TLSReloadInterval)
+		}
+	}
+	var clientCAs *proxy.CABundle
+	if cfg.ClientAuth != config.ClientAuthNone {
+		clientCAs, err = proxy.NewCABundle(cfg.ClientCAFile)
+		if err != nil {
+			slog.Error("Failed to load the client CA bundle", "ca", cfg.ClientCAFile, "error", err)
+			os.Exit(1)
+		}
+		if cfg.TLSReloadInterval > 0 {
+			go clientCAs.Run(ctx, cfg.TLSReloadInterval)
+		}
+	}
+	var keys *proxy.APIKeys
+	if cfg.APIKeysFile != "" || cfg.APIKeys != "" {
+		source, load := cfg.APIKeysFile, proxy.APIKeysFile(cfg.APIKeysFile)
+		if cfg.APIKeys != "" {
+			source, load = "API_KEYS", proxy.APIKeysValue(live.APIKeys)
+		}
+		keys, err = proxy.NewAPIKeys(ctx, source, load)
+		if err != nil {
+			slog.Error("Failed to load the API keys", "source", source, "error", err)
+			os.Exit(1)
+		}
+		if cfg.APIKeysReloadInterval > 0 {
+			go keys.Run(ctx, cfg.APIKeysReloadInterval)
+		}
+	}
+	var acmeManager *autocert.Manager
+	if len(cfg.ACMEDomains) > 0 {
+		cache := proxy.NewACMECache(cfg.ACMECache, func() proxy.S3API {
+			return s3.NewFromConfig(awsConfig)
+		})
+		acmeManager = proxy.NewACMEManager(cfg.ACMEDomains, cfg.ACMEEmail, cfg.ACMEDirectoryURL, cache)
+	}
+	// on SIGHUP the audit log is reopened so it can be rotated, the
+	// certificate read again if it changed, and the configuration reloaded
+	reload := proxy.NewReloader(cfg, live, func() (config.Config, error) {
+		return config.Load(cmd.Values, cmd.ConfigFile, secrets)
+	})
+	if cfg.SecretsRefreshInterval > 0 {
+		go secrets.Run(ctx, cfg.SecretsRefreshInterval, func() {
+			reload.Reload()
+			if keys != nil {
+				keys.ReloadAndLog(ctx)
+			}
+		})
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := audit.Reopen(); err != nil {
+				slog.Error("Failed to reopen audit log", "path", cfg.AuditLogPath, "error", err)
+			}
+			if certs != nil {
+				certs.ReloadAndLog()
+			}
+			if backendCerts != nil {
+				backendCerts.ReloadAndLog()
+			}
+			if clientCAs != nil {
+				clientCAs.ReloadAndLog()
+			}
+			secrets.RefreshAndLog()
+			reload.Reload()
+			// after the reload, which applies a rotated API_KEYS
+			if keys != nil {
+				keys.ReloadAndLog(ctx)
+			}
+		}
+	}()
+	routes := discovery.NewRouteTable(nil, discovery.NewNegativeCache(cfg.NegativeTTL, cfg.NegativeCacheSize), cfg.LBStrategy)
+	routes.SetAudit(audit, "primary")
+	routes.SetAmbiguity(cfg.AmbiguousMatch, cfg.AmbiguousMatchPriority, cfg.ConfiguredOrgs())
+	live.OnOrgTargets(func(targets map[string]config.OrgTarget) {
+		routes.SetTargetContainers(discovery.OrgContainers(targets))
+	})
+	// connections to backends that leave the table are closed
+	transports := proxy.NewBackendTransports(backendCerts)
+	routes.OnRemove(transports.Drain)
+	routes.SetEjection(cfg.EjectFailures, cfg.EjectWindow, cfg.EjectCooldown)
+	routes.SetBreakers(cfg.BreakerFailures, cfg.BreakerOpenTimeout)
+	expvar.Publish("breakers", expvar.Func(func() any {
+		return routes.Breakers.States()
 	}))
-	log.Printf("AWS Region: %s cluster %s", config.AWSRegion, config.ECSCluster)
-
-	ecsClient := ecs.New(sess)
-	cluster := config.ECSCluster
-
-	serviceDetails := buildServiceDetails(ecsClient, cluster)
-	log.Printf("service details %v", serviceDetails)
-
-	r := mux.NewRouter()
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		orgID := r.Header.Get(config.HeaderRoutingName)
-		if orgID == "" {
-			err := fmt.Errorf("missing required header %s", config.HeaderRoutingName)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
-
-		serviceIP, ok := getServiceDetail(orgID, serviceDetails)
-		if !ok {
-			// try sync with the cluster
-			serviceDetails = buildServiceDetails(ecsClient, cluster)
-			serviceIP, ok = getServiceDetail(orgID, serviceDetails)
-			if !ok {
-				http.Error(w, "Service not found for Org-ID", http.StatusNotFound)
-				return
+	routes.SetOutliers(cfg.OutlierMultiplier, cfg.OutlierMinSamples, cfg.OutlierEjectFor)
+	routes.SetECSHealth(cfg.ECSHealth, cfg.ECSHealthUnknown == config.ECSHealthUnknownInclude)
+	expvar.Publish("latency_outliers", expvar.Func(func() any {
+		return routes.Outliers.Ejected()
+	}))
+	if cfg.AZAffinity == config.AZAffinityPrefer {
+		zone := cfg.AvailabilityZone
+		if zone == "" {
+			detectCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			zone, err = discovery.DetectZone(detectCtx)
+			cancel()
+			if err != nil {
+				slog.Warn("Failed to detect the availability zone, backends are picked in every zone", "error", err)
 			}
 		}
+		if zone != "" {
+			slog.Info("Preferring backends in the proxy's availability zone", "zone", zone)
+			routes.SetZone(zone)
+		}
+	}
+	var checker *discovery.HealthChecker
+	if cfg.HealthCheckInterval > 0 {
+		checker = discovery.NewHealthChecker(routes, cfg.HealthCheckPath, cfg.HealthCheckTimeout, cfg.HealthCheckConcurrency, cfg.BackendAllowedCIDRs)
+		routes.SetHealthChecked(checker.Changed)
+	}
+	slog.Info("Routing", "task_selection", opts.TaskSelection, "lb_strategy", cfg.LBStrategy, "mode", cfg.ProxyMode)
 
-		http.Redirect(w, r, fmt.Sprintf("http://%s", serviceIP), http.StatusTemporaryRedirect)
-	})
+	refresher := discovery.NewRefresher(targets, opts, routes, cfg.RefreshMinInterval)
+	// the deep health check reports a loop stopped before shutdown
+	loops := discovery.NewBackgroundLoops()
+	if cfg.DiscoveryMode == config.DiscoveryModeStatic {
+		static := discovery.NewStaticRoutes(cfg.StaticRoutes)
+		slog.Info("Reading static routes instead of discovering ECS services", "source", static.Path)
+		refresher.SetStatic(static)
+		loops.Go("static-routes", func() { static.Run(ctx, refresher.Refresh) })
+	}
+	refresher.SetStaleness(cfg.RoutesFreshTTL, cfg.RoutesMaxAge)
+	refresher.SetJitter(cfg.RefreshJitterPercent, cfg.RefreshInitialDelay)
+	if cfg.RouteStore == config.RouteStoreRedis {
+		slog.Info("Sharing routes through the route store", "address", cfg.RouteStoreAddr, "key", cfg.RouteStoreKey)
+		store := discovery.NewRESPClient(cfg.RouteStoreAddr, cfg.RouteStorePassword, 5*time.Second)
+		refresher.SetShared(ctx, discovery.NewSharedRoutes(store, cfg.RouteStoreKey, cfg.RouteStoreLeaseTTL, cfg.RouteStoreMaxStaleness))
+	}
+	discovery.RegisterRouteTable("primary", routes)
+	expvar.Publish("routes_age_seconds", expvar.Func(func() any {
+		if builtAt := routes.BuiltAt(); !builtAt.IsZero() {
+			return time.Since(builtAt).Seconds()
+		}
+		return nil
+	}))
+	expvar.Publish("routes_state", expvar.Func(func() any {
+		return refresher.State()
+	}))
 
-	http.ListenAndServe(":"+config.ProxyPort, r)
-}
+	overrides := discovery.NewRouteOverrides(cfg.BackendAllowedCIDRs)
+	go discovery.LogRoutesOnSignal(ctx, routes, overrides, cfg.RoutesLogRedactIPs)
+	if cfg.SnapshotPath != "" {
+		refresher.SetSnapshotPath(cfg.SnapshotPath, overrides)
+		overrides.OnChange(refresher.SaveSnapshot)
+		snapshot, err := discovery.LoadSnapshot(cfg.SnapshotPath, cfg.SnapshotMaxAge)
+		// overrides outlive a snapshot too old to route with
+		overrides.Restore(snapshot.Overrides)
+		if err == nil {
+			slog.Info("Restored route snapshot", "routes", len(snapshot.Services), "built_at", snapshot.BuiltAt, "path", cfg.SnapshotPath)
+			routes.Restore(snapshot.Services, snapshot.BuiltAt)
+			go refresher.Refresh(ctx, discovery.TriggerStartup)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Ignoring route snapshot", "path", cfg.SnapshotPath, "error", err)
+		}
+	}
 
-func listServices(ecsClient *ecs.ECS, cluster string) ([]*string, error) {
-	resp, err := ecsClient.ListServices(&ecs.ListServicesInput{
-		Cluster: aws.String(cluster),
-	})
-	if err != nil {
-		return nil, err
+	// when starting degraded requests get a 503 until routes exist
+	if cfg.StartupMode == config.StartupModeDegraded {
+		go refresher.WarmUp(ctx, 0)
+	} else if err := refresher.WarmUp(ctx, cfg.StartupTimeout); err != nil {
+		slog.Error("Failed to discover services", "error", err)
+		os.Exit(1)
+	}
+	if cfg.RefreshInterval > 0 {
+		slog.Info("Refreshing routes in the background", "interval", cfg.RefreshInterval)
+		loops.Go("refresh", func() { refresher.Run(ctx, cfg.RefreshInterval) })
+	}
+
+	if cfg.EventsQueueURL != "" {
+		consumer := &discovery.EventConsumer{
+			Client:     sqs.NewFromConfig(awsConfig),
+			QueueURL:   cfg.EventsQueueURL,
+			Targets:    targets,
+			Opts:       opts,
+			Routes:     routes,
+			Refresh:    refresher.RefreshSoon,
+			RetryDelay: 5 * time.Second,
+		}
+		loops.Go("events", func() { consumer.Run(ctx) })
 	}
-	return resp.ServiceArns, nil
-}
 
-func listTasks(ecsClient *ecs.ECS, cluster string) ([]*string, error) {
-	var tasks []*string
-	resp, err := ecsClient.ListTasks(&ecs.ListTasksInput{
-		Cluster: aws.String(cluster),
+	// the standby is discovered in the background and never delays startup
+	var standby *discovery.RouteTable
+	if cfg.SecondaryCluster != nil {
+		slog.Info("Failing over to a secondary cluster", "cluster", cfg.SecondaryCluster.Cluster, "region", cfg.SecondaryCluster.Region, "sticky", cfg.FailoverSticky)
+		standby = discovery.NewRouteTable(nil, nil, cfg.LBStrategy)
+		standby.OnRemove(transports.Drain)
+		standby.SetAudit(audit, "standby")
+		standby.SetAmbiguity(cfg.AmbiguousMatch, cfg.AmbiguousMatchPriority, cfg.ConfiguredOrgs())
+		live.OnOrgTargets(func(targets map[string]config.OrgTarget) {
+			standby.SetTargetContainers(discovery.OrgContainers(targets))
+		})
+		standby.SetECSHealth(cfg.ECSHealth, cfg.ECSHealthUnknown == config.ECSHealthUnknownInclude)
+		standbyRefresher := discovery.NewRefresher([]discovery.ClusterTarget{{
+			Client:  regionClient(cfg.SecondaryCluster.Region),
+			Cluster: cfg.SecondaryCluster.Cluster,
+			Region:  cfg.SecondaryCluster.Region,
+		}}, opts, standby, cfg.RefreshMinInterval)
+		standbyRefresher.SetJitter(cfg.RefreshJitterPercent, cfg.RefreshInitialDelay)
+		standbyRefresher.SetName("standby")
+		discovery.RegisterRouteTable("standby", standby)
+		go standbyRefresher.WarmUp(ctx, 0)
+		if cfg.RefreshInterval > 0 {
+			loops.Go("standby-refresh", func() { standbyRefresher.Run(ctx, cfg.RefreshInterval) })
+		}
+	}
+	lookup := discovery.NewFailoverRoutes(overrides, routes, standby, cfg.FailoverSticky)
+
+	if checker != nil {
+		// backends only get traffic once they passed a check
+		checker.CheckAll(ctx)
+		loops.Go("health-checks", func() { checker.Run(ctx, cfg.HealthCheckInterval) })
+	}
+
+	orgs := proxy.NewOrgLabels(cfg.OrgMetricsMax)
+	budget := proxy.NewRetryBudget(cfg.RetryBudgetPercent, cfg.RetryBudgetWindow)
+	expvar.Publish("retry_budget_used_percent", expvar.Func(func() any {
+		return budget.Usage()
+	}))
+	forwarder := proxy.NewForwarder(&proxy.RetryTransport{
+		Next: &proxy.TracingTransport{Next: &discovery.BreakerTransport{
+			Next:     &proxy.LatencyTransport{Next: transports, Outliers: routes.Outliers, Orgs: orgs},
+			Breakers: routes.Breakers,
+		}},
+		Retries: cfg.UpstreamRetries,
+		Budget:  budget,
+		Failed:  routes.ReportFailure,
+	}, routes.ReportFailure, live.RetryAfter, proxy.ResponseRewriter{
+		Location:     cfg.RewriteLocation,
+		CookieDomain: cfg.RewriteCookieDomain,
+		Headers:      live.ResponseHeaders,
+		BackendTask:  cfg.BackendTaskHeader,
 	})
-	if err != nil {
-		return nil, err
+	var draining atomic.Bool
+	var limiter proxy.RateLimiter
+	if cfg.RateLimit.Rate > 0 {
+		limiter = proxy.NewLocalRateLimiter(cfg.RateLimit, cfg.RateLimitOrgs, cfg.RateLimitMaxOrgs)
+	}
+	var concurrency *proxy.OrgConcurrencyLimiter
+	if cfg.OrgMaxConcurrent > 0 {
+		concurrency = proxy.NewOrgConcurrencyLimiter(cfg.OrgMaxConcurrent, cfg.OrgMaxConcurrentOrgs, cfg.OrgConcurrencyQueueTimeout, cfg.RateLimitMaxOrgs)
+	}
+	// the admin token also unlocks the debug headers of routed requests
+	adminToken := cfg.AdminToken
+	var wake *discovery.Waker
+	if cfg.EnableWake {
+		wake = discovery.NewWaker(targets, routes, cfg.WakeServices, cfg.WakeDesiredCount, cfg.WakeInterval)
+	}
+	var cache *proxy.ResponseCache
+	if cfg.ResponseCache {
+		cache = proxy.NewResponseCache(cfg.ResponseCacheMaxBytes, cfg.ResponseCacheMaxEntry)
+	}
+	var held *proxy.MissWait
+	if cfg.MissWait {
+		held = proxy.NewMissWait(cfg.MissWaitTimeout, cfg.MissWaitMaxWaiters)
+	}
+	var proxied http.Handler = &proxy.Handler{
+		Config:    cfg,
+		Live:      live,
+		Routes:    routes,
+		Lookup:    lookup,
+		Refresher: refresher,
+		Keys:      keys,
+		Limiter:   limiter,
+		Orgs:      orgs,
+		InFlight:  concurrency,
+		Debug:     proxy.NewDebugTargets(adminToken),
+		Forwarder: forwarder,
+		Mirror:    proxy.NewMirror(cfg.Mirrors, routes, cfg.BackendAllowedCIDRs, cfg.MirrorTimeout, cfg.MirrorMaxBody),
+		Waker:     wake,
+		MissWait:  held,
+		Cache:     cache,
+	}
+	// only routed requests need a token, health checks and operator
+	// endpoints have their own routes
+	if cfg.JWKSURL != "" {
+		set := proxy.NewJWKS(cfg.JWKSURL, cfg.JWKSTTL)
+		if err := set.Refresh(ctx); err != nil {
+			slog.Error("Failed to fetch the JWKS, retrying on the first token", "url", cfg.JWKSURL, "error", err)
+		}
+		proxied = proxy.RequireJWT(proxied, proxy.NewJWTVerifier(set, cfg.JWTIssuers, cfg.JWTAudiences, cfg.JWTClockSkew))
+	}
+	if cfg.AuthMode == config.AuthModeSigV4 {
+		proxied = proxy.RequireSigV4(proxied, proxy.NewSigV4Verifier(cfg.SigV4Audience, cfg.SigV4ClockSkew), cfg.SigV4Header)
+	}
+	if cfg.SlowRequestThreshold > 0 {
+		proxied = proxy.LogSlowRequests(proxied, cfg.SlowRequestThreshold)
+	}
+	// health checks and operator endpoints have their own routes and stay
+	// answered when the proxy is saturated
+	if cfg.MaxConcurrentRequests > 0 {
+		proxied = proxy.LimitConcurrency(proxied, cfg.MaxConcurrentRequests, cfg.ConcurrencyQueueTimeout, live.RetryAfter)
+	}
+	ready := proxy.Readiness{
+		Routes:      routes,
+		Refresher:   refresher,
+		MaxFailures: cfg.ReadyMaxFailures,
+		AllowEmpty:  cfg.ReadyAllowEmpty,
+		Draining:    &draining,
+	}
+	var routed http.Handler = proxy.NewRouter(cfg, ready, proxy.InstrumentRequests(orgs, proxy.TraceRequests(proxied)))
+	if len(cfg.AllowCIDRs) > 0 || len(cfg.DenyCIDRs) > 0 {
+		filter := &proxy.IPFilter{Allow: cfg.AllowCIDRs, Deny: cfg.DenyCIDRs}
+		if cfg.IPFilterExemptHealth {
+			filter.Exempt = []string{cfg.HealthzPath, cfg.ReadyzPath}
+		}
+		routed = filter.Wrap(routed)
 	}
-	tasks = append(tasks, resp.TaskArns...)
-	return tasks, nil
-}
 
-func buildServiceDetails(ecsClient *ecs.ECS, cluster string) []ECSService {
-	services, err := listServices(ecsClient, cluster)
-	if err != nil {
-		log.Fatalf("Failed to list services: %v", err)
+	// panics are recovered inside the access log so they are logged as 500s
+	handler := proxy.RecoverPanics(routed, cfg.HeaderRoutingName)
+	if cfg.AccessLog != config.AccessLogOff {
+		level := slog.LevelInfo
+		if cfg.AccessLog == config.AccessLogDebug {
+			level = slog.LevelDebug
+		}
+		handler = proxy.AccessLog(handler, cfg.HeaderRoutingName, level)
 	}
-	log.Printf("services %v", services)
+	handler = proxy.WithTraceHeaders(handler, cfg.TraceHeaders, cfg.AmznTraceID)
+	handler = proxy.WithRequestID(handler, cfg.RequestIDHeader)
+	if len(cfg.SecurityHeaders) > 0 {
+		handler = proxy.WithSecurityHeaders(handler, cfg.SecurityHeaders)
+	}
+	handler = proxy.WithClientIdentity(handler)
+	// outermost, so every layer sees the client behind trusted proxies
+	handler = proxy.WithClientAddr(handler, cfg.TrustedProxies)
 
-	tasks, err := listTasks(ecsClient, cluster)
-	if err != nil {
-		log.Fatalf("Failed to list tasks: %v", err)
+	var sink telemetry.MetricsSink
+	switch cfg.MetricsSink {
+	case config.MetricsSinkCloudWatch:
+		sink = telemetry.NewEMFSink(os.Stdout, cfg.MetricsNamespace, cfg.ECSCluster, telemetry.Registry)
+	case config.MetricsSinkStatsD:
+		// UDP, so this only fails on a malformed address
+		conn, err := net.Dial("udp", cfg.StatsDAddr)
+		if err != nil {
+			slog.Error("Failed to reach StatsD agent", "address", cfg.StatsDAddr, "error", err)
+			os.Exit(1)
+		}
+		defer conn.Close()
+		sink = telemetry.NewStatsDSink(conn, cfg.ECSCluster, telemetry.Registry)
+	}
+	if sink != nil {
+		go telemetry.RunSink(ctx, sink, cfg.MetricsInterval)
 	}
-	log.Printf("tasks %v", tasks)
 
-	return getServiceDetails(ecsClient, cluster, tasks)
-}
-func getServiceDetails(ecsClient *ecs.ECS, cluster string, tasks []*string) []ECSService {
-	serviceDetails := []ECSService{}
-	for _, taskArn := range tasks {
-		taskDetail, err := ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
-			Cluster: aws.String(cluster),
-			Tasks:   []*string{taskArn},
-		})
+	// every address is bound before the proxy listener serves, so a wrong
+	// one fails the startup
+	addr := net.JoinHostPort(cfg.BindAddr, strconv.Itoa(cfg.ProxyPort))
+	if cfg.ProxyListen != "" {
+		addr = cfg.ProxyListen
+	}
+	listener, err := proxy.Listen(addr, cfg.SocketMode)
+	if err != nil {
+		slog.Error("Failed to listen", "address", addr, "error", err)
+		os.Exit(1)
+	}
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = proxy.NewTLSConfig(certs.GetCertificate, cfg.TLSMinVersion, cfg.TLSCipherSuites)
+	} else if acmeManager != nil {
+		// TLS-ALPN challenges are answered during the handshake
+		tlsConfig = proxy.NewTLSConfig(acmeManager.GetCertificate, cfg.TLSMinVersion, cfg.TLSCipherSuites, "http/1.1", acme.ALPNProto)
+	}
+	if clientCAs != nil {
+		proxy.SetClientAuth(tlsConfig, cfg.ClientAuth, clientCAs)
+	}
+	if tlsConfig != nil {
+		// without a TLS port the proxy port terminates TLS itself
+		if cfg.TLSPort == 0 {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+	}
+	var tlsServer *http.Server
+	tlsAddr := ""
+	if cfg.TLSPort != 0 {
+		tlsAddr = net.JoinHostPort(cfg.BindAddr, strconv.Itoa(cfg.TLSPort))
+		tlsListener, err := net.Listen("tcp", tlsAddr)
 		if err != nil {
-			log.Printf("Failed to describe task: %v", err)
-			continue
-		}
-
-		for _, task := range taskDetail.Tasks {
-			for _, container := range task.Containers {
-				for _, network := range container.NetworkInterfaces {
-					serviceDetails = append(serviceDetails, ECSService{
-						Name: *container.Name,
-						IP:   *network.PrivateIpv4Address,
-					})
-				}
+			slog.Error("Failed to listen for TLS", "address", tlsAddr, "error", err)
+			os.Exit(1)
+		}
+		tlsServer = proxy.NewServer(handler, cfg)
+		go func() {
+			// the TLS listener serves the same routes as the plain one
+			if err := tlsServer.Serve(tls.NewListener(tlsListener, tlsConfig)); err != http.ErrServerClosed {
+				slog.Error("TLS server stopped", "error", err)
+				os.Exit(1)
 			}
+		}()
+		if cfg.RedirectToTLS {
+			handler = proxy.RedirectToTLS(handler, cfg.TLSPort, cfg.HealthzPath, cfg.ReadyzPath)
+		}
+		// HTTP-01 challenges are answered ahead of routing, which would
+		// turn them down for their missing org header
+		if acmeManager != nil {
+			handler = acmeManager.HTTPHandler(handler)
 		}
 	}
-	return serviceDetails
-}
+	server := proxy.NewServer(handler, cfg)
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		adminListener, err := net.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			slog.Error("Failed to listen for the admin endpoints", "address", cfg.AdminAddr, "error", err)
+			os.Exit(1)
+		}
+		deep := proxy.DeepHealth{
+			Targets:      targets,
+			Routes:       routes,
+			Refresher:    refresher,
+			Loops:        loops,
+			Draining:     &draining,
+			Timeout:      cfg.DeepHealthTimeout,
+			StaleAfter:   cfg.DeepHealthStaleAfter,
+			MaxStaleness: cfg.DeepHealthMaxStaleness,
+		}
+		adminServer = proxy.NewServer(proxy.NewAdminHandler(cfg.MetricsPath, routes, refresher, overrides, live.Maintenance(), cfg.EnablePprof, adminToken, cfg.AdminRefreshTimeout, deep), cfg)
+		go func() {
+			if err := adminServer.Serve(adminListener); err != http.ErrServerClosed {
+				slog.Error("Admin server stopped", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		// fail readiness first so load balancers stop sending new requests
+		draining.Store(true)
+		slog.Info("Shutting down, draining requests", "timeout", live.ShutdownDelay()+live.ShutdownTimeout())
+		time.Sleep(live.ShutdownDelay())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), live.ShutdownTimeout())
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if tlsServer != nil {
+			if tlsErr := tlsServer.Shutdown(shutdownCtx); err == nil {
+				err = tlsErr
+			}
+		}
+		// the admin endpoints stay up while requests drain
+		if adminServer != nil {
+			adminServer.Shutdown(shutdownCtx)
+		}
+		shutdown <- err
+	}()
 
-func getServiceDetail(orgID string, services []ECSService) (string, bool) {
-	for _, svc := range services {
-		if strings.Contains(svc.Name, orgID) {
-			return svc.IP, true
+	slog.Info("Listening", "address", addr, "tls", tlsAddr, "admin", cfg.AdminAddr)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+	shutdownErr := <-shutdown
+	// the requests drained during shutdown are published too
+	if sink != nil {
+		if err := sink.Flush(); err != nil {
+			slog.Error("Failed to publish metrics", "error", err)
 		}
 	}
-	log.Printf("Service not found for Org-ID %s", orgID)
-	return "", false
+	if shutdownErr != nil {
+		slog.Error("Requests still in flight", "timeout", live.ShutdownTimeout(), "error", shutdownErr)
+		os.Exit(1)
+	}
+	slog.Info("Server stopped")
 }